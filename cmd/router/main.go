@@ -1,62 +1,290 @@
 package main
 
 import (
+    "context"
+    "crypto/tls"
     "flag"
     "fmt"
-    "log"
     "os"
     "os/signal"
     "syscall"
+    "time"
     
+    "github.com/asterisk-call-routing-v2/internal/agi"
+    "github.com/asterisk-call-routing-v2/internal/ami"
     "github.com/asterisk-call-routing-v2/internal/api"
+    "github.com/asterisk-call-routing-v2/internal/ari"
+    "github.com/asterisk-call-routing-v2/internal/config"
+    "github.com/asterisk-call-routing-v2/internal/jwt"
+    "github.com/asterisk-call-routing-v2/internal/lifecycle"
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/redis"
     "github.com/asterisk-call-routing-v2/internal/router"
 )
 
+var logger = logging.New("main")
+
+// fatalf logs at error level, which no log level hides, and exits
+func fatalf(format string, args ...interface{}) {
+    logger.Errorf(format, args...)
+    os.Exit(1)
+}
+
 func main() {
-    var (
-        httpPort = flag.Int("port", 8001, "HTTP server port")
-        dbHost   = flag.String("dbhost", "localhost", "MySQL host")
-        dbPort   = flag.Int("dbport", 3306, "MySQL port")
-        dbUser   = flag.String("dbuser", "root", "MySQL user")
-        dbPass   = flag.String("dbpass", "temppass", "MySQL password")
-        dbName   = flag.String("dbname", "call_routing", "MySQL database name")
-    )
+    cfg := config.Default()
+    configPath := flag.String("config", "", "YAML config file; environment variables (S2_<SECTION>_<KEY>) and flags override it")
+    // Release soak testing only, so left out of -help and the config file
+    soak := flag.Duration("soak", 0, "Verify invariants this often under load and halt with a dump on the first violation")
+    soakDump := flag.String("soak-dump", "", "File the soak dump is written to (default in the temp dir)")
+    hidden := map[string]bool{"soak": true, "soak-dump": true}
+    cfg.RegisterFlags(flag.CommandLine)
+    flag.Usage = func() {
+        visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+        visible.SetOutput(flag.CommandLine.Output())
+        flag.VisitAll(func(f *flag.Flag) {
+            if !hidden[f.Name] {
+                visible.Var(f.Value, f.Name, f.Usage)
+            }
+        })
+        fmt.Fprintf(visible.Output(), "Usage of %s:\n", os.Args[0])
+        visible.PrintDefaults()
+    }
     flag.Parse()
+    if err := cfg.Load(*configPath, flag.CommandLine); err != nil {
+        fatalf("Failed to load configuration: %v", err)
+    }
     
     // Setup logging
-    log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-    log.Printf("Starting S2 Dynamic Call Router v2...")
+    level, err := logging.ParseLevel(cfg.Logging.Level)
+    if err != nil {
+        fatalf("Failed to load configuration: %v", err)
+    }
+    if cfg.Logging.Format != "text" && cfg.Logging.Format != "json" {
+        fatalf("Failed to load configuration: invalid log format %q (text or json)", cfg.Logging.Format)
+    }
+    logging.Configure(os.Stderr, level, cfg.Logging.Format == "json")
+    logging.RedirectStdlib()
+    logger.Infof("Starting S2 Dynamic Call Router v2...")
     
-    // Build DSN
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true",
-        *dbUser, *dbPass, *dbHost, *dbPort, *dbName)
+    var replicationTLS *tls.Config
+    if cfg.Replication.TLS {
+        replicationTLS, err = api.PeerTLS(cfg.HTTP.TLSCert, cfg.HTTP.TLSKey, cfg.HTTP.TLSClientCA, cfg.HTTP.TLSClientCNs)
+        if err != nil {
+            fatalf("Invalid replication.tls: %v", err)
+        }
+    }
     
     // Initialize router
-    r, err := router.NewRouter(dsn)
+    r, err := router.NewRouter(cfg.DSN(), router.Config{
+        StorageDriver:          cfg.Database.Driver,
+        QueryTimeout:           cfg.Database.QueryTimeout,
+        SchemaCheckInterval:    cfg.Database.SchemaCheckInterval,
+        SchemaRepair:           cfg.Database.SchemaRepair,
+        WriteRetryMaxAge:       cfg.Database.WriteRetryMaxAge,
+        WriteReportFile:        cfg.Database.WriteReportFile,
+        DBBreakerFailures:      cfg.Database.BreakerFailures,
+        DBReconnectMaxBackoff:  cfg.Database.ReconnectMaxBackoff,
+        DegradedMode:           cfg.Database.DegradedMode,
+        WriteRetryLimit:        cfg.Database.WriteRetryLimit,
+        WriteBehindWorkers:     cfg.Database.WriteBehindWorkers,
+        WriteBehindBuffer:      cfg.Database.WriteBehindBuffer,
+        WriteBatchInterval:     cfg.Database.WriteBatchInterval,
+        ForwardTrunk:           cfg.Routing.ForwardTrunk,
+        ReturnTrunk:            cfg.Routing.ReturnTrunk,
+        RecordingPath:          cfg.Routing.RecordingPath,
+        RecordingQuota:         int64(cfg.Recordings.QuotaMB) << 20,
+        RecordingFullAction:    cfg.Recordings.FullAction,
+        RecordingInterval:      cfg.Recordings.Interval,
+        RecordingMetadata:      cfg.Recordings.Metadata,
+        WebhookURLs:            cfg.Webhooks.URLs,
+        WebhookMaxAttempts:     cfg.Webhooks.Attempts,
+        DedupWindow:            cfg.Routing.DedupWindow,
+        TokenMode:              cfg.Routing.TokenMode,
+        TokenDigits:            cfg.Routing.TokenDigits,
+        StatelessKey:           cfg.Routing.StatelessKey,
+        AnomalyThreshold:       cfg.Routing.AnomalyThreshold,
+        ReadOnly:               cfg.Routing.ReadOnly,
+        ReputationTrunk:        cfg.Reputation.Trunk,
+        ReputationThreshold:    cfg.Reputation.Threshold,
+        ExportDir:              cfg.Exports.Dir,
+        ExportRetention:        cfg.Exports.Retention,
+        StatsInterval:          cfg.Stats.Interval,
+        StatsRetention:         cfg.Stats.Retention,
+        ArchiveAfter:           time.Duration(cfg.Archive.AfterDays) * 24 * time.Hour,
+        ArchiveRetention:       time.Duration(cfg.Archive.RetentionDays) * 24 * time.Hour,
+        ArchiveInterval:        cfg.Archive.Interval,
+        ArchiveBatch:           cfg.Archive.Batch,
+        TraceEndpoint:          cfg.Tracing.Endpoint,
+        CallIDGenerator:        cfg.Routing.CallIDGenerator,
+        NodeID:                 cfg.Routing.NodeID,
+        InputNormalization:     cfg.Routing.InputNormalization,
+        E164Mode:               cfg.Routing.E164Mode,
+        E164HomeCountry:        cfg.Routing.E164HomeCountry,
+        NumberingRules:         cfg.Routing.NumberingRules,
+        DIDSelection:           cfg.Routing.DIDSelection,
+        DIDSelectionPools:      cfg.Routing.DIDSelectionPools,
+        NumberFormats:          cfg.Routing.NumberFormats,
+        DIDCooldown:            cfg.Routing.DIDCooldown,
+        DIDWait:                cfg.Routing.DIDWait,
+        Overflow:               cfg.Routing.Overflow,
+        OverflowTarget:         cfg.Routing.OverflowTarget,
+        PoolPrefixes:           cfg.Routing.PoolPrefixes,
+        CountryPrefixes:        cfg.Routing.CountryPrefixes,
+        CountryFromNumberPlan:  cfg.Routing.CountryFromNumberPlan,
+        StateReloadLookback:    cfg.Routing.StateReloadLookback,
+        SoakCheck:              *soak,
+        SoakDumpFile:           *soakDump,
+        ANIMismatchMode:        cfg.Routing.ANIMismatch,
+        ANIMismatchQuarantine:  cfg.Routing.ANIMismatchQuarantine,
+        S1Partitions:           cfg.Routing.S1Partitions,
+        MaxCallDuration:        cfg.Routing.MaxCallDuration,
+        MaxConcurrentCalls:     cfg.Routing.MaxConcurrentCalls,
+        MaxCPS:                 cfg.Routing.MaxCPS,
+        CPSBurst:               cfg.Routing.CPSBurst,
+        HideCost:               cfg.Routing.HideCost,
+        ProvisioningURL:        cfg.Provisioning.URL,
+        ProvisioningThreshold:  cfg.Provisioning.Threshold,
+        ProvisioningSustain:    cfg.Provisioning.Sustain,
+        ProvisioningBatch:      cfg.Provisioning.Batch,
+        ProvisioningBudgetDIDs: cfg.Provisioning.BudgetDIDs,
+        ProvisioningBudgetCost: cfg.Provisioning.BudgetCost,
+        ProvisioningApproval:   cfg.Provisioning.Approval,
+        Redis:                  router.RedisConfig{Config: redis.Config{Addr: cfg.Redis.Addr, Password: cfg.Redis.Password, DB: cfg.Redis.DB}, Prefix: cfg.Redis.Prefix},
+        Replication:            router.ReplicationConfig{Peer: cfg.Replication.Peer, Listen: cfg.Replication.Listen, Key: cfg.Replication.Key, TLS: replicationTLS},
+        V1DualWrite:            router.V1DualWriteConfig{DSN: cfg.Migration.V1DSN, ReconcileInterval: cfg.Migration.V1ReconcileInterval},
+        Diagnostics:            router.DiagnosticsConfig{Dir: cfg.Diagnostics.Dir, P99Latency: cfg.Diagnostics.P99Latency, ErrorRate: cfg.Diagnostics.ErrorRate, Window: cfg.Diagnostics.Window,
+            CPUProfile: cfg.Diagnostics.CPUProfile, Cooldown: cfg.Diagnostics.Cooldown, Keep: cfg.Diagnostics.Keep, UploadURL: cfg.Diagnostics.UploadURL},
+        CDR:                    router.CDRConfig{Sinks: cfg.CDR.Sinks, File: cfg.CDR.File, Format: cfg.CDR.Format, RotateEvery: cfg.CDR.Rotate,
+            RotateBytes: int64(cfg.CDR.RotateMB) << 20, Keep: cfg.CDR.Keep, HTTPURL: cfg.CDR.HTTPURL, Buffer: cfg.CDR.Buffer},
+        EventStream:            router.EventStreamConfig{Backend: cfg.EventStream.Backend, URL: cfg.EventStream.URL, Topic: cfg.EventStream.Topic},
+        AMI:                    ami.Config{Addr: cfg.AMI.Addr, Username: cfg.AMI.User, Secret: cfg.AMI.Secret},
+        NegativeCacheTTL:       cfg.NegativeCache.TTL,
+        NegativeCacheFailures:  cfg.NegativeCache.Failures,
+        NegativeCacheDigits:    cfg.NegativeCache.Digits,
+        NegativeCacheReroute:   cfg.NegativeCache.Reroute,
+        NegativeCacheFailback:  cfg.NegativeCache.Failback,
+        NegativeCacheRamp:      cfg.NegativeCache.Ramp,
+    })
+    if err != nil {
+        fatalf("Failed to initialize router: %v", err)
+    }
+    
+    jwtKeys, err := jwt.ParseKeys(cfg.HTTP.JWTKeys)
+    if err != nil {
+        fatalf("Invalid http.jwt_keys: %v", err)
+    }
+    allowed, err := api.ParseAllowlist(cfg.HTTP.AllowedSources)
     if err != nil {
-        log.Fatalf("Failed to initialize router: %v", err)
+        fatalf("Invalid http.allowed_sources: %v", err)
     }
-    defer r.Close()
     
     // Start API server
-    apiServer := api.NewServer(r, *httpPort)
-    go func() {
-        if err := apiServer.Start(); err != nil {
-            log.Fatalf("API server failed: %v", err)
+    apiServer := api.NewServer(r, api.Config{
+        Port:              cfg.HTTP.Port,
+        APIKey:            cfg.HTTP.APIKey,
+        RateLimit:         cfg.HTTP.RateLimit,
+        RateBurst:         cfg.HTTP.RateBurst,
+        ClientRateLimit:   cfg.HTTP.ClientRateLimit,
+        ClientRateBurst:   cfg.HTTP.ClientRateBurst,
+        ClientRateBy:      cfg.HTTP.ClientRateBy,
+        AllowedSources:    allowed,
+        ReadTimeout:       cfg.HTTP.ReadTimeout,
+        WriteTimeout:      cfg.HTTP.WriteTimeout,
+        TLSCert:           cfg.HTTP.TLSCert,
+        TLSKey:            cfg.HTTP.TLSKey,
+        TLSReloadInterval: cfg.HTTP.TLSReloadInterval,
+        TLSClientCA:       cfg.HTTP.TLSClientCA,
+        TLSClientCNs:      cfg.HTTP.TLSClientCNs,
+        TLSClientAuth:     cfg.HTTP.TLSClientAuth,
+        WatchdogInterval:  cfg.HTTP.WatchdogInterval,
+        WatchdogTimeout:   cfg.HTTP.WatchdogTimeout,
+        WatchdogFailures:  cfg.HTTP.WatchdogFailures,
+        WatchdogAction:    cfg.HTTP.WatchdogAction,
+        JWT:               jwtKeys,
+        JWTTTL:            cfg.HTTP.JWTTTL,
+        JWTMaxSession:     cfg.HTTP.JWTMaxSession,
+    })
+    
+    // The listeners share one lifecycle: SIGINT/SIGTERM or any of them
+    // failing starts the shutdown below
+    sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stopSignals()
+    life := lifecycle.New(sigCtx)
+    life.Go("api", func(context.Context) error {
+        return apiServer.Start()
+    })
+    life.Go("watchdog", apiServer.Watchdog)
+    life.Go("tls-reload", apiServer.WatchTLS)
+    life.Go("sighup", func(ctx context.Context) error {
+        // SIGHUP rotates the TLS certificate without a restart
+        hup := make(chan os.Signal, 1)
+        signal.Notify(hup, syscall.SIGHUP)
+        defer signal.Stop(hup)
+        for {
+            select {
+            case <-ctx.Done():
+                return nil
+            case <-hup:
+                apiServer.ReloadTLS()
+            }
         }
-    }()
+    })
+    
+    var agiServer *agi.Server
+    if cfg.AGI.Addr != "" {
+        agiServer = agi.NewServer(cfg.AGI.Addr)
+        agi.RegisterRouting(agiServer, r)
+        life.Go("agi", func(context.Context) error {
+            return agiServer.ListenAndServe()
+        })
+    }
+    
+    var ariClient *ari.Client
+    if cfg.ARI.URL != "" {
+        ariClient = ari.NewRouting(ari.Config{URL: cfg.ARI.URL, Username: cfg.ARI.User, Password: cfg.ARI.Password, App: cfg.ARI.App}, r)
+        life.Go("ari", func(context.Context) error {
+            ariClient.Run()
+            return nil
+        })
+    }
+    
+    logger.Infof("S2 Router started successfully on port %d", cfg.HTTP.Port)
+    logger.Infof("Endpoints:")
+    logger.Infof("  - /api/processIncoming")
+    logger.Infof("  - /api/processReturn")
+    logger.Infof("  - /api/hangup")
+    logger.Infof("  - /api/stats")
+    logger.Infof("  - /api/exports")
+    logger.Infof("  - /api/health")
+    logger.Infof("  - /metrics")
+    if cfg.AGI.Addr != "" {
+        logger.Infof("  - agi://%s/{incoming,return,hangup}", cfg.AGI.Addr)
+    }
+    if cfg.ARI.URL != "" {
+        logger.Infof("  - Stasis(%s,{incoming,return}) via %s", cfg.ARI.App, cfg.ARI.URL)
+    }
     
-    log.Printf("S2 Router started successfully on port %d", *httpPort)
-    log.Printf("Endpoints:")
-    log.Printf("  - /api/processIncoming")
-    log.Printf("  - /api/processReturn")
-    log.Printf("  - /api/stats")
-    log.Printf("  - /api/health")
+    // Wait for a signal or a failed listener
+    <-life.Context().Done()
     
-    // Wait for interrupt signal
-    sigChan := make(chan os.Signal, 1)
-    signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-    <-sigChan
+    logger.Infof("Shutting down, draining active calls...")
+    r.Drain(cfg.Shutdown.DrainTimeout)
     
-    log.Println("Shutting down...")
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := apiServer.Shutdown(ctx); err != nil {
+        logger.Warnf("API server shutdown: %v", err)
+    }
+    if agiServer != nil {
+        agiServer.Close()
+    }
+    if ariClient != nil {
+        ariClient.Close()
+    }
+    err = life.Shutdown(5 * time.Second)
+    r.Close()
+    if err != nil {
+        fatalf("Shutdown: %v", err)
+    }
+    logger.Infof("Shutdown complete")
 }
@@ -0,0 +1,205 @@
+// Command routerctl runs operator tasks against a running S2 router through
+// its HTTP API. The API address and key are taken from the router's config;
+// when it sets JWT keys, routerctl signs itself a short-lived admin token:
+//
+//	routerctl -config /etc/s2/router.yaml dids import numbers.csv
+//	routerctl dids import -tenant acme -dry-run numbers.csv
+//	routerctl migrate v1 -dry-run 'user:pass@tcp(v1-db:3306)/call_routing'
+//	routerctl token -subject grafana -ttl 24h
+//	routerctl schema check -against router
+package main
+
+import (
+    "crypto/tls"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/config"
+    "github.com/asterisk-call-routing-v2/internal/jwt"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const usage = `Usage: routerctl [-config file] [-api url] [-token jwt] [-cert file -key file] [-timeout d] <command>
+
+Commands:
+  dids import [-tenant id] [-pool name] [-dry-run] file.csv
+        Add the numbers in a did,country,tags CSV to the DID pool
+  migrate v1 [-since YYYY-MM-DD] [-batch n] [-dry-run] dsn
+        Import the DIDs and call history of a v1 router database (a MySQL
+        DSN such as user:pass@tcp(host:3306)/call_routing); calls still in
+        flight continue on v2
+  token -subject name [-ttl d]
+        Print an admin bearer token signed with the config's current JWT key
+  schema check [-against file|router]
+        Check that the events the router emits conform to the current event
+        schema and, given its published copy, that it still accepts them
+  schema validate [-version n] [file]
+        Validate JSON payloads, one per line, against the event schema
+`
+
+// Lifetime of the token routerctl signs for its own requests
+const selfTokenTTL = 10 * time.Minute
+
+// client talks to the router API
+type client struct {
+    api    string
+    apiKey string
+    token  string // bearer token for the admin routes, if JWT auth is on
+    http   *http.Client
+}
+
+func main() {
+    configPath := flag.String("config", "", "Router YAML config the API port and key are taken from")
+    api := flag.String("api", "", "S2 API base URL (default http://127.0.0.1:<http.port>)")
+    token := flag.String("token", os.Getenv("S2_TOKEN"), "Admin bearer token (default: signed with the config's JWT keys)")
+    certFile := flag.String("cert", "", "Client certificate for routers requiring mutual TLS")
+    keyFile := flag.String("key", "", "Private key of -cert")
+    timeout := flag.Duration("timeout", 5*time.Minute, "How long to wait for the router to answer")
+    flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+    flag.Parse()
+
+    cfg := config.Default()
+    if err := cfg.Load(*configPath, nil); err != nil {
+        fatalf("Failed to load configuration: %v", err)
+    }
+    tlsConfig := &tls.Config{}
+    if *api == "" {
+        *api = fmt.Sprintf("http://127.0.0.1:%d", cfg.HTTP.Port)
+        if cfg.HTTP.TLSCert != "" {
+            // The certificate names the router's public host, not loopback
+            *api = fmt.Sprintf("https://127.0.0.1:%d", cfg.HTTP.Port)
+            tlsConfig.InsecureSkipVerify = true
+        }
+    }
+    if *certFile != "" {
+        cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+        if err != nil {
+            fatalf("Failed to load client certificate: %v", err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+    keys, err := jwt.ParseKeys(cfg.HTTP.JWTKeys)
+    if err != nil {
+        fatalf("Invalid http.jwt_keys: %v", err)
+    }
+    if *token == "" && keys != nil {
+        if *token, _, err = keys.Issue("routerctl", time.Now(), selfTokenTTL); err != nil {
+            fatalf("Failed to sign a token: %v", err)
+        }
+    }
+    c := &client{api: strings.TrimSuffix(*api, "/"), apiKey: cfg.HTTP.APIKey, token: *token, http: &http.Client{Timeout: *timeout, Transport: transport}}
+
+    args := flag.Args()
+    switch {
+    case len(args) >= 1 && args[0] == "token":
+        os.Exit(issueToken(keys, cfg.HTTP.JWTTTL, args[1:]))
+    case len(args) >= 2 && args[0] == "dids" && args[1] == "import":
+        os.Exit(c.importDIDs(args[2:]))
+    case len(args) >= 2 && args[0] == "migrate" && args[1] == "v1":
+        os.Exit(c.migrateV1(args[2:]))
+    case len(args) >= 2 && args[0] == "schema" && args[1] == "check":
+        os.Exit(c.checkSchema(args[2:]))
+    case len(args) >= 2 && args[0] == "schema" && args[1] == "validate":
+        os.Exit(validateEvents(args[2:]))
+    default:
+        flag.Usage()
+        os.Exit(2)
+    }
+}
+
+// importDIDs uploads a CSV to /api/dids/import and prints the report. It
+// exits 1 when any row was rejected so scripts notice a partial seed.
+func (c *client) importDIDs(args []string) int {
+    fs := flag.NewFlagSet("dids import", flag.ExitOnError)
+    tenant := fs.String("tenant", "", "Tenant whose pool receives the numbers (default pool if empty)")
+    pool := fs.String("pool", "", "Named DID pool the numbers join (unpooled if empty)")
+    dryRun := fs.Bool("dry-run", false, "Validate and count without inserting")
+    fs.Parse(args)
+    if fs.NArg() != 1 {
+        fmt.Fprint(os.Stderr, usage)
+        return 2
+    }
+
+    file, err := os.Open(fs.Arg(0))
+    if err != nil {
+        fatalf("%v", err)
+    }
+    defer file.Close()
+
+    query := url.Values{}
+    if *tenant != "" {
+        query.Set("tenant", *tenant)
+    }
+    if *pool != "" {
+        query.Set("pool", *pool)
+    }
+    if *dryRun {
+        query.Set("dry_run", "true")
+    }
+    var report models.DIDImport
+    if err := c.do("POST", "/api/dids/import?"+query.Encode(), "text/csv", file, &report); err != nil {
+        fatalf("Import failed: %v", err)
+    }
+
+    verb := "Imported"
+    if report.DryRun {
+        verb = "Would import"
+    }
+    fmt.Printf("%s %d of %d rows: %d duplicate in file, %d already present, %d invalid\n",
+        verb, report.Imported, report.TotalRows, report.Duplicates, report.Existing, report.Invalid)
+    for _, e := range report.Errors {
+        fmt.Printf("  line %d %s: %s\n", e.Line, e.DID, e.Error)
+    }
+    if len(report.Errors) < report.Invalid {
+        fmt.Printf("  ... and %d more invalid rows\n", report.Invalid-len(report.Errors))
+    }
+    if report.Invalid > 0 {
+        return 1
+    }
+    return 0
+}
+
+// do sends a request and decodes a JSON answer into out, turning an error
+// status into the API's error message
+func (c *client) do(method, path, contentType string, body io.Reader, out interface{}) error {
+    req, err := http.NewRequest(method, c.api+path, body)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", contentType)
+    if c.token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.token)
+    } else if c.apiKey != "" {
+        req.Header.Set("X-API-Key", c.apiKey)
+    }
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        var apiErr struct {
+            Error string `json:"error"`
+        }
+        if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+            return fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+        }
+        return fmt.Errorf("%s", resp.Status)
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func fatalf(format string, args ...interface{}) {
+    fmt.Fprintf(os.Stderr, "routerctl: "+format+"\n", args...)
+    os.Exit(1)
+}
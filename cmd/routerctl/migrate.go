@@ -0,0 +1,148 @@
+package main
+
+import (
+    "bytes"
+    "database/sql"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/go-sql-driver/mysql"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// migrateV1 reads the dids and call_records tables of a v1 router database
+// and sends them in batches to /api/migrate/v1: DIDs first, then calls
+// oldest first so the calls still in flight arrive last, closest to the
+// cutover. It exits 1 when any row was rejected.
+func (c *client) migrateV1(args []string) int {
+    fs := flag.NewFlagSet("migrate v1", flag.ExitOnError)
+    since := fs.String("since", "", "Only import calls started on or after this date (YYYY-MM-DD); DIDs are always imported")
+    batchSize := fs.Int("batch", 1000, "Rows sent per request")
+    dryRun := fs.Bool("dry-run", false, "Validate and count without writing")
+    fs.Parse(args)
+    if fs.NArg() != 1 || *batchSize <= 0 {
+        fmt.Fprint(os.Stderr, usage)
+        return 2
+    }
+
+    dsn, err := mysql.ParseDSN(fs.Arg(0))
+    if err != nil {
+        fatalf("Invalid v1 DSN: %v", err)
+    }
+    dsn.ParseTime = true
+    db, err := sql.Open("mysql", dsn.FormatDSN())
+    if err != nil {
+        fatalf("%v", err)
+    }
+    defer db.Close()
+    from := time.Time{}
+    if *since != "" {
+        if from, err = time.ParseInLocation("2006-01-02", *since, time.Local); err != nil {
+            fatalf("Invalid -since: %v", err)
+        }
+    }
+
+    total := &models.V1Import{DryRun: *dryRun}
+    path := "/api/migrate/v1"
+    if *dryRun {
+        path += "?dry_run=true"
+    }
+    send := func(batch *models.V1Batch) {
+        if len(batch.DIDs)+len(batch.Calls) == 0 {
+            return
+        }
+        body, err := json.Marshal(batch)
+        if err != nil {
+            fatalf("%v", err)
+        }
+        var report models.V1Import
+        if err := c.do("POST", path, "application/json", bytes.NewReader(body), &report); err != nil {
+            fatalf("Import failed after %d DIDs and %d calls: %v", total.DIDs, total.Calls, err)
+        }
+        total.DIDs += report.DIDs
+        total.DIDsExisting += report.DIDsExisting
+        total.Calls += report.Calls
+        total.CallsExisting += report.CallsExisting
+        total.Active += report.Active
+        total.Abandoned += report.Abandoned
+        total.Invalid += report.Invalid
+        total.Errors = append(total.Errors, report.Errors...)
+        *batch = models.V1Batch{}
+    }
+
+    batch := &models.V1Batch{}
+    rows, err := db.Query("SELECT did, COALESCE(country, '') FROM dids ORDER BY did")
+    if err != nil {
+        fatalf("Reading v1 dids: %v", err)
+    }
+    for rows.Next() {
+        var d models.V1DID
+        if err := rows.Scan(&d.DID, &d.Country); err != nil {
+            fatalf("Reading v1 dids: %v", err)
+        }
+        batch.DIDs = append(batch.DIDs, d)
+        if len(batch.DIDs) == *batchSize {
+            send(batch)
+        }
+    }
+    if err := rows.Err(); err != nil {
+        fatalf("Reading v1 dids: %v", err)
+    }
+    rows.Close()
+    send(batch)
+
+    rows, err = db.Query(`
+        SELECT call_id, COALESCE(original_ani, ''), COALESCE(original_dnis, ''), COALESCE(assigned_did, ''),
+            COALESCE(status, ''), start_time, end_time, COALESCE(duration, 0), COALESCE(recording_path, '')
+        FROM call_records
+        WHERE start_time >= ?
+        ORDER BY start_time
+    `, from)
+    if err != nil {
+        fatalf("Reading v1 call_records: %v", err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var call models.V1Call
+        var end sql.NullTime
+        if err := rows.Scan(&call.CallID, &call.ANI, &call.DNIS, &call.DID, &call.Status,
+            &call.StartTime, &end, &call.Duration, &call.RecordingPath); err != nil {
+            fatalf("Reading v1 call_records: %v", err)
+        }
+        if end.Valid {
+            call.EndTime = &end.Time
+        }
+        batch.Calls = append(batch.Calls, call)
+        if len(batch.Calls) == *batchSize {
+            send(batch)
+        }
+    }
+    if err := rows.Err(); err != nil {
+        fatalf("Reading v1 call_records: %v", err)
+    }
+    send(batch)
+
+    verb := "Imported"
+    if total.DryRun {
+        verb = "Would import"
+    }
+    fmt.Printf("%s %d DIDs (%d already present) and %d calls (%d already present)\n",
+        verb, total.DIDs, total.DIDsExisting, total.Calls, total.CallsExisting)
+    fmt.Printf("In-flight calls: %d continue on v2, %d abandoned as FAILED\n", total.Active, total.Abandoned)
+    if total.Invalid > 0 {
+        fmt.Printf("%d invalid rows:\n", total.Invalid)
+        for i, e := range total.Errors {
+            if i == 100 {
+                fmt.Printf("  ... and %d more\n", len(total.Errors)-i)
+                break
+            }
+            fmt.Printf("  call %s DID %s: %s\n", e.CallID, e.DID, e.Error)
+        }
+        return 1
+    }
+    return 0
+}
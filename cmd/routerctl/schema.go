@@ -0,0 +1,116 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+
+    "github.com/asterisk-call-routing-v2/internal/eventschema"
+)
+
+// checkSchema runs the event contract's compatibility suite, against a
+// published copy of the schema when one is given. It exits 1 on any
+// problem so CI can gate on it.
+func (c *client) checkSchema(args []string) int {
+    fs := flag.NewFlagSet("schema check", flag.ExitOnError)
+    against := fs.String("against", "", "Published schema to stay compatible with: a file, or \"router\" for the running router's")
+    fs.Parse(args)
+    if fs.NArg() != 0 {
+        fmt.Fprint(os.Stderr, usage)
+        return 2
+    }
+
+    var published []byte
+    switch *against {
+    case "":
+    case "router":
+        var doc json.RawMessage
+        if err := c.do("GET", fmt.Sprintf("/api/events/schema/%d", eventschema.Current), "", nil, &doc); err != nil {
+            fatalf("Fetching the router's event schema failed: %v", err)
+        }
+        published = doc
+    default:
+        var err error
+        if published, err = os.ReadFile(*against); err != nil {
+            fatalf("%v", err)
+        }
+    }
+
+    problems := eventschema.Check(published)
+    for _, p := range problems {
+        fmt.Println(p)
+    }
+    if len(problems) > 0 {
+        fmt.Fprintf(os.Stderr, "%d problems with event schema version %d\n", len(problems), eventschema.Current)
+        return 1
+    }
+    fmt.Printf("Events conform to schema version %d\n", eventschema.Current)
+    return 0
+}
+
+// validateEvents checks captured payloads, one JSON object per line (e.g.
+// logged webhook bodies), against the schema version each one names
+func validateEvents(args []string) int {
+    fs := flag.NewFlagSet("schema validate", flag.ExitOnError)
+    version := fs.Int("version", 0, "Schema version to validate against (default: each payload's schema_version)")
+    fs.Parse(args)
+    if fs.NArg() > 1 {
+        fmt.Fprint(os.Stderr, usage)
+        return 2
+    }
+    var in io.Reader = os.Stdin
+    if fs.NArg() == 1 && fs.Arg(0) != "-" {
+        file, err := os.Open(fs.Arg(0))
+        if err != nil {
+            fatalf("%v", err)
+        }
+        defer file.Close()
+        in = file
+    }
+
+    scanner := bufio.NewScanner(in)
+    scanner.Buffer(make([]byte, 64*1024), 1<<20)
+    line, checked, invalid := 0, 0, 0
+    for scanner.Scan() {
+        line++
+        payload := bytes.TrimSpace(scanner.Bytes())
+        if len(payload) == 0 {
+            continue
+        }
+        checked++
+        v := *version
+        if v == 0 {
+            var head struct {
+                SchemaVersion int `json:"schema_version"`
+            }
+            json.Unmarshal(payload, &head)
+            v = head.SchemaVersion
+        }
+        if v == 0 {
+            // Payloads from before schema_version was added
+            v = 1
+        }
+        problems, err := eventschema.Validate(v, payload)
+        if err != nil {
+            problems = []string{err.Error()}
+        }
+        if len(problems) > 0 {
+            invalid++
+        }
+        for _, p := range problems {
+            fmt.Printf("line %d: %s\n", line, p)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        fatalf("%v", err)
+    }
+    fmt.Fprintf(os.Stderr, "%d of %d payloads conform\n", checked-invalid, checked)
+    if invalid > 0 {
+        return 1
+    }
+    return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/jwt"
+)
+
+// issueToken prints a bearer token for the admin routes. Tokens are signed
+// locally with the config's keys, so handing one out needs access to the
+// router's config rather than to a running router.
+func issueToken(keys *jwt.KeySet, defaultTTL time.Duration, args []string) int {
+    fs := flag.NewFlagSet("token", flag.ExitOnError)
+    subject := fs.String("subject", "", "Who the token is for, logged on refresh and used as note author (required)")
+    ttl := fs.Duration("ttl", defaultTTL, "How long the token is valid")
+    fs.Parse(args)
+    if fs.NArg() != 0 || *subject == "" || *ttl <= 0 {
+        fmt.Fprint(os.Stderr, usage)
+        return 2
+    }
+    if keys == nil {
+        fmt.Fprintln(os.Stderr, "routerctl: http.jwt_keys is empty, the admin routes take the API key")
+        return 1
+    }
+
+    token, claims, err := keys.Issue(*subject, time.Now(), *ttl)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "routerctl: %v\n", err)
+        return 1
+    }
+    fmt.Println(token)
+    fmt.Fprintf(os.Stderr, "Signed with key %s for %s, expires %s\n", keys.SigningKeyID(), claims.Subject, claims.Expires().Format(time.RFC3339))
+    return 0
+}
@@ -0,0 +1,164 @@
+// Command scenarios writes an acceptance battery for an S2 deployment: SIPp
+// scenarios for each hop of the call loop and a k6 script driving the HTTP
+// API through incoming -> return -> hangup. Settings are read from the
+// router's own config so the scripts match the deployment under test:
+//
+//	scenarios -config /etc/s2/router.yaml -s2 10.0.0.5:5060 -out acceptance
+//
+// See the README.md written next to the scripts for how to run them.
+package main
+
+import (
+    "embed"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "text/template"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/config"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// Generated files and the template each one comes from
+var outputs = []struct {
+    path     string
+    template string
+}{
+    {"README.md", "README.md.tmpl"},
+    {"k6/call_flow.js", "call_flow.js.tmpl"},
+    {"sipp/numbers.csv", "numbers.csv.tmpl"},
+    {"sipp/s1_uac.xml", "s1_uac.xml.tmpl"},
+    {"sipp/s3_uas.xml", "s3_uas.xml.tmpl"},
+    {"sipp/s3_return_uac.xml", "s3_return_uac.xml.tmpl"},
+    {"sipp/s4_uas.xml", "s4_uas.xml.tmpl"},
+}
+
+// battery is the data every template sees
+type battery struct {
+    API      string      // base URL of the S2 API
+    APIKey   string      // sent as X-API-Key, "" when auth is off
+    S2       string      // SIP address S1 and S3 send calls to
+    Numbers  [][2]string // ANI-1, DNIS-1 pairs
+    Hold     time.Duration
+    CPS      int
+    Duration time.Duration
+    VUs      int
+    P95      time.Duration // latency budget per API step
+}
+
+// Durations formatted the way SIPp and k6 take them
+
+func (b battery) HoldMS() int64 { return b.Hold.Milliseconds() }
+
+func (b battery) P95MS() int64 { return b.P95.Milliseconds() }
+
+func (b battery) HoldSeconds() string {
+    return strconv.FormatFloat(b.Hold.Seconds(), 'f', -1, 64)
+}
+
+func (b battery) DurationK6() string {
+    return fmt.Sprintf("%ds", int(b.Duration.Seconds()))
+}
+
+func main() {
+    configPath := flag.String("config", "", "Router YAML config the API port and key are taken from")
+    out := flag.String("out", "acceptance", "Directory the scenarios are written to")
+    api := flag.String("api", "", "S2 API base URL (default http://127.0.0.1:<http.port>)")
+    s2 := flag.String("s2", "127.0.0.1:5060", "SIP address of S2 for the SIPp scenarios")
+    ani := flag.String("ani", "15550100000", "First ANI-1 of the test numbers")
+    dnis := flag.String("dnis", "15550200000", "First DNIS-1 of the test numbers")
+    count := flag.Int("numbers", 100, "How many ANI/DNIS pairs to generate")
+    hold := flag.Duration("hold", 5*time.Second, "How long each test call is held")
+    cps := flag.Int("cps", 5, "Calls per second offered by k6 and SIPp")
+    duration := flag.Duration("duration", time.Minute, "How long k6 offers calls")
+    vus := flag.Int("vus", 50, "k6 virtual users preallocated for the arrival rate")
+    p95 := flag.Duration("p95", 500*time.Millisecond, "95th percentile latency allowed per API step")
+    flag.Parse()
+
+    cfg := config.Default()
+    if err := cfg.Load(*configPath, nil); err != nil {
+        log.Fatalf("Failed to load configuration: %v", err)
+    }
+    if *api == "" {
+        scheme := "http"
+        if cfg.HTTP.TLSCert != "" {
+            scheme = "https"
+        }
+        *api = fmt.Sprintf("%s://127.0.0.1:%d", scheme, cfg.HTTP.Port)
+    }
+
+    numbers, err := testNumbers(*ani, *dnis, *count)
+    if err != nil {
+        log.Fatalf("Invalid test numbers: %v", err)
+    }
+    b := battery{
+        API:      *api,
+        APIKey:   cfg.HTTP.APIKey,
+        S2:       *s2,
+        Numbers:  numbers,
+        Hold:     *hold,
+        CPS:      *cps,
+        Duration: *duration,
+        VUs:      *vus,
+        P95:      *p95,
+    }
+
+    tmpl, err := template.ParseFS(templates, "templates/*.tmpl")
+    if err != nil {
+        log.Fatalf("Failed to parse templates: %v", err)
+    }
+    for _, o := range outputs {
+        path := filepath.Join(*out, o.path)
+        if err := write(tmpl, o.template, path, b); err != nil {
+            log.Fatalf("Failed to write %s: %v", path, err)
+        }
+        log.Printf("Wrote %s", path)
+    }
+}
+
+// testNumbers counts up from the first ANI and DNIS, keeping their width so
+// leading zeros and country codes survive. Distinct pairs keep the router's
+// dedup window from folding test calls together.
+func testNumbers(ani, dnis string, count int) ([][2]string, error) {
+    if count <= 0 {
+        return nil, fmt.Errorf("need at least one number")
+    }
+    a, err := strconv.ParseUint(ani, 10, 64)
+    if err != nil {
+        return nil, fmt.Errorf("ANI %q is not numeric", ani)
+    }
+    d, err := strconv.ParseUint(dnis, 10, 64)
+    if err != nil {
+        return nil, fmt.Errorf("DNIS %q is not numeric", dnis)
+    }
+
+    numbers := make([][2]string, count)
+    for i := range numbers {
+        numbers[i] = [2]string{
+            fmt.Sprintf("%0*d", len(ani), a+uint64(i)),
+            fmt.Sprintf("%0*d", len(dnis), d+uint64(i)),
+        }
+    }
+    return numbers, nil
+}
+
+func write(tmpl *template.Template, name, path string, b battery) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    f, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := tmpl.ExecuteTemplate(f, name, b); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
@@ -0,0 +1,224 @@
+package agi
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// The routing scripts answer through channel variables instead of JSON:
+//
+//	same => n,AGI(agi://router:4573/incoming?campaign=spring,${CALLID})
+//	same => n,GotoIf($["${S2_STATUS}" != "success"]?failed)
+//	same => n,Set(CALLERID(num)=${S2_ANI})
+//	same => n,Dial(PJSIP/${S2_DNIS}@${S2_NEXTHOP})
+//
+// incoming: arg 1 is the CallID (issued by S2 when it generates CallIDs,
+// otherwise the channel's uniqueid), ANI is
+// the caller ID and DNIS the dialled extension. Query parameters campaign,
+// domain, pool, source and tag_* behave as on /api/processIncoming.
+// return: ANI-2 is the caller ID, the DID the dialled extension and arg 1
+// an optional match token.
+// hangup: arg 1 is the CallID, arg 2 the hangup cause (defaults to HANGUPCAUSE).
+//
+// Every script sets S2_STATUS ("success" or "error"); errors also set
+// S2_ERROR and S2_RETRYABLE (1 if another attempt or another S2 may work).
+// With an overflow route, incoming sets S2_STATUS to "overflow" when no DID
+// was free and S2_OVERFLOW to direct, to dial S4 at S2_NEXTHOP, or
+// announcement, to go to the context in S2_NEXTHOP:
+//
+//	same => n,GotoIf($["${S2_OVERFLOW}" = "announcement"]?${S2_NEXTHOP},${S2_DNIS},1)
+// Trace context is read from the inbound traceparent/baggage SIP headers and
+// returned as S2_TRACEPARENT and S2_BAGGAGE for the outbound leg.
+//
+// incoming also sets S2_RECORDING to the file the call should be recorded
+// to; it is left unset while recordings are over their quota:
+//
+//	same => n,ExecIf($["${S2_RECORDING}" != ""]?MixMonitor(${S2_RECORDING}))
+//
+// When the forward leg has a rate, incoming sets S2_COST (per minute),
+// S2_CURRENCY and S2_INCREMENT (e.g. 60/60) unless costs are hidden.
+//
+// Headers from the next hop's carrier profile come as S2_HEADERS, a
+// ^-separated list of Name=value inherited by the dialled channel, for a
+// pre-dial handler to add:
+//
+//	same => n,Dial(PJSIP/${S2_DNIS}@${S2_NEXTHOP},,b(s2-headers^s^1))
+//
+//	[s2-headers]
+//	exten => s,1,Set(I=1)
+//	 same => n,While($[${I} <= ${FIELDQTY(S2_HEADERS,^)}])
+//	 same => n,Set(H=${CUT(S2_HEADERS,^,${I})})
+//	 same => n,Set(PJSIP_HEADER(add,${CUT(H,=,1)})=${CUT(H,=,2-)})
+//	 same => n,Set(I=$[${I} + 1])
+//	 same => n,EndWhile()
+//	 same => n,Return()
+const (
+    varStatus      = "S2_STATUS"
+    varError       = "S2_ERROR"
+    varRetryable   = "S2_RETRYABLE"
+    varCallID      = "S2_CALLID"
+    varDID         = "S2_DID"
+    varNextHop     = "S2_NEXTHOP"
+    varANI         = "S2_ANI"
+    varDNIS        = "S2_DNIS"
+    varToken       = "S2_TOKEN"
+    varTraceparent = "S2_TRACEPARENT"
+    varBaggage     = "S2_BAGGAGE"
+    varState       = "S2_STATE"
+    varRecording   = "S2_RECORDING"
+    varCost        = "S2_COST"      // per-minute rate of the forward leg
+    varCurrency    = "S2_CURRENCY"
+    varIncrement   = "S2_INCREMENT" // billing increments as initial/next seconds, e.g. 60/60
+    varPacing      = "S2_PACING_MS" // delay suggested before the next call to the same trunk
+    varOverflow    = "S2_OVERFLOW"  // direct or announcement when the status is overflow
+    varHeaders     = "_S2_HEADERS"  // leading _ makes Asterisk copy it to the dialled channel
+)
+
+// RegisterRouting adds the incoming, return and hangup scripts backed by rt
+func RegisterRouting(srv *Server, rt *router.Router) {
+    srv.Handle("incoming", func(s *Session) { handleIncoming(s, rt) })
+    srv.Handle("return", func(s *Session) { handleReturn(s, rt) })
+    srv.Handle("hangup", func(s *Session) { handleHangup(s, rt) })
+}
+
+func handleIncoming(s *Session, rt *router.Router) {
+    callID := s.Arg(1)
+    if callID == "" && !rt.IssuesCallIDs() {
+        callID = s.Get("uniqueid")
+    }
+    ani := s.Get("callerid")
+    dnis := s.Get("extension")
+    clog := logger.Call(callID, "", ani)
+    clog.Infof("Incoming: callID=%s, ani=%s, dnis=%s", callID, ani, dnis)
+
+    tags := make(map[string]string)
+    for key, values := range s.Query {
+        if strings.HasPrefix(key, "tag_") && len(values) > 0 {
+            tags[strings.TrimPrefix(key, "tag_")] = values[0]
+        }
+    }
+    if len(tags) == 0 {
+        tags = nil
+    }
+
+    resp, err := rt.ProcessIncomingCall(context.Background(), callID, ani, dnis, router.IncomingOptions{
+        Tags:        tags,
+        Campaign:    s.Query.Get("campaign"),
+        Pool:        s.Query.Get("pool"),
+        Source:      s.Query.Get("source"),
+        Domain:      s.Query.Get("domain"),
+        TraceParent: header(s, "traceparent"),
+        Baggage:     header(s, "baggage"),
+    })
+    if err != nil {
+        clog.Errorf("Incoming error: %v", err)
+        setError(s, err)
+        return
+    }
+    s.SetVariable(varCallID, resp.CallID)
+    setResponse(s, resp)
+}
+
+func handleReturn(s *Session, rt *router.Router) {
+    ani2 := s.Get("callerid")
+    did := s.Get("extension")
+    clog := logger.Call("", did, ani2)
+    clog.Infof("Return: ani2=%s, did=%s", ani2, did)
+
+    resp, err := rt.ProcessReturnCall(context.Background(), ani2, did, router.ReturnOptions{
+        Token:       s.Arg(1),
+        TraceParent: header(s, "traceparent"),
+        Baggage:     header(s, "baggage"),
+    })
+    if err != nil {
+        clog.Errorf("Return error: %v", err)
+        setError(s, err)
+        return
+    }
+    setResponse(s, resp)
+}
+
+func handleHangup(s *Session, rt *router.Router) {
+    callID := s.Arg(1)
+    cause := s.Arg(2)
+    if cause == "" {
+        cause, _ = s.Variable("${HANGUPCAUSE}")
+    }
+    clog := logger.Call(callID, "", "")
+    clog.Infof("Hangup: callID=%s, cause=%s", callID, cause)
+
+    record, err := rt.CompleteCall(context.Background(), callID, cause)
+    if err != nil {
+        clog.Errorf("Hangup error: %v", err)
+        setError(s, err)
+        return
+    }
+    s.SetVariable(varStatus, "success")
+    s.SetVariable(varState, string(record.Status))
+}
+
+// header reads a SIP header of the inbound channel, "" if absent
+func header(s *Session, name string) string {
+    v, err := s.Variable("${PJSIP_HEADER(read," + name + ")}")
+    if err != nil {
+        return ""
+    }
+    return v
+}
+
+func setResponse(s *Session, resp *models.CallResponse) {
+    s.SetVariable(varDID, resp.DIDAssigned)
+    s.SetVariable(varNextHop, resp.NextHop)
+    s.SetVariable(varANI, resp.ANIToSend)
+    s.SetVariable(varDNIS, resp.DNISToSend)
+    if resp.MatchToken != "" {
+        s.SetVariable(varToken, resp.MatchToken)
+    }
+    if resp.Recording != "" {
+        s.SetVariable(varRecording, resp.Recording)
+    }
+    if resp.Cost != nil {
+        s.SetVariable(varCost, strconv.FormatFloat(resp.Cost.PerMinute, 'f', -1, 64))
+        s.SetVariable(varCurrency, resp.Cost.Currency)
+        s.SetVariable(varIncrement, fmt.Sprintf("%d/%d", resp.Cost.InitialIncrement, resp.Cost.Increment))
+    }
+    if resp.PacingMs > 0 {
+        s.SetVariable(varPacing, strconv.Itoa(resp.PacingMs))
+    }
+    if resp.Overflow != "" {
+        s.SetVariable(varOverflow, resp.Overflow)
+    }
+    if resp.TraceParent != "" {
+        s.SetVariable(varTraceparent, resp.TraceParent)
+        s.SetVariable(varBaggage, resp.Baggage)
+    }
+    if len(resp.Headers) > 0 {
+        names := make([]string, 0, len(resp.Headers))
+        for name := range resp.Headers {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for i, name := range names {
+            names[i] = name + "=" + resp.Headers[name]
+        }
+        s.SetVariable(varHeaders, strings.Join(names, "^"))
+    }
+    // Last, so the dialplan never sees success with half the variables set
+    s.SetVariable(varStatus, resp.Status)
+}
+
+func setError(s *Session, err error) {
+    retryable := "0"
+    if router.Retryable(err) {
+        retryable = "1"
+    }
+    s.SetVariable(varError, err.Error())
+    s.SetVariable(varRetryable, retryable)
+    s.SetVariable(varStatus, "error")
+}
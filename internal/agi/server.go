@@ -0,0 +1,242 @@
+package agi
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+)
+
+var logger = logging.New("agi")
+
+// Time a session may take, from the AGI environment to the last reply
+const sessionTimeout = 10 * time.Second
+
+// Handler runs one AGI request
+type Handler func(s *Session)
+
+// Session is one FastAGI connection from Asterisk
+type Session struct {
+    Env    map[string]string // agi_* variables sent by Asterisk, without the prefix
+    Script string            // path part of the AGI URL, e.g. "incoming"
+    Query  url.Values        // query string of the AGI URL
+    Args   []string          // AGI() arguments after the URL
+
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+// Get returns an AGI environment value, e.g. Get("callerid")
+func (s *Session) Get(key string) string {
+    return s.Env[key]
+}
+
+// Arg returns the nth AGI() argument (1-based), or ""
+func (s *Session) Arg(n int) string {
+    if n < 1 || n > len(s.Args) {
+        return ""
+    }
+    return s.Args[n-1]
+}
+
+// Command sends an AGI command and returns the result code and the
+// parenthesised data of a "200 result=N (data)" reply
+func (s *Session) Command(cmd string) (int, string, error) {
+    if _, err := fmt.Fprintf(s.conn, "%s\n", cmd); err != nil {
+        return 0, "", err
+    }
+
+    line, err := s.readLine()
+    // The channel hung up; Asterisk still answers the pending command
+    for err == nil && line == "HANGUP" {
+        line, err = s.readLine()
+    }
+    if err != nil {
+        return 0, "", err
+    }
+
+    if strings.HasPrefix(line, "520-") {
+        // Multi-line usage text ends with "520 End of proper usage."
+        for err == nil && !strings.HasPrefix(line, "520 ") {
+            line, err = s.readLine()
+        }
+        return 0, "", fmt.Errorf("agi: invalid command syntax: %s", cmd)
+    }
+    if !strings.HasPrefix(line, "200 ") {
+        return 0, "", fmt.Errorf("agi: %s", line)
+    }
+
+    rest := strings.TrimPrefix(line, "200 result=")
+    data := ""
+    if i := strings.Index(rest, " ("); i >= 0 && strings.HasSuffix(rest, ")") {
+        data = rest[i+2 : len(rest)-1]
+        rest = rest[:i]
+    }
+    if i := strings.IndexByte(rest, ' '); i >= 0 {
+        rest = rest[:i]
+    }
+    result, err := strconv.Atoi(rest)
+    if err != nil {
+        return 0, "", fmt.Errorf("agi: unexpected reply %q", line)
+    }
+    return result, data, nil
+}
+
+// SetVariable sets a channel variable
+func (s *Session) SetVariable(name, value string) error {
+    _, _, err := s.Command(fmt.Sprintf("SET VARIABLE %s %s", name, quote(value)))
+    return err
+}
+
+// Variable evaluates an expression such as "${PJSIP_HEADER(read,traceparent)}"
+// on the channel, returning "" when it is unset
+func (s *Session) Variable(expr string) (string, error) {
+    result, data, err := s.Command("GET FULL VARIABLE " + quote(expr))
+    if err != nil || result != 1 {
+        return "", err
+    }
+    return data, nil
+}
+
+func (s *Session) Verbose(msg string, level int) error {
+    _, _, err := s.Command(fmt.Sprintf("VERBOSE %s %d", quote(msg), level))
+    return err
+}
+
+func (s *Session) readLine() (string, error) {
+    line, err := s.r.ReadString('\n')
+    return strings.TrimRight(line, "\r\n"), err
+}
+
+func quote(v string) string {
+    v = strings.ReplaceAll(v, `\`, `\\`)
+    v = strings.ReplaceAll(v, `"`, `\"`)
+    v = strings.ReplaceAll(v, "\n", " ")
+    return `"` + v + `"`
+}
+
+// Server accepts FastAGI connections and dispatches them by script name
+type Server struct {
+    addr     string
+    handlers map[string]Handler
+
+    mu       sync.Mutex
+    listener net.Listener
+    closed   bool
+}
+
+func NewServer(addr string) *Server {
+    return &Server{addr: addr, handlers: make(map[string]Handler)}
+}
+
+// Handle registers h for AGI(agi://host/<script>)
+func (srv *Server) Handle(script string, h Handler) {
+    srv.handlers[script] = h
+}
+
+// ListenAndServe accepts connections until Close is called
+func (srv *Server) ListenAndServe() error {
+    ln, err := net.Listen("tcp", srv.addr)
+    if err != nil {
+        return err
+    }
+    srv.mu.Lock()
+    if srv.closed {
+        srv.mu.Unlock()
+        ln.Close()
+        return nil
+    }
+    srv.listener = ln
+    srv.mu.Unlock()
+
+    logger.Infof("FastAGI server listening on %s", srv.addr)
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            srv.mu.Lock()
+            closed := srv.closed
+            srv.mu.Unlock()
+            if closed {
+                return nil
+            }
+            // e.g. out of file descriptors; back off instead of spinning
+            logger.Warnf("Accept failed: %v", err)
+            time.Sleep(50 * time.Millisecond)
+            continue
+        }
+        go srv.serve(conn)
+    }
+}
+
+func (srv *Server) Close() {
+    srv.mu.Lock()
+    defer srv.mu.Unlock()
+    srv.closed = true
+    if srv.listener != nil {
+        srv.listener.Close()
+    }
+}
+
+func (srv *Server) serve(conn net.Conn) {
+    defer conn.Close()
+    defer func() {
+        if rec := recover(); rec != nil {
+            logger.Errorf("PANIC serving %s: %v", conn.RemoteAddr(), rec)
+        }
+    }()
+    conn.SetDeadline(time.Now().Add(sessionTimeout))
+
+    s := &Session{Env: make(map[string]string), conn: conn, r: bufio.NewReader(conn)}
+    // The environment is "agi_key: value" lines ended by a blank line
+    for {
+        line, err := s.readLine()
+        if err != nil {
+            logger.Warnf("Reading environment from %s: %v", conn.RemoteAddr(), err)
+            return
+        }
+        if line == "" {
+            break
+        }
+        key, value, ok := strings.Cut(line, ": ")
+        if !ok || !strings.HasPrefix(key, "agi_") {
+            continue
+        }
+        key = strings.TrimPrefix(key, "agi_")
+        s.Env[key] = value
+        if strings.HasPrefix(key, "arg_") {
+            if n, err := strconv.Atoi(key[4:]); err == nil && n >= 1 {
+                for len(s.Args) < n {
+                    s.Args = append(s.Args, "")
+                }
+                s.Args[n-1] = value
+            }
+        }
+    }
+
+    script := s.Env["network_script"]
+    if script == "" {
+        if u, err := url.Parse(s.Env["request"]); err == nil {
+            script = strings.TrimPrefix(u.Path, "/")
+            if u.RawQuery != "" {
+                script += "?" + u.RawQuery
+            }
+        }
+    }
+    path, rawQuery, _ := strings.Cut(script, "?")
+    s.Script = strings.Trim(path, "/")
+    s.Query, _ = url.ParseQuery(rawQuery)
+
+    h, ok := srv.handlers[s.Script]
+    if !ok {
+        logger.Infof("Unknown script %q from %s", s.Script, conn.RemoteAddr())
+        s.Verbose("S2 router: unknown AGI script "+s.Script, 1)
+        return
+    }
+    h(s)
+}
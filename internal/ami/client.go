@@ -0,0 +1,282 @@
+package ami
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "net/textproto"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+)
+
+var logger = logging.New("ami")
+
+const (
+    dialTimeout  = 5 * time.Second
+    baseBackoff  = time.Second
+    maxBackoff   = 30 * time.Second
+    loginTimeout = 10 * time.Second
+)
+
+// Config selects the AMI endpoint and credentials
+type Config struct {
+    Addr     string // host:port, e.g. 127.0.0.1:5038; empty disables AMI
+    Username string
+    Secret   string
+    Events   string // event classes to subscribe to, defaults to "call"
+}
+
+// Event is one AMI event. Channel variables exported through manager.conf
+// channelvars are collected in Vars.
+type Event struct {
+    Fields map[string]string
+    Vars   map[string]string
+}
+
+// Name returns the event type, e.g. "Hangup"
+func (e Event) Name() string { return e.Fields["Event"] }
+
+// Get returns a header value, or "" when absent
+func (e Event) Get(key string) string { return e.Fields[key] }
+
+// Status reports the state of the AMI connection
+type Status struct {
+    Addr        string     `json:"addr"`
+    Connected   bool       `json:"connected"`
+    Since       *time.Time `json:"since,omitempty"` // when the current state began
+    Connects    int        `json:"connects"`
+    Events      int64      `json:"events"`
+    LastEventAt *time.Time `json:"last_event_at,omitempty"`
+    Failures    int        `json:"failures"`
+    LastError   string     `json:"last_error,omitempty"`
+    LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Client maintains one AMI session: it logs in, subscribes to call events
+// and hands each one to a callback, reconnecting with backoff on failure
+type Client struct {
+    config  Config
+    handler func(Event)
+
+    mu     sync.Mutex
+    status Status
+    conn   net.Conn
+    closed bool
+    stop   chan struct{} // closed by Close to cut a reconnect backoff short
+}
+
+// NewClient prepares a client that passes every received event to handler
+func NewClient(cfg Config, handler func(Event)) *Client {
+    if cfg.Events == "" {
+        cfg.Events = "call"
+    }
+    now := time.Now()
+    return &Client{
+        config:  cfg,
+        handler: handler,
+        status:  Status{Addr: cfg.Addr, Since: &now},
+        stop:    make(chan struct{}),
+    }
+}
+
+// Run connects and reads events until Close is called, reconnecting after failures
+func (c *Client) Run() {
+    backoff := baseBackoff
+    for !c.isClosed() {
+        started := time.Now()
+        err := c.session()
+        if c.isClosed() {
+            return
+        }
+        c.recordFailure(err)
+        logger.Warnf("Connection to %s lost: %v, reconnecting in %s", c.config.Addr, err, backoff)
+
+        // A session that stayed up for a while resets the backoff
+        if time.Since(started) > maxBackoff {
+            backoff = baseBackoff
+        }
+        select {
+        case <-time.After(backoff):
+        case <-c.stop:
+            return
+        }
+        backoff *= 2
+        if backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+// Close ends the session and stops reconnecting
+func (c *Client) Close() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.closed {
+        close(c.stop)
+    }
+    c.closed = true
+    if c.conn != nil {
+        c.conn.Close()
+    }
+}
+
+// Status returns a snapshot of the connection state
+func (c *Client) Status() Status {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.status
+}
+
+func (c *Client) isClosed() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.closed
+}
+
+func (c *Client) session() error {
+    conn, err := net.DialTimeout("tcp", c.config.Addr, dialTimeout)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        return nil
+    }
+    c.conn = conn
+    c.mu.Unlock()
+
+    reader := textproto.NewReader(bufio.NewReader(conn))
+
+    // Banner, e.g. "Asterisk Call Manager/5.0.1"
+    conn.SetReadDeadline(time.Now().Add(loginTimeout))
+    banner, err := reader.ReadLine()
+    if err != nil {
+        return fmt.Errorf("reading banner: %v", err)
+    }
+    if !strings.HasPrefix(banner, "Asterisk Call Manager") {
+        return fmt.Errorf("unexpected banner %q", banner)
+    }
+
+    login := fmt.Sprintf("Action: Login\r\nUsername: %s\r\nSecret: %s\r\nEvents: %s\r\n\r\n",
+        c.config.Username, c.config.Secret, c.config.Events)
+    if _, err := conn.Write([]byte(login)); err != nil {
+        return fmt.Errorf("sending login: %v", err)
+    }
+
+    // Skip anything before the login response, such as FullyBooted
+    for {
+        msg, err := readMessage(reader)
+        if err != nil {
+            return fmt.Errorf("reading login response: %v", err)
+        }
+        if resp := msg.Get("Response"); resp != "" {
+            if resp != "Success" {
+                return fmt.Errorf("login rejected: %s", msg.Get("Message"))
+            }
+            break
+        }
+    }
+    conn.SetReadDeadline(time.Time{})
+
+    c.recordConnected()
+    logger.Infof("Connected to %s (%s)", c.config.Addr, banner)
+
+    for {
+        msg, err := readMessage(reader)
+        if err != nil {
+            return err
+        }
+        if msg.Name() == "" {
+            continue
+        }
+        c.recordEvent()
+        c.dispatch(msg)
+    }
+}
+
+// dispatch runs the handler, keeping a panic in it from killing the session
+func (c *Client) dispatch(ev Event) {
+    defer func() {
+        if rec := recover(); rec != nil {
+            logger.Errorf("ALERT: handler panicked on %s event: %v", ev.Name(), rec)
+        }
+    }()
+    c.handler(ev)
+}
+
+// readMessage reads one blank-line terminated block of "Key: Value" lines
+func readMessage(reader *textproto.Reader) (Event, error) {
+    ev := Event{Fields: make(map[string]string), Vars: make(map[string]string)}
+    for {
+        line, err := reader.ReadLine()
+        if err != nil {
+            return ev, err
+        }
+        if line == "" {
+            if len(ev.Fields) == 0 {
+                continue
+            }
+            return ev, nil
+        }
+
+        i := strings.Index(line, ":")
+        if i < 0 {
+            continue
+        }
+        key := line[:i]
+        value := strings.TrimSpace(line[i+1:])
+
+        switch {
+        case key == "ChanVariable":
+            // Asterisk 12+: "ChanVariable: NAME=value"
+            if j := strings.Index(value, "="); j > 0 {
+                ev.Vars[value[:j]] = value[j+1:]
+            }
+        case strings.HasPrefix(key, "ChanVariable(") && strings.HasSuffix(key, ")"):
+            // Asterisk 11: "ChanVariable(channel): NAME=value"
+            if j := strings.Index(value, "="); j > 0 {
+                ev.Vars[value[:j]] = value[j+1:]
+            }
+        default:
+            ev.Fields[key] = value
+        }
+    }
+}
+
+func (c *Client) recordConnected() {
+    now := time.Now()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.status.Connected = true
+    c.status.Since = &now
+    c.status.Connects++
+}
+
+func (c *Client) recordEvent() {
+    now := time.Now()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.status.Events++
+    c.status.LastEventAt = &now
+}
+
+func (c *Client) recordFailure(err error) {
+    now := time.Now()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.status.Connected {
+        c.status.Since = &now
+    }
+    c.status.Connected = false
+    c.status.Failures++
+    if err != nil {
+        c.status.LastError = err.Error()
+    }
+    c.status.LastErrorAt = &now
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// handleDumpMaps reports the in-memory index sizes, their recent history
+// and any orphaned entries
+func (s *Server) handleDumpMaps(w http.ResponseWriter, r *http.Request) {
+    history := s.router.MapHistory()
+    var current interface{}
+    if len(history) > 0 {
+        current = history[len(history)-1]
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "current": current,
+        "history": history,
+        "orphans": s.router.OrphanedEntries(),
+    })
+}
+
+// handleReloadState rebuilds the in-memory call state from the database;
+// ?lookback= (e.g. 2h, or 0 for the in-flight windows) overrides the
+// configured lookback
+func (s *Server) handleReloadState(w http.ResponseWriter, r *http.Request) {
+    lookback := time.Duration(-1)
+    if v := r.URL.Query().Get("lookback"); v != "" {
+        d, err := time.ParseDuration(v)
+        if err != nil || d < 0 {
+            writeError(w, "lookback must be a non-negative duration", http.StatusBadRequest)
+            return
+        }
+        lookback = d
+    }
+
+    report, err := s.router.ReloadState(r.Context(), lookback)
+    if errors.Is(err, router.ErrStateless) {
+        writeError(w, err.Error(), http.StatusConflict)
+        return
+    }
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) handleTrimMaps(w http.ResponseWriter, r *http.Request) {
+    removed := s.router.TrimOrphans()
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "removed": len(removed),
+        "entries": removed,
+    })
+}
+
+// handleWriteReport lists failed call state writes, pending and given up
+func (s *Server) handleWriteReport(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, s.router.WriteReport())
+}
+
+func (s *Server) handleNegativeCache(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, s.router.NegativeCache())
+}
+
+// handleClearNegativeCache unblocks destinations matching ?trunk= and
+// ?prefix=, or all of them when neither is given
+func (s *Server) handleClearNegativeCache(w http.ResponseWriter, r *http.Request) {
+    removed := s.router.ClearNegativeCache(r.URL.Query().Get("trunk"), r.URL.Query().Get("prefix"))
+
+    writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+// handleApproveFailback restores destinations awaiting manual failback that
+// match ?trunk= and ?prefix=, or all of them when neither is given
+func (s *Server) handleApproveFailback(w http.ResponseWriter, r *http.Request) {
+    approved := s.router.ApproveFailback(r.URL.Query().Get("trunk"), r.URL.Query().Get("prefix"))
+
+    writeJSON(w, http.StatusOK, map[string]int{"approved": approved})
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+var httpSourceRejected = metrics.NewCounter("s2_http_source_rejected_total",
+    "Dialplan callbacks refused because the client address is not allowlisted, by path", "path")
+
+// ParseAllowlist reads the allowed callback sources, each a CIDR such as
+// 10.0.1.0/24 or a single address
+func ParseAllowlist(specs []string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, spec := range specs {
+        spec = strings.TrimSpace(spec)
+        if !strings.Contains(spec, "/") {
+            ip := net.ParseIP(spec)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid address %q", spec)
+            }
+            bits := 8 * net.IPv6len
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 8*net.IPv4len
+            }
+            nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(spec)
+        if err != nil {
+            return nil, fmt.Errorf("invalid CIDR %q", spec)
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+// sourceAllowlistMiddleware answers 403 to clients outside nets. It goes by
+// the connection's address: S1 and S3 call the router directly, and a header
+// naming the client would let anyone claim to be one of them. An empty list
+// disables the check.
+func sourceAllowlistMiddleware(nets []*net.IPNet) Middleware {
+    return func(next http.Handler) http.Handler {
+        if len(nets) == 0 {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            host, _, err := net.SplitHostPort(r.RemoteAddr)
+            if err != nil {
+                host = r.RemoteAddr
+            }
+            if ip := net.ParseIP(host); ip == nil || !allowed(nets, ip) {
+                httpSourceRejected.Inc(r.URL.Path)
+                logger.Context(r.Context()).Warnf("Refused %s %s from %s: source not allowlisted", r.Method, r.URL.Path, r.RemoteAddr)
+                writeError(w, "Forbidden", http.StatusForbidden)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+func allowed(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/jwt"
+)
+
+// tokenResponse carries a freshly issued admin token
+type tokenResponse struct {
+    Token     string    `json:"token"`
+    TokenType string    `json:"token_type"`
+    Subject   string    `json:"subject"`
+    KeyID     string    `json:"key_id"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleRefreshToken swaps a valid bearer token for a new one with a full
+// lifetime, signed with the current key. Clients refreshing before expiry
+// pick up a rotated signing key without operator involvement. The new
+// token stays in the old one's session, so refreshing cannot outlive
+// JWTMaxSession from the first token, issued out of band with routerctl
+// token.
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+    claims := tokenClaims(r)
+    if s.config.JWT == nil || claims == nil {
+        writeError(w, "JWT auth is not enabled", http.StatusNotFound)
+        return
+    }
+
+    token, issued, err := s.config.JWT.Refresh(claims, time.Now(), s.config.JWTTTL, s.config.JWTMaxSession)
+    if errors.Is(err, jwt.ErrSession) {
+        logger.Context(r.Context()).Warnf("Refused to refresh the admin token of %s: session began %s", claims.Subject, claims.SessionStart().UTC().Format(time.RFC3339))
+        writeError(w, "Session expired, issue a new token", http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        logger.Errorf("Failed to issue token: %v", err)
+        writeError(w, "Failed to issue token", http.StatusInternalServerError)
+        return
+    }
+    logger.Context(r.Context()).Infof("Refreshed admin token for %s (key %s)", issued.Subject, s.config.JWT.SigningKeyID())
+    writeJSON(w, http.StatusOK, tokenResponse{
+        Token:     token,
+        TokenType: "Bearer",
+        Subject:   issued.Subject,
+        KeyID:     s.config.JWT.SigningKeyID(),
+        ExpiresAt: issued.Expires(),
+    })
+}
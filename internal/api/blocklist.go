@@ -0,0 +1,126 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// blocklistStatus maps a failed blocklist write to its status
+func blocklistStatus(err error, fallback int) int {
+    if errors.Is(err, router.ErrReadOnly) {
+        return http.StatusServiceUnavailable
+    }
+    return fallback
+}
+
+// handleListBlocklist lists entries, optionally ?source= or ?number=
+func (s *Server) handleListBlocklist(w http.ResponseWriter, r *http.Request) {
+    limit := 1000
+    if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 10000 {
+        limit = v
+    }
+    list, err := s.router.BlocklistEntries(r.Context(), r.URL.Query().Get("source"), r.URL.Query().Get("number"), limit)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+// handleCheckBlocklist reports how a number resolves across all sources
+func (s *Server) handleCheckBlocklist(w http.ResponseWriter, r *http.Request) {
+    verdict, err := s.router.BlocklistCheck(r.Context(), PathParam(r, "number"))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, verdict)
+}
+
+// handleSetBlocklistEntry adds a manual entry from {"action", "reason",
+// "ttl"}, ttl in seconds with 0 never expiring
+func (s *Server) handleSetBlocklistEntry(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Action string `json:"action"`
+        Reason string `json:"reason"`
+        TTL    int    `json:"ttl"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    entry := models.BlocklistEntry{Number: PathParam(r, "number"), Action: body.Action, Reason: body.Reason}
+    saved, err := s.router.SetBlocklistEntry(r.Context(), entry, time.Duration(body.TTL)*time.Second)
+    if err != nil {
+        writeError(w, err.Error(), blocklistStatus(err, http.StatusBadRequest))
+        return
+    }
+
+    writeJSON(w, http.StatusOK, saved)
+}
+
+func (s *Server) handleDeleteBlocklistEntry(w http.ResponseWriter, r *http.Request) {
+    if err := s.router.DeleteBlocklistEntry(r.Context(), PathParam(r, "number")); err != nil {
+        writeError(w, err.Error(), blocklistStatus(err, http.StatusNotFound))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListBlocklistFeeds(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.BlocklistFeeds(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleSetBlocklistFeed(w http.ResponseWriter, r *http.Request) {
+    var f models.BlocklistFeed
+    if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+    f.Name = PathParam(r, "name")
+
+    saved, err := s.router.SetBlocklistFeed(r.Context(), f)
+    if err != nil {
+        writeError(w, err.Error(), blocklistStatus(err, http.StatusBadRequest))
+        return
+    }
+
+    writeJSON(w, http.StatusOK, saved)
+}
+
+func (s *Server) handleDeleteBlocklistFeed(w http.ResponseWriter, r *http.Request) {
+    if err := s.router.DeleteBlocklistFeed(r.Context(), PathParam(r, "name")); err != nil {
+        writeError(w, err.Error(), blocklistStatus(err, http.StatusNotFound))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRefreshBlocklistFeed fetches a list feed now instead of waiting
+// for its interval
+func (s *Server) handleRefreshBlocklistFeed(w http.ResponseWriter, r *http.Request) {
+    feed, err := s.router.RefreshBlocklistFeed(r.Context(), PathParam(r, "name"))
+    if err != nil {
+        writeError(w, err.Error(), blocklistStatus(err, http.StatusBadRequest))
+        return
+    }
+
+    writeJSON(w, http.StatusOK, feed)
+}
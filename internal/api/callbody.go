@@ -0,0 +1,136 @@
+package api
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+
+    "github.com/asterisk-call-routing-v2/internal/tracing"
+)
+
+// Largest JSON body accepted by processIncoming and processReturn
+const maxCallBodyBytes = 64 << 10
+
+// IncomingRequest is what processIncoming takes. Besides the query string
+// it accepts a POST with Content-Type application/json and this object as
+// the body, which carries ANIs such as "+4420..." as plain JSON strings
+// with no URL encoding to get wrong:
+//
+//	{"callid": "abc", "ani": "+442071234567", "dnis": "18005551234",
+//	 "campaign": "spring", "tags": {"region": "eu"}}
+//
+// ani and dnis are required, and callid unless the router issues call
+// IDs. Unknown fields are rejected. traceparent and baggage fall back to
+// the HTTP headers of the same name.
+type IncomingRequest struct {
+    CallID      string            `json:"callid"`
+    ANI         string            `json:"ani"`
+    DNIS        string            `json:"dnis"`
+    Campaign    string            `json:"campaign,omitempty"`
+    Domain      string            `json:"domain,omitempty"`
+    Pool        string            `json:"pool,omitempty"`
+    Source      string            `json:"source,omitempty"`
+    Tags        map[string]string `json:"tags,omitempty"`
+    TraceParent string            `json:"traceparent,omitempty"`
+    Baggage     string            `json:"baggage,omitempty"`
+}
+
+// ReturnRequest is what processReturn takes, as a query string or as a
+// JSON body like IncomingRequest. ani2 and did are required.
+type ReturnRequest struct {
+    ANI2        string `json:"ani2"`
+    DID         string `json:"did"`
+    Token       string `json:"token,omitempty"`
+    TraceParent string `json:"traceparent,omitempty"`
+    Baggage     string `json:"baggage,omitempty"`
+}
+
+// incomingRequest reads processIncoming's parameters from the JSON body
+// or the query string
+func incomingRequest(r *http.Request) (IncomingRequest, error) {
+    var req IncomingRequest
+    if isJSONBody(r) {
+        err := decodeCallBody(r, &req)
+        req.TraceParent = orHeader(r, req.TraceParent, tracing.HeaderTraceparent)
+        req.Baggage = orHeader(r, req.Baggage, tracing.HeaderBaggage)
+        return req, err
+    }
+
+    q := r.URL.Query()
+    tags, err := tagsFromQuery(q)
+    if err != nil {
+        return req, err
+    }
+    return IncomingRequest{
+        CallID:      q.Get("callid"),
+        ANI:         q.Get("ani"),
+        DNIS:        q.Get("dnis"),
+        Campaign:    q.Get("campaign"),
+        Domain:      q.Get("domain"),
+        Pool:        q.Get("pool"),
+        Source:      q.Get("source"),
+        Tags:        tags,
+        TraceParent: traceParam(r, tracing.HeaderTraceparent),
+        Baggage:     traceParam(r, tracing.HeaderBaggage),
+    }, nil
+}
+
+// returnRequest reads processReturn's parameters from the JSON body or
+// the query string
+func returnRequest(r *http.Request) (ReturnRequest, error) {
+    var req ReturnRequest
+    if isJSONBody(r) {
+        err := decodeCallBody(r, &req)
+        req.TraceParent = orHeader(r, req.TraceParent, tracing.HeaderTraceparent)
+        req.Baggage = orHeader(r, req.Baggage, tracing.HeaderBaggage)
+        return req, err
+    }
+
+    q := r.URL.Query()
+    return ReturnRequest{
+        ANI2:        q.Get("ani2"),
+        DID:         q.Get("did"),
+        Token:       q.Get("token"),
+        TraceParent: traceParam(r, tracing.HeaderTraceparent),
+        Baggage:     traceParam(r, tracing.HeaderBaggage),
+    }, nil
+}
+
+func isJSONBody(r *http.Request) bool {
+    if r.Method != http.MethodPost {
+        return false
+    }
+    mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return err == nil && mediaType == "application/json"
+}
+
+// decodeCallBody decodes exactly one JSON object with only known fields
+func decodeCallBody(r *http.Request, v interface{}) error {
+    body, err := io.ReadAll(io.LimitReader(r.Body, maxCallBodyBytes+1))
+    if err != nil {
+        return fmt.Errorf("reading body: %v", err)
+    }
+    if len(body) > maxCallBodyBytes {
+        return fmt.Errorf("body is larger than %d bytes", maxCallBodyBytes)
+    }
+    dec := json.NewDecoder(bytes.NewReader(body))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        return fmt.Errorf("invalid JSON body: %v", err)
+    }
+    if dec.More() {
+        return fmt.Errorf("invalid JSON body: more than one object")
+    }
+    return nil
+}
+
+// orHeader is v, or the HTTP header of that name when v is empty
+func orHeader(r *http.Request, v, header string) string {
+    if v != "" {
+        return v
+    }
+    return r.Header.Get(header)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// handleGetCall returns one call with its timeline, recording and notes,
+// the usual starting point for a disputed call
+func (s *Server) handleGetCall(w http.ResponseWriter, r *http.Request) {
+    callID := PathParam(r, "callid")
+    detail, err := s.router.CallDetail(r.Context(), callID)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if detail == nil {
+        writeError(w, "no call "+callID, http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, detail)
+}
+
+// handleListCalls pages through call records filtered by ?status=, ?ani=,
+// ?did= and a ?from=/?to= start time window, newest first
+func (s *Server) handleListCalls(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    from, err := timeParam(query.Get("from"), time.Time{})
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    to, err := timeParam(query.Get("to"), time.Time{})
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !from.IsZero() && !to.IsZero() && !to.After(from) {
+        writeError(w, "to must be after from", http.StatusBadRequest)
+        return
+    }
+    page, err := intParam(query.Get("page"), 1)
+    if err != nil || page < 1 {
+        writeError(w, "Invalid page", http.StatusBadRequest)
+        return
+    }
+    perPage, err := intParam(query.Get("per_page"), router.DefaultCallsPerPage)
+    if err != nil || perPage < 1 {
+        writeError(w, "Invalid per_page", http.StatusBadRequest)
+        return
+    }
+
+    result, err := s.router.ListCalls(r.Context(), router.CallFilter{
+        Status: models.CallState(query.Get("status")),
+        ANI:    query.Get("ani"),
+        DID:    query.Get("did"),
+        From:   from,
+        To:     to,
+    }, page, perPage)
+    switch {
+    case errors.Is(err, router.ErrUnknownStatus):
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    case err != nil:
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+func (s *Server) handleListCampaigns(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.Campaigns(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleSetCampaign(w http.ResponseWriter, r *http.Request) {
+    var c models.Campaign
+    if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+    c.ID = PathParam(r, "id")
+
+    saved, err := s.router.SetCampaign(r.Context(), c)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, saved)
+}
+
+func (s *Server) handleDeleteCampaign(w http.ResponseWriter, r *http.Request) {
+    if err := s.router.DeleteCampaign(r.Context(), PathParam(r, "id")); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCampaignStats reports per-campaign traffic, defaulting to today
+func (s *Server) handleCampaignStats(w http.ResponseWriter, r *http.Request) {
+    now := time.Now()
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+    from, err := timeParam(r.URL.Query().Get("from"), today)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    to, err := timeParam(r.URL.Query().Get("to"), now)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    stats, err := s.router.CampaignStatistics(r.Context(), from, to)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, stats)
+}
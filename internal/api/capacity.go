@@ -0,0 +1,40 @@
+package api
+
+import (
+    "net/http"
+)
+
+// handleCapacity answers "how many DIDs do we need?" either for a given load
+// (?erlangs=500) or from recent history (?days=7&hold=180), at ?target blocking
+func (s *Server) handleCapacity(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+
+    days, err := intParam(q.Get("days"), 7)
+    if err != nil || days <= 0 {
+        writeError(w, "Invalid days", http.StatusBadRequest)
+        return
+    }
+    target, err := floatParam(q.Get("target"), 0.01)
+    if err != nil || target <= 0 || target >= 1 {
+        writeError(w, "Invalid target (blocking probability between 0 and 1)", http.StatusBadRequest)
+        return
+    }
+    erlangs, err := floatParam(q.Get("erlangs"), 0)
+    if err != nil || erlangs < 0 {
+        writeError(w, "Invalid erlangs", http.StatusBadRequest)
+        return
+    }
+    hold, err := floatParam(q.Get("hold"), 0)
+    if err != nil || hold < 0 {
+        writeError(w, "Invalid hold", http.StatusBadRequest)
+        return
+    }
+
+    plan, err := s.router.CapacityPlan(r.Context(), days, erlangs, hold, target)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, plan)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+func (s *Server) handleListCarriers(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.CarrierProfiles(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleSetCarrier(w http.ResponseWriter, r *http.Request) {
+    var p models.CarrierProfile
+    if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+    p.Trunk = PathParam(r, "trunk")
+
+    saved, err := s.router.SetCarrierProfile(r.Context(), p)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, saved)
+}
+
+func (s *Server) handleDeleteCarrier(w http.ResponseWriter, r *http.Request) {
+    if err := s.router.DeleteCarrierProfile(r.Context(), PathParam(r, "trunk")); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
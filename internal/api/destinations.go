@@ -0,0 +1,53 @@
+package api
+
+import (
+    "net/http"
+    "time"
+)
+
+// handleDestinationReport reports calls and minutes per destination,
+// defaulting to the current month
+func (s *Server) handleDestinationReport(w http.ResponseWriter, r *http.Request) {
+    now := time.Now()
+    monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+
+    from, err := timeParam(r.URL.Query().Get("from"), monthStart)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    to, err := timeParam(r.URL.Query().Get("to"), now)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    report, err := s.router.DestinationReport(r.Context(), from, to)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "from":         from.Format(time.RFC3339),
+        "to":           to.Format(time.RFC3339),
+        "destinations": report,
+    })
+}
+
+// handleDestinationLookup labels ?number= from the numbering plan
+func (s *Server) handleDestinationLookup(w http.ResponseWriter, r *http.Request) {
+    number := r.URL.Query().Get("number")
+    if number == "" {
+        writeError(w, "Missing parameters", http.StatusBadRequest)
+        return
+    }
+
+    destination, ok := s.router.LookupDestination(number)
+    if !ok {
+        writeError(w, "Number not in the numbering plan", http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, destination)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+    "errors"
+    "io"
+    "net/http"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// Largest CSV accepted by /api/dids/import
+const maxImportBytes = 10 << 20
+
+// handleImportDIDs takes the CSV as the request body (text/csv) or as the
+// "file" field of a multipart form. ?tenant= and ?pool= pick the pool and
+// ?dry_run=true reports without inserting.
+func (s *Server) handleImportDIDs(w http.ResponseWriter, r *http.Request) {
+    r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+    var src io.Reader = r.Body
+    if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+        file, _, err := r.FormFile("file")
+        if err != nil {
+            writeError(w, "Missing CSV file field", http.StatusBadRequest)
+            return
+        }
+        defer file.Close()
+        src = file
+    }
+
+    query := r.URL.Query()
+    report, err := s.router.ImportDIDs(r.Context(), src, query.Get("tenant"), query.Get("pool"), query.Get("dry_run") == "true")
+    if err != nil {
+        var tooLarge *http.MaxBytesError
+        switch {
+        case errors.As(err, &tooLarge):
+            writeError(w, "CSV exceeds 10MB", http.StatusRequestEntityTooLarge)
+        case errors.Is(err, router.ErrReadOnly):
+            writeError(w, err.Error(), http.StatusServiceUnavailable)
+        default:
+            writeError(w, err.Error(), http.StatusBadRequest)
+        }
+        return
+    }
+
+    writeJSON(w, http.StatusOK, report)
+}
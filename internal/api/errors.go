@@ -0,0 +1,132 @@
+package api
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// apiError is the JSON body of every error response. Retryable tells S1
+// whether the same request can succeed later or on another S2 ("try the
+// other S2"); a terminal error fails the same way everywhere ("this call is
+// simply blocked"). RetryAfter mirrors the Retry-After header when set.
+type apiError struct {
+    Status     string `json:"status"` // always "error"
+    Error      string `json:"error"`
+    Code       string `json:"code"`
+    Retryable  bool   `json:"retryable"`
+    RetryAfter int    `json:"retry_after,omitempty"` // seconds
+}
+
+// Default classification by HTTP status for errors without a more
+// specific one
+var statusCodes = map[int]string{
+    http.StatusBadRequest:          "invalid_request",
+    http.StatusUnauthorized:        "unauthorized",
+    http.StatusForbidden:           "forbidden",
+    http.StatusNotFound:            "not_found",
+    http.StatusMethodNotAllowed:    "method_not_allowed",
+    http.StatusConflict:            "conflict",
+    http.StatusTooManyRequests:     "rate_limited",
+    http.StatusInternalServerError: "internal",
+    http.StatusBadGateway:          "upstream",
+    http.StatusServiceUnavailable:  "unavailable",
+    http.StatusGatewayTimeout:      "timeout",
+}
+
+func retryableStatus(code int) bool {
+    switch code {
+    case http.StatusConflict, http.StatusTooManyRequests, http.StatusInternalServerError,
+        http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return true
+    }
+    return false
+}
+
+// writeError is the JSON counterpart of http.Error, classifying the error
+// by its status code
+func writeError(w http.ResponseWriter, msg string, code int) {
+    name, ok := statusCodes[code]
+    if !ok {
+        name = "error"
+    }
+    writeAPIError(w, code, apiError{Error: msg, Code: name, Retryable: retryableStatus(code)})
+}
+
+func writeAPIError(w http.ResponseWriter, code int, e apiError) {
+    e.Status = "error"
+    if e.RetryAfter > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+    } else if v, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil {
+        e.RetryAfter = v
+    }
+    writeJSON(w, code, e)
+}
+
+// writeCallError answers a failed processIncoming/processReturn/hangup.
+// Call path errors are classified by cause rather than status alone, since
+// e.g. a full DID pool and a blocked destination are both a 503 to S1 but
+// only the first is worth another attempt.
+func writeCallError(w http.ResponseWriter, err error, fallback int) {
+    e := apiError{Error: err.Error()}
+    code := fallback
+
+    switch {
+    case errors.Is(err, router.ErrReadOnly):
+        // A replica; the primary S2 will take the call
+        code, e.Code, e.Retryable = http.StatusServiceUnavailable, "read_only", true
+    case errors.Is(err, router.ErrDraining):
+        // Shutting down; another S2 takes the call
+        code, e.Code, e.Retryable = http.StatusServiceUnavailable, "draining", true
+    case errors.Is(err, router.ErrCapacity):
+        // This S2 is full; another may not be
+        code, e.Code, e.Retryable, e.RetryAfter = http.StatusServiceUnavailable, "capacity", true, 1
+    case errors.Is(err, router.ErrNoAvailableDIDs):
+        code, e.Code, e.Retryable, e.RetryAfter = http.StatusServiceUnavailable, "no_available_dids", true, 1
+    case errors.Is(err, router.ErrThrottled):
+        code, e.Code, e.Retryable, e.RetryAfter = http.StatusTooManyRequests, "throttled", true, 1
+    case errors.Is(err, router.ErrCampaignLimit):
+        code, e.Code, e.Retryable, e.RetryAfter = http.StatusTooManyRequests, "campaign_limit", true, 1
+    case errors.Is(err, router.ErrCarrierLimit):
+        code, e.Code, e.Retryable, e.RetryAfter = http.StatusTooManyRequests, "carrier_limit", true, 1
+    case errors.Is(err, router.ErrDestinationUnreachable):
+        code, e.Code, e.Retryable = http.StatusServiceUnavailable, "destination_unreachable", false
+    case errors.Is(err, router.ErrBlockedCaller):
+        code, e.Code, e.Retryable = http.StatusForbidden, "blocked_caller", false
+    case errors.Is(err, router.ErrANIMismatch):
+        // S3 sent the leg back with another caller ID; it fails the same way on any S2
+        code, e.Code, e.Retryable = http.StatusForbidden, "ani_mismatch", false
+    case errors.Is(err, router.ErrUnknownTenant):
+        code, e.Code, e.Retryable = http.StatusForbidden, "unknown_tenant", false
+    case errors.Is(err, router.ErrMissingCallID):
+        code, e.Code, e.Retryable = http.StatusBadRequest, "missing_callid", false
+    case errors.Is(err, router.ErrInvalidTags):
+        code, e.Code, e.Retryable = http.StatusBadRequest, "invalid_tags", false
+    case errors.Is(err, router.ErrInvalidPool):
+        code, e.Code, e.Retryable = http.StatusBadRequest, "invalid_pool", false
+    case errors.Is(err, router.ErrInvalidSource):
+        code, e.Code, e.Retryable = http.StatusBadRequest, "invalid_source", false
+    case errors.Is(err, router.ErrCallNotFound):
+        code, e.Code, e.Retryable = http.StatusNotFound, "call_not_found", false
+    case errors.Is(err, router.ErrDIDMismatch):
+        code, e.Code, e.Retryable = http.StatusForbidden, "did_mismatch", false
+    case errors.Is(err, router.ErrMalformedNumber):
+        code, e.Code, e.Retryable = http.StatusBadRequest, "malformed_number", false
+    case errors.Is(err, router.ErrDatabaseDown):
+        // The breaker is open; an S2 with its own database may take the call
+        code, e.Code, e.Retryable, e.RetryAfter = http.StatusServiceUnavailable, "database_unavailable", true, 1
+    case errors.Is(err, context.DeadlineExceeded):
+        // The database missed the query timeout; another S2 may be healthier
+        code, e.Code, e.Retryable, e.RetryAfter = http.StatusServiceUnavailable, "database_timeout", true, 1
+    default:
+        if e.Code = statusCodes[code]; e.Code == "" {
+            e.Code = "error"
+        }
+        e.Retryable = retryableStatus(code)
+    }
+
+    writeAPIError(w, code, e)
+}
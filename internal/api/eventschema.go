@@ -0,0 +1,42 @@
+package api
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+
+    "github.com/asterisk-call-routing-v2/internal/eventschema"
+)
+
+// handleEventSchemas lists the published event schema versions and the
+// one the router emits
+func (s *Server) handleEventSchemas(w http.ResponseWriter, r *http.Request) {
+    type version struct {
+        Version int    `json:"version"`
+        URL     string `json:"url"`
+    }
+    versions := []version{}
+    for _, v := range eventschema.Versions() {
+        versions = append(versions, version{Version: v, URL: fmt.Sprintf("/api/events/schema/%d", v)})
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "current":  eventschema.Current,
+        "versions": versions,
+    })
+}
+
+// handleEventSchema serves one version's JSON Schema document
+func (s *Server) handleEventSchema(w http.ResponseWriter, r *http.Request) {
+    version, err := strconv.Atoi(PathParam(r, "version"))
+    if err != nil {
+        writeError(w, "version must be a number", http.StatusBadRequest)
+        return
+    }
+    doc, ok := eventschema.Document(version)
+    if !ok {
+        writeError(w, fmt.Sprintf("no event schema version %d", version), http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", "application/schema+json")
+    w.Write(doc)
+}
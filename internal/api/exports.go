@@ -0,0 +1,100 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "path/filepath"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// exportRequest is the body of POST /api/exports
+type exportRequest struct {
+    From      string `json:"from"` // RFC3339 or YYYY-MM-DD
+    To        string `json:"to"`
+    Format    string `json:"format"`
+    Campaign  string `json:"campaign_id"`
+    Tenant    string `json:"tenant_id"`
+    Status    string `json:"call_status"`
+    UploadURL string `json:"upload_url"`
+}
+
+// handleCreateExport queues an export and answers 202 with the job;
+// poll /api/exports/{id} until it is done, then fetch .../download
+func (s *Server) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+    var req exportRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+    from, err := timeParam(req.From, time.Time{})
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    to, err := timeParam(req.To, time.Now())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    job, err := s.router.CreateExport(models.ExportJob{
+        Format:     req.Format,
+        From:       from,
+        To:         to,
+        Campaign:   req.Campaign,
+        Tenant:     req.Tenant,
+        CallStatus: req.Status,
+        UploadURL:  req.UploadURL,
+    })
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Location", "/api/exports/"+job.ID)
+    writeJSON(w, http.StatusAccepted, job)
+}
+
+func (s *Server) handleListExports(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, s.router.Exports())
+}
+
+func (s *Server) handleGetExport(w http.ResponseWriter, r *http.Request) {
+    job, err := s.router.Export(PathParam(r, "id"))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+    path, job, err := s.router.ExportFile(PathParam(r, "id"))
+    if errors.Is(err, router.ErrExportNotReady) {
+        w.Header().Set("Retry-After", "5")
+        writeError(w, fmt.Sprintf("%v (status %s)", err, job.Status), http.StatusConflict)
+        return
+    }
+    if err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+    http.ServeFile(w, r, path)
+}
+
+func (s *Server) handleDeleteExport(w http.ResponseWriter, r *http.Request) {
+    if err := s.router.DeleteExport(PathParam(r, "id")); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
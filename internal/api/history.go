@@ -0,0 +1,61 @@
+package api
+
+import (
+    "net/http"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// GET /api/dids/{did}/history?from=&to=&limit=
+// Defaults to the last 7 days and 1000 calls
+func (s *Server) handleDIDHistory(w http.ResponseWriter, r *http.Request) {
+    did := PathParam(r, "did")
+    now := time.Now()
+
+    from, err := timeParam(r.URL.Query().Get("from"), now.AddDate(0, 0, -7))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    to, err := timeParam(r.URL.Query().Get("to"), now)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !to.After(from) {
+        writeError(w, "to must be after from", http.StatusBadRequest)
+        return
+    }
+    limit, err := intParam(r.URL.Query().Get("limit"), 1000)
+    if err != nil || limit <= 0 {
+        writeError(w, "Invalid limit", http.StatusBadRequest)
+        return
+    }
+    if limit > router.MaxHistoryCalls {
+        limit = router.MaxHistoryCalls
+    }
+
+    calls, dispositions, err := s.router.DIDHistory(r.Context(), did, from, to, limit)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    notes, err := s.router.Notes(r.Context(), router.NoteDID, did)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "did":          did,
+        "notes":        notes,
+        "from":         from.Format(time.RFC3339),
+        "to":           to.Format(time.RFC3339),
+        "count":        len(calls),
+        "truncated":    len(calls) >= limit,
+        "dispositions": dispositions,
+        "calls":        calls,
+    })
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+)
+
+const liveFeedPing = 30 * time.Second
+
+// handleCallFeed upgrades to a WebSocket and pushes the active calls as a
+// snapshot message, then one message per call added, updated or removed.
+// An update for a call missing from the snapshot (e.g. one picked up from
+// another instance) should be treated as an addition. The server closes
+// the socket when the client falls behind; reconnecting sends a fresh
+// snapshot. Browsers pass the API key as ?apikey=.
+func (s *Server) handleCallFeed(w http.ResponseWriter, r *http.Request) {
+    ws, err := upgradeWebSocket(w, r)
+    if err != nil {
+        logger.Warnf("Live call feed from %s refused: %v", r.RemoteAddr, err)
+        return
+    }
+    defer ws.Close()
+
+    snapshot, updates, cancel := s.router.SubscribeCalls()
+    defer cancel()
+    logger.Infof("Live call feed opened by %s, %d active calls", r.RemoteAddr, len(snapshot.Calls))
+
+    closed := make(chan error, 1)
+    go func() { closed <- ws.Discard() }()
+
+    send := func(v interface{}) bool {
+        msg, _ := json.Marshal(v)
+        if err := ws.WriteText(msg); err != nil {
+            logger.Warnf("Live call feed to %s failed: %v", r.RemoteAddr, err)
+            return false
+        }
+        return true
+    }
+    if !send(snapshot) {
+        return
+    }
+
+    ping := time.NewTicker(liveFeedPing)
+    defer ping.Stop()
+    for {
+        select {
+        case update, ok := <-updates:
+            if !ok {
+                logger.Warnf("Live call feed to %s dropped: client fell behind", r.RemoteAddr)
+                return
+            }
+            if !send(update) {
+                return
+            }
+        case <-ping.C:
+            if err := ws.Ping(); err != nil {
+                return
+            }
+        case <-closed:
+            logger.Infof("Live call feed closed by %s", r.RemoteAddr)
+            return
+        }
+    }
+}
@@ -0,0 +1,359 @@
+package api
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "runtime/debug"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/jwt"
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/ratelimit"
+)
+
+var (
+    httpRequests = metrics.NewCounter("s2_http_requests_total",
+        "HTTP requests by route, method and status code", "route", "method", "code")
+    httpDuration = metrics.NewHistogram("s2_http_request_duration_seconds",
+        "HTTP request latency by route", nil, "route")
+    httpPanics = metrics.NewCounter("s2_http_panics_total",
+        "Handler panics caught by the recovery middleware")
+    httpRateLimited = metrics.NewCounter("s2_http_rate_limited_total",
+        "Requests rejected by the rate limiter")
+    httpClientRateLimited = metrics.NewCounter("s2_http_client_rate_limited_total",
+        "Requests rejected by the per-client rate limiter, by what identified the client (token, apikey or ip)", "by")
+)
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+    http.ResponseWriter
+    status      int
+    wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+    if !sr.wroteHeader {
+        sr.status = code
+        sr.wroteHeader = true
+    }
+    sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+    if !sr.wroteHeader {
+        sr.WriteHeader(http.StatusOK)
+    }
+    return sr.ResponseWriter.Write(b)
+}
+
+// Hijack passes the connection through to WebSocket handlers
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    h, ok := sr.ResponseWriter.(http.Hijacker)
+    if !ok {
+        return nil, nil, fmt.Errorf("connection cannot be hijacked")
+    }
+    sr.status, sr.wroteHeader = http.StatusSwitchingProtocols, true
+    return h.Hijack()
+}
+
+func recoveryMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        defer func() {
+            if rec := recover(); rec != nil {
+                if rec == http.ErrAbortHandler {
+                    panic(rec)
+                }
+                httpPanics.Inc()
+                logger.Errorf("PANIC in %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+                writeError(w, "Internal server error", http.StatusInternalServerError)
+            }
+        }()
+        next.ServeHTTP(w, r)
+    })
+}
+
+// headerRequestID carries the correlation ID of a request. S1 may send its
+// own so one ID follows a call through S1, S2 and S3; otherwise one is
+// generated. Either way it is echoed in the response, tagged on the log
+// lines of the request and stored with the call's timeline and events.
+const headerRequestID = "X-Request-ID"
+
+const maxRequestIDLen = 128
+
+func requestIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(headerRequestID)
+        if !validRequestID(id) {
+            id = newRequestID()
+        }
+        w.Header().Set(headerRequestID, id)
+        next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+    })
+}
+
+// validRequestID accepts up to maxRequestIDLen visible ASCII characters, so
+// a client's ID cannot break log lines or the column it is stored in
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLen {
+        return false
+    }
+    for i := 0; i < len(id); i++ {
+        if id[i] <= ' ' || id[i] > '~' {
+            return false
+        }
+    }
+    return true
+}
+
+func newRequestID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        logger.Context(r.Context()).Infof("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+        next.ServeHTTP(w, r)
+    })
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        req, mr := withRouteCapture(r)
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+        defer func() {
+            route := mr.pattern
+            if route == "" {
+                route = "unmatched"
+            }
+            httpRequests.Inc(route, r.Method, strconv.Itoa(rec.status))
+            httpDuration.ObserveExemplar(time.Since(start).Seconds(), mr.traceID, route)
+        }()
+
+        next.ServeHTTP(rec, req)
+    })
+}
+
+// setTraceExemplar attaches a trace ID to the request's latency observation
+func setTraceExemplar(r *http.Request, traceID string) {
+    if mr, ok := r.Context().Value(routeKey{}).(*matchedRoute); ok {
+        mr.traceID = traceID
+    }
+}
+
+func corsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Access-Control-Allow-Origin", "*")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Request-ID")
+        w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
+        if r.Method == "OPTIONS" {
+            w.WriteHeader(http.StatusOK)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// authMiddleware requires the shared API key in the X-API-Key header or the
+// apikey query parameter (easier to pass from dialplan CURL()). An empty key
+// disables the check.
+func authMiddleware(apiKey string) Middleware {
+    return func(next http.Handler) http.Handler {
+        if apiKey == "" {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            key := r.Header.Get("X-API-Key")
+            if key == "" {
+                key = r.URL.Query().Get("apikey")
+            }
+            if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) != 1 {
+                logger.Warnf("Unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+                writeError(w, "Unauthorized", http.StatusUnauthorized)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+type tokenKey struct{}
+
+// adminAuthMiddleware guards the admin surface. With JWT keys configured
+// it requires a bearer token in the Authorization header, or the
+// access_token query parameter for browser WebSockets, that cannot set
+// one; the API key then only opens the dialplan callbacks. Without keys
+// the admin routes fall back to the API key.
+func adminAuthMiddleware(keys *jwt.KeySet, apiKey string) Middleware {
+    if keys == nil {
+        return authMiddleware(apiKey)
+    }
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            token := r.URL.Query().Get("access_token")
+            if h := r.Header.Get("Authorization"); h != "" {
+                scheme, value, _ := strings.Cut(h, " ")
+                if !strings.EqualFold(scheme, "Bearer") {
+                    writeError(w, "Bearer token required", http.StatusUnauthorized)
+                    return
+                }
+                token = strings.TrimSpace(value)
+            }
+            if token == "" {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="s2"`)
+                writeError(w, "Bearer token required", http.StatusUnauthorized)
+                return
+            }
+            claims, err := keys.Verify(token, time.Now())
+            if err != nil {
+                logger.Context(r.Context()).Warnf("Unauthorized %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+                w.Header().Set("WWW-Authenticate", `Bearer realm="s2", error="invalid_token"`)
+                writeError(w, "Unauthorized", http.StatusUnauthorized)
+                return
+            }
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, claims)))
+        })
+    }
+}
+
+// tokenClaims returns the claims of the bearer token a request was
+// admitted with, nil under API key auth
+func tokenClaims(r *http.Request) *jwt.Claims {
+    claims, _ := r.Context().Value(tokenKey{}).(*jwt.Claims)
+    return claims
+}
+
+// rateLimitMiddleware caps the request rate across all clients and every
+// route it wraps. A rate of zero disables limiting.
+func rateLimitMiddleware(rate float64, burst int) Middleware {
+    bucket := ratelimit.NewBucket(rate, burst, nil)
+    return func(next http.Handler) http.Handler {
+        if rate <= 0 {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if !bucket.Allow() {
+                httpRateLimited.Inc()
+                w.Header().Set("Retry-After", "1")
+                writeError(w, "Too many requests", http.StatusTooManyRequests)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// What the per-client rate limiter tells clients apart by
+const (
+    ClientRateByIP  = "ip"     // source address
+    ClientRateByKey = "apikey" // bearer token subject or API key, then source address
+)
+
+// clientRateLimitMiddleware gives every client its own rate and burst, so
+// one misbehaving S1 is refused before it can drain the shared limiter,
+// the DID pool or MySQL for the others. A rate of zero disables it.
+func clientRateLimitMiddleware(rate float64, burst int, by string) Middleware {
+    buckets := ratelimit.NewKeyed(rate, burst, nil)
+    retryAfter := "1"
+    if rate > 0 && rate < 1 {
+        retryAfter = strconv.Itoa(int(math.Ceil(1 / rate)))
+    }
+    return func(next http.Handler) http.Handler {
+        if rate <= 0 {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            kind, client := clientIdentity(r, by)
+            ok, rejected := buckets.Allow(kind + ":" + client)
+            if !ok {
+                httpClientRateLimited.Inc(kind)
+                // Once per burst of refusals, not once per request
+                if rejected == 1 {
+                    logger.Context(r.Context()).Warnf("Rate limiting %s %s: over %g requests per second", kind, redactClient(kind, client), rate)
+                }
+                w.Header().Set("Retry-After", retryAfter)
+                writeError(w, "Too many requests", http.StatusTooManyRequests)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// clientIdentity names the client a request counts against
+func clientIdentity(r *http.Request, by string) (kind, client string) {
+    if by == ClientRateByKey {
+        if claims := tokenClaims(r); claims != nil {
+            return "token", claims.Subject
+        }
+        key := r.Header.Get("X-API-Key")
+        if key == "" {
+            key = r.URL.Query().Get("apikey")
+        }
+        if key != "" {
+            return "apikey", key
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return "ip", host
+}
+
+// redactClient keeps API keys out of the logs
+func redactClient(kind, client string) string {
+    if kind != "apikey" {
+        return client
+    }
+    if len(client) > 4 {
+        client = client[:4]
+    }
+    return client + "..."
+}
+
+// featureTablesMiddleware refuses the features whose tables the storage
+// backend does not have
+func featureTablesMiddleware(available bool) Middleware {
+    return func(next http.Handler) http.Handler {
+        if available {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            writeError(w, "not available on this storage driver, it needs mysql", http.StatusNotImplemented)
+        })
+    }
+}
+
+// readOnlyMiddleware refuses every method that could change state while the
+// router runs against a replica
+func readOnlyMiddleware(enabled bool) Middleware {
+    return func(next http.Handler) http.Handler {
+        if !enabled {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+                writeError(w, "router is in read-only mode", http.StatusServiceUnavailable)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// Largest batch accepted by /api/migrate/v1; routerctl sends far smaller
+const maxV1BatchBytes = 32 << 20
+
+// handleImportV1 takes a batch of a v1 router database as JSON, as sent by
+// routerctl migrate v1. ?dry_run=true reports without writing.
+func (s *Server) handleImportV1(w http.ResponseWriter, r *http.Request) {
+    r.Body = http.MaxBytesReader(w, r.Body, maxV1BatchBytes)
+
+    var batch models.V1Batch
+    if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            writeError(w, "Batch exceeds 32MB", http.StatusRequestEntityTooLarge)
+            return
+        }
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    report, err := s.router.ImportV1(r.Context(), &batch, r.URL.Query().Get("dry_run") == "true")
+    if err != nil {
+        logger.Errorf("ImportV1 error: %v", err)
+        code := http.StatusInternalServerError
+        if errors.Is(err, router.ErrReadOnly) {
+            code = http.StatusServiceUnavailable
+        }
+        writeError(w, err.Error(), code)
+        return
+    }
+    writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+// Where the signaling path crosses untrusted networks, S1 and S3 present
+// client certificates signed by the configured CA bundle. The handshake
+// verifies any certificate a client offers and refuses common names off
+// the allowlist; the /api routes then require one in TLSClientAuthRequire
+// mode. The unauthenticated probes (/api/health, /api/load, /metrics) stay
+// open to load balancers and the watchdog, as without mTLS.
+const (
+    TLSClientAuthRequire  = "require"
+    TLSClientAuthOptional = "optional" // verify certificates given, admit clients without one
+)
+
+var tlsClientRejected = metrics.NewCounter("s2_tls_client_rejected_total",
+    "Clients refused by mutual TLS by reason (cn, missing)", "reason")
+
+func loadCAs(file string) (*x509.CertPool, error) {
+    pem, err := os.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("no certificates in %s", file)
+    }
+    return pool, nil
+}
+
+// mutualTLS makes cfg verify client certificates against the current CA
+// bundle and the CN allowlist
+func (s *Server) mutualTLS(cfg *tls.Config) {
+    cfg.ClientAuth = tls.VerifyClientCertIfGiven
+    cfg.VerifyConnection = s.verifyClientCN
+    cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+        // Each handshake gets the bundle loaded last
+        c := cfg.Clone()
+        c.GetConfigForClient = nil
+        s.certs.mu.RLock()
+        c.ClientCAs = s.certs.clientCAs
+        s.certs.mu.RUnlock()
+        return c, nil
+    }
+}
+
+func (s *Server) verifyClientCN(cs tls.ConnectionState) error {
+    return verifyCN(cs, s.config.TLSClientCNs)
+}
+
+// verifyCN refuses a peer certificate whose common name is not in cns,
+// when cns is set
+func verifyCN(cs tls.ConnectionState, cns []string) error {
+    if len(cs.PeerCertificates) == 0 || len(cns) == 0 {
+        return nil
+    }
+    cn := cs.PeerCertificates[0].Subject.CommonName
+    for _, allowed := range cns {
+        if cn == allowed {
+            return nil
+        }
+    }
+    tlsClientRejected.Inc("cn")
+    logger.Warnf("Refused TLS peer %q: CN not allowlisted", cn)
+    return errors.New("peer certificate CN not allowed")
+}
+
+// PeerTLS is the mutual TLS config for connections between routers, such
+// as call-state replication, built from the API's settings: each side
+// presents the API certificate and verifies the other's against the
+// client CA bundle and CN allowlist. Unlike the API's, the files are read
+// once, so a rotation reaches these connections on restart.
+func PeerTLS(certFile, keyFile, caFile string, cns []string) (*tls.Config, error) {
+    if certFile == "" || keyFile == "" || caFile == "" {
+        return nil, errors.New("mutual TLS between routers needs a certificate, a key and a client CA bundle")
+    }
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return nil, err
+    }
+    pool, err := loadCAs(caFile)
+    if err != nil {
+        return nil, err
+    }
+    return &tls.Config{
+        MinVersion:       tls.VersionTLS12,
+        Certificates:     []tls.Certificate{cert},
+        RootCAs:          pool,
+        ClientCAs:        pool,
+        ClientAuth:       tls.RequireAndVerifyClientCert,
+        VerifyConnection: func(cs tls.ConnectionState) error { return verifyCN(cs, cns) },
+    }, nil
+}
+
+// clientCertMiddleware answers 403 to requests that did not come with a
+// verified client certificate. It does nothing unless mTLS is required.
+func clientCertMiddleware(required bool) Middleware {
+    return func(next http.Handler) http.Handler {
+        if !required {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+                tlsClientRejected.Inc("missing")
+                logger.Context(r.Context()).Warnf("Refused %s %s from %s: no client certificate", r.Method, r.URL.Path, r.RemoteAddr)
+                writeError(w, "Client certificate required", http.StatusForbidden)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
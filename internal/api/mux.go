@@ -0,0 +1,184 @@
+package api
+
+import (
+    "context"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middleware so the first one listed runs outermost
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+    for i := len(mws) - 1; i >= 0; i-- {
+        h = mws[i](h)
+    }
+    return h
+}
+
+// Mux is a small stdlib router supporting method matching, {name} path
+// parameters and route groups with their own middleware
+type Mux struct {
+    routes     []*route
+    middleware []Middleware
+    handler    http.Handler // dispatch wrapped in middleware, rebuilt by Use
+}
+
+type route struct {
+    pattern  string
+    segments []string
+    methods  map[string]bool
+    handler  http.Handler
+}
+
+type paramsKey struct{}
+
+type routeKey struct{}
+
+// matchedRoute lets outer middleware learn which pattern served a request
+type matchedRoute struct {
+    pattern string
+    traceID string // exemplar for the latency histogram, set by the handler
+}
+
+func NewMux() *Mux {
+    m := &Mux{}
+    m.handler = http.HandlerFunc(m.dispatch)
+    return m
+}
+
+// Use adds middleware that runs for every request, including unmatched ones
+func (m *Mux) Use(mws ...Middleware) {
+    m.middleware = append(m.middleware, mws...)
+    m.handler = Chain(http.HandlerFunc(m.dispatch), m.middleware...)
+}
+
+func (m *Mux) Handle(pattern string, h http.Handler, methods ...string) {
+    rt := &route{
+        pattern:  pattern,
+        segments: splitPath(pattern),
+        handler:  h,
+    }
+    if len(methods) > 0 {
+        rt.methods = make(map[string]bool, len(methods))
+        for _, method := range methods {
+            rt.methods[method] = true
+        }
+    }
+    m.routes = append(m.routes, rt)
+}
+
+func (m *Mux) HandleFunc(pattern string, f http.HandlerFunc, methods ...string) {
+    m.Handle(pattern, f, methods...)
+}
+
+// Group returns a route group rooted at prefix
+func (m *Mux) Group(prefix string, mws ...Middleware) *Group {
+    return &Group{mux: m, prefix: strings.TrimSuffix(prefix, "/"), middleware: mws}
+}
+
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    m.handler.ServeHTTP(w, r)
+}
+
+func (m *Mux) dispatch(w http.ResponseWriter, r *http.Request) {
+    path := splitPath(r.URL.Path)
+    var allowed []string
+
+    for _, rt := range m.routes {
+        params, ok := rt.match(path)
+        if !ok {
+            continue
+        }
+        if rt.methods != nil && !rt.methods[r.Method] {
+            for method := range rt.methods {
+                allowed = append(allowed, method)
+            }
+            continue
+        }
+        if mr, ok := r.Context().Value(routeKey{}).(*matchedRoute); ok {
+            mr.pattern = rt.pattern
+        }
+        if len(params) > 0 {
+            r = r.WithContext(context.WithValue(r.Context(), paramsKey{}, params))
+        }
+        rt.handler.ServeHTTP(w, r)
+        return
+    }
+
+    if len(allowed) > 0 {
+        sort.Strings(allowed)
+        w.Header().Set("Allow", strings.Join(allowed, ", "))
+        writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    http.NotFound(w, r)
+}
+
+func (rt *route) match(path []string) (map[string]string, bool) {
+    if len(path) != len(rt.segments) {
+        return nil, false
+    }
+    var params map[string]string
+    for i, seg := range rt.segments {
+        if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+            if params == nil {
+                params = make(map[string]string)
+            }
+            params[seg[1:len(seg)-1]] = path[i]
+            continue
+        }
+        if seg != path[i] {
+            return nil, false
+        }
+    }
+    return params, true
+}
+
+// PathParam returns the value of a {name} segment matched for this request
+func PathParam(r *http.Request, name string) string {
+    params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+    return params[name]
+}
+
+// withRouteCapture returns a request that records the pattern dispatch matched
+func withRouteCapture(r *http.Request) (*http.Request, *matchedRoute) {
+    mr := &matchedRoute{}
+    return r.WithContext(context.WithValue(r.Context(), routeKey{}, mr)), mr
+}
+
+// Group registers routes under a common prefix with shared middleware
+type Group struct {
+    mux        *Mux
+    prefix     string
+    middleware []Middleware
+}
+
+// Use adds middleware to routes registered on the group afterwards
+func (g *Group) Use(mws ...Middleware) {
+    g.middleware = append(g.middleware, mws...)
+}
+
+// Group nests a sub-group that inherits this group's middleware
+func (g *Group) Group(prefix string, mws ...Middleware) *Group {
+    inherited := append(append([]Middleware(nil), g.middleware...), mws...)
+    return &Group{mux: g.mux, prefix: g.prefix + strings.TrimSuffix(prefix, "/"), middleware: inherited}
+}
+
+func (g *Group) Handle(pattern string, h http.Handler, methods ...string) {
+    g.mux.Handle(g.prefix+pattern, Chain(h, g.middleware...), methods...)
+}
+
+func (g *Group) HandleFunc(pattern string, f http.HandlerFunc, methods ...string) {
+    g.Handle(pattern, f, methods...)
+}
+
+func splitPath(p string) []string {
+    p = strings.Trim(p, "/")
+    if p == "" {
+        return nil
+    }
+    return strings.Split(p, "/")
+}
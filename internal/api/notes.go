@@ -0,0 +1,71 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+type noteRequest struct {
+    Author string `json:"author"`
+    Body   string `json:"body"`
+}
+
+// handleListNotes serves the notes of the call or DID named by path param
+func (s *Server) handleListNotes(subject, param string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        notes, err := s.router.Notes(r.Context(), subject, PathParam(r, param))
+        if err != nil {
+            writeError(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        writeJSON(w, http.StatusOK, notes)
+    }
+}
+
+// handleAddNote attaches {"author": ..., "body": ...} to the call or DID
+// named by path param
+func (s *Server) handleAddNote(subject, param string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req noteRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, "Invalid JSON body", http.StatusBadRequest)
+            return
+        }
+        // Token holders are identified; the author defaults to them
+        if claims := tokenClaims(r); claims != nil && req.Author == "" {
+            req.Author = claims.Subject
+        }
+
+        note, err := s.router.AddNote(r.Context(), subject, PathParam(r, param), req.Author, req.Body)
+        if err != nil {
+            code := http.StatusBadRequest
+            if errors.Is(err, router.ErrNoteSubjectNotFound) {
+                code = http.StatusNotFound
+            }
+            writeError(w, err.Error(), code)
+            return
+        }
+
+        writeJSON(w, http.StatusCreated, note)
+    }
+}
+
+func (s *Server) handleDeleteNote(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(PathParam(r, "id"), 10, 64)
+    if err != nil {
+        writeError(w, "Invalid id", http.StatusBadRequest)
+        return
+    }
+
+    if err := s.router.DeleteNote(r.Context(), id); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// overrideRequest is a routing override with its lifetime, e.g. "2h"
+type overrideRequest struct {
+    models.RoutingOverride
+    Duration string `json:"duration"`
+}
+
+func (s *Server) handleListOverrides(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.Overrides(r.Context(), r.URL.Query().Get("all") == "true")
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleCreateOverride(w http.ResponseWriter, r *http.Request) {
+    var req overrideRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    duration, err := time.ParseDuration(req.Duration)
+    if err != nil {
+        writeError(w, "duration must be a Go duration such as 2h or 30m", http.StatusBadRequest)
+        return
+    }
+
+    created, err := s.router.CreateOverride(r.Context(), req.RoutingOverride, duration)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) handleCancelOverride(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(PathParam(r, "id"), 10, 64)
+    if err != nil {
+        writeError(w, "Invalid id", http.StatusBadRequest)
+        return
+    }
+
+    if err := s.router.CancelOverride(r.Context(), id, r.URL.Query().Get("by")); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleOverrideAudit(w http.ResponseWriter, r *http.Request) {
+    limit, err := intParam(r.URL.Query().Get("limit"), 100)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    list, err := s.router.OverrideAudit(r.Context(), limit)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+func intParam(v string, def int) (int, error) {
+    if v == "" {
+        return def, nil
+    }
+    return strconv.Atoi(v)
+}
+
+func floatParam(v string, def float64) (float64, error) {
+    if v == "" {
+        return def, nil
+    }
+    return strconv.ParseFloat(v, 64)
+}
+
+// timeParam accepts RFC3339 timestamps or plain dates (YYYY-MM-DD, local time)
+func timeParam(v string, def time.Time) (time.Time, error) {
+    if v == "" {
+        return def, nil
+    }
+    if t, err := time.Parse(time.RFC3339, v); err == nil {
+        return t, nil
+    }
+    if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+        return t, nil
+    }
+    return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339 or YYYY-MM-DD", v)
+}
+
+// traceParam reads a trace context value from the query string, where the
+// dialplan puts it, falling back to the HTTP header of the same name
+func traceParam(r *http.Request, name string) string {
+    if v := r.URL.Query().Get(name); v != "" {
+        return v
+    }
+    return r.Header.Get(name)
+}
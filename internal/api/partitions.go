@@ -0,0 +1,59 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+func (s *Server) handleListPartitions(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.S1Partitions(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "partitions": s.router.PartitionCount(),
+        "sources":    list,
+    })
+}
+
+// handleSetPartition assigns the S1 source to the partition in a
+// {"partition": n} body
+func (s *Server) handleSetPartition(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Partition *int `json:"partition"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Partition == nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    saved, err := s.router.SetS1Partition(r.Context(), PathParam(r, "source"), *body.Partition)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, saved)
+}
+
+func (s *Server) handleDeletePartition(w http.ResponseWriter, r *http.Request) {
+    if err := s.router.DeleteS1Partition(r.Context(), PathParam(r, "source")); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDIDSource names the S1 sources whose partition holds the DID
+func (s *Server) handleDIDSource(w http.ResponseWriter, r *http.Request) {
+    src, err := s.router.DIDSource(PathParam(r, "did"))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, src)
+}
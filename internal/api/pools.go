@@ -0,0 +1,33 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+func (s *Server) handleListPools(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.DIDPools(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+// handleAssignPoolDIDs moves the DIDs in a JSON array body into the pool
+func (s *Server) handleAssignPoolDIDs(w http.ResponseWriter, r *http.Request) {
+    var dids []string
+    if err := json.NewDecoder(r.Body).Decode(&dids); err != nil {
+        writeError(w, "body must be a JSON array of DIDs", http.StatusBadRequest)
+        return
+    }
+
+    moved, err := s.router.AssignPoolDIDs(r.Context(), PathParam(r, "pool"), dids)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]int{"assigned": moved})
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// handleListProvisioning lists DID provisioning requests, optionally
+// ?status=PENDING_APPROVAL, with this month's budget
+func (s *Server) handleListProvisioning(w http.ResponseWriter, r *http.Request) {
+    limit := 100
+    if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+        limit = v
+    }
+    requests, err := s.router.ProvisioningRequests(r.Context(), r.URL.Query().Get("status"), limit)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    budget, err := s.router.ProvisioningBudget(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "requests": requests,
+        "budget":   budget,
+    })
+}
+
+// handleDecideProvisioning approves or rejects a request held for
+// approval; ?by= records who decided
+func (s *Server) handleDecideProvisioning(approve bool) http.HandlerFunc {
+    status := "rejected"
+    if approve {
+        status = "approved"
+    }
+    return func(w http.ResponseWriter, r *http.Request) {
+        id, err := strconv.ParseInt(PathParam(r, "id"), 10, 64)
+        if err != nil {
+            writeError(w, "Invalid id", http.StatusBadRequest)
+            return
+        }
+
+        if err := s.router.DecideProvisioning(r.Context(), id, approve, r.URL.Query().Get("by")); err != nil {
+            logger.Errorf("DecideProvisioning error: %v", err)
+            code := http.StatusInternalServerError
+            switch {
+            case errors.Is(err, router.ErrProvisioningRequestNotFound):
+                code = http.StatusNotFound
+            case errors.Is(err, router.ErrReadOnly):
+                code = http.StatusServiceUnavailable
+            }
+            writeError(w, err.Error(), code)
+            return
+        }
+
+        writeJSON(w, http.StatusOK, map[string]interface{}{
+            "status": status,
+            "id":     id,
+        })
+    }
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+    "net/http"
+)
+
+// GET /api/dids/quarantined
+func (s *Server) handleListQuarantined(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.QuarantinedDIDs(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+// DELETE /api/dids/{did}/quarantine returns the DID to the pool early
+func (s *Server) handleLiftQuarantine(w http.ResponseWriter, r *http.Request) {
+    did := PathParam(r, "did")
+    lifted, err := s.router.LiftQuarantine(r.Context(), did)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !lifted {
+        writeError(w, "DID "+did+" is not in quarantine", http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+func (s *Server) handleListDIDRanges(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.DIDRanges(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleAddDIDRange(w http.ResponseWriter, r *http.Request) {
+    var rg models.DIDRange
+    if err := json.NewDecoder(r.Body).Decode(&rg); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    created, err := s.router.AddDIDRange(r.Context(), rg)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) handleDeleteDIDRange(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(PathParam(r, "id"), 10, 64)
+    if err != nil {
+        writeError(w, "Invalid id", http.StatusBadRequest)
+        return
+    }
+
+    if err := s.router.DeleteDIDRange(r.Context(), id); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
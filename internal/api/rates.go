@@ -0,0 +1,87 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+func (s *Server) handleListRates(w http.ResponseWriter, r *http.Request) {
+    rates, err := s.router.Rates(r.Context(), r.URL.Query().Get("trunk"))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, rates)
+}
+
+// handleEffectiveRates previews the deck as it will stand at ?at=, defaulting to now
+func (s *Server) handleEffectiveRates(w http.ResponseWriter, r *http.Request) {
+    at, err := timeParam(r.URL.Query().Get("at"), time.Now())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "at":    at.Format(time.RFC3339),
+        "rates": s.router.RatesAt(r.URL.Query().Get("trunk"), at),
+    })
+}
+
+// handleRateLookup returns the rate a call to ?dnis= on ?trunk= would be billed at
+func (s *Server) handleRateLookup(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    if q.Get("trunk") == "" || q.Get("dnis") == "" {
+        writeError(w, "Missing parameters", http.StatusBadRequest)
+        return
+    }
+    at, err := timeParam(q.Get("at"), time.Now())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    rate, ok := s.router.RateFor(q.Get("trunk"), q.Get("dnis"), at)
+    if !ok {
+        writeError(w, "No rate in effect", http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, rate)
+}
+
+func (s *Server) handleAddRate(w http.ResponseWriter, r *http.Request) {
+    var rate models.Rate
+    if err := json.NewDecoder(r.Body).Decode(&rate); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    created, err := s.router.AddRate(r.Context(), rate)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) handleDeleteRate(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(PathParam(r, "id"), 10, 64)
+    if err != nil {
+        writeError(w, "Invalid id", http.StatusBadRequest)
+        return
+    }
+
+    if err := s.router.DeleteRate(r.Context(), id); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
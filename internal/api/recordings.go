@@ -0,0 +1,40 @@
+package api
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// handleRecordingMeta serves the checksum and size stored for a call's
+// recording, with the outcome of its last verification
+func (s *Server) handleRecordingMeta(w http.ResponseWriter, r *http.Request) {
+    meta, err := s.router.RecordingMeta(r.Context(), PathParam(r, "callid"))
+    if err != nil {
+        code := http.StatusInternalServerError
+        if errors.Is(err, router.ErrNoRecordingMeta) {
+            code = http.StatusNotFound
+        }
+        writeError(w, err.Error(), code)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, meta)
+}
+
+// handleVerifyRecording checks a call's recording against its stored
+// checksum. A failed check is still a 200; status says what was found.
+func (s *Server) handleVerifyRecording(w http.ResponseWriter, r *http.Request) {
+    result, err := s.router.VerifyRecording(r.Context(), PathParam(r, "callid"))
+    if err != nil {
+        code := http.StatusInternalServerError
+        if errors.Is(err, router.ErrNoRecordingMeta) {
+            code = http.StatusNotFound
+        }
+        writeError(w, err.Error(), code)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, result)
+}
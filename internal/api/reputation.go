@@ -0,0 +1,50 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+func (s *Server) handleGetReputation(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, s.router.Reputation(PathParam(r, "ani")))
+}
+
+func (s *Server) handleAddComplaint(w http.ResponseWriter, r *http.Request) {
+    var body struct {
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    ani := PathParam(r, "ani")
+    if err := s.router.AddComplaint(r.Context(), ani, body.Reason); err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, s.router.Reputation(ani))
+}
+
+// handleLowReputation lists A-numbers scoring below ?below=, worst first
+func (s *Server) handleLowReputation(w http.ResponseWriter, r *http.Request) {
+    below, err := floatParam(r.URL.Query().Get("below"), 30)
+    if err != nil {
+        writeError(w, "Invalid below", http.StatusBadRequest)
+        return
+    }
+    limit, err := intParam(r.URL.Query().Get("limit"), 100)
+    if err != nil || limit <= 0 {
+        writeError(w, "Invalid limit", http.StatusBadRequest)
+        return
+    }
+
+    list, err := s.router.LowReputation(r.Context(), below, limit)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// handleSchema compares the live database schema with the expected one
+// and lists the drift with a suggested fix for each
+func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
+    report, err := s.router.CheckSchema(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeJSON(w, http.StatusOK, report)
+}
+
+// handleRepairSchema applies the safe fixes and returns the schema after
+// them; the others are left for a DBA to review
+func (s *Server) handleRepairSchema(w http.ResponseWriter, r *http.Request) {
+    report, err := s.router.RepairSchema(r.Context())
+    if err != nil {
+        logger.Errorf("RepairSchema error: %v", err)
+        code := http.StatusInternalServerError
+        if errors.Is(err, router.ErrReadOnly) {
+            code = http.StatusServiceUnavailable
+        }
+        writeError(w, err.Error(), code)
+        return
+    }
+    writeJSON(w, http.StatusOK, report)
+}
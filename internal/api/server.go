@@ -1,134 +1,479 @@
 package api
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
-    "log"
+    "net"
     "net/http"
+    "sync"
+    "sync/atomic"
     "time"
     
-    "github.com/gorilla/mux"
+    "github.com/asterisk-call-routing-v2/internal/jwt"
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
     "github.com/asterisk-call-routing-v2/internal/router"
 )
 
+var logger = logging.New("api")
+
 type Server struct {
-    router *router.Router
-    port   int
+    router  *router.Router
+    config  Config
+    handler http.Handler
+    certs   *certReloader // nil unless serving HTTPS
+    conns   int64 // open HTTP connections, for watchdog diagnostics
+
+    mu     sync.Mutex
+    http   *http.Server // replaced when the watchdog restarts the listener
+    closed bool
+}
+
+// Config controls the HTTP listener and its middleware chain
+type Config struct {
+    Port      int
+    APIKey    string  // shared key for dialplan callbacks (and admin routes without JWT), empty disables auth
+    RateLimit float64 // requests per second across /api routes, 0 disables
+    RateBurst int
+
+    ClientRateLimit float64 // requests per second per client across /api routes, 0 disables
+    ClientRateBurst int
+    ClientRateBy    string // ClientRateByIP (default) or ClientRateByKey
+
+    AllowedSources []*net.IPNet // clients allowed to call processIncoming/processReturn, empty allows all
+
+    TLSCert           string        // PEM certificate (chain) to serve HTTPS with, empty serves HTTP
+    TLSKey            string        // PEM private key of TLSCert
+    TLSReloadInterval time.Duration // how often the files are checked for changes, 0 only reloads on ReloadTLS
+    TLSClientCA       string        // CA bundle client certificates are verified against, empty disables mTLS
+    TLSClientCNs      []string      // client certificate common names admitted, empty admits any the CA signed
+    TLSClientAuth     string        // TLSClientAuthRequire (default) or TLSClientAuthOptional
+
+    ReadTimeout  time.Duration // 0 means 15s
+    WriteTimeout time.Duration // 0 means 15s
+
+    WatchdogInterval time.Duration // between loopback self-requests, 0 disables the watchdog
+    WatchdogTimeout  time.Duration // 0 means 5s
+    WatchdogFailures int           // failed self-requests in a row before acting, 0 means 3
+    WatchdogAction   string        // log, restart or exit; empty means log
+
+    JWT           *jwt.KeySet   // verifies bearer tokens on the admin routes, nil leaves them on APIKey
+    JWTTTL        time.Duration // lifetime of tokens refreshed through /api/auth/token, 0 means 1h
+    JWTMaxSession time.Duration // age of the first token past which refreshing stops, 0 never stops
 }
 
-func NewServer(r *router.Router, port int) *Server {
-    return &Server{
+func NewServer(r *router.Router, cfg Config) *Server {
+    if cfg.ReadTimeout <= 0 {
+        cfg.ReadTimeout = 15 * time.Second
+    }
+    if cfg.WriteTimeout <= 0 {
+        cfg.WriteTimeout = 15 * time.Second
+    }
+    if cfg.WatchdogTimeout <= 0 {
+        cfg.WatchdogTimeout = 5 * time.Second
+    }
+    if cfg.WatchdogFailures <= 0 {
+        cfg.WatchdogFailures = 3
+    }
+    if cfg.WatchdogAction == "" {
+        cfg.WatchdogAction = WatchdogLog
+    }
+    if cfg.JWTTTL <= 0 {
+        cfg.JWTTTL = time.Hour
+    }
+    if cfg.ClientRateBy == "" {
+        cfg.ClientRateBy = ClientRateByIP
+    }
+    if cfg.TLSClientCA != "" && cfg.TLSClientAuth == "" {
+        cfg.TLSClientAuth = TLSClientAuthRequire
+    }
+    s := &Server{
         router: r,
-        port:   port,
+        config: cfg,
+    }
+    if cfg.TLSCert != "" || cfg.TLSKey != "" {
+        s.certs = &certReloader{certFile: cfg.TLSCert, keyFile: cfg.TLSKey, caFile: cfg.TLSClientCA}
+    }
+    s.handler = s.routes()
+    s.http = s.newHTTPServer()
+    return s
+}
+
+func (s *Server) newHTTPServer() *http.Server {
+    return &http.Server{
+        Handler:      s.handler,
+        Addr:         fmt.Sprintf(":%d", s.config.Port),
+        WriteTimeout: s.config.WriteTimeout,
+        ReadTimeout:  s.config.ReadTimeout,
+        TLSConfig:    s.tlsConfig(),
+        ConnState: func(_ net.Conn, state http.ConnState) {
+            switch state {
+            case http.StateNew:
+                atomic.AddInt64(&s.conns, 1)
+            case http.StateClosed, http.StateHijacked:
+                atomic.AddInt64(&s.conns, -1)
+            }
+        },
     }
 }
 
+// Start serves until Shutdown, which makes it return nil. A listener the
+// watchdog restarts is bound again here.
 func (s *Server) Start() error {
-    r := mux.NewRouter()
-    
-    // Middleware
-    r.Use(loggingMiddleware)
-    r.Use(corsMiddleware)
-    
-    // API endpoints
-    r.HandleFunc("/api/processIncoming", s.handleProcessIncoming).Methods("GET", "POST")
-    r.HandleFunc("/api/processReturn", s.handleProcessReturn).Methods("GET", "POST")
-    r.HandleFunc("/api/stats", s.handleStats).Methods("GET")
-    r.HandleFunc("/api/health", s.handleHealth).Methods("GET")
-    
-    srv := &http.Server{
-        Handler:      r,
-        Addr:         fmt.Sprintf(":%d", s.port),
-        WriteTimeout: 15 * time.Second,
-        ReadTimeout:  15 * time.Second,
+    if by := s.config.ClientRateBy; by != ClientRateByIP && by != ClientRateByKey {
+        return fmt.Errorf("invalid client rate limit key %q (ip or apikey)", by)
+    }
+    if s.certs == nil && s.config.TLSClientCA != "" {
+        return errors.New("mutual TLS needs a server certificate and key")
+    }
+    if s.certs != nil {
+        if s.config.TLSCert == "" || s.config.TLSKey == "" {
+            return errors.New("TLS needs both a certificate and a key")
+        }
+        if a := s.config.TLSClientAuth; a != "" && a != TLSClientAuthRequire && a != TLSClientAuthOptional {
+            return fmt.Errorf("invalid TLS client auth %q (require or optional)", a)
+        }
+        if err := s.certs.load(); err != nil {
+            return fmt.Errorf("loading TLS certificate: %w", err)
+        }
+    }
+    logger.Infof("Server starting on port %d (%s)", s.config.Port, s.scheme())
+    for {
+        s.mu.Lock()
+        srv := s.http
+        s.mu.Unlock()
+        var err error
+        if s.certs != nil {
+            // The certificate comes from TLSConfig.GetCertificate
+            err = srv.ListenAndServeTLS("", "")
+        } else {
+            err = srv.ListenAndServe()
+        }
+        if err != http.ErrServerClosed {
+            return err
+        }
+
+        s.mu.Lock()
+        restarted := !s.closed && s.http != srv
+        s.mu.Unlock()
+        if !restarted {
+            return nil
+        }
+        logger.Infof("Listener on port %d restarted", s.config.Port)
     }
-    
-    log.Printf("[API] Server starting on port %d", s.port)
-    return srv.ListenAndServe()
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        log.Printf("[API] %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
-        next.ServeHTTP(w, r)
-    })
+// Shutdown stops accepting connections and waits for in-flight requests
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.mu.Lock()
+    s.closed = true
+    srv := s.http
+    s.mu.Unlock()
+    return srv.Shutdown(ctx)
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-        
-        if r.Method == "OPTIONS" {
-            w.WriteHeader(http.StatusOK)
-            return
-        }
-        
-        next.ServeHTTP(w, r)
-    })
+func (s *Server) routes() http.Handler {
+    m := NewMux()
+    
+    // Middleware (recovery first so it also covers panics in other middleware)
+    m.Use(recoveryMiddleware, requestIDMiddleware, metricsMiddleware, loggingMiddleware, corsMiddleware)
+    
+    // Unauthenticated probes
+    m.HandleFunc("/api/health", s.handleHealth, "GET")
+    m.HandleFunc("/api/load", s.handleLoad, "GET")
+    m.Handle("/metrics", metrics.Handler(), "GET")
+    
+    // One limiter across all groups. Each client is held to its own rate
+    // first, so requests refused for a flooding client take no tokens from
+    // the others.
+    clientLimit := clientRateLimitMiddleware(s.config.ClientRateLimit, s.config.ClientRateBurst, s.config.ClientRateBy)
+    limit := rateLimitMiddleware(s.config.RateLimit, s.config.RateBurst)
+    readOnly := readOnlyMiddleware(s.router.ReadOnly())
+    clientCert := clientCertMiddleware(s.certs != nil && s.config.TLSClientCA != "" && s.config.TLSClientAuth == TLSClientAuthRequire)
+    
+    // Dialplan callbacks keep the lightweight API key; only the S1 and S3
+    // hosts may route calls
+    dialplan := m.Group("/api", clientCert, authMiddleware(s.config.APIKey), clientLimit, limit, readOnly)
+    callbacks := m.Group("/api", sourceAllowlistMiddleware(s.config.AllowedSources), clientCert, authMiddleware(s.config.APIKey), clientLimit, limit, readOnly)
+    callbacks.HandleFunc("/processIncoming", s.handleProcessIncoming, "GET", "POST")
+    callbacks.HandleFunc("/processReturn", s.handleProcessReturn, "GET", "POST")
+    dialplan.HandleFunc("/hangup", s.handleHangup, "GET", "POST")
+    
+    // Admin surface, on bearer tokens when JWT keys are configured
+    api := m.Group("/api", clientCert, adminAuthMiddleware(s.config.JWT, s.config.APIKey), clientLimit, limit, readOnly)
+    api.HandleFunc("/auth/token", s.handleRefreshToken, "POST")
+    
+    // Everything but routing and call history needs the feature tables
+    features := api.Group("", featureTablesMiddleware(s.router.FeatureTables()))
+    
+    // Operational endpoints
+    api.HandleFunc("/stats", s.handleStats, "GET")
+    features.HandleFunc("/stats/history", s.handleStatsHistory, "GET")
+    features.HandleFunc("/capacity", s.handleCapacity, "GET")
+    features.HandleFunc("/traffic/profile", s.handleTrafficProfile, "GET")
+    features.HandleFunc("/traffic/anomalies", s.handleTrafficAnomalies, "GET")
+    features.HandleFunc("/settlement/rules", s.handleListSettlementRules, "GET")
+    features.HandleFunc("/settlement/rules", s.handleAddSettlementRule, "POST")
+    features.HandleFunc("/settlement/rules/{id}", s.handleDeleteSettlementRule, "DELETE")
+    features.HandleFunc("/reports/settlement", s.handleSettlementReport, "GET")
+    features.HandleFunc("/reports/destinations", s.handleDestinationReport, "GET")
+    features.HandleFunc("/destinations/lookup", s.handleDestinationLookup, "GET")
+    features.HandleFunc("/rates", s.handleListRates, "GET")
+    features.HandleFunc("/rates", s.handleAddRate, "POST")
+    features.HandleFunc("/rates/effective", s.handleEffectiveRates, "GET")
+    features.HandleFunc("/rates/lookup", s.handleRateLookup, "GET")
+    features.HandleFunc("/rates/{id}", s.handleDeleteRate, "DELETE")
+    features.HandleFunc("/dids/ranges", s.handleListDIDRanges, "GET")
+    features.HandleFunc("/dids/ranges", s.handleAddDIDRange, "POST")
+    features.HandleFunc("/dids/ranges/{id}", s.handleDeleteDIDRange, "DELETE")
+    features.HandleFunc("/dids/import", s.handleImportDIDs, "POST")
+    features.HandleFunc("/dids/quarantined", s.handleListQuarantined, "GET")
+    features.HandleFunc("/migrate/v1", s.handleImportV1, "POST")
+    features.HandleFunc("/pools", s.handleListPools, "GET")
+    features.HandleFunc("/pools/{pool}/dids", s.handleAssignPoolDIDs, "PUT")
+    features.HandleFunc("/partitions", s.handleListPartitions, "GET")
+    features.HandleFunc("/partitions/did/{did}", s.handleDIDSource, "GET")
+    features.HandleFunc("/partitions/{source}", s.handleSetPartition, "PUT")
+    features.HandleFunc("/partitions/{source}", s.handleDeletePartition, "DELETE")
+    features.HandleFunc("/provisioning", s.handleListProvisioning, "GET")
+    features.HandleFunc("/provisioning/{id}/approve", s.handleDecideProvisioning(true), "POST")
+    features.HandleFunc("/provisioning/{id}/reject", s.handleDecideProvisioning(false), "POST")
+    features.HandleFunc("/schema", s.handleSchema, "GET")
+    features.HandleFunc("/schema/repair", s.handleRepairSchema, "POST")
+    features.HandleFunc("/dids/{did}/tags", s.handleGetDIDTags, "GET")
+    features.HandleFunc("/dids/{did}/tags", s.handleSetDIDTags, "PUT")
+    api.HandleFunc("/dids/{did}/history", s.handleDIDHistory, "GET")
+    features.HandleFunc("/dids/{did}/quarantine", s.handleLiftQuarantine, "DELETE")
+    features.HandleFunc("/dids/{did}/notes", s.handleListNotes(router.NoteDID, "did"), "GET")
+    features.HandleFunc("/dids/{did}/notes", s.handleAddNote(router.NoteDID, "did"), "POST")
+    api.HandleFunc("/calls", s.handleListCalls, "GET")
+    api.HandleFunc("/ws/calls", s.handleCallFeed, "GET")
+    api.HandleFunc("/calls/{callid}", s.handleGetCall, "GET")
+    api.HandleFunc("/calls/{callid}/events", s.handleCallTimeline, "GET")
+    api.HandleFunc("/calls/{callid}/flow", s.handleCallFlow, "GET")
+    features.HandleFunc("/calls/{callid}/recording", s.handleRecordingMeta, "GET")
+    features.HandleFunc("/calls/{callid}/recording/verify", s.handleVerifyRecording, "POST")
+    features.HandleFunc("/calls/{callid}/tags", s.handleGetCallTags, "GET")
+    features.HandleFunc("/calls/{callid}/tags", s.handleMergeCallTags, "PATCH")
+    features.HandleFunc("/calls/{callid}/notes", s.handleListNotes(router.NoteCall, "callid"), "GET")
+    features.HandleFunc("/calls/{callid}/notes", s.handleAddNote(router.NoteCall, "callid"), "POST")
+    features.HandleFunc("/notes/{id}", s.handleDeleteNote, "DELETE")
+    features.HandleFunc("/blocklist", s.handleListBlocklist, "GET")
+    features.HandleFunc("/blocklist/numbers/{number}", s.handleCheckBlocklist, "GET")
+    features.HandleFunc("/blocklist/numbers/{number}", s.handleSetBlocklistEntry, "PUT")
+    features.HandleFunc("/blocklist/numbers/{number}", s.handleDeleteBlocklistEntry, "DELETE")
+    features.HandleFunc("/blocklist/feeds", s.handleListBlocklistFeeds, "GET")
+    features.HandleFunc("/blocklist/feeds/{name}", s.handleSetBlocklistFeed, "PUT")
+    features.HandleFunc("/blocklist/feeds/{name}", s.handleDeleteBlocklistFeed, "DELETE")
+    features.HandleFunc("/blocklist/feeds/{name}/refresh", s.handleRefreshBlocklistFeed, "POST")
+    features.HandleFunc("/ani/{ani}/reputation", s.handleGetReputation, "GET")
+    features.HandleFunc("/ani/{ani}/complaints", s.handleAddComplaint, "POST")
+    features.HandleFunc("/reputation/low", s.handleLowReputation, "GET")
+    features.HandleFunc("/campaigns", s.handleListCampaigns, "GET")
+    features.HandleFunc("/campaigns/stats", s.handleCampaignStats, "GET")
+    features.HandleFunc("/campaigns/{id}", s.handleSetCampaign, "PUT")
+    features.HandleFunc("/campaigns/{id}", s.handleDeleteCampaign, "DELETE")
+    features.HandleFunc("/carriers", s.handleListCarriers, "GET")
+    features.HandleFunc("/carriers/{trunk}", s.handleSetCarrier, "PUT")
+    features.HandleFunc("/carriers/{trunk}", s.handleDeleteCarrier, "DELETE")
+    features.HandleFunc("/tenants", s.handleListTenants, "GET")
+    features.HandleFunc("/tenants/{id}", s.handleSetTenant, "PUT")
+    features.HandleFunc("/tenants/{id}", s.handleDeleteTenant, "DELETE")
+    features.HandleFunc("/tenants/{id}/dids", s.handleAssignTenantDIDs, "PUT")
+    features.HandleFunc("/overrides", s.handleListOverrides, "GET")
+    features.HandleFunc("/overrides", s.handleCreateOverride, "POST")
+    features.HandleFunc("/overrides/audit", s.handleOverrideAudit, "GET")
+    features.HandleFunc("/overrides/{id}", s.handleCancelOverride, "DELETE")
+    features.HandleFunc("/exports", s.handleListExports, "GET")
+    features.HandleFunc("/exports", s.handleCreateExport, "POST")
+    features.HandleFunc("/exports/{id}", s.handleGetExport, "GET")
+    features.HandleFunc("/exports/{id}", s.handleDeleteExport, "DELETE")
+    features.HandleFunc("/exports/{id}/download", s.handleDownloadExport, "GET")
+    api.HandleFunc("/events/schema", s.handleEventSchemas, "GET")
+    api.HandleFunc("/events/schema/{version}", s.handleEventSchema, "GET")
+    features.HandleFunc("/webhooks/dead", s.handleDeadWebhooks, "GET")
+    features.HandleFunc("/webhooks/dead/{id}/retry", s.handleRetryWebhook, "POST")
+    
+    // Operator tooling
+    api.HandleFunc("/admin/maps", s.handleDumpMaps, "GET")
+    api.HandleFunc("/admin/maps/trim", s.handleTrimMaps, "POST")
+    api.HandleFunc("/admin/reloadState", s.handleReloadState, "POST")
+    api.HandleFunc("/admin/writes", s.handleWriteReport, "GET")
+    api.HandleFunc("/admin/negcache", s.handleNegativeCache, "GET")
+    api.HandleFunc("/admin/negcache", s.handleClearNegativeCache, "DELETE")
+    api.HandleFunc("/admin/negcache/failback", s.handleApproveFailback, "POST")
+    
+    return m
 }
 
 func (s *Server) handleProcessIncoming(w http.ResponseWriter, r *http.Request) {
-    callID := r.URL.Query().Get("callid")
-    ani := r.URL.Query().Get("ani")
-    dnis := r.URL.Query().Get("dnis")
+    req, err := incomingRequest(r)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    callID, ani, dnis := req.CallID, req.ANI, req.DNIS
     
-    log.Printf("[API] ProcessIncoming: callID=%s, ani=%s, dnis=%s", callID, ani, dnis)
+    clog := logger.Call(callID, "", ani).Context(r.Context())
+    clog.Infof("ProcessIncoming: callID=%s, ani=%s, dnis=%s", callID, ani, dnis)
     
-    if callID == "" || ani == "" || dnis == "" {
-        http.Error(w, "Missing parameters", http.StatusBadRequest)
+    // Without a callid the router issues one, when configured to
+    if (callID == "" && !s.router.IssuesCallIDs()) || ani == "" || dnis == "" {
+        writeError(w, "Missing parameters", http.StatusBadRequest)
         return
     }
     
-    resp, err := s.router.ProcessIncomingCall(callID, ani, dnis)
+    opts := router.IncomingOptions{
+        Tags:        req.Tags,
+        Campaign:    req.Campaign,
+        Domain:      req.Domain,
+        Pool:        req.Pool,
+        Source:      req.Source,
+        TraceParent: req.TraceParent,
+        Baggage:     req.Baggage,
+    }
+    
+    resp, err := s.router.ProcessIncomingCall(r.Context(), callID, ani, dnis, opts)
     if err != nil {
-        log.Printf("[API] ProcessIncoming error: %v", err)
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        clog.Errorf("ProcessIncoming error: %v", err)
+        writeCallError(w, err, http.StatusInternalServerError)
         return
     }
+    setTraceExemplar(r, s.router.TraceExemplar(resp.TraceParent))
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(resp)
+    writeJSON(w, http.StatusOK, resp)
 }
 
 func (s *Server) handleProcessReturn(w http.ResponseWriter, r *http.Request) {
-    ani2 := r.URL.Query().Get("ani2")
-    did := r.URL.Query().Get("did")
+    req, err := returnRequest(r)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    ani2, did, token := req.ANI2, req.DID, req.Token
     
-    log.Printf("[API] ProcessReturn: ani2=%s, did=%s", ani2, did)
+    clog := logger.Call("", did, ani2).Context(r.Context())
+    clog.Infof("ProcessReturn: ani2=%s, did=%s, token=%s", ani2, did, token)
     
     if ani2 == "" || did == "" {
-        http.Error(w, "Missing parameters", http.StatusBadRequest)
+        writeError(w, "Missing parameters", http.StatusBadRequest)
         return
     }
     
-    resp, err := s.router.ProcessReturnCall(ani2, did)
+    resp, err := s.router.ProcessReturnCall(r.Context(), ani2, did, router.ReturnOptions{
+        Token:       token,
+        TraceParent: req.TraceParent,
+        Baggage:     req.Baggage,
+    })
     if err != nil {
-        log.Printf("[API] ProcessReturn error: %v", err)
-        http.Error(w, err.Error(), http.StatusNotFound)
+        clog.Errorf("ProcessReturn error: %v", err)
+        writeCallError(w, err, http.StatusNotFound)
         return
     }
+    setTraceExemplar(r, s.router.TraceExemplar(resp.TraceParent))
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(resp)
+    writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleHangup(w http.ResponseWriter, r *http.Request) {
+    callID := r.URL.Query().Get("callid")
+    cause := r.URL.Query().Get("cause")
+    
+    clog := logger.Call(callID, "", "").Context(r.Context())
+    clog.Infof("Hangup: callID=%s, cause=%s", callID, cause)
+    
+    if callID == "" {
+        writeError(w, "Missing parameters", http.StatusBadRequest)
+        return
+    }
+    
+    record, err := s.router.CompleteCall(r.Context(), callID, cause)
+    if err != nil {
+        clog.Errorf("Hangup error: %v", err)
+        writeCallError(w, err, http.StatusNotFound)
+        return
+    }
+    
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "status":       "success",
+        "call_id":      record.CallID,
+        "state":        record.Status,
+        "did_released": record.AssignedDID,
+    })
 }
 
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
-    stats, err := s.router.GetStatistics()
+    stats, err := s.router.GetStatistics(r.Context())
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        writeError(w, err.Error(), http.StatusInternalServerError)
         return
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(stats)
+    writeJSON(w, http.StatusOK, stats)
+}
+
+// GET /api/stats/history?hours=24&node=
+func (s *Server) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+    hours, err := floatParam(r.URL.Query().Get("hours"), 24)
+    if err != nil || hours <= 0 {
+        writeError(w, "hours must be a positive number", http.StatusBadRequest)
+        return
+    }
+    since := time.Now().Add(-time.Duration(hours * float64(time.Hour)))
+    
+    history, err := s.router.StatsHistory(r.Context(), since, r.URL.Query().Get("node"))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "since":     since.Format(time.RFC3339),
+        "snapshots": history,
+    })
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{
-        "status": "ok",
-        "time": time.Now().Format(time.RFC3339),
+    workers, healthy := s.router.WorkerHealth()
+    status, code := "ok", http.StatusOK
+    if !healthy {
+        status = "degraded"
+    }
+    database := s.router.DatabaseHealth()
+    if database.State != "up" {
+        // Every call would fail fast; let the balancer pick another S2
+        status, code = "database_down", http.StatusServiceUnavailable
+    }
+    if s.router.Draining() {
+        // Take this instance out of the load balancer
+        status, code = "draining", http.StatusServiceUnavailable
+    }
+    
+    writeJSON(w, code, map[string]interface{}{
+        "status":    status,
+        "time":      time.Now().Format(time.RFC3339),
+        "read_only": s.router.ReadOnly(),
+        "database":  database,
+        "workers":   workers,
     })
 }
+
+// handleLoad answers balancer polls; an instance not taking calls answers
+// 503 so a balancer that only looks at the status skips it too
+func (s *Server) handleLoad(w http.ResponseWriter, r *http.Request) {
+    load := s.router.Load(r.Context())
+    code := http.StatusOK
+    if !load.Accepting {
+        code = http.StatusServiceUnavailable
+    }
+
+    writeJSON(w, code, load)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
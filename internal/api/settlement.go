@@ -0,0 +1,81 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+func (s *Server) handleListSettlementRules(w http.ResponseWriter, r *http.Request) {
+    rules, err := s.router.SettlementRules(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, rules)
+}
+
+func (s *Server) handleAddSettlementRule(w http.ResponseWriter, r *http.Request) {
+    var rule models.SettlementRule
+    if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+
+    created, err := s.router.AddSettlementRule(r.Context(), rule)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) handleDeleteSettlementRule(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(PathParam(r, "id"), 10, 64)
+    if err != nil {
+        writeError(w, "Invalid id", http.StatusBadRequest)
+        return
+    }
+
+    if err := s.router.DeleteSettlementRule(r.Context(), id); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSettlementReport reports minutes per settlement class, defaulting
+// to the current month
+func (s *Server) handleSettlementReport(w http.ResponseWriter, r *http.Request) {
+    now := time.Now()
+    monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+
+    from, err := timeParam(r.URL.Query().Get("from"), monthStart)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    to, err := timeParam(r.URL.Query().Get("to"), now)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    report, err := s.router.SettlementReport(r.Context(), from, to)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "from":    from.Format(time.RFC3339),
+        "to":      to.Format(time.RFC3339),
+        "classes": report,
+    })
+}
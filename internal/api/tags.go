@@ -0,0 +1,98 @@
+package api
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// tagsFromQuery collects tags passed as a JSON object in "tags" and/or as
+// individual tag_<key>=<value> parameters (easier from dialplan CURL())
+func tagsFromQuery(q url.Values) (map[string]string, error) {
+    tags := make(map[string]string)
+
+    if raw := q.Get("tags"); raw != "" {
+        if err := json.Unmarshal([]byte(raw), &tags); err != nil {
+            return nil, fmt.Errorf("tags must be a JSON object of strings")
+        }
+    }
+    for key, values := range q {
+        if strings.HasPrefix(key, "tag_") && len(values) > 0 {
+            tags[strings.TrimPrefix(key, "tag_")] = values[0]
+        }
+    }
+
+    if len(tags) == 0 {
+        return nil, nil
+    }
+    return tags, nil
+}
+
+func decodeTagsBody(r *http.Request) (map[string]string, error) {
+    var tags map[string]string
+    if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+        return nil, fmt.Errorf("body must be a JSON object of strings")
+    }
+    return tags, nil
+}
+
+func (s *Server) handleGetDIDTags(w http.ResponseWriter, r *http.Request) {
+    tags, err := s.router.DIDTags(r.Context(), PathParam(r, "did"))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, emptyIfNil(tags))
+}
+
+func (s *Server) handleSetDIDTags(w http.ResponseWriter, r *http.Request) {
+    tags, err := decodeTagsBody(r)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := s.router.SetDIDTags(r.Context(), PathParam(r, "did"), tags); err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, emptyIfNil(tags))
+}
+
+func (s *Server) handleGetCallTags(w http.ResponseWriter, r *http.Request) {
+    tags, err := s.router.CallTags(r.Context(), PathParam(r, "callid"))
+    if err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, emptyIfNil(tags))
+}
+
+// handleMergeCallTags adds tags to a call; a key with an empty value is removed
+func (s *Server) handleMergeCallTags(w http.ResponseWriter, r *http.Request) {
+    updates, err := decodeTagsBody(r)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    tags, err := s.router.MergeCallTags(r.Context(), PathParam(r, "callid"), updates)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, emptyIfNil(tags))
+}
+
+func emptyIfNil(tags map[string]string) map[string]string {
+    if tags == nil {
+        return map[string]string{}
+    }
+    return tags
+}
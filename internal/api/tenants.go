@@ -0,0 +1,61 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+func (s *Server) handleListTenants(w http.ResponseWriter, r *http.Request) {
+    list, err := s.router.Tenants(r.Context())
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleSetTenant(w http.ResponseWriter, r *http.Request) {
+    var t models.Tenant
+    if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+        writeError(w, "Invalid JSON body", http.StatusBadRequest)
+        return
+    }
+    t.ID = PathParam(r, "id")
+
+    saved, err := s.router.SetTenant(r.Context(), t)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, saved)
+}
+
+func (s *Server) handleDeleteTenant(w http.ResponseWriter, r *http.Request) {
+    if err := s.router.DeleteTenant(r.Context(), PathParam(r, "id")); err != nil {
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAssignTenantDIDs moves the DIDs in a JSON array body into the tenant's pool
+func (s *Server) handleAssignTenantDIDs(w http.ResponseWriter, r *http.Request) {
+    var dids []string
+    if err := json.NewDecoder(r.Body).Decode(&dids); err != nil {
+        writeError(w, "body must be a JSON array of DIDs", http.StatusBadRequest)
+        return
+    }
+
+    moved, err := s.router.AssignTenantDIDs(r.Context(), PathParam(r, "id"), dids)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]int{"assigned": moved})
+}
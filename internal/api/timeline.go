@@ -0,0 +1,37 @@
+package api
+
+import (
+    "net/http"
+)
+
+func (s *Server) handleCallTimeline(w http.ResponseWriter, r *http.Request) {
+    callID := PathParam(r, "callid")
+    timeline, err := s.router.CallTimeline(r.Context(), callID)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if timeline == nil {
+        writeError(w, "no events recorded for call "+callID, http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, timeline)
+}
+
+// handleCallFlow serves a call's journey shaped for the dashboard's
+// sequence diagram
+func (s *Server) handleCallFlow(w http.ResponseWriter, r *http.Request) {
+    callID := PathParam(r, "callid")
+    flow, err := s.router.CallFlow(r.Context(), callID)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if flow == nil {
+        writeError(w, "no call "+callID, http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, flow)
+}
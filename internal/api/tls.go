@@ -0,0 +1,164 @@
+package api
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+// With a certificate configured the listener serves HTTPS. The key pair and
+// client CA bundle are read again on ReloadTLS (SIGHUP) and whenever one of
+// the files changes, and handshakes after that use the new ones; open
+// connections keep theirs. Files that fail to load leave the current ones
+// in place, so a half-written rotation never takes the API down.
+var (
+    tlsReloads = metrics.NewCounter("s2_tls_reloads_total",
+        "Certificate reloads by result (ok or error)", "result")
+    tlsExpiry = metrics.NewGauge("s2_tls_cert_expiry_timestamp_seconds",
+        "Unix time the served certificate expires")
+)
+
+type certReloader struct {
+    certFile, keyFile string
+    caFile            string // client CA bundle for mTLS, "" when off
+
+    mu        sync.RWMutex
+    cert      *tls.Certificate
+    clientCAs *x509.CertPool
+    modTime   time.Time // newest of the files when last loaded
+}
+
+// load reads the key pair and swaps it in
+func (c *certReloader) load() error {
+    modTime, err := c.modified()
+    if err != nil {
+        return err
+    }
+    cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if err != nil {
+        return err
+    }
+    leaf, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        return err
+    }
+    cert.Leaf = leaf
+    var pool *x509.CertPool
+    if c.caFile != "" {
+        if pool, err = loadCAs(c.caFile); err != nil {
+            return err
+        }
+    }
+
+    c.mu.Lock()
+    c.cert = &cert
+    c.clientCAs = pool
+    c.modTime = modTime
+    c.mu.Unlock()
+    tlsExpiry.Set(float64(leaf.NotAfter.Unix()))
+    return nil
+}
+
+// modified returns the latest modification time of the files
+func (c *certReloader) modified() (time.Time, error) {
+    var latest time.Time
+    for _, name := range []string{c.certFile, c.keyFile, c.caFile} {
+        if name == "" {
+            continue
+        }
+        info, err := os.Stat(name)
+        if err != nil {
+            return time.Time{}, err
+        }
+        if info.ModTime().After(latest) {
+            latest = info.ModTime()
+        }
+    }
+    return latest, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    if c.cert == nil {
+        return nil, errors.New("no certificate loaded")
+    }
+    return c.cert, nil
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+    if s.certs == nil {
+        return nil
+    }
+    cfg := &tls.Config{
+        MinVersion:     tls.VersionTLS12,
+        GetCertificate: s.certs.getCertificate,
+    }
+    if s.certs.caFile != "" {
+        s.mutualTLS(cfg)
+    }
+    return cfg
+}
+
+// ReloadTLS reads the certificate and key again. It does nothing when the
+// server is not serving HTTPS.
+func (s *Server) ReloadTLS() error {
+    if s.certs == nil {
+        return nil
+    }
+    if err := s.certs.load(); err != nil {
+        tlsReloads.Inc("error")
+        logger.Errorf("Failed to reload TLS certificate, keeping the current one: %v", err)
+        return err
+    }
+    tlsReloads.Inc("ok")
+    s.certs.mu.RLock()
+    leaf := s.certs.cert.Leaf
+    s.certs.mu.RUnlock()
+    logger.Infof("Reloaded TLS certificate %s (expires %s)", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+    return nil
+}
+
+// WatchTLS reloads the certificate when its files change, checked every
+// TLSReloadInterval, until ctx is done
+func (s *Server) WatchTLS(ctx context.Context) error {
+    if s.certs == nil || s.config.TLSReloadInterval <= 0 {
+        return nil
+    }
+    ticker := time.NewTicker(s.config.TLSReloadInterval)
+    defer ticker.Stop()
+    var failed time.Time // files that did not load, not retried until they change again
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case <-ticker.C:
+        }
+
+        modTime, err := s.certs.modified()
+        if err != nil {
+            // Mid-rotation, a file may briefly be missing
+            continue
+        }
+        s.certs.mu.RLock()
+        changed := modTime.After(s.certs.modTime) && !modTime.Equal(failed)
+        s.certs.mu.RUnlock()
+        if changed && s.ReloadTLS() != nil {
+            failed = modTime
+        }
+    }
+}
+
+// scheme is the URL scheme the API is served on
+func (s *Server) scheme() string {
+    if s.certs != nil {
+        return "https"
+    }
+    return "http"
+}
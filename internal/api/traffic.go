@@ -0,0 +1,22 @@
+package api
+
+import (
+    "net/http"
+    "time"
+)
+
+func (s *Server) handleTrafficProfile(w http.ResponseWriter, r *http.Request) {
+    slots, learnedAt := s.router.TrafficBaseline()
+
+    resp := map[string]interface{}{
+        "slots": slots,
+    }
+    if !learnedAt.IsZero() {
+        resp["learned_at"] = learnedAt.Format(time.RFC3339)
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleTrafficAnomalies(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, s.router.TrafficAnomalies())
+}
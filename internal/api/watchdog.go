@@ -0,0 +1,156 @@
+package api
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "runtime"
+    "runtime/pprof"
+    "sync/atomic"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+// What the watchdog does once the listener stops answering
+const (
+    WatchdogLog     = "log"     // log diagnostics and a goroutine dump
+    WatchdogRestart = "restart" // also close the listener and its connections and bind again
+    WatchdogExit    = "exit"    // also exit at once, for systemd to restart the process
+)
+
+var (
+    watchdogFailures = metrics.NewCounter("s2_http_watchdog_failures_total",
+        "Loopback self-requests the HTTP listener did not answer")
+    watchdogTrips = metrics.NewCounter("s2_http_watchdog_trips_total",
+        "Times the watchdog found the HTTP listener wedged, by action taken", "action")
+)
+
+// Watchdog requests /api/health over loopback every WatchdogInterval until
+// ctx is done. A deadlocked handler chain or an exhausted FD table leaves
+// the process alive but the listener silent; after WatchdogFailures
+// unanswered requests in a row it logs diagnostics and a goroutine dump,
+// then takes WatchdogAction. Any HTTP response, even a 503 while draining,
+// counts as an answer.
+func (s *Server) Watchdog(ctx context.Context) error {
+    cfg := s.config
+    if cfg.WatchdogInterval <= 0 {
+        return nil
+    }
+    switch cfg.WatchdogAction {
+    case WatchdogLog, WatchdogRestart, WatchdogExit:
+    default:
+        return fmt.Errorf("invalid watchdog action %q (log, restart or exit)", cfg.WatchdogAction)
+    }
+
+    // A new connection per request, so a listener that stopped accepting
+    // is caught and not hidden by a kept-alive connection. The certificate
+    // names the public host, not 127.0.0.1, and is not what is checked.
+    client := &http.Client{
+        Timeout: cfg.WatchdogTimeout,
+        Transport: &http.Transport{
+            DisableKeepAlives: true,
+            TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+        },
+    }
+    url := fmt.Sprintf("%s://127.0.0.1:%d/api/health", s.scheme(), cfg.Port)
+
+    ticker := time.NewTicker(cfg.WatchdogInterval)
+    defer ticker.Stop()
+    failures, tripped := 0, false
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case <-ticker.C:
+        }
+
+        err := selfRequest(ctx, client, url)
+        if ctx.Err() != nil {
+            return nil
+        }
+        if err == nil {
+            if tripped {
+                logger.Infof("Watchdog: listener on port %d answering again", cfg.Port)
+            }
+            failures, tripped = 0, false
+            continue
+        }
+        watchdogFailures.Inc()
+        failures++
+        logger.Warnf("Watchdog self-request failed (%d of %d): %v", failures, cfg.WatchdogFailures, err)
+        if failures < cfg.WatchdogFailures {
+            continue
+        }
+        failures = 0
+
+        // Only logging changes nothing, so one dump per outage is enough
+        if tripped && cfg.WatchdogAction == WatchdogLog {
+            continue
+        }
+        tripped = true
+        s.tripWatchdog()
+    }
+}
+
+func selfRequest(ctx context.Context, client *http.Client, url string) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    io.Copy(io.Discard, resp.Body)
+    return resp.Body.Close()
+}
+
+func (s *Server) tripWatchdog() {
+    action := s.config.WatchdogAction
+    watchdogTrips.Inc(action)
+    logger.Errorf("ALERT: watchdog: HTTP listener on port %d not answering (%d goroutines, %s open files, %d connections), action %s",
+        s.config.Port, runtime.NumGoroutine(), openFiles(), atomic.LoadInt64(&s.conns), action)
+
+    var dump bytes.Buffer
+    pprof.Lookup("goroutine").WriteTo(&dump, 2)
+    logger.Errorf("Watchdog goroutine dump:\n%s", dump.String())
+
+    switch action {
+    case WatchdogRestart:
+        s.restartListener()
+    case WatchdogExit:
+        // A wedged process cannot be trusted to shut down cleanly
+        os.Exit(1)
+    }
+}
+
+// restartListener closes the current listener with its connections; Start
+// then binds a new one. Handlers that are stuck stay stuck, but a wedged
+// accept loop or connections hogging FDs are cleared.
+func (s *Server) restartListener() {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return
+    }
+    old := s.http
+    s.http = s.newHTTPServer()
+    s.mu.Unlock()
+    if err := old.Close(); err != nil {
+        logger.Warnf("Watchdog: closing listener: %v", err)
+    }
+}
+
+// openFiles counts the process's file descriptors where /proc shows them
+func openFiles() string {
+    entries, err := os.ReadDir("/proc/self/fd")
+    if err != nil {
+        return "unknown"
+    }
+    return fmt.Sprint(len(entries))
+}
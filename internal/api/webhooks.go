@@ -0,0 +1,41 @@
+package api
+
+import (
+    "net/http"
+    "strconv"
+)
+
+func (s *Server) handleDeadWebhooks(w http.ResponseWriter, r *http.Request) {
+    limit, err := intParam(r.URL.Query().Get("limit"), 100)
+    if err != nil || limit <= 0 {
+        writeError(w, "Invalid limit", http.StatusBadRequest)
+        return
+    }
+
+    list, err := s.router.DeadWebhooks(r.Context(), limit)
+    if err != nil {
+        writeError(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleRetryWebhook(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.ParseInt(PathParam(r, "id"), 10, 64)
+    if err != nil {
+        writeError(w, "Invalid id", http.StatusBadRequest)
+        return
+    }
+
+    if err := s.router.RetryDeadWebhook(r.Context(), id); err != nil {
+        logger.Errorf("RetryWebhook error: %v", err)
+        writeError(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "status": "queued",
+        "id":     id,
+    })
+}
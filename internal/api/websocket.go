@@ -0,0 +1,202 @@
+package api
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Server side of RFC 6455, enough to push JSON text messages to browsers:
+// no extensions, no compression, and client messages are read only to
+// answer pings and notice the close.
+const (
+    wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+    wsOpText  = 0x1
+    wsOpClose = 0x8
+    wsOpPing  = 0x9
+    wsOpPong  = 0xA
+
+    wsMaxFrame     = 64 << 10
+    wsWriteTimeout = 10 * time.Second
+)
+
+var errWSClosed = errors.New("WebSocket close frame already sent")
+
+type wsConn struct {
+    conn net.Conn
+    r    *bufio.Reader
+    wmu  sync.Mutex
+    shut bool // a close frame was sent, and nothing may follow it
+}
+
+// upgradeWebSocket answers the upgrade request and takes over the
+// connection. On failure the response has already been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+    if !headerHas(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+        writeError(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+        return nil, fmt.Errorf("not a WebSocket upgrade")
+    }
+    if r.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        writeError(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+        return nil, fmt.Errorf("unsupported WebSocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+    }
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if key == "" {
+        writeError(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+        return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+    }
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        writeError(w, "WebSocket not supported", http.StatusInternalServerError)
+        return nil, fmt.Errorf("response writer cannot be hijacked")
+    }
+
+    conn, rw, err := hijacker.Hijack()
+    if err != nil {
+        return nil, err
+    }
+    // The server's read/write timeouts still apply to the hijacked conn
+    conn.SetDeadline(time.Time{})
+
+    sum := sha1.Sum([]byte(key + wsGUID))
+    fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+        base64.StdEncoding.EncodeToString(sum[:]))
+    conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+    if err := rw.Flush(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// headerHas reports whether a comma-separated header lists token
+func headerHas(h http.Header, name, token string) bool {
+    for _, v := range h.Values(name) {
+        for _, t := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// WriteText sends one text message; safe for concurrent use
+func (c *wsConn) WriteText(msg []byte) error {
+    return c.writeFrame(wsOpText, msg)
+}
+
+func (c *wsConn) Ping() error {
+    return c.writeFrame(wsOpPing, nil)
+}
+
+func (c *wsConn) Close() error {
+    c.writeFrame(wsOpClose, nil)
+    return c.conn.Close()
+}
+
+// Discard reads client frames until the client closes or the connection
+// fails, answering pings on the way
+func (c *wsConn) Discard() error {
+    for {
+        op, payload, err := c.readFrame()
+        if err != nil {
+            return err
+        }
+        switch op {
+        case wsOpPing:
+            if err := c.writeFrame(wsOpPong, payload); err != nil {
+                return err
+            }
+        case wsOpClose:
+            c.writeFrame(wsOpClose, payload)
+            return io.EOF
+        }
+    }
+}
+
+func (c *wsConn) readFrame() (op byte, payload []byte, err error) {
+    var head [2]byte
+    if _, err = io.ReadFull(c.r, head[:]); err != nil {
+        return
+    }
+    op = head[0] & 0x0F
+    if head[1]&0x80 == 0 {
+        err = fmt.Errorf("unmasked WebSocket frame from client")
+        return
+    }
+
+    n := uint64(head[1] & 0x7F)
+    switch n {
+    case 126:
+        var ext [2]byte
+        if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+            return
+        }
+        n = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+            return
+        }
+        n = binary.BigEndian.Uint64(ext[:])
+    }
+    if n > wsMaxFrame {
+        err = fmt.Errorf("WebSocket frame of %d bytes exceeds %d", n, wsMaxFrame)
+        return
+    }
+
+    var mask [4]byte
+    if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+        return
+    }
+    payload = make([]byte, n)
+    if _, err = io.ReadFull(c.r, payload); err != nil {
+        return
+    }
+    for i := range payload {
+        payload[i] ^= mask[i%4]
+    }
+    return
+}
+
+// writeFrame sends one unfragmented frame; server frames are never masked
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+    c.wmu.Lock()
+    defer c.wmu.Unlock()
+    if c.shut {
+        return errWSClosed
+    }
+    if op == wsOpClose {
+        c.shut = true
+    }
+
+    frame := []byte{0x80 | op}
+    switch n := len(payload); {
+    case n < 126:
+        frame = append(frame, byte(n))
+    case n <= 0xFFFF:
+        frame = append(frame, 126, byte(n>>8), byte(n))
+    default:
+        var ext [8]byte
+        binary.BigEndian.PutUint64(ext[:], uint64(n))
+        frame = append(frame, 127)
+        frame = append(frame, ext[:]...)
+    }
+    frame = append(frame, payload...)
+
+    c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+    _, err := c.conn.Write(frame)
+    return err
+}
@@ -0,0 +1,464 @@
+package api
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+func TestMain(m *testing.M) {
+    logging.Configure(io.Discard, logging.LevelError, false)
+    os.Exit(m.Run())
+}
+
+// pipeListener serves HTTP over in-memory pipes. A pipe write blocks until
+// the other end reads, so a client that stops reading holds the server up
+// at once, not after the kernel's socket buffers fill.
+type pipeListener struct {
+    conns chan net.Conn
+    done  chan struct{}
+    once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+    return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+    select {
+    case c := <-l.conns:
+        return c, nil
+    case <-l.done:
+        return nil, net.ErrClosed
+    }
+}
+
+func (l *pipeListener) Close() error {
+    l.once.Do(func() { close(l.done) })
+    return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+    return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (l *pipeListener) dial() net.Conn {
+    client, server := net.Pipe()
+    l.conns <- server
+    return client
+}
+
+type feedTest struct {
+    router *router.Router
+    ln     *pipeListener
+    calls  int
+}
+
+// newFeedTest serves the API, with key as its API key, on a router over
+// SQLite with two free DIDs
+func newFeedTest(t *testing.T, key string) *feedTest {
+    t.Helper()
+    dsn := "file:" + filepath.Join(t.TempDir(), "s2.db") + "?_pragma=busy_timeout(5000)&_pragma=synchronous(off)"
+    r, err := router.NewRouter(dsn, router.Config{StorageDriver: "sqlite"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(r.Close)
+    db, err := sql.Open("sqlite", dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if _, err := db.Exec(`INSERT INTO dids (did) VALUES ('18005550100'), ('18005550101')`); err != nil {
+        t.Fatal(err)
+    }
+
+    s := NewServer(r, Config{APIKey: key})
+    ln := newPipeListener()
+    srv := s.newHTTPServer()
+    go srv.Serve(ln)
+    t.Cleanup(func() { srv.Close() })
+    return &feedTest{router: r, ln: ln}
+}
+
+// startCall routes the forward leg of a new call
+func (f *feedTest) startCall(t *testing.T) (callID, did string) {
+    t.Helper()
+    f.calls++
+    callID = fmt.Sprintf("call-%d", f.calls)
+    resp, err := f.router.ProcessIncomingCall(context.Background(), callID, "12125550001", fmt.Sprintf("4420755%05d", f.calls), router.IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return callID, resp.DIDAssigned
+}
+
+// runCall takes a call through all three legs, three updates on the feed
+func (f *feedTest) runCall(t *testing.T) {
+    t.Helper()
+    callID, did := f.startCall(t)
+    ctx := context.Background()
+    if _, err := f.router.ProcessReturnCall(ctx, "12125550001", did, router.ReturnOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := f.router.CompleteCall(ctx, callID, "16"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// wsClient speaks raw RFC 6455 to the feed
+type wsClient struct {
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+// upgrade sends an upgrade request for url with the headers set, and
+// returns the response and, on a 101, the client
+func (f *feedTest) upgrade(t *testing.T, url string, header http.Header) (*http.Response, *wsClient) {
+    t.Helper()
+    conn := f.ln.dial()
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+    req, _ := http.NewRequest("GET", "http://s2"+url, nil)
+    req.Header = header
+    go req.Write(conn)
+    br := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(br, req)
+    if err != nil {
+        t.Fatalf("upgrade %s: %v", url, err)
+    }
+    if resp.StatusCode != http.StatusSwitchingProtocols {
+        return resp, nil
+    }
+    return resp, &wsClient{conn: conn, r: br}
+}
+
+func upgradeHeader() http.Header {
+    return http.Header{
+        "Connection":            {"keep-alive, Upgrade"},
+        "Upgrade":               {"websocket"},
+        "Sec-Websocket-Version": {"13"},
+        "Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+    }
+}
+
+// dial opens the feed and reads the snapshot
+func (f *feedTest) dial(t *testing.T) (*wsClient, models.LiveCallUpdate) {
+    t.Helper()
+    resp, c := f.upgrade(t, "/api/ws/calls", upgradeHeader())
+    if c == nil {
+        t.Fatalf("upgrade answered %s", resp.Status)
+    }
+    snapshot := c.readUpdate(t)
+    if snapshot.Type != "snapshot" {
+        t.Fatalf("first message is %s, want the snapshot", snapshot.Type)
+    }
+    return c, snapshot
+}
+
+// send writes one frame, masked as a client must unless masked is false
+func (c *wsClient) send(t *testing.T, fin bool, op byte, payload []byte, masked bool) {
+    t.Helper()
+    b0 := op
+    if fin {
+        b0 |= 0x80
+    }
+    frame := []byte{b0}
+    var maskBit byte
+    if masked {
+        maskBit = 0x80
+    }
+    switch n := len(payload); {
+    case n < 126:
+        frame = append(frame, maskBit|byte(n))
+    case n <= 0xFFFF:
+        frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+    default:
+        var ext [8]byte
+        binary.BigEndian.PutUint64(ext[:], uint64(n))
+        frame = append(append(frame, maskBit|127), ext[:]...)
+    }
+    body := append([]byte(nil), payload...)
+    if masked {
+        var mask [4]byte
+        rand.Read(mask[:])
+        frame = append(frame, mask[:]...)
+        for i := range body {
+            body[i] ^= mask[i%4]
+        }
+    }
+    if _, err := c.conn.Write(append(frame, body...)); err != nil {
+        t.Fatalf("sending frame: %v", err)
+    }
+}
+
+// next reads one server frame, which must be unmasked and unfragmented
+func (c *wsClient) next() (op byte, payload []byte, err error) {
+    var head [2]byte
+    if _, err = io.ReadFull(c.r, head[:]); err != nil {
+        return
+    }
+    if head[0]&0x80 == 0 || head[0]&0x70 != 0 {
+        return 0, nil, fmt.Errorf("server frame header %08b: want FIN and no RSV bits", head[0])
+    }
+    if head[1]&0x80 != 0 {
+        return 0, nil, fmt.Errorf("server frame is masked")
+    }
+    op = head[0] & 0x0F
+    n := uint64(head[1] & 0x7F)
+    switch n {
+    case 126:
+        var ext [2]byte
+        if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+            return
+        }
+        n = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+            return
+        }
+        n = binary.BigEndian.Uint64(ext[:])
+    }
+    payload = make([]byte, n)
+    _, err = io.ReadFull(c.r, payload)
+    return
+}
+
+// readUpdate reads the next text message as a live call update
+func (c *wsClient) readUpdate(t *testing.T) models.LiveCallUpdate {
+    t.Helper()
+    op, payload, err := c.next()
+    if err != nil {
+        t.Fatalf("reading the feed: %v", err)
+    }
+    if op != wsOpText {
+        t.Fatalf("got opcode %#x, want a text message", op)
+    }
+    var update models.LiveCallUpdate
+    if err := json.Unmarshal(payload, &update); err != nil {
+        t.Fatalf("message %s: %v", payload, err)
+    }
+    return update
+}
+
+// expectClosed reads a close frame and then the end of the connection
+func (c *wsClient) expectClosed(t *testing.T, want []byte) {
+    t.Helper()
+    op, payload, err := c.next()
+    if err != nil || op != wsOpClose || string(payload) != string(want) {
+        t.Fatalf("got opcode %#x %q, %v; want a close frame %q", op, payload, err, want)
+    }
+    if _, _, err := c.next(); err != io.EOF {
+        t.Fatalf("after the close frame: %v, want EOF", err)
+    }
+}
+
+func TestCallFeedHandshake(t *testing.T) {
+    f := newFeedTest(t, "k3y")
+
+    for _, tc := range []struct {
+        name   string
+        url    string
+        edit   func(h http.Header)
+        status int
+    }{
+        {"no API key", "/api/ws/calls", func(h http.Header) {}, http.StatusUnauthorized},
+        {"wrong API key", "/api/ws/calls?apikey=nope", func(h http.Header) {}, http.StatusUnauthorized},
+        {"plain GET", "/api/ws/calls?apikey=k3y", func(h http.Header) { h.Del("Upgrade") }, http.StatusUpgradeRequired},
+        {"old version", "/api/ws/calls?apikey=k3y", func(h http.Header) { h.Set("Sec-Websocket-Version", "8") }, http.StatusUpgradeRequired},
+        {"no key", "/api/ws/calls?apikey=k3y", func(h http.Header) { h.Del("Sec-Websocket-Key") }, http.StatusBadRequest},
+    } {
+        h := upgradeHeader()
+        tc.edit(h)
+        resp, _ := f.upgrade(t, tc.url, h)
+        if resp.StatusCode != tc.status {
+            t.Errorf("%s: %s, want %d", tc.name, resp.Status, tc.status)
+        }
+        if tc.name == "old version" && resp.Header.Get("Sec-Websocket-Version") != "13" {
+            t.Errorf("%s: Sec-WebSocket-Version %q, want 13", tc.name, resp.Header.Get("Sec-Websocket-Version"))
+        }
+    }
+
+    // The accept value for the key of RFC 6455 section 1.3
+    resp, c := f.upgrade(t, "/api/ws/calls?apikey=k3y", upgradeHeader())
+    if c == nil {
+        t.Fatalf("upgrade answered %s", resp.Status)
+    }
+    if got := resp.Header.Get("Sec-Websocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+        t.Errorf("Sec-WebSocket-Accept %q", got)
+    }
+    if !headerHas(resp.Header, "Connection", "upgrade") || !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+        t.Errorf("101 headers %v", resp.Header)
+    }
+    if snapshot := c.readUpdate(t); snapshot.Type != "snapshot" || len(snapshot.Calls) != 0 {
+        t.Errorf("first message %+v, want an empty snapshot", snapshot)
+    }
+}
+
+func TestCallFeedPushesUpdates(t *testing.T) {
+    f := newFeedTest(t, "")
+    up, _ := f.startCall(t)
+
+    c, snapshot := f.dial(t)
+    if len(snapshot.Calls) != 1 || snapshot.Calls[0].CallID != up {
+        t.Fatalf("snapshot %+v, want %s", snapshot.Calls, up)
+    }
+    f.runCall(t)
+    for _, want := range []string{"added", "updated", "removed"} {
+        update := c.readUpdate(t)
+        if update.Type != want || update.Call == nil || update.Call.CallID != "call-2" {
+            t.Fatalf("update %+v, want %s of call-2", update, want)
+        }
+    }
+}
+
+// Text sent by the client may come in fragments of any length, with
+// control frames between them; the feed ignores the text and answers the
+// pings
+func TestCallFeedFragmentation(t *testing.T) {
+    f := newFeedTest(t, "")
+    c, _ := f.dial(t)
+
+    c.send(t, false, wsOpText, []byte(`{"hello":`), true)
+    c.send(t, true, wsOpPing, []byte("between fragments"), true)
+    if op, payload, err := c.next(); err != nil || op != wsOpPong || string(payload) != "between fragments" {
+        t.Fatalf("got opcode %#x %q, %v; want the pong", op, payload, err)
+    }
+    // A 16-bit and a 64-bit length
+    c.send(t, false, 0x0, []byte(strings.Repeat("x", 300)), true)
+    c.send(t, true, 0x0, []byte(strings.Repeat("y", 0x10000)), true)
+
+    // Still served
+    f.runCall(t)
+    if update := c.readUpdate(t); update.Type != "added" {
+        t.Fatalf("update %s after fragments, want added", update.Type)
+    }
+}
+
+// Frames from the client must be masked; an unmasked one ends the feed
+func TestCallFeedRequiresMasking(t *testing.T) {
+    f := newFeedTest(t, "")
+    c, _ := f.dial(t)
+    c.send(t, true, wsOpPing, []byte("bare"), false)
+    c.expectClosed(t, nil)
+}
+
+// Frames longer than wsMaxFrame end the feed before the payload is read
+func TestCallFeedRejectsLargeFrames(t *testing.T) {
+    f := newFeedTest(t, "")
+    c, _ := f.dial(t)
+    head := []byte{0x80 | wsOpText, 0x80 | 127, 0, 0, 0, 0, 0, 1, 0, 1}
+    if _, err := c.conn.Write(head); err != nil {
+        t.Fatal(err)
+    }
+    c.expectClosed(t, nil)
+}
+
+// The server echoes the client's close frame, status code and all, and
+// hangs up
+func TestCallFeedClose(t *testing.T) {
+    f := newFeedTest(t, "")
+    c, _ := f.dial(t)
+    payload := []byte{0x03, 0xE8, 'b', 'y', 'e'} // 1000, normal closure
+    c.send(t, true, wsOpClose, payload, true)
+    c.expectClosed(t, payload)
+
+    // Calls keep routing with the feed gone
+    f.runCall(t)
+}
+
+// A client that stops reading is dropped once its buffer of updates fills,
+// after the updates queued for it, and gets a fresh snapshot on
+// reconnecting
+func TestCallFeedDropsSlowConsumer(t *testing.T) {
+    f := newFeedTest(t, "")
+    slow, _ := f.dial(t)
+    fast, _ := f.dial(t)
+
+    // One call stays up and the rest run through, for 298 updates. The
+    // fast client keeps reading throughout.
+    const calls = 100
+    const updates = 1 + 3*(calls-1)
+    fastDone := make(chan error, 1)
+    go func() {
+        for i := 0; i < updates; i++ {
+            op, _, err := fast.next()
+            if err == nil && op != wsOpText {
+                err = fmt.Errorf("opcode %#x", op)
+            }
+            if err != nil {
+                fastDone <- fmt.Errorf("update %d: %v", i, err)
+                return
+            }
+        }
+        fastDone <- nil
+    }()
+
+    up, _ := f.startCall(t)
+    for i := 0; i < calls-1; i++ {
+        f.runCall(t)
+    }
+    if err := <-fastDone; err != nil {
+        t.Fatalf("fast client: %v", err)
+    }
+
+    // The slow client gets what was queued for it, then the close
+    received := 0
+    for {
+        op, _, err := slow.next()
+        if err != nil {
+            t.Fatalf("slow client after %d updates: %v", received, err)
+        }
+        if op == wsOpClose {
+            break
+        }
+        received++
+    }
+    if _, _, err := slow.next(); err != io.EOF {
+        t.Fatalf("after the close frame: %v, want EOF", err)
+    }
+    if received >= updates {
+        t.Fatalf("slow client got all %d updates, want it dropped", received)
+    }
+
+    _, snapshot := f.dial(t)
+    if len(snapshot.Calls) != 1 || snapshot.Calls[0].CallID != up {
+        t.Errorf("snapshot on reconnecting %+v, want %s", snapshot.Calls, up)
+    }
+}
+
+// Server frames carry 7-bit, 16-bit and 64-bit lengths
+func TestWebSocketFrameLengths(t *testing.T) {
+    server, client := net.Pipe()
+    defer server.Close()
+    ws := &wsConn{conn: server}
+    c := &wsClient{conn: client, r: bufio.NewReader(client)}
+
+    for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+        msg := []byte(strings.Repeat("m", n))
+        go ws.WriteText(msg)
+        op, payload, err := c.next()
+        if err != nil || op != wsOpText || len(payload) != n {
+            t.Errorf("%d bytes: got opcode %#x with %d bytes, %v", n, op, len(payload), err)
+        }
+    }
+}
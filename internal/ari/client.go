@@ -0,0 +1,414 @@
+package ari
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+)
+
+var logger = logging.New("ari")
+
+const (
+    dialTimeout  = 5 * time.Second
+    restTimeout  = 5 * time.Second
+    baseBackoff  = time.Second
+    maxBackoff   = 30 * time.Second
+    pingInterval = 30 * time.Second
+)
+
+// Config selects the ARI endpoint, credentials and Stasis application
+type Config struct {
+    URL      string // REST base, e.g. http://127.0.0.1:8088/ari; empty disables ARI
+    Username string // ari.conf user
+    Password string
+    App      string // Stasis application name, defaults to "s2"
+}
+
+// Event is one message from the ARI event stream. Only the fields the
+// router uses are decoded.
+type Event struct {
+    Type      string   `json:"type"`
+    Timestamp string   `json:"timestamp"`
+    Channel   *Channel `json:"channel,omitempty"`
+    Args      []string `json:"args,omitempty"`
+    Cause     int      `json:"cause,omitempty"` // Q.850 cause of ChannelDestroyed
+    CauseText string   `json:"cause_txt,omitempty"`
+}
+
+// Channel is an ARI channel snapshot
+type Channel struct {
+    ID       string   `json:"id"`
+    Name     string   `json:"name"`
+    State    string   `json:"state"`
+    Caller   CallerID `json:"caller"`
+    Dialplan Dialplan `json:"dialplan"`
+}
+
+type CallerID struct {
+    Name   string `json:"name"`
+    Number string `json:"number"`
+}
+
+type Dialplan struct {
+    Context  string `json:"context"`
+    Exten    string `json:"exten"`
+    Priority int    `json:"priority"`
+}
+
+// Originate describes an outbound channel placed into the Stasis app
+type Originate struct {
+    Endpoint  string            // e.g. PJSIP/5551234@s3-trunk
+    CallerID  string            // number presented on the new leg
+    AppArgs   string            // Stasis arguments the new channel starts with
+    Timeout   int               // seconds to wait for an answer, 0 means Asterisk's default
+    Variables map[string]string // channel variables, e.g. PJSIP_HEADER(add,traceparent)
+}
+
+// Status reports the state of the event stream
+type Status struct {
+    URL         string     `json:"url"`
+    App         string     `json:"app"`
+    Connected   bool       `json:"connected"`
+    Since       *time.Time `json:"since,omitempty"`
+    Connects    int        `json:"connects"`
+    Events      int64      `json:"events"`
+    LastEventAt *time.Time `json:"last_event_at,omitempty"`
+    Failures    int        `json:"failures"`
+    LastError   string     `json:"last_error,omitempty"`
+    LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Client holds the ARI event stream for one Stasis application, handing
+// each event to a callback and reconnecting with backoff, and issues REST
+// commands against the same Asterisk
+type Client struct {
+    config  Config
+    handler func(Event)
+    http    *http.Client
+
+    mu     sync.Mutex
+    status Status
+    ws     *wsConn
+    closed bool
+    stop   chan struct{} // closed by Close to cut a reconnect backoff short
+}
+
+// NewClient prepares a client that passes every received event to handler.
+// Events are handled one at a time, in order.
+func NewClient(cfg Config, handler func(Event)) *Client {
+    if cfg.App == "" {
+        cfg.App = "s2"
+    }
+    cfg.URL = strings.TrimRight(cfg.URL, "/")
+    now := time.Now()
+    return &Client{
+        config:  cfg,
+        handler: handler,
+        http:    &http.Client{Timeout: restTimeout},
+        status:  Status{URL: cfg.URL, App: cfg.App, Since: &now},
+        stop:    make(chan struct{}),
+    }
+}
+
+// App returns the Stasis application name
+func (c *Client) App() string { return c.config.App }
+
+// Run connects and reads events until Close is called, reconnecting after failures
+func (c *Client) Run() {
+    backoff := baseBackoff
+    for !c.isClosed() {
+        started := time.Now()
+        err := c.session()
+        if c.isClosed() {
+            return
+        }
+        c.recordFailure(err)
+        logger.Warnf("Event stream from %s lost: %v, reconnecting in %s", c.config.URL, err, backoff)
+
+        if time.Since(started) > maxBackoff {
+            backoff = baseBackoff
+        }
+        select {
+        case <-time.After(backoff):
+        case <-c.stop:
+            return
+        }
+        backoff *= 2
+        if backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+// Close ends the event stream and stops reconnecting
+func (c *Client) Close() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.closed {
+        close(c.stop)
+    }
+    c.closed = true
+    if c.ws != nil {
+        c.ws.Close()
+    }
+}
+
+// Status returns a snapshot of the event stream state
+func (c *Client) Status() Status {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.status
+}
+
+func (c *Client) isClosed() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.closed
+}
+
+func (c *Client) session() error {
+    wsURL := c.config.URL + "/events?" + url.Values{"app": {c.config.App}}.Encode()
+    switch {
+    case strings.HasPrefix(wsURL, "https://"):
+        wsURL = "wss://" + strings.TrimPrefix(wsURL, "https://")
+    case strings.HasPrefix(wsURL, "http://"):
+        wsURL = "ws://" + strings.TrimPrefix(wsURL, "http://")
+    }
+    auth := base64.StdEncoding.EncodeToString([]byte(c.config.Username + ":" + c.config.Password))
+    header := http.Header{"Authorization": {"Basic " + auth}}
+
+    ws, err := dialWebSocket(wsURL, header)
+    if err != nil {
+        return err
+    }
+    defer ws.Close()
+
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        return nil
+    }
+    c.ws = ws
+    c.mu.Unlock()
+
+    c.recordConnected()
+    logger.Infof("Connected to %s, Stasis app %q", c.config.URL, c.config.App)
+
+    // Asterisk answers pings, so a silent half-open stream is noticed within
+    // a couple of intervals
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        ticker := time.NewTicker(pingInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+                ws.Ping()
+            }
+        }
+    }()
+
+    for {
+        ws.SetReadDeadline(time.Now().Add(3 * pingInterval))
+        data, err := ws.ReadMessage()
+        if err != nil {
+            return err
+        }
+        var ev Event
+        if err := json.Unmarshal(data, &ev); err != nil {
+            logger.Warnf("Ignoring malformed event: %v", err)
+            continue
+        }
+        c.recordEvent()
+        c.dispatch(ev)
+    }
+}
+
+// dispatch runs the handler, keeping a panic in it from killing the stream
+func (c *Client) dispatch(ev Event) {
+    defer func() {
+        if rec := recover(); rec != nil {
+            logger.Warnf("ALERT: handler panicked on %s event: %v", ev.Type, rec)
+        }
+    }()
+    c.handler(ev)
+}
+
+// Answer answers a ringing channel
+func (c *Client) Answer(channelID string) error {
+    return c.do("POST", "/channels/"+url.PathEscape(channelID)+"/answer", nil, nil, nil)
+}
+
+// Hangup hangs up a channel with a Q.850 cause, 0 for normal clearing
+func (c *Client) Hangup(channelID string, cause int) error {
+    q := url.Values{}
+    if cause > 0 {
+        q.Set("reason_code", fmt.Sprint(cause))
+    }
+    return c.do("DELETE", "/channels/"+url.PathEscape(channelID), q, nil, nil)
+}
+
+// Continue returns a channel to the dialplan after its Stasis() application
+func (c *Client) Continue(channelID string) error {
+    return c.do("POST", "/channels/"+url.PathEscape(channelID)+"/continue", nil, nil, nil)
+}
+
+// ContinueAt returns a channel to the dialplan at priority 1 of extension
+// in context
+func (c *Client) ContinueAt(channelID, context, extension string) error {
+    q := url.Values{"context": {context}, "extension": {extension}, "priority": {"1"}}
+    return c.do("POST", "/channels/"+url.PathEscape(channelID)+"/continue", q, nil, nil)
+}
+
+// SetVariable sets a channel variable or function, e.g. PJSIP_HEADER(add,x)
+func (c *Client) SetVariable(channelID, name, value string) error {
+    q := url.Values{"variable": {name}, "value": {value}}
+    return c.do("POST", "/channels/"+url.PathEscape(channelID)+"/variable", q, nil, nil)
+}
+
+// Variable reads a channel variable or function, e.g. PJSIP_HEADER(read,x).
+// Unset variables are an error from Asterisk.
+func (c *Client) Variable(channelID, name string) (string, error) {
+    var out struct {
+        Value string `json:"value"`
+    }
+    q := url.Values{"variable": {name}}
+    if err := c.do("GET", "/channels/"+url.PathEscape(channelID)+"/variable", q, nil, &out); err != nil {
+        return "", err
+    }
+    return out.Value, nil
+}
+
+// Originate places a new channel into this client's Stasis app
+func (c *Client) Originate(o Originate) (*Channel, error) {
+    q := url.Values{"endpoint": {o.Endpoint}, "app": {c.config.App}}
+    if o.AppArgs != "" {
+        q.Set("appArgs", o.AppArgs)
+    }
+    if o.CallerID != "" {
+        q.Set("callerId", o.CallerID)
+    }
+    if o.Timeout > 0 {
+        q.Set("timeout", fmt.Sprint(o.Timeout))
+    }
+    var body interface{}
+    if len(o.Variables) > 0 {
+        body = map[string]interface{}{"variables": o.Variables}
+    }
+    var ch Channel
+    if err := c.do("POST", "/channels", q, body, &ch); err != nil {
+        return nil, err
+    }
+    return &ch, nil
+}
+
+// CreateBridge creates a mixing bridge and returns its ID
+func (c *Client) CreateBridge() (string, error) {
+    var out struct {
+        ID string `json:"id"`
+    }
+    if err := c.do("POST", "/bridges", url.Values{"type": {"mixing"}}, nil, &out); err != nil {
+        return "", err
+    }
+    return out.ID, nil
+}
+
+// AddChannels puts channels into a bridge
+func (c *Client) AddChannels(bridgeID string, channelIDs ...string) error {
+    q := url.Values{"channel": {strings.Join(channelIDs, ",")}}
+    return c.do("POST", "/bridges/"+url.PathEscape(bridgeID)+"/addChannel", q, nil, nil)
+}
+
+// DestroyBridge removes a bridge, leaving its channels up
+func (c *Client) DestroyBridge(bridgeID string) error {
+    return c.do("DELETE", "/bridges/"+url.PathEscape(bridgeID), nil, nil, nil)
+}
+
+func (c *Client) do(method, path string, query url.Values, body, out interface{}) error {
+    u := c.config.URL + path
+    if len(query) > 0 {
+        u += "?" + query.Encode()
+    }
+
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(data)
+    }
+    req, err := http.NewRequest(method, u, reader)
+    if err != nil {
+        return err
+    }
+    req.SetBasicAuth(c.config.Username, c.config.Password)
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        var apiErr struct {
+            Message string `json:"message"`
+        }
+        data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+        if json.Unmarshal(data, &apiErr) == nil && apiErr.Message != "" {
+            return fmt.Errorf("ari: %s %s: %s (%s)", method, path, apiErr.Message, resp.Status)
+        }
+        return fmt.Errorf("ari: %s %s: %s", method, path, resp.Status)
+    }
+    if out != nil {
+        return json.NewDecoder(resp.Body).Decode(out)
+    }
+    return nil
+}
+
+func (c *Client) recordConnected() {
+    now := time.Now()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.status.Connected = true
+    c.status.Since = &now
+    c.status.Connects++
+}
+
+func (c *Client) recordEvent() {
+    now := time.Now()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.status.Events++
+    c.status.LastEventAt = &now
+}
+
+func (c *Client) recordFailure(err error) {
+    now := time.Now()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.status.Connected {
+        c.status.Since = &now
+    }
+    c.status.Connected = false
+    c.status.Failures++
+    if err != nil {
+        c.status.LastError = err.Error()
+    }
+    c.status.LastErrorAt = &now
+}
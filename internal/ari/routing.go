@@ -0,0 +1,295 @@
+package ari
+
+import (
+    "context"
+    "fmt"
+    "net/url"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/router"
+)
+
+// In Stasis mode the router drives each hop itself instead of answering
+// dialplan callbacks. Calls are sent into the app from the dialplan:
+//
+//	exten => _X.,1,Stasis(s2,incoming,${CALLID},campaign=spring)   ; from S1
+//	exten => _X.,1,Stasis(s2,return)                                ; from S3
+//
+// incoming: arg 1 is the CallID (issued by S2 when it generates CallIDs,
+// otherwise the channel ID); later key=value args are campaign, domain,
+// pool, source and tag_* as on /api/processIncoming. return: arg 1 is an
+// optional match token.
+//
+// For either, the router routes the call, originates the next leg (S3 or
+// S4) into the app with the transformed ANI/DNIS and bridges both legs once
+// it answers. When either leg of a pair hangs up, so does the other. The
+// S1 pair spans the whole call, so its hangup finalises the call.
+//
+// A call the router refuses gets S2_STATUS=error, S2_ERROR and S2_RETRYABLE
+// and continues in the dialplan, as with the AGI scripts. A call overflowed
+// for want of a DID is dialled straight to S4, or for an announcement gets
+// S2_STATUS=overflow and continues at its DNIS in the announcement context.
+const (
+    argIncoming = "incoming"
+    argReturn   = "return"
+    argDial     = "dial" // originated leg; arg 1 is the inbound channel ID
+
+    originateTimeout = 60 // seconds the next hop may take to answer
+)
+
+// leg is one half of a bridged pair
+type leg struct {
+    callID   string
+    peer     string // channel on the other side of the bridge
+    bridge   string
+    finalise bool // hanging up ends the call (the S1 pair)
+}
+
+// Routing is the Stasis application driving the call loop
+type Routing struct {
+    client *Client
+    router *router.Router
+    legs   map[string]*leg // channel ID -> leg, only touched from the event loop
+}
+
+// NewRouting creates the ARI client for cfg and routes every call entering
+// its Stasis app through rt. Run the returned client to start.
+func NewRouting(cfg Config, rt *router.Router) *Client {
+    app := &Routing{router: rt, legs: make(map[string]*leg)}
+    app.client = NewClient(cfg, app.handle)
+    return app.client
+}
+
+func (a *Routing) handle(ev Event) {
+    if ev.Channel == nil {
+        return
+    }
+    switch ev.Type {
+    case "StasisStart":
+        a.stasisStart(ev.Channel, ev.Args)
+    case "ChannelDestroyed":
+        a.channelDestroyed(ev.Channel, ev.Cause)
+    }
+}
+
+func (a *Routing) stasisStart(ch *Channel, args []string) {
+    kind := ""
+    if len(args) > 0 {
+        kind = args[0]
+    }
+    switch kind {
+    case argIncoming:
+        a.routeIncoming(ch, args[1:])
+    case argReturn:
+        a.routeReturn(ch, args[1:])
+    case argDial:
+        if len(args) > 1 {
+            a.answered(ch, args[1])
+        }
+    default:
+        logger.Infof("Channel %s entered Stasis with unknown args %v, continuing", ch.Name, args)
+        a.client.Continue(ch.ID)
+    }
+}
+
+func (a *Routing) routeIncoming(ch *Channel, args []string) {
+    callID := ""
+    if len(args) > 0 && !strings.Contains(args[0], "=") {
+        callID, args = args[0], args[1:]
+    }
+    if callID == "" && !a.router.IssuesCallIDs() {
+        callID = ch.ID
+    }
+    ani := ch.Caller.Number
+    dnis := ch.Dialplan.Exten
+    clog := logger.Call(callID, "", ani)
+    clog.Infof("Incoming: channel=%s, callID=%s, ani=%s, dnis=%s", ch.Name, callID, ani, dnis)
+
+    params := url.Values{}
+    for _, arg := range args {
+        if key, value, ok := strings.Cut(arg, "="); ok {
+            params.Set(key, value)
+        }
+    }
+    tags := make(map[string]string)
+    for key, values := range params {
+        if strings.HasPrefix(key, "tag_") {
+            tags[strings.TrimPrefix(key, "tag_")] = values[0]
+        }
+    }
+    if len(tags) == 0 {
+        tags = nil
+    }
+
+    resp, err := a.router.ProcessIncomingCall(context.Background(), callID, ani, dnis, router.IncomingOptions{
+        Tags:        tags,
+        Campaign:    params.Get("campaign"),
+        Pool:        params.Get("pool"),
+        Source:      params.Get("source"),
+        Domain:      params.Get("domain"),
+        TraceParent: a.header(ch, "traceparent"),
+        Baggage:     a.header(ch, "baggage"),
+    })
+    if err != nil {
+        clog.Errorf("Incoming error: %v", err)
+        a.refuse(ch, err)
+        return
+    }
+    a.client.SetVariable(ch.ID, "S2_CALLID", resp.CallID)
+    if resp.Overflow != "" {
+        a.overflow(ch, resp)
+        return
+    }
+
+    if err := a.dial(ch, resp, true); err != nil {
+        logger.Call(resp.CallID, resp.DIDAssigned, ani).Errorf("Failed to dial S3 for call %s: %v", resp.CallID, err)
+        // Nothing reached S3; fail the call now rather than at the stale cleanup
+        a.router.CompleteCall(context.Background(), resp.CallID, "")
+        a.refuse(ch, err)
+    }
+}
+
+func (a *Routing) routeReturn(ch *Channel, args []string) {
+    token := ""
+    if len(args) > 0 {
+        token = args[0]
+    }
+    ani2 := ch.Caller.Number
+    did := ch.Dialplan.Exten
+    clog := logger.Call("", did, ani2)
+    clog.Infof("Return: channel=%s, ani2=%s, did=%s", ch.Name, ani2, did)
+
+    resp, err := a.router.ProcessReturnCall(context.Background(), ani2, did, router.ReturnOptions{
+        Token:       token,
+        TraceParent: a.header(ch, "traceparent"),
+        Baggage:     a.header(ch, "baggage"),
+    })
+    if err != nil {
+        clog.Errorf("Return error: %v", err)
+        a.refuse(ch, err)
+        return
+    }
+
+    if err := a.dial(ch, resp, false); err != nil {
+        logger.Call(resp.CallID, did, resp.ANIToSend).Errorf("Failed to dial S4 for call %s: %v", resp.CallID, err)
+        a.refuse(ch, err)
+    }
+}
+
+// overflow routes an incoming call the router found no DID for. Nothing is
+// tracked for it, so neither leg finalises a call.
+func (a *Routing) overflow(ch *Channel, resp *models.CallResponse) {
+    if resp.Overflow == router.OverflowAnnouncement {
+        a.client.SetVariable(ch.ID, "S2_OVERFLOW", resp.Overflow)
+        a.client.SetVariable(ch.ID, "S2_STATUS", resp.Status)
+        if err := a.client.ContinueAt(ch.ID, resp.NextHop, resp.DNISToSend); err != nil {
+            logger.Errorf("Failed to send %s to announcement context %s: %v", ch.Name, resp.NextHop, err)
+        }
+        return
+    }
+    if err := a.dial(ch, resp, false); err != nil {
+        logger.Call(resp.CallID, "", resp.ANIToSend).Errorf("Failed to dial S4 for overflowed call %s: %v", resp.CallID, err)
+        a.refuse(ch, err)
+    }
+}
+
+// dial originates the next hop for an inbound channel and pairs the two legs
+func (a *Routing) dial(in *Channel, resp *models.CallResponse, finalise bool) error {
+    bridge, err := a.client.CreateBridge()
+    if err != nil {
+        return err
+    }
+
+    vars := make(map[string]string)
+    if resp.TraceParent != "" {
+        vars["PJSIP_HEADER(add,traceparent)"] = resp.TraceParent
+        if resp.Baggage != "" {
+            vars["PJSIP_HEADER(add,baggage)"] = resp.Baggage
+        }
+    }
+    for name, value := range resp.Headers {
+        vars["PJSIP_HEADER(add,"+name+")"] = value
+    }
+    out, err := a.client.Originate(Originate{
+        Endpoint:  fmt.Sprintf("PJSIP/%s@%s", resp.DNISToSend, resp.NextHop),
+        CallerID:  resp.ANIToSend,
+        AppArgs:   argDial + "," + in.ID,
+        Timeout:   originateTimeout,
+        Variables: vars,
+    })
+    if err != nil {
+        a.client.DestroyBridge(bridge)
+        return err
+    }
+
+    a.legs[in.ID] = &leg{callID: resp.CallID, peer: out.ID, bridge: bridge, finalise: finalise}
+    a.legs[out.ID] = &leg{callID: resp.CallID, peer: in.ID, bridge: bridge, finalise: finalise}
+    logger.Call(resp.CallID, "", "").Infof("Call %s: dialling %s as %s for %s", resp.CallID, resp.DNISToSend, resp.ANIToSend, in.Name)
+    return nil
+}
+
+// answered bridges an originated leg with the inbound one once it picks up
+func (a *Routing) answered(out *Channel, inID string) {
+    l := a.legs[inID]
+    if l == nil {
+        // The caller gave up while we were dialling
+        a.client.Hangup(out.ID, 0)
+        return
+    }
+    if err := a.client.Answer(inID); err != nil {
+        logger.Call(l.callID, "", "").Errorf("Failed to answer %s for call %s: %v", inID, l.callID, err)
+    }
+    if err := a.client.AddChannels(l.bridge, inID, out.ID); err != nil {
+        logger.Call(l.callID, "", "").Errorf("Failed to bridge call %s: %v", l.callID, err)
+        a.client.Hangup(out.ID, 0)
+        return
+    }
+    logger.Call(l.callID, "", "").Infof("Call %s: bridged %s with %s", l.callID, inID, out.Name)
+}
+
+// channelDestroyed tears down the other leg of a pair and, for the S1 pair,
+// finalises the call with the hangup cause of whichever leg went first
+func (a *Routing) channelDestroyed(ch *Channel, cause int) {
+    l := a.legs[ch.ID]
+    if l == nil {
+        return
+    }
+    delete(a.legs, ch.ID)
+
+    if _, up := a.legs[l.peer]; !up {
+        // Second leg of the pair; the first already did the work
+        a.client.DestroyBridge(l.bridge)
+        return
+    }
+    a.client.Hangup(l.peer, cause)
+
+    if l.finalise {
+        if _, err := a.router.CompleteCall(context.Background(), l.callID, fmt.Sprint(cause)); err != nil {
+            logger.Call(l.callID, "", "").Errorf("Failed to complete call %s: %v", l.callID, err)
+        }
+    }
+}
+
+// header reads a SIP header of the inbound channel, "" if absent
+func (a *Routing) header(ch *Channel, name string) string {
+    v, err := a.client.Variable(ch.ID, "PJSIP_HEADER(read,"+name+")")
+    if err != nil {
+        return ""
+    }
+    return v
+}
+
+// refuse hands a channel back to the dialplan with the error variables set
+func (a *Routing) refuse(ch *Channel, err error) {
+    retryable := "0"
+    if router.Retryable(err) {
+        retryable = "1"
+    }
+    a.client.SetVariable(ch.ID, "S2_ERROR", err.Error())
+    a.client.SetVariable(ch.ID, "S2_RETRYABLE", retryable)
+    a.client.SetVariable(ch.ID, "S2_STATUS", "error")
+    if err := a.client.Continue(ch.ID); err != nil {
+        logger.Errorf("Failed to return %s to the dialplan: %v", ch.Name, err)
+    }
+}
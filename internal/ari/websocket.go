@@ -0,0 +1,243 @@
+package ari
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+)
+
+// The ARI event stream is a WebSocket. This is just enough of RFC 6455 for
+// a client reading JSON text messages: no extensions, no compression.
+const (
+    wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+    opContinuation = 0x0
+    opText         = 0x1
+    opBinary       = 0x2
+    opClose        = 0x8
+    opPing         = 0x9
+    opPong         = 0xA
+
+    maxMessageSize = 1 << 20
+)
+
+type wsConn struct {
+    conn net.Conn
+    r    *bufio.Reader
+    wmu  sync.Mutex
+}
+
+// dialWebSocket opens a ws:// or wss:// URL and completes the upgrade
+func dialWebSocket(rawURL string, header http.Header) (*wsConn, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+
+    host := u.Host
+    var conn net.Conn
+    switch u.Scheme {
+    case "ws":
+        if u.Port() == "" {
+            host += ":80"
+        }
+        conn, err = net.DialTimeout("tcp", host, dialTimeout)
+    case "wss":
+        if u.Port() == "" {
+            host += ":443"
+        }
+        conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", host,
+            &tls.Config{ServerName: u.Hostname()})
+    default:
+        return nil, fmt.Errorf("unsupported WebSocket scheme %q", u.Scheme)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := make([]byte, 16)
+    if _, err := rand.Read(nonce); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    key := base64.StdEncoding.EncodeToString(nonce)
+
+    req := &http.Request{
+        Method:     "GET",
+        URL:        u,
+        Host:       u.Host,
+        Header:     header.Clone(),
+        Proto:      "HTTP/1.1",
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+    }
+    if req.Header == nil {
+        req.Header = make(http.Header)
+    }
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Sec-WebSocket-Key", key)
+    req.Header.Set("Sec-WebSocket-Version", "13")
+
+    conn.SetDeadline(time.Now().Add(dialTimeout))
+    if err := req.Write(conn); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    r := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(r, req)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusSwitchingProtocols {
+        conn.Close()
+        return nil, fmt.Errorf("WebSocket upgrade refused: %s", resp.Status)
+    }
+    sum := sha1.Sum([]byte(key + wsGUID))
+    if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+        conn.Close()
+        return nil, fmt.Errorf("WebSocket upgrade returned a bad accept key")
+    }
+    conn.SetDeadline(time.Time{})
+    return &wsConn{conn: conn, r: r}, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings on
+// the way. A close frame from the server ends the stream with io.EOF.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+    var msg []byte
+    for {
+        fin, op, payload, err := c.readFrame()
+        if err != nil {
+            return nil, err
+        }
+        switch op {
+        case opPing:
+            if err := c.writeFrame(opPong, payload); err != nil {
+                return nil, err
+            }
+            continue
+        case opPong:
+            continue
+        case opClose:
+            c.writeFrame(opClose, payload)
+            return nil, io.EOF
+        case opText, opBinary, opContinuation:
+            if len(msg)+len(payload) > maxMessageSize {
+                return nil, fmt.Errorf("WebSocket message exceeds %d bytes", maxMessageSize)
+            }
+            msg = append(msg, payload...)
+            if fin {
+                return msg, nil
+            }
+        default:
+            return nil, fmt.Errorf("unexpected WebSocket opcode %#x", op)
+        }
+    }
+}
+
+// Ping sends a ping; the pong (or its absence) shows up on the read side
+func (c *wsConn) Ping() error {
+    return c.writeFrame(opPing, nil)
+}
+
+// SetReadDeadline bounds the wait for the next frame
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+    return c.conn.SetReadDeadline(t)
+}
+
+func (c *wsConn) Close() error {
+    c.writeFrame(opClose, nil)
+    return c.conn.Close()
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+    var head [2]byte
+    if _, err = io.ReadFull(c.r, head[:]); err != nil {
+        return
+    }
+    fin = head[0]&0x80 != 0
+    op = head[0] & 0x0F
+    masked := head[1]&0x80 != 0
+
+    n := uint64(head[1] & 0x7F)
+    switch n {
+    case 126:
+        var ext [2]byte
+        if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+            return
+        }
+        n = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+            return
+        }
+        n = binary.BigEndian.Uint64(ext[:])
+    }
+    if n > maxMessageSize {
+        err = fmt.Errorf("WebSocket frame of %d bytes exceeds %d", n, maxMessageSize)
+        return
+    }
+
+    var mask [4]byte
+    if masked {
+        if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+            return
+        }
+    }
+    payload = make([]byte, n)
+    if _, err = io.ReadFull(c.r, payload); err != nil {
+        return
+    }
+    if masked {
+        for i := range payload {
+            payload[i] ^= mask[i%4]
+        }
+    }
+    return
+}
+
+// writeFrame sends one unfragmented frame; client frames are always masked
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+    c.wmu.Lock()
+    defer c.wmu.Unlock()
+
+    frame := []byte{0x80 | op}
+    switch n := len(payload); {
+    case n < 126:
+        frame = append(frame, 0x80|byte(n))
+    case n <= 0xFFFF:
+        frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+    default:
+        var ext [8]byte
+        binary.BigEndian.PutUint64(ext[:], uint64(n))
+        frame = append(frame, 0x80|127)
+        frame = append(frame, ext[:]...)
+    }
+
+    var mask [4]byte
+    if _, err := rand.Read(mask[:]); err != nil {
+        return err
+    }
+    frame = append(frame, mask[:]...)
+    for i, b := range payload {
+        frame = append(frame, b^mask[i%4])
+    }
+
+    c.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+    _, err := c.conn.Write(frame)
+    return err
+}
@@ -0,0 +1,107 @@
+package capacity
+
+import (
+    "math"
+    "time"
+)
+
+// ErlangB returns the probability that a call offered to a pool of n DIDs
+// finds all of them busy, for traffic measured in Erlangs
+func ErlangB(traffic float64, n int) float64 {
+    if traffic <= 0 {
+        return 0
+    }
+    b := 1.0
+    for k := 1; k <= n; k++ {
+        b = traffic * b / (float64(k) + traffic*b)
+    }
+    return b
+}
+
+// RequiredServers returns the smallest pool size whose blocking probability
+// does not exceed target
+func RequiredServers(traffic, target float64) int {
+    if traffic <= 0 {
+        return 0
+    }
+    if target <= 0 {
+        target = math.SmallestNonzeroFloat64
+    }
+    b := 1.0
+    for n := 1; ; n++ {
+        b = traffic * b / (float64(n) + traffic*b)
+        if b <= target {
+            return n
+        }
+    }
+}
+
+// HourlyCalls is the number of call attempts started within one hour
+type HourlyCalls struct {
+    Hour  time.Time
+    Calls int
+}
+
+// HourLoad is the simulated load for one hour of the traffic curve
+type HourLoad struct {
+    Hour           time.Time `json:"hour"`
+    Calls          int       `json:"calls"`
+    OfferedErlangs float64   `json:"offered_erlangs"`
+    RequiredDIDs   int       `json:"required_dids"`
+}
+
+// Plan is the pool sizing recommendation for a traffic curve
+type Plan struct {
+    TargetBlocking  float64    `json:"target_blocking"`
+    AvgHoldSeconds  float64    `json:"avg_hold_seconds"`
+    PeakErlangs     float64    `json:"peak_erlangs"`
+    PeakHour        *time.Time `json:"peak_hour,omitempty"`
+    RequiredDIDs    int        `json:"required_dids"`
+    CurrentDIDs     int        `json:"current_dids"`
+    CurrentBlocking float64    `json:"current_blocking"`
+    Hours           []HourLoad `json:"hours,omitempty"`
+}
+
+// PlanForTraffic sizes the pool for a fixed offered load, e.g. "500 concurrent calls"
+func PlanForTraffic(erlangs, target float64, currentDIDs int) *Plan {
+    return &Plan{
+        TargetBlocking:  target,
+        PeakErlangs:     erlangs,
+        RequiredDIDs:    RequiredServers(erlangs, target),
+        CurrentDIDs:     currentDIDs,
+        CurrentBlocking: ErlangB(erlangs, currentDIDs),
+    }
+}
+
+// PlanForCurve converts hourly call counts into offered traffic using the
+// average DID hold time and sizes the pool for the busiest hour
+func PlanForCurve(curve []HourlyCalls, holdSeconds, target float64, currentDIDs int) *Plan {
+    plan := &Plan{
+        TargetBlocking: target,
+        AvgHoldSeconds: holdSeconds,
+        CurrentDIDs:    currentDIDs,
+        Hours:          make([]HourLoad, 0, len(curve)),
+    }
+
+    for _, h := range curve {
+        erlangs := float64(h.Calls) * holdSeconds / 3600
+        load := HourLoad{
+            Hour:           h.Hour,
+            Calls:          h.Calls,
+            OfferedErlangs: math.Round(erlangs*100) / 100,
+            RequiredDIDs:   RequiredServers(erlangs, target),
+        }
+        plan.Hours = append(plan.Hours, load)
+
+        if erlangs > plan.PeakErlangs {
+            hour := h.Hour
+            plan.PeakErlangs = erlangs
+            plan.PeakHour = &hour
+            plan.RequiredDIDs = load.RequiredDIDs
+        }
+    }
+
+    plan.CurrentBlocking = ErlangB(plan.PeakErlangs, currentDIDs)
+    plan.PeakErlangs = math.Round(plan.PeakErlangs*100) / 100
+    return plan
+}
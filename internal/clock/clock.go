@@ -0,0 +1,141 @@
+// Package clock lets time-dependent code run against a fake clock. The
+// router reads the time and starts its tickers through a Clock, so stale
+// calls, dedup windows, negative cache TTLs and override expiry can be
+// driven by advancing a Fake instead of sleeping.
+package clock
+
+import (
+    "sync"
+    "time"
+)
+
+// Clock is the source of time
+type Clock interface {
+    Now() time.Time
+    NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks like time.Ticker
+type Ticker interface {
+    C() <-chan time.Time
+    Stop()
+}
+
+// Since is the time elapsed on c since t
+func Since(c Clock, t time.Time) time.Duration {
+    return c.Now().Sub(t)
+}
+
+// Real returns the system clock
+func Real() Clock {
+    return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+    return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+    t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Fake is a clock that only moves when told to. Its tickers fire from
+// Advance, once per period crossed, dropping ticks a slow reader misses
+// just as time.Ticker does.
+type Fake struct {
+    mu      sync.Mutex
+    now     time.Time
+    tickers []*fakeTicker
+}
+
+// NewFake returns a fake clock reading start
+func NewFake(start time.Time) *Fake {
+    return &Fake{now: start}
+}
+
+func (f *Fake) Now() time.Time {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+    if d <= 0 {
+        panic("clock: non-positive interval for NewTicker")
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    t := &fakeTicker{clock: f, period: d, next: f.now.Add(d), c: make(chan time.Time, 1)}
+    f.tickers = append(f.tickers, t)
+    return t
+}
+
+// Advance moves the clock forward by d, firing every tick due on the way
+// in time order
+func (f *Fake) Advance(d time.Duration) {
+    f.mu.Lock()
+    target := f.now.Add(d)
+    for {
+        t := f.nextDue(target)
+        if t == nil {
+            break
+        }
+        f.now = t.next
+        t.next = t.next.Add(t.period)
+        select {
+        case t.c <- f.now:
+        default:
+        }
+    }
+    f.now = target
+    f.mu.Unlock()
+}
+
+// Set jumps the clock to t, firing the ticks due in between when t is
+// later than now
+func (f *Fake) Set(t time.Time) {
+    f.Advance(t.Sub(f.Now()))
+}
+
+// nextDue returns the ticker firing soonest at or before target. Caller
+// must hold f.mu.
+func (f *Fake) nextDue(target time.Time) *fakeTicker {
+    var first *fakeTicker
+    for _, t := range f.tickers {
+        if t.next.After(target) {
+            continue
+        }
+        if first == nil || t.next.Before(first.next) {
+            first = t
+        }
+    }
+    return first
+}
+
+type fakeTicker struct {
+    clock  *Fake
+    period time.Duration
+    next   time.Time
+    c      chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+    f := t.clock
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    for i, other := range f.tickers {
+        if other == t {
+            f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+            return
+        }
+    }
+}
@@ -0,0 +1,556 @@
+// Package config loads the router's settings. Each setting has a built-in
+// default, can be set in a YAML file (-config), overridden by an
+// environment variable and finally by its command-line flag:
+//
+//	database:
+//	  host: db.internal
+//	  password: secret       # or S2_DATABASE_PASSWORD=secret
+//	routing:
+//	  forward_trunk: trunk-s3
+//	webhooks:
+//	  urls: [https://hooks.example.com/s2]
+//
+// The environment variable for a setting is S2_ followed by its section
+// and key in upper case, e.g. S2_HTTP_PORT or S2_REDIS_ADDR. Lists take
+// comma-separated values in flags and environment variables.
+package config
+
+import (
+    "flag"
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const envPrefix = "S2_"
+
+// Config holds every router setting. The yaml tag names the key in its
+// section, flag the command-line flag and usage its help text.
+type Config struct {
+    HTTP struct {
+        Port              int           `yaml:"port" flag:"port" usage:"HTTP server port"`
+        APIKey            string        `yaml:"api_key" flag:"apikey" usage:"Shared API key for the dialplan callbacks, and the admin routes without JWT keys (empty disables auth)"`
+        RateLimit         float64       `yaml:"rate_limit" flag:"ratelimit" usage:"Max API requests per second (0 disables)"`
+        RateBurst         int           `yaml:"rate_burst" flag:"rateburst" usage:"Rate limiter burst size"`
+        ClientRateLimit   float64       `yaml:"client_rate_limit" flag:"client-ratelimit" usage:"Max API requests per second from any one client (0 disables)"`
+        ClientRateBurst   int           `yaml:"client_rate_burst" flag:"client-rateburst" usage:"Per-client rate limiter burst size"`
+        ClientRateBy      string        `yaml:"client_rate_by" flag:"client-rate-by" usage:"What tells clients apart for the per-client limit: ip (source address) or apikey (bearer token subject or API key, else source address)"`
+        AllowedSources    []string      `yaml:"allowed_sources" flag:"http-allowed-sources" usage:"Comma-separated CIDRs or addresses of the S1/S3 hosts allowed to call processIncoming and processReturn (empty allows all)"`
+        ReadTimeout       time.Duration `yaml:"read_timeout" flag:"http-read-timeout" usage:"Time allowed to read an API request"`
+        WriteTimeout      time.Duration `yaml:"write_timeout" flag:"http-write-timeout" usage:"Time allowed to write an API response"`
+        TLSCert           string        `yaml:"tls_cert" flag:"http-tls-cert" usage:"PEM certificate (chain) to serve the API over HTTPS with (empty serves HTTP)"`
+        TLSKey            string        `yaml:"tls_key" flag:"http-tls-key" usage:"PEM private key of the TLS certificate"`
+        TLSClientCA       string        `yaml:"tls_client_ca" flag:"http-tls-client-ca" usage:"CA bundle S1/S3 client certificates must be signed by, enabling mutual TLS (empty disables)"`
+        TLSClientCNs      []string      `yaml:"tls_client_cns" flag:"http-tls-client-cns" usage:"Comma-separated client certificate common names admitted (empty admits any the CA signed)"`
+        TLSClientAuth     string        `yaml:"tls_client_auth" flag:"http-tls-client-auth" usage:"require (no /api access without a client certificate) or optional (verify certificates given, admit clients without one)"`
+        TLSReloadInterval time.Duration `yaml:"tls_reload_interval" flag:"http-tls-reload-interval" usage:"How often the certificate files are checked for changes and reloaded (0 only reloads on SIGHUP)"`
+        WatchdogInterval  time.Duration `yaml:"watchdog_interval" flag:"http-watchdog-interval" usage:"How often the watchdog requests /api/health over loopback (0 disables)"`
+        WatchdogTimeout   time.Duration `yaml:"watchdog_timeout" flag:"http-watchdog-timeout" usage:"Time a watchdog self-request may take"`
+        WatchdogFailures  int           `yaml:"watchdog_failures" flag:"http-watchdog-failures" usage:"Failed self-requests in a row before the watchdog acts"`
+        WatchdogAction    string        `yaml:"watchdog_action" flag:"http-watchdog-action" usage:"What the watchdog does with a wedged listener after logging a goroutine dump: log, restart (rebind the listener) or exit (for systemd to restart)"`
+        JWTKeys           []string      `yaml:"jwt_keys" flag:"http-jwt-keys" usage:"Comma-separated id:secret keys for admin bearer tokens, the first signs and all verify (empty leaves the admin routes on the API key)"`
+        JWTTTL            time.Duration `yaml:"jwt_ttl" flag:"http-jwt-ttl" usage:"Lifetime of admin bearer tokens"`
+        JWTMaxSession     time.Duration `yaml:"jwt_max_session" flag:"http-jwt-max-session" usage:"Time from a token's issue after which it and its refreshes can no longer be refreshed (0 allows refreshing forever)"`
+    } `yaml:"http"`
+
+    Database struct {
+        Driver              string        `yaml:"driver" flag:"db-driver" usage:"Storage backend: mysql, postgres or sqlite (only mysql has the feature tables)"`
+        Host                string        `yaml:"host" flag:"dbhost" usage:"Database host"`
+        Port                int           `yaml:"port" flag:"dbport" usage:"Database port"`
+        User                string        `yaml:"user" flag:"dbuser" usage:"Database user"`
+        Password            string        `yaml:"password" flag:"dbpass" usage:"Database password"`
+        Name                string        `yaml:"name" flag:"dbname" usage:"Database name, or the database file for sqlite"`
+        QueryTimeout        time.Duration `yaml:"query_timeout" flag:"db-query-timeout" usage:"Time allowed for each database operation (0 disables)"`
+        SchemaCheckInterval time.Duration `yaml:"schema_check_interval" flag:"db-schema-check-interval" usage:"How often the live schema is compared with the expected one for /api/schema (0 only checks on startup)"`
+        SchemaRepair        bool          `yaml:"schema_repair" flag:"db-schema-repair" usage:"Apply safe schema fixes (missing tables, columns and plain indexes, widened columns) automatically"`
+        WriteRetryMaxAge    time.Duration `yaml:"write_retry_max_age" flag:"db-write-retry-max-age" usage:"How long a failed call state write is retried before it is reported as unreconciled (0 retries until shutdown)"`
+        BreakerFailures     int           `yaml:"breaker_failures" flag:"db-breaker-failures" usage:"Storage calls in a row failing to reach MySQL before the circuit breaker opens and calls fail fast (0 disables)"`
+        ReconnectMaxBackoff time.Duration `yaml:"reconnect_max_backoff" flag:"db-reconnect-max-backoff" usage:"Longest wait between reconnect attempts while the circuit breaker is open"`
+        DegradedMode        bool          `yaml:"degraded_mode" flag:"db-degraded-mode" usage:"Keep allocating DIDs from an in-memory pool snapshot while the circuit breaker is open, writing back when MySQL returns"`
+        WriteRetryLimit     int           `yaml:"write_retry_limit" flag:"db-write-retry-limit" usage:"Failed call state writes held for retry before the oldest are given up"`
+        WriteBehindWorkers  int           `yaml:"write_behind_workers" flag:"db-write-behind-workers" usage:"Writers call records and status changes are handed to so the signaling path does not wait on the database (0 writes inline)"`
+        WriteBehindBuffer   int           `yaml:"write_behind_buffer" flag:"db-write-behind-buffer" usage:"Call state writes each write-behind writer buffers before new ones are dropped and reported as unreconciled"`
+        WriteBatchInterval  time.Duration `yaml:"write_batch_interval" flag:"db-write-batch-interval" usage:"Tick over which write-behind writers coalesce call records and status changes into multi-row statements (0 writes them one by one)"`
+        WriteReportFile     string        `yaml:"write_report_file" flag:"db-write-report-file" usage:"JSON lines file unreconciled call state writes are appended to (empty keeps the report in memory only)"`
+    } `yaml:"database"`
+
+    Routing struct {
+        ForwardTrunk          string        `yaml:"forward_trunk" flag:"forward-trunk" usage:"Default trunk towards S3"`
+        ReturnTrunk           string        `yaml:"return_trunk" flag:"return-trunk" usage:"Default trunk towards S4"`
+        RecordingPath         string        `yaml:"recording_path" flag:"recording-path" usage:"Directory call recordings are written to"`
+        TokenMode             string        `yaml:"token_mode" flag:"token-mode" usage:"Embed a match token in the forwarded DNIS: prefix or suffix (empty disables)"`
+        TokenDigits           int           `yaml:"token_digits" flag:"token-digits" usage:"Length of the match token"`
+        DedupWindow           time.Duration `yaml:"dedup_window" flag:"dedup-window" usage:"Treat identical ANI/DNIS within this window as one call (0 disables)"`
+        StatelessKey          string        `yaml:"stateless_key" flag:"stateless-key" usage:"HMAC key enabling stateless routing (ANI-1 encoded into the forwarded DNIS)"`
+        CallIDGenerator       string        `yaml:"callid_generator" flag:"callid-generator" usage:"Issue CallIDs for calls S1 sends without one: ulid or snowflake (empty requires callid)"`
+        NodeID                int           `yaml:"node_id" flag:"node-id" usage:"Snowflake node ID (0-1023), unique per router instance"`
+        AnomalyThreshold      float64       `yaml:"anomaly_threshold" flag:"anomaly-threshold" usage:"Traffic deviation score that raises an alert (0 disables)"`
+        ReadOnly              bool          `yaml:"readonly" flag:"readonly" usage:"Serve stats/CDR/health only and refuse allocations and writes (DR replicas)"`
+        InputNormalization    string        `yaml:"input_normalization" flag:"input-normalization" usage:"Handling of SIP URIs, lost plus signs, parameters and escapes in Asterisk-supplied numbers: tolerant (rewrite), strict (reject) or off"`
+        E164Mode              string        `yaml:"e164_mode" flag:"e164-mode" usage:"Validate ANI, DNIS and DIDs against numbering_rules: rewrite (to E.164, numbers without a rule pass) or strict (numbers without a rule are refused); empty disables"`
+        E164HomeCountry       string        `yaml:"e164_home_country" flag:"e164-home-country" usage:"Country code national numbers are read against; needs a numbering rule"`
+        NumberingRules        []string      `yaml:"numbering_rules" flag:"numbering-rules" usage:"Comma-separated cc=min[-max][:trunk[:intl]] national number lengths and dialling prefixes per country code, e.g. 44=9-10:0,1=10:1:011"`
+        DIDSelection          string        `yaml:"did_selection" flag:"did-selection" usage:"How free DIDs are picked: random, lru or round-robin"`
+        DIDSelectionPools     []string      `yaml:"did_selection_pools" flag:"did-selection-pools" usage:"Comma-separated tenant=strategy overrides of -did-selection per pool"`
+        NumberFormats         []string      `yaml:"number_formats" flag:"number-formats" usage:"Comma-separated trunk=e164|00|national[:countrycode] ANI/DNIS output formats"`
+        DIDCooldown           time.Duration `yaml:"did_cooldown" flag:"did-cooldown" usage:"Keep a released DID out of the pool this long so CDRs of consecutive calls don't collide (0 disables)"`
+        DIDWait               time.Duration `yaml:"did_wait" flag:"did-wait" usage:"How long a call waits for a DID to be released when its pool is exhausted (0 fails at once)"`
+        Overflow              string        `yaml:"overflow" flag:"overflow" usage:"What a call gets when no DID is free: direct (straight to S4 with the original ANI/DNIS) or announcement (empty refuses it)"`
+        OverflowTarget        string        `yaml:"overflow_target" flag:"overflow-target" usage:"S4 trunk for -overflow direct (empty uses the return-leg trunk), or the dialplan context for -overflow announcement"`
+        PoolPrefixes          []string      `yaml:"pool_prefixes" flag:"pool-prefixes" usage:"Comma-separated prefix=pool mapping DNIS prefixes to DID pools for calls that name none"`
+        CountryPrefixes       []string      `yaml:"country_prefixes" flag:"country-prefixes" usage:"Comma-separated prefix=country mapping international prefixes to the dids country column, to prefer DIDs of the destination country"`
+        CountryFromNumberPlan bool          `yaml:"country_from_number_plan" flag:"country-from-number-plan" usage:"Prefer DIDs whose country column holds the ISO code the built-in numbering plan gives the destination, where country_prefixes has no match"`
+        ANIMismatch           string        `yaml:"ani_mismatch" flag:"ani-mismatch" usage:"What a return leg whose ANI-2 is not the original DNIS gets: warn (logged only) or strict (refused as ani_mismatch)"`
+        ANIMismatchQuarantine time.Duration `yaml:"ani_mismatch_quarantine" flag:"ani-mismatch-quarantine" usage:"Keep the DID of a mismatched return leg out of the pool this long after its call (0 disables)"`
+        StateReloadLookback   time.Duration `yaml:"state_reload_lookback" flag:"state-reload-lookback" usage:"Unfinished calls started within this long that /api/admin/reloadState loads by default (0 loads what a restart would)"`
+        MaxCallDuration       time.Duration `yaml:"max_call_duration" flag:"max-call-duration" usage:"End returned calls and free their DID after this long, for lost hangups (0 disables; tenants may override)"`
+        MaxConcurrentCalls    int           `yaml:"max_concurrent_calls" flag:"max-concurrent-calls" usage:"Calls tracked at once before new ones are refused as capacity (0 disables)"`
+        MaxCPS                float64       `yaml:"max_cps" flag:"max-cps" usage:"Incoming calls per second the router admits before answering throttled (0 disables)"`
+        CPSBurst              int           `yaml:"cps_burst" flag:"cps-burst" usage:"Calls admitted at once above -max-cps (0 means one second's worth)"`
+        HideCost              bool          `yaml:"hide_cost" flag:"hide-cost" usage:"Leave the per-call cost estimate out of routing responses, for untrusted S1 callers"`
+        S1Partitions          int           `yaml:"s1_partitions" flag:"s1-partitions" usage:"Hash the DID pool into this many partitions assigned to S1 sources via /api/partitions (0 disables)"`
+    } `yaml:"routing"`
+
+    Reputation struct {
+        Trunk     string  `yaml:"trunk" flag:"reputation-trunk" usage:"Trunk for callers with a low ANI reputation (empty disables)"`
+        Threshold float64 `yaml:"threshold" flag:"reputation-threshold" usage:"ANI reputation score (0-100) below which calls go to -reputation-trunk"`
+    } `yaml:"reputation"`
+
+    Webhooks struct {
+        URLs     []string `yaml:"urls" flag:"webhooks" usage:"Comma-separated URLs notified of call events"`
+        Attempts int      `yaml:"attempts" flag:"webhook-attempts" usage:"Delivery attempts before a webhook is dead-lettered"`
+    } `yaml:"webhooks"`
+
+    Redis struct {
+        Addr     string `yaml:"addr" flag:"redis-addr" usage:"Redis host:port for call state shared between router instances (empty disables)"`
+        Password string `yaml:"password" flag:"redis-password" usage:"Redis password"`
+        DB       int    `yaml:"db" flag:"redis-db" usage:"Redis database number"`
+        Prefix   string `yaml:"prefix" flag:"redis-prefix" usage:"Prefix for shared call state keys"`
+    } `yaml:"redis"`
+
+    Replication struct {
+        Peer   string `yaml:"peer" flag:"replication-peer" usage:"Warm standby host:port to stream in-flight call state to (empty disables)"`
+        Listen string `yaml:"listen" flag:"replication-listen" usage:"Address accepting a primary's call-state stream, e.g. :4574, on a standby (empty disables)"`
+        Key    string `yaml:"key" flag:"replication-key" usage:"Shared secret the primary presents to the standby"`
+        TLS    bool   `yaml:"tls" flag:"replication-tls" usage:"Stream in mutual TLS with the http.tls_cert, tls_key, tls_client_ca and tls_client_cns settings, on the primary and the standby alike"`
+    } `yaml:"replication"`
+
+    Migration struct {
+        V1DSN               string        `yaml:"v1_dsn" flag:"v1-dsn" usage:"MySQL DSN of the v1 router database DID claims and releases are mirrored into while both routers run (empty disables)"`
+        V1ReconcileInterval time.Duration `yaml:"v1_reconcile_interval" flag:"v1-reconcile-interval" usage:"How often writes v1 refused are retried and DIDs released in bulk are freed in v1"`
+    } `yaml:"migration"`
+
+    EventStream struct {
+        Backend string `yaml:"backend" flag:"event-stream" usage:"Stream call events to a message bus: nats or kafka (empty disables)"`
+        URL     string `yaml:"url" flag:"event-stream-url" usage:"nats://host:4222, or the Kafka REST Proxy URL, e.g. http://localhost:8082"`
+        Topic   string `yaml:"topic" flag:"event-stream-topic" usage:"NATS subject or Kafka topic call events are published to"`
+    } `yaml:"event_stream"`
+
+    CDR struct {
+        Sinks    []string      `yaml:"sinks" flag:"cdr-sinks" usage:"Comma-separated sinks every finished call's CDR is written to: mysql, file and http (empty disables)"`
+        File     string        `yaml:"file" flag:"cdr-file" usage:"File the file sink appends CDRs to"`
+        Format   string        `yaml:"format" flag:"cdr-format" usage:"File sink format: csv or jsonl"`
+        Rotate   time.Duration `yaml:"rotate" flag:"cdr-rotate" usage:"How often the CDR file is rotated (0 never on age)"`
+        RotateMB int           `yaml:"rotate_mb" flag:"cdr-rotate-mb" usage:"Megabytes at which the CDR file is rotated (0 never on size)"`
+        Keep     int           `yaml:"keep" flag:"cdr-keep" usage:"Rotated CDR files kept, oldest deleted first (0 keeps all)"`
+        HTTPURL  string        `yaml:"http_url" flag:"cdr-http-url" usage:"URL the http sink POSTs CDR batches to as a JSON array"`
+        Buffer   int           `yaml:"buffer" flag:"cdr-buffer" usage:"CDRs each sink holds while it is failing before dropping the oldest"`
+    } `yaml:"cdr"`
+
+    Provisioning struct {
+        URL        string        `yaml:"url" flag:"provisioning-url" usage:"Number provider connector DIDs are ordered from when a pool runs full (empty disables)"`
+        Threshold  float64       `yaml:"threshold" flag:"provisioning-threshold" usage:"Pool utilization (0-1) that triggers provisioning"`
+        Sustain    time.Duration `yaml:"sustain" flag:"provisioning-sustain" usage:"How long a pool stays above the threshold before DIDs are ordered"`
+        Batch      int           `yaml:"batch" flag:"provisioning-batch" usage:"DIDs ordered per request"`
+        BudgetDIDs int           `yaml:"budget_dids" flag:"provisioning-budget-dids" usage:"DIDs ordered per calendar month (0 is unlimited)"`
+        BudgetCost float64       `yaml:"budget_cost" flag:"provisioning-budget-cost" usage:"Connector cost per calendar month (0 is unlimited)"`
+        Approval   bool          `yaml:"approval" flag:"provisioning-approval" usage:"Hold requests until approved via POST /api/provisioning/{id}/approve"`
+    } `yaml:"provisioning"`
+
+    AGI struct {
+        Addr string `yaml:"addr" flag:"agi-addr" usage:"FastAGI listen address, e.g. :4573 (empty disables)"`
+    } `yaml:"agi"`
+
+    ARI struct {
+        URL      string `yaml:"url" flag:"ari-url" usage:"Asterisk ARI base URL, e.g. http://127.0.0.1:8088/ari, to drive calls as a Stasis app (empty disables)"`
+        User     string `yaml:"user" flag:"ari-user" usage:"ARI username"`
+        Password string `yaml:"password" flag:"ari-password" usage:"ARI password"`
+        App      string `yaml:"app" flag:"ari-app" usage:"Stasis application name"`
+    } `yaml:"ari"`
+
+    AMI struct {
+        Addr   string `yaml:"addr" flag:"ami-addr" usage:"Asterisk Manager host:port for hangup detection (empty disables)"`
+        User   string `yaml:"user" flag:"ami-user" usage:"Asterisk Manager username"`
+        Secret string `yaml:"secret" flag:"ami-secret" usage:"Asterisk Manager secret"`
+    } `yaml:"ami"`
+
+    NegativeCache struct {
+        TTL      time.Duration `yaml:"ttl" flag:"negcache-ttl" usage:"Block a destination prefix on a trunk for this long after repeated hard failures (0 disables)"`
+        Failures int           `yaml:"failures" flag:"negcache-failures" usage:"Hard failures within -negcache-ttl that block a destination"`
+        Digits   int           `yaml:"digits" flag:"negcache-digits" usage:"Destination prefix length failures are grouped by"`
+        Reroute  string        `yaml:"reroute" flag:"negcache-reroute" usage:"Trunk tried for blocked destinations before failing fast (empty fails fast)"`
+        Failback string        `yaml:"failback" flag:"negcache-failback" usage:"How a blocked destination returns once its block expires: immediate, manual or ramp"`
+        Ramp     time.Duration `yaml:"ramp" flag:"negcache-ramp" usage:"Time -negcache-failback=ramp takes to admit all calls again"`
+    } `yaml:"negative_cache"`
+
+    Recordings struct {
+        QuotaMB    int           `yaml:"quota_mb" flag:"recording-quota-mb" usage:"Megabytes -recording-path may hold before the quota is enforced (0 disables)"`
+        FullAction string        `yaml:"full_action" flag:"recording-full-action" usage:"What to do over quota: stop (stop requesting recordings) or purge (delete the oldest)"`
+        Interval   time.Duration `yaml:"interval" flag:"recording-interval" usage:"How often recordings disk use is measured (0 disables)"`
+        Metadata   string        `yaml:"metadata" flag:"recording-metadata" usage:"Where SHA-256 checksums of finished recordings are kept for tamper checks: mysql or sidecar (empty disables)"`
+    } `yaml:"recordings"`
+
+    Exports struct {
+        Dir       string        `yaml:"dir" flag:"export-dir" usage:"Directory for async CDR export files (empty disables exports)"`
+        Retention time.Duration `yaml:"retention" flag:"export-retention" usage:"How long finished CDR exports are kept"`
+    } `yaml:"exports"`
+
+    Stats struct {
+        Interval  time.Duration `yaml:"interval" flag:"stats-interval" usage:"How often key stats are saved for /api/stats/history (0 disables)"`
+        Retention time.Duration `yaml:"retention" flag:"stats-retention" usage:"How long stats snapshots are kept"`
+    } `yaml:"stats"`
+
+    Archive struct {
+        AfterDays     int           `yaml:"after_days" flag:"archive-after-days" usage:"Closed call records older than this many days are moved to call_records_archive (0 disables)"`
+        RetentionDays int           `yaml:"retention_days" flag:"archive-retention-days" usage:"Archived call records older than this many days are deleted, with their events, notes and recording metadata (0 keeps them)"`
+        Interval      time.Duration `yaml:"interval" flag:"archive-interval" usage:"How often the call record archiver runs"`
+        Batch         int           `yaml:"batch" flag:"archive-batch" usage:"Call records moved per archive transaction"`
+    } `yaml:"archive"`
+
+    Tracing struct {
+        Endpoint string `yaml:"endpoint" flag:"trace-endpoint" usage:"OTLP/HTTP traces URL, e.g. http://jaeger:4318/v1/traces (empty only propagates trace context)"`
+    } `yaml:"tracing"`
+
+    Diagnostics struct {
+        Dir        string        `yaml:"dir" flag:"diagnostics-dir" usage:"Directory profiles and recent logs are captured into when routing breaches its SLOs (empty disables)"`
+        P99Latency time.Duration `yaml:"p99_latency" flag:"slo-p99-latency" usage:"Routing p99 latency that triggers a diagnostics capture (0 disables)"`
+        ErrorRate  float64       `yaml:"error_rate" flag:"slo-error-rate" usage:"Share of routing requests (0-1) failing on S2's side that triggers a diagnostics capture (0 disables)"`
+        Window     time.Duration `yaml:"window" flag:"slo-window" usage:"Period routing p99 latency and error rate are measured over"`
+        CPUProfile time.Duration `yaml:"cpu_profile" flag:"diagnostics-cpu-profile" usage:"Length of the CPU profile in a diagnostics bundle"`
+        Cooldown   time.Duration `yaml:"cooldown" flag:"diagnostics-cooldown" usage:"Least time between diagnostics captures"`
+        Keep       int           `yaml:"keep" flag:"diagnostics-keep" usage:"Diagnostics bundles kept on disk, oldest deleted first"`
+        UploadURL  string        `yaml:"upload_url" flag:"diagnostics-upload-url" usage:"URL diagnostics bundles are POSTed to (empty keeps them local)"`
+    } `yaml:"diagnostics"`
+
+    Logging struct {
+        Level  string `yaml:"level" flag:"loglevel" usage:"Lowest log level written: debug, info, warn or error"`
+        Format string `yaml:"format" flag:"log-format" usage:"Log line format: text or json (one object per line with call_id, did and ani fields)"`
+    } `yaml:"logging"`
+
+    Shutdown struct {
+        DrainTimeout time.Duration `yaml:"drain_timeout" flag:"drain-timeout" usage:"How long SIGTERM waits for active calls to finish before exiting"`
+    } `yaml:"shutdown"`
+}
+
+// Default returns the built-in settings
+func Default() *Config {
+    c := &Config{}
+    c.HTTP.Port = 8001
+    c.HTTP.RateBurst = 50
+    c.HTTP.ClientRateBurst = 20
+    c.HTTP.ClientRateBy = "ip"
+    c.HTTP.ReadTimeout = 15 * time.Second
+    c.HTTP.WriteTimeout = 15 * time.Second
+    c.HTTP.TLSReloadInterval = 10 * time.Second
+    c.HTTP.TLSClientAuth = "require"
+    c.HTTP.WatchdogInterval = 30 * time.Second
+    c.HTTP.WatchdogTimeout = 5 * time.Second
+    c.HTTP.WatchdogFailures = 3
+    c.HTTP.WatchdogAction = "log"
+    c.HTTP.JWTTTL = time.Hour
+    c.HTTP.JWTMaxSession = 12 * time.Hour
+    c.Database.Driver = "mysql"
+    c.Database.Host = "localhost"
+    c.Database.Port = 3306
+    c.Database.User = "root"
+    c.Database.Password = "temppass"
+    c.Database.Name = "call_routing"
+    c.Database.QueryTimeout = 3 * time.Second
+    c.Database.SchemaCheckInterval = time.Hour
+    c.Database.WriteRetryMaxAge = time.Hour
+    c.Database.WriteReportFile = "/var/spool/s2/unreconciled-writes.jsonl"
+    c.Database.BreakerFailures = 5
+    c.Database.ReconnectMaxBackoff = 30 * time.Second
+    c.Database.WriteRetryLimit = 10000
+    c.Database.WriteBehindWorkers = 4
+    c.Database.WriteBehindBuffer = 10000
+    c.Database.WriteBatchInterval = 10 * time.Millisecond
+    c.Routing.ForwardTrunk = "trunk-s3"
+    c.Routing.ReturnTrunk = "trunk-s4"
+    c.Routing.RecordingPath = "/var/spool/asterisk/recordings"
+    c.Routing.TokenDigits = 4
+    c.Routing.AnomalyThreshold = 3
+    c.Routing.DIDSelection = "random"
+    c.Routing.InputNormalization = "tolerant"
+    c.Routing.ANIMismatch = "warn"
+    c.Reputation.Threshold = 30
+    c.Webhooks.Attempts = 10
+    c.Redis.Prefix = "s2:"
+    c.EventStream.Topic = "s2.calls"
+    c.Migration.V1ReconcileInterval = 30 * time.Second
+    c.CDR.File = "/var/spool/s2/cdr/cdr.csv"
+    c.CDR.Format = "csv"
+    c.CDR.Rotate = time.Hour
+    c.CDR.Keep = 168
+    c.CDR.Buffer = 100000
+    c.Provisioning.Threshold = 0.85
+    c.Provisioning.Sustain = 10 * time.Minute
+    c.Provisioning.Batch = 50
+    c.ARI.App = "s2"
+    c.NegativeCache.Failures = 3
+    c.NegativeCache.Digits = 6
+    c.NegativeCache.Failback = "immediate"
+    c.NegativeCache.Ramp = 5 * time.Minute
+    c.Recordings.FullAction = "stop"
+    c.Recordings.Interval = time.Minute
+    c.Recordings.Metadata = "mysql"
+    c.Exports.Dir = "/var/spool/s2/exports"
+    c.Exports.Retention = 24 * time.Hour
+    c.Stats.Interval = time.Minute
+    c.Stats.Retention = 7 * 24 * time.Hour
+    c.Archive.Interval = time.Hour
+    c.Archive.Batch = 5000
+    c.Diagnostics.Window = time.Minute
+    c.Diagnostics.CPUProfile = 10 * time.Second
+    c.Diagnostics.Cooldown = 15 * time.Minute
+    c.Diagnostics.Keep = 10
+    c.Logging.Level = "info"
+    c.Logging.Format = "text"
+    c.Shutdown.DrainTimeout = 30 * time.Second
+    return c
+}
+
+// DSN is the data source name for the database section, in the form the
+// configured driver expects
+func (c *Config) DSN() string {
+    d := c.Database
+    switch d.Driver {
+    case "postgres":
+        u := url.URL{
+            Scheme: "postgres",
+            User:   url.UserPassword(d.User, d.Password),
+            Host:   net.JoinHostPort(d.Host, strconv.Itoa(d.Port)),
+            Path:   "/" + d.Name,
+        }
+        return u.String()
+    case "sqlite":
+        return "file:" + d.Name + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+    }
+    return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", d.User, d.Password, d.Host, d.Port, d.Name)
+}
+
+// setting is one leaf of Config
+type setting struct {
+    path  string // section.key
+    env   string
+    flag  string
+    usage string
+    value reflect.Value
+}
+
+func (c *Config) settings() []setting {
+    var out []setting
+    root := reflect.ValueOf(c).Elem()
+    for i := 0; i < root.NumField(); i++ {
+        section := root.Type().Field(i)
+        sv := root.Field(i)
+        for j := 0; j < sv.NumField(); j++ {
+            f := sv.Type().Field(j)
+            out = append(out, setting{
+                path:  section.Tag.Get("yaml") + "." + f.Tag.Get("yaml"),
+                env:   envPrefix + strings.ToUpper(section.Tag.Get("yaml")+"_"+f.Tag.Get("yaml")),
+                flag:  f.Tag.Get("flag"),
+                usage: f.Tag.Get("usage"),
+                value: sv.Field(j),
+            })
+        }
+    }
+    return out
+}
+
+// RegisterFlags defines a flag for every setting, defaulting to the current
+// value. Call Load after parsing so the file and environment apply beneath
+// the flags actually given.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+    for _, s := range c.settings() {
+        fs.Var(&flagValue{s.value}, s.flag, s.usage)
+    }
+}
+
+// Load applies the YAML file at path (skipped when empty), then the
+// environment, then re-applies the flags set on fs so they win
+func (c *Config) Load(path string, fs *flag.FlagSet) error {
+    given := make(map[string]string)
+    if fs != nil {
+        fs.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+    }
+
+    settings := c.settings()
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return err
+        }
+        doc, err := parseYAML(data)
+        if err != nil {
+            return fmt.Errorf("%s: %v", path, err)
+        }
+        if err := c.apply(doc, settings); err != nil {
+            return fmt.Errorf("%s: %v", path, err)
+        }
+    }
+
+    for _, s := range settings {
+        if v, ok := os.LookupEnv(s.env); ok {
+            if err := setValue(s.value, v); err != nil {
+                return fmt.Errorf("%s: %v", s.env, err)
+            }
+        }
+    }
+
+    for _, s := range settings {
+        if v, ok := given[s.flag]; ok {
+            if err := setValue(s.value, v); err != nil {
+                return fmt.Errorf("-%s: %v", s.flag, err)
+            }
+        }
+    }
+    return nil
+}
+
+// apply copies a parsed file onto the settings, rejecting unknown keys so
+// a typo does not silently fall back to the default
+func (c *Config) apply(doc map[string]interface{}, settings []setting) error {
+    byPath := make(map[string]setting, len(settings))
+    sections := make(map[string]bool)
+    for _, s := range settings {
+        byPath[s.path] = s
+        sections[strings.SplitN(s.path, ".", 2)[0]] = true
+    }
+
+    for _, name := range sortedKeys(doc) {
+        if !sections[name] {
+            return fmt.Errorf("unknown section %q", name)
+        }
+        section, ok := doc[name].(map[string]interface{})
+        if !ok {
+            if doc[name] == "" {
+                continue
+            }
+            return fmt.Errorf("%s must be a mapping", name)
+        }
+        for _, key := range sortedKeys(section) {
+            s, ok := byPath[name+"."+key]
+            if !ok {
+                return fmt.Errorf("unknown setting %s.%s", name, key)
+            }
+            var err error
+            switch v := section[key].(type) {
+            case string:
+                err = setValue(s.value, v)
+            case []string:
+                if s.value.Kind() != reflect.Slice {
+                    err = fmt.Errorf("expected a single value")
+                } else {
+                    s.value.Set(reflect.ValueOf(append([]string(nil), v...)))
+                }
+            default:
+                err = fmt.Errorf("expected a value, not a mapping")
+            }
+            if err != nil {
+                return fmt.Errorf("%s.%s: %v", name, key, err)
+            }
+        }
+    }
+    return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// setValue parses s into a setting of any supported type
+func setValue(v reflect.Value, s string) error {
+    switch v.Interface().(type) {
+    case time.Duration:
+        d, err := time.ParseDuration(s)
+        if err != nil {
+            return err
+        }
+        v.SetInt(int64(d))
+        return nil
+    case []string:
+        var items []string
+        for _, item := range strings.Split(s, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                items = append(items, item)
+            }
+        }
+        v.Set(reflect.ValueOf(items))
+        return nil
+    }
+
+    switch v.Kind() {
+    case reflect.String:
+        v.SetString(s)
+    case reflect.Int:
+        n, err := strconv.Atoi(s)
+        if err != nil {
+            return fmt.Errorf("invalid integer %q", s)
+        }
+        v.SetInt(int64(n))
+    case reflect.Float64:
+        f, err := strconv.ParseFloat(s, 64)
+        if err != nil {
+            return fmt.Errorf("invalid number %q", s)
+        }
+        v.SetFloat(f)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(s)
+        if err != nil {
+            return fmt.Errorf("invalid boolean %q", s)
+        }
+        v.SetBool(b)
+    default:
+        return fmt.Errorf("unsupported setting type %s", v.Type())
+    }
+    return nil
+}
+
+// flagValue binds a flag to a setting
+type flagValue struct {
+    v reflect.Value
+}
+
+func (f *flagValue) String() string {
+    if !f.v.IsValid() {
+        return ""
+    }
+    switch x := f.v.Interface().(type) {
+    case time.Duration:
+        return x.String()
+    case []string:
+        return strings.Join(x, ",")
+    }
+    return fmt.Sprint(f.v.Interface())
+}
+
+func (f *flagValue) Set(s string) error {
+    return setValue(f.v, s)
+}
+
+// IsBoolFlag lets boolean settings be given as a bare -flag
+func (f *flagValue) IsBoolFlag() bool {
+    return f.v.IsValid() && f.v.Kind() == reflect.Bool
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+    "flag"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "config.yaml")
+    if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+// The file applies over the defaults, S2_* variables over the file and
+// the flags given over both
+func TestLoadLayers(t *testing.T) {
+    path := writeConfig(t, `
+http:
+  port: 9000
+  jwt_ttl: 30m
+database:
+  host: db.file
+  password: "from file"
+webhooks:
+  urls:
+  - https://a.example
+  - https://b.example
+redis:
+  addr: redis.file:6379
+`)
+    t.Setenv("S2_DATABASE_HOST", "db.env")
+    t.Setenv("S2_WEBHOOKS_URLS", "https://env.example, https://env2.example")
+    t.Setenv("S2_REDIS_ADDR", "redis.env:6379")
+    t.Setenv("S2_HTTP_JWT_TTL", "45m")
+
+    c := Default()
+    fs := flag.NewFlagSet("router", flag.ContinueOnError)
+    c.RegisterFlags(fs)
+    if err := fs.Parse([]string{"-redis-addr", "redis.flag:6379"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Load(path, fs); err != nil {
+        t.Fatal(err)
+    }
+
+    if c.HTTP.Port != 9000 || c.Database.Password != "from file" {
+        t.Fatalf("file not applied: port %d, password %q", c.HTTP.Port, c.Database.Password)
+    }
+    if c.Database.Host != "db.env" || c.HTTP.JWTTTL != 45*time.Minute {
+        t.Fatalf("environment not applied over the file: host %q, jwt_ttl %s", c.Database.Host, c.HTTP.JWTTTL)
+    }
+    if want := []string{"https://env.example", "https://env2.example"}; !reflect.DeepEqual(c.Webhooks.URLs, want) {
+        t.Fatalf("webhook URLs %q, want %q", c.Webhooks.URLs, want)
+    }
+    if c.Redis.Addr != "redis.flag:6379" {
+        t.Fatalf("flag not applied over the environment: redis addr %q", c.Redis.Addr)
+    }
+    if c.Database.Port != Default().Database.Port {
+        t.Fatalf("unset setting lost its default: port %d", c.Database.Port)
+    }
+}
+
+func TestLoadErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        yaml string
+        env  map[string]string
+        err  string
+    }{
+        {name: "unknown section", yaml: "nope:\n  a: 1\n", err: `unknown section "nope"`},
+        {name: "unknown setting", yaml: "http:\n  prot: 80\n", err: "unknown setting http.prot"},
+        {name: "bad integer", yaml: "http:\n  port: eighty\n", err: "http.port"},
+        {name: "list for a scalar", yaml: "http:\n  port: [80]\n", err: "expected a single value"},
+        {name: "section as a scalar", yaml: "http: 80\n", err: "http must be a mapping"},
+        {name: "syntax", yaml: "http:\n  port 80\n", err: "line 2"},
+        {name: "bad environment value", env: map[string]string{"S2_HTTP_PORT": "x"}, err: "S2_HTTP_PORT"},
+        {name: "bad environment duration", env: map[string]string{"S2_HTTP_JWT_TTL": "soon"}, err: "S2_HTTP_JWT_TTL"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for k, v := range tt.env {
+                t.Setenv(k, v)
+            }
+            path := ""
+            if tt.yaml != "" {
+                path = writeConfig(t, tt.yaml)
+            }
+            err := Default().Load(path, nil)
+            if err == nil || !strings.Contains(err.Error(), tt.err) {
+                t.Fatalf("error %v, want one containing %q", err, tt.err)
+            }
+        })
+    }
+}
+
+// The shipped example parses and names only real settings
+func TestLoadExample(t *testing.T) {
+    if err := Default().Load(filepath.Join("..", "..", "config.example.yaml"), nil); err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,201 @@
+package config
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// parseYAML reads the subset of YAML the config file needs:
+//
+//   - mappings nested by space indentation, "key: value" one per line
+//   - scalars, plain, "double quoted" with Go escapes or 'single quoted'
+//     with a quote doubled; ~ and null are empty
+//   - lists of scalars, inline as [a, "b, c"] or as block "- item" lines,
+//     indented under their key or level with it
+//   - # comments, outside quotes and after a space
+//
+// Anything else - anchors, tags, multi-line scalars, flow mappings, lists
+// of lists or mappings, several documents - is an error rather than read
+// differently than a YAML library would. Mapping values are string,
+// []string or map[string]interface{}.
+func parseYAML(data []byte) (map[string]interface{}, error) {
+    type frame struct {
+        indent int
+        m      map[string]interface{}
+    }
+    root := make(map[string]interface{})
+    stack := []frame{{indent: -1, m: root}}
+
+    // The last "key:" line without a value; the lines under it decide
+    // whether it holds a mapping or a list
+    var open struct {
+        key    string
+        parent map[string]interface{}
+        indent int
+        list   []string
+        inList bool
+    }
+
+    for n, raw := range strings.Split(string(data), "\n") {
+        lineNo := n + 1
+        line := strings.TrimRight(stripComment(raw), " \t\r")
+        text := strings.TrimLeft(line, " \t")
+        if text == "" {
+            continue
+        }
+        if strings.Contains(line[:len(line)-len(text)], "\t") {
+            return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+        }
+        indent := len(line) - len(text)
+
+        if text == "-" || strings.HasPrefix(text, "- ") {
+            // Items may sit level with their key, as YAML allows in a mapping
+            if open.key == "" || indent < open.indent {
+                return nil, fmt.Errorf("line %d: list item without a key", lineNo)
+            }
+            value, err := parseScalar(strings.TrimSpace(text[1:]))
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", lineNo, err)
+            }
+            open.inList = true
+            open.list = append(open.list, value)
+            open.parent[open.key] = open.list
+            continue
+        }
+
+        if open.key != "" && !open.inList {
+            if indent > open.indent {
+                child := make(map[string]interface{})
+                open.parent[open.key] = child
+                stack = append(stack, frame{indent: open.indent, m: child})
+            } else {
+                // "key:" with nothing under it
+                open.parent[open.key] = ""
+            }
+        }
+        open.key, open.list, open.inList = "", nil, false
+
+        for len(stack) > 1 && indent <= stack[len(stack)-1].indent {
+            stack = stack[:len(stack)-1]
+        }
+        parent := stack[len(stack)-1].m
+
+        key, rest, ok := strings.Cut(text, ":")
+        key = strings.TrimSpace(key)
+        if !ok || key == "" || (rest != "" && rest[0] != ' ') {
+            return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+        }
+        if _, dup := parent[key]; dup {
+            return nil, fmt.Errorf("line %d: duplicate key %q", lineNo, key)
+        }
+        rest = strings.TrimSpace(rest)
+
+        switch {
+        case rest == "":
+            open.key, open.parent, open.indent = key, parent, indent
+        case strings.HasPrefix(rest, "["):
+            items, err := parseInlineList(rest)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", lineNo, err)
+            }
+            parent[key] = items
+        default:
+            value, err := parseScalar(rest)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", lineNo, err)
+            }
+            parent[key] = value
+        }
+    }
+    if open.key != "" && !open.inList {
+        open.parent[open.key] = ""
+    }
+    return root, nil
+}
+
+// stripComment drops a # comment that is not inside quotes
+func stripComment(line string) string {
+    var quote byte
+    for i := 0; i < len(line); i++ {
+        c := line[i]
+        switch {
+        case quote != 0:
+            if c == '\\' && quote == '"' {
+                i++
+            } else if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            quote = c
+        case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+            return line[:i]
+        }
+    }
+    return line
+}
+
+func parseScalar(v string) (string, error) {
+    switch {
+    case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+        s, err := strconv.Unquote(v)
+        if err != nil {
+            return "", fmt.Errorf("invalid quoted string %s", v)
+        }
+        return s, nil
+    case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+        return strings.ReplaceAll(v[1:len(v)-1], "''", "'"), nil
+    case strings.HasPrefix(v, "\"") || strings.HasPrefix(v, "'"):
+        return "", fmt.Errorf("unterminated string %s", v)
+    case v == "~" || v == "null":
+        return "", nil
+    case v != "" && strings.ContainsRune("&*!|>{[%@`", rune(v[0])),
+        v == "-" || strings.HasPrefix(v, "- ") || strings.Contains(v, ": "):
+        return "", fmt.Errorf("unsupported YAML %s, quote it if it is a string", v)
+    }
+    return v, nil
+}
+
+func parseInlineList(v string) ([]string, error) {
+    if !strings.HasSuffix(v, "]") {
+        return nil, fmt.Errorf("unterminated list %s", v)
+    }
+    inner := strings.TrimSpace(v[1 : len(v)-1])
+    items := []string{}
+    if inner == "" {
+        return items, nil
+    }
+    for _, part := range splitInline(inner) {
+        item, err := parseScalar(strings.TrimSpace(part))
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, item)
+    }
+    return items, nil
+}
+
+// splitInline splits the items of an inline list on the commas outside
+// quotes
+func splitInline(inner string) []string {
+    var parts []string
+    var quote byte
+    start := 0
+    for i := 0; i < len(inner); i++ {
+        c := inner[i]
+        switch {
+        case quote != 0:
+            if c == '\\' && quote == '"' {
+                i++
+            } else if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            quote = c
+        case c == ',':
+            parts = append(parts, inner[start:i])
+            start = i + 1
+        }
+    }
+    return append(parts, inner[start:])
+}
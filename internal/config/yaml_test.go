@@ -0,0 +1,109 @@
+package config
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseYAML(t *testing.T) {
+    tests := []struct {
+        name string
+        in   string
+        want map[string]interface{}
+        err  string // part of the error, "" for none
+    }{
+        {
+            name: "nested mappings",
+            in:   "http:\n  port: 8080\n  tls:\n    cert: a.pem\nredis:\n  addr: r:6379\n",
+            want: map[string]interface{}{
+                "http":  map[string]interface{}{"port": "8080", "tls": map[string]interface{}{"cert": "a.pem"}},
+                "redis": map[string]interface{}{"addr": "r:6379"},
+            },
+        },
+        {
+            name: "key with nothing under it",
+            in:   "http:\n  api_key:\nredis:\n",
+            want: map[string]interface{}{"http": map[string]interface{}{"api_key": ""}, "redis": ""},
+        },
+        {
+            name: "block list indented under its key",
+            in:   "webhooks:\n  urls:\n    - https://a.example\n    - https://b.example\n  timeout: 5s\n",
+            want: map[string]interface{}{"webhooks": map[string]interface{}{
+                "urls": []string{"https://a.example", "https://b.example"}, "timeout": "5s",
+            }},
+        },
+        {
+            name: "block list level with its key",
+            in:   "webhooks:\n  urls:\n  - https://a.example\n  - https://b.example\n  timeout: 5s\n",
+            want: map[string]interface{}{"webhooks": map[string]interface{}{
+                "urls": []string{"https://a.example", "https://b.example"}, "timeout": "5s",
+            }},
+        },
+        {
+            name: "top-level block list level with its key",
+            in:   "urls:\n- a\n- b\n",
+            want: map[string]interface{}{"urls": []string{"a", "b"}},
+        },
+        {
+            name: "inline lists",
+            in:   "a: []\nb: [x]\nc: [ x , y ]\n",
+            want: map[string]interface{}{"a": []string{}, "b": []string{"x"}, "c": []string{"x", "y"}},
+        },
+        {
+            name: "quoted commas in an inline list",
+            in:   `a: ["x, y", 'it''s, z', w]` + "\n",
+            want: map[string]interface{}{"a": []string{"x, y", "it's, z", "w"}},
+        },
+        {
+            name: "quoted scalars",
+            in:   "a: \"tab\\there\"\nb: 'say ''hi'''\nc: \"#not a comment\"\nd: '[1, 2]'\ne: \"key: value\"\n",
+            want: map[string]interface{}{"a": "tab\there", "b": "say 'hi'", "c": "#not a comment", "d": "[1, 2]", "e": "key: value"},
+        },
+        {
+            name: "null scalars",
+            in:   "a: ~\nb: null\n",
+            want: map[string]interface{}{"a": "", "b": ""},
+        },
+        {
+            name: "comments",
+            in:   "# header\nhttp: # section\n  port: 80 # trailing\n  # between\n  key: pass#word\n",
+            want: map[string]interface{}{"http": map[string]interface{}{"port": "80", "key": "pass#word"}},
+        },
+        {
+            name: "comment after a list item",
+            in:   "urls:\n  - a # first\n  - \"b # kept\"\n",
+            want: map[string]interface{}{"urls": []string{"a", "b # kept"}},
+        },
+        {name: "tab indentation", in: "http:\n\tport: 80\n", err: "tabs"},
+        {name: "list item without a key", in: "- a\n", err: "list item without a key"},
+        {name: "list item left of its key", in: "http:\n  urls:\n- a\n", err: "list item without a key"},
+        {name: "duplicate key", in: "a: 1\na: 2\n", err: "duplicate key"},
+        {name: "no colon", in: "just text\n", err: "expected"},
+        {name: "unterminated string", in: "a: \"open\n", err: "unterminated"},
+        {name: "unterminated list", in: "a: [x, y\n", err: "unterminated list"},
+        {name: "nested inline list", in: "a: [x, [y]]\n", err: "unsupported"},
+        {name: "list of mappings", in: "a:\n  - name: x\n", err: "unsupported"},
+        {name: "list of lists", in: "a:\n  - - x\n", err: "unsupported"},
+        {name: "anchor", in: "a: &base x\n", err: "unsupported"},
+        {name: "block scalar", in: "a: |\n  text\n", err: "unsupported"},
+        {name: "flow mapping", in: "a: {b: c}\n", err: "unsupported"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parseYAML([]byte(tt.in))
+            if tt.err != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.err) {
+                    t.Fatalf("error %v, want one containing %q", err, tt.err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("got %#v\nwant %#v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,241 @@
+package eventschema
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Check is the event contract's compatibility suite. It encodes every
+// event type and live feed message the way the router does, with every
+// field set and with none, and reports payloads that do not conform to
+// the current schema, including fields it does not declare. Given the
+// published copy of the current document (from a release, or a running
+// router's /api/events/schema endpoint) it also reports changes since
+// that a consumer built against it would break on.
+func Check(published []byte) []string {
+    root, err := load(Current)
+    if err != nil {
+        return []string{err.Error()}
+    }
+    var problems []string
+    for _, v := range []string{"event", "live_update"} {
+        if value := constAt(root, v); value != fmt.Sprint(Current) {
+            problems = append(problems, fmt.Sprintf("$defs.%s.schema_version is %s, want the current version %d", v, value, Current))
+        }
+    }
+
+    for _, sample := range samples(root) {
+        payload, err := json.Marshal(sample.value)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("%s: %v", sample.name, err))
+            continue
+        }
+        found, err := validatePayload(root, payload, true)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("%s: %v", sample.name, err))
+        }
+        for _, p := range found {
+            problems = append(problems, sample.name+": "+p)
+        }
+    }
+
+    if published != nil {
+        var old map[string]interface{}
+        if err := decode(published, &old); err != nil {
+            return append(problems, "published schema: "+err.Error())
+        }
+        problems = append(problems, breakingChanges(old, root)...)
+    }
+    return problems
+}
+
+type sample struct {
+    name  string
+    value interface{}
+}
+
+// samples builds the payloads Check validates
+func samples(root map[string]interface{}) []sample {
+    var out []sample
+    for _, eventType := range knownEventTypes(root) {
+        full := models.Event{}
+        fill(reflect.ValueOf(&full).Elem())
+        full.Type, full.SchemaVersion = eventType, Current
+        out = append(out,
+            sample{eventType + " (all fields)", full},
+            sample{eventType + " (no optional fields)", models.Event{SchemaVersion: Current, Type: eventType, Timestamp: time.Now()}})
+    }
+    for _, updateType := range []string{"snapshot", "added", "updated", "removed"} {
+        full := models.LiveCallUpdate{}
+        fill(reflect.ValueOf(&full).Elem())
+        full.Type, full.SchemaVersion = updateType, Current
+        out = append(out,
+            sample{"live " + updateType + " (all fields)", full},
+            sample{"live " + updateType + " (no optional fields)", models.LiveCallUpdate{SchemaVersion: Current, Type: updateType, Timestamp: time.Now()}})
+    }
+    return out
+}
+
+// fill sets every field of v to a plausible non-zero value so that no
+// omitempty field is left out of the encoding
+func fill(v reflect.Value) {
+    switch v.Kind() {
+    case reflect.String:
+        if v.Type() == reflect.TypeOf(models.CallState("")) {
+            v.SetString(string(models.CallStateActive))
+        } else {
+            v.SetString("x")
+        }
+    case reflect.Int, reflect.Int64, reflect.Int32:
+        v.SetInt(1)
+    case reflect.Float64:
+        v.SetFloat(1)
+    case reflect.Bool:
+        v.SetBool(true)
+    case reflect.Map:
+        m := reflect.MakeMap(v.Type())
+        key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+        fill(key)
+        fill(elem)
+        m.SetMapIndex(key, elem)
+        v.Set(m)
+    case reflect.Slice:
+        s := reflect.MakeSlice(v.Type(), 1, 1)
+        fill(s.Index(0))
+        v.Set(s)
+    case reflect.Ptr:
+        p := reflect.New(v.Type().Elem())
+        fill(p.Elem())
+        v.Set(p)
+    case reflect.Struct:
+        if v.Type() == reflect.TypeOf(time.Time{}) {
+            v.Set(reflect.ValueOf(time.Now()))
+            return
+        }
+        for i := 0; i < v.NumField(); i++ {
+            if v.Type().Field(i).IsExported() {
+                fill(v.Field(i))
+            }
+        }
+    }
+}
+
+// knownEventTypes reads the listed event types from the document
+func knownEventTypes(root map[string]interface{}) []string {
+    event := lookup(root, "$defs", "event", "properties", "event")
+    anyOf, _ := event["anyOf"].([]interface{})
+    var types []string
+    for _, branch := range anyOf {
+        branch, _ := branch.(map[string]interface{})
+        enum, _ := branch["enum"].([]interface{})
+        for _, t := range enum {
+            if t, ok := t.(string); ok {
+                types = append(types, t)
+            }
+        }
+    }
+    return types
+}
+
+// breakingChanges lists what new drops, retypes or newly requires compared
+// with old, and event types or enum values it no longer lists
+func breakingChanges(old, new map[string]interface{}) []string {
+    var problems []string
+    if old["$id"] != new["$id"] {
+        return []string{fmt.Sprintf("published schema is %v, not %v; compare against a copy of the same version", old["$id"], new["$id"])}
+    }
+    oldDefs, _ := old["$defs"].(map[string]interface{})
+    newDefs, _ := new["$defs"].(map[string]interface{})
+    for _, name := range sortedKeys(oldDefs) {
+        oldDef, _ := oldDefs[name].(map[string]interface{})
+        newDef, ok := newDefs[name].(map[string]interface{})
+        if !ok {
+            problems = append(problems, "$defs."+name+" was removed")
+            continue
+        }
+        problems = append(problems, compareSchemas(oldDef, newDef, "$defs."+name)...)
+    }
+    return problems
+}
+
+func compareSchemas(old, new map[string]interface{}, path string) []string {
+    var problems []string
+    for _, keyword := range []string{"type", "$ref", "const", "format"} {
+        if !reflect.DeepEqual(old[keyword], new[keyword]) {
+            problems = append(problems, fmt.Sprintf("%s: %s changed from %v to %v", path, keyword, old[keyword], new[keyword]))
+        }
+    }
+    if enum, ok := old["enum"].([]interface{}); ok {
+        newEnum, _ := new["enum"].([]interface{})
+        for _, value := range enum {
+            if !contains(newEnum, value) {
+                problems = append(problems, fmt.Sprintf("%s: %v was dropped from the enum", path, value))
+            }
+        }
+    }
+    for _, keyword := range []string{"anyOf", "oneOf"} {
+        oldList, _ := old[keyword].([]interface{})
+        newList, _ := new[keyword].([]interface{})
+        if len(oldList) != len(newList) {
+            if len(oldList) > 0 {
+                problems = append(problems, fmt.Sprintf("%s: %s changed from %d to %d branches", path, keyword, len(oldList), len(newList)))
+            }
+            continue
+        }
+        for i := range oldList {
+            a, _ := oldList[i].(map[string]interface{})
+            b, _ := newList[i].(map[string]interface{})
+            problems = append(problems, compareSchemas(a, b, fmt.Sprintf("%s.%s[%d]", path, keyword, i))...)
+        }
+    }
+    if items, ok := old["items"].(map[string]interface{}); ok {
+        newItems, _ := new["items"].(map[string]interface{})
+        problems = append(problems, compareSchemas(items, newItems, path+"[]")...)
+    }
+
+    oldRequired, _ := old["required"].([]interface{})
+    newRequired, _ := new["required"].([]interface{})
+    for _, name := range newRequired {
+        if !contains(oldRequired, name) {
+            problems = append(problems, fmt.Sprintf("%s: %v is newly required", path, name))
+        }
+    }
+    oldProps, _ := old["properties"].(map[string]interface{})
+    newProps, _ := new["properties"].(map[string]interface{})
+    for _, name := range sortedKeys(oldProps) {
+        oldProp, _ := oldProps[name].(map[string]interface{})
+        newProp, ok := newProps[name].(map[string]interface{})
+        if !ok {
+            problems = append(problems, path+"."+name+" was removed")
+            continue
+        }
+        problems = append(problems, compareSchemas(oldProp, newProp, path+"."+name)...)
+    }
+    return problems
+}
+
+func lookup(m map[string]interface{}, keys ...string) map[string]interface{} {
+    for _, k := range keys {
+        m, _ = m[k].(map[string]interface{})
+    }
+    return m
+}
+
+// constAt returns the schema_version const a definition pins
+func constAt(root map[string]interface{}, def string) string {
+    return fmt.Sprint(lookup(root, "$defs", def, "properties", "schema_version")["const"])
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -0,0 +1,103 @@
+package eventschema
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+// The events the router emits today conform to the committed schema of
+// their version, and nothing in it has changed incompatibly
+func TestCheckAgainstPublished(t *testing.T) {
+    published, ok := Document(Current)
+    if !ok {
+        t.Fatalf("schema version %d is not published", Current)
+    }
+    if problems := Check(published); len(problems) > 0 {
+        t.Fatalf("%d problems:\n%s", len(problems), strings.Join(problems, "\n"))
+    }
+}
+
+// Check reports a published copy the current document breaks: each case
+// edits the published side, so the current document looks as if it had
+// made the opposite change
+func TestCheckReportsBreakingChanges(t *testing.T) {
+    tests := []struct {
+        name   string
+        edit   func(doc map[string]interface{})
+        report string
+    }{
+        {
+            name: "removed field",
+            edit: func(doc map[string]interface{}) {
+                props(doc, "event")["legacy_id"] = map[string]interface{}{"type": "string"}
+            },
+            report: "$defs.event.legacy_id was removed",
+        },
+        {
+            name: "retyped field",
+            edit: func(doc map[string]interface{}) {
+                props(doc, "event")["call_id"].(map[string]interface{})["type"] = "integer"
+            },
+            report: "$defs.event.call_id: type changed from integer to string",
+        },
+        {
+            name: "newly required field",
+            edit: func(doc map[string]interface{}) {
+                def(doc, "event")["required"] = []interface{}{"schema_version", "event", "timestamp"}
+            },
+            report: "$defs.event: call_id is newly required",
+        },
+        {
+            name: "dropped event type",
+            edit: func(doc map[string]interface{}) {
+                branch := props(doc, "event")["event"].(map[string]interface{})["anyOf"].([]interface{})[0].(map[string]interface{})
+                branch["enum"] = append(branch["enum"].([]interface{}), "call.legacy")
+            },
+            report: "call.legacy was dropped from the enum",
+        },
+        {
+            name: "removed definition",
+            edit: func(doc map[string]interface{}) {
+                doc["$defs"].(map[string]interface{})["legacy"] = map[string]interface{}{"type": "object"}
+            },
+            report: "$defs.legacy was removed",
+        },
+        {
+            name: "another version",
+            edit: func(doc map[string]interface{}) {
+                doc["$id"] = "s2:events:v0"
+            },
+            report: "compare against a copy of the same version",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            published, _ := Document(Current)
+            var doc map[string]interface{}
+            if err := json.Unmarshal(published, &doc); err != nil {
+                t.Fatal(err)
+            }
+            tt.edit(doc)
+            edited, err := json.Marshal(doc)
+            if err != nil {
+                t.Fatal(err)
+            }
+            problems := Check(edited)
+            for _, p := range problems {
+                if strings.Contains(p, tt.report) {
+                    return
+                }
+            }
+            t.Fatalf("no problem reporting %q in %q", tt.report, problems)
+        })
+    }
+}
+
+func def(doc map[string]interface{}, name string) map[string]interface{} {
+    return lookup(doc, "$defs", name)
+}
+
+func props(doc map[string]interface{}, name string) map[string]interface{} {
+    return lookup(doc, "$defs", name, "properties")
+}
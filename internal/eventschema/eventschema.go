@@ -0,0 +1,49 @@
+// Package eventschema publishes the JSON Schema of the events the router
+// emits - webhook bodies, event stream messages and live call feed
+// messages - and checks payloads and new schema revisions against it.
+//
+// Each version is one document, events.v<N>.json, embedded here and served
+// at /api/events/schema/<N>. Every payload carries its schema_version.
+// Within a version the document only grows: fields and event types may be
+// added, nothing removed, retyped or newly required. A breaking change is a
+// new document and a bump of models.EventSchemaVersion.
+package eventschema
+
+import (
+    "embed"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+//go:embed events.v*.json
+var documents embed.FS
+
+// Current is the version of the events the router emits
+const Current = models.EventSchemaVersion
+
+// Versions lists the published versions, oldest first
+func Versions() []int {
+    entries, _ := documents.ReadDir(".")
+    var versions []int
+    for _, e := range entries {
+        v, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(e.Name(), "events.v"), ".json"))
+        if err == nil {
+            versions = append(versions, v)
+        }
+    }
+    sort.Ints(versions)
+    return versions
+}
+
+// Document returns the schema of version, false if it was never published
+func Document(version int) ([]byte, bool) {
+    doc, err := documents.ReadFile(fmt.Sprintf("events.v%d.json", version))
+    if err != nil {
+        return nil, false
+    }
+    return doc, true
+}
@@ -0,0 +1,217 @@
+package eventschema
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+    "time"
+)
+
+// The validator covers the keywords the event documents use: $ref into
+// $defs, type, const, enum, anyOf, oneOf, properties, required,
+// additionalProperties, items, minimum and the date-time format.
+type validator struct {
+    defs   map[string]interface{}
+    strict bool // properties a schema does not declare are problems
+}
+
+// Validate checks one JSON payload against version's schema and returns
+// what is wrong with it, nothing if it conforms
+func Validate(version int, payload []byte) ([]string, error) {
+    root, err := load(version)
+    if err != nil {
+        return nil, err
+    }
+    return validatePayload(root, payload, false)
+}
+
+func load(version int) (map[string]interface{}, error) {
+    doc, ok := Document(version)
+    if !ok {
+        return nil, fmt.Errorf("no event schema version %d", version)
+    }
+    var root map[string]interface{}
+    if err := decode(doc, &root); err != nil {
+        return nil, fmt.Errorf("event schema version %d: %w", version, err)
+    }
+    return root, nil
+}
+
+func validatePayload(root map[string]interface{}, payload []byte, strict bool) ([]string, error) {
+    var value interface{}
+    if err := decode(payload, &value); err != nil {
+        return nil, err
+    }
+    defs, _ := root["$defs"].(map[string]interface{})
+    v := &validator{defs: defs, strict: strict}
+    return v.check(root, value, "$"), nil
+}
+
+// decode keeps numbers as json.Number so integers compare exactly
+func decode(data []byte, v interface{}) error {
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.UseNumber()
+    return dec.Decode(v)
+}
+
+func (v *validator) check(schema map[string]interface{}, value interface{}, path string) []string {
+    if ref, ok := schema["$ref"].(string); ok {
+        def, ok := v.defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+        if !ok {
+            return []string{path + ": unresolved $ref " + ref}
+        }
+        return v.check(def, value, path)
+    }
+
+    var problems []string
+    if t, ok := schema["type"].(string); ok && !hasType(value, t) {
+        return []string{fmt.Sprintf("%s: want %s, got %s", path, t, typeOf(value))}
+    }
+    if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+        problems = append(problems, fmt.Sprintf("%s: want %v, got %v", path, c, value))
+    }
+    if enum, ok := schema["enum"].([]interface{}); ok && !contains(enum, value) {
+        problems = append(problems, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+    }
+    if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+        if n, closest := v.matches(anyOf, value, path); n == 0 {
+            problems = append(problems, closest...)
+        }
+    }
+    if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+        n, closest := v.matches(oneOf, value, path)
+        if n == 0 {
+            problems = append(problems, closest...)
+        } else if n > 1 {
+            problems = append(problems, fmt.Sprintf("%s: matches %d of oneOf, want exactly 1", path, n))
+        }
+    }
+    if schema["format"] == "date-time" {
+        if s, ok := value.(string); ok {
+            if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+                problems = append(problems, fmt.Sprintf("%s: %q is not an RFC 3339 date-time", path, s))
+            }
+        }
+    }
+    if min, ok := schema["minimum"].(json.Number); ok {
+        if n, ok := value.(json.Number); ok {
+            lo, _ := min.Float64()
+            if f, _ := n.Float64(); f < lo {
+                problems = append(problems, fmt.Sprintf("%s: %v is below the minimum %v", path, n, min))
+            }
+        }
+    }
+
+    switch value := value.(type) {
+    case map[string]interface{}:
+        problems = append(problems, v.checkObject(schema, value, path)...)
+    case []interface{}:
+        if items, ok := schema["items"].(map[string]interface{}); ok {
+            for i, item := range value {
+                problems = append(problems, v.check(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+            }
+        }
+    }
+    return problems
+}
+
+func (v *validator) checkObject(schema, value map[string]interface{}, path string) []string {
+    var problems []string
+    required, _ := schema["required"].([]interface{})
+    for _, name := range required {
+        if _, ok := value[name.(string)]; !ok {
+            problems = append(problems, fmt.Sprintf("%s: missing required %s", path, name))
+        }
+    }
+    properties, _ := schema["properties"].(map[string]interface{})
+    names := make([]string, 0, len(value))
+    for name := range value {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        if prop, ok := properties[name].(map[string]interface{}); ok {
+            problems = append(problems, v.check(prop, value[name], path+"."+name)...)
+            continue
+        }
+        switch extra := schema["additionalProperties"].(type) {
+        case map[string]interface{}:
+            problems = append(problems, v.check(extra, value[name], path+"."+name)...)
+        case bool:
+            if !extra {
+                problems = append(problems, fmt.Sprintf("%s: %s is not allowed", path, name))
+            }
+        default:
+            if v.strict && properties != nil {
+                problems = append(problems, fmt.Sprintf("%s: %s is not in the schema", path, name))
+            }
+        }
+    }
+    return problems
+}
+
+// matches counts the schemas of a list value conforms to. When it
+// conforms to none, it also returns the problems with the closest one.
+func (v *validator) matches(schemas []interface{}, value interface{}, path string) (int, []string) {
+    n := 0
+    var closest []string
+    for _, s := range schemas {
+        s, ok := s.(map[string]interface{})
+        if !ok {
+            continue
+        }
+        problems := v.check(s, value, path)
+        if len(problems) == 0 {
+            n++
+        } else if closest == nil || len(problems) < len(closest) {
+            closest = problems
+        }
+    }
+    return n, closest
+}
+
+func hasType(value interface{}, t string) bool {
+    switch t {
+    case "integer":
+        n, ok := value.(json.Number)
+        if !ok {
+            return false
+        }
+        _, err := n.Int64()
+        return err == nil
+    case "number":
+        _, ok := value.(json.Number)
+        return ok
+    }
+    return typeOf(value) == t
+}
+
+func typeOf(value interface{}) string {
+    switch value.(type) {
+    case nil:
+        return "null"
+    case bool:
+        return "boolean"
+    case string:
+        return "string"
+    case json.Number:
+        return "number"
+    case []interface{}:
+        return "array"
+    case map[string]interface{}:
+        return "object"
+    }
+    return fmt.Sprintf("%T", value)
+}
+
+func contains(list []interface{}, value interface{}) bool {
+    for _, item := range list {
+        if reflect.DeepEqual(item, value) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,239 @@
+// Package jwt issues and verifies the bearer tokens of the admin API.
+package jwt
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Admin API clients authenticate with HS256 JSON Web Tokens. Each signing
+// key has an ID that travels in the token's "kid" header, so keys can be
+// rotated without logging everyone out: put the new key first (it signs
+// from then on), keep the old one after it until the tokens it signed have
+// expired, then drop it.
+//
+//	http:
+//	  jwt_keys: ["2024b:<new secret>", "2024a:<old secret>"]
+const (
+    Issuer = "s2-router"
+
+    // Tolerated clock difference between the issuer and the router
+    leeway = 30 * time.Second
+
+    minSecretLen = 16
+)
+
+var (
+    ErrMalformed  = errors.New("malformed token")
+    ErrUnknownKey = errors.New("token signed with an unknown key")
+    ErrSignature  = errors.New("invalid token signature")
+    ErrExpired    = errors.New("token expired")
+    ErrNotYet     = errors.New("token not valid yet")
+    ErrSession    = errors.New("session too old to refresh")
+)
+
+// Claims are the registered claims the router issues and checks
+type Claims struct {
+    Subject   string `json:"sub"`
+    Issuer    string `json:"iss,omitempty"`
+    IssuedAt  int64  `json:"iat"`
+    NotBefore int64  `json:"nbf,omitempty"`
+    ExpiresAt int64  `json:"exp"`
+    ID        string `json:"jti,omitempty"`
+    AuthTime  int64  `json:"auth_time,omitempty"` // when the session began, kept through refreshes
+}
+
+// Expires returns the expiry as a time
+func (c *Claims) Expires() time.Time {
+    return time.Unix(c.ExpiresAt, 0)
+}
+
+// SessionStart is when the session the token belongs to began. Tokens
+// issued before auth_time was added started theirs when they were issued.
+func (c *Claims) SessionStart() time.Time {
+    if c.AuthTime != 0 {
+        return time.Unix(c.AuthTime, 0)
+    }
+    return time.Unix(c.IssuedAt, 0)
+}
+
+type header struct {
+    Alg string `json:"alg"`
+    Typ string `json:"typ,omitempty"`
+    Kid string `json:"kid,omitempty"`
+}
+
+type key struct {
+    id     string
+    secret []byte
+}
+
+// KeySet signs with its first key and verifies with any of them
+type KeySet struct {
+    keys []key
+}
+
+// ParseKeys builds a key set from id:secret specs, the signing key first.
+// No specs returns nil: JWT auth is off.
+func ParseKeys(specs []string) (*KeySet, error) {
+    if len(specs) == 0 {
+        return nil, nil
+    }
+    ks := &KeySet{}
+    seen := make(map[string]bool)
+    for _, spec := range specs {
+        id, secret, ok := strings.Cut(spec, ":")
+        id = strings.TrimSpace(id)
+        switch {
+        case !ok || id == "":
+            return nil, fmt.Errorf("JWT key %q: want id:secret", id)
+        case len(secret) < minSecretLen:
+            return nil, fmt.Errorf("JWT key %q: secret must be at least %d characters", id, minSecretLen)
+        case seen[id]:
+            return nil, fmt.Errorf("JWT key %q listed twice", id)
+        }
+        seen[id] = true
+        ks.keys = append(ks.keys, key{id: id, secret: []byte(secret)})
+    }
+    return ks, nil
+}
+
+// SigningKeyID names the key new tokens are signed with
+func (ks *KeySet) SigningKeyID() string {
+    return ks.keys[0].id
+}
+
+// Issue signs a token for subject valid for ttl from now, starting a session
+func (ks *KeySet) Issue(subject string, now time.Time, ttl time.Duration) (string, *Claims, error) {
+    return ks.issue(subject, now, now.Add(ttl), now)
+}
+
+// Refresh signs a new token in the session of claims, a verified token's.
+// It is valid for ttl from now but never past maxAge from the session's
+// start, and refused once the session is that old; maxAge 0 lets a session
+// be refreshed forever.
+func (ks *KeySet) Refresh(claims *Claims, now time.Time, ttl, maxAge time.Duration) (string, *Claims, error) {
+    started := claims.SessionStart()
+    expires := now.Add(ttl)
+    if maxAge > 0 {
+        end := started.Add(maxAge)
+        if !now.Before(end) {
+            return "", nil, ErrSession
+        }
+        if expires.After(end) {
+            expires = end
+        }
+    }
+    return ks.issue(claims.Subject, now, expires, started)
+}
+
+func (ks *KeySet) issue(subject string, now, expires, started time.Time) (string, *Claims, error) {
+    var jti [8]byte
+    if _, err := rand.Read(jti[:]); err != nil {
+        return "", nil, err
+    }
+    claims := &Claims{
+        Subject:   subject,
+        Issuer:    Issuer,
+        IssuedAt:  now.Unix(),
+        ExpiresAt: expires.Unix(),
+        ID:        hex.EncodeToString(jti[:]),
+        AuthTime:  started.Unix(),
+    }
+    token, err := ks.Sign(claims)
+    if err != nil {
+        return "", nil, err
+    }
+    return token, claims, nil
+}
+
+// Sign encodes claims as a token signed with the current key
+func (ks *KeySet) Sign(claims *Claims) (string, error) {
+    k := ks.keys[0]
+    h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT", Kid: k.id})
+    if err != nil {
+        return "", err
+    }
+    p, err := json.Marshal(claims)
+    if err != nil {
+        return "", err
+    }
+    signed := encode(h) + "." + encode(p)
+    return signed + "." + encode(sign(k.secret, signed)), nil
+}
+
+// Verify checks a token's signature and validity period and returns its
+// claims. Only HS256 tokens carrying an expiry are accepted.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, ErrMalformed
+    }
+    var h header
+    if err := decodeJSON(parts[0], &h); err != nil || h.Alg != "HS256" {
+        return nil, ErrMalformed
+    }
+    k, ok := ks.lookup(h.Kid)
+    if !ok {
+        return nil, ErrUnknownKey
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, ErrMalformed
+    }
+    if !hmac.Equal(sig, sign(k.secret, parts[0]+"."+parts[1])) {
+        return nil, ErrSignature
+    }
+
+    var claims Claims
+    if err := decodeJSON(parts[1], &claims); err != nil || claims.ExpiresAt == 0 || claims.Subject == "" {
+        return nil, ErrMalformed
+    }
+    if now.Add(-leeway).Unix() >= claims.ExpiresAt {
+        return nil, ErrExpired
+    }
+    if claims.NotBefore != 0 && now.Add(leeway).Unix() < claims.NotBefore {
+        return nil, ErrNotYet
+    }
+    return &claims, nil
+}
+
+// lookup finds the key a token names. Tokens without a kid are only
+// accepted while there is a single key.
+func (ks *KeySet) lookup(id string) (key, bool) {
+    if id == "" {
+        return ks.keys[0], len(ks.keys) == 1
+    }
+    for _, k := range ks.keys {
+        if k.id == id {
+            return k, true
+        }
+    }
+    return key{}, false
+}
+
+func sign(secret []byte, signed string) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(signed))
+    return mac.Sum(nil)
+}
+
+func encode(b []byte) string {
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSON(part string, v interface{}) error {
+    b, err := base64.RawURLEncoding.DecodeString(part)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(b, v)
+}
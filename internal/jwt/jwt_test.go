@@ -0,0 +1,270 @@
+package jwt
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+var epoch = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func mustKeys(t *testing.T, specs ...string) *KeySet {
+    t.Helper()
+    ks, err := ParseKeys(specs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return ks
+}
+
+func mustIssue(t *testing.T, ks *KeySet, ttl time.Duration) (string, *Claims) {
+    t.Helper()
+    token, claims, err := ks.Issue("ops", epoch, ttl)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return token, claims
+}
+
+// forge builds a token from a raw header and claims, signed HS256 with
+// secret, or carrying sig as is when secret is empty
+func forge(t *testing.T, h, claims interface{}, secret, sig string) string {
+    t.Helper()
+    hb, err := json.Marshal(h)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cb, err := json.Marshal(claims)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signed := encode(hb) + "." + encode(cb)
+    if secret != "" {
+        mac := hmac.New(sha256.New, []byte(secret))
+        mac.Write([]byte(signed))
+        sig = encode(mac.Sum(nil))
+    }
+    return signed + "." + sig
+}
+
+func TestParseKeys(t *testing.T) {
+    for _, specs := range [][]string{
+        {"nosecret"},
+        {":0123456789abcdef"},
+        {"a:short"},
+        {"a:0123456789abcdef", "a:fedcba9876543210"},
+    } {
+        if _, err := ParseKeys(specs); err == nil {
+            t.Errorf("keys %q accepted", specs)
+        }
+    }
+    if ks, err := ParseKeys(nil); ks != nil || err != nil {
+        t.Fatalf("no keys gave %v, %v", ks, err)
+    }
+}
+
+func TestVerifyExpiry(t *testing.T) {
+    ks := mustKeys(t, "a:0123456789abcdef")
+    token, _ := mustIssue(t, ks, time.Hour)
+
+    for _, tt := range []struct {
+        at   time.Duration
+        want error
+    }{
+        {0, nil},
+        {time.Hour - time.Second, nil},
+        {time.Hour + leeway - time.Second, nil}, // within the leeway
+        {time.Hour + leeway, ErrExpired},
+        {2 * time.Hour, ErrExpired},
+    } {
+        if _, err := ks.Verify(token, epoch.Add(tt.at)); err != tt.want {
+            t.Errorf("at +%s: %v, want %v", tt.at, err, tt.want)
+        }
+    }
+
+    early := forge(t, header{Alg: "HS256", Kid: "a"},
+        Claims{Subject: "ops", NotBefore: epoch.Add(time.Hour).Unix(), ExpiresAt: epoch.Add(2 * time.Hour).Unix()},
+        "0123456789abcdef", "")
+    if _, err := ks.Verify(early, epoch); err != ErrNotYet {
+        t.Errorf("before nbf: %v", err)
+    }
+    if _, err := ks.Verify(early, epoch.Add(time.Hour-leeway)); err != nil {
+        t.Errorf("at nbf less the leeway: %v", err)
+    }
+    noExpiry := forge(t, header{Alg: "HS256", Kid: "a"}, Claims{Subject: "ops"}, "0123456789abcdef", "")
+    if _, err := ks.Verify(noExpiry, epoch); err != ErrMalformed {
+        t.Errorf("without exp: %v", err)
+    }
+}
+
+// Rotation: the new key signs, the old one verifies what it signed until
+// dropped, and a kid the router has never had is refused
+func TestVerifyKeyRotation(t *testing.T) {
+    before := mustKeys(t, "2024a:0123456789abcdef")
+    old, _ := mustIssue(t, before, time.Hour)
+
+    during := mustKeys(t, "2024b:fedcba9876543210", "2024a:0123456789abcdef")
+    if _, err := during.Verify(old, epoch); err != nil {
+        t.Fatalf("old key's token during the rotation: %v", err)
+    }
+    fresh, _ := mustIssue(t, during, time.Hour)
+    if _, err := before.Verify(fresh, epoch); err != ErrUnknownKey {
+        t.Fatalf("new key's token before the rotation: %v", err)
+    }
+
+    after := mustKeys(t, "2024b:fedcba9876543210")
+    if _, err := after.Verify(old, epoch); err != ErrUnknownKey {
+        t.Fatalf("old key's token after it was dropped: %v", err)
+    }
+    if _, err := after.Verify(fresh, epoch); err != nil {
+        t.Fatalf("new key's token after the rotation: %v", err)
+    }
+
+    // A kid naming a listed key does not let another key's secret sign
+    claims := Claims{Subject: "ops", ExpiresAt: epoch.Add(time.Hour).Unix()}
+    misnamed := forge(t, header{Alg: "HS256", Kid: "2024b"}, claims, "0123456789abcdef", "")
+    if _, err := during.Verify(misnamed, epoch); err != ErrSignature {
+        t.Fatalf("token signed with another key than its kid: %v", err)
+    }
+    unknown := forge(t, header{Alg: "HS256", Kid: "2023z"}, claims, "0123456789abcdef", "")
+    if _, err := during.Verify(unknown, epoch); err != ErrUnknownKey {
+        t.Fatalf("unknown kid: %v", err)
+    }
+    // Without a kid a token is only checked while there is one key
+    bare := forge(t, header{Alg: "HS256"}, claims, "0123456789abcdef", "")
+    if _, err := before.Verify(bare, epoch); err != nil {
+        t.Fatalf("kid-less token on one key: %v", err)
+    }
+    if _, err := during.Verify(bare, epoch); err != ErrUnknownKey {
+        t.Fatalf("kid-less token on two keys: %v", err)
+    }
+}
+
+// Only HS256 is accepted, whatever the signature the token carries
+func TestVerifyAlgConfusion(t *testing.T) {
+    ks := mustKeys(t, "a:0123456789abcdef")
+    claims := Claims{Subject: "ops", ExpiresAt: epoch.Add(time.Hour).Unix()}
+    for _, alg := range []string{"none", "None", "", "HS512", "RS256", "ES256", "hs256"} {
+        // Signed as HS256 with the real secret, so only alg is wrong
+        token := forge(t, header{Alg: alg, Kid: "a"}, claims, "0123456789abcdef", "")
+        if _, err := ks.Verify(token, epoch); err != ErrMalformed {
+            t.Errorf("alg %q: %v", alg, err)
+        }
+    }
+    unsigned := forge(t, header{Alg: "none", Kid: "a"}, claims, "", "")
+    if _, err := ks.Verify(unsigned, epoch); err != ErrMalformed {
+        t.Errorf("unsigned alg none: %v", err)
+    }
+    hs256Empty := forge(t, header{Alg: "HS256", Kid: "a"}, claims, "", "")
+    if _, err := ks.Verify(hs256Empty, epoch); err != ErrSignature {
+        t.Errorf("HS256 with an empty signature: %v", err)
+    }
+}
+
+func TestVerifyTampering(t *testing.T) {
+    ks := mustKeys(t, "a:0123456789abcdef")
+    token, _ := mustIssue(t, ks, time.Hour)
+    parts := strings.Split(token, ".")
+
+    var claims map[string]interface{}
+    if err := decodeJSON(parts[1], &claims); err != nil {
+        t.Fatal(err)
+    }
+    claims["sub"] = "admin"
+    elevated, _ := json.Marshal(claims)
+    claims["sub"] = "ops"
+    claims["exp"] = epoch.Add(24 * time.Hour).Unix()
+    extended, _ := json.Marshal(claims)
+
+    sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+    sig[0] ^= 1
+
+    for name, tampered := range map[string]string{
+        "subject":          parts[0] + "." + encode(elevated) + "." + parts[2],
+        "expiry":           parts[0] + "." + encode(extended) + "." + parts[2],
+        "signature":        parts[0] + "." + parts[1] + "." + encode(sig),
+        "truncated sig":    parts[0] + "." + parts[1] + "." + parts[2][:10],
+        "header":           encode([]byte(`{"alg":"HS256","kid":"a","typ":"x"}`)) + "." + parts[1] + "." + parts[2],
+        "signed by a peer": forge(t, header{Alg: "HS256", Kid: "a"}, claims, "fedcba9876543210", ""),
+    } {
+        if _, err := ks.Verify(tampered, epoch); err != ErrSignature {
+            t.Errorf("tampered %s: %v", name, err)
+        }
+    }
+    for name, malformed := range map[string]string{
+        "two parts":      parts[0] + "." + parts[1],
+        "four parts":     token + ".x",
+        "bad base64 sig": parts[0] + "." + parts[1] + ".!!",
+        "bad header":     "xx." + parts[1] + "." + parts[2],
+    } {
+        if _, err := ks.Verify(malformed, epoch); err != ErrMalformed {
+            t.Errorf("%s: %v", name, err)
+        }
+    }
+}
+
+// Refreshing keeps the session's start, so a token refreshed forever still
+// stops at the maximum session age
+func TestRefreshKeepsSession(t *testing.T) {
+    ks := mustKeys(t, "a:0123456789abcdef")
+    _, claims := mustIssue(t, ks, time.Hour)
+    if !claims.SessionStart().Equal(epoch) {
+        t.Fatalf("session started %s, issued %s", claims.SessionStart(), epoch)
+    }
+
+    const maxAge = 3*time.Hour + 30*time.Minute
+    now := epoch
+    for i := 0; i < 3; i++ {
+        now = now.Add(50 * time.Minute)
+        token, refreshed, err := ks.Refresh(claims, now, time.Hour, maxAge)
+        if err != nil {
+            t.Fatalf("refresh %d: %v", i+1, err)
+        }
+        if refreshed.AuthTime != epoch.Unix() || refreshed.IssuedAt != now.Unix() || refreshed.Subject != "ops" {
+            t.Fatalf("refresh %d claims %+v", i+1, refreshed)
+        }
+        if claims, err = ks.Verify(token, now); err != nil {
+            t.Fatalf("refresh %d: %v", i+1, err)
+        }
+    }
+
+    // 2h30m in: the last refresh ends with the session, not an hour on
+    now = now.Add(50 * time.Minute)
+    token, last, err := ks.Refresh(claims, now, time.Hour, maxAge)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !last.Expires().Equal(epoch.Add(maxAge)) {
+        t.Fatalf("last refresh expires %s, session ends %s", last.Expires(), epoch.Add(maxAge))
+    }
+    if claims, err = ks.Verify(token, now); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := ks.Refresh(claims, epoch.Add(maxAge), time.Hour, maxAge); !errors.Is(err, ErrSession) {
+        t.Fatalf("refresh at the session's end: %v", err)
+    }
+
+    // Without a maximum age the session never ends
+    if _, forever, err := ks.Refresh(claims, epoch.Add(30*24*time.Hour), time.Hour, 0); err != nil ||
+        forever.AuthTime != epoch.Unix() {
+        t.Fatalf("unlimited refresh %+v, %v", forever, err)
+    }
+}
+
+// Tokens from before auth_time started their session when issued
+func TestRefreshLegacyToken(t *testing.T) {
+    ks := mustKeys(t, "a:0123456789abcdef")
+    legacy := &Claims{Subject: "ops", IssuedAt: epoch.Unix(), ExpiresAt: epoch.Add(time.Hour).Unix()}
+    if _, _, err := ks.Refresh(legacy, epoch.Add(2*time.Hour), time.Hour, 2*time.Hour); !errors.Is(err, ErrSession) {
+        t.Fatalf("legacy token past its session: %v", err)
+    }
+    _, refreshed, err := ks.Refresh(legacy, epoch.Add(30*time.Minute), time.Hour, 2*time.Hour)
+    if err != nil || refreshed.AuthTime != epoch.Unix() {
+        t.Fatalf("legacy refresh %+v, %v", refreshed, err)
+    }
+}
@@ -0,0 +1,126 @@
+// Package lifecycle owns the goroutines of a long-running component so that
+// stopping it actually ends them. A Group works like errgroup: goroutines
+// share a context that is cancelled by Stop or by the first one to fail,
+// and Wait returns once all of them have returned.
+package lifecycle
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+)
+
+var logger = logging.New("lifecycle")
+
+// Group tracks named goroutines sharing one cancellable context
+type Group struct {
+    ctx    context.Context
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+
+    mu      sync.Mutex
+    err     error
+    running map[string]int
+}
+
+// New returns a group whose context is derived from parent
+func New(parent context.Context) *Group {
+    ctx, cancel := context.WithCancel(parent)
+    return &Group{ctx: ctx, cancel: cancel, running: make(map[string]int)}
+}
+
+// Context is cancelled when the group stops
+func (g *Group) Context() context.Context {
+    return g.ctx
+}
+
+// Go runs fn in a goroutine owned by the group. fn must return once ctx is
+// done. An error other than the context's own stops the whole group. Go
+// after Stop is a no-op, so nothing is started that Wait would not see.
+func (g *Group) Go(name string, fn func(ctx context.Context) error) {
+    g.mu.Lock()
+    if g.ctx.Err() != nil {
+        g.mu.Unlock()
+        return
+    }
+    g.running[name]++
+    g.wg.Add(1)
+    g.mu.Unlock()
+
+    go func() {
+        defer g.wg.Done()
+        err := fn(g.ctx)
+
+        g.mu.Lock()
+        if g.running[name]--; g.running[name] == 0 {
+            delete(g.running, name)
+        }
+        failed := err != nil && !errors.Is(err, context.Canceled) && g.err == nil
+        if failed {
+            g.err = fmt.Errorf("%s: %w", name, err)
+        }
+        g.mu.Unlock()
+
+        if failed {
+            logger.Errorf("%s failed, stopping: %v", name, err)
+            g.cancel()
+        }
+    }()
+}
+
+// Stop cancels the group's context without waiting
+func (g *Group) Stop() {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.cancel()
+}
+
+// Wait blocks until every goroutine has returned and reports the first
+// failure, if any
+func (g *Group) Wait() error {
+    g.wg.Wait()
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.err
+}
+
+// Shutdown stops the group and waits up to timeout for it to drain. If
+// goroutines are still running then, the error names them.
+func (g *Group) Shutdown(timeout time.Duration) error {
+    g.Stop()
+    done := make(chan struct{})
+    go func() {
+        g.wg.Wait()
+        close(done)
+    }()
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case <-done:
+        return g.Wait()
+    case <-timer.C:
+        return fmt.Errorf("still running after %s: %s", timeout, strings.Join(g.Running(), ", "))
+    }
+}
+
+// Running lists the goroutines that have not returned yet
+func (g *Group) Running() []string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    names := make([]string, 0, len(g.running))
+    for name, n := range g.running {
+        if n > 1 {
+            name = fmt.Sprintf("%s (x%d)", name, n)
+        }
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
@@ -0,0 +1,265 @@
+package logging
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Level is the severity of a log line
+type Level int32
+
+const (
+    LevelDebug Level = iota
+    LevelInfo
+    LevelWarn
+    LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+    if l < LevelDebug || l > LevelError {
+        return "level" + strconv.Itoa(int(l))
+    }
+    return levelNames[l]
+}
+
+// ParseLevel accepts debug, info, warn (or warning) and error
+func ParseLevel(s string) (Level, error) {
+    switch strings.ToLower(s) {
+    case "debug":
+        return LevelDebug, nil
+    case "", "info":
+        return LevelInfo, nil
+    case "warn", "warning":
+        return LevelWarn, nil
+    case "error":
+        return LevelError, nil
+    }
+    return 0, fmt.Errorf("invalid log level %q (debug, info, warn or error)", s)
+}
+
+// Output is shared by every logger. Text lines keep the old layout with
+// fields appended as key=value; JSON puts one object per line for log
+// shippers.
+var (
+    mu         sync.Mutex
+    out        io.Writer = os.Stderr
+    jsonFormat bool
+    minLevel   = int32(LevelInfo)
+)
+
+// The last lines written are kept in memory for diagnostics bundles
+const recentLines = 2000
+
+var (
+    recent     [recentLines][]byte
+    recentNext int
+)
+
+// Configure sets where lines go, the lowest level written and whether
+// lines are JSON
+func Configure(w io.Writer, level Level, asJSON bool) {
+    mu.Lock()
+    defer mu.Unlock()
+    out, jsonFormat = w, asJSON
+    atomic.StoreInt32(&minLevel, int32(level))
+}
+
+// SetLevel changes the lowest level written
+func SetLevel(level Level) {
+    atomic.StoreInt32(&minLevel, int32(level))
+}
+
+// Enabled reports whether lines at level are written
+func Enabled(level Level) bool {
+    return int32(level) >= atomic.LoadInt32(&minLevel)
+}
+
+type field struct {
+    key   string
+    value interface{}
+}
+
+// Logger writes lines for one component, each carrying the logger's fields
+type Logger struct {
+    component string
+    fields    []field
+}
+
+// New returns the logger of a component such as "router" or "api"
+func New(component string) *Logger {
+    return &Logger{component: component}
+}
+
+// With returns a logger adding key/value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+    fields := make([]field, len(l.fields), len(l.fields)+len(kv)/2)
+    copy(fields, l.fields)
+    for i := 0; i+1 < len(kv); i += 2 {
+        fields = append(fields, field{key: fmt.Sprint(kv[i]), value: kv[i+1]})
+    }
+    return &Logger{component: l.component, fields: fields}
+}
+
+// Call returns a logger tagging lines with a call's CallID, DID and ANI;
+// empty values are left out
+func (l *Logger) Call(callID, did, ani string) *Logger {
+    kv := make([]interface{}, 0, 6)
+    if callID != "" {
+        kv = append(kv, "call_id", callID)
+    }
+    if did != "" {
+        kv = append(kv, "did", did)
+    }
+    if ani != "" {
+        kv = append(kv, "ani", ani)
+    }
+    return l.With(kv...)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the correlation ID of the
+// request being served
+func WithRequestID(ctx context.Context, id string) context.Context {
+    return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the correlation ID carried by ctx, or ""
+func RequestID(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+// Context returns a logger tagging lines with the request ID in ctx, if any
+func (l *Logger) Context(ctx context.Context) *Logger {
+    if id := RequestID(ctx); id != "" {
+        return l.With("request_id", id)
+    }
+    return l
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args) }
+
+func (l *Logger) logf(level Level, format string, args []interface{}) {
+    if !Enabled(level) {
+        return
+    }
+    write(time.Now(), level, l.component, fmt.Sprintf(format, args...), l.fields)
+}
+
+func write(now time.Time, level Level, component, msg string, fields []field) {
+    var b bytes.Buffer
+    mu.Lock()
+    defer mu.Unlock()
+    if jsonFormat {
+        b.WriteString(`{"time":`)
+        appendJSON(&b, now.UTC().Format(time.RFC3339Nano))
+        b.WriteString(`,"level":`)
+        appendJSON(&b, level.String())
+        if component != "" {
+            b.WriteString(`,"component":`)
+            appendJSON(&b, component)
+        }
+        b.WriteString(`,"msg":`)
+        appendJSON(&b, msg)
+        for _, f := range fields {
+            b.WriteByte(',')
+            appendJSON(&b, f.key)
+            b.WriteByte(':')
+            appendJSON(&b, f.value)
+        }
+        b.WriteString("}\n")
+    } else {
+        b.WriteString(now.Format("2006/01/02 15:04:05 "))
+        b.WriteString(strings.ToUpper(level.String()))
+        if component != "" {
+            b.WriteString(" [" + strings.ToUpper(component) + "]")
+        }
+        b.WriteByte(' ')
+        b.WriteString(msg)
+        for _, f := range fields {
+            b.WriteByte(' ')
+            b.WriteString(f.key)
+            b.WriteByte('=')
+            v := fmt.Sprint(f.value)
+            if v == "" || strings.ContainsAny(v, " \"=") {
+                v = strconv.Quote(v)
+            }
+            b.WriteString(v)
+        }
+        b.WriteByte('\n')
+    }
+    out.Write(b.Bytes())
+    recent[recentNext] = b.Bytes()
+    recentNext = (recentNext + 1) % recentLines
+}
+
+// WriteRecent writes the last lines logged, oldest first
+func WriteRecent(w io.Writer) error {
+    mu.Lock()
+    lines := make([][]byte, 0, recentLines)
+    for i := 0; i < recentLines; i++ {
+        if line := recent[(recentNext+i)%recentLines]; line != nil {
+            lines = append(lines, line)
+        }
+    }
+    mu.Unlock()
+    for _, line := range lines {
+        if _, err := w.Write(line); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func appendJSON(b *bytes.Buffer, v interface{}) {
+    if err, ok := v.(error); ok {
+        v = err.Error()
+    }
+    data, err := json.Marshal(v)
+    if err != nil {
+        data, _ = json.Marshal(fmt.Sprint(v))
+    }
+    b.Write(data)
+}
+
+// RedirectStdlib sends lines of the standard log package through the
+// configured output, so packages still using it (net/http's server errors,
+// third party clients) come out in the same format. They are written at
+// warn level whatever the configured level, since such a line is most
+// likely a problem and there is no telling what else it may be. A leading
+// [COMPONENT] tag becomes the component.
+func RedirectStdlib() {
+    log.SetFlags(0)
+    log.SetPrefix("")
+    log.SetOutput(stdlibWriter{})
+}
+
+type stdlibWriter struct{}
+
+func (stdlibWriter) Write(p []byte) (int, error) {
+    msg := strings.TrimRight(string(p), "\n")
+    component := ""
+    if strings.HasPrefix(msg, "[") {
+        if end := strings.Index(msg, "] "); end > 0 {
+            component, msg = strings.ToLower(msg[1:end]), msg[end+2:]
+        }
+    }
+    write(time.Now(), LevelWarn, component, msg, nil)
+    return len(p), nil
+}
@@ -0,0 +1,31 @@
+package logging
+
+import (
+    "bytes"
+    "log"
+    "os"
+    "strings"
+    "testing"
+)
+
+// Lines from the standard log package are never dropped, whatever the
+// level, and come out at warn with their tag as the component
+func TestStdlibLinesSurviveErrorLevel(t *testing.T) {
+    var buf bytes.Buffer
+    Configure(&buf, LevelError, false)
+    RedirectStdlib()
+    defer func() {
+        Configure(os.Stderr, LevelInfo, false)
+        log.SetOutput(os.Stderr)
+    }()
+
+    New("test").Infof("hidden")
+    log.Printf("[HTTP] http: TLS handshake error from 10.0.0.1: EOF")
+    out := buf.String()
+    if strings.Contains(out, "hidden") {
+        t.Errorf("info line written at error level: %q", out)
+    }
+    if !strings.Contains(out, "WARN [HTTP] http: TLS handshake error from 10.0.0.1: EOF") {
+        t.Errorf("stdlib line missing or at the wrong level: %q", out)
+    }
+}
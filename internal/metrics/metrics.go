@@ -0,0 +1,379 @@
+package metrics
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Registry holds named metrics and renders them in the Prometheus text
+// format, or in OpenMetrics (which adds histogram exemplars) for scrapers
+// that ask for it
+type Registry struct {
+    mu      sync.RWMutex
+    metrics map[string]metric
+}
+
+type metric interface {
+    name() string
+    write(w io.Writer, om bool)
+}
+
+// Default is the registry used by the package level constructors
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+    return &Registry{metrics: make(map[string]metric)}
+}
+
+func (reg *Registry) register(m metric) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    if _, exists := reg.metrics[m.name()]; exists {
+        panic(fmt.Sprintf("metrics: duplicate registration of %s", m.name()))
+    }
+    reg.metrics[m.name()] = m
+}
+
+// Write renders every registered metric sorted by name
+func (reg *Registry) Write(w io.Writer) {
+    reg.write(w, false)
+}
+
+// WriteOpenMetrics renders the registry in the OpenMetrics text format
+func (reg *Registry) WriteOpenMetrics(w io.Writer) {
+    reg.write(w, true)
+    fmt.Fprintln(w, "# EOF")
+}
+
+func (reg *Registry) write(w io.Writer, om bool) {
+    reg.mu.RLock()
+    names := make([]string, 0, len(reg.metrics))
+    for name := range reg.metrics {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    list := make([]metric, 0, len(names))
+    for _, name := range names {
+        list = append(list, reg.metrics[name])
+    }
+    reg.mu.RUnlock()
+
+    for _, m := range list {
+        m.write(w, om)
+    }
+}
+
+// Handler serves the registry for scraping. Prometheus only keeps exemplars
+// when scraping OpenMetrics, which it requests through the Accept header.
+func (reg *Registry) Handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+            w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+            reg.WriteOpenMetrics(w)
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        reg.Write(w)
+    })
+}
+
+func Handler() http.Handler {
+    return Default.Handler()
+}
+
+// Counter is a monotonically increasing value, optionally split by labels
+type Counter struct {
+    vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+    c := &Counter{vec: newVec(name, help, "counter", labels)}
+    Default.register(c)
+    return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+    c.update(labelValues, func(cur float64) float64 { return cur + v })
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+    vec
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+    g := &Gauge{vec: newVec(name, help, "gauge", labels)}
+    Default.register(g)
+    return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+    g.update(labelValues, func(float64) float64 { return v })
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+    g.update(labelValues, func(cur float64) float64 { return cur + v })
+}
+
+// GaugeFunc reports the result of fn at scrape time
+type GaugeFunc struct {
+    metricName string
+    help       string
+    fn         func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+    g := &GaugeFunc{metricName: name, help: help, fn: fn}
+    Default.register(g)
+    return g
+}
+
+func (g *GaugeFunc) name() string { return g.metricName }
+
+func (g *GaugeFunc) write(w io.Writer, om bool) {
+    writeHeader(w, g.metricName, g.help, "gauge")
+    fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+// vec stores one float value per label combination
+type vec struct {
+    metricName string
+    help       string
+    kind       string
+    labelNames []string
+
+    mu     sync.Mutex
+    values map[string]*sample
+}
+
+type sample struct {
+    labelValues []string
+    value       float64
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+    return vec{
+        metricName: name,
+        help:       help,
+        kind:       kind,
+        labelNames: labels,
+        values:     make(map[string]*sample),
+    }
+}
+
+func (v *vec) name() string { return v.metricName }
+
+func (v *vec) update(labelValues []string, fn func(float64) float64) {
+    key := labelKey(v.metricName, v.labelNames, labelValues)
+    v.mu.Lock()
+    s, ok := v.values[key]
+    if !ok {
+        s = &sample{labelValues: append([]string(nil), labelValues...)}
+        v.values[key] = s
+    }
+    s.value = fn(s.value)
+    v.mu.Unlock()
+}
+
+// Value returns the current value for the given label values
+func (v *vec) Value(labelValues ...string) float64 {
+    key := labelKey(v.metricName, v.labelNames, labelValues)
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    if s, ok := v.values[key]; ok {
+        return s.value
+    }
+    return 0
+}
+
+// Values returns a copy of every label combination and its value, keyed by
+// the label values joined with ","
+func (v *vec) Values() map[string]float64 {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    out := make(map[string]float64, len(v.values))
+    for _, s := range v.values {
+        out[strings.Join(s.labelValues, ",")] = s.value
+    }
+    return out
+}
+
+func (v *vec) write(w io.Writer, om bool) {
+    family := v.metricName
+    if om && v.kind == "counter" {
+        // OpenMetrics names the counter family without its _total sample suffix
+        family = strings.TrimSuffix(family, "_total")
+    }
+    writeHeader(w, family, v.help, v.kind)
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    for _, key := range sortedKeys(v.values) {
+        s := v.values[key]
+        fmt.Fprintf(w, "%s%s %s\n", v.metricName, formatLabels(v.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+    }
+}
+
+// Histogram counts observations into cumulative buckets. Observations made
+// with ObserveExemplar also keep the latest trace ID per bucket.
+type Histogram struct {
+    metricName string
+    help       string
+    buckets    []float64
+    labelNames []string
+
+    mu     sync.Mutex
+    series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+    labelValues []string
+    counts      []uint64
+    sum         float64
+    count       uint64
+    exemplars   []*exemplar // per bucket, the last one +Inf
+}
+
+// exemplar links one observation to the trace it was measured in
+type exemplar struct {
+    traceID string
+    value   float64
+    at      time.Time
+}
+
+// DefaultBuckets suits request latencies measured in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+    if buckets == nil {
+        buckets = DefaultBuckets
+    }
+    h := &Histogram{
+        metricName: name,
+        help:       help,
+        buckets:    buckets,
+        labelNames: labels,
+        series:     make(map[string]*histogramSeries),
+    }
+    Default.register(h)
+    return h
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+    h.ObserveExemplar(v, "", labelValues...)
+}
+
+// ObserveExemplar records v and, when traceID is set, keeps it as the
+// exemplar of the bucket v falls into
+func (h *Histogram) ObserveExemplar(v float64, traceID string, labelValues ...string) {
+    key := labelKey(h.metricName, h.labelNames, labelValues)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    s, ok := h.series[key]
+    if !ok {
+        s = &histogramSeries{
+            labelValues: append([]string(nil), labelValues...),
+            counts:      make([]uint64, len(h.buckets)),
+            exemplars:   make([]*exemplar, len(h.buckets)+1),
+        }
+        h.series[key] = s
+    }
+    bucket := len(h.buckets)
+    for i, upper := range h.buckets {
+        if v <= upper {
+            s.counts[i]++
+            if i < bucket {
+                bucket = i
+            }
+        }
+    }
+    s.sum += v
+    s.count++
+    if traceID != "" {
+        s.exemplars[bucket] = &exemplar{traceID: traceID, value: v, at: time.Now()}
+    }
+}
+
+func (h *Histogram) write(w io.Writer, om bool) {
+    writeHeader(w, h.metricName, h.help, "histogram")
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for _, key := range sortedKeys(h.series) {
+        s := h.series[key]
+        for i, upper := range h.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.metricName,
+                formatLabels(h.labelNames, s.labelValues, "le", formatFloat(upper)), s.counts[i],
+                formatExemplar(s.exemplars[i], om))
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.metricName,
+            formatLabels(h.labelNames, s.labelValues, "le", "+Inf"), s.count,
+            formatExemplar(s.exemplars[len(h.buckets)], om))
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, formatLabels(h.labelNames, s.labelValues, "", ""), formatFloat(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, formatLabels(h.labelNames, s.labelValues, "", ""), s.count)
+    }
+}
+
+// Helpers
+
+func labelKey(name string, labelNames, labelValues []string) string {
+    if len(labelValues) != len(labelNames) {
+        panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", name, len(labelNames), len(labelValues)))
+    }
+    return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+    fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+    fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+    if len(names) == 0 && extraName == "" {
+        return ""
+    }
+    parts := make([]string, 0, len(names)+1)
+    for i, name := range names {
+        parts = append(parts, fmt.Sprintf("%s=%q", name, values[i]))
+    }
+    if extraName != "" {
+        parts = append(parts, fmt.Sprintf("%s=%q", extraName, extraValue))
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatExemplar renders the OpenMetrics exemplar suffix of a bucket line,
+// "" in the Prometheus format that has no place for it
+func formatExemplar(e *exemplar, om bool) string {
+    if e == nil || !om {
+        return ""
+    }
+    ts := float64(e.at.UnixNano()) / 1e9
+    return fmt.Sprintf(" # {trace_id=%q} %s %.3f", e.traceID, formatFloat(e.value), ts)
+}
+
+func formatFloat(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return fmt.Sprintf("%g", v)
+}
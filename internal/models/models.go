@@ -14,25 +14,102 @@ const (
     CallStateFailed     CallState = "FAILED"
 )
 
+// Transitions recorded in a call's timeline
+const (
+    CallEventIncoming    = "INCOMING"
+    CallEventDIDAssigned = "DID_ASSIGNED"
+    CallEventForwarded   = "FORWARDED"
+    CallEventReturned    = "RETURNED"
+    CallEventCompleted   = "COMPLETED"
+    CallEventFailed      = "FAILED"
+    CallEventOverflow    = "OVERFLOW"     // no DID was free, sent along the overflow route
+    CallEventANIMismatch = "ANI_MISMATCH" // the return leg's ANI-2 was not the DNIS-1
+)
+
 type CallRecord struct {
-    ID            int64
-    CallID        string
-    OriginalANI   string
-    OriginalDNIS  string
-    AssignedDID   string
-    Status        CallState
-    StartTime     time.Time
-    EndTime       *time.Time
-    Duration      int
-    RecordingPath string
+    ID              int64
+    CallID          string
+    OriginalANI     string
+    OriginalDNIS    string
+    AssignedDID     string
+    Status          CallState
+    StartTime       time.Time
+    EndTime         *time.Time
+    Duration        int
+    RecordingPath   string
+    MatchToken      string
+    SettlementClass string
+    Tags            map[string]string
+    Campaign        string
+    ForwardTrunk    string
+    Tenant          string
+    TraceParent     string      // S2's forward span, parent of the rest of the call's spans
+    Destination     Destination // the DNIS per the numbering plan
+}
+
+// LiveCall is an active call as shown on the live call feed
+type LiveCall struct {
+    CallID       string            `json:"call_id"`
+    ANI          string            `json:"ani"`
+    DNIS         string            `json:"dnis"`
+    DID          string            `json:"did"`
+    Status       CallState         `json:"status"`
+    StartTime    time.Time         `json:"start_time"`
+    Duration     int               `json:"duration,omitempty"` // seconds, once removed
+    ForwardTrunk string            `json:"forward_trunk,omitempty"`
+    Campaign     string            `json:"campaign,omitempty"`
+    Tenant       string            `json:"tenant_id,omitempty"`
+    Tags         map[string]string `json:"tags,omitempty"`
 }
 
+// LiveCallUpdate is one message of the live call feed: a snapshot of every
+// active call first, then a message per call added, updated or removed
+type LiveCallUpdate struct {
+    SchemaVersion int `json:"schema_version"`
+
+    Type      string     `json:"type"` // "snapshot", "added", "updated" or "removed"
+    Timestamp time.Time  `json:"timestamp"`
+    Call      *LiveCall  `json:"call,omitempty"`
+    Calls     []LiveCall `json:"calls,omitempty"`
+}
+
+// CallResponse tells the dialplan where to send the next leg. TraceParent
+// and Baggage must be copied into the traceparent/baggage SIP headers of
+// that leg so the next server continues the trace.
 type CallResponse struct {
     Status      string `json:"status"`
+    CallID      string `json:"call_id,omitempty"` // S1's CallID, or the one S2 issued
     DIDAssigned string `json:"did_assigned"`
     NextHop     string `json:"next_hop"`
     ANIToSend   string `json:"ani_to_send"`
     DNISToSend  string `json:"dnis_to_send"`
+    MatchToken  string `json:"match_token,omitempty"`
+    Recording   string `json:"recording,omitempty"` // file to record the call to, omitted while recordings are suspended
+    TraceParent string `json:"traceparent,omitempty"`
+    Baggage     string `json:"baggage,omitempty"`
+
+    Headers map[string]string `json:"headers,omitempty"` // SIP headers for the outbound leg, from the carrier profile
+
+    Cost *CostEstimate `json:"cost,omitempty"` // rate of the forward leg, when one is configured and not hidden
+
+    // Suggested delay before S1's next call to NextHop, set while the trunk
+    // is near its carrier profile's CPS limit
+    PacingMs int `json:"pacing_ms,omitempty"`
+
+    // How a call with status "overflow" is routed without a DID: "direct"
+    // to S4 at NextHop, or "announcement" in the dialplan context NextHop
+    Overflow string `json:"overflow,omitempty"`
+}
+
+// CostEstimate is what the forward leg of a call is billed at, so S1 can
+// check its margin before connecting
+type CostEstimate struct {
+    RateID           int64   `json:"rate_id"`
+    Prefix           string  `json:"prefix"`
+    PerMinute        float64 `json:"per_minute"`
+    Currency         string  `json:"currency"`
+    InitialIncrement int     `json:"initial_increment"` // seconds
+    Increment        int     `json:"increment"`         // seconds
 }
 
 type DID struct {
@@ -43,3 +120,650 @@ type DID struct {
     Country     string
     UpdatedAt   time.Time
 }
+
+// EventSchemaVersion is the version of the published JSON Schema that
+// Event and LiveCallUpdate payloads conform to (see package eventschema)
+const EventSchemaVersion = 1
+
+// Event is a call lifecycle notification delivered to external consumers
+type Event struct {
+    SchemaVersion int `json:"schema_version"`
+
+    Type      string            `json:"event"`
+    Timestamp time.Time         `json:"timestamp"`
+    CallID    string            `json:"call_id"`
+    ANI       string            `json:"ani,omitempty"`
+    DNIS      string            `json:"dnis,omitempty"`
+    DID       string            `json:"did,omitempty"`
+    Status    CallState         `json:"status,omitempty"`
+    Detail    string            `json:"detail,omitempty"`
+    Tags      map[string]string `json:"tags,omitempty"`
+    Campaign  string            `json:"campaign,omitempty"`
+    Tenant    string            `json:"tenant,omitempty"`
+    TraceID   string            `json:"trace_id,omitempty"`
+    RequestID string            `json:"request_id,omitempty"`
+}
+
+// WebhookDelivery is a queued notification as stored in webhook_queue
+type WebhookDelivery struct {
+    ID            int64     `json:"id"`
+    EventType     string    `json:"event_type"`
+    URL           string    `json:"url"`
+    Payload       string    `json:"payload"`
+    Status        string    `json:"status"`
+    Attempts      int       `json:"attempts"`
+    NextAttemptAt time.Time `json:"next_attempt_at"`
+    LastError     string    `json:"last_error,omitempty"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+// SettlementRule tags a trunk or destination prefix with a settlement class
+type SettlementRule struct {
+    ID        int64     `json:"id"`
+    MatchType string    `json:"match_type"` // "prefix" or "trunk"
+    Pattern   string    `json:"pattern"`
+    Class     string    `json:"class"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// SettlementUsage is the traffic carried in one settlement class
+type SettlementUsage struct {
+    Class   string  `json:"class"`
+    Calls   int     `json:"calls"`
+    Minutes float64 `json:"minutes"`
+}
+
+// DIDCall is one use of a DID, as listed by /api/dids/{did}/history
+type DIDCall struct {
+    CallID       string     `json:"call_id"`
+    ANI          string     `json:"ani"`
+    DNIS         string     `json:"dnis"`
+    Status       CallState  `json:"status"`
+    StartTime    time.Time  `json:"start_time"`
+    EndTime      *time.Time `json:"end_time,omitempty"`
+    Duration     int        `json:"duration"`               // seconds
+    HangupCause  string     `json:"hangup_cause,omitempty"` // Q.850 cause, when known
+    Campaign     string     `json:"campaign_id,omitempty"`
+    Tenant       string     `json:"tenant_id,omitempty"`
+    ForwardTrunk string     `json:"forward_trunk,omitempty"`
+    Notes        []Note     `json:"notes,omitempty"`
+}
+
+// Call is one call record as listed by /api/calls
+type Call struct {
+    CallID          string            `json:"call_id"`
+    ANI             string            `json:"ani"`
+    DNIS            string            `json:"dnis"`
+    DID             string            `json:"did"`
+    Status          CallState         `json:"status"`
+    StartTime       time.Time         `json:"start_time"`
+    EndTime         *time.Time        `json:"end_time,omitempty"`
+    Duration        int               `json:"duration"`               // seconds
+    HangupCause     string            `json:"hangup_cause,omitempty"` // Q.850 cause, when known
+    SettlementClass string            `json:"settlement_class,omitempty"`
+    Campaign        string            `json:"campaign_id,omitempty"`
+    Tenant          string            `json:"tenant_id,omitempty"`
+    ForwardTrunk    string            `json:"forward_trunk,omitempty"`
+    Tags            map[string]string `json:"tags,omitempty"`
+}
+
+// CallDetail is everything recorded about one call, for /api/calls/{callid}
+type CallDetail struct {
+    Call
+    MatchToken    string        `json:"match_token,omitempty"`
+    RecordingPath string        `json:"recording_path,omitempty"`
+    TraceParent   string        `json:"traceparent,omitempty"` // S2's forward span, to find the call in the trace backend
+    Timeline      *CallTimeline `json:"timeline,omitempty"`    // omitted when no events were recorded
+    Notes         []Note        `json:"notes"`
+}
+
+// CallPage is one page of /api/calls; Total counts every matching call
+type CallPage struct {
+    Calls   []Call `json:"calls"`
+    Total   int    `json:"total"`
+    Page    int    `json:"page"`
+    PerPage int    `json:"per_page"`
+}
+
+// StatsSnapshot is one row of /api/stats/history
+type StatsSnapshot struct {
+    Node           string    `json:"node"`
+    TakenAt        time.Time `json:"taken_at"`
+    ActiveCalls    int       `json:"active_calls"`
+    TotalDIDs      int       `json:"total_dids"`
+    UsedDIDs       int       `json:"used_dids"`
+    AvailableDIDs  int64     `json:"available_dids"`
+    Utilization    float64   `json:"utilization"` // used / (used + available), 0-1
+    CallsToday     int       `json:"calls_today"`
+    CompletedToday int       `json:"completed_today"`
+}
+
+// Note is free-text investigation context an operator left on a call or DID
+type Note struct {
+    ID        int64     `json:"id"`
+    Subject   string    `json:"subject"` // "call" or "did"
+    SubjectID string    `json:"subject_id"`
+    Author    string    `json:"author"`
+    Body      string    `json:"body"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Campaign holds per-campaign throttling limits; zero means unlimited
+type Campaign struct {
+    ID            string    `json:"campaign_id"`
+    MaxCPS        float64   `json:"max_cps"`
+    MaxConcurrent int       `json:"max_concurrent"`
+    UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// BlocklistEntry lists or allows one A-number on behalf of a source: an
+// operator ("manual") or a feed
+type BlocklistEntry struct {
+    Number    string     `json:"number"`
+    Source    string     `json:"source"`
+    Action    string     `json:"action"` // "block" or "allow"
+    Reason    string     `json:"reason,omitempty"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
+    UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// BlocklistFeed is an external list imported into the blocklist
+type BlocklistFeed struct {
+    Name      string     `json:"name"`
+    URL       string     `json:"url"`    // list URL, or the zone of a dnsbl feed
+    Format    string     `json:"format"` // "csv", "text" or "dnsbl"
+    Action    string     `json:"action"` // what listed numbers get: "block" (default) or "allow"
+    TTL       int        `json:"ttl"`      // seconds an entry lives after its last fetch
+    Interval  int        `json:"interval"` // seconds between fetches
+    Priority  int        `json:"priority"` // higher wins when feeds disagree
+    Enabled   bool       `json:"enabled"`
+    LastFetch *time.Time `json:"last_fetch,omitempty"`
+    LastError string     `json:"last_error,omitempty"`
+    Entries   int        `json:"entries"`
+    UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// BlocklistVerdict is how the blocklist resolves one number
+type BlocklistVerdict struct {
+    Number  string           `json:"number"`
+    Action  string           `json:"action"`
+    Source  string           `json:"source,omitempty"`
+    Reason  string           `json:"reason,omitempty"`
+    Entries []BlocklistEntry `json:"entries"`
+}
+
+// S1Partition assigns an upstream S1 node to one partition of the DID pool
+type S1Partition struct {
+    Source    string    `json:"source"`
+    Partition int       `json:"partition"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DIDSource is the partition of a DID and the S1 sources assigned to it
+type DIDSource struct {
+    DID       string   `json:"did"`
+    Partition int      `json:"partition"`
+    Sources   []string `json:"sources"`
+}
+
+// CarrierProfile adapts the calls sent over a trunk to what its carrier
+// accepts
+type CarrierProfile struct {
+    Trunk          string            `json:"trunk"`
+    DialPrefix     string            `json:"dial_prefix,omitempty"`      // prepended to the DNIS, e.g. a tech prefix
+    CallerIDHeader string            `json:"caller_id_header,omitempty"` // pai or rpid; empty sends the caller ID in From only
+    Privacy        string            `json:"privacy,omitempty"`          // Privacy header value, e.g. id or none
+    MaxCPS         float64           `json:"max_cps"`                    // new calls per second towards the trunk, 0 is unlimited
+    Headers        map[string]string `json:"headers,omitempty"`          // extra SIP headers sent as-is
+    UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// CampaignStats summarises one campaign's traffic
+type CampaignStats struct {
+    CampaignID    string  `json:"campaign_id"`
+    ActiveCalls   int     `json:"active_calls"`
+    Calls         int     `json:"calls"`
+    Completed     int     `json:"completed"`
+    Failed        int     `json:"failed"`
+    AvgDuration   float64 `json:"avg_duration"`
+    Throttled     int     `json:"throttled"`
+    MaxCPS        float64 `json:"max_cps"`
+    MaxConcurrent int     `json:"max_concurrent"`
+}
+
+// RoutingOverride temporarily sends a destination prefix to another trunk
+type RoutingOverride struct {
+    ID          int64      `json:"id"`
+    Prefix      string     `json:"prefix"`
+    Leg         string     `json:"leg"` // "forward" (to S3) or "return" (to S4)
+    Trunk       string     `json:"trunk"`
+    Reason      string     `json:"reason"`
+    CreatedBy   string     `json:"created_by"`
+    Status      string     `json:"status"`
+    StartsAt    time.Time  `json:"starts_at"`
+    ExpiresAt   time.Time  `json:"expires_at"`
+    CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+    CreatedAt   time.Time  `json:"created_at"`
+}
+
+// OverrideAudit records a lifecycle action on a routing override
+type OverrideAudit struct {
+    ID         int64     `json:"id"`
+    OverrideID int64     `json:"override_id"`
+    Action     string    `json:"action"`
+    Actor      string    `json:"actor"`
+    Detail     string    `json:"detail"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// Rate is the per-minute price for a destination prefix on a trunk over an
+// effective period. A nil EffectiveTo means the rate runs until superseded.
+type Rate struct {
+    ID               int64      `json:"id"`
+    Trunk            string     `json:"trunk"`
+    Prefix           string     `json:"prefix"`
+    PerMinute        float64    `json:"per_minute"`
+    Currency         string     `json:"currency"`
+    InitialIncrement int        `json:"initial_increment"` // seconds billed for the first increment
+    Increment        int        `json:"increment"`         // seconds per increment after the first
+    EffectiveFrom    time.Time  `json:"effective_from"`
+    EffectiveTo      *time.Time `json:"effective_to,omitempty"`
+    CreatedAt        time.Time  `json:"created_at"`
+}
+
+// ANIReputation summarises how calls from one A-number have behaved.
+// Counts are decayed so old history weighs less than recent traffic.
+type ANIReputation struct {
+    ANI         string    `json:"ani"`
+    Score       float64   `json:"score"` // 0 (bad) to 100 (good)
+    Calls       float64   `json:"calls"`
+    Completed   float64   `json:"completed"`
+    AvgDuration float64   `json:"avg_duration"`
+    Complaints  float64   `json:"complaints"`
+    UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Tenant is a reseller selected by the SIP domain S1 received the call on.
+// It owns a DID pool and may send both legs to its own trunks.
+type Tenant struct {
+    ID           string    `json:"tenant_id"`
+    Name         string    `json:"name"`
+    Domains      []string  `json:"domains"`
+    ForwardTrunk string    `json:"forward_trunk,omitempty"` // replaces trunk-s3 when set
+    ReturnTrunk  string    `json:"return_trunk,omitempty"`  // replaces trunk-s4 when set
+
+    // QoS overrides, 0 keeps the router default
+    ReservationTTL int `json:"reservation_ttl,omitempty"` // seconds a forwarded call holds its DID waiting for S3
+    StaleTimeout   int `json:"stale_timeout,omitempty"`   // seconds a returned call is tracked without a hangup
+    MaxDuration    int `json:"max_duration,omitempty"`    // seconds before a returned call is ended
+    Priority       int `json:"priority,omitempty"`        // higher is served first when calls wait for a DID
+
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DIDRange is a block of consecutive numbers whose DIDs are created on
+// first allocation instead of being inserted up front
+type DIDRange struct {
+    ID           int64     `json:"id"`
+    Start        string    `json:"start"`
+    End          string    `json:"end"`
+    Size         int64     `json:"size"`
+    Materialized int64     `json:"materialized"`
+    Tenant       string    `json:"tenant_id,omitempty"`
+    Country      string    `json:"country,omitempty"`
+    CreatedAt    time.Time `json:"created_at"`
+}
+
+// CDR is the billing record of one finished call, as written to the CDR
+// sinks. Seq counts up by one per CDR on a router from its start, so a gap
+// in a sink's feed means CDRs were dropped.
+type CDR struct {
+    Seq             uint64    `json:"seq"`
+    Node            string    `json:"node"`
+    CallID          string    `json:"call_id"`
+    ANI             string    `json:"ani"`
+    DNIS            string    `json:"dnis"`
+    DID             string    `json:"did"`
+    Status          CallState `json:"status"`
+    StartTime       time.Time `json:"start_time"`
+    EndTime         time.Time `json:"end_time"`
+    Duration        int       `json:"duration"` // seconds
+    HangupCause     string    `json:"hangup_cause,omitempty"`
+    EndSource       string    `json:"end_source,omitempty"` // what ended the call: api, ami or max_duration
+    Campaign        string    `json:"campaign_id,omitempty"`
+    Tenant          string    `json:"tenant_id,omitempty"`
+    SettlementClass string    `json:"settlement_class,omitempty"`
+    ForwardTrunk    string    `json:"forward_trunk,omitempty"`
+    DestCountry     string    `json:"dest_country,omitempty"` // the DNIS per the numbering plan
+    DestRegion      string    `json:"dest_region,omitempty"`
+    DestType        string    `json:"dest_type,omitempty"`
+}
+
+// ExportJob is an asynchronous CDR export of calls started in [From, To)
+type ExportJob struct {
+    ID         string     `json:"id"`
+    Status     string     `json:"status"` // queued, running, done, failed or cancelled
+    Format     string     `json:"format"` // csv or ndjson
+    From       time.Time  `json:"from"`
+    To         time.Time  `json:"to"`
+    Campaign   string     `json:"campaign_id,omitempty"`
+    Tenant     string     `json:"tenant_id,omitempty"`
+    CallStatus string     `json:"call_status,omitempty"`
+    UploadURL  string     `json:"-"` // pushed here with PUT when set, e.g. a pre-signed S3 URL
+    Uploaded   bool       `json:"uploaded,omitempty"`
+    Rows       int64      `json:"rows"`
+    Bytes      int64      `json:"bytes,omitempty"`
+    Error      string     `json:"error,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+    StartedAt  *time.Time `json:"started_at,omitempty"`
+    FinishedAt *time.Time `json:"finished_at,omitempty"`
+    ExpiresAt  *time.Time `json:"expires_at,omitempty"` // file and job are removed after this
+}
+
+// DIDPool is the size of one named pool of a tenant ("" for unpooled DIDs
+// or the default tenant)
+type DIDPool struct {
+    Pool   string `json:"pool"`
+    Tenant string `json:"tenant_id"`
+    Total  int    `json:"total"`
+    Free   int    `json:"free"`
+}
+
+// ProvisioningRequest is one order of DIDs for a pool that ran near capacity
+type ProvisioningRequest struct {
+    ID          int64      `json:"id"`
+    Tenant      string     `json:"tenant_id"`
+    Pool        string     `json:"pool"`
+    Count       int        `json:"count"`
+    Utilization float64    `json:"utilization"`
+    Status      string     `json:"status"`
+    Added       int        `json:"added"`
+    Cost        float64    `json:"cost"`
+    Error       string     `json:"error,omitempty"`
+    DecidedBy   string     `json:"decided_by,omitempty"`
+    RequestedAt time.Time  `json:"requested_at"`
+    CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// ProvisioningBudget is the month's provisioning against its caps; a zero
+// limit is unlimited
+type ProvisioningBudget struct {
+    Month     string  `json:"month"`
+    DIDs      int     `json:"dids"`
+    DIDLimit  int     `json:"did_limit"`
+    Cost      float64 `json:"cost"`
+    CostLimit float64 `json:"cost_limit"`
+}
+
+// SchemaDrift is one difference between the live database and the schema
+// the router expects. Fix is the suggested statement, if any; Safe ones
+// only add tables, columns or indexes, or widen a column, and can be
+// applied automatically.
+type SchemaDrift struct {
+    Kind     string `json:"kind"` // missing_table, missing_column, missing_index, wrong_type, wrong_index, extra_column or extra_index
+    Table    string `json:"table"`
+    Column   string `json:"column,omitempty"`
+    Index    string `json:"index,omitempty"`
+    Expected string `json:"expected,omitempty"`
+    Actual   string `json:"actual,omitempty"`
+    Fix      string `json:"fix,omitempty"`
+    Safe     bool   `json:"safe"`
+}
+
+// SchemaReport is the outcome of the latest schema check
+type SchemaReport struct {
+    CheckedAt time.Time     `json:"checked_at"`
+    OK        bool          `json:"ok"` // nothing missing or different; extra columns and indexes are allowed
+    Drift     []SchemaDrift `json:"drift"`
+    Repaired  []SchemaDrift `json:"repaired,omitempty"`
+}
+
+// Load is how busy one S2 instance is, for S1 or a SIP load balancer
+// picking the least-loaded router
+type Load struct {
+    Score       float64 `json:"score"` // 0 idle to 100 full or not accepting
+    ActiveCalls int     `json:"active_calls"`
+    CPS         float64 `json:"cps"`      // admitted calls per second, last 10s
+    Headroom    float64 `json:"headroom"` // share of the DID pool free
+    FreeDIDs    int64   `json:"free_dids"`
+    UsedDIDs    int     `json:"used_dids"`
+    Accepting   bool    `json:"accepting"`
+}
+
+// CallEvent is one transition of a call as stored in call_events
+type CallEvent struct {
+    Event     string    `json:"event"`
+    At        time.Time `json:"at"`
+    Detail    string    `json:"detail,omitempty"`
+    RequestID string    `json:"request_id,omitempty"`
+}
+
+// StageLatency is the time a call took from one transition to the next
+type StageLatency struct {
+    From   string  `json:"from"`
+    To     string  `json:"to"`
+    Millis float64 `json:"ms"`
+}
+
+// CallTimeline is the journey of one call through S2
+type CallTimeline struct {
+    CallID string         `json:"call_id"`
+    Events []CallEvent    `json:"events"`
+    Stages []StageLatency `json:"stages"`
+    Total  float64        `json:"total_ms"` // first to last transition
+}
+
+// CallFlow is the journey of one call laid out for a sequence diagram:
+// the systems it passed through, one step per message between them, and
+// the legs with the number rewrites S2 applied on each
+type CallFlow struct {
+    CallID       string     `json:"call_id"`
+    Status       CallState  `json:"status,omitempty"` // empty when only events were recorded
+    HangupCause  string     `json:"hangup_cause,omitempty"`
+    Participants []string   `json:"participants"`
+    Steps        []FlowStep `json:"steps"`
+    Legs         []FlowLeg  `json:"legs"`
+    StartTime    *time.Time `json:"start_time,omitempty"`
+    EndTime      *time.Time `json:"end_time,omitempty"`
+    Total        float64    `json:"total_ms"` // first to last step
+}
+
+// FlowStep is one arrow of the diagram; From equals To for S2's own work
+type FlowStep struct {
+    From   string    `json:"from"`
+    To     string    `json:"to"`
+    Event  string    `json:"event"`
+    Label  string    `json:"label"`
+    At     time.Time `json:"at"`
+    Offset float64   `json:"offset_ms"` // since the first step
+    Detail string    `json:"detail,omitempty"`
+}
+
+// FlowLeg is one leg S2 routed, forward (S1 to S3) or return (S3 to S4)
+type FlowLeg struct {
+    Leg             string               `json:"leg"`
+    From            string               `json:"from"`
+    To              string               `json:"to"`
+    Trunk           string               `json:"trunk,omitempty"`
+    At              time.Time            `json:"at"`
+    Transformations []FlowTransformation `json:"transformations"`
+}
+
+// FlowTransformation is a number S2 received on a leg and what it sent on
+type FlowTransformation struct {
+    Field string `json:"field"` // "ani" or "dnis"
+    From  string `json:"from"`
+    To    string `json:"to"`
+}
+
+// RecordingUsage is the disk use of the recordings directory against its quota
+type RecordingUsage struct {
+    Path       string     `json:"path"`
+    Bytes      int64      `json:"bytes"`
+    Files      int        `json:"files"`
+    QuotaBytes int64      `json:"quota_bytes,omitempty"`
+    FullAction string     `json:"full_action,omitempty"`
+    Suspended  bool       `json:"suspended"` // calls are not being recorded
+    Purged     int64      `json:"purged"`    // recordings deleted since start
+    CheckedAt  *time.Time `json:"checked_at,omitempty"`
+}
+
+// RecordingMeta is the checksum and size of a recording, taken once its
+// call had ended
+type RecordingMeta struct {
+    CallID       string     `json:"call_id"`
+    Path         string     `json:"path"`
+    Size         int64      `json:"size_bytes"`
+    SHA256       string     `json:"sha256"`
+    CompletedAt  time.Time  `json:"completed_at"`
+    VerifiedAt   *time.Time `json:"verified_at,omitempty"`
+    VerifyStatus string     `json:"verify_status,omitempty"`
+}
+
+// RecordingVerification is the outcome of checking a recording against its
+// stored checksum. Status is ok, checksum_mismatch, truncated,
+// size_mismatch, missing, or error when the file could not be read.
+type RecordingVerification struct {
+    CallID         string    `json:"call_id"`
+    Path           string    `json:"path"`
+    Status         string    `json:"status"`
+    Size           int64     `json:"size_bytes"`
+    SHA256         string    `json:"sha256,omitempty"`
+    ExpectedSize   int64     `json:"expected_size_bytes"`
+    ExpectedSHA256 string    `json:"expected_sha256"`
+    CheckedAt      time.Time `json:"checked_at"`
+    Error          string    `json:"error,omitempty"`
+}
+
+// ReplicationStatus describes call-state replication to and from peers
+type ReplicationStatus struct {
+    Peer          string             `json:"peer,omitempty"`   // standby this instance streams to
+    Listen        string             `json:"listen,omitempty"` // address accepting a primary's stream
+    Sending       *ReplicationStream `json:"sending,omitempty"`
+    Receiving     *ReplicationStream `json:"receiving,omitempty"`
+    Queued        int                `json:"queued"`         // deltas waiting to be sent
+    MirroredCalls int                `json:"mirrored_calls"` // in-flight calls held for the primary
+}
+
+// ReplicationStream is one live replication connection
+type ReplicationStream struct {
+    Peer   string    `json:"peer"`
+    Since  time.Time `json:"since"`
+    Seq    uint64    `json:"seq"`             // last message sent or applied
+    Acked  uint64    `json:"acked,omitempty"` // last message the standby confirmed, when sending
+    LastAt time.Time `json:"last_at"`
+}
+
+// Destination is what the numbering plan says about a called number
+type Destination struct {
+    Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2
+    Region  string `json:"region,omitempty"`
+    Type    string `json:"type,omitempty"` // fixed, mobile, fixed_or_mobile, toll_free or premium
+}
+
+// DestinationUsage is the traffic to one destination over a period
+type DestinationUsage struct {
+    Country   string  `json:"country"`
+    Region    string  `json:"region,omitempty"`
+    Type      string  `json:"type"`
+    Calls     int     `json:"calls"`
+    Completed int     `json:"completed"`
+    Minutes   float64 `json:"minutes"`
+}
+
+// CountryMatch counts the calls for one destination country that got a DID
+// of that country and those that fell back to another
+type CountryMatch struct {
+    Country  string `json:"country"`
+    Matched  int64  `json:"matched"`
+    Fallback int64  `json:"fallback"`
+}
+
+// DIDImport summarises a bulk DID import. Rows are counted once each: a row
+// is imported, a duplicate of an earlier row, already in the database or
+// invalid.
+type DIDImport struct {
+    TotalRows  int              `json:"total_rows"`
+    Imported   int              `json:"imported"`
+    Duplicates int              `json:"duplicates"`
+    Existing   int              `json:"existing"`
+    Invalid    int              `json:"invalid"`
+    DryRun     bool             `json:"dry_run"`
+    Errors     []DIDImportError `json:"errors,omitempty"`
+}
+
+// DIDImportError is a rejected row of a DID import
+type DIDImportError struct {
+    Line  int    `json:"line"`
+    DID   string `json:"did,omitempty"`
+    Error string `json:"error"`
+}
+
+// V1DID is a row of the v1 router's dids table
+type V1DID struct {
+    DID     string `json:"did"`
+    Country string `json:"country,omitempty"`
+}
+
+// V1Call is a row of the v1 router's call_records table
+type V1Call struct {
+    CallID        string     `json:"call_id"`
+    ANI           string     `json:"original_ani"`
+    DNIS          string     `json:"original_dnis"`
+    DID           string     `json:"assigned_did"`
+    Status        string     `json:"status"`
+    StartTime     time.Time  `json:"start_time"`
+    EndTime       *time.Time `json:"end_time,omitempty"`
+    Duration      int        `json:"duration"`
+    RecordingPath string     `json:"recording_path,omitempty"`
+}
+
+// V1Batch is part of a v1 database, as POSTed to /api/migrate/v1
+type V1Batch struct {
+    DIDs  []V1DID  `json:"dids"`
+    Calls []V1Call `json:"calls"`
+}
+
+// V1Import reports the import of a V1Batch. Active calls were in flight
+// and continue on v2; abandoned ones were in flight too but are imported
+// as FAILED, being past the stale window or holding a DID a v2 call uses.
+type V1Import struct {
+    DryRun        bool            `json:"dry_run"`
+    DIDs          int             `json:"dids"`
+    DIDsExisting  int             `json:"dids_existing"`
+    Calls         int             `json:"calls"`
+    CallsExisting int             `json:"calls_existing"`
+    Active        int             `json:"active"`
+    Abandoned     int             `json:"abandoned"`
+    Invalid       int             `json:"invalid"`
+    Errors        []V1ImportError `json:"errors,omitempty"`
+}
+
+// V1ImportError is a rejected row of a v1 import
+type V1ImportError struct {
+    CallID string `json:"call_id,omitempty"`
+    DID    string `json:"did,omitempty"`
+    Error  string `json:"error"`
+}
+
+// V1DualWrite reports the mirroring of DID state into a v1 router during a
+// migration
+type V1DualWrite struct {
+    Held      int       `json:"held"`      // DIDs claimed in v1 on v2's behalf
+    Pending   int       `json:"pending"`   // writes v1 has not taken yet
+    Conflicts int64     `json:"conflicts"` // claims given up because v1 had the DID in use
+    LastSync  time.Time `json:"last_sync"`
+    LastError string    `json:"last_error,omitempty"`
+}
+
+// Diagnostics reports the routing SLOs diagnostics bundles are captured on
+type Diagnostics struct {
+    Requests    int        `json:"requests"`   // routing requests in the SLO window
+    P99Millis   float64    `json:"p99_ms"`     // routing p99 latency over the window
+    ErrorRate   float64    `json:"error_rate"` // share of requests failing on S2's side
+    Captures    int        `json:"captures"`
+    LastCapture *time.Time `json:"last_capture,omitempty"`
+    LastReason  string     `json:"last_reason,omitempty"`
+    LastBundle  string     `json:"last_bundle,omitempty"`
+    LastError   string     `json:"last_error,omitempty"`
+}
@@ -0,0 +1,181 @@
+package nats
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    dialTimeout = 2 * time.Second
+    opTimeout   = 5 * time.Second
+)
+
+// Config selects the NATS server
+type Config struct {
+    URL string // nats://[user:pass@]host:port; empty disables NATS
+}
+
+// Error is an -ERR reply from the server
+type Error string
+
+func (e Error) Error() string { return "nats: " + string(e) }
+
+// Client publishes to one NATS server over the plain text protocol. It only
+// publishes; a batch is confirmed by the PONG to a PING sent after it,
+// which the server answers once every earlier PUB was processed.
+type Client struct {
+    addr string
+    user string
+    pass string
+
+    mu   sync.Mutex
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+func NewClient(cfg Config) (*Client, error) {
+    u, err := url.Parse(cfg.URL)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "nats" {
+        return nil, fmt.Errorf("nats: unsupported URL scheme %q", u.Scheme)
+    }
+    c := &Client{addr: u.Host}
+    if u.Port() == "" {
+        c.addr += ":4222"
+    }
+    if u.User != nil {
+        c.user = u.User.Username()
+        c.pass, _ = u.User.Password()
+    }
+    return c, nil
+}
+
+// Publish sends every message to subject and waits for the server to take
+// them. A broken connection is redialled once, so a batch may be delivered
+// twice but is never silently lost.
+func (c *Client) Publish(subject string, msgs ...[]byte) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    err := c.publish(subject, msgs)
+    if err != nil {
+        if _, ok := err.(Error); ok {
+            return err
+        }
+        // The server may have dropped an idle connection; try a fresh one
+        c.drop()
+        err = c.publish(subject, msgs)
+    }
+    if err != nil {
+        c.drop()
+    }
+    return err
+}
+
+func (c *Client) publish(subject string, msgs [][]byte) error {
+    if c.conn == nil {
+        if err := c.connect(); err != nil {
+            return err
+        }
+    }
+    c.conn.SetDeadline(time.Now().Add(opTimeout))
+    w := bufio.NewWriter(c.conn)
+    for _, msg := range msgs {
+        fmt.Fprintf(w, "PUB %s %d\r\n", subject, len(msg))
+        w.Write(msg)
+        w.WriteString("\r\n")
+    }
+    w.WriteString("PING\r\n")
+    if err := w.Flush(); err != nil {
+        return err
+    }
+    return c.awaitPong()
+}
+
+// connect dials the server and completes the INFO/CONNECT handshake
+func (c *Client) connect() error {
+    conn, err := net.DialTimeout("tcp", c.addr, dialTimeout)
+    if err != nil {
+        return err
+    }
+    c.conn, c.r = conn, bufio.NewReader(conn)
+    conn.SetDeadline(time.Now().Add(opTimeout))
+
+    line, err := c.readLine()
+    if err != nil {
+        c.drop()
+        return err
+    }
+    if !strings.HasPrefix(line, "INFO ") {
+        c.drop()
+        return fmt.Errorf("nats: expected INFO, got %q", line)
+    }
+
+    opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "s2-router", "lang": "go"}
+    if c.user != "" {
+        opts["user"], opts["pass"] = c.user, c.pass
+    }
+    data, _ := json.Marshal(opts)
+    if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", data); err != nil {
+        c.drop()
+        return err
+    }
+    if err := c.awaitPong(); err != nil {
+        c.drop()
+        return err
+    }
+    return nil
+}
+
+// awaitPong reads until the PONG, answering the server's own PINGs
+func (c *Client) awaitPong() error {
+    for {
+        line, err := c.readLine()
+        if err != nil {
+            return err
+        }
+        switch {
+        case line == "PONG":
+            return nil
+        case line == "PING":
+            if _, err := c.conn.Write([]byte("PONG\r\n")); err != nil {
+                return err
+            }
+        case strings.HasPrefix(line, "-ERR"):
+            return Error(strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+        case line == "+OK", strings.HasPrefix(line, "INFO "):
+        default:
+            return fmt.Errorf("nats: unexpected %q", line)
+        }
+    }
+}
+
+func (c *Client) readLine() (string, error) {
+    line, err := c.r.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *Client) drop() {
+    if c.conn != nil {
+        c.conn.Close()
+        c.conn, c.r = nil, nil
+    }
+}
+
+// Close ends the connection; a later Publish dials again
+func (c *Client) Close() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.drop()
+}
@@ -0,0 +1,244 @@
+// Package natstest runs an in-memory NATS server for tests, speaking as
+// much of the text protocol as the nats client uses: INFO, CONNECT, PUB,
+// PING and PONG. It records what was published instead of routing it.
+package natstest
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// Msg is one published message
+type Msg struct {
+    Subject string
+    Data    []byte
+}
+
+// Server is a fake NATS server listening on a loopback port
+type Server struct {
+    ln   net.Listener
+    user string
+    pass string
+
+    mu         sync.Mutex
+    msgs       []Msg
+    connects   int
+    conns      map[net.Conn]bool
+    maxPayload int
+    pingFirst  bool
+    wg         sync.WaitGroup
+}
+
+// NewServer starts a server on a free port, requiring user and pass in
+// CONNECT when user is set
+func NewServer(user, pass string) (*Server, error) {
+    return Listen("127.0.0.1:0", user, pass)
+}
+
+// Listen starts a server on addr, e.g. to bring one back where an earlier
+// server was closed
+func Listen(addr, user, pass string) (*Server, error) {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    s := &Server{ln: ln, user: user, pass: pass, conns: make(map[net.Conn]bool), maxPayload: 1 << 20}
+    s.wg.Add(1)
+    go s.accept()
+    return s, nil
+}
+
+// URL is the nats:// URL of the server, without credentials
+func (s *Server) URL() string {
+    return "nats://" + s.ln.Addr().String()
+}
+
+// Close stops listening and drops every connection, as a server going down
+func (s *Server) Close() {
+    s.ln.Close()
+    s.Drop()
+    s.wg.Wait()
+}
+
+// Drop closes the client connections but keeps listening, as a server
+// dropping idle clients or a load balancer cutting them
+func (s *Server) Drop() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for c := range s.conns {
+        c.Close()
+    }
+}
+
+// SetMaxPayload sets the largest PUB the server takes, 1MB by default.
+// A larger one gets a Maximum Payload Violation and the connection closed.
+func (s *Server) SetMaxPayload(n int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.maxPayload = n
+}
+
+// PingFirst makes the server PING the client, and wait for its PONG,
+// before answering each PING of the client's
+func (s *Server) PingFirst(on bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.pingFirst = on
+}
+
+// Messages returns the messages published since the last call, in order
+func (s *Server) Messages() []Msg {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    msgs := s.msgs
+    s.msgs = nil
+    return msgs
+}
+
+// Connects is the number of connections that completed CONNECT
+func (s *Server) Connects() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.connects
+}
+
+func (s *Server) accept() {
+    defer s.wg.Done()
+    for {
+        c, err := s.ln.Accept()
+        if err != nil {
+            return
+        }
+        s.mu.Lock()
+        s.conns[c] = true
+        s.mu.Unlock()
+        s.wg.Add(1)
+        go s.serve(c)
+    }
+}
+
+func (s *Server) serve(c net.Conn) {
+    defer s.wg.Done()
+    defer func() {
+        c.Close()
+        s.mu.Lock()
+        delete(s.conns, c)
+        s.mu.Unlock()
+    }()
+    s.mu.Lock()
+    info, _ := json.Marshal(map[string]interface{}{
+        "server_id": "natstest", "version": "2.10.0", "proto": 1,
+        "max_payload": s.maxPayload, "auth_required": s.user != "",
+    })
+    s.mu.Unlock()
+    if _, err := fmt.Fprintf(c, "INFO %s\r\n", info); err != nil {
+        return
+    }
+
+    r := bufio.NewReader(c)
+    connected := false
+    // Publishes are only counted once the client's PING confirms them, and
+    // a connection dropped before then loses them, as a real server would
+    var batch []Msg
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return
+        }
+        if !strings.HasSuffix(line, "\r\n") {
+            fmt.Fprintf(c, "-ERR 'Protocol Error'\r\n")
+            return
+        }
+        line = strings.TrimSuffix(line, "\r\n")
+        op, args := line, ""
+        if i := strings.IndexByte(line, ' '); i >= 0 {
+            op, args = line[:i], line[i+1:]
+        }
+        switch strings.ToUpper(op) {
+        case "CONNECT":
+            var opts struct {
+                User string `json:"user"`
+                Pass string `json:"pass"`
+            }
+            if err := json.Unmarshal([]byte(args), &opts); err != nil {
+                fmt.Fprintf(c, "-ERR 'Protocol Error'\r\n")
+                return
+            }
+            if s.user != "" && (opts.User != s.user || opts.Pass != s.pass) {
+                fmt.Fprintf(c, "-ERR 'Authorization Violation'\r\n")
+                return
+            }
+            connected = true
+            s.mu.Lock()
+            s.connects++
+            s.mu.Unlock()
+        case "PUB":
+            if !connected {
+                fmt.Fprintf(c, "-ERR 'Authorization Violation'\r\n")
+                return
+            }
+            msg, err := readPub(r, args)
+            if err != nil {
+                fmt.Fprintf(c, "-ERR '%s'\r\n", err)
+                return
+            }
+            s.mu.Lock()
+            tooBig := len(msg.Data) > s.maxPayload
+            s.mu.Unlock()
+            if tooBig {
+                fmt.Fprintf(c, "-ERR 'Maximum Payload Violation'\r\n")
+                return
+            }
+            batch = append(batch, msg)
+        case "PING":
+            s.mu.Lock()
+            pingFirst := s.pingFirst
+            s.mu.Unlock()
+            if pingFirst {
+                if _, err := io.WriteString(c, "PING\r\n"); err != nil {
+                    return
+                }
+                if pong, err := r.ReadString('\n'); err != nil || pong != "PONG\r\n" {
+                    return
+                }
+            }
+            s.mu.Lock()
+            s.msgs = append(s.msgs, batch...)
+            s.mu.Unlock()
+            batch = nil
+            if _, err := io.WriteString(c, "PONG\r\n"); err != nil {
+                return
+            }
+        case "PONG":
+        default:
+            fmt.Fprintf(c, "-ERR 'Unknown Protocol Operation'\r\n")
+            return
+        }
+    }
+}
+
+// readPub reads the payload of "PUB <subject> [reply-to] <#bytes>"
+func readPub(r *bufio.Reader, args string) (Msg, error) {
+    fields := strings.Fields(args)
+    if len(fields) != 2 && len(fields) != 3 {
+        return Msg{}, fmt.Errorf("Parser Error")
+    }
+    size, err := strconv.Atoi(fields[len(fields)-1])
+    if err != nil || size < 0 {
+        return Msg{}, fmt.Errorf("Parser Error")
+    }
+    data := make([]byte, size+2)
+    if _, err := io.ReadFull(r, data); err != nil {
+        return Msg{}, err
+    }
+    if string(data[size:]) != "\r\n" {
+        return Msg{}, fmt.Errorf("Parser Error")
+    }
+    return Msg{Subject: fields[0], Data: data[:size]}, nil
+}
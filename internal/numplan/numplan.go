@@ -0,0 +1,103 @@
+// Package numplan labels phone numbers with their destination - country,
+// region and line type - from a numbering plan dataset embedded in the
+// binary, so that no lookup service is needed on the call path.
+//
+// The dataset, numplan.csv, maps international prefixes to destinations;
+// the longest prefix of a number decides. It covers country codes
+// worldwide at country level and refines the larger markets by region and
+// by mobile, toll free and premium ranges. Numbers it has no prefix for
+// are not labelled.
+package numplan
+
+import (
+    _ "embed"
+    "encoding/csv"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Line types the dataset uses
+const (
+    Fixed         = "fixed"
+    Mobile        = "mobile"
+    FixedOrMobile = "fixed_or_mobile"
+    TollFree      = "toll_free"
+    Premium       = "premium"
+)
+
+//go:embed numplan.csv
+var dataset string
+
+var (
+    loadOnce sync.Once
+    plan     map[string]models.Destination
+    longest  int
+    loadErr  error
+)
+
+// Lookup returns the destination of a number given as international
+// digits (country code first, no + or 00), false if the plan has no
+// prefix for it
+func Lookup(digits string) (models.Destination, bool) {
+    loadOnce.Do(load)
+    if len(digits) > longest {
+        digits = digits[:longest]
+    }
+    for n := len(digits); n > 0; n-- {
+        if d, ok := plan[digits[:n]]; ok {
+            return d, true
+        }
+    }
+    return models.Destination{}, false
+}
+
+// Size reports how many prefixes the plan holds, or why it failed to load
+func Size() (int, error) {
+    loadOnce.Do(load)
+    return len(plan), loadErr
+}
+
+func load() {
+    plan, loadErr = parse(strings.NewReader(dataset))
+    for prefix := range plan {
+        if len(prefix) > longest {
+            longest = len(prefix)
+        }
+    }
+}
+
+func parse(src io.Reader) (map[string]models.Destination, error) {
+    reader := csv.NewReader(src)
+    reader.Comment = '#'
+    reader.FieldsPerRecord = 4
+    m := make(map[string]models.Destination)
+    for first := true; ; first = false {
+        record, err := reader.Read()
+        if err == io.EOF {
+            return m, nil
+        }
+        if err != nil {
+            return m, err
+        }
+        if first && record[0] == "prefix" {
+            continue
+        }
+        prefix := record[0]
+        if prefix == "" || strings.Trim(prefix, "0123456789") != "" {
+            return m, fmt.Errorf("numbering plan: invalid prefix %q", prefix)
+        }
+        switch record[3] {
+        case Fixed, Mobile, FixedOrMobile, TollFree, Premium:
+        default:
+            return m, fmt.Errorf("numbering plan: prefix %s has unknown type %q", prefix, record[3])
+        }
+        if _, dup := m[prefix]; dup {
+            return m, fmt.Errorf("numbering plan: prefix %s listed twice", prefix)
+        }
+        m[prefix] = models.Destination{Country: record[1], Region: record[2], Type: record[3]}
+    }
+}
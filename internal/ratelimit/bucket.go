@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+)
+
+// Bucket is a thread-safe token bucket refilled at rate tokens per second
+type Bucket struct {
+    mu       sync.Mutex
+    clock    clock.Clock
+    rate     float64
+    burst    float64
+    tokens   float64
+    lastFill time.Time
+}
+
+// NewBucket returns a full bucket refilling on c, nil for the system clock
+func NewBucket(rate float64, burst int, c clock.Clock) *Bucket {
+    if burst < 1 {
+        burst = 1
+    }
+    if c == nil {
+        c = clock.Real()
+    }
+    return &Bucket{
+        clock:    c,
+        rate:     rate,
+        burst:    float64(burst),
+        tokens:   float64(burst),
+        lastFill: c.Now(),
+    }
+}
+
+// Allow takes a token if one is available
+func (b *Bucket) Allow() bool {
+    ok, _ := b.Take()
+    return ok
+}
+
+// Take is Allow that also returns the share of the burst left afterwards,
+// 0 empty to 1 full
+func (b *Bucket) Take() (bool, float64) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.refill()
+    if b.tokens < 1 {
+        return false, b.tokens / b.burst
+    }
+    b.tokens--
+    return true, b.tokens / b.burst
+}
+
+// SetRate changes the refill rate and burst, keeping the tokens already earned
+func (b *Bucket) SetRate(rate float64, burst int) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.refill()
+    if burst < 1 {
+        burst = 1
+    }
+    b.rate = rate
+    b.burst = float64(burst)
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+}
+
+func (b *Bucket) refill() {
+    now := b.clock.Now()
+    b.tokens += now.Sub(b.lastFill).Seconds() * b.rate
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+    b.lastFill = now
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+)
+
+// Buckets of clients that have been idle this long are dropped; a new
+// bucket starts full, so a client coming back loses nothing
+const keyedIdle = 10 * time.Minute
+
+// Keyed gives every key its own bucket with the same rate and burst
+type Keyed struct {
+    clock clock.Clock
+    rate  float64
+    burst int
+
+    mu        sync.Mutex
+    buckets   map[string]*keyedBucket
+    lastSweep time.Time
+}
+
+type keyedBucket struct {
+    *Bucket
+    lastSeen time.Time
+    rejected int64 // requests refused in a row
+}
+
+// NewKeyed returns a limiter whose buckets refill on c, nil for the system clock
+func NewKeyed(rate float64, burst int, c clock.Clock) *Keyed {
+    if c == nil {
+        c = clock.Real()
+    }
+    return &Keyed{
+        clock:     c,
+        rate:      rate,
+        burst:     burst,
+        buckets:   make(map[string]*keyedBucket),
+        lastSweep: c.Now(),
+    }
+}
+
+// Allow takes a token from key's bucket. When it refuses it also returns
+// how many requests in a row key has had refused, 1 on the first.
+func (k *Keyed) Allow(key string) (bool, int64) {
+    now := k.clock.Now()
+    k.mu.Lock()
+    defer k.mu.Unlock()
+
+    if now.Sub(k.lastSweep) >= keyedIdle {
+        for id, b := range k.buckets {
+            if now.Sub(b.lastSeen) >= keyedIdle {
+                delete(k.buckets, id)
+            }
+        }
+        k.lastSweep = now
+    }
+    b, ok := k.buckets[key]
+    if !ok {
+        b = &keyedBucket{Bucket: NewBucket(k.rate, k.burst, k.clock)}
+        k.buckets[key] = b
+    }
+    b.lastSeen = now
+    if b.Allow() {
+        b.rejected = 0
+        return true, 0
+    }
+    b.rejected++
+    return false, b.rejected
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+)
+
+// Each key refills on the limiter's clock, counts its refusals in a row,
+// and is forgotten once idle, coming back with a full bucket
+func TestKeyedFollowsClock(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    k := NewKeyed(1, 2, fake)
+
+    for i := 0; i < 2; i++ {
+        if ok, _ := k.Allow("a"); !ok {
+            t.Fatalf("request %d within the burst refused", i+1)
+        }
+    }
+    for want := int64(1); want <= 2; want++ {
+        if ok, rejected := k.Allow("a"); ok || rejected != want {
+            t.Fatalf("over the burst: allowed %t, %d refused in a row, want %d", ok, rejected, want)
+        }
+    }
+    if ok, _ := k.Allow("b"); !ok {
+        t.Fatal("another key shares a's bucket")
+    }
+
+    fake.Advance(time.Second)
+    if ok, rejected := k.Allow("a"); !ok || rejected != 0 {
+        t.Fatalf("after a token refilled: allowed %t, %d refused", ok, rejected)
+    }
+    if ok, _ := k.Allow("a"); ok {
+        t.Fatal("one refilled token allowed two requests")
+    }
+
+    fake.Advance(keyedIdle)
+    k.Allow("c") // sweeps
+    k.mu.Lock()
+    _, kept := k.buckets["a"]
+    k.mu.Unlock()
+    if kept {
+        t.Fatal("idle key still tracked after the sweep")
+    }
+}
@@ -0,0 +1,259 @@
+package redis
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    dialTimeout = 2 * time.Second
+    opTimeout   = time.Second
+    maxIdle     = 8
+)
+
+// ErrNil is returned by the typed helpers when the key does not exist
+var ErrNil = errors.New("redis: nil")
+
+// Config selects the Redis server
+type Config struct {
+    Addr     string // host:port; empty disables Redis
+    Password string
+    DB       int
+}
+
+// Error is an error reply from the server
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Client is a small RESP2 client with a pool of idle connections. It covers
+// the handful of commands the router needs, not the whole protocol surface.
+type Client struct {
+    config Config
+    idle   chan *conn
+
+    mu     sync.Mutex
+    closed bool
+}
+
+type conn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func NewClient(cfg Config) *Client {
+    return &Client{config: cfg, idle: make(chan *conn, maxIdle)}
+}
+
+// Do sends one command and returns its reply: string for simple and bulk
+// strings, int64 for integers, []interface{} for arrays and nil for a nil
+// reply. An error reply is returned as Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+    cn, err := c.get()
+    if err != nil {
+        return nil, err
+    }
+
+    cn.SetDeadline(time.Now().Add(opTimeout))
+    reply, err := cn.do(args)
+    if err != nil {
+        if _, ok := err.(Error); !ok {
+            // The stream may be out of step; never reuse the connection
+            cn.Close()
+            return nil, err
+        }
+    }
+    c.put(cn)
+    return reply, err
+}
+
+// Get returns the string at key, or ErrNil
+func (c *Client) Get(key string) (string, error) {
+    reply, err := c.Do("GET", key)
+    if err != nil {
+        return "", err
+    }
+    if reply == nil {
+        return "", ErrNil
+    }
+    s, ok := reply.(string)
+    if !ok {
+        return "", fmt.Errorf("redis: unexpected GET reply %T", reply)
+    }
+    return s, nil
+}
+
+// Set stores value at key, expiring after ttl when ttl > 0
+func (c *Client) Set(key, value string, ttl time.Duration) error {
+    args := []string{"SET", key, value}
+    if ttl > 0 {
+        args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+    }
+    _, err := c.Do(args...)
+    return err
+}
+
+func (c *Client) Del(keys ...string) error {
+    _, err := c.Do(append([]string{"DEL"}, keys...)...)
+    return err
+}
+
+// Script for deleting a key only while it still holds the expected value
+const compareAndDelete = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// DelIfEquals deletes key only if it holds value, so an entry already
+// pointing at something newer is left alone
+func (c *Client) DelIfEquals(key, value string) error {
+    _, err := c.Do("EVAL", compareAndDelete, "1", key, value)
+    return err
+}
+
+func (c *Client) Ping() error {
+    _, err := c.Do("PING")
+    return err
+}
+
+// Close drops idle connections; connections in use are closed when returned
+func (c *Client) Close() {
+    c.mu.Lock()
+    c.closed = true
+    c.mu.Unlock()
+    for {
+        select {
+        case cn := <-c.idle:
+            cn.Close()
+        default:
+            return
+        }
+    }
+}
+
+func (c *Client) get() (*conn, error) {
+    select {
+    case cn := <-c.idle:
+        return cn, nil
+    default:
+    }
+
+    nc, err := net.DialTimeout("tcp", c.config.Addr, dialTimeout)
+    if err != nil {
+        return nil, err
+    }
+    cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+    cn.SetDeadline(time.Now().Add(opTimeout))
+    if c.config.Password != "" {
+        if _, err := cn.do([]string{"AUTH", c.config.Password}); err != nil {
+            cn.Close()
+            return nil, err
+        }
+    }
+    if c.config.DB != 0 {
+        if _, err := cn.do([]string{"SELECT", strconv.Itoa(c.config.DB)}); err != nil {
+            cn.Close()
+            return nil, err
+        }
+    }
+    return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+    c.mu.Lock()
+    closed := c.closed
+    c.mu.Unlock()
+    if closed {
+        cn.Close()
+        return
+    }
+    select {
+    case c.idle <- cn:
+    default:
+        cn.Close()
+    }
+}
+
+func (cn *conn) do(args []string) (interface{}, error) {
+    buf := make([]byte, 0, 64)
+    buf = append(buf, '*')
+    buf = strconv.AppendInt(buf, int64(len(args)), 10)
+    buf = append(buf, '\r', '\n')
+    for _, a := range args {
+        buf = append(buf, '$')
+        buf = strconv.AppendInt(buf, int64(len(a)), 10)
+        buf = append(buf, '\r', '\n')
+        buf = append(buf, a...)
+        buf = append(buf, '\r', '\n')
+    }
+    if _, err := cn.Write(buf); err != nil {
+        return nil, err
+    }
+    return cn.readReply()
+}
+
+func (cn *conn) readLine() (string, error) {
+    line, err := cn.r.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    if len(line) < 3 || line[len(line)-2] != '\r' {
+        return "", fmt.Errorf("redis: malformed reply line %q", line)
+    }
+    return line[:len(line)-2], nil
+}
+
+func (cn *conn) readReply() (interface{}, error) {
+    line, err := cn.readLine()
+    if err != nil {
+        return nil, err
+    }
+
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return nil, Error(line[1:])
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        data := make([]byte, n+2)
+        if _, err := io.ReadFull(cn.r, data); err != nil {
+            return nil, err
+        }
+        return string(data[:n]), nil
+    case '*':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        items := make([]interface{}, n)
+        for i := range items {
+            // Error replies inside an array are kept as values
+            item, err := cn.readReply()
+            if e, ok := err.(Error); ok {
+                items[i] = e
+                continue
+            }
+            if err != nil {
+                return nil, err
+            }
+            items[i] = item
+        }
+        return items, nil
+    }
+    return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
@@ -0,0 +1,231 @@
+package redis
+
+import (
+    "errors"
+    "net"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/redis/redistest"
+)
+
+func newServer(t *testing.T, password string) *redistest.Server {
+    t.Helper()
+    srv, err := redistest.NewServer(password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func newClient(t *testing.T, cfg Config) *Client {
+    t.Helper()
+    c := NewClient(cfg)
+    t.Cleanup(c.Close)
+    return c
+}
+
+func TestClientCommands(t *testing.T) {
+    srv := newServer(t, "")
+    c := newClient(t, Config{Addr: srv.Addr()})
+
+    if err := c.Ping(); err != nil {
+        t.Fatalf("Ping: %v", err)
+    }
+    // Values go out as bulk strings, so CRLF and spaces pass through
+    if err := c.Set("s2:call:a", "{\"x\": 1}\r\n", 0); err != nil {
+        t.Fatalf("Set: %v", err)
+    }
+    if got, err := c.Get("s2:call:a"); err != nil || got != "{\"x\": 1}\r\n" {
+        t.Fatalf("Get = %q, %v", got, err)
+    }
+    if _, err := c.Get("s2:call:missing"); err != ErrNil {
+        t.Fatalf("Get missing key: err = %v, want ErrNil", err)
+    }
+    if n, err := c.Do("DEL", "s2:call:a", "s2:call:missing"); err != nil || n != int64(1) {
+        t.Fatalf("DEL = %v, %v; want 1", n, err)
+    }
+
+    // DelIfEquals leaves a key that moved on to another value
+    c.Set("s2:did:1555", "call-2", 0)
+    if err := c.DelIfEquals("s2:did:1555", "call-1"); err != nil {
+        t.Fatalf("DelIfEquals: %v", err)
+    }
+    if _, ok := srv.Get("s2:did:1555"); !ok {
+        t.Fatal("DelIfEquals deleted a key holding another value")
+    }
+    if err := c.DelIfEquals("s2:did:1555", "call-2"); err != nil {
+        t.Fatalf("DelIfEquals: %v", err)
+    }
+    if _, ok := srv.Get("s2:did:1555"); ok {
+        t.Fatal("DelIfEquals kept a key holding the value")
+    }
+
+    want := [][]string{
+        {"PING"},
+        {"SET", "s2:call:a", "{\"x\": 1}\r\n"},
+        {"GET", "s2:call:a"},
+        {"GET", "s2:call:missing"},
+        {"DEL", "s2:call:a", "s2:call:missing"},
+        {"SET", "s2:did:1555", "call-2"},
+        {"EVAL", compareAndDelete, "1", "s2:did:1555", "call-1"},
+        {"EVAL", compareAndDelete, "1", "s2:did:1555", "call-2"},
+    }
+    if got := srv.Commands(); !reflect.DeepEqual(got, want) {
+        t.Errorf("server received\n%q\nwant\n%q", got, want)
+    }
+    if n := srv.Conns(); n != 1 {
+        t.Errorf("%d connections for sequential commands, want 1 reused", n)
+    }
+}
+
+func TestClientErrorReplyKeepsConnection(t *testing.T) {
+    srv := newServer(t, "")
+    c := newClient(t, Config{Addr: srv.Addr()})
+
+    _, err := c.Do("HSET", "k", "f", "v")
+    var reply Error
+    if !errors.As(err, &reply) || !strings.HasPrefix(string(reply), "ERR unknown command") {
+        t.Fatalf("err = %v, want an unknown command Error", err)
+    }
+    // An error reply leaves the stream in step, so the connection is reused
+    if err := c.Ping(); err != nil {
+        t.Fatalf("Ping after error reply: %v", err)
+    }
+    if n := srv.Conns(); n != 1 {
+        t.Errorf("%d connections, want the first one reused", n)
+    }
+}
+
+func TestClientTTL(t *testing.T) {
+    srv := newServer(t, "")
+    c := newClient(t, Config{Addr: srv.Addr()})
+
+    if err := c.Set("s2:token:t1", "call-1", 90*time.Second); err != nil {
+        t.Fatalf("Set: %v", err)
+    }
+    cmds := srv.Commands()
+    if want := []string{"SET", "s2:token:t1", "call-1", "PX", "90000"}; len(cmds) != 1 || !reflect.DeepEqual(cmds[0], want) {
+        t.Fatalf("Set sent %q, want %q", cmds, want)
+    }
+    if ttl := srv.TTL("s2:token:t1"); ttl != 90*time.Second {
+        t.Fatalf("TTL = %v, want 90s", ttl)
+    }
+
+    srv.Advance(90*time.Second - time.Millisecond)
+    if got, err := c.Get("s2:token:t1"); err != nil || got != "call-1" {
+        t.Fatalf("Get 1ms before expiry = %q, %v", got, err)
+    }
+    srv.Advance(time.Millisecond)
+    if _, err := c.Get("s2:token:t1"); err != ErrNil {
+        t.Fatalf("Get after expiry: err = %v, want ErrNil", err)
+    }
+
+    // A ttl of 0 stores the key without expiry
+    c.Set("s2:token:t2", "call-2", 0)
+    srv.Advance(24 * time.Hour)
+    if got, err := c.Get("s2:token:t2"); err != nil || got != "call-2" {
+        t.Fatalf("Get of a key without TTL = %q, %v", got, err)
+    }
+}
+
+func TestClientAuthAndSelect(t *testing.T) {
+    srv := newServer(t, "s3cret")
+
+    var reply Error
+    if err := newClient(t, Config{Addr: srv.Addr()}).Ping(); !errors.As(err, &reply) || !strings.HasPrefix(string(reply), "NOAUTH") {
+        t.Errorf("Ping without a password: err = %v, want NOAUTH", err)
+    }
+    if err := newClient(t, Config{Addr: srv.Addr(), Password: "wrong"}).Ping(); !errors.As(err, &reply) || !strings.HasPrefix(string(reply), "WRONGPASS") {
+        t.Errorf("Ping with the wrong password: err = %v, want WRONGPASS", err)
+    }
+    srv.Commands()
+
+    c := newClient(t, Config{Addr: srv.Addr(), Password: "s3cret", DB: 3})
+    if err := c.Ping(); err != nil {
+        t.Fatalf("Ping: %v", err)
+    }
+    want := [][]string{{"AUTH", "s3cret"}, {"SELECT", "3"}, {"PING"}}
+    if got := srv.Commands(); !reflect.DeepEqual(got, want) {
+        t.Errorf("server received %q, want %q", got, want)
+    }
+}
+
+func TestClientRedisDown(t *testing.T) {
+    srv := newServer(t, "")
+    addr := srv.Addr()
+    c := newClient(t, Config{Addr: addr})
+    if err := c.Set("k", "v", 0); err != nil {
+        t.Fatalf("Set: %v", err)
+    }
+
+    srv.Close()
+    // The idle connection is dead and dialing is refused; neither may look
+    // like a missing key
+    for i := 0; i < 2; i++ {
+        start := time.Now()
+        _, err := c.Get("k")
+        if err == nil || err == ErrNil {
+            t.Fatalf("Get %d with Redis down: err = %v", i, err)
+        }
+        if _, ok := err.(Error); ok {
+            t.Fatalf("Get %d with Redis down returned a server reply %v", i, err)
+        }
+        if d := time.Since(start); d > opTimeout+dialTimeout {
+            t.Fatalf("Get %d with Redis down took %v", i, d)
+        }
+    }
+
+    // The client redials once Redis is back
+    back, err := redistest.Listen(addr, "")
+    if err != nil {
+        t.Skipf("cannot listen on %s again: %v", addr, err)
+    }
+    defer back.Close()
+    if err := c.Set("k", "v2", 0); err != nil {
+        t.Fatalf("Set after Redis came back: %v", err)
+    }
+    if got, _ := back.Get("k"); got != "v2" {
+        t.Errorf("restarted server holds %q, want v2", got)
+    }
+}
+
+func TestClientDropsConnectionOutOfStep(t *testing.T) {
+    // A server that answers with a reply type RESP2 does not have
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    accepted := make(chan struct{}, 4)
+    go func() {
+        for {
+            nc, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            accepted <- struct{}{}
+            go func() {
+                defer nc.Close()
+                buf := make([]byte, 512)
+                nc.Read(buf)
+                nc.Write([]byte("~2\r\n"))
+                nc.Read(buf)
+            }()
+        }
+    }()
+
+    c := newClient(t, Config{Addr: ln.Addr().String()})
+    for i := 0; i < 2; i++ {
+        if err := c.Ping(); err == nil || !strings.Contains(err.Error(), "unknown reply type") {
+            t.Fatalf("Ping %d: err = %v, want unknown reply type", i, err)
+        }
+    }
+    // Each Ping dialed afresh rather than reusing a stream out of step
+    if n := len(accepted); n != 2 {
+        t.Errorf("%d connections for 2 commands, want 2", n)
+    }
+}
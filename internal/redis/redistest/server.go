@@ -0,0 +1,299 @@
+// Package redistest runs an in-memory Redis for tests, speaking as much
+// RESP2 as the redis client and the router's shared call state use: GET,
+// SET with PX, DEL, the compare-and-delete EVAL, PING, AUTH and SELECT.
+// Keys expire on the server's own clock, moved with Advance.
+package redistest
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Server is a fake Redis listening on a loopback port
+type Server struct {
+    ln       net.Listener
+    password string
+
+    mu       sync.Mutex
+    now      time.Time
+    data     map[string]entry
+    commands [][]string
+    conns    map[net.Conn]bool
+    wg       sync.WaitGroup
+}
+
+type entry struct {
+    value   string
+    expires time.Time // zero never expires
+}
+
+// NewServer starts a server on a free port, requiring AUTH when password
+// is set
+func NewServer(password string) (*Server, error) {
+    return Listen("127.0.0.1:0", password)
+}
+
+// Listen starts a server on addr, e.g. to bring one back where an earlier
+// server was closed
+func Listen(addr, password string) (*Server, error) {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    s := &Server{
+        ln:       ln,
+        password: password,
+        now:      time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+        data:     make(map[string]entry),
+        conns:    make(map[net.Conn]bool),
+    }
+    s.wg.Add(1)
+    go s.accept()
+    return s, nil
+}
+
+// Addr is the host:port the server listens on
+func (s *Server) Addr() string {
+    return s.ln.Addr().String()
+}
+
+// Close stops listening and drops every connection, as a Redis going down
+func (s *Server) Close() {
+    s.ln.Close()
+    s.mu.Lock()
+    for c := range s.conns {
+        c.Close()
+    }
+    s.mu.Unlock()
+    s.wg.Wait()
+}
+
+// Advance moves the server's clock on, expiring the keys whose TTL ran out
+func (s *Server) Advance(d time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.now = s.now.Add(d)
+}
+
+// Get returns the live value at key
+func (s *Server) Get(key string) (string, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    e, ok := s.lookup(key)
+    return e.value, ok
+}
+
+// TTL is the time key has left, 0 for a key without expiry and -1 for a
+// missing one
+func (s *Server) TTL(key string) time.Duration {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    e, ok := s.lookup(key)
+    switch {
+    case !ok:
+        return -1
+    case e.expires.IsZero():
+        return 0
+    }
+    return e.expires.Sub(s.now)
+}
+
+// Commands returns the commands received since the last call
+func (s *Server) Commands() [][]string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    commands := s.commands
+    s.commands = nil
+    return commands
+}
+
+// Conns is the number of client connections open
+func (s *Server) Conns() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.conns)
+}
+
+func (s *Server) accept() {
+    defer s.wg.Done()
+    for {
+        c, err := s.ln.Accept()
+        if err != nil {
+            return
+        }
+        s.mu.Lock()
+        s.conns[c] = true
+        s.mu.Unlock()
+        s.wg.Add(1)
+        go s.serve(c)
+    }
+}
+
+func (s *Server) serve(c net.Conn) {
+    defer s.wg.Done()
+    defer func() {
+        c.Close()
+        s.mu.Lock()
+        delete(s.conns, c)
+        s.mu.Unlock()
+    }()
+    r := bufio.NewReader(c)
+    authed := s.password == ""
+    for {
+        args, err := readCommand(r)
+        if err != nil {
+            if err != io.EOF {
+                fmt.Fprintf(c, "-ERR Protocol error: %v\r\n", err)
+            }
+            return
+        }
+        s.mu.Lock()
+        s.commands = append(s.commands, args)
+        var reply string
+        switch {
+        case strings.EqualFold(args[0], "AUTH"):
+            if len(args) == 2 && args[1] == s.password && s.password != "" {
+                authed, reply = true, "+OK\r\n"
+            } else {
+                reply = "-WRONGPASS invalid username-password pair\r\n"
+            }
+        case !authed:
+            reply = "-NOAUTH Authentication required.\r\n"
+        default:
+            reply = s.exec(args)
+        }
+        s.mu.Unlock()
+        if _, err := io.WriteString(c, reply); err != nil {
+            return
+        }
+    }
+}
+
+// exec runs one authenticated command. Caller must hold s.mu.
+func (s *Server) exec(args []string) string {
+    switch strings.ToUpper(args[0]) {
+    case "PING":
+        return "+PONG\r\n"
+    case "SELECT":
+        if len(args) != 2 {
+            return wrongArgs(args[0])
+        }
+        if _, err := strconv.Atoi(args[1]); err != nil {
+            return "-ERR value is not an integer or out of range\r\n"
+        }
+        return "+OK\r\n"
+    case "GET":
+        if len(args) != 2 {
+            return wrongArgs(args[0])
+        }
+        e, ok := s.lookup(args[1])
+        if !ok {
+            return "$-1\r\n"
+        }
+        return bulk(e.value)
+    case "SET":
+        if len(args) != 3 && len(args) != 5 {
+            return wrongArgs(args[0])
+        }
+        e := entry{value: args[2]}
+        if len(args) == 5 {
+            ms, err := strconv.ParseInt(args[4], 10, 64)
+            if !strings.EqualFold(args[3], "PX") || err != nil || ms <= 0 {
+                return "-ERR syntax error\r\n"
+            }
+            e.expires = s.now.Add(time.Duration(ms) * time.Millisecond)
+        }
+        s.data[args[1]] = e
+        return "+OK\r\n"
+    case "DEL":
+        if len(args) < 2 {
+            return wrongArgs(args[0])
+        }
+        n := 0
+        for _, key := range args[1:] {
+            if _, ok := s.lookup(key); ok {
+                delete(s.data, key)
+                n++
+            }
+        }
+        return ":" + strconv.Itoa(n) + "\r\n"
+    case "EVAL":
+        // Only the client's compare-and-delete: EVAL script 1 key value
+        if len(args) != 5 || args[2] != "1" || !strings.Contains(args[1], `redis.call("DEL"`) {
+            return "-ERR unsupported script\r\n"
+        }
+        if e, ok := s.lookup(args[3]); ok && e.value == args[4] {
+            delete(s.data, args[3])
+            return ":1\r\n"
+        }
+        return ":0\r\n"
+    }
+    return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// lookup returns the live entry at key, dropping it once expired. Caller
+// must hold s.mu.
+func (s *Server) lookup(key string) (entry, bool) {
+    e, ok := s.data[key]
+    if ok && !e.expires.IsZero() && !s.now.Before(e.expires) {
+        delete(s.data, key)
+        return entry{}, false
+    }
+    return e, ok
+}
+
+// readCommand reads one command, an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+    n, err := readHeader(r, '*')
+    if err != nil {
+        return nil, err
+    }
+    if n < 1 {
+        return nil, fmt.Errorf("empty command")
+    }
+    args := make([]string, n)
+    for i := range args {
+        size, err := readHeader(r, '$')
+        if err != nil {
+            return nil, err
+        }
+        data := make([]byte, size+2)
+        if _, err := io.ReadFull(r, data); err != nil {
+            return nil, err
+        }
+        if string(data[size:]) != "\r\n" {
+            return nil, fmt.Errorf("bulk string not terminated by CRLF")
+        }
+        args[i] = string(data[:size])
+    }
+    return args, nil
+}
+
+func readHeader(r *bufio.Reader, kind byte) (int, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return 0, err
+    }
+    if len(line) < 4 || line[0] != kind || !strings.HasSuffix(line, "\r\n") {
+        return 0, fmt.Errorf("expected '%c', got %q", kind, line)
+    }
+    n, err := strconv.Atoi(line[1 : len(line)-2])
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("invalid length in %q", line)
+    }
+    return n, nil
+}
+
+func bulk(s string) string {
+    return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func wrongArgs(cmd string) string {
+    return fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(cmd))
+}
@@ -0,0 +1,152 @@
+// Call-state replication from a primary router to its warm standby.
+// Regenerate the Go code with `make proto`.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: replication.proto
+
+package replicationpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Replication_Stream_FullMethodName = "/s2.replication.v1.Replication/Stream"
+)
+
+// ReplicationClient is the client API for Replication service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReplicationClient interface {
+	// Stream carries one primary's call state: a hello, a snapshot of every
+	// in-flight call, then deltas and pings, numbered from 1 with no gaps.
+	// The standby acks each snapshot and ping with the sequence it has
+	// applied up to.
+	Stream(ctx context.Context, opts ...grpc.CallOption) (Replication_StreamClient, error)
+}
+
+type replicationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReplicationClient(cc grpc.ClientConnInterface) ReplicationClient {
+	return &replicationClient{cc}
+}
+
+func (c *replicationClient) Stream(ctx context.Context, opts ...grpc.CallOption) (Replication_StreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Replication_ServiceDesc.Streams[0], Replication_Stream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &replicationStreamClient{stream}
+	return x, nil
+}
+
+type Replication_StreamClient interface {
+	Send(*Delta) error
+	Recv() (*Ack, error)
+	grpc.ClientStream
+}
+
+type replicationStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *replicationStreamClient) Send(m *Delta) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *replicationStreamClient) Recv() (*Ack, error) {
+	m := new(Ack)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReplicationServer is the server API for Replication service.
+// All implementations must embed UnimplementedReplicationServer
+// for forward compatibility
+type ReplicationServer interface {
+	// Stream carries one primary's call state: a hello, a snapshot of every
+	// in-flight call, then deltas and pings, numbered from 1 with no gaps.
+	// The standby acks each snapshot and ping with the sequence it has
+	// applied up to.
+	Stream(Replication_StreamServer) error
+	mustEmbedUnimplementedReplicationServer()
+}
+
+// UnimplementedReplicationServer must be embedded to have forward compatible implementations.
+type UnimplementedReplicationServer struct {
+}
+
+func (UnimplementedReplicationServer) Stream(Replication_StreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedReplicationServer) mustEmbedUnimplementedReplicationServer() {}
+
+// UnsafeReplicationServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReplicationServer will
+// result in compilation errors.
+type UnsafeReplicationServer interface {
+	mustEmbedUnimplementedReplicationServer()
+}
+
+func RegisterReplicationServer(s grpc.ServiceRegistrar, srv ReplicationServer) {
+	s.RegisterService(&Replication_ServiceDesc, srv)
+}
+
+func _Replication_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ReplicationServer).Stream(&replicationStreamServer{stream})
+}
+
+type Replication_StreamServer interface {
+	Send(*Ack) error
+	Recv() (*Delta, error)
+	grpc.ServerStream
+}
+
+type replicationStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *replicationStreamServer) Send(m *Ack) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *replicationStreamServer) Recv() (*Delta, error) {
+	m := new(Delta)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Replication_ServiceDesc is the grpc.ServiceDesc for Replication service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Replication_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "s2.replication.v1.Replication",
+	HandlerType: (*ReplicationServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _Replication_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "replication.proto",
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// A return leg whose ANI-2 is not the call's DNIS-1 did not come back the
+// way S2 sent it: S3 rewrote the caller ID, or someone is dialling the DID
+// directly. By default this is only logged. In strict mode the leg is
+// refused with ErrANIMismatch and the call stays with S3 until it returns
+// properly or goes stale. Either way, ANIMismatchQuarantine keeps the DID
+// out of the pool for a while once the call releases it, so a number that
+// is being dialled from outside is not handed straight to the next call.
+const (
+    ANIMismatchWarn   = "warn"
+    ANIMismatchStrict = "strict"
+)
+
+// ErrANIMismatch is returned in strict mode for a return leg whose ANI-2
+// does not match the original DNIS-1
+var ErrANIMismatch = errors.New("ANI-2 does not match the original DNIS")
+
+var aniMismatches = metrics.NewCounter("s2_ani_mismatch_total",
+    "Return legs whose ANI-2 did not match the original DNIS, by action taken", "action")
+
+// QuarantinedDID is a DID kept out of the pool after an ANI mismatch
+type QuarantinedDID struct {
+    DID    string    `json:"did"`
+    Until  time.Time `json:"until"`
+    Reason string    `json:"reason"`
+    InUse  bool      `json:"in_use"`
+}
+
+// checkReturnANI applies the mismatch policy to a return leg. Caller must
+// hold r.mu.
+func (r *Router) checkReturnANI(ctx context.Context, record *models.CallRecord, ani2, did string) error {
+    if r.formats.same(record.OriginalDNIS, ani2) {
+        return nil
+    }
+    clog := callLogger(ctx, record)
+    strict := r.config.ANIMismatchMode == ANIMismatchStrict
+    action := "warned"
+    if strict {
+        action = "rejected"
+    }
+    aniMismatches.Inc(action)
+    clog.Warnf("ANI mismatch - expected %s, got %s (%s)", record.OriginalDNIS, ani2, action)
+    r.recordCallEvent(ctx, record.CallID, models.CallEventANIMismatch, r.clock.Now(),
+        "expected="+record.OriginalDNIS+" ani2="+ani2+" did="+did+" action="+action)
+
+    if r.config.ANIMismatchQuarantine > 0 {
+        reason := "ANI mismatch on call " + record.CallID + ": expected " + record.OriginalDNIS + ", got " + ani2
+        if err := r.quarantineDID(ctx, record.AssignedDID, r.config.ANIMismatchQuarantine, reason); err != nil {
+            clog.Errorf("Failed to quarantine DID %s: %v", record.AssignedDID, err)
+        } else {
+            clog.Warnf("Quarantined DID %s for %s", record.AssignedDID, r.config.ANIMismatchQuarantine)
+        }
+    }
+
+    if strict {
+        return ErrANIMismatch
+    }
+    return nil
+}
+
+// quarantineDID keeps did from being picked for d, measured on the
+// database clock like the release cooldown
+func (r *Router) quarantineDID(ctx context.Context, did string, d time.Duration, reason string) error {
+    if len(reason) > 255 {
+        reason = reason[:255]
+    }
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, `
+        UPDATE dids
+        SET quarantined_until = NOW(3) + INTERVAL ? MICROSECOND, quarantine_reason = ?
+        WHERE did = ?
+    `, d.Microseconds(), reason, did)
+    return err
+}
+
+// QuarantinedDIDs lists the DIDs still in quarantine, soonest released first
+func (r *Router) QuarantinedDIDs(ctx context.Context) ([]QuarantinedDID, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT did, quarantined_until, COALESCE(quarantine_reason, ''), in_use
+        FROM dids
+        WHERE quarantined_until > NOW(3)
+        ORDER BY quarantined_until, did
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []QuarantinedDID{}
+    for rows.Next() {
+        var q QuarantinedDID
+        if err := rows.Scan(&q.DID, &q.Until, &q.Reason, &q.InUse); err != nil {
+            return nil, err
+        }
+        list = append(list, q)
+    }
+    return list, rows.Err()
+}
+
+// LiftQuarantine returns did to the pool; false if it was not in quarantine
+func (r *Router) LiftQuarantine(ctx context.Context, did string) (bool, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, `
+        UPDATE dids
+        SET quarantined_until = NULL, quarantine_reason = NULL
+        WHERE did = ? AND quarantined_until > NOW(3)
+    `, did)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    if n > 0 {
+        logger.Context(ctx).Infof("Lifted quarantine of DID %s", did)
+    }
+    return n > 0, err
+}
@@ -0,0 +1,236 @@
+package router
+
+import (
+    "context"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+// With ArchiveAfter set, call_records stops growing without bound: every
+// ArchiveInterval the primary moves closed records that started longer
+// ago than that into call_records_archive, ArchiveBatch rows per
+// transaction so the locks it takes stay short, and with ArchiveRetention
+// set deletes archived rows past it. A run stops after archiveMaxBatches
+// batches and reports what it left as the backlog for the next one. A
+// call's events, notes and recording metadata stay where they are: looking
+// up one call, its tags or notes falls back to the archive, and they are
+// deleted along with the archived record. History, exports and reports
+// read call_records only, so ArchiveAfter should be longer than they look
+// back.
+const (
+    archiveMaxBatches   = 200
+    archiveBatchTimeout = time.Minute // one batch's statements, longer than a query on the call path
+    archiveClosed       = `'COMPLETED_AT_S4', 'FAILED'`
+)
+
+// archiveColumns are copied as they are; the archive adds archived_at
+const archiveColumns = `id, call_id, original_ani, original_dnis, assigned_did, status, start_time, end_time,
+    duration, recording_path, match_token, settlement_class, tags, campaign_id, forward_trunk, tenant_id,
+    trace_parent, hangup_cause, dest_country, dest_region, dest_type, updated_at`
+
+var (
+    archiveRows = metrics.NewCounter("s2_archive_rows_total",
+        "Call records moved to call_records_archive, or deleted from it past retention", "action")
+    archiveBacklog = metrics.NewGauge("s2_archive_backlog",
+        "Closed call records past the archive age left for the next archiver run")
+    archiveRunSeconds = metrics.NewGauge("s2_archive_last_run_seconds",
+        "How long the last archiver run took")
+)
+
+// ArchiveStatus describes the archiver's last run
+type ArchiveStatus struct {
+    LastRun   time.Time `json:"last_run"`
+    Duration  string    `json:"duration"`
+    Archived  int       `json:"archived"`
+    Purged    int       `json:"purged"`
+    Backlog   int64     `json:"backlog"`
+    Total     int64     `json:"total_archived"`
+    LastError string    `json:"last_error,omitempty"`
+}
+
+type archiveState struct {
+    mu     sync.Mutex
+    status ArchiveStatus
+}
+
+// archiveCallRecords is one archiver run
+func (r *Router) archiveCallRecords() error {
+    started := r.clock.Now()
+    cutoff := started.Add(-r.config.ArchiveAfter)
+    run := ArchiveStatus{LastRun: started}
+
+    err := r.archiveBatches(func() (int, error) { return r.archiveBatch(cutoff) }, &run.Archived)
+    if err == nil && r.config.ArchiveRetention > 0 {
+        purgeBefore := started.Add(-r.config.ArchiveRetention)
+        err = r.archiveBatches(func() (int, error) { return r.purgeArchiveBatch(purgeBefore) }, &run.Purged)
+    }
+    if err == nil && run.Archived >= archiveMaxBatches*r.config.ArchiveBatch {
+        ctx, cancel := r.dbContext(context.Background())
+        err = r.db.QueryRowContext(ctx, `
+            SELECT COUNT(*) FROM call_records
+            WHERE start_time < ? AND end_time IS NOT NULL AND status IN (`+archiveClosed+`)
+        `, cutoff).Scan(&run.Backlog)
+        cancel()
+    }
+
+    took := r.since(started)
+    run.Duration = took.Round(time.Millisecond).String()
+    archiveRunSeconds.Set(took.Seconds())
+    archiveBacklog.Set(float64(run.Backlog))
+    if err != nil {
+        run.LastError = err.Error()
+        logger.Errorf("Call record archiver failed after archiving %d and purging %d: %v", run.Archived, run.Purged, err)
+    } else if run.Archived > 0 || run.Purged > 0 {
+        logger.Infof("Archived %d call records older than %s, purged %d archived ones, %d left, in %s",
+            run.Archived, r.config.ArchiveAfter, run.Purged, run.Backlog, run.Duration)
+    }
+
+    a := &r.archive
+    a.mu.Lock()
+    run.Total = a.status.Total + int64(run.Archived)
+    a.status = run
+    a.mu.Unlock()
+    return err
+}
+
+// archiveBatches runs batch until it comes back short or the run's cap,
+// adding the rows it handled to n
+func (r *Router) archiveBatches(batch func() (int, error), n *int) error {
+    for i := 0; i < archiveMaxBatches; i++ {
+        rows, err := batch()
+        *n += rows
+        if err != nil || rows < r.config.ArchiveBatch {
+            return err
+        }
+    }
+    return nil
+}
+
+// archiveBatch moves one batch of closed records started before cutoff,
+// copy and delete in one transaction
+func (r *Router) archiveBatch(cutoff time.Time) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), archiveBatchTimeout)
+    defer cancel()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, `
+        SELECT id FROM call_records
+        WHERE start_time < ? AND end_time IS NOT NULL AND status IN (`+archiveClosed+`)
+        ORDER BY start_time
+        LIMIT ?
+        FOR UPDATE
+    `, cutoff, r.config.ArchiveBatch)
+    if err != nil {
+        return 0, err
+    }
+    var ids []interface{}
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    if len(ids) == 0 {
+        return 0, nil
+    }
+
+    in := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+    if _, err := tx.ExecContext(ctx, "INSERT INTO call_records_archive ("+archiveColumns+")"+
+        " SELECT "+archiveColumns+" FROM call_records WHERE id IN "+in, ids...); err != nil {
+        return 0, err
+    }
+    if _, err := tx.ExecContext(ctx, "DELETE FROM call_records WHERE id IN "+in, ids...); err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+    archiveRows.Add(float64(len(ids)), "archived")
+    return len(ids), nil
+}
+
+// purgeArchiveBatch deletes one batch of archived records started before
+// the retention cutoff, with their events, notes and recording metadata,
+// in one transaction
+func (r *Router) purgeArchiveBatch(before time.Time) (int, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), archiveBatchTimeout)
+    defer cancel()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, `
+        SELECT id, call_id FROM call_records_archive
+        WHERE start_time < ?
+        ORDER BY start_time
+        LIMIT ?
+        FOR UPDATE
+    `, before, r.config.ArchiveBatch)
+    if err != nil {
+        return 0, err
+    }
+    var ids, callIDs []interface{}
+    for rows.Next() {
+        var id int64
+        var callID string
+        if err := rows.Scan(&id, &callID); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        ids = append(ids, id)
+        callIDs = append(callIDs, callID)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    if len(ids) == 0 {
+        return 0, nil
+    }
+
+    in := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+    for _, query := range []string{
+        "DELETE FROM call_events WHERE call_id IN " + in,
+        "DELETE FROM notes WHERE subject_type = '" + NoteCall + "' AND subject_id IN " + in,
+        "DELETE FROM recordings WHERE call_id IN " + in,
+    } {
+        if _, err := tx.ExecContext(ctx, query, callIDs...); err != nil {
+            return 0, err
+        }
+    }
+    if _, err := tx.ExecContext(ctx, "DELETE FROM call_records_archive WHERE id IN "+in, ids...); err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+    archiveRows.Add(float64(len(ids)), "purged")
+    return len(ids), nil
+}
+
+// ArchiveStatus reports the archiver's last run, nil when it is off
+func (r *Router) ArchiveStatus() *ArchiveStatus {
+    if r.config.ArchiveAfter <= 0 || r.config.ReadOnly {
+        return nil
+    }
+    a := &r.archive
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    status := a.status
+    return &status
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+    "context"
+    "database/sql/driver"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+)
+
+// Purging archived records takes their events, notes and recording
+// metadata with them, in the same transaction
+func TestPurgeDeletesDependentRows(t *testing.T) {
+    db, log := openRecordingDB(t)
+    log.answer("FROM call_records_archive", []string{"id", "call_id"},
+        []driver.Value{int64(1), "call-a"}, []driver.Value{int64(2), "call-b"})
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    r, err := newRouter(db, newFakeStorage(), Config{Clock: fake})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.life.Stop()
+
+    n, err := r.purgeArchiveBatch(fake.Now().AddDate(0, 0, -90))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n != 2 {
+        t.Fatalf("purged %d records, want 2", n)
+    }
+
+    var got []string
+    for _, q := range log.take() {
+        fields := strings.Fields(q.query)
+        if len(fields) > 3 {
+            fields = fields[:3]
+        }
+        got = append(got, fmt.Sprintf("%s %v", strings.Join(fields, " "), q.args))
+    }
+    want := []string{
+        "BEGIN []",
+        fmt.Sprintf("SELECT id, call_id [%v 5000]", fake.Now().AddDate(0, 0, -90)),
+        "DELETE FROM call_events [call-a call-b]",
+        "DELETE FROM notes [call-a call-b]",
+        "DELETE FROM recordings [call-a call-b]",
+        "DELETE FROM call_records_archive [1 2]",
+        "COMMIT []",
+    }
+    if strings.Join(got, "\n") != strings.Join(want, "\n") {
+        t.Fatalf("purge ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+    }
+}
+
+// A call moved to the archive is still found by call lookups
+func TestCallDetailFallsBackToArchive(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    s, log := newRecordingStorage(t, 0, fake)
+    start := fake.Now().AddDate(0, 0, -60)
+    log.answer("FROM call_records_archive", []string{
+        "call_id", "original_ani", "original_dnis", "assigned_did", "status", "start_time", "end_time", "duration",
+        "hangup_cause", "settlement_class", "campaign_id", "tenant_id", "forward_trunk", "tags",
+        "match_token", "recording_path", "trace_parent",
+    }, []driver.Value{
+        "archived-1", "12125550001", "442070000001", "15550000000", "COMPLETED_AT_S4", start, start.Add(time.Minute), int64(60),
+        "16", "", "", "", "trunk-s3", nil,
+        "", "", "",
+    })
+
+    d, err := s.CallDetail(context.Background(), "archived-1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d == nil || d.CallID != "archived-1" || d.Duration != 60 {
+        t.Fatalf("archived call looked up as %+v", d)
+    }
+    queries := log.take()
+    if len(queries) != 2 || strings.Contains(queries[0].query, "call_records_archive") {
+        t.Fatalf("lookup ran %d queries, want call_records then the archive", len(queries))
+    }
+}
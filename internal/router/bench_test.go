@@ -0,0 +1,109 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "runtime"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// The benchmarks hang every call up off the clock so that the pool never
+// runs dry, and measure only the call path under test
+
+func BenchmarkProcessIncomingCall(b *testing.B) {
+    r := newTestRouter(b, newFakeStorage(fakeDIDs(64)...), Config{})
+    ctx := context.Background()
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        callID := fmt.Sprintf("bench-%d", i)
+        if _, err := r.ProcessIncomingCall(ctx, callID, fmt.Sprintf("1212%07d", i), fmt.Sprintf("4420%07d", i), IncomingOptions{}); err != nil {
+            b.Fatal(err)
+        }
+        b.StopTimer()
+        if _, err := r.CompleteCall(ctx, callID, "16"); err != nil {
+            b.Fatal(err)
+        }
+        b.StartTimer()
+    }
+}
+
+func BenchmarkProcessReturnCall(b *testing.B) {
+    r := newTestRouter(b, newFakeStorage(fakeDIDs(64)...), Config{})
+    ctx := context.Background()
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        b.StopTimer()
+        callID := fmt.Sprintf("bench-%d", i)
+        dnis := fmt.Sprintf("4420%07d", i)
+        resp, err := r.ProcessIncomingCall(ctx, callID, fmt.Sprintf("1212%07d", i), dnis, IncomingOptions{})
+        if err != nil {
+            b.Fatal(err)
+        }
+        b.StartTimer()
+        if _, err := r.ProcessReturnCall(ctx, dnis, resp.DIDAssigned, ReturnOptions{}); err != nil {
+            b.Fatal(err)
+        }
+        b.StopTimer()
+        if _, err := r.CompleteCall(ctx, callID, "16"); err != nil {
+            b.Fatal(err)
+        }
+        b.StartTimer()
+    }
+}
+
+// benchConcurrency is the number of calls BenchmarkCallParallel keeps in
+// flight at once
+const benchConcurrency = 500
+
+// About benchConcurrency calls at once, the whole way from arrival to
+// hangup, to show what r.mu costs when it is contended. With a storage
+// latency the calls overlap their round trips only as far as the router
+// keeps them outside its lock.
+func BenchmarkCallParallel(b *testing.B) {
+    for _, latency := range []time.Duration{0, 200 * time.Microsecond, time.Millisecond} {
+        b.Run(fmt.Sprintf("latency=%s", latency), func(b *testing.B) {
+            store := newFakeStorage(fakeDIDs(2 * benchConcurrency)...)
+            store.setLatency(latency)
+            store.spread.Store(true)
+            r := newTestRouter(b, store, Config{})
+            ctx := context.Background()
+            var next, completed atomic.Int64
+            // RunParallel starts parallelism x GOMAXPROCS goroutines
+            procs := runtime.GOMAXPROCS(0)
+            b.SetParallelism((benchConcurrency + procs - 1) / procs)
+            b.ReportAllocs()
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                for pb.Next() {
+                    i := next.Add(1)
+                    callID := fmt.Sprintf("bench-%d", i)
+                    dnis := fmt.Sprintf("4420%07d", i)
+                    resp, err := r.ProcessIncomingCall(ctx, callID, fmt.Sprintf("1212%07d", i), dnis, IncomingOptions{})
+                    if errors.Is(err, ErrNoAvailableDIDs) {
+                        continue
+                    }
+                    if err != nil {
+                        b.Error(err)
+                        return
+                    }
+                    if _, err := r.ProcessReturnCall(ctx, dnis, resp.DIDAssigned, ReturnOptions{}); err != nil {
+                        b.Error(err)
+                        return
+                    }
+                    if _, err := r.CompleteCall(ctx, callID, "16"); err != nil {
+                        b.Error(err)
+                        return
+                    }
+                    completed.Add(1)
+                }
+            })
+            b.ReportMetric(float64(completed.Load())/b.Elapsed().Seconds(), "calls/s")
+            b.ReportMetric(float64(int64(b.N)-completed.Load())/float64(b.N), "refused/op")
+        })
+    }
+}
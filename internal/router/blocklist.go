@@ -0,0 +1,644 @@
+package router
+
+import (
+    "bufio"
+    "context"
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// The blocklist refuses calls from listed A-numbers. Entries come from
+// operators (source "manual") and from feeds: CSV or plain text lists
+// fetched over HTTP on a schedule, or DNSBL-style zones queried per call.
+// Every source has its own TTL; feed entries are refreshed on each fetch,
+// so numbers dropped from a feed age out once their TTL passes.
+//
+// When sources disagree about a number, manual entries win, then the feed
+// with the highest priority. On a tie between feeds, block beats allow.
+const (
+    BlocklistManual = "manual"
+
+    BlockAction = "block"
+    AllowAction = "allow"
+
+    FeedCSV   = "csv"   // number[,reason] per row
+    FeedText  = "text"  // one number per line
+    FeedDNSBL = "dnsbl" // URL is a zone; listed when <reversed digits>.<zone> resolves
+
+    maxBlocklistFeedBytes = 256 << 20
+    maxBlocklistNumberLen = 32
+    blocklistBatchSize    = 500
+    dnsblTimeout          = 300 * time.Millisecond
+
+    // Manual entries outrank every feed priority
+    manualRank = int(^uint(0) >> 1)
+)
+
+// ErrBlockedCaller is returned for calls from a blocklisted A-number
+var ErrBlockedCaller = errors.New("caller is blocklisted")
+
+var (
+    blocklistRejected = metrics.NewCounter("s2_blocklist_rejected_total",
+        "Incoming calls refused by the blocklist by source", "source")
+    blocklistEntries = metrics.NewGauge("s2_blocklist_entries",
+        "Numbers the blocklist currently refuses")
+)
+
+var blocklistClient = &http.Client{Timeout: 2 * time.Minute}
+
+// blocklistHit is the winning entry for a number
+type blocklistHit struct {
+    rank   int
+    action string
+    source string
+    reason string
+}
+
+// blocklistCache holds the resolved static entries and cached DNSBL answers
+type blocklistCache struct {
+    mu      sync.RWMutex
+    numbers map[string]blocklistHit // resolved from the blocklist table
+    dnsbl   []models.BlocklistFeed  // enabled DNSBL feeds, highest priority first
+    lookups map[string]dnsblAnswer  // feed|number -> answer
+}
+
+type dnsblAnswer struct {
+    listed  bool
+    expires time.Time
+}
+
+// blocklistNumber reduces a number to its digits so +1555..., 1555... and
+// 1-555-... match the same entry
+func blocklistNumber(number string) string {
+    var b strings.Builder
+    for _, c := range number {
+        if c >= '0' && c <= '9' {
+            b.WriteRune(c)
+        }
+    }
+    return b.String()
+}
+
+func validBlocklistNumber(number string) bool {
+    return len(number) >= 3 && len(number) <= maxBlocklistNumberLen
+}
+
+// wins reports whether a hit takes precedence over the current winner
+func (h blocklistHit) wins(over blocklistHit, found bool) bool {
+    if !found || h.rank > over.rank {
+        return true
+    }
+    return h.rank == over.rank && h.action == BlockAction && over.action != BlockAction
+}
+
+// checkBlocklist refuses the call if its A-number is blocklisted
+func (r *Router) checkBlocklist(callID, ani, dnis string) error {
+    hit, blocked := r.blocklistVerdict(ani)
+    if !blocked {
+        return nil
+    }
+    blocklistRejected.Inc(hit.source)
+    logger.Call(callID, "", ani).Warnf("Rejecting call %s: ANI %s blocklisted by %s (%s)", callID, ani, hit.source, hit.reason)
+    r.publish(models.Event{
+        Type:   "call.blocked",
+        CallID: callID,
+        ANI:    ani,
+        DNIS:   dnis,
+        Detail: strings.TrimSpace(hit.source + " " + hit.reason),
+    })
+    return fmt.Errorf("%w: %s by %s", ErrBlockedCaller, ani, hit.source)
+}
+
+// blocklistVerdict resolves the static entries and DNSBL feeds for a number
+func (r *Router) blocklistVerdict(ani string) (blocklistHit, bool) {
+    number := blocklistNumber(ani)
+    if number == "" {
+        return blocklistHit{}, false
+    }
+    c := &r.blocklist
+    c.mu.RLock()
+    hit, found := c.numbers[number]
+    feeds := c.dnsbl
+    c.mu.RUnlock()
+
+    for _, feed := range feeds {
+        candidate := blocklistHit{rank: feed.Priority, action: feed.Action, source: feed.Name, reason: "listed in " + feed.URL}
+        if !candidate.wins(hit, found) {
+            // Feeds are sorted, so no later one can win either
+            break
+        }
+        if r.dnsblListed(feed, number) {
+            hit, found = candidate, true
+        }
+    }
+    return hit, found && hit.action == BlockAction
+}
+
+// dnsblListed asks a DNSBL zone about a number, caching the answer for the
+// feed's TTL. Lookup failures count as not listed.
+func (r *Router) dnsblListed(feed models.BlocklistFeed, number string) bool {
+    key := feed.Name + "|" + number
+    now := r.clock.Now()
+    c := &r.blocklist
+    c.mu.RLock()
+    answer, ok := c.lookups[key]
+    c.mu.RUnlock()
+    if ok && now.Before(answer.expires) {
+        return answer.listed
+    }
+
+    labels := make([]string, len(number))
+    for i := range number {
+        labels[len(number)-1-i] = number[i : i+1]
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), dnsblTimeout)
+    defer cancel()
+    addrs, err := net.DefaultResolver.LookupHost(ctx, strings.Join(labels, ".")+"."+feed.URL)
+    var dnsErr *net.DNSError
+    if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+        logger.Warnf("DNSBL %s lookup for %s failed: %v", feed.Name, number, err)
+        return false
+    }
+    answer = dnsblAnswer{listed: len(addrs) > 0, expires: now.Add(time.Duration(feed.TTL) * time.Second)}
+
+    c.mu.Lock()
+    c.lookups[key] = answer
+    c.mu.Unlock()
+    return answer.listed
+}
+
+// loadBlocklist rebuilds the resolved entries and the DNSBL feed list
+func (r *Router) loadBlocklist() error {
+    feeds, err := r.BlocklistFeeds(context.Background())
+    if err != nil {
+        logger.Errorf("Error loading blocklist feeds: %v", err)
+        return err
+    }
+    ranks := map[string]int{BlocklistManual: manualRank}
+    var dnsbl []models.BlocklistFeed
+    for _, feed := range feeds {
+        if !feed.Enabled {
+            continue
+        }
+        ranks[feed.Name] = feed.Priority
+        if feed.Format == FeedDNSBL {
+            dnsbl = append(dnsbl, feed)
+        }
+    }
+    sort.SliceStable(dnsbl, func(i, j int) bool { return dnsbl[i].Priority > dnsbl[j].Priority })
+
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT number, source, action, COALESCE(reason, '')
+        FROM blocklist
+        WHERE expires_at IS NULL OR expires_at > ?
+    `, r.clock.Now())
+    if err != nil {
+        logger.Errorf("Error loading blocklist: %v", err)
+        return err
+    }
+    defer rows.Close()
+
+    numbers := make(map[string]blocklistHit)
+    for rows.Next() {
+        var number string
+        var hit blocklistHit
+        if err := rows.Scan(&number, &hit.source, &hit.action, &hit.reason); err != nil {
+            return err
+        }
+        rank, ok := ranks[hit.source]
+        if !ok {
+            // Entries of a disabled feed
+            continue
+        }
+        hit.rank = rank
+        if current, found := numbers[number]; hit.wins(current, found) {
+            numbers[number] = hit
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    blocked := 0
+    for number, hit := range numbers {
+        if hit.action == BlockAction {
+            blocked++
+        } else if len(dnsbl) == 0 {
+            // An allow only matters to override a feed
+            delete(numbers, number)
+        }
+    }
+    blocklistEntries.Set(float64(blocked))
+
+    now := r.clock.Now()
+    c := &r.blocklist
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.numbers = numbers
+    c.dnsbl = dnsbl
+    for key, answer := range c.lookups {
+        if !now.Before(answer.expires) {
+            delete(c.lookups, key)
+        }
+    }
+    return nil
+}
+
+// BlocklistEntries lists entries, optionally for one source or number
+func (r *Router) BlocklistEntries(ctx context.Context, source, number string, limit int) ([]models.BlocklistEntry, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    number = blocklistNumber(number)
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT number, source, action, COALESCE(reason, ''), expires_at, updated_at
+        FROM blocklist
+        WHERE (? = '' OR source = ?) AND (? = '' OR number = ?)
+        AND (expires_at IS NULL OR expires_at > ?)
+        ORDER BY number, source
+        LIMIT ?
+    `, source, source, number, number, r.clock.Now(), limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.BlocklistEntry{}
+    for rows.Next() {
+        var e models.BlocklistEntry
+        if err := rows.Scan(&e.Number, &e.Source, &e.Action, &e.Reason, &e.ExpiresAt, &e.UpdatedAt); err != nil {
+            return nil, err
+        }
+        list = append(list, e)
+    }
+    return list, rows.Err()
+}
+
+// BlocklistCheck reports how the blocklist resolves a number and every
+// entry that was considered
+func (r *Router) BlocklistCheck(ctx context.Context, number string) (*models.BlocklistVerdict, error) {
+    entries, err := r.BlocklistEntries(ctx, "", number, 1000)
+    if err != nil {
+        return nil, err
+    }
+    verdict := &models.BlocklistVerdict{Number: blocklistNumber(number), Action: AllowAction, Entries: entries}
+    if hit, ok := r.blocklistVerdict(number); ok {
+        verdict.Action, verdict.Source, verdict.Reason = hit.action, hit.source, hit.reason
+    }
+    return verdict, nil
+}
+
+// SetBlocklistEntry adds or replaces a manual entry. A zero ttl never expires.
+func (r *Router) SetBlocklistEntry(ctx context.Context, e models.BlocklistEntry, ttl time.Duration) (*models.BlocklistEntry, error) {
+    if r.config.ReadOnly {
+        return nil, ErrReadOnly
+    }
+    e.Number = blocklistNumber(e.Number)
+    if !validBlocklistNumber(e.Number) {
+        return nil, fmt.Errorf("number must have 3-%d digits", maxBlocklistNumberLen)
+    }
+    if e.Action == "" {
+        e.Action = BlockAction
+    }
+    if e.Action != BlockAction && e.Action != AllowAction {
+        return nil, fmt.Errorf("action must be %s or %s", BlockAction, AllowAction)
+    }
+    if len(e.Reason) > 255 {
+        return nil, fmt.Errorf("reason must be at most 255 characters")
+    }
+    if ttl < 0 {
+        return nil, fmt.Errorf("ttl must not be negative")
+    }
+    e.Source = BlocklistManual
+    e.UpdatedAt = r.clock.Now()
+    e.ExpiresAt = nil
+    if ttl > 0 {
+        expires := e.UpdatedAt.Add(ttl)
+        e.ExpiresAt = &expires
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, `
+        INSERT INTO blocklist (number, source, action, reason, expires_at)
+        VALUES (?, ?, ?, NULLIF(?, ''), ?)
+        ON DUPLICATE KEY UPDATE action = VALUES(action), reason = VALUES(reason), expires_at = VALUES(expires_at)
+    `, e.Number, e.Source, e.Action, e.Reason, e.ExpiresAt)
+    if err != nil {
+        return nil, err
+    }
+    r.loadBlocklist()
+    return &e, nil
+}
+
+// DeleteBlocklistEntry removes a manual entry; feed entries go with their feed
+func (r *Router) DeleteBlocklistEntry(ctx context.Context, number string) error {
+    if r.config.ReadOnly {
+        return ErrReadOnly
+    }
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM blocklist WHERE number = ? AND source = ?",
+        blocklistNumber(number), BlocklistManual)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("no manual blocklist entry for %s", number)
+    }
+    r.loadBlocklist()
+    return nil
+}
+
+// BlocklistFeeds lists configured feeds with their last fetch
+func (r *Router) BlocklistFeeds(ctx context.Context) ([]models.BlocklistFeed, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT name, url, format, action, ttl, fetch_interval, priority, enabled,
+            last_fetch, COALESCE(last_error, ''), entries, updated_at
+        FROM blocklist_feeds
+        ORDER BY name
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.BlocklistFeed{}
+    for rows.Next() {
+        var f models.BlocklistFeed
+        if err := rows.Scan(&f.Name, &f.URL, &f.Format, &f.Action, &f.TTL, &f.Interval, &f.Priority, &f.Enabled,
+            &f.LastFetch, &f.LastError, &f.Entries, &f.UpdatedAt); err != nil {
+            return nil, err
+        }
+        list = append(list, f)
+    }
+    return list, rows.Err()
+}
+
+// SetBlocklistFeed creates or updates a feed; it is fetched on the next run
+func (r *Router) SetBlocklistFeed(ctx context.Context, f models.BlocklistFeed) (*models.BlocklistFeed, error) {
+    if r.config.ReadOnly {
+        return nil, ErrReadOnly
+    }
+    if f.Name == "" || len(f.Name) > 64 || f.Name == BlocklistManual {
+        return nil, fmt.Errorf("name must be 1-64 characters and not %q", BlocklistManual)
+    }
+    switch f.Format {
+    case FeedCSV, FeedText:
+        if !strings.HasPrefix(f.URL, "http://") && !strings.HasPrefix(f.URL, "https://") {
+            return nil, fmt.Errorf("%s feeds need an http(s) URL", f.Format)
+        }
+    case FeedDNSBL:
+        if f.URL == "" || strings.Contains(f.URL, "/") {
+            return nil, fmt.Errorf("dnsbl feeds need a DNS zone as URL")
+        }
+    default:
+        return nil, fmt.Errorf("format must be %s, %s or %s", FeedCSV, FeedText, FeedDNSBL)
+    }
+    if f.Action == "" {
+        f.Action = BlockAction
+    }
+    if f.Action != BlockAction && f.Action != AllowAction {
+        return nil, fmt.Errorf("action must be %s or %s", BlockAction, AllowAction)
+    }
+    if f.Interval <= 0 {
+        f.Interval = 3600
+    }
+    if f.TTL <= 0 {
+        f.TTL = 7 * 24 * 3600
+    }
+    if f.Format != FeedDNSBL && f.TTL < f.Interval {
+        return nil, fmt.Errorf("ttl must be at least the interval, or entries expire between fetches")
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, `
+        INSERT INTO blocklist_feeds (name, url, format, action, ttl, fetch_interval, priority, enabled)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE url = VALUES(url), format = VALUES(format), action = VALUES(action), ttl = VALUES(ttl),
+            fetch_interval = VALUES(fetch_interval), priority = VALUES(priority), enabled = VALUES(enabled)
+    `, f.Name, f.URL, f.Format, f.Action, f.TTL, f.Interval, f.Priority, f.Enabled)
+    if err != nil {
+        return nil, err
+    }
+
+    f.UpdatedAt = r.clock.Now()
+    r.loadBlocklist()
+    return &f, nil
+}
+
+// DeleteBlocklistFeed removes a feed and the entries it imported
+func (r *Router) DeleteBlocklistFeed(ctx context.Context, name string) error {
+    if r.config.ReadOnly {
+        return ErrReadOnly
+    }
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM blocklist_feeds WHERE name = ?", name)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("blocklist feed %s not found", name)
+    }
+    if _, err := r.db.ExecContext(ctx, "DELETE FROM blocklist WHERE source = ?", name); err != nil {
+        return err
+    }
+    r.loadBlocklist()
+    return nil
+}
+
+// RefreshBlocklistFeed fetches one feed now
+func (r *Router) RefreshBlocklistFeed(ctx context.Context, name string) (*models.BlocklistFeed, error) {
+    if r.config.ReadOnly {
+        return nil, ErrReadOnly
+    }
+    feeds, err := r.BlocklistFeeds(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for _, feed := range feeds {
+        if feed.Name != name {
+            continue
+        }
+        if feed.Format == FeedDNSBL {
+            return nil, fmt.Errorf("dnsbl feeds are queried per call, not fetched")
+        }
+        r.fetchBlocklistFeed(ctx, &feed)
+        r.loadBlocklist()
+        return &feed, nil
+    }
+    return nil, fmt.Errorf("blocklist feed %s not found", name)
+}
+
+// refreshBlocklistFeeds fetches every list feed that is due and drops
+// expired entries
+func (r *Router) refreshBlocklistFeeds() error {
+    ctx := context.Background()
+    feeds, err := r.BlocklistFeeds(ctx)
+    if err != nil {
+        return err
+    }
+    now := r.clock.Now()
+    fetched := false
+    for i := range feeds {
+        feed := &feeds[i]
+        if !feed.Enabled || feed.Format == FeedDNSBL {
+            continue
+        }
+        if feed.LastFetch != nil && now.Sub(*feed.LastFetch) < time.Duration(feed.Interval)*time.Second {
+            continue
+        }
+        r.fetchBlocklistFeed(ctx, feed)
+        fetched = true
+    }
+
+    if _, err := r.backgroundExec("DELETE FROM blocklist WHERE expires_at < ? LIMIT 10000", now); err != nil {
+        return err
+    }
+    if fetched {
+        return r.loadBlocklist()
+    }
+    return nil
+}
+
+// fetchBlocklistFeed imports one list feed and records the outcome on it
+func (r *Router) fetchBlocklistFeed(ctx context.Context, feed *models.BlocklistFeed) {
+    imported, err := r.importBlocklistFeed(ctx, feed)
+    now := r.clock.Now()
+    feed.LastFetch, feed.LastError = &now, ""
+    if err != nil {
+        feed.LastError = err.Error()
+        if len(feed.LastError) > 255 {
+            feed.LastError = feed.LastError[:255]
+        }
+        logger.Warnf("Blocklist feed %s failed: %v", feed.Name, err)
+    } else {
+        feed.Entries = imported
+        logger.Infof("Blocklist feed %s imported %d numbers", feed.Name, imported)
+    }
+    if _, err := r.backgroundExec(`
+        UPDATE blocklist_feeds SET last_fetch = ?, last_error = NULLIF(?, ''), entries = ? WHERE name = ?
+    `, now, feed.LastError, feed.Entries, feed.Name); err != nil {
+        logger.Errorf("Error saving blocklist feed %s: %v", feed.Name, err)
+    }
+}
+
+// importBlocklistFeed downloads a feed and upserts its numbers with the
+// feed's TTL. A failed download keeps the previous entries until they expire.
+func (r *Router) importBlocklistFeed(ctx context.Context, feed *models.BlocklistFeed) (int, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.URL, nil)
+    if err != nil {
+        return 0, err
+    }
+    resp, err := blocklistClient.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("feed returned %s", resp.Status)
+    }
+
+    expires := r.clock.Now().Add(time.Duration(feed.TTL) * time.Second)
+    type entry struct{ number, reason string }
+    var batch []entry
+    imported := 0
+    flush := func() error {
+        if len(batch) == 0 {
+            return nil
+        }
+        args := make([]interface{}, 0, 5*len(batch))
+        for _, e := range batch {
+            args = append(args, e.number, feed.Name, feed.Action, e.reason, expires)
+        }
+        _, err := r.backgroundExec(`
+            INSERT INTO blocklist (number, source, action, reason, expires_at)
+            VALUES `+strings.TrimSuffix(strings.Repeat("(?, ?, ?, NULLIF(?, ''), ?), ", len(batch)), ", ")+`
+            ON DUPLICATE KEY UPDATE action = VALUES(action), reason = VALUES(reason), expires_at = VALUES(expires_at)
+        `, args...)
+        if err != nil {
+            return err
+        }
+        imported += len(batch)
+        batch = batch[:0]
+        return nil
+    }
+    add := func(number, reason string) error {
+        number = blocklistNumber(number)
+        if !validBlocklistNumber(number) {
+            return nil
+        }
+        if len(reason) > 255 {
+            reason = reason[:255]
+        }
+        batch = append(batch, entry{number, reason})
+        if len(batch) >= blocklistBatchSize {
+            return flush()
+        }
+        return nil
+    }
+
+    body := io.LimitReader(resp.Body, maxBlocklistFeedBytes)
+    switch feed.Format {
+    case FeedCSV:
+        reader := csv.NewReader(body)
+        reader.FieldsPerRecord = -1
+        reader.Comment = '#'
+        reader.TrimLeadingSpace = true
+        for {
+            record, err := reader.Read()
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                return imported, err
+            }
+            reason := ""
+            if len(record) > 1 {
+                reason = strings.TrimSpace(record[1])
+            }
+            // A header row has no digits and is skipped like any other
+            if err := add(record[0], reason); err != nil {
+                return imported, err
+            }
+        }
+    default:
+        scanner := bufio.NewScanner(body)
+        for scanner.Scan() {
+            line := strings.TrimSpace(scanner.Text())
+            if line == "" || strings.HasPrefix(line, "#") {
+                continue
+            }
+            if err := add(strings.Fields(line)[0], ""); err != nil {
+                return imported, err
+            }
+        }
+        if err := scanner.Err(); err != nil {
+            return imported, err
+        }
+    }
+    if err := flush(); err != nil {
+        return imported, err
+    }
+    return imported, nil
+}
@@ -0,0 +1,399 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/go-sql-driver/mysql"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// When DBBreakerFailures storage calls in a row fail to reach MySQL, the
+// breaker opens: the call path fails fast with ErrDatabaseDown instead of
+// every call waiting out the query timeout, and state writes go straight
+// to the retry queue. Meanwhile the database is pinged with exponential
+// backoff, up to DBReconnectMaxBackoff between attempts; the first ping
+// that succeeds closes the breaker, or with DegradedMode starts the DID
+// write-back that does. An error the server itself returned - a duplicate
+// key, a lock wait - shows MySQL is up and does not count.
+const dbReconnectBackoff = 500 * time.Millisecond
+
+// ErrDatabaseDown is returned while the breaker is open
+var ErrDatabaseDown = errors.New("database unavailable")
+
+var (
+    dbBreakerOpen = metrics.NewGauge("s2_db_breaker_open",
+        "1 while the database circuit breaker is open")
+    dbBreakerTrips = metrics.NewCounter("s2_db_breaker_trips_total",
+        "Times the database circuit breaker opened")
+    dbFastFailures = metrics.NewCounter("s2_db_fast_failures_total",
+        "Storage calls failed by the open breaker without reaching the database")
+)
+
+// DatabaseHealth is the breaker state reported by /api/health
+type DatabaseHealth struct {
+    State               string     `json:"state"` // up or down
+    Since               *time.Time `json:"since,omitempty"`
+    ConsecutiveFailures int        `json:"consecutive_failures"`
+    LastError           string     `json:"last_error,omitempty"`
+    Probes              int        `json:"reconnect_attempts,omitempty"`
+    NextProbe           *time.Time `json:"next_reconnect_at,omitempty"`
+    Trips               int64      `json:"trips"`
+    Degraded            bool       `json:"degraded,omitempty"` // routing from the in-memory pool snapshot
+}
+
+// dbBreaker counts consecutive failures and holds the open state
+type dbBreaker struct {
+    threshold int
+    wake      chan struct{} // signalled when the breaker opens
+    pool      *poolSnapshot // DIDs routed from while open, nil fails fast
+
+    mu        sync.Mutex
+    failures  int
+    open      bool
+    openedAt  time.Time
+    lastError string
+    probes    int
+    nextProbe time.Time
+    trips     int64
+}
+
+// startBreaker wraps the storage in the breaker and starts the reconnect
+// loop that closes it again
+func (r *Router) startBreaker(threshold int, maxBackoff time.Duration, degraded bool) {
+    if maxBackoff <= 0 {
+        maxBackoff = 30 * time.Second
+    }
+    b := &dbBreaker{threshold: threshold, wake: make(chan struct{}, 1)}
+    if degraded {
+        b.pool = &poolSnapshot{breaker: b, dids: make(map[string]*snapshotDID), pending: make(map[string]didUpdate)}
+    }
+    r.breaker = b
+    r.store = &breakerStorage{Storage: r.store, b: b, now: r.clock.Now}
+    r.life.Go("db-reconnect", func(ctx context.Context) error {
+        for {
+            select {
+            case <-ctx.Done():
+                return nil
+            case <-b.wake:
+                if b.pool != nil {
+                    r.enterDegraded()
+                }
+                r.reconnect(ctx, maxBackoff)
+            }
+        }
+    })
+}
+
+// reconnect pings the database with backoff until it answers
+func (r *Router) reconnect(ctx context.Context, maxBackoff time.Duration) {
+    b := r.breaker
+    backoff := dbReconnectBackoff
+    for {
+        b.mu.Lock()
+        b.nextProbe = r.clock.Now().Add(backoff)
+        b.mu.Unlock()
+        timer := time.NewTimer(backoff)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+
+        pingCtx, cancel := r.dbContext(ctx)
+        err := r.db.PingContext(pingCtx)
+        cancel()
+
+        if err == nil {
+            err = r.closeBreaker(ctx)
+        }
+        if err == nil {
+            return
+        }
+        b.mu.Lock()
+        b.probes++
+        b.lastError = err.Error()
+        probes := b.probes
+        b.mu.Unlock()
+        if backoff *= 2; backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+        logger.Warnf("Database still unreachable after %d reconnect attempts, next in %s: %v", probes, backoff, err)
+    }
+}
+
+// closeBreaker closes the breaker once the database is back, after the
+// degraded mode write-back
+func (r *Router) closeBreaker(ctx context.Context) error {
+    b := r.breaker
+    if b.pool != nil {
+        return r.writeBack(ctx)
+    }
+    b.mu.Lock()
+    down := b.closeLocked(r.clock.Now())
+    b.mu.Unlock()
+    r.breakerClosed(down)
+    return nil
+}
+
+// closeLocked resets the breaker and returns how long it was open.
+// Caller must hold b.mu.
+func (b *dbBreaker) closeLocked(now time.Time) time.Duration {
+    down := now.Sub(b.openedAt)
+    b.open, b.failures, b.probes, b.nextProbe = false, 0, 0, time.Time{}
+    dbBreakerOpen.Set(0)
+    return down
+}
+
+func (r *Router) breakerClosed(down time.Duration) {
+    logger.Infof("Database reachable again after %s, breaker closed", down.Round(time.Millisecond))
+    r.publish(models.Event{Type: "database.up", Detail: "down for " + down.Round(time.Second).String()})
+}
+
+// allow fails fast while the breaker is open
+func (b *dbBreaker) allow() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !b.open {
+        return nil
+    }
+    dbFastFailures.Inc()
+    return fmt.Errorf("%w: %s", ErrDatabaseDown, b.lastError)
+}
+
+// observe counts the outcome of one storage call, opening the breaker on
+// the threshold-th failure in a row
+func (b *dbBreaker) observe(err error, now time.Time) {
+    if err != nil && !unreachable(err) {
+        err = nil
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if err == nil {
+        b.failures = 0
+        return
+    }
+    b.failures++
+    b.lastError = err.Error()
+    if b.open || b.failures < b.threshold {
+        return
+    }
+    b.open, b.openedAt = true, now
+    b.trips++
+    dbBreakerTrips.Inc()
+    dbBreakerOpen.Set(1)
+    logger.Errorf("ALERT: database unreachable after %d failed calls, breaker open: %v", b.failures, err)
+    select {
+    case b.wake <- struct{}{}:
+    default:
+    }
+}
+
+// unreachable reports whether err means MySQL could not be reached, as
+// opposed to an answer it gave
+func unreachable(err error) bool {
+    var mysqlErr *mysql.MySQLError
+    switch {
+    case errors.Is(err, sql.ErrNoRows), errors.Is(err, context.Canceled), errors.Is(err, ErrDatabaseDown):
+        return false
+    case errors.As(err, &mysqlErr):
+        return false
+    }
+    return true
+}
+
+// DatabaseHealth reports the breaker state; always up when it is off
+func (r *Router) DatabaseHealth() DatabaseHealth {
+    b := r.breaker
+    if b == nil {
+        return DatabaseHealth{State: "up"}
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    h := DatabaseHealth{State: "up", ConsecutiveFailures: b.failures, LastError: b.lastError, Trips: b.trips}
+    if b.open {
+        openedAt, nextProbe := b.openedAt, b.nextProbe
+        h.State, h.Since, h.Probes, h.Degraded = "down", &openedAt, b.probes, b.pool != nil
+        if !nextProbe.IsZero() {
+            h.NextProbe = &nextProbe
+        }
+    }
+    return h
+}
+
+// breakerStorage is the Storage behind the breaker
+type breakerStorage struct {
+    Storage
+    b   *dbBreaker
+    now func() time.Time
+}
+
+func guard[T any](s *breakerStorage, fn func() (T, error)) (T, error) {
+    if err := s.b.allow(); err != nil {
+        var zero T
+        return zero, err
+    }
+    v, err := fn()
+    s.b.observe(err, s.now())
+    return v, err
+}
+
+func (s *breakerStorage) exec(fn func() error) error {
+    _, err := guard(s, func() (struct{}, error) { return struct{}{}, fn() })
+    return err
+}
+
+func (s *breakerStorage) PickFreeDID(ctx context.Context, f DIDFilter) (string, error) {
+    if s.b.inMemory() {
+        return s.b.pool.pick(f, 0, "")
+    }
+    return guard(s, func() (string, error) { return s.Storage.PickFreeDID(ctx, f) })
+}
+
+func (s *breakerStorage) PickLeastRecentDID(ctx context.Context, f DIDFilter, skip int) (string, error) {
+    if s.b.inMemory() {
+        return s.b.pool.pick(f, skip, "")
+    }
+    return guard(s, func() (string, error) { return s.Storage.PickLeastRecentDID(ctx, f, skip) })
+}
+
+func (s *breakerStorage) PickFreeDIDAfter(ctx context.Context, f DIDFilter, after string) (string, error) {
+    if s.b.inMemory() {
+        return s.b.pool.pick(f, 0, after)
+    }
+    return guard(s, func() (string, error) { return s.Storage.PickFreeDIDAfter(ctx, f, after) })
+}
+
+func (s *breakerStorage) ClaimDID(ctx context.Context, did, destination string) (bool, error) {
+    if s.b.pool != nil {
+        if claimed, ok := s.b.pool.claim(did, destination, s.now()); ok {
+            return claimed, nil
+        }
+    }
+    claimed, err := guard(s, func() (bool, error) { return s.Storage.ClaimDID(ctx, did, destination) })
+    if claimed && s.b.pool != nil {
+        s.b.pool.track(did, true, nil)
+    }
+    return claimed, err
+}
+
+func (s *breakerStorage) InsertClaimedDID(ctx context.Context, did, destination, country, tenant string) (bool, error) {
+    inserted, err := guard(s, func() (bool, error) { return s.Storage.InsertClaimedDID(ctx, did, destination, country, tenant) })
+    if inserted && s.b.pool != nil {
+        s.b.pool.track(did, true, &snapshotDID{tenant: tenant, country: country, inUse: true})
+    }
+    return inserted, err
+}
+
+func (s *breakerStorage) ReleaseDID(ctx context.Context, did, callID string) (bool, error) {
+    if s.b.pool != nil && s.b.pool.release(did, s.now()) {
+        return true, nil
+    }
+    var released bool
+    err := s.exec(func() (err error) {
+        released, err = s.Storage.ReleaseDID(ctx, did, callID)
+        return err
+    })
+    if released && s.b.pool != nil {
+        s.b.pool.track(did, false, nil)
+    }
+    return released, err
+}
+
+func (s *breakerStorage) DIDCounts(ctx context.Context) (total, used int, err error) {
+    err = s.exec(func() error {
+        var err error
+        total, used, err = s.Storage.DIDCounts(ctx)
+        return err
+    })
+    return total, used, err
+}
+
+func (s *breakerStorage) StoreCallRecord(ctx context.Context, record *models.CallRecord) error {
+    return s.exec(func() error { return s.Storage.StoreCallRecord(ctx, record) })
+}
+
+func (s *breakerStorage) UpdateCallStatus(ctx context.Context, callID string, status models.CallState) error {
+    return s.exec(func() error { return s.Storage.UpdateCallStatus(ctx, callID, status) })
+}
+
+func (s *breakerStorage) RecordHangupCause(ctx context.Context, callID, cause string) error {
+    return s.exec(func() error { return s.Storage.RecordHangupCause(ctx, callID, cause) })
+}
+
+func (s *breakerStorage) StoreCallRecords(ctx context.Context, records []*models.CallRecord) error {
+    return s.exec(func() error { return s.Storage.StoreCallRecords(ctx, records) })
+}
+
+func (s *breakerStorage) UpdateCallStatuses(ctx context.Context, callIDs []string, status models.CallState) error {
+    return s.exec(func() error { return s.Storage.UpdateCallStatuses(ctx, callIDs, status) })
+}
+
+func (s *breakerStorage) RecordHangupCauses(ctx context.Context, callIDs []string, cause string) error {
+    return s.exec(func() error { return s.Storage.RecordHangupCauses(ctx, callIDs, cause) })
+}
+
+func (s *breakerStorage) CallRecordByDID(ctx context.Context, did string) (*models.CallRecord, error) {
+    return guard(s, func() (*models.CallRecord, error) { return s.Storage.CallRecordByDID(ctx, did) })
+}
+
+func (s *breakerStorage) CallRecordByToken(ctx context.Context, token string) (*models.CallRecord, error) {
+    return guard(s, func() (*models.CallRecord, error) { return s.Storage.CallRecordByToken(ctx, token) })
+}
+
+func (s *breakerStorage) InFlightCallRecord(ctx context.Context, callID string) (*models.CallRecord, error) {
+    return guard(s, func() (*models.CallRecord, error) { return s.Storage.InFlightCallRecord(ctx, callID) })
+}
+
+func (s *breakerStorage) InFlightCallRecords(ctx context.Context) ([]*models.CallRecord, error) {
+    return guard(s, func() ([]*models.CallRecord, error) { return s.Storage.InFlightCallRecords(ctx) })
+}
+
+func (s *breakerStorage) UnfinishedCallRecords(ctx context.Context, since time.Time) ([]*models.CallRecord, error) {
+    return guard(s, func() ([]*models.CallRecord, error) { return s.Storage.UnfinishedCallRecords(ctx, since) })
+}
+
+func (s *breakerStorage) FailStaleCalls(ctx context.Context) (int64, error) {
+    return guard(s, func() (int64, error) { return s.Storage.FailStaleCalls(ctx) })
+}
+
+func (s *breakerStorage) CallCounts(ctx context.Context) (calls, completed int, err error) {
+    err = s.exec(func() error {
+        var err error
+        calls, completed, err = s.Storage.CallCounts(ctx)
+        return err
+    })
+    return calls, completed, err
+}
+
+func (s *breakerStorage) DIDHistory(ctx context.Context, did string, from, to time.Time, limit int) ([]models.DIDCall, error) {
+    return guard(s, func() ([]models.DIDCall, error) { return s.Storage.DIDHistory(ctx, did, from, to, limit) })
+}
+
+func (s *breakerStorage) ListCalls(ctx context.Context, f CallFilter, offset, limit int) (calls []models.Call, total int, err error) {
+    err = s.exec(func() error {
+        var err error
+        calls, total, err = s.Storage.ListCalls(ctx, f, offset, limit)
+        return err
+    })
+    return calls, total, err
+}
+
+func (s *breakerStorage) CallDetail(ctx context.Context, callID string) (*models.CallDetail, error) {
+    return guard(s, func() (*models.CallDetail, error) { return s.Storage.CallDetail(ctx, callID) })
+}
+
+func (s *breakerStorage) RecordCallEvent(ctx context.Context, callID string, event models.CallEvent) error {
+    return s.exec(func() error { return s.Storage.RecordCallEvent(ctx, callID, event) })
+}
+
+func (s *breakerStorage) CallEvents(ctx context.Context, callID string) ([]models.CallEvent, error) {
+    return guard(s, func() ([]models.CallEvent, error) { return s.Storage.CallEvents(ctx, callID) })
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+// A call that ends while the breaker is open, with no degraded pool to
+// release its DID into, gets the DID freed once the database is back
+func TestReleaseWhileBreakerOpenIsRetried(t *testing.T) {
+    store := newFakeStorage(fakeDIDs(1)...)
+    r := newTestRouter(t, store, Config{})
+    r.startBreaker(1, time.Second, false)
+    ctx := context.Background()
+
+    resp, err := r.ProcessIncomingCall(ctx, "breaker-1", "12125550001", "442070000001", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.ProcessReturnCall(ctx, "442070000001", resp.DIDAssigned, ReturnOptions{}); err != nil {
+        t.Fatal(err)
+    }
+
+    store.down.Store(true)
+    if _, err := r.CompleteCall(ctx, "breaker-1", "16"); err != nil {
+        t.Fatal(err)
+    }
+    if h := r.DatabaseHealth(); h.State != "down" {
+        t.Fatalf("breaker %s after the database went away", h.State)
+    }
+    if !store.inUse(resp.DIDAssigned) {
+        t.Fatalf("DID %s released with the database down", resp.DIDAssigned)
+    }
+    if err := r.retryWrites(); err == nil {
+        t.Fatal("writes replayed with the breaker open")
+    }
+
+    store.down.Store(false)
+    if err := r.closeBreaker(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if err := r.retryWrites(); err != nil {
+        t.Fatal(err)
+    }
+    if store.inUse(resp.DIDAssigned) {
+        t.Fatalf("DID %s still in use after the breaker closed", resp.DIDAssigned)
+    }
+    if pending := r.WriteReport().Pending; len(pending) != 0 {
+        t.Fatalf("%d writes still pending: %+v", len(pending), pending)
+    }
+}
@@ -0,0 +1,119 @@
+package router
+
+import (
+    "context"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// The systems a call passes through, in diagram order
+var flowParticipants = []string{"S1", "S2", "S3", "S4"}
+
+// CallFlow lays out a call's journey for a sequence diagram from its
+// recorded transitions and call record, or returns nil if neither exists.
+// Older calls recorded without a return trunk just show the leg without one.
+func (r *Router) CallFlow(ctx context.Context, callID string) (*models.CallFlow, error) {
+    callID = cleanString(callID)
+    call, err := r.store.CallDetail(ctx, callID)
+    if err != nil {
+        return nil, err
+    }
+    events, err := r.store.CallEvents(ctx, callID)
+    if err != nil {
+        return nil, err
+    }
+    if call == nil && len(events) == 0 {
+        return nil, nil
+    }
+
+    flow := &models.CallFlow{
+        CallID:       callID,
+        Participants: flowParticipants,
+        Steps:        []models.FlowStep{},
+        Legs:         []models.FlowLeg{},
+    }
+    // The call record holds the numbers as routed; the events, where they
+    // have them, hold the numbers as received
+    var ani, dnis, did string
+    if call != nil {
+        flow.Status, flow.HangupCause = call.Status, call.HangupCause
+        start := call.StartTime
+        flow.StartTime, flow.EndTime = &start, call.EndTime
+        ani, dnis, did = call.ANI, call.DNIS, call.DID
+    }
+
+    for _, ev := range events {
+        fields := detailFields(ev.Detail)
+        step := models.FlowStep{From: "S2", To: "S2", Event: ev.Event, At: ev.At, Detail: ev.Detail}
+        switch ev.Event {
+        case models.CallEventIncoming:
+            if v := fields["ani"]; v != "" {
+                ani = v
+            }
+            if v := fields["dnis"]; v != "" {
+                dnis = v
+            }
+            step.From, step.Label = "S1", "INVITE ani="+ani+" dnis="+dnis
+        case models.CallEventDIDAssigned:
+            if ev.Detail != "" {
+                did = ev.Detail
+            }
+            step.Label = "assign DID " + did
+        case models.CallEventForwarded:
+            step.To, step.Label = "S3", "INVITE ani="+dnis+" dnis="+did
+            flow.Legs = append(flow.Legs, models.FlowLeg{
+                Leg: legForward, From: "S1", To: "S3", Trunk: ev.Detail, At: ev.At,
+                Transformations: []models.FlowTransformation{
+                    {Field: "ani", From: ani, To: dnis},
+                    {Field: "dnis", From: dnis, To: did},
+                },
+            })
+        case models.CallEventReturned:
+            ani2, returnDID := fields["ani2"], fields["did"]
+            step.From, step.Label = "S3", "INVITE ani="+ani2+" dnis="+returnDID
+            flow.Steps = append(flow.Steps, step)
+            // S2 sends the restored call straight on to S4
+            step = models.FlowStep{From: "S2", To: "S4", Event: ev.Event, At: ev.At,
+                Label: "INVITE ani=" + ani + " dnis=" + dnis, Detail: fields["trunk"]}
+            flow.Legs = append(flow.Legs, models.FlowLeg{
+                Leg: legReturn, From: "S3", To: "S4", Trunk: fields["trunk"], At: ev.At,
+                Transformations: []models.FlowTransformation{
+                    {Field: "ani", From: ani2, To: ani},
+                    {Field: "dnis", From: returnDID, To: dnis},
+                },
+            })
+        case models.CallEventCompleted, models.CallEventFailed:
+            step.Label = "BYE"
+            if ev.Event == models.CallEventFailed {
+                step.Label = "call failed"
+            }
+            if cause := fields["cause"]; cause != "" {
+                step.Label += " cause=" + cause
+            }
+        default:
+            step.Label = strings.ToLower(ev.Event)
+        }
+        flow.Steps = append(flow.Steps, step)
+    }
+
+    if len(flow.Steps) > 0 {
+        first := flow.Steps[0].At
+        for i := range flow.Steps {
+            flow.Steps[i].Offset = millis(flow.Steps[i].At.Sub(first))
+        }
+        flow.Total = flow.Steps[len(flow.Steps)-1].Offset
+    }
+    return flow, nil
+}
+
+// detailFields reads the key=value pairs of a call event's detail
+func detailFields(detail string) map[string]string {
+    fields := make(map[string]string)
+    for _, f := range strings.Fields(detail) {
+        if k, v, ok := strings.Cut(f, "="); ok {
+            fields[k] = v
+        }
+    }
+    return fields
+}
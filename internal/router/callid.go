@@ -0,0 +1,143 @@
+package router
+
+import (
+    "crypto/rand"
+    "fmt"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// CallID generators for calls S1 sends without one
+const (
+    CallIDOff       = ""
+    CallIDULID      = "ulid"
+    CallIDSnowflake = "snowflake"
+)
+
+// idGenerator issues unique, time-sortable CallIDs
+type idGenerator interface {
+    NewID() string
+}
+
+func newIDGenerator(mode string, node int) (idGenerator, error) {
+    switch mode {
+    case CallIDOff:
+        return nil, nil
+    case CallIDULID:
+        return &ulidGenerator{}, nil
+    case CallIDSnowflake:
+        if node < 0 || node > snowflakeMaxNode {
+            return nil, fmt.Errorf("snowflake node ID must be 0-%d, got %d", snowflakeMaxNode, node)
+        }
+        return &snowflakeGenerator{node: int64(node)}, nil
+    }
+    return nil, fmt.Errorf("invalid CallID generator %q", mode)
+}
+
+// IssuesCallIDs reports whether the router generates CallIDs S1 leaves out
+func (r *Router) IssuesCallIDs() bool {
+    return r.ids != nil
+}
+
+// Crockford's base32, which sorts the same as the numbers it encodes
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator produces 26 character ULIDs: 48 bits of milliseconds then
+// 80 random bits. Within one millisecond the random part is incremented, so
+// IDs from one router are strictly increasing.
+type ulidGenerator struct {
+    mu     sync.Mutex
+    lastMS uint64
+    last   [10]byte
+}
+
+func (g *ulidGenerator) NewID() string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    ms := uint64(time.Now().UnixMilli())
+    if ms > g.lastMS {
+        g.lastMS = ms
+        if _, err := rand.Read(g.last[:]); err != nil {
+            panic(fmt.Sprintf("router: crypto/rand failed: %v", err))
+        }
+    } else {
+        // Same millisecond (or the clock stepped back): keep sorting forward
+        for i := len(g.last) - 1; i >= 0; i-- {
+            g.last[i]++
+            if g.last[i] != 0 {
+                break
+            }
+        }
+    }
+
+    var id [16]byte
+    for i := 0; i < 6; i++ {
+        id[i] = byte(g.lastMS >> (40 - 8*i))
+    }
+    copy(id[6:], g.last[:])
+    return encodeULID(id)
+}
+
+func encodeULID(id [16]byte) string {
+    // 128 bits as 26 base32 digits, the first digit holding the top 3 bits
+    out := make([]byte, 26)
+    var acc uint
+    bits := 2 // 130 bits of output for 128 of input: pad two zero bits in front
+    k := 0
+    for _, b := range id {
+        acc = acc<<8 | uint(b)
+        bits += 8
+        for bits >= 5 {
+            bits -= 5
+            out[k] = ulidAlphabet[(acc>>uint(bits))&31]
+            k++
+        }
+    }
+    return string(out)
+}
+
+// Snowflake layout: 41 bits of milliseconds since snowflakeEpoch, 10 bits
+// of node ID and a 12 bit per-millisecond sequence
+const (
+    snowflakeNodeBits = 10
+    snowflakeSeqBits  = 12
+    snowflakeMaxNode  = 1<<snowflakeNodeBits - 1
+    snowflakeMaxSeq   = 1<<snowflakeSeqBits - 1
+)
+
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+// snowflakeGenerator produces decimal 64-bit IDs. Routers sharing a
+// database need distinct node IDs.
+type snowflakeGenerator struct {
+    mu     sync.Mutex
+    node   int64
+    lastMS int64
+    seq    int64
+}
+
+func (g *snowflakeGenerator) NewID() string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    ms := time.Now().UnixMilli() - snowflakeEpoch
+    if ms < g.lastMS {
+        // Never reuse a timestamp after the clock steps back
+        ms = g.lastMS
+    }
+    if ms == g.lastMS {
+        g.seq = (g.seq + 1) & snowflakeMaxSeq
+        if g.seq == 0 {
+            // Sequence exhausted: borrow the next millisecond
+            ms++
+        }
+    } else {
+        g.seq = 0
+    }
+    g.lastMS = ms
+
+    id := ms<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq
+    return strconv.FormatInt(id, 10)
+}
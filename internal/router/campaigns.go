@@ -0,0 +1,227 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/ratelimit"
+)
+
+// ErrCampaignLimit is returned when a campaign is over its CPS or concurrency cap
+var ErrCampaignLimit = errors.New("campaign limit reached")
+
+var campaignThrottled = metrics.NewCounter("s2_campaign_throttled_total",
+    "Incoming calls rejected by campaign limits", "campaign", "reason")
+
+// campaignLimits caches campaign caps and their CPS buckets
+type campaignLimits struct {
+    mu      sync.Mutex
+    limits  map[string]models.Campaign
+    buckets map[string]*ratelimit.Bucket
+}
+
+// loadCampaigns refreshes the cached limits from the database
+func (r *Router) loadCampaigns() error {
+    list, err := r.Campaigns(context.Background())
+    if err != nil {
+        logger.Errorf("Error loading campaigns: %v", err)
+        return err
+    }
+
+    c := &r.campaigns
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    limits := make(map[string]models.Campaign, len(list))
+    for _, camp := range list {
+        limits[camp.ID] = camp
+        if camp.MaxCPS <= 0 {
+            delete(c.buckets, camp.ID)
+            continue
+        }
+        burst := int(math.Ceil(camp.MaxCPS))
+        if b, ok := c.buckets[camp.ID]; ok {
+            b.SetRate(camp.MaxCPS, burst)
+        } else {
+            c.buckets[camp.ID] = ratelimit.NewBucket(camp.MaxCPS, burst, r.clock)
+        }
+    }
+    for id := range c.buckets {
+        if _, ok := limits[id]; !ok {
+            delete(c.buckets, id)
+        }
+    }
+    c.limits = limits
+    return nil
+}
+
+// checkCampaign enforces the campaign's caps for a new call.
+// Caller must hold r.mu.
+func (r *Router) checkCampaign(campaign string) error {
+    if campaign == "" {
+        return nil
+    }
+
+    c := &r.campaigns
+    c.mu.Lock()
+    limit, ok := c.limits[campaign]
+    bucket := c.buckets[campaign]
+    c.mu.Unlock()
+    if !ok {
+        return nil
+    }
+
+    if limit.MaxConcurrent > 0 && r.campaignActiveCalls(campaign) >= limit.MaxConcurrent {
+        campaignThrottled.Inc(campaign, "concurrency")
+        return fmt.Errorf("%w: campaign %s at %d concurrent calls", ErrCampaignLimit, campaign, limit.MaxConcurrent)
+    }
+    if bucket != nil && !bucket.Allow() {
+        campaignThrottled.Inc(campaign, "cps")
+        return fmt.Errorf("%w: campaign %s over %.1f CPS", ErrCampaignLimit, campaign, limit.MaxCPS)
+    }
+    return nil
+}
+
+// campaignActiveCalls counts in-flight calls of a campaign. Caller must hold r.mu.
+func (r *Router) campaignActiveCalls(campaign string) int {
+    count := 0
+    for _, record := range r.activeCallsMap {
+        if record.Campaign == campaign && r.isInFlight(record) {
+            count++
+        }
+    }
+    for _, a := range r.admissions {
+        if a.campaign == campaign {
+            count++
+        }
+    }
+    return count
+}
+
+// Campaigns lists configured campaigns
+func (r *Router) Campaigns(ctx context.Context) ([]models.Campaign, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT campaign_id, max_cps, max_concurrent, updated_at
+        FROM campaigns
+        ORDER BY campaign_id
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.Campaign{}
+    for rows.Next() {
+        var c models.Campaign
+        if err := rows.Scan(&c.ID, &c.MaxCPS, &c.MaxConcurrent, &c.UpdatedAt); err != nil {
+            return nil, err
+        }
+        list = append(list, c)
+    }
+    return list, rows.Err()
+}
+
+// SetCampaign creates or updates a campaign's limits
+func (r *Router) SetCampaign(ctx context.Context, c models.Campaign) (*models.Campaign, error) {
+    if c.ID == "" || len(c.ID) > 64 {
+        return nil, fmt.Errorf("campaign_id must be 1-64 characters")
+    }
+    if c.MaxCPS < 0 || c.MaxConcurrent < 0 {
+        return nil, fmt.Errorf("limits must not be negative")
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, `
+        INSERT INTO campaigns (campaign_id, max_cps, max_concurrent)
+        VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE max_cps = VALUES(max_cps), max_concurrent = VALUES(max_concurrent)
+    `, c.ID, c.MaxCPS, c.MaxConcurrent)
+    if err != nil {
+        return nil, err
+    }
+
+    c.UpdatedAt = r.clock.Now()
+    r.loadCampaigns()
+    return &c, nil
+}
+
+func (r *Router) DeleteCampaign(ctx context.Context, id string) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM campaigns WHERE campaign_id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("campaign %s not found", id)
+    }
+    r.loadCampaigns()
+    return nil
+}
+
+// CampaignStatistics reports per-campaign traffic for calls started in [from, to)
+func (r *Router) CampaignStatistics(ctx context.Context, from, to time.Time) ([]models.CampaignStats, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT
+            campaign_id,
+            COUNT(*),
+            SUM(CASE WHEN status = 'COMPLETED_AT_S4' THEN 1 ELSE 0 END),
+            SUM(CASE WHEN status = 'FAILED' THEN 1 ELSE 0 END),
+            COALESCE(AVG(CASE WHEN duration > 0 THEN duration END), 0)
+        FROM call_records
+        WHERE campaign_id IS NOT NULL AND campaign_id <> ''
+        AND start_time >= ? AND start_time < ?
+        GROUP BY campaign_id
+        ORDER BY campaign_id
+    `, from, to)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var list []models.CampaignStats
+    for rows.Next() {
+        var st models.CampaignStats
+        if err := rows.Scan(&st.CampaignID, &st.Calls, &st.Completed, &st.Failed, &st.AvgDuration); err != nil {
+            return nil, err
+        }
+        st.AvgDuration = math.Round(st.AvgDuration*10) / 10
+        list = append(list, st)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    r.campaigns.mu.Lock()
+    limits := r.campaigns.limits
+    r.campaigns.mu.Unlock()
+
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    for i := range list {
+        st := &list[i]
+        st.ActiveCalls = r.campaignActiveCalls(st.CampaignID)
+        st.Throttled = int(campaignThrottled.Value(st.CampaignID, "cps") + campaignThrottled.Value(st.CampaignID, "concurrency"))
+        if limit, ok := limits[st.CampaignID]; ok {
+            st.MaxCPS = limit.MaxCPS
+            st.MaxConcurrent = limit.MaxConcurrent
+        }
+    }
+    if list == nil {
+        list = []models.CampaignStats{}
+    }
+    return list, nil
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+    "context"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/capacity"
+)
+
+// Hold time assumed when history has no completed calls to measure
+const defaultHoldSeconds = 180
+
+// TrafficCurve returns hourly call attempts over the last days together
+// with the average DID hold time of completed calls (0 if unknown)
+func (r *Router) TrafficCurve(ctx context.Context, days int) ([]capacity.HourlyCalls, float64, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT DATE_FORMAT(start_time, '%Y-%m-%d %H:00:00') AS hour, COUNT(*)
+        FROM call_records
+        WHERE start_time > DATE_SUB(NOW(), INTERVAL ? DAY)
+        GROUP BY hour
+        ORDER BY hour
+    `, days)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    var curve []capacity.HourlyCalls
+    for rows.Next() {
+        var hour string
+        var h capacity.HourlyCalls
+        if err := rows.Scan(&hour, &h.Calls); err != nil {
+            return nil, 0, err
+        }
+        h.Hour, _ = time.ParseInLocation("2006-01-02 15:04:05", hour, time.Local)
+        curve = append(curve, h)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, 0, err
+    }
+
+    var avgHold float64
+    r.db.QueryRowContext(ctx, `
+        SELECT COALESCE(AVG(duration), 0)
+        FROM call_records
+        WHERE start_time > DATE_SUB(NOW(), INTERVAL ? DAY)
+        AND duration > 0
+    `, days).Scan(&avgHold)
+
+    return curve, avgHold, nil
+}
+
+// CapacityPlan sizes the DID pool for a target blocking probability.
+// With erlangs > 0 the offered load is taken as given; otherwise it is
+// derived from the last days of traffic. holdSeconds overrides the measured
+// average hold time when positive.
+func (r *Router) CapacityPlan(ctx context.Context, days int, erlangs, holdSeconds, target float64) (*capacity.Plan, error) {
+    var totalDIDs int
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    if err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM dids").Scan(&totalDIDs); err != nil {
+        return nil, err
+    }
+
+    if erlangs > 0 {
+        return capacity.PlanForTraffic(erlangs, target, totalDIDs), nil
+    }
+
+    curve, measuredHold, err := r.TrafficCurve(ctx, days)
+    if err != nil {
+        return nil, err
+    }
+    if holdSeconds <= 0 {
+        holdSeconds = measuredHold
+    }
+    if holdSeconds <= 0 {
+        holdSeconds = defaultHoldSeconds
+    }
+
+    return capacity.PlanForCurve(curve, holdSeconds, target, totalDIDs), nil
+}
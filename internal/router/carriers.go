@@ -0,0 +1,248 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "math"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/ratelimit"
+)
+
+// ErrCarrierLimit is returned when the trunk a call would take is over its
+// carrier profile's CPS
+var ErrCarrierLimit = errors.New("carrier limit reached")
+
+var (
+    carrierThrottled = metrics.NewCounter("s2_carrier_throttled_total",
+        "Incoming calls rejected by carrier profile CPS limits", "trunk")
+    carrierPacing = metrics.NewCounter("s2_carrier_pacing_advised_total",
+        "Routing responses advising S1 to pace calls to a trunk near its CPS limit", "trunk")
+)
+
+// Below this share of its burst left, a trunk is near its CPS limit and
+// responses suggest S1 space its next call by the trunk's rate
+const pacingThreshold = 0.25
+
+// Caller ID header styles of a carrier profile
+const (
+    callerIDPAI  = "pai"
+    callerIDRPID = "rpid"
+)
+
+const maxCarrierHeaders = 20
+
+// carrierProfiles caches the profiles by trunk and their CPS buckets
+type carrierProfiles struct {
+    mu       sync.Mutex
+    profiles map[string]models.CarrierProfile
+    buckets  map[string]*ratelimit.Bucket
+}
+
+// loadCarriers refreshes the cached profiles from the database
+func (r *Router) loadCarriers() error {
+    list, err := r.CarrierProfiles(context.Background())
+    if err != nil {
+        logger.Errorf("Error loading carrier profiles: %v", err)
+        return err
+    }
+
+    c := &r.carriers
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    profiles := make(map[string]models.CarrierProfile, len(list))
+    for _, p := range list {
+        profiles[p.Trunk] = p
+        if p.MaxCPS <= 0 {
+            delete(c.buckets, p.Trunk)
+            continue
+        }
+        burst := int(math.Ceil(p.MaxCPS))
+        if b, ok := c.buckets[p.Trunk]; ok {
+            b.SetRate(p.MaxCPS, burst)
+        } else {
+            c.buckets[p.Trunk] = ratelimit.NewBucket(p.MaxCPS, burst, r.clock)
+        }
+    }
+    for trunk := range c.buckets {
+        if _, ok := profiles[trunk]; !ok {
+            delete(c.buckets, trunk)
+        }
+    }
+    c.profiles = profiles
+    return nil
+}
+
+func (r *Router) carrierProfile(trunk string) (models.CarrierProfile, bool) {
+    c := &r.carriers
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    p, ok := c.profiles[trunk]
+    return p, ok
+}
+
+// checkCarrier enforces the CPS of the trunk a new call is forwarded to
+// and returns the pacing to advise when the trunk is near its limit.
+// Return legs are not limited: their call was admitted on the forward leg.
+func (r *Router) checkCarrier(trunk string) (time.Duration, error) {
+    c := &r.carriers
+    c.mu.Lock()
+    bucket := c.buckets[trunk]
+    limit := c.profiles[trunk].MaxCPS
+    c.mu.Unlock()
+
+    if bucket == nil {
+        return 0, nil
+    }
+    ok, left := bucket.Take()
+    if !ok {
+        carrierThrottled.Inc(trunk)
+        return 0, fmt.Errorf("%w: trunk %s over %.1f CPS", ErrCarrierLimit, trunk, limit)
+    }
+    if left >= pacingThreshold || limit <= 0 {
+        return 0, nil
+    }
+    carrierPacing.Inc(trunk)
+    return time.Duration(float64(time.Second) / limit), nil
+}
+
+// pacingMillis is a pacing delay as sent to S1, rounded up
+func pacingMillis(d time.Duration) int {
+    return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// applyCarrier adapts a response to the profile of its next hop: the dial
+// prefix goes on the DNIS and the caller ID and privacy settings become
+// SIP headers for the outbound leg
+func (r *Router) applyCarrier(resp *models.CallResponse) *models.CallResponse {
+    p, ok := r.carrierProfile(resp.NextHop)
+    if !ok {
+        return resp
+    }
+
+    resp.DNISToSend = p.DialPrefix + resp.DNISToSend
+    headers := make(map[string]string, len(p.Headers)+2)
+    for k, v := range p.Headers {
+        headers[k] = v
+    }
+    switch p.CallerIDHeader {
+    case callerIDPAI:
+        headers["P-Asserted-Identity"] = fmt.Sprintf("<tel:%s>", resp.ANIToSend)
+    case callerIDRPID:
+        privacy := "off"
+        if p.Privacy != "" && p.Privacy != "none" {
+            privacy = "full"
+        }
+        headers["Remote-Party-ID"] = fmt.Sprintf("<tel:%s>;party=calling;privacy=%s;screen=yes", resp.ANIToSend, privacy)
+    }
+    if p.Privacy != "" {
+        headers["Privacy"] = p.Privacy
+    }
+    if len(headers) > 0 {
+        resp.Headers = headers
+    }
+    return resp
+}
+
+// validateCarrierProfile checks a profile before it is stored
+func validateCarrierProfile(p models.CarrierProfile) error {
+    if p.Trunk == "" || len(p.Trunk) > 100 {
+        return fmt.Errorf("trunk must be 1-100 characters")
+    }
+    if len(p.DialPrefix) > 20 || strings.Trim(p.DialPrefix, "0123456789*#+") != "" {
+        return fmt.Errorf("dial_prefix must be up to 20 digits, *, # or +")
+    }
+    if p.CallerIDHeader != "" && p.CallerIDHeader != callerIDPAI && p.CallerIDHeader != callerIDRPID {
+        return fmt.Errorf("caller_id_header must be pai, rpid or empty")
+    }
+    if len(p.Privacy) > 50 {
+        return fmt.Errorf("privacy exceeds 50 characters")
+    }
+    if p.MaxCPS < 0 {
+        return fmt.Errorf("max_cps must not be negative")
+    }
+    if len(p.Headers) > maxCarrierHeaders {
+        return fmt.Errorf("too many headers: %d (max %d)", len(p.Headers), maxCarrierHeaders)
+    }
+    for name, value := range p.Headers {
+        // Header names are tokens; CR/LF in either would inject headers
+        if name == "" || strings.ContainsAny(name, " :\r\n") || strings.ContainsAny(value, "\r\n") {
+            return fmt.Errorf("invalid header %q", name)
+        }
+    }
+    return nil
+}
+
+// CarrierProfiles lists the configured profiles
+func (r *Router) CarrierProfiles(ctx context.Context) ([]models.CarrierProfile, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT trunk, dial_prefix, caller_id_header, privacy, max_cps, headers, updated_at
+        FROM carrier_profiles
+        ORDER BY trunk
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.CarrierProfile{}
+    for rows.Next() {
+        var p models.CarrierProfile
+        var headers sql.NullString
+        if err := rows.Scan(&p.Trunk, &p.DialPrefix, &p.CallerIDHeader, &p.Privacy, &p.MaxCPS, &headers, &p.UpdatedAt); err != nil {
+            return nil, err
+        }
+        p.Headers = decodeTags(headers)
+        list = append(list, p)
+    }
+    return list, rows.Err()
+}
+
+// SetCarrierProfile creates or replaces the profile of a trunk
+func (r *Router) SetCarrierProfile(ctx context.Context, p models.CarrierProfile) (*models.CarrierProfile, error) {
+    if err := validateCarrierProfile(p); err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, `
+        INSERT INTO carrier_profiles (trunk, dial_prefix, caller_id_header, privacy, max_cps, headers)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE dial_prefix = VALUES(dial_prefix), caller_id_header = VALUES(caller_id_header),
+            privacy = VALUES(privacy), max_cps = VALUES(max_cps), headers = VALUES(headers)
+    `, p.Trunk, p.DialPrefix, p.CallerIDHeader, p.Privacy, p.MaxCPS, encodeTags(p.Headers))
+    if err != nil {
+        return nil, err
+    }
+
+    p.UpdatedAt = r.clock.Now()
+    r.loadCarriers()
+    logger.Infof("Carrier profile for %s saved", p.Trunk)
+    return &p, nil
+}
+
+func (r *Router) DeleteCarrierProfile(ctx context.Context, trunk string) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM carrier_profiles WHERE trunk = ?", trunk)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("carrier profile for %s not found", trunk)
+    }
+    r.loadCarriers()
+    return nil
+}
@@ -0,0 +1,472 @@
+package router
+
+import (
+    "bytes"
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// A CDR is written for every call that ends, to each configured sink:
+//
+//	mysql  the cdrs table, one row per call
+//	file   a local CSV or JSON lines file, rotated by age and size
+//	http   batches POSTed as a JSON array
+//
+// Each sink has its own queue and writer, so a sink that is down or slow
+// holds up nobody else: billing keeps its file feed while the database is
+// unreachable. A sink takes CDRs strictly in Seq order; a batch that fails
+// is retried, with backoff, before anything newer. Delivery is at least
+// once - a batch can be repeated after a failure part way through - and
+// the oldest CDRs are dropped beyond the sink's buffer, which shows as a
+// gap in Seq.
+const (
+    cdrBatch       = 500
+    cdrInterval    = 200 * time.Millisecond
+    cdrBackoff     = time.Second
+    cdrMaxBackoff  = time.Minute
+    cdrShutdownTTL = 5 * time.Second // last flush attempt when the router closes
+)
+
+var (
+    cdrsWritten = metrics.NewCounter("s2_cdr_written_total",
+        "CDRs by sink and result (written, failed or dropped)", "sink", "result")
+    cdrPending = metrics.NewGauge("s2_cdr_pending",
+        "CDRs waiting for a sink", "sink")
+)
+
+// CDRConfig selects where CDRs are written
+type CDRConfig struct {
+    Sinks       []string      // any of mysql, file and http; empty disables CDRs
+    File        string        // file sink path, e.g. /var/spool/s2/cdr/cdr.csv
+    Format      string        // file sink format: csv or jsonl
+    RotateEvery time.Duration // the file is rotated this often, 0 never on age
+    RotateBytes int64         // the file is rotated at this size, 0 never on size
+    Keep        int           // rotated files kept, 0 keeps all
+    HTTPURL     string        // http sink endpoint
+    Buffer      int           // CDRs each sink queues before dropping the oldest
+}
+
+// cdrSink writes one batch of CDRs, in order, or fails without the caller
+// being able to tell how much of it landed
+type cdrSink interface {
+    write(ctx context.Context, batch []models.CDR) error
+    close()
+}
+
+var cdrSinks = map[string]func(r *Router, cfg CDRConfig) (cdrSink, error){
+    "mysql": newMySQLCDRSink,
+    "file":  newFileCDRSink,
+    "http":  newHTTPCDRSink,
+}
+
+// CDRSinks lists the names accepted in CDRConfig.Sinks
+func CDRSinks() []string {
+    names := make([]string, 0, len(cdrSinks))
+    for name := range cdrSinks {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// cdrQueue is one sink's queue and delivery state
+type cdrQueue struct {
+    name   string
+    sink   cdrSink
+    buffer int
+
+    mu      sync.Mutex
+    pending []models.CDR
+    dropped int // CDRs dropped for space since the current batch was taken
+}
+
+// cdrWriter fans CDRs out to the sink queues
+type cdrWriter struct {
+    seq    uint64
+    queues []*cdrQueue
+}
+
+// startCDRSinks opens the configured sinks and starts a writer for each
+func (r *Router) startCDRSinks(cfg CDRConfig) error {
+    if len(cfg.Sinks) == 0 {
+        return nil
+    }
+    if cfg.Buffer <= 0 {
+        cfg.Buffer = 100000
+    }
+    w := &cdrWriter{}
+    for _, name := range cfg.Sinks {
+        newSink, ok := cdrSinks[name]
+        if !ok {
+            return fmt.Errorf("unsupported CDR sink %q (available: %s)", name, strings.Join(CDRSinks(), ", "))
+        }
+        sink, err := newSink(r, cfg)
+        if err != nil {
+            return fmt.Errorf("CDR sink %s: %w", name, err)
+        }
+        q := &cdrQueue{name: name, sink: sink, buffer: cfg.Buffer}
+        w.queues = append(w.queues, q)
+        r.life.Go("cdr-"+name, func(ctx context.Context) error {
+            q.run(ctx)
+            return nil
+        })
+    }
+    r.cdrs = w
+    logger.Infof("Writing CDRs to %s", strings.Join(cfg.Sinks, ", "))
+    return nil
+}
+
+// writeCDR queues the CDR of a call that just ended with every sink
+func (r *Router) writeCDR(record *models.CallRecord, status models.CallState, cause, source string) {
+    w := r.cdrs
+    if w == nil {
+        return
+    }
+    end := r.clock.Now()
+    cdr := models.CDR{
+        Seq:             atomic.AddUint64(&w.seq, 1),
+        Node:            statsNode,
+        CallID:          record.CallID,
+        ANI:             record.OriginalANI,
+        DNIS:            record.OriginalDNIS,
+        DID:             record.AssignedDID,
+        Status:          status,
+        StartTime:       record.StartTime,
+        EndTime:         end,
+        Duration:        int(end.Sub(record.StartTime).Seconds()),
+        HangupCause:     cause,
+        EndSource:       source,
+        Campaign:        record.Campaign,
+        Tenant:          record.Tenant,
+        SettlementClass: record.SettlementClass,
+        ForwardTrunk:    record.ForwardTrunk,
+        DestCountry:     record.Destination.Country,
+        DestRegion:      record.Destination.Region,
+        DestType:        record.Destination.Type,
+    }
+    for _, q := range w.queues {
+        q.add(cdr)
+    }
+}
+
+func (q *cdrQueue) add(cdr models.CDR) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if len(q.pending) >= q.buffer {
+        q.pending = q.pending[1:]
+        q.dropped++
+        cdrsWritten.Inc(q.name, "dropped")
+    }
+    q.pending = append(q.pending, cdr)
+    cdrPending.Set(float64(len(q.pending)), q.name)
+}
+
+// run writes queued CDRs until ctx is done, backing off while the sink
+// fails, then makes one last attempt with whatever is left
+func (q *cdrQueue) run(ctx context.Context) {
+    defer q.sink.close()
+    ticker := time.NewTicker(cdrInterval)
+    defer ticker.Stop()
+    var retryAt time.Time
+    backoff := cdrBackoff
+    for {
+        select {
+        case <-ctx.Done():
+            final, cancel := context.WithTimeout(context.Background(), cdrShutdownTTL)
+            if err := q.drain(final); err != nil {
+                logger.Errorf("CDR sink %s lost %d CDRs at shutdown: %v", q.name, q.size(), err)
+            }
+            cancel()
+            return
+        case now := <-ticker.C:
+            if now.Before(retryAt) {
+                continue
+            }
+            if err := q.drain(ctx); err != nil {
+                logger.Warnf("CDR sink %s failed, retrying in %s with %d CDRs queued: %v", q.name, backoff, q.size(), err)
+                retryAt = now.Add(backoff)
+                if backoff *= 2; backoff > cdrMaxBackoff {
+                    backoff = cdrMaxBackoff
+                }
+                continue
+            }
+            backoff = cdrBackoff
+        }
+    }
+}
+
+// drain writes batches until the queue is empty or the sink fails
+func (q *cdrQueue) drain(ctx context.Context) error {
+    for q.size() > 0 {
+        if err := q.flush(ctx); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (q *cdrQueue) size() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return len(q.pending)
+}
+
+// flush writes the oldest batch, leaving it queued if the sink fails
+func (q *cdrQueue) flush(ctx context.Context) error {
+    q.mu.Lock()
+    n := len(q.pending)
+    if n > cdrBatch {
+        n = cdrBatch
+    }
+    batch := append([]models.CDR(nil), q.pending[:n]...)
+    q.dropped = 0
+    q.mu.Unlock()
+    if len(batch) == 0 {
+        return nil
+    }
+
+    if err := q.sink.write(ctx, batch); err != nil {
+        cdrsWritten.Add(float64(len(batch)), q.name, "failed")
+        return err
+    }
+    cdrsWritten.Add(float64(len(batch)), q.name, "written")
+
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    // CDRs dropped for space while writing were the oldest: ours
+    if q.dropped >= n {
+        q.dropped -= n
+        n = 0
+    } else {
+        n -= q.dropped
+        q.dropped = 0
+    }
+    q.pending = q.pending[n:]
+    cdrPending.Set(float64(len(q.pending)), q.name)
+    return nil
+}
+
+// mysqlCDRSink inserts into the cdrs table; a repeated batch is ignored
+// row by row on the call_id key
+type mysqlCDRSink struct {
+    r *Router
+}
+
+func newMySQLCDRSink(r *Router, cfg CDRConfig) (cdrSink, error) {
+    return &mysqlCDRSink{r: r}, nil
+}
+
+func (s *mysqlCDRSink) write(ctx context.Context, batch []models.CDR) error {
+    var query strings.Builder
+    query.WriteString(`INSERT IGNORE INTO cdrs
+        (call_id, seq, node, ani, dnis, did, status, start_time, end_time, duration,
+        hangup_cause, end_source, campaign_id, tenant_id, settlement_class, forward_trunk,
+        dest_country, dest_region, dest_type) VALUES `)
+    args := make([]interface{}, 0, len(batch)*19)
+    for i, c := range batch {
+        if i > 0 {
+            query.WriteString(", ")
+        }
+        query.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+        args = append(args, c.CallID, c.Seq, c.Node, c.ANI, c.DNIS, c.DID, c.Status, c.StartTime, c.EndTime, c.Duration,
+            c.HangupCause, c.EndSource, c.Campaign, c.Tenant, c.SettlementClass, c.ForwardTrunk,
+            c.DestCountry, c.DestRegion, c.DestType)
+    }
+    ctx, cancel := s.r.dbContext(ctx)
+    defer cancel()
+    _, err := s.r.db.ExecContext(ctx, query.String(), args...)
+    return err
+}
+
+func (s *mysqlCDRSink) close() {}
+
+var cdrColumns = []string{
+    "seq", "node", "call_id", "ani", "dnis", "did", "status", "start_time", "end_time", "duration",
+    "hangup_cause", "end_source", "campaign_id", "tenant_id", "settlement_class", "forward_trunk",
+    "dest_country", "dest_region", "dest_type",
+}
+
+// fileCDRSink appends to a local file, synced after every batch, and
+// rotates it to <name>-<UTC time><ext> by age or size. A CSV file starts
+// with a header row.
+type fileCDRSink struct {
+    cfg    CDRConfig
+    now    func() time.Time
+    f      *os.File
+    size   int64
+    opened time.Time
+}
+
+func newFileCDRSink(r *Router, cfg CDRConfig) (cdrSink, error) {
+    if cfg.File == "" {
+        return nil, fmt.Errorf("the file sink needs a file path")
+    }
+    if cfg.Format == "" {
+        cfg.Format = "csv"
+    }
+    if cfg.Format != "csv" && cfg.Format != "jsonl" {
+        return nil, fmt.Errorf("format must be csv or jsonl")
+    }
+    if err := os.MkdirAll(filepath.Dir(cfg.File), 0o755); err != nil {
+        return nil, err
+    }
+    s := &fileCDRSink{cfg: cfg, now: r.clock.Now}
+    return s, s.open()
+}
+
+func (s *fileCDRSink) open() error {
+    f, err := os.OpenFile(s.cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    s.f, s.size, s.opened = f, info.Size(), s.now()
+    if s.size == 0 && s.cfg.Format == "csv" {
+        var header bytes.Buffer
+        w := csv.NewWriter(&header)
+        w.Write(cdrColumns)
+        w.Flush()
+        n, err := f.Write(header.Bytes())
+        s.size += int64(n)
+        if err != nil {
+            s.close()
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *fileCDRSink) write(ctx context.Context, batch []models.CDR) error {
+    if s.f != nil && s.rotationDue() {
+        if err := s.rotate(); err != nil {
+            logger.Errorf("Failed to rotate CDR file %s: %v", s.cfg.File, err)
+        }
+    }
+    if s.f == nil {
+        if err := s.open(); err != nil {
+            return err
+        }
+    }
+
+    var buf bytes.Buffer
+    if s.cfg.Format == "jsonl" {
+        enc := json.NewEncoder(&buf)
+        for _, c := range batch {
+            enc.Encode(c)
+        }
+    } else {
+        w := csv.NewWriter(&buf)
+        for _, c := range batch {
+            w.Write(cdrRow(c))
+        }
+        w.Flush()
+    }
+    n, err := s.f.Write(buf.Bytes())
+    s.size += int64(n)
+    if err == nil {
+        err = s.f.Sync()
+    }
+    if err != nil {
+        // Reopen on the retry; the file may have been moved or the disk fixed
+        s.close()
+    }
+    return err
+}
+
+func (s *fileCDRSink) rotationDue() bool {
+    return (s.cfg.RotateEvery > 0 && s.now().Sub(s.opened) >= s.cfg.RotateEvery) ||
+        (s.cfg.RotateBytes > 0 && s.size >= s.cfg.RotateBytes)
+}
+
+// rotate moves the current file aside, prunes old ones and opens a new one
+func (s *fileCDRSink) rotate() error {
+    s.close()
+    ext := filepath.Ext(s.cfg.File)
+    base := strings.TrimSuffix(s.cfg.File, ext)
+    rotated := base + "-" + s.now().UTC().Format("20060102T150405Z") + ext
+    if err := os.Rename(s.cfg.File, rotated); err != nil {
+        return err
+    }
+    logger.Infof("Rotated CDR file to %s", rotated)
+
+    if s.cfg.Keep > 0 {
+        old, _ := filepath.Glob(base + "-*" + ext)
+        // Names sort by rotation time
+        sort.Strings(old)
+        for len(old) > s.cfg.Keep {
+            os.Remove(old[0])
+            old = old[1:]
+        }
+    }
+    return s.open()
+}
+
+func (s *fileCDRSink) close() {
+    if s.f != nil {
+        s.f.Close()
+        s.f = nil
+    }
+}
+
+func cdrRow(c models.CDR) []string {
+    return []string{
+        strconv.FormatUint(c.Seq, 10), c.Node, c.CallID, c.ANI, c.DNIS, c.DID, string(c.Status),
+        c.StartTime.UTC().Format(time.RFC3339), c.EndTime.UTC().Format(time.RFC3339), strconv.Itoa(c.Duration),
+        c.HangupCause, c.EndSource, c.Campaign, c.Tenant, c.SettlementClass, c.ForwardTrunk,
+        c.DestCountry, c.DestRegion, c.DestType,
+    }
+}
+
+// httpCDRSink POSTs each batch as a JSON array; any 2xx accepts it
+type httpCDRSink struct {
+    url    string
+    client *http.Client
+}
+
+func newHTTPCDRSink(r *Router, cfg CDRConfig) (cdrSink, error) {
+    if !strings.HasPrefix(cfg.HTTPURL, "http://") && !strings.HasPrefix(cfg.HTTPURL, "https://") {
+        return nil, fmt.Errorf("the http sink needs an http(s) URL")
+    }
+    return &httpCDRSink{url: cfg.HTTPURL, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (s *httpCDRSink) write(ctx context.Context, batch []models.CDR) error {
+    body, err := json.Marshal(batch)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("CDR endpoint returned %s", resp.Status)
+    }
+    return nil
+}
+
+func (s *httpCDRSink) close() {}
@@ -0,0 +1,78 @@
+package router
+
+import (
+    "sort"
+    "sync"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// With CountryPrefixes set a call prefers DIDs whose country column matches
+// its destination, taken from the DNIS or, failing that, the ANI. Countries
+// are whatever the dids table holds (ISO codes, names, ...); the mapping
+// only has to agree with it. With CountryFromNumberPlan, numbers it does
+// not map take the ISO code of the embedded numbering plan instead. An
+// exhausted country falls back to the rest of the pool.
+var countryAllocations = metrics.NewCounter("s2_did_country_allocations_total",
+    "DIDs allocated for calls with a known destination country, by whether the country matched", "country", "result")
+
+// countryStats counts matches per country since the router started
+type countryStats struct {
+    mu     sync.Mutex
+    counts map[string]*models.CountryMatch
+}
+
+// countryOf returns the destination country of a call, "" if unknown
+func (r *Router) countryOf(ani, dnis string) string {
+    for _, number := range []string{dnis, ani} {
+        if digits, ok := internationalDigits(number, ""); ok && len(r.countries) > 0 {
+            if country := r.countries.lookup(digits); country != "" {
+                return country
+            }
+        }
+    }
+    if r.config.CountryFromNumberPlan {
+        return r.planCountry(ani, dnis)
+    }
+    return ""
+}
+
+// countMatch records whether a call for country got a DID of that country
+func (r *Router) countMatch(country string, matched bool) {
+    result := "fallback"
+    if matched {
+        result = "matched"
+    }
+    countryAllocations.Inc(country, result)
+
+    s := &r.countryStats
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    m, ok := s.counts[country]
+    if !ok {
+        m = &models.CountryMatch{Country: country}
+        s.counts[country] = m
+    }
+    if matched {
+        m.Matched++
+    } else {
+        m.Fallback++
+    }
+}
+
+// CountryMatches reports per destination country how many calls got a DID
+// of their country and how many fell back to another, for sizing country
+// inventories
+func (r *Router) CountryMatches() []models.CountryMatch {
+    s := &r.countryStats
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    list := make([]models.CountryMatch, 0, len(s.counts))
+    for _, m := range s.counts {
+        list = append(list, *m)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Country < list[j].Country })
+    return list
+}
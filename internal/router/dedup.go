@@ -0,0 +1,71 @@
+package router
+
+import (
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+var dedupHits = metrics.NewCounter("s2_dedup_hits_total",
+    "Incoming requests answered from an in-flight call with the same ANI/DNIS")
+
+type dedupEntry struct {
+    callID string
+    seen   time.Time
+}
+
+func dedupKey(ani, dnis string) string {
+    return ani + "|" + dnis
+}
+
+// findDuplicate returns the in-flight call with the same ANI/DNIS seen within
+// the dedup window, or nil. Caller must hold r.mu.
+func (r *Router) findDuplicate(ani, dnis string) *models.CallRecord {
+    if r.config.DedupWindow <= 0 {
+        return nil
+    }
+
+    key := dedupKey(ani, dnis)
+    entry, ok := r.recentIncoming[key]
+    if !ok {
+        return nil
+    }
+    if r.since(entry.seen) > r.config.DedupWindow {
+        delete(r.recentIncoming, key)
+        return nil
+    }
+
+    record, ok := r.activeCallsMap[entry.callID]
+    if !ok {
+        delete(r.recentIncoming, key)
+        return nil
+    }
+
+    dedupHits.Inc()
+    return record
+}
+
+// rememberIncoming records a new call for dedup. Caller must hold r.mu.
+func (r *Router) rememberIncoming(record *models.CallRecord) {
+    if r.config.DedupWindow <= 0 {
+        return
+    }
+    r.recentIncoming[dedupKey(record.OriginalANI, record.OriginalDNIS)] = dedupEntry{
+        callID: record.CallID,
+        seen:   r.clock.Now(),
+    }
+}
+
+// pruneDedup drops entries that have aged out of the window
+func (r *Router) pruneDedup() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    for key, entry := range r.recentIncoming {
+        if r.since(entry.seen) > r.config.DedupWindow {
+            delete(r.recentIncoming, key)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,283 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "hash/crc32"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// In degraded mode an open breaker does not stop calls. DIDs are picked,
+// claimed and released in a snapshot of the pool the router keeps while
+// the database is up - refreshed every poolSnapshotInterval and kept
+// current by its own claims and releases - and call state writes wait in
+// the retry queue (WriteRetryLimit long) as for any failed write. When
+// MySQL answers again the DID changes made meanwhile are written back,
+// the last one per DID, before the breaker closes; the queued call writes
+// follow through the retry worker. The snapshot leaves out unmaterialized
+// range DIDs and ignores the release cooldown, and a DID another router
+// claims during the outage is not seen, so this suits a router that owns
+// its pool.
+const poolSnapshotInterval = 30 * time.Second
+
+var (
+    degradedAllocations = metrics.NewCounter("s2_degraded_allocations_total",
+        "DIDs claimed from the in-memory pool snapshot while the database was down")
+    degradedPending = metrics.NewGauge("s2_degraded_pending_did_updates",
+        "DID claims and releases made in memory and not yet written back")
+)
+
+// snapshotDID is one DID as the snapshot knows it
+type snapshotDID struct {
+    tenant, pool, country string
+    inUse                 bool
+}
+
+// didUpdate is the latest in-memory change to a DID
+type didUpdate struct {
+    inUse       bool
+    destination string
+    at          time.Time
+}
+
+// poolSnapshot is the in-memory copy of the DID pool
+type poolSnapshot struct {
+    breaker *dbBreaker // taken inside mu, never the other way round
+
+    mu      sync.Mutex
+    dids    map[string]*snapshotDID
+    takenAt time.Time
+    pending map[string]didUpdate // changes to write back
+}
+
+// refreshPoolSnapshot reloads the snapshot while the database is up
+func (r *Router) refreshPoolSnapshot() error {
+    if r.breaker.isOpen() {
+        return nil
+    }
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT did, tenant_id, pool, COALESCE(country, ''), in_use
+        FROM dids
+        WHERE quarantined_until IS NULL OR quarantined_until <= NOW(3)
+    `)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    dids := make(map[string]*snapshotDID)
+    for rows.Next() {
+        var did string
+        d := &snapshotDID{}
+        if err := rows.Scan(&did, &d.tenant, &d.pool, &d.country, &d.inUse); err != nil {
+            return err
+        }
+        dids[did] = d
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    p := r.breaker.pool
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if len(p.pending) > 0 {
+        return nil // the write-back is not done; keep what memory knows
+    }
+    p.dids, p.takenAt = dids, r.clock.Now()
+    return nil
+}
+
+// enterDegraded marks in use every DID this router's calls hold, covering
+// claims made since the last refresh
+func (r *Router) enterDegraded() {
+    r.mu.RLock()
+    held := make([]string, 0, len(r.didToCallMap))
+    for did := range r.didToCallMap {
+        held = append(held, did)
+    }
+    r.mu.RUnlock()
+
+    p := r.breaker.pool
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for _, did := range held {
+        if d := p.dids[did]; d != nil {
+            d.inUse = true
+        }
+    }
+    logger.Warnf("Degraded mode: routing from a pool snapshot of %d DIDs taken %s ago", len(p.dids), r.since(p.takenAt).Round(time.Second))
+    r.publish(models.Event{Type: "database.degraded", Detail: fmt.Sprintf("%d DIDs in snapshot", len(p.dids))})
+}
+
+// pick returns a free snapshot DID matching f, skipping the first skip
+func (p *poolSnapshot) pick(f DIDFilter, skip int, after string) (string, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    var free []string
+    for did, d := range p.dids {
+        if d.inUse || d.tenant != f.Tenant || d.pool != f.Pool || (f.Country != "" && d.country != f.Country) {
+            continue
+        }
+        if f.Partitions > 0 && int(crc32.ChecksumIEEE([]byte(did))%uint32(f.Partitions)) != f.Partition {
+            continue
+        }
+        if after == "" && skip == 0 {
+            return did, nil // map order is random enough
+        }
+        free = append(free, did)
+    }
+    if len(free) == 0 {
+        return "", sql.ErrNoRows
+    }
+    sort.Strings(free)
+    if after != "" {
+        i := sort.SearchStrings(free, after)
+        if i < len(free) && free[i] == after {
+            i++
+        }
+        return free[i%len(free)], nil
+    }
+    if skip >= len(free) {
+        return "", sql.ErrNoRows
+    }
+    return free[skip], nil
+}
+
+// claim takes did in memory while the breaker is open; ok is false once
+// it has closed and the database decides again
+func (p *poolSnapshot) claim(did, destination string, at time.Time) (claimed, ok bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if !p.breaker.isOpen() {
+        return false, false
+    }
+    d := p.dids[did]
+    if d == nil || d.inUse {
+        return false, true
+    }
+    d.inUse = true
+    p.pending[did] = didUpdate{inUse: true, destination: destination, at: at}
+    degradedPending.Set(float64(len(p.pending)))
+    degradedAllocations.Inc()
+    return true, true
+}
+
+// release frees did in memory while the breaker is open
+func (p *poolSnapshot) release(did string, at time.Time) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if !p.breaker.isOpen() {
+        return false
+    }
+    if d := p.dids[did]; d != nil {
+        d.inUse = false
+    }
+    p.pending[did] = didUpdate{inUse: false, at: at}
+    degradedPending.Set(float64(len(p.pending)))
+    return true
+}
+
+// track follows a claim or release the database made, so the snapshot is
+// current when the breaker opens
+func (p *poolSnapshot) track(did string, inUse bool, added *snapshotDID) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if d := p.dids[did]; d != nil {
+        d.inUse = inUse
+    } else if added != nil {
+        p.dids[did] = added
+    }
+}
+
+// writeBack writes the DID changes made in memory to the database, then
+// closes the breaker. It stays open until then, so no claim goes to the
+// database while the two could still disagree.
+func (r *Router) writeBack(ctx context.Context) error {
+    b := r.breaker
+    p := b.pool
+    for {
+        p.mu.Lock()
+        if len(p.pending) == 0 {
+            b.mu.Lock()
+            down := b.closeLocked(r.clock.Now())
+            b.mu.Unlock()
+            p.mu.Unlock()
+            r.breakerClosed(down)
+            return nil
+        }
+        batch := make(map[string]didUpdate, len(p.pending))
+        for did, u := range p.pending {
+            batch[did] = u
+        }
+        p.mu.Unlock()
+
+        for did, u := range batch {
+            var err error
+            qctx, cancel := r.dbContext(ctx)
+            if u.inUse {
+                _, err = r.db.ExecContext(qctx, `
+                    UPDATE dids SET in_use = 1, destination = ?, last_used_at = ?, updated_at = ?
+                    WHERE did = ?
+                `, u.destination, u.at, r.clock.Now(), did)
+            } else {
+                _, err = r.db.ExecContext(qctx, `
+                    UPDATE dids SET in_use = 0, destination = NULL, last_released_at = ?, updated_at = ?
+                    WHERE did = ?
+                `, u.at, r.clock.Now(), did)
+            }
+            cancel()
+            if err != nil {
+                return fmt.Errorf("writing back DID %s: %w", did, err)
+            }
+            p.mu.Lock()
+            if p.pending[did] == u {
+                delete(p.pending, did)
+            }
+            degradedPending.Set(float64(len(p.pending)))
+            p.mu.Unlock()
+        }
+        logger.Infof("Wrote back %d DID changes made during the outage", len(batch))
+    }
+}
+
+// DegradedStatus reports the pool snapshot, nil without degraded mode
+func (r *Router) DegradedStatus() map[string]interface{} {
+    if r.breaker == nil || r.breaker.pool == nil {
+        return nil
+    }
+    p := r.breaker.pool
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    free := 0
+    for _, d := range p.dids {
+        if !d.inUse {
+            free++
+        }
+    }
+    return map[string]interface{}{
+        "active":              r.breaker.isOpen(),
+        "snapshot_dids":       len(p.dids),
+        "snapshot_free":       free,
+        "snapshot_taken_at":   p.takenAt,
+        "pending_did_updates": len(p.pending),
+    }
+}
+
+// inMemory reports whether DIDs come from the snapshot
+func (b *dbBreaker) inMemory() bool {
+    return b != nil && b.pool != nil && b.isOpen()
+}
+
+func (b *dbBreaker) isOpen() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.open
+}
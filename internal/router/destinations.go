@@ -0,0 +1,73 @@
+package router
+
+import (
+    "context"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/numplan"
+)
+
+// Every call is labelled with its destination - country, region and line
+// type of the DNIS - from the embedded numbering plan. The label is kept
+// on the call record and its CDR and feeds the destination report. With
+// CountryFromNumberPlan, a DNIS (or ANI) that CountryPrefixes does not map
+// takes its ISO country from the plan for DID country matching, so a dids
+// table keyed by ISO code needs no prefix list.
+//
+// destinationOf labels number, the zero Destination if the plan cannot.
+// National numbers are read against E164HomeCountry.
+func (r *Router) destinationOf(number string) models.Destination {
+    digits, ok := internationalDigits(number, r.config.E164HomeCountry)
+    if !ok {
+        return models.Destination{}
+    }
+    d, _ := numplan.Lookup(digits)
+    return d
+}
+
+// LookupDestination labels a number as the router would label a call to it
+func (r *Router) LookupDestination(number string) (models.Destination, bool) {
+    d := r.destinationOf(number)
+    return d, d.Country != ""
+}
+
+// planCountry is the ISO country of a call from the numbering plan
+func (r *Router) planCountry(ani, dnis string) string {
+    for _, number := range []string{dnis, ani} {
+        if d := r.destinationOf(number); d.Country != "" {
+            return d.Country
+        }
+    }
+    return ""
+}
+
+// DestinationReport reports calls and minutes per destination for calls
+// started in [from, to), busiest first. Calls from before destinations
+// were recorded are counted under an empty country.
+func (r *Router) DestinationReport(ctx context.Context, from, to time.Time) ([]models.DestinationUsage, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT COALESCE(dest_country, ''), COALESCE(dest_region, ''), COALESCE(dest_type, ''),
+            COUNT(*), SUM(CASE WHEN status = 'COMPLETED_AT_S4' THEN 1 ELSE 0 END), COALESCE(SUM(duration), 0) / 60
+        FROM call_records
+        WHERE start_time >= ? AND start_time < ?
+        GROUP BY 1, 2, 3
+        ORDER BY 4 DESC, 1, 2, 3
+    `, from, to)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    report := []models.DestinationUsage{}
+    for rows.Next() {
+        var u models.DestinationUsage
+        if err := rows.Scan(&u.Country, &u.Region, &u.Type, &u.Calls, &u.Completed, &u.Minutes); err != nil {
+            return nil, err
+        }
+        report = append(report, u)
+    }
+    return report, rows.Err()
+}
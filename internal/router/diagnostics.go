@@ -0,0 +1,390 @@
+package router
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "net/http"
+    "os"
+    "path/filepath"
+    "runtime"
+    "runtime/pprof"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Incidents on the routing path are often over before anyone can attach a
+// profiler. With diagnostics on, every routing request is measured, and
+// when the p99 latency or the error rate over the last window breaches its
+// SLO the router captures a bundle while the incident is still under way:
+//
+//	summary.json   what tripped, the window's figures and the thresholds
+//	cpu.pprof      CPU profile over CPUProfile
+//	heap.pprof     heap profile
+//	goroutine.txt  every goroutine's stack
+//	logs.txt       the last lines logged
+//
+// Bundles are tar.gz files in Dir, the oldest pruned past Keep, and are
+// POSTed to UploadURL when one is set. After a capture the next waits for
+// Cooldown, so a long incident leaves one bundle rather than hundreds.
+const (
+    diagnosticsPrefix     = "s2-diagnostics-"
+    diagnosticsCheckEvery = 10 * time.Second
+    sloMinSamples         = 50    // fewer requests in the window say nothing
+    sloMaxSamples         = 50000 // ring size bounding memory at high CPS
+)
+
+var (
+    sloP99 = metrics.NewGauge("s2_slo_routing_p99_seconds",
+        "Routing p99 latency over the diagnostics SLO window")
+    sloErrorRatio = metrics.NewGauge("s2_slo_routing_error_ratio",
+        "Share of routing requests failing on S2's side over the diagnostics SLO window")
+    diagnosticsBundles = metrics.NewCounter("s2_diagnostics_bundles_total",
+        "Diagnostics bundles captured by trigger (latency or error_rate) and result (ok or error)", "trigger", "result")
+)
+
+// DiagnosticsConfig enables SLO-triggered diagnostics bundles
+type DiagnosticsConfig struct {
+    Dir        string        // bundles are written here, "" disables diagnostics
+    P99Latency time.Duration // routing p99 that triggers a capture, 0 disables the latency SLO
+    ErrorRate  float64       // share of failed routing requests (0-1) that triggers a capture, 0 disables
+    Window     time.Duration // what the SLOs are measured over, 0 means 1m
+    CPUProfile time.Duration // length of the CPU profile, 0 means 10s
+    Cooldown   time.Duration // least time between captures, 0 means 15m
+    Keep       int           // bundles kept in Dir, 0 means 10
+    UploadURL  string        // bundles are also POSTed here, "" keeps them local
+}
+
+// Errors that are the caller's doing, not S2 failing, and so spend none of
+// the error budget
+var sloExempt = []error{
+    ErrMissingCallID, ErrMalformedNumber, ErrInvalidTags, ErrInvalidPool, ErrInvalidSource,
+    ErrBlockedCaller, ErrUnknownTenant, ErrANIMismatch,
+}
+
+type sloSample struct {
+    at      time.Time
+    seconds float64
+    failed  bool
+}
+
+// sloTracker holds the latest routing requests and the capture history
+type sloTracker struct {
+    mu      sync.Mutex
+    samples []sloSample
+    next    int
+
+    captures    int
+    lastCapture time.Time
+    lastBundle  string
+    lastReason  string
+    lastError   string
+}
+
+func (c *DiagnosticsConfig) withDefaults() DiagnosticsConfig {
+    cfg := *c
+    if cfg.Window <= 0 {
+        cfg.Window = time.Minute
+    }
+    if cfg.CPUProfile <= 0 {
+        cfg.CPUProfile = 10 * time.Second
+    }
+    if cfg.Cooldown <= 0 {
+        cfg.Cooldown = 15 * time.Minute
+    }
+    if cfg.Keep <= 0 {
+        cfg.Keep = 10
+    }
+    return cfg
+}
+
+// observeRouting records one routing request against the SLOs
+func (r *Router) observeRouting(elapsed time.Duration, err error) {
+    if r.config.Diagnostics.Dir == "" {
+        return
+    }
+    failed := err != nil
+    for _, exempt := range sloExempt {
+        if failed && errors.Is(err, exempt) {
+            failed = false
+        }
+    }
+    s := &r.slo
+    s.mu.Lock()
+    sample := sloSample{at: r.clock.Now(), seconds: elapsed.Seconds(), failed: failed}
+    if len(s.samples) < sloMaxSamples {
+        s.samples = append(s.samples, sample)
+    } else {
+        s.samples[s.next] = sample
+        s.next = (s.next + 1) % sloMaxSamples
+    }
+    s.mu.Unlock()
+}
+
+// sloWindow returns the request count, p99 latency and error rate over
+// the window ending now
+func (r *Router) sloWindow(window time.Duration) (int, float64, float64) {
+    since := r.clock.Now().Add(-window)
+    s := &r.slo
+    s.mu.Lock()
+    latencies := make([]float64, 0, len(s.samples))
+    failed := 0
+    for _, sample := range s.samples {
+        if sample.at.Before(since) {
+            continue
+        }
+        latencies = append(latencies, sample.seconds)
+        if sample.failed {
+            failed++
+        }
+    }
+    s.mu.Unlock()
+
+    if len(latencies) == 0 {
+        return 0, 0, 0
+    }
+    sort.Float64s(latencies)
+    p99 := latencies[int(math.Ceil(0.99*float64(len(latencies))))-1]
+    return len(latencies), p99, float64(failed) / float64(len(latencies))
+}
+
+// checkSLOs captures a bundle when an SLO is breached and the cooldown
+// since the last capture has passed
+func (r *Router) checkSLOs() error {
+    cfg := r.config.Diagnostics.withDefaults()
+    n, p99, errorRate := r.sloWindow(cfg.Window)
+    sloP99.Set(p99)
+    sloErrorRatio.Set(errorRate)
+    if n < sloMinSamples {
+        return nil
+    }
+
+    var trigger, reason string
+    switch {
+    case cfg.P99Latency > 0 && p99 > cfg.P99Latency.Seconds():
+        trigger = "latency"
+        reason = fmt.Sprintf("routing p99 %.0fms breaches the %s SLO", p99*1000, cfg.P99Latency)
+    case cfg.ErrorRate > 0 && errorRate > cfg.ErrorRate:
+        trigger = "error_rate"
+        reason = fmt.Sprintf("routing error rate %.1f%% breaches the %.1f%% SLO", errorRate*100, cfg.ErrorRate*100)
+    default:
+        return nil
+    }
+
+    s := &r.slo
+    s.mu.Lock()
+    cooling := !s.lastCapture.IsZero() && r.since(s.lastCapture) < cfg.Cooldown
+    if !cooling {
+        s.lastCapture = r.clock.Now()
+    }
+    s.mu.Unlock()
+    if cooling {
+        return nil
+    }
+
+    logger.Warnf("ALERT: %s over the last %s (%d requests), capturing diagnostics", reason, cfg.Window, n)
+    summary := map[string]interface{}{
+        "reason":           reason,
+        "trigger":          trigger,
+        "captured_at":      r.clock.Now().UTC().Format(time.RFC3339),
+        "window":           cfg.Window.String(),
+        "requests":         n,
+        "p99_ms":           math.Round(p99*10000) / 10,
+        "error_rate":       errorRate,
+        "slo_p99_ms":       cfg.P99Latency.Milliseconds(),
+        "slo_error_rate":   cfg.ErrorRate,
+        "goroutines":       runtime.NumGoroutine(),
+        "go_version":       runtime.Version(),
+        "active_calls":     r.activeCallCount(),
+        "cpu_profile_secs": cfg.CPUProfile.Seconds(),
+    }
+    path, err := r.captureDiagnostics(cfg, summary)
+
+    s.mu.Lock()
+    s.captures++
+    s.lastReason = reason
+    s.lastError = ""
+    if err != nil {
+        s.lastError = err.Error()
+    } else {
+        s.lastBundle = path
+    }
+    s.mu.Unlock()
+    if err != nil {
+        diagnosticsBundles.Inc(trigger, "error")
+        return fmt.Errorf("capturing diagnostics: %w", err)
+    }
+    diagnosticsBundles.Inc(trigger, "ok")
+    logger.Infof("Diagnostics bundle written to %s", path)
+    r.publish(models.Event{Type: "diagnostics.captured", Detail: reason})
+
+    if cfg.UploadURL != "" {
+        if err := uploadDiagnostics(cfg.UploadURL, path); err != nil {
+            logger.Errorf("Failed to upload diagnostics bundle %s: %v", path, err)
+        }
+    }
+    return nil
+}
+
+func (r *Router) activeCallCount() int {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return len(r.activeCallsMap)
+}
+
+// captureDiagnostics writes a bundle and prunes the old ones. The CPU
+// profile is cut short if the router closes meanwhile.
+func (r *Router) captureDiagnostics(cfg DiagnosticsConfig, summary map[string]interface{}) (string, error) {
+    if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+        return "", err
+    }
+
+    var problems []string
+    var cpu bytes.Buffer
+    if err := pprof.StartCPUProfile(&cpu); err != nil {
+        // Most likely a profile someone started by hand; the rest is still worth having
+        problems = append(problems, "cpu profile: "+err.Error())
+    } else {
+        select {
+        case <-time.After(cfg.CPUProfile):
+        case <-r.life.Context().Done():
+        }
+        pprof.StopCPUProfile()
+    }
+    var heap, goroutines, logs bytes.Buffer
+    if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+        problems = append(problems, "heap profile: "+err.Error())
+    }
+    pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+    logging.WriteRecent(&logs)
+    if len(problems) > 0 {
+        summary["problems"] = problems
+    }
+    summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+    if err != nil {
+        return "", err
+    }
+
+    now := r.clock.Now()
+    name := diagnosticsPrefix + now.UTC().Format("20060102T150405Z") + ".tar.gz"
+    path := filepath.Join(cfg.Dir, name)
+    f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+    if err != nil {
+        return "", err
+    }
+    gz := gzip.NewWriter(f)
+    tw := tar.NewWriter(gz)
+    files := []struct {
+        name string
+        data []byte
+    }{
+        {"summary.json", summaryJSON},
+        {"cpu.pprof", cpu.Bytes()},
+        {"heap.pprof", heap.Bytes()},
+        {"goroutine.txt", goroutines.Bytes()},
+        {"logs.txt", logs.Bytes()},
+    }
+    for _, file := range files {
+        if err == nil {
+            err = tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0o600, Size: int64(len(file.data)), ModTime: now})
+        }
+        if err == nil {
+            _, err = tw.Write(file.data)
+        }
+    }
+    for _, closer := range []interface{ Close() error }{tw, gz, f} {
+        if cerr := closer.Close(); err == nil {
+            err = cerr
+        }
+    }
+    if err == nil {
+        err = os.Rename(path+".tmp", path)
+    }
+    if err != nil {
+        os.Remove(path + ".tmp")
+        return "", err
+    }
+
+    pruneDiagnostics(cfg.Dir, cfg.Keep)
+    return path, nil
+}
+
+// pruneDiagnostics deletes all but the newest keep bundles
+func pruneDiagnostics(dir string, keep int) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return
+    }
+    var bundles []string
+    for _, e := range entries {
+        if strings.HasPrefix(e.Name(), diagnosticsPrefix) && strings.HasSuffix(e.Name(), ".tar.gz") {
+            bundles = append(bundles, e.Name())
+        }
+    }
+    // Names sort by capture time
+    sort.Strings(bundles)
+    for len(bundles) > keep {
+        os.Remove(filepath.Join(dir, bundles[0]))
+        bundles = bundles[1:]
+    }
+}
+
+func uploadDiagnostics(url, path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    req, err := http.NewRequest(http.MethodPost, url, f)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/gzip")
+    req.Header.Set("X-S2-Bundle", filepath.Base(path))
+    resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("upload returned %s", resp.Status)
+    }
+    return nil
+}
+
+// DiagnosticsStatus reports the SLO figures and the last capture, nil
+// when diagnostics are off
+func (r *Router) DiagnosticsStatus() *models.Diagnostics {
+    if r.config.Diagnostics.Dir == "" {
+        return nil
+    }
+    cfg := r.config.Diagnostics.withDefaults()
+    n, p99, errorRate := r.sloWindow(cfg.Window)
+    status := &models.Diagnostics{
+        Requests:  n,
+        P99Millis: math.Round(p99*10000) / 10,
+        ErrorRate: math.Round(errorRate*10000) / 10000,
+    }
+    s := &r.slo
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    status.Captures = s.captures
+    status.LastBundle = s.lastBundle
+    status.LastReason = s.lastReason
+    status.LastError = s.lastError
+    if !s.lastCapture.IsZero() {
+        at := s.lastCapture
+        status.LastCapture = &at
+    }
+    return status
+}
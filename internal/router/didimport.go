@@ -0,0 +1,229 @@
+package router
+
+import (
+    "context"
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    // Largest import accepted in one file; split bigger seeds
+    maxImportRows = 100000
+
+    // Rows checked and inserted per statement
+    importBatchSize = 500
+
+    // Row errors listed in the report; the counts stay exact beyond it
+    maxImportErrors = 100
+)
+
+// importRow is a validated CSV row waiting to be inserted
+type importRow struct {
+    line    int
+    did     string
+    country string
+    tags    map[string]string
+}
+
+// ImportDIDs adds the numbers of a CSV file with the columns did, country
+// and tags to the pool of tenant ("" for the default pool), in the named
+// pool if one is given. A did,country,tags header row is optional; tags are
+// written as key=value;key=value.
+// Rows that repeat an earlier row or a DID already in the database are
+// skipped and counted. dryRun validates and counts without inserting.
+func (r *Router) ImportDIDs(ctx context.Context, src io.Reader, tenant, pool string, dryRun bool) (*models.DIDImport, error) {
+    if r.config.ReadOnly && !dryRun {
+        return nil, ErrReadOnly
+    }
+    if tenant != "" && r.tenantByID(tenant) == nil {
+        return nil, fmt.Errorf("tenant %s not found", tenant)
+    }
+    if len(pool) > maxPoolLen {
+        return nil, fmt.Errorf("pool must be at most %d characters", maxPoolLen)
+    }
+
+    report := &models.DIDImport{DryRun: dryRun}
+    reject := func(line int, did string, err error) {
+        report.Invalid++
+        if len(report.Errors) < maxImportErrors {
+            report.Errors = append(report.Errors, models.DIDImportError{Line: line, DID: did, Error: err.Error()})
+        }
+    }
+
+    reader := csv.NewReader(src)
+    reader.FieldsPerRecord = -1
+    reader.TrimLeadingSpace = true
+    reader.Comment = '#'
+
+    var rows []importRow
+    seen := make(map[string]bool)
+    for first := true; ; first = false {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        var parseErr *csv.ParseError
+        if errors.As(err, &parseErr) {
+            reject(parseErr.Line, "", parseErr.Err)
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        if first && isImportHeader(record) {
+            continue
+        }
+        line, _ := reader.FieldPos(0)
+        report.TotalRows++
+        if report.TotalRows > maxImportRows {
+            return nil, fmt.Errorf("import exceeds %d rows", maxImportRows)
+        }
+
+        row, err := parseImportRow(line, record)
+        if err == nil {
+            _, err = r.toE164("did", row.did)
+        }
+        if err != nil {
+            reject(line, row.did, err)
+            continue
+        }
+        if seen[row.did] {
+            report.Duplicates++
+            continue
+        }
+        seen[row.did] = true
+        rows = append(rows, row)
+    }
+
+    for start := 0; start < len(rows); start += importBatchSize {
+        end := start + importBatchSize
+        if end > len(rows) {
+            end = len(rows)
+        }
+        imported, existing, err := r.importBatch(ctx, rows[start:end], tenant, pool, dryRun)
+        if err != nil {
+            return nil, fmt.Errorf("import stopped at line %d after %d DIDs: %w", rows[start].line, report.Imported, err)
+        }
+        report.Imported += imported
+        report.Existing += existing
+    }
+
+    if !dryRun {
+        logger.Infof("Imported %d DIDs (%d duplicate, %d existing, %d invalid rows)",
+            report.Imported, report.Duplicates, report.Existing, report.Invalid)
+    }
+    return report, nil
+}
+
+// isImportHeader reports whether a first row names the columns
+func isImportHeader(record []string) bool {
+    return len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "did")
+}
+
+// parseImportRow validates one CSV record
+func parseImportRow(line int, record []string) (importRow, error) {
+    row := importRow{line: line, did: strings.TrimSpace(record[0])}
+    if len(record) > 3 {
+        return row, fmt.Errorf("expected at most 3 columns, got %d", len(record))
+    }
+    if len(record) > 1 {
+        row.country = strings.TrimSpace(record[1])
+    }
+
+    digits := strings.TrimPrefix(row.did, "+")
+    if !isDigits(digits) || len(row.did) > 50 {
+        return row, fmt.Errorf("DID must be digits with an optional leading +, at most 50 characters")
+    }
+    if len(row.country) > 50 {
+        return row, fmt.Errorf("country exceeds 50 characters")
+    }
+    if len(record) > 2 {
+        tags, err := parseImportTags(record[2])
+        if err != nil {
+            return row, err
+        }
+        row.tags = tags
+    }
+    return row, nil
+}
+
+// parseImportTags reads key=value;key=value
+func parseImportTags(v string) (map[string]string, error) {
+    v = strings.TrimSpace(v)
+    if v == "" {
+        return nil, nil
+    }
+    tags := make(map[string]string)
+    for _, pair := range strings.Split(v, ";") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        key, value, ok := strings.Cut(pair, "=")
+        if !ok {
+            return nil, fmt.Errorf("%w: %q is not key=value", ErrInvalidTags, pair)
+        }
+        tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+    }
+    if err := ValidateTags(tags); err != nil {
+        return nil, err
+    }
+    return tags, nil
+}
+
+// importBatch skips the rows whose DID already exists and inserts the rest.
+// INSERT IGNORE covers a number added between the check and the insert,
+// which is then counted as existing too.
+func (r *Router) importBatch(ctx context.Context, rows []importRow, tenant, pool string, dryRun bool) (imported, existing int, err error) {
+    args := make([]interface{}, len(rows))
+    for i, row := range rows {
+        args[i] = row.did
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(rows)), ",")
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.QueryContext(ctx, "SELECT did FROM dids WHERE did IN ("+placeholders+")", args...)
+    if err != nil {
+        return 0, 0, err
+    }
+    present := make(map[string]bool)
+    for result.Next() {
+        var did string
+        if err := result.Scan(&did); err == nil {
+            present[did] = true
+        }
+    }
+    result.Close()
+    if err := result.Err(); err != nil {
+        return 0, 0, err
+    }
+
+    values := make([]string, 0, len(rows))
+    args = args[:0]
+    for _, row := range rows {
+        if present[row.did] {
+            existing++
+            continue
+        }
+        values = append(values, "(?, 0, NULLIF(?, ''), ?, ?, ?)")
+        args = append(args, row.did, row.country, encodeTags(row.tags), tenant, pool)
+    }
+    if len(values) == 0 || dryRun {
+        return len(values), existing, nil
+    }
+
+    res, err := r.db.ExecContext(ctx, `
+        INSERT IGNORE INTO dids (did, in_use, country, tags, tenant_id, pool)
+        VALUES `+strings.Join(values, ", "), args...)
+    if err != nil {
+        return 0, 0, err
+    }
+    n, _ := res.RowsAffected()
+    return int(n), existing + len(values) - int(n), nil
+}
@@ -0,0 +1,162 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// With DIDWait set, a call finding its pool exhausted waits for a DID
+// instead of failing straight away. Waiters are served highest tenant
+// priority first, then in arrival order. A hangup wakes the first waiter;
+// if the freed DID is not one it can take (another pool, its cooldown,
+// another router got it) it hands the wake-up on to the next. Waiters also
+// retry every didWaitPoll, which catches cooldowns running out and DIDs
+// freed by other routers or added to the pool.
+const didWaitPoll = 250 * time.Millisecond
+
+var (
+    didQueueDepth = metrics.NewGauge("s2_did_wait_queue_depth",
+        "Calls waiting for a DID to be released")
+    didWaits = metrics.NewCounter("s2_did_wait_total",
+        "Calls that waited for a DID by result (allocated, timeout or cancelled)", "result")
+    didWaitSeconds = metrics.NewHistogram("s2_did_wait_seconds",
+        "How long calls waited for a DID", nil)
+)
+
+type didWaiter struct {
+    priority int
+    seq      uint64
+    wake     chan struct{} // buffered, so a wake-up is never lost
+}
+
+// didWaitQueue orders the calls waiting for a DID
+type didWaitQueue struct {
+    mu      sync.Mutex
+    waiters []*didWaiter
+    seq     uint64
+}
+
+func (q *didWaitQueue) join(priority int) *didWaiter {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.seq++
+    w := &didWaiter{priority: priority, seq: q.seq, wake: make(chan struct{}, 1)}
+    i := sort.Search(len(q.waiters), func(i int) bool { return q.waiters[i].priority < priority })
+    q.waiters = append(q.waiters, nil)
+    copy(q.waiters[i+1:], q.waiters[i:])
+    q.waiters[i] = w
+    didQueueDepth.Set(float64(len(q.waiters)))
+    return w
+}
+
+func (q *didWaitQueue) leave(w *didWaiter) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for i, other := range q.waiters {
+        if other == w {
+            q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+            break
+        }
+    }
+    didQueueDepth.Set(float64(len(q.waiters)))
+    // A wake-up w took but could not use belongs to the next in line
+    select {
+    case <-w.wake:
+        q.wakeFrom(0)
+    default:
+    }
+}
+
+// notify wakes the first waiter not already woken, after a DID is released
+func (q *didWaitQueue) notify() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.wakeFrom(0)
+}
+
+// passOn wakes the first waiter behind w not already woken, after w could
+// not use the DID it was woken for
+func (q *didWaitQueue) passOn(w *didWaiter) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for i, other := range q.waiters {
+        if other == w {
+            q.wakeFrom(i + 1)
+            return
+        }
+    }
+}
+
+// wakeFrom wakes the first waiter from index i on not already woken.
+// Caller must hold q.mu.
+func (q *didWaitQueue) wakeFrom(i int) {
+    for ; i < len(q.waiters); i++ {
+        select {
+        case q.waiters[i].wake <- struct{}{}:
+            return
+        default:
+        }
+    }
+}
+
+func (q *didWaitQueue) depth() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return len(q.waiters)
+}
+
+// awaitDID queues the call for up to DIDWait and claims a DID matching f
+// as soon as one is free
+func (r *Router) awaitDID(ctx context.Context, destination string, f DIDFilter, tenant *models.Tenant) (string, error) {
+    priority := 0
+    if tenant != nil {
+        priority = tenant.Priority
+    }
+    w := r.didQueue.join(priority)
+    defer r.didQueue.leave(w)
+    started := r.clock.Now()
+    deadline := time.NewTimer(r.config.DIDWait)
+    defer deadline.Stop()
+    poll := time.NewTicker(didWaitPoll)
+    defer poll.Stop()
+
+    result := "allocated"
+    defer func() {
+        didWaits.Inc(result)
+        didWaitSeconds.Observe(r.since(started).Seconds())
+    }()
+    for {
+        var err error
+        select {
+        case <-w.wake:
+        case <-poll.C:
+        case <-deadline.C:
+            result, err = "timeout", fmt.Errorf("%w after waiting %s", ErrNoAvailableDIDs, r.config.DIDWait)
+        case <-ctx.Done():
+            result, err = "cancelled", ctx.Err()
+        }
+        if err != nil {
+            return "", err
+        }
+        if r.Draining() {
+            result = "cancelled"
+            return "", ErrDraining
+        }
+
+        did, err := r.allocateDID(ctx, destination, f)
+        if !errors.Is(err, ErrNoAvailableDIDs) {
+            if err != nil {
+                result = "cancelled"
+            }
+            return did, err
+        }
+        r.didQueue.passOn(w)
+    }
+}
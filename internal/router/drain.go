@@ -0,0 +1,79 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// ErrDraining is returned for new calls once shutdown has begun; another
+// router should take them
+var ErrDraining = errors.New("router is draining for shutdown")
+
+// How often Drain checks whether the remaining calls have settled
+const drainPollInterval = 500 * time.Millisecond
+
+// Draining reports whether the router has stopped taking new calls
+func (r *Router) Draining() bool {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.draining
+}
+
+// Drain stops accepting new calls, waits up to timeout for the calls in
+// flight to finish and flushes what is left so the next start can restore
+// it. Return legs and hangups for existing calls are still served meanwhile.
+func (r *Router) Drain(timeout time.Duration) {
+    r.mu.Lock()
+    r.draining = true
+    active := len(r.activeCallsMap) + len(r.admissions)
+    r.mu.Unlock()
+    logger.Infof("Draining: refusing new calls, waiting up to %s for %d active calls", timeout, active)
+
+    ticker := r.clock.NewTicker(drainPollInterval)
+    defer ticker.Stop()
+    deadline := r.clock.Now().Add(timeout)
+    for active > 0 && r.clock.Now().Before(deadline) {
+        <-ticker.C()
+        r.mu.RLock()
+        active = len(r.activeCallsMap) + len(r.admissions)
+        r.mu.RUnlock()
+    }
+
+    if active > 0 {
+        logger.Infof("Drain timed out with %d calls still active", active)
+    } else {
+        logger.Infof("Drained: no active calls")
+    }
+    r.flushState()
+}
+
+// flushState writes the in-memory view of unfinished calls back to the
+// database and pushes out buffered webhooks and spans
+func (r *Router) flushState() {
+    if !r.config.ReadOnly {
+        // Copied under the lock, written after it so hangups are not held up
+        r.mu.RLock()
+        statuses := make(map[string]models.CallState, len(r.activeCallsMap))
+        for callID, record := range r.activeCallsMap {
+            statuses[callID] = record.Status
+        }
+        r.mu.RUnlock()
+        for callID, status := range statuses {
+            r.updateCallStatus(context.Background(), callID, status)
+        }
+
+        if len(r.config.WebhookURLs) > 0 {
+            if err := r.deliverWebhooks(); err != nil {
+                logger.Errorf("Failed to flush webhooks: %v", err)
+            }
+        }
+    }
+    if r.tracer.Exporting() {
+        if err := r.tracer.Flush(); err != nil {
+            logger.Errorf("Failed to flush spans: %v", err)
+        }
+    }
+}
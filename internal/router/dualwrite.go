@@ -0,0 +1,421 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// While v1 and v2 both take calls during a migration they share one DID
+// pool. With dual-write on, v2 mirrors the DIDs it claims and releases into
+// v1's dids table, so neither router hands out a number the other has in
+// use:
+//
+//   - a claim is repeated in v1 as its own conditional UPDATE; a DID v1
+//     already has in use is given back in v2 and allocation moves on to
+//     another DID
+//   - a release frees the DID in v1 too, but only if v2 claimed it there
+//   - writes v1 could not take are retried by the v1-dual-write worker, which
+//     also frees in v1 the DIDs v2 released in bulk (the stale call cleanup)
+//
+// DIDs v1 does not have are left alone. On startup the DIDs v2 has in use
+// are claimed in v1; those v1 already has in use are taken for v2's own
+// from before the restart. v1 is expected to keep its dids table layout:
+// did, in_use, destination, last_used_at.
+const (
+    v1ReconcileInterval = 30 * time.Second
+    v1SeedBatch         = 500
+)
+
+var (
+    v1DualWrites = metrics.NewCounter("s2_v1_dual_writes_total",
+        "DID claims and releases mirrored into v1 by op and result (ok, conflict, error)", "op", "result")
+    v1DualWritePending = metrics.NewGauge("s2_v1_dual_write_pending",
+        "DID states waiting to be written to v1")
+)
+
+// errV1InUse is returned by claimV1 for a DID a v1 call is using
+var errV1InUse = errors.New("DID in use on v1")
+
+// V1DualWriteConfig mirrors DID state into a v1 router during a migration
+type V1DualWriteConfig struct {
+    DSN               string        // v1 router database, empty disables dual-write
+    ReconcileInterval time.Duration // between retries of writes v1 refused, 0 means 30s
+}
+
+// v1Write is the state a DID should have in v1
+type v1Write struct {
+    inUse       bool
+    destination string
+}
+
+// v1Mirror is the Storage of a router in dual-write mode: the v2 backend,
+// with DID claims and releases repeated in v1
+type v1Mirror struct {
+    Storage
+    v1      *sql.DB
+    v2      *sql.DB
+    timeout time.Duration
+    clock   clock.Clock
+
+    mu        sync.Mutex
+    held      map[string]bool    // DIDs claimed in v1 on v2's behalf
+    pending   map[string]v1Write // writes v1 has not taken yet, latest per DID
+    conflicts int64
+    lastSync  time.Time
+    lastError string
+}
+
+// startV1DualWrite opens the v1 database, claims in it the DIDs v2 has in
+// use and wraps r.store
+func (r *Router) startV1DualWrite(cfg V1DualWriteConfig) error {
+    v1, err := sql.Open("mysql", cfg.DSN)
+    if err != nil {
+        return fmt.Errorf("v1 database: %w", err)
+    }
+    if err := v1.Ping(); err != nil {
+        v1.Close()
+        return fmt.Errorf("v1 database: %w", err)
+    }
+    v1.SetMaxOpenConns(5)
+    v1.SetConnMaxLifetime(5 * time.Minute)
+
+    m := &v1Mirror{
+        Storage: r.store,
+        v1:      v1,
+        v2:      r.db,
+        timeout: r.config.QueryTimeout,
+        clock:   r.clock,
+        held:    make(map[string]bool),
+        pending: make(map[string]v1Write),
+    }
+    if err := m.seed(); err != nil {
+        v1.Close()
+        return fmt.Errorf("v1 dual-write: %w", err)
+    }
+    r.v1 = m
+    r.store = m
+    logger.Infof("Dual-write to v1 enabled: %d DIDs in use on v2 held in v1", len(m.held))
+    return nil
+}
+
+// seed claims in v1 the DIDs v2 has in use
+func (m *v1Mirror) seed() error {
+    ctx, cancel := withQueryTimeout(context.Background(), m.timeout)
+    defer cancel()
+    rows, err := m.v2.QueryContext(ctx, "SELECT did FROM dids WHERE in_use = 1")
+    if err != nil {
+        return err
+    }
+    var dids []interface{}
+    for rows.Next() {
+        var did string
+        if err := rows.Scan(&did); err == nil {
+            dids = append(dids, did)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for start := 0; start < len(dids); start += v1SeedBatch {
+        end := start + v1SeedBatch
+        if end > len(dids) {
+            end = len(dids)
+        }
+        batch := dids[start:end]
+        placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+        if _, err := m.v1.ExecContext(ctx, "UPDATE dids SET in_use = 1, last_used_at = NOW() WHERE did IN ("+placeholders+")", batch...); err != nil {
+            return err
+        }
+        present, err := m.v1.QueryContext(ctx, "SELECT did FROM dids WHERE did IN ("+placeholders+")", batch...)
+        if err != nil {
+            return err
+        }
+        for present.Next() {
+            var did string
+            if err := present.Scan(&did); err == nil {
+                m.held[did] = true
+            }
+        }
+        present.Close()
+        if err := present.Err(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (m *v1Mirror) ClaimDID(ctx context.Context, did, destination string) (bool, error) {
+    claimed, err := m.Storage.ClaimDID(ctx, did, destination)
+    if err != nil || !claimed {
+        return claimed, err
+    }
+    return m.mirrorClaim(ctx, did, destination)
+}
+
+func (m *v1Mirror) InsertClaimedDID(ctx context.Context, did, destination, country, tenant string) (bool, error) {
+    claimed, err := m.Storage.InsertClaimedDID(ctx, did, destination, country, tenant)
+    if err != nil || !claimed {
+        return claimed, err
+    }
+    return m.mirrorClaim(ctx, did, destination)
+}
+
+func (m *v1Mirror) ReleaseDID(ctx context.Context, did, callID string) (bool, error) {
+    if released, err := m.Storage.ReleaseDID(ctx, did, callID); err != nil || !released {
+        return released, err
+    }
+    m.mu.Lock()
+    held := m.held[did]
+    if w, queued := m.pending[did]; queued && w.inUse {
+        // v1 never took the claim; a v1 call may have the DID by now
+        delete(m.pending, did)
+        delete(m.held, did)
+        held = false
+        v1DualWritePending.Set(float64(len(m.pending)))
+    }
+    m.mu.Unlock()
+    if !held {
+        return true, nil
+    }
+
+    if err := m.releaseV1(ctx, did); err != nil {
+        m.queue(did, v1Write{}, err)
+        v1DualWrites.Inc("release", "error")
+        return true, nil
+    }
+    m.mu.Lock()
+    delete(m.held, did)
+    delete(m.pending, did)
+    v1DualWritePending.Set(float64(len(m.pending)))
+    m.mu.Unlock()
+    v1DualWrites.Inc("release", "ok")
+    return true, nil
+}
+
+// mirrorClaim repeats a v2 claim in v1. A DID v1 is using is given back so
+// the caller picks another; v1 being unreachable does not fail the call,
+// the claim is retried instead.
+func (m *v1Mirror) mirrorClaim(ctx context.Context, did, destination string) (bool, error) {
+    held, err := m.claimV1(ctx, did, destination)
+    switch {
+    case err == errV1InUse:
+        v1DualWrites.Inc("claim", "conflict")
+        m.mu.Lock()
+        m.conflicts++
+        m.mu.Unlock()
+        logger.Call("", did, "").Context(ctx).Infof("DID %s is in use on v1, giving it back", did)
+        if _, err := m.Storage.ReleaseDID(ctx, did, ""); err != nil {
+            return false, err
+        }
+        return false, nil
+    case err != nil:
+        v1DualWrites.Inc("claim", "error")
+        m.queue(did, v1Write{inUse: true, destination: destination}, err)
+        return true, nil
+    }
+    v1DualWrites.Inc("claim", "ok")
+    m.mu.Lock()
+    if held {
+        m.held[did] = true
+    }
+    delete(m.pending, did)
+    v1DualWritePending.Set(float64(len(m.pending)))
+    m.mu.Unlock()
+    return true, nil
+}
+
+// queue queues a write v1 refused for the reconcile worker. A queued claim
+// counts as held, so a release before the retry is queued as well.
+func (m *v1Mirror) queue(did string, w v1Write, err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.pending[did] = w
+    if w.inUse {
+        m.held[did] = true
+    }
+    m.lastError = err.Error()
+    v1DualWritePending.Set(float64(len(m.pending)))
+    logger.Warnf("Dual-write to v1 failed for DID %s, will retry: %v", did, err)
+}
+
+// claimV1 marks did in use in v1. held is false for a DID v1 does not have.
+func (m *v1Mirror) claimV1(ctx context.Context, did, destination string) (held bool, err error) {
+    ctx, cancel := withQueryTimeout(ctx, m.timeout)
+    defer cancel()
+    res, err := m.v1.ExecContext(ctx, `
+        UPDATE dids SET in_use = 1, destination = ?, last_used_at = NOW()
+        WHERE did = ? AND in_use = 0
+    `, destination, did)
+    if err != nil {
+        return false, err
+    }
+    if n, _ := res.RowsAffected(); n > 0 {
+        return true, nil
+    }
+    var inUse bool
+    err = m.v1.QueryRowContext(ctx, "SELECT in_use FROM dids WHERE did = ?", did).Scan(&inUse)
+    switch {
+    case err == sql.ErrNoRows:
+        return false, nil
+    case err != nil:
+        return false, err
+    case inUse:
+        return false, errV1InUse
+    }
+    // Freed in between; claim it again next round
+    return false, fmt.Errorf("DID %s changed on v1 during the claim", did)
+}
+
+func (m *v1Mirror) releaseV1(ctx context.Context, did string) error {
+    ctx, cancel := withQueryTimeout(ctx, m.timeout)
+    defer cancel()
+    _, err := m.v1.ExecContext(ctx, "UPDATE dids SET in_use = 0, destination = NULL WHERE did = ?", did)
+    return err
+}
+
+// reconcile retries the writes v1 refused and frees in v1 the held DIDs v2
+// has released without going through ReleaseDID
+func (m *v1Mirror) reconcile() error {
+    ctx := context.Background()
+    m.mu.Lock()
+    pending := make(map[string]v1Write, len(m.pending))
+    for did, w := range m.pending {
+        pending[did] = w
+    }
+    held := make([]interface{}, 0, len(m.held))
+    for did := range m.held {
+        if _, queued := m.pending[did]; !queued {
+            held = append(held, did)
+        }
+    }
+    m.mu.Unlock()
+
+    var failed error
+    for did, w := range pending {
+        var err error
+        present := true
+        if w.inUse {
+            present, err = m.claimV1(ctx, did, w.destination)
+        } else {
+            err = m.releaseV1(ctx, did)
+        }
+        op := "release"
+        if w.inUse {
+            op = "claim"
+        }
+        if err == errV1InUse {
+            // The call is already up on v2; all that is left is to say so
+            v1DualWrites.Inc(op, "conflict")
+            logger.Warnf("DID %s is in use on both v1 and v2", did)
+            m.mu.Lock()
+            m.conflicts++
+            m.mu.Unlock()
+            err = nil
+        }
+        if err != nil {
+            v1DualWrites.Inc(op, "error")
+            failed = err
+            continue
+        }
+        v1DualWrites.Inc(op, "ok")
+        m.mu.Lock()
+        if m.pending[did] == w {
+            delete(m.pending, did)
+            if !w.inUse || !present {
+                delete(m.held, did)
+            }
+        }
+        m.mu.Unlock()
+    }
+
+    released, err := m.releasedOnV2(ctx, held)
+    if err != nil {
+        failed = err
+    }
+    for _, did := range released {
+        m.mu.Lock()
+        _, queued := m.pending[did]
+        m.mu.Unlock()
+        if queued {
+            continue
+        }
+        if err := m.releaseV1(ctx, did); err != nil {
+            m.queue(did, v1Write{}, err)
+            v1DualWrites.Inc("release", "error")
+            continue
+        }
+        v1DualWrites.Inc("release", "ok")
+        m.mu.Lock()
+        delete(m.held, did)
+        m.mu.Unlock()
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    v1DualWritePending.Set(float64(len(m.pending)))
+    if failed != nil {
+        m.lastError = failed.Error()
+        return failed
+    }
+    m.lastSync = m.clock.Now()
+    m.lastError = ""
+    return nil
+}
+
+// releasedOnV2 returns those of dids that are free on v2
+func (m *v1Mirror) releasedOnV2(ctx context.Context, dids []interface{}) ([]string, error) {
+    ctx, cancel := withQueryTimeout(ctx, m.timeout)
+    defer cancel()
+    var free []string
+    for start := 0; start < len(dids); start += v1SeedBatch {
+        end := start + v1SeedBatch
+        if end > len(dids) {
+            end = len(dids)
+        }
+        batch := dids[start:end]
+        placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+        rows, err := m.v2.QueryContext(ctx, "SELECT did FROM dids WHERE in_use = 0 AND did IN ("+placeholders+")", batch...)
+        if err != nil {
+            return free, err
+        }
+        for rows.Next() {
+            var did string
+            if err := rows.Scan(&did); err == nil {
+                free = append(free, did)
+            }
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return free, err
+        }
+    }
+    return free, nil
+}
+
+// V1DualWriteStatus reports dual-write to v1, nil when it is off
+func (r *Router) V1DualWriteStatus() *models.V1DualWrite {
+    m := r.v1
+    if m == nil {
+        return nil
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return &models.V1DualWrite{
+        Held:      len(m.held),
+        Pending:   len(m.pending),
+        Conflicts: m.conflicts,
+        LastSync:  m.lastSync,
+        LastError: m.lastError,
+    }
+}
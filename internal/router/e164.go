@@ -0,0 +1,239 @@
+package router
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+// With E164Mode set, numbers that passed input normalization are read
+// against per-country numbering rules and written as E.164 (+, country
+// code, national significant number) before they reach the database or
+// the dialplan. A number is read as:
+//
+//	+CC...          international
+//	<intl>CC...     international, after the home country's
+//	                international prefix (00 unless the rule says otherwise)
+//	<trunk>...      national, after the home country's trunk prefix
+//	CC...           international when a rule's country code starts it
+//	                and the rest has that country's length
+//	...             national when it has the home country's length
+//
+// The national significant number must then have the length its country's
+// rule allows. The modes:
+//
+//	rewrite  numbers of countries with a rule are validated and rewritten;
+//	         others need only be at most 15 digits, and keep their form
+//	         unless written internationally
+//	strict   numbers no rule covers are refused as well
+//
+// DIDs are validated but keep the spelling the dids table holds them in.
+// An ANI may also be withheld (anonymous, restricted, ...), which passes.
+const (
+    E164Off     = ""
+    E164Rewrite = "rewrite"
+    E164Strict  = "strict"
+)
+
+const e164MaxDigits = 15
+
+var (
+    e164Rewritten = metrics.NewCounter("s2_e164_rewritten_total",
+        "Numbers rewritten to E.164 at the API boundary, by field", "field")
+    e164Rejected = metrics.NewCounter("s2_e164_rejected_total",
+        "Numbers refused by E.164 validation, by field and reason", "field", "reason")
+)
+
+// Caller IDs Asterisk and carriers use for a withheld number
+var withheldANIs = map[string]bool{
+    "anonymous":   true,
+    "restricted":  true,
+    "private":     true,
+    "unavailable": true,
+    "unknown":     true,
+}
+
+// numberingRule is one country's plan: the lengths of its national
+// significant numbers and the prefixes used when dialling from it
+type numberingRule struct {
+    countryCode string
+    minLen      int
+    maxLen      int
+    trunk       string // national trunk prefix, e.g. 0
+    intl        string // international prefix, e.g. 00 or 011
+}
+
+// numberingPlan holds the rules, longest country code first
+type numberingPlan struct {
+    mode  string
+    rules []numberingRule
+    home  *numberingRule // nil without a home country
+}
+
+// parseNumberingPlan reads "cc=min[-max][:trunk[:intl]]" rules, e.g.
+// 44=9-10:0 or 1=10:1:011, and the home country national input is read
+// against
+func parseNumberingPlan(mode, home string, entries []string) (*numberingPlan, error) {
+    switch mode {
+    case E164Off, E164Rewrite, E164Strict:
+    default:
+        return nil, fmt.Errorf("invalid E.164 mode %q (rewrite or strict)", mode)
+    }
+    plan := &numberingPlan{mode: mode}
+    seen := make(map[string]bool)
+    for _, entry := range entries {
+        rule, err := parseNumberingRule(entry)
+        if err != nil {
+            return nil, err
+        }
+        if seen[rule.countryCode] {
+            return nil, fmt.Errorf("numbering rule for country code %s given twice", rule.countryCode)
+        }
+        seen[rule.countryCode] = true
+        plan.rules = append(plan.rules, rule)
+    }
+    sort.Slice(plan.rules, func(i, j int) bool { return len(plan.rules[i].countryCode) > len(plan.rules[j].countryCode) })
+
+    if home != "" {
+        for i := range plan.rules {
+            if plan.rules[i].countryCode == home {
+                plan.home = &plan.rules[i]
+            }
+        }
+        if plan.home == nil {
+            return nil, fmt.Errorf("home country code %s has no numbering rule", home)
+        }
+    }
+    if mode == E164Strict && len(plan.rules) == 0 {
+        return nil, fmt.Errorf("strict E.164 mode needs numbering rules")
+    }
+    return plan, nil
+}
+
+func parseNumberingRule(entry string) (numberingRule, error) {
+    invalid := fmt.Errorf("invalid numbering rule %q, expected cc=min[-max][:trunk[:intl]]", entry)
+    cc, spec, ok := strings.Cut(strings.TrimSpace(entry), "=")
+    if !ok || !isDigits(cc) || len(cc) > 3 {
+        return numberingRule{}, invalid
+    }
+    fields := strings.Split(spec, ":")
+    if len(fields) > 3 {
+        return numberingRule{}, invalid
+    }
+    rule := numberingRule{countryCode: cc, intl: "00"}
+    lo, hi, ranged := strings.Cut(fields[0], "-")
+    var err error
+    if rule.minLen, err = strconv.Atoi(lo); err != nil {
+        return numberingRule{}, invalid
+    }
+    rule.maxLen = rule.minLen
+    if ranged {
+        if rule.maxLen, err = strconv.Atoi(hi); err != nil {
+            return numberingRule{}, invalid
+        }
+    }
+    if rule.minLen < 1 || rule.maxLen < rule.minLen || len(cc)+rule.maxLen > e164MaxDigits {
+        return numberingRule{}, fmt.Errorf("numbering rule %q: lengths must be at least 1 and fit in %d digits with the country code", entry, e164MaxDigits)
+    }
+    if len(fields) > 1 {
+        rule.trunk = fields[1]
+    }
+    if len(fields) > 2 {
+        rule.intl = fields[2]
+    }
+    if (rule.trunk != "" && !isDigits(rule.trunk)) || !isDigits(rule.intl) {
+        return numberingRule{}, fmt.Errorf("numbering rule %q: prefixes must be digits", entry)
+    }
+    return rule, nil
+}
+
+// toE164 validates a normalized number and returns it as E.164; field
+// names it in metrics and errors. DIDs come back as given.
+func (r *Router) toE164(field, number string) (string, error) {
+    plan := r.numbering
+    if plan.mode == E164Off {
+        return number, nil
+    }
+    if (field == "ani" || field == "ani2") && withheldANIs[strings.ToLower(number)] {
+        return number, nil
+    }
+    e164, reason := plan.e164(number)
+    if reason != "" {
+        e164Rejected.Inc(field, reason)
+        return "", fmt.Errorf("%w: %s %q is not a valid number (%s)", ErrMalformedNumber, field, number, reason)
+    }
+    if field == "did" {
+        return number, nil
+    }
+    if e164 != number {
+        e164Rewritten.Inc(field)
+    }
+    return e164, nil
+}
+
+// e164 returns number in E.164 or why it cannot be: not_digits, length or
+// no_rule (strict mode only)
+func (p *numberingPlan) e164(number string) (string, string) {
+    digits, international := number, false
+    switch {
+    case strings.HasPrefix(number, "+"):
+        digits, international = number[1:], true
+    case p.home != nil && strings.HasPrefix(number, p.home.intl):
+        digits, international = number[len(p.home.intl):], true
+    case p.home != nil && p.home.trunk != "" && strings.HasPrefix(number, p.home.trunk):
+        digits, international = p.home.countryCode+number[len(p.home.trunk):], true
+    }
+    if !isDigits(digits) {
+        return "", "not_digits"
+    }
+
+    if !international {
+        // Bare digits: a country code and a number of its length, or a
+        // national number of the home country
+        if rule := p.rule(digits); rule != nil && rule.valid(digits) {
+            international = true
+        } else if p.home != nil && p.home.valid(p.home.countryCode+digits) {
+            digits, international = p.home.countryCode+digits, true
+        }
+    }
+
+    if len(digits) > e164MaxDigits {
+        return "", "length"
+    }
+    rule := p.rule(digits)
+    switch {
+    case rule != nil:
+        if !rule.valid(digits) {
+            return "", "length"
+        }
+    case p.mode == E164Strict:
+        return "", "no_rule"
+    case !international:
+        // No telling which country a bare number is from
+        return number, ""
+    }
+    return "+" + digits, ""
+}
+
+// rule is the rule whose country code starts digits, nil if none does
+func (p *numberingPlan) rule(digits string) *numberingRule {
+    for i := range p.rules {
+        if strings.HasPrefix(digits, p.rules[i].countryCode) {
+            return &p.rules[i]
+        }
+    }
+    return nil
+}
+
+// valid reports whether international digits are a number of this
+// rule's country and length
+func (rule *numberingRule) valid(digits string) bool {
+    if !strings.HasPrefix(digits, rule.countryCode) {
+        return false
+    }
+    n := len(digits) - len(rule.countryCode)
+    return n >= rule.minLen && n <= rule.maxLen
+}
@@ -0,0 +1,25 @@
+package router
+
+import (
+    "context"
+    "errors"
+)
+
+// Call path errors worth another attempt, here or on another S2: the
+// router is busy, shutting down or a replica, or the database was slow.
+// The rest fail the same way wherever the call is retried.
+var retryableErrors = []error{
+    ErrReadOnly, ErrDraining, ErrCapacity, ErrNoAvailableDIDs,
+    ErrThrottled, ErrCampaignLimit, ErrCarrierLimit, ErrDatabaseDown, context.DeadlineExceeded,
+}
+
+// Retryable reports whether a call refused with err may succeed if S1
+// tries again, for the dialplan's S2_RETRYABLE and the API's retryable flag
+func Retryable(err error) bool {
+    for _, target := range retryableErrors {
+        if errors.Is(err, target) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,279 @@
+package router
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/nats"
+)
+
+// Every call.* event can also be streamed to a message bus, so analytics
+// pipelines consume call state changes instead of polling MySQL. Events are
+// published in their webhook JSON, keyed by CallID where the bus has keys
+// so a consumer sees each call's changes in order. Delivery is at least
+// once and best effort: events wait in memory while the bus is down and
+// the oldest are dropped beyond eventStreamBuffer.
+const (
+    eventStreamBuffer   = 10000
+    eventStreamBatch    = 500
+    eventStreamInterval = 100 * time.Millisecond
+    eventStreamBackoff  = 5 * time.Second
+)
+
+var (
+    streamedEvents = metrics.NewCounter("s2_event_stream_events_total",
+        "Call events sent to the event stream by result", "result")
+    eventStreamPending = metrics.NewGauge("s2_event_stream_pending",
+        "Call events waiting for the event stream")
+)
+
+// EventStreamConfig selects the bus call events are streamed to
+type EventStreamConfig struct {
+    Backend string // see EventStreamBackends; "" disables streaming
+    URL     string // nats://host:4222, or the Kafka REST Proxy base URL
+    Topic   string // NATS subject or Kafka topic, "" means s2.calls
+}
+
+// eventSink publishes one batch of encoded events to a bus
+type eventSink interface {
+    publish(events []models.Event, payloads [][]byte) error
+    close()
+}
+
+var eventStreamBackends = map[string]func(cfg EventStreamConfig) (eventSink, error){
+    "nats":  newNATSSink,
+    "kafka": newKafkaSink,
+}
+
+// EventStreamBackends lists the names accepted by EventStreamConfig.Backend
+func EventStreamBackends() []string {
+    names := make([]string, 0, len(eventStreamBackends))
+    for name := range eventStreamBackends {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+type eventStream struct {
+    sink eventSink
+
+    mu      sync.Mutex
+    pending []models.Event
+    dropped int // events dropped for space since the current batch was taken
+}
+
+// startEventStream connects the configured sink and starts its publisher
+func (r *Router) startEventStream(cfg EventStreamConfig) error {
+    if cfg.Backend == "" {
+        return nil
+    }
+    newSink, ok := eventStreamBackends[cfg.Backend]
+    if !ok {
+        return fmt.Errorf("unsupported event stream %q (available: %s)", cfg.Backend, strings.Join(EventStreamBackends(), ", "))
+    }
+    if cfg.Topic == "" {
+        cfg.Topic = "s2.calls"
+    }
+    sink, err := newSink(cfg)
+    if err != nil {
+        return fmt.Errorf("event stream: %w", err)
+    }
+    r.events = &eventStream{sink: sink}
+    r.life.Go("event-stream", func(ctx context.Context) error {
+        r.runEventStream(ctx)
+        return nil
+    })
+    logger.Infof("Streaming call events to %s topic %s", cfg.Backend, cfg.Topic)
+    return nil
+}
+
+// streamEvent queues a call event for the stream
+func (r *Router) streamEvent(event models.Event) {
+    s := r.events
+    if s == nil || !strings.HasPrefix(event.Type, "call.") {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.pending) >= eventStreamBuffer {
+        s.pending = s.pending[1:]
+        s.dropped++
+        streamedEvents.Inc("dropped")
+    }
+    s.pending = append(s.pending, event)
+    eventStreamPending.Set(float64(len(s.pending)))
+}
+
+// runEventStream publishes queued events in batches until ctx is done,
+// then makes one last attempt with whatever is left
+func (r *Router) runEventStream(ctx context.Context) {
+    s := r.events
+    defer s.sink.close()
+    ticker := r.clock.NewTicker(eventStreamInterval)
+    defer ticker.Stop()
+    var retryAt time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            if err := s.drain(); err != nil {
+                logger.Warnf("Event stream lost %d events at shutdown: %v", s.size(), err)
+            }
+            return
+        case now := <-ticker.C():
+            if now.Before(retryAt) {
+                continue
+            }
+            if err := s.drain(); err != nil {
+                logger.Warnf("Event stream publish failed, retrying in %s: %v", eventStreamBackoff, err)
+                retryAt = now.Add(eventStreamBackoff)
+            }
+        }
+    }
+}
+
+// drain publishes batches until the queue is empty or the sink fails
+func (s *eventStream) drain() error {
+    for s.size() > 0 {
+        if err := s.flush(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *eventStream) size() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.pending)
+}
+
+// flush publishes the oldest batch, leaving it queued if the sink fails
+func (s *eventStream) flush() error {
+    s.mu.Lock()
+    n := len(s.pending)
+    if n > eventStreamBatch {
+        n = eventStreamBatch
+    }
+    batch := append([]models.Event(nil), s.pending[:n]...)
+    s.dropped = 0
+    s.mu.Unlock()
+    if len(batch) == 0 {
+        return nil
+    }
+
+    payloads := make([][]byte, len(batch))
+    for i, event := range batch {
+        payloads[i], _ = json.Marshal(event)
+    }
+    if err := s.sink.publish(batch, payloads); err != nil {
+        streamedEvents.Add(float64(len(batch)), "failed")
+        return err
+    }
+    streamedEvents.Add(float64(len(batch)), "sent")
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    // Events dropped for space while publishing were the oldest: ours
+    if s.dropped >= n {
+        s.dropped -= n
+        n = 0
+    } else {
+        n -= s.dropped
+        s.dropped = 0
+    }
+    s.pending = s.pending[n:]
+    eventStreamPending.Set(float64(len(s.pending)))
+    return nil
+}
+
+// natsSink publishes each event as one message on the subject
+type natsSink struct {
+    client  *nats.Client
+    subject string
+}
+
+func newNATSSink(cfg EventStreamConfig) (eventSink, error) {
+    client, err := nats.NewClient(nats.Config{URL: cfg.URL})
+    if err != nil {
+        return nil, err
+    }
+    return &natsSink{client: client, subject: cfg.Topic}, nil
+}
+
+func (s *natsSink) publish(events []models.Event, payloads [][]byte) error {
+    return s.client.Publish(s.subject, payloads...)
+}
+
+func (s *natsSink) close() {
+    s.client.Close()
+}
+
+// kafkaSink produces to a topic through the Kafka REST Proxy v2 API, keyed
+// by CallID so every event of a call lands on the same partition
+type kafkaSink struct {
+    url    string
+    client *http.Client
+}
+
+func newKafkaSink(cfg EventStreamConfig) (eventSink, error) {
+    if cfg.URL == "" {
+        return nil, fmt.Errorf("kafka needs the REST Proxy URL")
+    }
+    return &kafkaSink{
+        url:    strings.TrimSuffix(cfg.URL, "/") + "/topics/" + cfg.Topic,
+        client: &http.Client{Timeout: 10 * time.Second},
+    }, nil
+}
+
+type kafkaRecord struct {
+    Key   string          `json:"key"`
+    Value json.RawMessage `json:"value"`
+}
+
+func (s *kafkaSink) publish(events []models.Event, payloads [][]byte) error {
+    records := make([]kafkaRecord, len(events))
+    for i, event := range events {
+        records[i] = kafkaRecord{Key: event.CallID, Value: payloads[i]}
+    }
+    body, err := json.Marshal(map[string]interface{}{"records": records})
+    if err != nil {
+        return err
+    }
+    resp, err := s.client.Post(s.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("kafka REST proxy returned %s", resp.Status)
+    }
+
+    // The proxy accepts the request even when single records fail
+    var result struct {
+        Offsets []struct {
+            ErrorCode *int   `json:"error_code"`
+            Error     string `json:"error"`
+        } `json:"offsets"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return err
+    }
+    for _, o := range result.Offsets {
+        if o.ErrorCode != nil {
+            return fmt.Errorf("kafka rejected a record: %s", o.Error)
+        }
+    }
+    return nil
+}
+
+func (s *kafkaSink) close() {}
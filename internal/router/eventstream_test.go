@@ -0,0 +1,330 @@
+package router
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/nats/natstest"
+)
+
+// flakySink fails every publish while down
+type flakySink struct {
+    mu       sync.Mutex
+    down     bool
+    attempts int
+    sent     int
+}
+
+func (s *flakySink) publish(events []models.Event, payloads [][]byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.attempts++
+    if s.down {
+        return errors.New("bus down")
+    }
+    s.sent += len(events)
+    return nil
+}
+
+func (s *flakySink) close() {}
+
+func (s *flakySink) counts() (attempts, sent int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.attempts, s.sent
+}
+
+// The publisher ticks and backs off on the router's clock: after a failed
+// publish it waits out eventStreamBackoff of clock time, not real time
+func TestEventStreamBacksOffOnRouterClock(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    r := newTestRouter(t, newFakeStorage(), Config{Clock: fake})
+    sink := &flakySink{down: true}
+    r.events = &eventStream{sink: sink}
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        r.runEventStream(ctx)
+    }()
+    defer func() {
+        cancel()
+        <-done
+    }()
+
+    // Ticks until the publisher has its ticker and fails once
+    r.streamEvent(models.Event{Type: "call.started", CallID: "call-1"})
+    eventually(t, "the first publish", 5*time.Second, func() bool {
+        if attempts, _ := sink.counts(); attempts > 0 {
+            return true
+        }
+        fake.Advance(eventStreamInterval)
+        return false
+    })
+    sink.mu.Lock()
+    sink.down = false
+    sink.mu.Unlock()
+
+    // Half the backoff on, well clear of however far the wait above ran
+    for elapsed := time.Duration(0); elapsed < eventStreamBackoff/2; elapsed += eventStreamInterval {
+        fake.Advance(eventStreamInterval)
+    }
+    time.Sleep(50 * time.Millisecond)
+    if attempts, _ := sink.counts(); attempts != 1 {
+        t.Fatalf("published %d times within the backoff", attempts)
+    }
+
+    eventually(t, "the retry", 5*time.Second, func() bool {
+        if _, sent := sink.counts(); sent == 1 {
+            return true
+        }
+        fake.Advance(eventStreamInterval)
+        return false
+    })
+}
+
+// gateSink holds each publish until the test releases it
+type gateSink struct {
+    started chan []models.Event
+    release chan error
+}
+
+func (s *gateSink) publish(events []models.Event, payloads [][]byte) error {
+    s.started <- events
+    return <-s.release
+}
+
+func (s *gateSink) close() {}
+
+func pendingCallIDs(s *eventStream) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ids := make([]string, len(s.pending))
+    for i, event := range s.pending {
+        ids[i] = event.CallID
+    }
+    return ids
+}
+
+// Beyond eventStreamBuffer the oldest events are dropped and counted
+func TestEventStreamDropsOldestWhenFull(t *testing.T) {
+    r := newTestRouter(t, newFakeStorage(), Config{})
+    r.events = &eventStream{sink: &flakySink{down: true}}
+    dropped := streamedEvents.Value("dropped")
+
+    for i := 0; i < eventStreamBuffer+5; i++ {
+        r.streamEvent(models.Event{Type: "call.started", CallID: fmt.Sprintf("call-%d", i)})
+    }
+    // Only call events are streamed
+    r.streamEvent(models.Event{Type: "pool.exhausted"})
+
+    ids := pendingCallIDs(r.events)
+    if len(ids) != eventStreamBuffer || ids[0] != "call-5" || ids[len(ids)-1] != fmt.Sprintf("call-%d", eventStreamBuffer+4) {
+        t.Fatalf("queue holds %d events from %s to %s, want %d from call-5", len(ids), ids[0], ids[len(ids)-1], eventStreamBuffer)
+    }
+    if got := streamedEvents.Value("dropped") - dropped; got != 5 {
+        t.Errorf("%v drops counted, want 5", got)
+    }
+    if err := r.events.drain(); err == nil {
+        t.Error("drain with the bus down succeeded")
+    }
+    if n := r.events.size(); n != eventStreamBuffer {
+        t.Errorf("a failed publish left %d events queued, want all %d", n, eventStreamBuffer)
+    }
+}
+
+// Events dropped for space while a batch is being published are that
+// batch's own, so its success takes only what is left of it off the queue
+func TestEventStreamDropsDuringPublish(t *testing.T) {
+    r := newTestRouter(t, newFakeStorage(), Config{})
+    sink := &gateSink{started: make(chan []models.Event), release: make(chan error)}
+    r.events = &eventStream{sink: sink}
+    for i := 0; i < 3; i++ {
+        r.streamEvent(models.Event{Type: "call.started", CallID: fmt.Sprintf("old-%d", i)})
+    }
+
+    flushed := make(chan error)
+    go func() { flushed <- r.events.flush() }()
+    if batch := <-sink.started; len(batch) != 3 {
+        t.Fatalf("published a batch of %d, want 3", len(batch))
+    }
+    // Fill the queue and push out two of the three events in flight
+    for i := 0; i < eventStreamBuffer-1; i++ {
+        r.streamEvent(models.Event{Type: "call.started", CallID: fmt.Sprintf("new-%d", i)})
+    }
+    sink.release <- nil
+    if err := <-flushed; err != nil {
+        t.Fatal(err)
+    }
+
+    ids := pendingCallIDs(r.events)
+    if len(ids) != eventStreamBuffer-1 || ids[0] != "new-0" {
+        t.Fatalf("queue holds %d events from %s, want %d from new-0", len(ids), ids[0], eventStreamBuffer-1)
+    }
+}
+
+// Call events reach NATS as one message each, in order, across a dropped
+// connection and a bus that goes down and comes back
+func TestEventStreamToNATS(t *testing.T) {
+    srv, err := natstest.NewServer("", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer func() { srv.Close() }()
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    r := newTestRouter(t, newFakeStorage(), Config{Clock: fake})
+    if err := r.startEventStream(EventStreamConfig{Backend: "nats", URL: srv.URL()}); err != nil {
+        t.Fatal(err)
+    }
+
+    var got []models.Event
+    receive := func(what string, want int) {
+        t.Helper()
+        eventually(t, what, 5*time.Second, func() bool {
+            for _, msg := range srv.Messages() {
+                if msg.Subject != "s2.calls" {
+                    t.Errorf("published on %s, want s2.calls", msg.Subject)
+                }
+                var event models.Event
+                if err := json.Unmarshal(msg.Data, &event); err != nil {
+                    t.Errorf("message %q: %v", msg.Data, err)
+                }
+                got = append(got, event)
+            }
+            if len(got) >= want {
+                return true
+            }
+            fake.Advance(eventStreamInterval)
+            return false
+        })
+    }
+
+    r.streamEvent(models.Event{Type: "call.started", CallID: "call-1"})
+    r.streamEvent(models.Event{Type: "call.started", CallID: "call-2"})
+    r.streamEvent(models.Event{Type: "call.returned", CallID: "call-1"})
+    receive("the first events", 3)
+
+    // The client redials a dropped connection without failing the batch
+    failed := streamedEvents.Value("failed")
+    srv.Drop()
+    r.streamEvent(models.Event{Type: "call.completed", CallID: "call-1"})
+    receive("the event after the drop", 4)
+    if streamedEvents.Value("failed") != failed {
+        t.Error("a dropped connection failed the batch")
+    }
+
+    // While the bus is down events wait, and go out once it is back
+    url := srv.URL()
+    srv.Close()
+    r.streamEvent(models.Event{Type: "call.completed", CallID: "call-2"})
+    eventually(t, "the failed publish", 5*time.Second, func() bool {
+        if streamedEvents.Value("failed") > failed {
+            return true
+        }
+        fake.Advance(eventStreamInterval)
+        return false
+    })
+    if srv, err = natstest.Listen(strings.TrimPrefix(url, "nats://"), "", ""); err != nil {
+        t.Skipf("cannot listen on %s again: %v", url, err)
+    }
+    receive("the event queued while the bus was down", 5)
+
+    want := []string{"call.started call-1", "call.started call-2", "call.returned call-1", "call.completed call-1", "call.completed call-2"}
+    if len(got) != len(want) {
+        t.Fatalf("received %d events, want %d", len(got), len(want))
+    }
+    for i, event := range got {
+        if s := event.Type + " " + event.CallID; s != want[i] {
+            t.Errorf("event %d = %s, want %s", i, s, want[i])
+        }
+    }
+}
+
+// The Kafka sink produces a batch in one REST Proxy request keyed by
+// CallID, and leaves it queued when the proxy or a record fails
+func TestEventStreamToKafka(t *testing.T) {
+    var (
+        mu      sync.Mutex
+        reply   = `{"offsets":[{"partition":0,"offset":1},{"partition":1,"offset":7}]}`
+        status  = http.StatusOK
+        batches [][]kafkaRecord
+    )
+    proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        if req.Method != http.MethodPost || req.URL.Path != "/kafka/topics/calls.test" {
+            t.Errorf("request %s %s", req.Method, req.URL.Path)
+        }
+        if ct := req.Header.Get("Content-Type"); ct != "application/vnd.kafka.json.v2+json" {
+            t.Errorf("Content-Type %q", ct)
+        }
+        body, _ := io.ReadAll(req.Body)
+        var produce struct {
+            Records []kafkaRecord `json:"records"`
+        }
+        if err := json.Unmarshal(body, &produce); err != nil {
+            t.Errorf("body %s: %v", body, err)
+        }
+        batches = append(batches, produce.Records)
+        w.WriteHeader(status)
+        io.WriteString(w, reply)
+    }))
+    defer proxy.Close()
+
+    sink, err := newKafkaSink(EventStreamConfig{URL: proxy.URL + "/kafka/", Topic: "calls.test"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &eventStream{sink: sink}
+    s.pending = []models.Event{
+        {Type: "call.started", CallID: "call-1", DID: "15550001111"},
+        {Type: "call.started", CallID: "call-2", DID: "15550002222"},
+    }
+
+    if err := s.drain(); err != nil {
+        t.Fatalf("drain: %v", err)
+    }
+    if len(batches) != 1 || len(batches[0]) != 2 {
+        t.Fatalf("proxy got %d requests, want one of 2 records", len(batches))
+    }
+    for i, record := range batches[0] {
+        var event models.Event
+        json.Unmarshal(record.Value, &event)
+        if id := fmt.Sprintf("call-%d", i+1); record.Key != id || event.CallID != id || event.Type != "call.started" {
+            t.Errorf("record %d = %s %s, want %s keyed by its CallID", i, record.Key, record.Value, id)
+        }
+    }
+
+    for _, tc := range []struct {
+        name   string
+        status int
+        reply  string
+        err    string
+    }{
+        {"proxy error", http.StatusServiceUnavailable, `{"error_code":50301,"message":"unavailable"}`, "503"},
+        {"rejected record", http.StatusOK, `{"offsets":[{"error_code":40403,"error":"leader not available"}]}`, "leader not available"},
+        {"bad reply", http.StatusOK, `<html>`, "invalid character"},
+    } {
+        mu.Lock()
+        status, reply = tc.status, tc.reply
+        mu.Unlock()
+        s.pending = []models.Event{{Type: "call.completed", CallID: "call-1"}}
+        if err := s.drain(); err == nil || !strings.Contains(err.Error(), tc.err) {
+            t.Errorf("%s: err = %v, want %q", tc.name, err, tc.err)
+        }
+        if n := s.size(); n != 1 {
+            t.Errorf("%s: %d events queued after the failure, want 1", tc.name, n)
+        }
+    }
+}
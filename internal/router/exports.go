@@ -0,0 +1,433 @@
+package router
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    exportQueued    = "queued"
+    exportRunning   = "running"
+    exportDone      = "done"
+    exportFailed    = "failed"
+    exportCancelled = "cancelled"
+
+    exportCSV    = "csv"
+    exportNDJSON = "ndjson"
+
+    // Exports running at once; further jobs wait in queued
+    maxConcurrentExports = 2
+    // Rows written between progress updates
+    exportProgressRows = 1000
+)
+
+// ErrExportNotFound is returned for unknown or pruned export jobs
+var ErrExportNotFound = errors.New("export job not found")
+
+// ErrExportNotReady is returned when downloading a job that has not finished
+var ErrExportNotReady = errors.New("export job has not finished")
+
+var exportUploadClient = &http.Client{Timeout: 10 * time.Minute}
+
+// exportJobs tracks CDR export jobs. Jobs live in memory and their files on
+// local disk, so a job is only visible on the router that ran it.
+type exportJobs struct {
+    mu    sync.Mutex
+    jobs  map[string]*exportJob
+    slots chan struct{}
+}
+
+type exportJob struct {
+    job    models.ExportJob
+    cancel context.CancelFunc
+}
+
+var exportColumns = []string{
+    "call_id", "original_ani", "original_dnis", "assigned_did", "status", "start_time", "end_time",
+    "duration", "campaign_id", "tenant_id", "settlement_class", "forward_trunk",
+}
+
+// CreateExport validates and queues a CDR export of calls started in
+// [From, To), returning immediately with the queued job
+func (r *Router) CreateExport(job models.ExportJob) (*models.ExportJob, error) {
+    if r.config.ExportDir == "" {
+        return nil, fmt.Errorf("exports are disabled (no export directory configured)")
+    }
+    if job.Format == "" {
+        job.Format = exportCSV
+    }
+    if job.Format != exportCSV && job.Format != exportNDJSON {
+        return nil, fmt.Errorf("format must be %s or %s", exportCSV, exportNDJSON)
+    }
+    if job.From.IsZero() || job.To.IsZero() || !job.To.After(job.From) {
+        return nil, fmt.Errorf("from and to are required and to must be after from")
+    }
+    if job.UploadURL != "" && !strings.HasPrefix(job.UploadURL, "http://") && !strings.HasPrefix(job.UploadURL, "https://") {
+        return nil, fmt.Errorf("upload_url must be an http(s) URL")
+    }
+
+    id := make([]byte, 8)
+    if _, err := rand.Read(id); err != nil {
+        return nil, err
+    }
+    job.ID = hex.EncodeToString(id)
+    job.Status = exportQueued
+    job.Rows = 0
+    job.Bytes = 0
+    job.Error = ""
+    job.CreatedAt = r.clock.Now()
+    job.StartedAt, job.FinishedAt, job.ExpiresAt = nil, nil, nil
+
+    // Derived from the lifecycle so Close cancels running exports too
+    ctx, cancel := context.WithCancel(r.life.Context())
+    e := &r.exports
+    e.mu.Lock()
+    e.jobs[job.ID] = &exportJob{job: job, cancel: cancel}
+    e.mu.Unlock()
+
+    logger.Infof("Queued %s export %s for %s - %s", job.Format, job.ID,
+        job.From.Format(time.RFC3339), job.To.Format(time.RFC3339))
+    r.life.Go("export", func(context.Context) error {
+        r.runExport(ctx, job)
+        return nil
+    })
+    return &job, nil
+}
+
+// Exports lists known jobs, newest first
+func (r *Router) Exports() []models.ExportJob {
+    e := &r.exports
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    list := make([]models.ExportJob, 0, len(e.jobs))
+    for _, j := range e.jobs {
+        list = append(list, j.job)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+    return list
+}
+
+func (r *Router) Export(id string) (*models.ExportJob, error) {
+    e := &r.exports
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    j, ok := e.jobs[id]
+    if !ok {
+        return nil, ErrExportNotFound
+    }
+    job := j.job
+    return &job, nil
+}
+
+// ExportFile returns the path of a finished export for download
+func (r *Router) ExportFile(id string) (string, *models.ExportJob, error) {
+    job, err := r.Export(id)
+    if err != nil {
+        return "", nil, err
+    }
+    if job.Status != exportDone {
+        return "", job, ErrExportNotReady
+    }
+    return r.exportPath(job.ID, job.Format), job, nil
+}
+
+// DeleteExport cancels a queued or running job, or removes a finished one
+// and its file
+func (r *Router) DeleteExport(id string) error {
+    e := &r.exports
+    e.mu.Lock()
+    j, ok := e.jobs[id]
+    if ok {
+        delete(e.jobs, id)
+    }
+    e.mu.Unlock()
+    if !ok {
+        return ErrExportNotFound
+    }
+
+    j.cancel()
+    os.Remove(r.exportPath(j.job.ID, j.job.Format))
+    return nil
+}
+
+func (r *Router) exportPath(id, format string) string {
+    return filepath.Join(r.config.ExportDir, "cdr-"+id+"."+format)
+}
+
+// updateExport applies fn to a job's record if it still exists
+func (r *Router) updateExport(id string, fn func(job *models.ExportJob)) {
+    e := &r.exports
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if j, ok := e.jobs[id]; ok {
+        fn(&j.job)
+    }
+}
+
+func (r *Router) runExport(ctx context.Context, job models.ExportJob) {
+    // Wait for a slot so exports cannot starve the call path of connections
+    select {
+    case r.exports.slots <- struct{}{}:
+        defer func() { <-r.exports.slots }()
+    case <-ctx.Done():
+        return
+    }
+
+    started := r.clock.Now()
+    r.updateExport(job.ID, func(j *models.ExportJob) {
+        j.Status = exportRunning
+        j.StartedAt = &started
+    })
+
+    path := r.exportPath(job.ID, job.Format)
+    size, err := r.writeExport(ctx, job, path)
+    if err == nil && job.UploadURL != "" {
+        err = uploadExport(ctx, path, job.UploadURL)
+    }
+
+    finished := r.clock.Now()
+    expires := finished.Add(r.config.ExportRetention)
+    r.updateExport(job.ID, func(j *models.ExportJob) {
+        j.FinishedAt = &finished
+        j.ExpiresAt = &expires
+        switch {
+        case ctx.Err() != nil:
+            j.Status = exportCancelled
+        case err != nil:
+            j.Status = exportFailed
+            j.Error = err.Error()
+        default:
+            j.Status = exportDone
+            j.Bytes = size
+            j.Uploaded = job.UploadURL != ""
+        }
+    })
+
+    if err != nil {
+        os.Remove(path)
+        logger.Warnf("Export %s failed: %v", job.ID, err)
+        return
+    }
+    logger.Infof("Export %s finished in %s (%d bytes)", job.ID, finished.Sub(started).Round(time.Millisecond), size)
+}
+
+// writeExport streams the matching call records into path. The file is
+// written under a temporary name so a partial export is never served.
+func (r *Router) writeExport(ctx context.Context, job models.ExportJob, path string) (int64, error) {
+    if err := os.MkdirAll(r.config.ExportDir, 0o750); err != nil {
+        return 0, err
+    }
+
+    where := []string{"start_time >= ?", "start_time < ?"}
+    args := []interface{}{job.From, job.To}
+    if job.Campaign != "" {
+        where = append(where, "campaign_id = ?")
+        args = append(args, job.Campaign)
+    }
+    if job.Tenant != "" {
+        where = append(where, "tenant_id = ?")
+        args = append(args, job.Tenant)
+    }
+    if job.CallStatus != "" {
+        where = append(where, "status = ?")
+        args = append(args, job.CallStatus)
+    }
+
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT call_id, original_ani, original_dnis, assigned_did, status, start_time, end_time,
+            duration, COALESCE(campaign_id, ''), COALESCE(tenant_id, ''), COALESCE(settlement_class, ''),
+            COALESCE(forward_trunk, '')
+        FROM call_records
+        WHERE `+strings.Join(where, " AND ")+`
+        ORDER BY start_time
+    `, args...)
+    if err != nil {
+        return 0, err
+    }
+    defer rows.Close()
+
+    tmp := path + ".part"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return 0, err
+    }
+    defer os.Remove(tmp)
+    defer f.Close()
+
+    buf := bufio.NewWriterSize(f, 64*1024)
+    out := newExportWriter(job.Format, buf)
+    if err := out.header(); err != nil {
+        return 0, err
+    }
+
+    var count int64
+    for rows.Next() {
+        var id, ani, dnis, did, status, campaign, tenant, class, trunk string
+        var start time.Time
+        var end sql.NullTime
+        var duration int
+        if err := rows.Scan(&id, &ani, &dnis, &did, &status, &start, &end, &duration, &campaign, &tenant, &class, &trunk); err != nil {
+            return 0, err
+        }
+
+        endTime := ""
+        if end.Valid {
+            endTime = end.Time.Format(time.RFC3339)
+        }
+        if err := out.row([]string{
+            id, ani, dnis, did, status, start.Format(time.RFC3339), endTime,
+            strconv.Itoa(duration), campaign, tenant, class, trunk,
+        }); err != nil {
+            return 0, err
+        }
+
+        count++
+        if count%exportProgressRows == 0 {
+            r.updateExport(job.ID, func(j *models.ExportJob) { j.Rows = count })
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    r.updateExport(job.ID, func(j *models.ExportJob) { j.Rows = count })
+
+    if err := out.flush(); err != nil {
+        return 0, err
+    }
+    if err := buf.Flush(); err != nil {
+        return 0, err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        return 0, err
+    }
+    if err := f.Close(); err != nil {
+        return 0, err
+    }
+    return info.Size(), os.Rename(tmp, path)
+}
+
+// exportWriter encodes rows of exportColumns in the job's format
+type exportWriter struct {
+    format string
+    csv    *csv.Writer
+    json   *json.Encoder
+}
+
+func newExportWriter(format string, w io.Writer) *exportWriter {
+    if format == exportNDJSON {
+        return &exportWriter{format: format, json: json.NewEncoder(w)}
+    }
+    return &exportWriter{format: format, csv: csv.NewWriter(w)}
+}
+
+func (w *exportWriter) header() error {
+    if w.csv != nil {
+        return w.csv.Write(exportColumns)
+    }
+    return nil
+}
+
+func (w *exportWriter) row(values []string) error {
+    if w.csv != nil {
+        return w.csv.Write(values)
+    }
+    obj := make(map[string]string, len(values))
+    for i, v := range values {
+        obj[exportColumns[i]] = v
+    }
+    return w.json.Encode(obj)
+}
+
+func (w *exportWriter) flush() error {
+    if w.csv != nil {
+        w.csv.Flush()
+        return w.csv.Error()
+    }
+    return nil
+}
+
+// uploadExport PUTs the finished file to url, e.g. a pre-signed S3 URL
+func uploadExport(ctx context.Context, path, url string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, f)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = info.Size()
+    resp, err := exportUploadClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("upload failed: %v", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("upload failed: %s", resp.Status)
+    }
+    return nil
+}
+
+// pruneExports drops finished jobs past their retention along with their
+// files, and removes files left behind by jobs lost in a restart
+func (r *Router) pruneExports() error {
+    now := r.clock.Now()
+    known := make(map[string]bool)
+
+    e := &r.exports
+    e.mu.Lock()
+    for id, j := range e.jobs {
+        if j.job.ExpiresAt != nil && now.After(*j.job.ExpiresAt) {
+            delete(e.jobs, id)
+            os.Remove(r.exportPath(j.job.ID, j.job.Format))
+            continue
+        }
+        known[filepath.Base(r.exportPath(j.job.ID, j.job.Format))] = true
+    }
+    e.mu.Unlock()
+
+    entries, err := os.ReadDir(r.config.ExportDir)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    for _, entry := range entries {
+        name := entry.Name()
+        if !strings.HasPrefix(name, "cdr-") || known[name] {
+            continue
+        }
+        info, err := entry.Info()
+        if err == nil && now.Sub(info.ModTime()) > r.config.ExportRetention {
+            os.Remove(filepath.Join(r.config.ExportDir, name))
+        }
+    }
+    return nil
+}
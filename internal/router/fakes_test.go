@@ -0,0 +1,429 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "os"
+    "runtime"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+func TestMain(m *testing.M) {
+    logging.Configure(io.Discard, logging.LevelError, false)
+    os.Exit(m.Run())
+}
+
+// errFakeDown stands in for a dead MySQL connection
+var errFakeDown = errors.New("fake: connection refused")
+
+// fakeStorage is an in-memory Storage. ClaimDID is the only atomic step,
+// as in MySQL, and PickFreeDID returns the lowest free DID and yields
+// before the caller claims it, so that concurrent calls race for it.
+// Benchmarks set spread and latency to look more like a real database.
+type fakeStorage struct {
+    mu      sync.Mutex
+    dids    map[string]*fakeDID
+    records map[string]*models.CallRecord
+    writes  []string // status changes and releases, in the order they landed
+    down    atomic.Bool
+    latency atomic.Int64 // time.Duration each call waits first, as for a database round trip
+    spread  atomic.Bool  // PickFreeDID picks any free DID, as MySQL does, rather than the lowest
+}
+
+type fakeDID struct {
+    inUse       bool
+    destination string
+    tenant      string
+    pool        string
+    country     string
+}
+
+func newFakeStorage(dids ...string) *fakeStorage {
+    s := &fakeStorage{dids: make(map[string]*fakeDID), records: make(map[string]*models.CallRecord)}
+    for _, did := range dids {
+        s.dids[did] = &fakeDID{}
+    }
+    return s
+}
+
+// fakeDIDs numbers n DIDs from 15550000000
+func fakeDIDs(n int) []string {
+    dids := make([]string, n)
+    for i := range dids {
+        dids[i] = fmt.Sprintf("1555%07d", i)
+    }
+    return dids
+}
+
+// setLatency makes every call wait d before it runs, outside s.mu
+func (s *fakeStorage) setLatency(d time.Duration) {
+    s.latency.Store(int64(d))
+}
+
+func (s *fakeStorage) check() error {
+    if d := time.Duration(s.latency.Load()); d > 0 {
+        time.Sleep(d)
+    }
+    if s.down.Load() {
+        return errFakeDown
+    }
+    return nil
+}
+
+// inUse reports whether did is marked in use
+func (s *fakeStorage) inUse(did string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    d := s.dids[did]
+    return d != nil && d.inUse
+}
+
+func (s *fakeStorage) free(f DIDFilter) []string {
+    var free []string
+    for did, d := range s.dids {
+        if !d.inUse && d.tenant == f.Tenant && d.pool == f.Pool && (f.Country == "" || d.country == f.Country) {
+            free = append(free, did)
+        }
+    }
+    sort.Strings(free)
+    return free
+}
+
+func (s *fakeStorage) Prepare(ctx context.Context) error { return s.check() }
+
+func (s *fakeStorage) PickFreeDID(ctx context.Context, f DIDFilter) (string, error) {
+    if !s.spread.Load() {
+        return s.PickLeastRecentDID(ctx, f, 0)
+    }
+    if err := s.check(); err != nil {
+        return "", err
+    }
+    s.mu.Lock()
+    free := s.free(f)
+    s.mu.Unlock()
+    if len(free) == 0 {
+        return "", sql.ErrNoRows
+    }
+    return free[rand.Intn(len(free))], nil
+}
+
+func (s *fakeStorage) PickLeastRecentDID(ctx context.Context, f DIDFilter, skip int) (string, error) {
+    if err := s.check(); err != nil {
+        return "", err
+    }
+    s.mu.Lock()
+    free := s.free(f)
+    s.mu.Unlock()
+    if skip >= len(free) {
+        return "", sql.ErrNoRows
+    }
+    runtime.Gosched() // let another call pick the same DID before this one claims it
+    return free[skip], nil
+}
+
+func (s *fakeStorage) PickFreeDIDAfter(ctx context.Context, f DIDFilter, after string) (string, error) {
+    if err := s.check(); err != nil {
+        return "", err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    free := s.free(f)
+    if len(free) == 0 {
+        return "", sql.ErrNoRows
+    }
+    i := sort.SearchStrings(free, after)
+    if i < len(free) && free[i] == after {
+        i++
+    }
+    return free[i%len(free)], nil
+}
+
+func (s *fakeStorage) ClaimDID(ctx context.Context, did, destination string) (bool, error) {
+    if err := s.check(); err != nil {
+        return false, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    d := s.dids[did]
+    if d == nil || d.inUse {
+        return false, nil
+    }
+    d.inUse, d.destination = true, destination
+    return true, nil
+}
+
+func (s *fakeStorage) InsertClaimedDID(ctx context.Context, did, destination, country, tenant string) (bool, error) {
+    if err := s.check(); err != nil {
+        return false, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.dids[did] != nil {
+        return false, nil
+    }
+    s.dids[did] = &fakeDID{inUse: true, destination: destination, country: country, tenant: tenant}
+    return true, nil
+}
+
+func (s *fakeStorage) ReleaseDID(ctx context.Context, did, callID string) (bool, error) {
+    if err := s.check(); err != nil {
+        return false, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, record := range s.records {
+        if record.AssignedDID == did && record.CallID != callID && (record.Status == models.CallStateActive ||
+            record.Status == models.CallStateForwarded || record.Status == models.CallStateReturned) {
+            return false, nil
+        }
+    }
+    if d := s.dids[did]; d != nil {
+        d.inUse, d.destination = false, ""
+    }
+    s.writes = append(s.writes, "release "+callID+" "+did)
+    return true, nil
+}
+
+// landed returns the writes the storage has taken so far
+func (s *fakeStorage) landed() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]string{}, s.writes...)
+}
+
+func (s *fakeStorage) DIDCounts(ctx context.Context) (total, used int, err error) {
+    if err := s.check(); err != nil {
+        return 0, 0, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, d := range s.dids {
+        if d.inUse {
+            used++
+        }
+    }
+    return len(s.dids), used, nil
+}
+
+func (s *fakeStorage) StoreCallRecord(ctx context.Context, record *models.CallRecord) error {
+    if err := s.check(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.records[record.CallID] = copyCallRecord(record)
+    return nil
+}
+
+func (s *fakeStorage) UpdateCallStatus(ctx context.Context, callID string, status models.CallState) error {
+    if err := s.check(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if record := s.records[callID]; record != nil {
+        record.Status = status
+    }
+    s.writes = append(s.writes, "status "+callID+" "+string(status))
+    return nil
+}
+
+func (s *fakeStorage) RecordHangupCause(ctx context.Context, callID, cause string) error {
+    return s.check()
+}
+
+func (s *fakeStorage) StoreCallRecords(ctx context.Context, records []*models.CallRecord) error {
+    for _, record := range records {
+        if err := s.StoreCallRecord(ctx, record); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *fakeStorage) UpdateCallStatuses(ctx context.Context, callIDs []string, status models.CallState) error {
+    for _, callID := range callIDs {
+        if err := s.UpdateCallStatus(ctx, callID, status); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *fakeStorage) RecordHangupCauses(ctx context.Context, callIDs []string, cause string) error {
+    return s.check()
+}
+
+func (s *fakeStorage) inFlight(match func(*models.CallRecord) bool) (*models.CallRecord, error) {
+    if err := s.check(); err != nil {
+        return nil, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, record := range s.records {
+        if (record.Status == models.CallStateActive || record.Status == models.CallStateForwarded ||
+            record.Status == models.CallStateReturned) && match(record) {
+            return copyCallRecord(record), nil
+        }
+    }
+    return nil, sql.ErrNoRows
+}
+
+func (s *fakeStorage) CallRecordByDID(ctx context.Context, did string) (*models.CallRecord, error) {
+    return s.inFlight(func(record *models.CallRecord) bool { return record.AssignedDID == did })
+}
+
+func (s *fakeStorage) CallRecordByToken(ctx context.Context, token string) (*models.CallRecord, error) {
+    return s.inFlight(func(record *models.CallRecord) bool { return token != "" && record.MatchToken == token })
+}
+
+func (s *fakeStorage) InFlightCallRecord(ctx context.Context, callID string) (*models.CallRecord, error) {
+    return s.inFlight(func(record *models.CallRecord) bool { return record.CallID == callID })
+}
+
+func (s *fakeStorage) InFlightCallRecords(ctx context.Context) ([]*models.CallRecord, error) {
+    return nil, s.check()
+}
+
+func (s *fakeStorage) UnfinishedCallRecords(ctx context.Context, since time.Time) ([]*models.CallRecord, error) {
+    return nil, s.check()
+}
+
+func (s *fakeStorage) FailStaleCalls(ctx context.Context) (int64, error) { return 0, s.check() }
+
+func (s *fakeStorage) CallCounts(ctx context.Context) (calls, completed int, err error) {
+    return 0, 0, s.check()
+}
+
+func (s *fakeStorage) DIDHistory(ctx context.Context, did string, from, to time.Time, limit int) ([]models.DIDCall, error) {
+    return nil, s.check()
+}
+
+func (s *fakeStorage) ListCalls(ctx context.Context, f CallFilter, offset, limit int) ([]models.Call, int, error) {
+    return nil, 0, s.check()
+}
+
+func (s *fakeStorage) CallDetail(ctx context.Context, callID string) (*models.CallDetail, error) {
+    return nil, s.check()
+}
+
+func (s *fakeStorage) RecordCallEvent(ctx context.Context, callID string, event models.CallEvent) error {
+    return s.check()
+}
+
+func (s *fakeStorage) CallEvents(ctx context.Context, callID string) ([]models.CallEvent, error) {
+    return nil, s.check()
+}
+
+func (s *fakeStorage) CallStatuses(ctx context.Context, callIDs []string) (map[string]models.CallState, error) {
+    if err := s.check(); err != nil {
+        return nil, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    statuses := make(map[string]models.CallState)
+    for _, callID := range callIDs {
+        if record := s.records[callID]; record != nil {
+            statuses[callID] = record.Status
+        }
+    }
+    return statuses, nil
+}
+
+func (s *fakeStorage) CallsEnded(ctx context.Context, from, to time.Time) (int, error) {
+    return 0, s.check()
+}
+
+func (s *fakeStorage) BackdateCallEnd(ctx context.Context, callID string, end time.Time) error {
+    return s.check()
+}
+
+// emptyDriver is a database/sql driver whose queries return no rows and
+// whose statements change nothing, for the feature tables a test does not
+// care about. Ping fails while the storage it was opened for is down.
+type emptyDriver struct{}
+
+type emptyConn struct{ store *fakeStorage }
+
+type emptyStmt struct{}
+
+type emptyRows struct{}
+
+var (
+    emptyStores   sync.Map // DSN -> *fakeStorage
+    emptyDSNCount atomic.Int64
+)
+
+func init() {
+    sql.Register("s2empty", emptyDriver{})
+}
+
+func (emptyDriver) Open(dsn string) (driver.Conn, error) {
+    store, _ := emptyStores.Load(dsn)
+    s, _ := store.(*fakeStorage)
+    return &emptyConn{store: s}, nil
+}
+
+func (c *emptyConn) Prepare(query string) (driver.Stmt, error) { return emptyStmt{}, nil }
+func (c *emptyConn) Close() error                              { return nil }
+func (c *emptyConn) Begin() (driver.Tx, error)                 { return emptyTx{}, nil }
+
+func (c *emptyConn) Ping(ctx context.Context) error {
+    if c.store != nil {
+        return c.store.check()
+    }
+    return nil
+}
+
+type emptyTx struct{}
+
+func (emptyTx) Commit() error   { return nil }
+func (emptyTx) Rollback() error { return nil }
+
+func (emptyStmt) Close() error  { return nil }
+func (emptyStmt) NumInput() int { return -1 }
+
+func (emptyStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+func (emptyStmt) Query(args []driver.Value) (driver.Rows, error)  { return emptyRows{}, nil }
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+// newTestRouter builds a router on store and an empty database, with the
+// workers NewRouter would start left out
+func newTestRouter(t testing.TB, store *fakeStorage, cfg Config) *Router {
+    t.Helper()
+    dsn := fmt.Sprintf("test-%d", emptyDSNCount.Add(1))
+    emptyStores.Store(dsn, store)
+    db, err := sql.Open("s2empty", dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    }
+    r, err := newRouter(db, store, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        r.life.Stop()
+        db.Close()
+        emptyStores.Delete(dsn)
+    })
+    return r
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/ami"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Channel variable the dialplan sets to the CallID passed to processIncoming.
+// Export it in manager.conf (channelvars=S2_CALLID) for exact correlation;
+// without it calls are matched on Uniqueid/Linkedid or the dialled DID.
+const amiCallIDVar = "S2_CALLID"
+
+var callCompletions = metrics.NewCounter("s2_call_completions_total",
+    "Calls finalised before the stale cleanup, by final state and signal", "status", "source")
+
+// HandleAMIEvent finalises calls as soon as Asterisk reports their hangup,
+// instead of waiting for the stale-call cleanup to release the DID
+func (r *Router) HandleAMIEvent(ev ami.Event) {
+    switch ev.Name() {
+    case "BridgeEnter", "Bridge":
+        r.mu.Lock()
+        if callID := r.correlateAMI(ev); callID != "" {
+            r.bridgedCalls[callID] = true
+        }
+        r.mu.Unlock()
+
+    case "Hangup":
+        r.mu.RLock()
+        callID := r.correlateAMI(ev)
+        r.mu.RUnlock()
+        if callID == "" {
+            return
+        }
+        unlock := r.calls.lock(callID)
+        defer unlock()
+
+        r.mu.RLock()
+        record := r.activeCallsMap[callID]
+        r.mu.RUnlock()
+        if record == nil {
+            // Ended while the call lock was awaited
+            return
+        }
+        r.syncShared(record)
+
+        r.mu.RLock()
+        // Only a call that came back from S3 and was bridged onward reached S4
+        status := models.CallStateFailed
+        if record.Status == models.CallStateReturned && r.bridgedCalls[callID] {
+            status = models.CallStateCompleted
+        }
+        r.mu.RUnlock()
+
+        callLogger(context.Background(), record).Infof("Hangup for call %s on %s (cause %s), marking %s and releasing DID %s",
+            callID, ev.Get("Channel"), ev.Get("Cause"), status, record.AssignedDID)
+        r.finishCall(context.Background(), record, status, ev.Get("Cause"), "ami")
+    }
+}
+
+// CompleteCall ends a call on the dialplan's word, e.g. from the h extension.
+// A call that came back from S3 completes unless the cause is a hard failure;
+// one that never returned has failed.
+func (r *Router) CompleteCall(ctx context.Context, callID, cause string) (*models.CallRecord, error) {
+    if r.config.ReadOnly {
+        return nil, ErrReadOnly
+    }
+    callID = cleanString(callID)
+    cause = cleanString(cause)
+
+    unlock := r.calls.lock(callID)
+    defer unlock()
+
+    r.mu.RLock()
+    record, ok := r.activeCallsMap[callID]
+    r.mu.RUnlock()
+    if ok {
+        r.syncShared(record)
+    } else {
+        record = r.sharedCall(callID)
+    }
+    if record == nil {
+        // Not in memory, e.g. after a restart beyond the restore window
+        var err error
+        record, err = r.store.InFlightCallRecord(ctx, callID)
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("%w %s", ErrCallNotFound, callID)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("looking up call %s: %w", callID, err)
+        }
+        // Ended here already, its final status still on its way
+        if r.writesPending(callID) {
+            return nil, fmt.Errorf("%w %s", ErrCallNotFound, callID)
+        }
+    }
+
+    r.mu.RLock()
+    status := models.CallStateFailed
+    if record.Status == models.CallStateReturned && !hardFailureCauses[cause] {
+        status = models.CallStateCompleted
+    }
+    r.mu.RUnlock()
+
+    callLogger(ctx, record).Infof("Hangup for call %s (cause %s), marking %s and releasing DID %s",
+        callID, cause, status, record.AssignedDID)
+    r.finishCall(ctx, record, status, cause, "api")
+    return record, nil
+}
+
+// correlateAMI maps an AMI event to a tracked CallID, or "". Caller must hold r.mu.
+func (r *Router) correlateAMI(ev ami.Event) string {
+    if callID := ev.Vars[amiCallIDVar]; callID != "" {
+        if _, ok := r.activeCallsMap[callID]; ok {
+            return callID
+        }
+    }
+
+    for _, key := range []string{"Uniqueid", "Linkedid", "Uniqueid1", "Uniqueid2"} {
+        if id := ev.Get(key); id != "" {
+            if _, ok := r.activeCallsMap[id]; ok {
+                return id
+            }
+        }
+    }
+
+    // The return leg from S3 is dialled to the assigned DID
+    exten := ev.Get("Exten")
+    if exten == "" {
+        return ""
+    }
+    if r.config.TokenMode != TokenOff {
+        if did, token, ok := DecodeToken(exten, r.config.TokenMode, r.config.TokenDigits); ok {
+            if callID, ok := r.tokenToCall[token]; ok && r.activeCallsMap[callID] != nil &&
+                r.activeCallsMap[callID].AssignedDID == did {
+                return callID
+            }
+        }
+    }
+    if callID, ok := r.didToCallMap[exten]; ok {
+        if _, tracked := r.activeCallsMap[callID]; tracked {
+            return callID
+        }
+    }
+    return ""
+}
+
+// finishCall drops the call from the in-memory indexes, records its final
+// state and frees its DID. cause is the Q.850 hangup cause if known and
+// source names the signal that ended the call. Caller must hold the call's
+// lock but not r.mu, which is only taken for the indexes.
+func (r *Router) finishCall(ctx context.Context, record *models.CallRecord, status models.CallState, cause, source string) {
+    r.mu.Lock()
+    previous := record.Status
+    record.Status = status
+    r.untrackCall(record)
+    record = copyCallRecord(record)
+    r.mu.Unlock()
+    r.unshareCall(record)
+
+    // A call that died before coming back from S3 failed on its forward trunk
+    if status == models.CallStateFailed && previous == models.CallStateForwarded {
+        r.recordHardFailure(record.ForwardTrunk, record.OriginalDNIS, cause)
+    }
+    r.updateCallStatus(ctx, record.CallID, status)
+    event, detail := models.CallEventCompleted, source
+    if status == models.CallStateFailed {
+        event = models.CallEventFailed
+    }
+    if cause != "" {
+        detail += " cause=" + cause
+    }
+    r.recordCallEvent(ctx, record.CallID, event, r.clock.Now(), strings.TrimSpace(detail))
+    if cause != "" {
+        r.recordHangupCause(ctx, record.CallID, cause)
+    }
+    r.releaseDID(ctx, record.CallID, record.AssignedDID)
+    r.writeCDR(record, status, cause, source)
+    r.queueRecordingChecksum(record)
+    callCompletions.Inc(string(status), source)
+    r.traceSpan("s2.call_"+strings.ToLower(string(status)), record, "call.cause", cause, "call.source", source)
+
+    eventType := "call.completed"
+    if status == models.CallStateFailed {
+        eventType = "call.failed"
+    }
+    final := eventFor(ctx, eventType, record, status)
+    final.Detail = strings.TrimSpace(detail)
+    r.publish(final)
+}
+
+// untrackCall removes a record from the in-memory indexes, leaving entries
+// that already point at a newer call. Caller must hold r.mu, and unshares
+// the call once it has let go of it - Redis is I/O.
+func (r *Router) untrackCall(record *models.CallRecord) {
+    r.replicateEnd(record)
+    if _, ok := r.activeCallsMap[record.CallID]; ok {
+        r.notifyLive("removed", record)
+    }
+    delete(r.activeCallsMap, record.CallID)
+    delete(r.bridgedCalls, record.CallID)
+    delete(r.replication.mirrored, record.CallID)
+    if r.didToCallMap[record.AssignedDID] == record.CallID {
+        delete(r.didToCallMap, record.AssignedDID)
+    }
+    if record.MatchToken != "" && r.tokenToCall[record.MatchToken] == record.CallID {
+        delete(r.tokenToCall, record.MatchToken)
+    }
+    key := dedupKey(record.OriginalANI, record.OriginalDNIS)
+    if entry, ok := r.recentIncoming[key]; ok && entry.callID == record.CallID {
+        delete(r.recentIncoming, key)
+    }
+}
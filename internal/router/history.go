@@ -0,0 +1,96 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// MaxHistoryCalls caps the calls one history request returns
+const MaxHistoryCalls = 10000
+
+// DIDHistory lists the calls that used a DID between from and to, newest
+// first with their operator notes, and counts them by final state. Carrier
+// complaints about traffic "from" one of our numbers start here.
+func (r *Router) DIDHistory(ctx context.Context, did string, from, to time.Time, limit int) ([]models.DIDCall, map[models.CallState]int, error) {
+    if limit <= 0 || limit > MaxHistoryCalls {
+        limit = MaxHistoryCalls
+    }
+    calls, err := r.store.DIDHistory(ctx, cleanString(did), from, to, limit)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    dispositions := make(map[models.CallState]int)
+    ids := make([]string, 0, len(calls))
+    for _, c := range calls {
+        dispositions[c.Status]++
+        ids = append(ids, c.CallID)
+    }
+
+    notes, err := r.notesFor(ctx, NoteCall, ids)
+    if err != nil {
+        logger.Errorf("Failed to load notes for DID %s history: %v", did, err)
+    }
+    for i := range calls {
+        calls[i].Notes = notes[calls[i].CallID]
+    }
+    return calls, dispositions, nil
+}
+
+// ErrUnknownStatus is returned for a call listing filtered by a state that
+// does not exist
+var ErrUnknownStatus = errors.New("unknown call status")
+
+// Page sizes of ListCalls
+const (
+    DefaultCallsPerPage = 50
+    MaxCallsPerPage     = 500
+)
+
+// CallDetail returns a call record with its timeline and notes, nil if no
+// call has that CallID
+func (r *Router) CallDetail(ctx context.Context, callID string) (*models.CallDetail, error) {
+    callID = cleanString(callID)
+    detail, err := r.store.CallDetail(ctx, callID)
+    if err != nil || detail == nil {
+        return nil, err
+    }
+    if detail.Timeline, err = r.CallTimeline(ctx, callID); err != nil {
+        return nil, err
+    }
+    if detail.Notes, err = r.Notes(ctx, NoteCall, callID); err != nil {
+        return nil, err
+    }
+    return detail, nil
+}
+
+// ListCalls returns page (from 1) of the call records matching f, newest
+// first, with the number of matches across all pages
+func (r *Router) ListCalls(ctx context.Context, f CallFilter, page, perPage int) (*models.CallPage, error) {
+    switch f.Status {
+    case "", models.CallStateActive, models.CallStateForwarded, models.CallStateReturned,
+        models.CallStateCompleted, models.CallStateFailed:
+    default:
+        return nil, fmt.Errorf("%w %q", ErrUnknownStatus, f.Status)
+    }
+    if page < 1 {
+        page = 1
+    }
+    if perPage <= 0 {
+        perPage = DefaultCallsPerPage
+    }
+    if perPage > MaxCallsPerPage {
+        perPage = MaxCallsPerPage
+    }
+    f.ANI, f.DID = cleanString(f.ANI), cleanString(f.DID)
+
+    calls, total, err := r.store.ListCalls(ctx, f, (page-1)*perPage, perPage)
+    if err != nil {
+        return nil, err
+    }
+    return &models.CallPage{Calls: calls, Total: total, Page: page, PerPage: perPage}, nil
+}
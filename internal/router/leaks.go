@@ -0,0 +1,351 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    mapSampleInterval = time.Minute
+    mapSweepInterval  = 2 * time.Minute
+    mapSweepBatch     = 500 // call IDs per status query
+    mapSampleHistory  = 60  // one hour of samples
+    leakWindow        = 10  // samples of monotonic growth that raise a leak alert
+    leakMinGrowth     = 10  // ignore growth smaller than this over the window
+)
+
+var (
+    mapSizes = metrics.NewGauge("s2_memory_map_entries",
+        "Entries held in the router's in-memory indexes", "map")
+    mapLeaks = metrics.NewCounter("s2_memory_map_leak_alerts_total",
+        "Times an in-memory index grew steadily while no calls completed", "map")
+    mapEvictions = metrics.NewCounter("s2_memory_map_evictions_total",
+        "Calls the map sweep dropped from memory because the database has them closed or they went stale")
+)
+
+// MapSample is one observation of the in-memory index sizes
+type MapSample struct {
+    At          time.Time `json:"at"`
+    ActiveCalls int       `json:"active_calls"`
+    DIDs        int       `json:"dids"`
+    Tokens      int       `json:"tokens"`
+    Dedup       int       `json:"dedup"`
+    Completions int       `json:"completions"` // calls ended since the previous sample
+}
+
+// OrphanEntry is an in-memory index entry no longer backed by a live call
+type OrphanEntry struct {
+    Map    string `json:"map"`
+    Key    string `json:"key"`
+    CallID string `json:"call_id"`
+    Reason string `json:"reason"`
+}
+
+// mapMonitor keeps the recent size history used for leak detection
+type mapMonitor struct {
+    mu      sync.Mutex
+    samples []MapSample
+    leaking map[string]bool
+}
+
+// sampleMaps records the index sizes and checks them for leaks
+func (r *Router) sampleMaps() error {
+    now := r.clock.Now()
+
+    m := &r.maps
+    m.mu.Lock()
+    since := now.Add(-mapSampleInterval)
+    if n := len(m.samples); n > 0 {
+        since = m.samples[n-1].At
+    }
+    m.mu.Unlock()
+
+    completions, err := r.store.CallsEnded(context.Background(), since, now)
+    if err != nil {
+        logger.Errorf("Error counting completions: %v", err)
+        return err
+    }
+
+    r.mu.RLock()
+    sample := MapSample{
+        At:          now,
+        ActiveCalls: len(r.activeCallsMap),
+        DIDs:        len(r.didToCallMap),
+        Tokens:      len(r.tokenToCall),
+        Dedup:       len(r.recentIncoming),
+        Completions: completions,
+    }
+    r.mu.RUnlock()
+
+    mapSizes.Set(float64(sample.ActiveCalls), "active_calls")
+    mapSizes.Set(float64(sample.DIDs), "dids")
+    mapSizes.Set(float64(sample.Tokens), "tokens")
+    mapSizes.Set(float64(sample.Dedup), "dedup")
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.samples = append(m.samples, sample)
+    if len(m.samples) > mapSampleHistory {
+        m.samples = m.samples[len(m.samples)-mapSampleHistory:]
+    }
+    m.checkLeak("active_calls", func(s MapSample) int { return s.ActiveCalls })
+    m.checkLeak("dids", func(s MapSample) int { return s.DIDs })
+    return nil
+}
+
+// checkLeak alerts once when a map has grown at every one of the last
+// leakWindow samples while no calls completed. Caller must hold m.mu.
+func (m *mapMonitor) checkLeak(name string, size func(MapSample) int) {
+    if len(m.samples) < leakWindow {
+        return
+    }
+    window := m.samples[len(m.samples)-leakWindow:]
+
+    growing := true
+    completions := 0
+    for i, s := range window {
+        if i > 0 {
+            completions += s.Completions
+            if size(s) <= size(window[i-1]) {
+                growing = false
+            }
+        }
+    }
+    growth := size(window[len(window)-1]) - size(window[0])
+    leaking := growing && completions == 0 && growth >= leakMinGrowth
+
+    if leaking && !m.leaking[name] {
+        mapLeaks.Inc(name)
+        logger.Warnf("ALERT: %s map grew by %d over %d samples with no completions; completion signals may be missed",
+            name, growth, leakWindow)
+    }
+    m.leaking[name] = leaking
+}
+
+// MapHistory returns the recorded size samples, oldest first
+func (r *Router) MapHistory() []MapSample {
+    m := &r.maps
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return append([]MapSample(nil), m.samples...)
+}
+
+// OrphanedEntries lists index entries that no longer point at a live call
+func (r *Router) OrphanedEntries() []OrphanEntry {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.findOrphans()
+}
+
+// TrimOrphans removes every orphaned index entry and returns what was removed
+func (r *Router) TrimOrphans() []OrphanEntry {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    orphans := r.findOrphans()
+    for _, o := range orphans {
+        switch o.Map {
+        case "active_calls":
+            if record := r.activeCallsMap[o.Key]; record != nil {
+                r.notifyLive("removed", record)
+            }
+            delete(r.activeCallsMap, o.Key)
+        case "dids":
+            delete(r.didToCallMap, o.Key)
+        case "tokens":
+            delete(r.tokenToCall, o.Key)
+        case "bridged":
+            delete(r.bridgedCalls, o.Key)
+        }
+    }
+    if len(orphans) > 0 {
+        logger.Infof("Trimmed %d orphaned map entries", len(orphans))
+    }
+    return orphans
+}
+
+// findOrphans walks the indexes for stale or dangling entries. A call that
+// is no longer in flight orphans its own entries along with it.
+// Caller must hold r.mu.
+func (r *Router) findOrphans() []OrphanEntry {
+    orphans := []OrphanEntry{}
+    dead := make(map[string]bool)
+
+    for callID, record := range r.activeCallsMap {
+        if !r.isInFlight(record) {
+            dead[callID] = true
+            orphans = append(orphans, OrphanEntry{Map: "active_calls", Key: callID, CallID: callID,
+                Reason: fmt.Sprintf("%s since %s", record.Status, record.StartTime.Format(time.RFC3339))})
+        }
+    }
+
+    for did, callID := range r.didToCallMap {
+        record, ok := r.activeCallsMap[callID]
+        switch {
+        case !ok:
+            orphans = append(orphans, OrphanEntry{Map: "dids", Key: did, CallID: callID, Reason: "call not tracked"})
+        case record.AssignedDID != did:
+            orphans = append(orphans, OrphanEntry{Map: "dids", Key: did, CallID: callID, Reason: "call moved to " + record.AssignedDID})
+        case dead[callID]:
+            orphans = append(orphans, OrphanEntry{Map: "dids", Key: did, CallID: callID, Reason: "call not in flight"})
+        }
+    }
+
+    for token, callID := range r.tokenToCall {
+        record, ok := r.activeCallsMap[callID]
+        switch {
+        case !ok:
+            orphans = append(orphans, OrphanEntry{Map: "tokens", Key: token, CallID: callID, Reason: "call not tracked"})
+        case record.MatchToken != token:
+            orphans = append(orphans, OrphanEntry{Map: "tokens", Key: token, CallID: callID, Reason: "token reassigned"})
+        case dead[callID]:
+            orphans = append(orphans, OrphanEntry{Map: "tokens", Key: token, CallID: callID, Reason: "call not in flight"})
+        }
+    }
+
+    for callID := range r.bridgedCalls {
+        if _, ok := r.activeCallsMap[callID]; !ok || dead[callID] {
+            orphans = append(orphans, OrphanEntry{Map: "bridged", Key: callID, CallID: callID, Reason: "call not in flight"})
+        }
+    }
+    return orphans
+}
+
+// MapSizes reports how many entries each in-memory index holds
+func (r *Router) MapSizes() map[string]int {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return map[string]int{
+        "active_calls": len(r.activeCallsMap),
+        "dids":         len(r.didToCallMap),
+        "tokens":       len(r.tokenToCall),
+        "bridged":      len(r.bridgedCalls),
+        "dedup":        len(r.recentIncoming),
+    }
+}
+
+// sweepMaps drops tracked calls whose latest database record is closed -
+// failed as stale, ended by another router or by hand - and fails those
+// still open past their reservation TTL or stale timeout, releasing their
+// DIDs, so that a missed hangup does not keep a call in memory or its DID
+// in use until restart. The database is read without r.mu; a call that
+// changed in between or is being routed or ended is left to the next
+// sweep, as is a closed one whose own writes are still queued for retry.
+func (r *Router) sweepMaps() error {
+    r.mu.RLock()
+    tracked := make(map[string]*models.CallRecord, len(r.activeCallsMap))
+    var stale []*models.CallRecord
+    for callID, record := range r.activeCallsMap {
+        tracked[callID] = record
+        if !r.isInFlight(record) {
+            stale = append(stale, record)
+        }
+    }
+    r.mu.RUnlock()
+
+    ids := make([]string, 0, len(tracked))
+    for callID := range tracked {
+        ids = append(ids, callID)
+    }
+    closed := make(map[string]models.CallState)
+    for start := 0; start < len(ids); start += mapSweepBatch {
+        end := start + mapSweepBatch
+        if end > len(ids) {
+            end = len(ids)
+        }
+        if err := r.closedCalls(ids[start:end], closed); err != nil {
+            logger.Errorf("Error sweeping in-memory calls: %v", err)
+            return err
+        }
+    }
+
+    r.mu.Lock()
+    var ended []*models.CallRecord
+    for callID, status := range closed {
+        record := r.activeCallsMap[callID]
+        if record == nil || record != tracked[callID] || r.writesPending(callID) {
+            continue
+        }
+        unlock, idle := r.calls.tryLock(callID)
+        if !idle {
+            continue
+        }
+        record.Status = status
+        r.untrackCall(record)
+        unlock()
+        ended = append(ended, copyCallRecord(record))
+    }
+    dangling := 0
+    for did, callID := range r.didToCallMap {
+        if _, ok := r.activeCallsMap[callID]; !ok {
+            delete(r.didToCallMap, did)
+            dangling++
+        }
+    }
+    for token, callID := range r.tokenToCall {
+        if _, ok := r.activeCallsMap[callID]; !ok {
+            delete(r.tokenToCall, token)
+            dangling++
+        }
+    }
+    r.mu.Unlock()
+    for _, record := range ended {
+        r.unshareCall(record)
+    }
+    failed := r.failStaleCalls(stale, closed)
+
+    if evicted := len(ended); evicted > 0 || failed > 0 || dangling > 0 {
+        mapEvictions.Add(float64(evicted + failed))
+        logger.Infof("Map sweep evicted %d closed calls, failed %d stale ones and dropped %d dangling index entries",
+            evicted, failed, dangling)
+    }
+    return nil
+}
+
+// failStaleCalls fails the calls of stale that are still tracked and still
+// past their in-flight age, other than those the database has closed, and
+// returns how many it failed
+func (r *Router) failStaleCalls(stale []*models.CallRecord, closed map[string]models.CallState) int {
+    ctx := context.Background()
+    failed := 0
+    for _, record := range stale {
+        if _, ok := closed[record.CallID]; ok {
+            continue
+        }
+        unlock, idle := r.calls.tryLock(record.CallID)
+        if !idle {
+            continue
+        }
+        r.mu.RLock()
+        current := r.activeCallsMap[record.CallID] == record && !r.isInFlight(record)
+        status := record.Status
+        r.mu.RUnlock()
+        if current {
+            callLogger(ctx, record).Warnf("Call %s stale in %s since %s, failing it and releasing DID %s",
+                record.CallID, status, record.StartTime.Format(time.RFC3339), record.AssignedDID)
+            r.finishCall(ctx, record, models.CallStateFailed, "", "stale")
+            failed++
+        }
+        unlock()
+    }
+    return failed
+}
+
+// closedCalls adds those of callIDs whose record is final to closed
+func (r *Router) closedCalls(callIDs []string, closed map[string]models.CallState) error {
+    statuses, err := r.store.CallStatuses(context.Background(), callIDs)
+    if err != nil {
+        return err
+    }
+    for callID, status := range statuses {
+        if status == models.CallStateCompleted || status == models.CallStateFailed {
+            closed[callID] = status
+        }
+    }
+    return nil
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// A call back from S3 whose hangup never arrived is failed by the map sweep
+// once past its stale timeout, and its DID released; a fresher call stays
+func TestSweepFailsStaleCalls(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    store := newFakeStorage(fakeDIDs(2)...)
+    r := newTestRouter(t, store, Config{Clock: fake})
+    ctx := context.Background()
+
+    stale, err := r.ProcessIncomingCall(ctx, "stale-1", "12125550001", "442070000001", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.ProcessReturnCall(ctx, "442070000001", stale.DIDAssigned, ReturnOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    fake.Advance(staleCallAge - time.Minute)
+    fresh, err := r.ProcessIncomingCall(ctx, "fresh-1", "12125550002", "442070000002", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := r.sweepMaps(); err != nil {
+        t.Fatal(err)
+    }
+    if !store.inUse(stale.DIDAssigned) {
+        t.Fatalf("call failed before its stale timeout")
+    }
+
+    fake.Advance(time.Minute)
+    if err := r.sweepMaps(); err != nil {
+        t.Fatal(err)
+    }
+    r.mu.RLock()
+    _, staleTracked := r.activeCallsMap["stale-1"]
+    _, freshTracked := r.activeCallsMap["fresh-1"]
+    _, didTracked := r.didToCallMap[stale.DIDAssigned]
+    r.mu.RUnlock()
+    if staleTracked || didTracked {
+        t.Fatal("stale call still tracked after the sweep")
+    }
+    if !freshTracked || !store.inUse(fresh.DIDAssigned) {
+        t.Fatal("sweep ended a call still in flight")
+    }
+    if store.inUse(stale.DIDAssigned) {
+        t.Fatalf("DID %s of the stale call still in use", stale.DIDAssigned)
+    }
+    store.mu.Lock()
+    status := store.records["stale-1"].Status
+    store.mu.Unlock()
+    if status != models.CallStateFailed {
+        t.Fatalf("stale call recorded as %s", status)
+    }
+}
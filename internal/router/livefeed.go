@@ -0,0 +1,91 @@
+package router
+
+import (
+    "sync"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Wallboards follow the active calls through a live feed: a snapshot when
+// they subscribe, then every call added, updated or removed. Updates are
+// sent with r.mu held, so the snapshot and the updates after it line up.
+// A subscriber that falls liveFeedBuffer updates behind is cut off rather
+// than allowed to hold up call processing; it resubscribes for a new
+// snapshot.
+const liveFeedBuffer = 256
+
+var liveFeedSubscribers = metrics.NewGauge("s2_live_feed_subscribers",
+    "Clients following the live call feed")
+
+type liveFeed struct {
+    mu   sync.Mutex
+    subs map[chan models.LiveCallUpdate]bool
+}
+
+// SubscribeCalls returns the active calls and a channel of the changes
+// after them. The channel is closed by cancel, or early if the subscriber
+// falls behind.
+func (r *Router) SubscribeCalls() (snapshot models.LiveCallUpdate, updates <-chan models.LiveCallUpdate, cancel func()) {
+    ch := make(chan models.LiveCallUpdate, liveFeedBuffer)
+
+    r.mu.RLock()
+    snapshot = models.LiveCallUpdate{SchemaVersion: models.EventSchemaVersion, Type: "snapshot", Timestamp: r.clock.Now(), Calls: make([]models.LiveCall, 0, len(r.activeCallsMap))}
+    for _, record := range r.activeCallsMap {
+        snapshot.Calls = append(snapshot.Calls, *liveCall(record))
+    }
+    f := &r.live
+    f.mu.Lock()
+    f.subs[ch] = true
+    liveFeedSubscribers.Set(float64(len(f.subs)))
+    f.mu.Unlock()
+    r.mu.RUnlock()
+
+    cancel = func() {
+        f.mu.Lock()
+        defer f.mu.Unlock()
+        if f.subs[ch] {
+            delete(f.subs, ch)
+            close(ch)
+            liveFeedSubscribers.Set(float64(len(f.subs)))
+        }
+    }
+    return snapshot, ch, cancel
+}
+
+// notifyLive sends a change of an active call to every subscriber.
+// Caller must hold r.mu.
+func (r *Router) notifyLive(change string, record *models.CallRecord) {
+    f := &r.live
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if len(f.subs) == 0 {
+        return
+    }
+    update := models.LiveCallUpdate{SchemaVersion: models.EventSchemaVersion, Type: change, Timestamp: r.clock.Now(), Call: liveCall(record)}
+    for ch := range f.subs {
+        select {
+        case ch <- update:
+        default:
+            delete(f.subs, ch)
+            close(ch)
+        }
+    }
+    liveFeedSubscribers.Set(float64(len(f.subs)))
+}
+
+func liveCall(record *models.CallRecord) *models.LiveCall {
+    return &models.LiveCall{
+        CallID:       record.CallID,
+        ANI:          record.OriginalANI,
+        DNIS:         record.OriginalDNIS,
+        DID:          record.AssignedDID,
+        Status:       record.Status,
+        StartTime:    record.StartTime,
+        Duration:     record.Duration,
+        ForwardTrunk: record.ForwardTrunk,
+        Campaign:     record.Campaign,
+        Tenant:       record.Tenant,
+        Tags:         copyTags(record.Tags),
+    }
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+    "context"
+    "math"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    loadWindow   = 10              // seconds of admitted calls CPS is averaged over
+    loadDIDCache = 5 * time.Second // how long DB DID counts serve load polls
+)
+
+// loadTracker keeps what Load needs so a poll is answered from memory:
+// admitted calls per second and recently read DID counts
+type loadTracker struct {
+    mu      sync.Mutex
+    calls   [loadWindow]int   // admitted calls, by Unix second modulo loadWindow
+    seconds [loadWindow]int64 // the Unix second each slot counts
+
+    refresh sync.Mutex // one DB read at a time; other polls wait for it
+    readAt  time.Time
+    free    int64 // including unmaterialized range DIDs
+    used    int
+}
+
+// countAdmitted records one incoming call accepted for routing
+func (r *Router) countAdmitted() {
+    now := r.clock.Now().Unix()
+    slot := now % loadWindow
+
+    l := &r.load
+    l.mu.Lock()
+    if l.seconds[slot] != now {
+        l.seconds[slot], l.calls[slot] = now, 0
+    }
+    l.calls[slot]++
+    l.mu.Unlock()
+}
+
+// admittedCPS averages admitted calls over the last loadWindow seconds
+func (r *Router) admittedCPS() float64 {
+    now := r.clock.Now().Unix()
+
+    l := &r.load
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    total := 0
+    for i, second := range l.seconds {
+        if now-second < loadWindow {
+            total += l.calls[i]
+        }
+    }
+    return float64(total) / loadWindow
+}
+
+// didCounts returns free and used DIDs, read from the database at most
+// every loadDIDCache. A failed read keeps serving the last counts.
+func (r *Router) didCounts(ctx context.Context) (free int64, used int) {
+    l := &r.load
+    l.refresh.Lock()
+    defer l.refresh.Unlock()
+
+    if r.clock.Now().Sub(l.readAt) >= loadDIDCache {
+        total, inUse, err := r.store.DIDCounts(ctx)
+        if err != nil {
+            logger.Errorf("Error counting DIDs for load: %v", err)
+        } else {
+            l.free = int64(total-inUse) + r.unmaterializedRangeDIDs(ctx)
+            l.used = inUse
+            l.readAt = r.clock.Now()
+        }
+    }
+    return l.free, l.used
+}
+
+// Load scores how busy this instance is for a balancer choosing among S2
+// routers: 0 is idle, 100 is full or not taking calls. The score is the
+// share of the DID pool in use, as DIDs are what runs out first, or of
+// the concurrent call limit when that is nearer; active calls and CPS
+// come along so the caller can weigh them itself.
+func (r *Router) Load(ctx context.Context) models.Load {
+    r.mu.RLock()
+    active := len(r.activeCallsMap)
+    draining := r.draining
+    r.mu.RUnlock()
+
+    free, used := r.didCounts(ctx)
+    load := models.Load{
+        ActiveCalls: active,
+        CPS:         math.Round(r.admittedCPS()*10) / 10,
+        FreeDIDs:    free,
+        UsedDIDs:    used,
+        Accepting:   !draining && !r.config.ReadOnly,
+        Score:       100,
+    }
+    limit := r.config.MaxConcurrentCalls
+    if limit > 0 && active >= limit {
+        load.Accepting = false
+    }
+    if pool := free + int64(used); pool > 0 {
+        load.Headroom = math.Round(float64(free)/float64(pool)*1000) / 1000
+        if load.Accepting {
+            load.Score = math.Round((1-load.Headroom)*1000) / 10
+        }
+    }
+    // Near the concurrent call limit the router is as full as its calls
+    if limit > 0 && load.Accepting {
+        load.Score = math.Max(load.Score, math.Round(float64(active)/float64(limit)*1000)/10)
+    }
+    return load
+}
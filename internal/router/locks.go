@@ -0,0 +1,122 @@
+package router
+
+import (
+    "context"
+    "sync"
+)
+
+// r.mu guards only the in-memory indexes and is never held across a
+// database round trip on the call path. What orders the work on one call -
+// its record, status and event writes, the return leg and the hangup - is
+// the call's own lock, taken before r.mu whenever both are needed.
+//
+// A call being admitted holds an admission from the moment its checks
+// pass until it is tracked, so the concurrency and campaign limits count
+// it and a duplicate request waits for it instead of taking a second DID.
+type callLocks struct {
+    mu    sync.Mutex
+    locks map[string]*callLock
+}
+
+type callLock struct {
+    sync.Mutex
+    refs int // holders and waiters; the lock is dropped at 0
+}
+
+func (l *callLocks) get(callID string) *callLock {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.locks == nil {
+        l.locks = make(map[string]*callLock)
+    }
+    c := l.locks[callID]
+    if c == nil {
+        c = &callLock{}
+        l.locks[callID] = c
+    }
+    c.refs++
+    return c
+}
+
+func (l *callLocks) put(callID string, c *callLock) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if c.refs--; c.refs == 0 {
+        delete(l.locks, callID)
+    }
+}
+
+// lock takes the lock of callID and returns its unlock
+func (l *callLocks) lock(callID string) func() {
+    c := l.get(callID)
+    c.Lock()
+    return func() {
+        c.Unlock()
+        l.put(callID, c)
+    }
+}
+
+// tryLock is lock for background tasks that skip a call busy elsewhere
+func (l *callLocks) tryLock(callID string) (func(), bool) {
+    c := l.get(callID)
+    if !c.TryLock() {
+        l.put(callID, c)
+        return nil, false
+    }
+    return func() {
+        c.Unlock()
+        l.put(callID, c)
+    }, true
+}
+
+// admission is a call between its checks and trackCall
+type admission struct {
+    callID   string
+    key      string // dedup key
+    campaign string
+    done     chan struct{}
+}
+
+// admit registers a call that passed its checks. Caller must hold r.mu.
+func (r *Router) admit(callID, ani, dnis, campaign string) *admission {
+    a := &admission{callID: callID, key: dedupKey(ani, dnis), campaign: campaign, done: make(chan struct{})}
+    r.admissions[callID] = a
+    return a
+}
+
+// settle ends an admission, waking duplicates waiting on it. Caller must
+// hold r.mu.
+func (r *Router) settle(a *admission) {
+    if r.admissions[a.callID] == a {
+        delete(r.admissions, a.callID)
+        close(a.done)
+    }
+}
+
+// admitting returns the admission of a call with the same ANI/DNIS, nil if
+// there is none or dedup is off. Caller must hold r.mu.
+func (r *Router) admitting(ani, dnis string) *admission {
+    if r.config.DedupWindow <= 0 {
+        return nil
+    }
+    key := dedupKey(ani, dnis)
+    for _, a := range r.admissions {
+        if a.key == key {
+            return a
+        }
+    }
+    return nil
+}
+
+// awaitAdmission waits for a to settle with r.mu released, and returns
+// with it held again
+func (r *Router) awaitAdmission(ctx context.Context, a *admission) error {
+    r.mu.Unlock()
+    defer r.mu.Lock()
+    select {
+    case <-a.done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
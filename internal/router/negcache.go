@@ -0,0 +1,340 @@
+package router
+
+import (
+    "errors"
+    "fmt"
+    mathrand "math/rand"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// How a blocked destination returns to service once its block runs out
+const (
+    FailbackImmediate = "immediate" // unblock as soon as the TTL passes
+    FailbackManual    = "manual"    // hold until ApproveFailback
+    FailbackRamp      = "ramp"      // admit a growing share of calls over NegativeCacheRamp
+)
+
+// Negative cache entry states
+const (
+    negBlocked  = "blocked"
+    negPending  = "awaiting_approval"
+    negRamping  = "ramping"
+    negWatching = "" // failures below the threshold
+)
+
+// ErrDestinationUnreachable is returned when a destination has recently
+// failed hard on its trunk and no reroute is available
+var ErrDestinationUnreachable = errors.New("destination unreachable")
+
+// Q.850 causes that mean the destination or trunk cannot take calls, as
+// opposed to the callee being busy or not answering
+var hardFailureCauses = map[string]bool{
+    "1":  true, // unallocated number
+    "2":  true, // no route to transit network
+    "3":  true, // no route to destination
+    "27": true, // destination out of order
+    "28": true, // invalid number format
+    "34": true, // no circuit available
+    "38": true, // network out of order
+    "41": true, // temporary failure
+    "42": true, // switching equipment congestion
+}
+
+var (
+    negativeCacheBlocks = metrics.NewCounter("s2_negative_cache_blocks_total",
+        "Calls fast-failed or rerouted because their destination recently failed", "action")
+    negativeCacheEntries = metrics.NewGauge("s2_negative_cache_entries",
+        "Destinations currently held in the negative cache")
+    negativeCacheFailbacks = metrics.NewCounter("s2_negative_cache_failbacks_total",
+        "Blocked destinations restored to service", "policy")
+)
+
+// NegativeEntry is the failure history of one destination prefix on a trunk
+type NegativeEntry struct {
+    Trunk        string     `json:"trunk"`
+    Prefix       string     `json:"prefix"`
+    Failures     int        `json:"failures"`
+    FirstFailure time.Time  `json:"first_failure"`
+    LastFailure  time.Time  `json:"last_failure"`
+    LastCause    string     `json:"last_cause"`
+    BlockedUntil *time.Time `json:"blocked_until,omitempty"`
+    State        string     `json:"state,omitempty"`      // blocked, awaiting_approval or ramping
+    RampUntil    *time.Time `json:"ramp_until,omitempty"` // when a ramping destination takes all calls again
+}
+
+// negativeCache remembers destinations that keep failing so they are not
+// hammered while dead
+type negativeCache struct {
+    mu      sync.Mutex
+    entries map[string]*NegativeEntry
+}
+
+func (r *Router) negativeKey(trunk, dnis string) (string, string) {
+    prefix := dnis
+    if len(prefix) > r.config.NegativeCacheDigits {
+        prefix = prefix[:r.config.NegativeCacheDigits]
+    }
+    return trunk + "|" + prefix, prefix
+}
+
+// recordHardFailure counts a failed call towards blocking its destination
+func (r *Router) recordHardFailure(trunk, dnis, cause string) {
+    if r.config.NegativeCacheTTL <= 0 || !hardFailureCauses[cause] {
+        return
+    }
+
+    key, prefix := r.negativeKey(trunk, dnis)
+    now := r.clock.Now()
+
+    c := &r.negative
+    c.mu.Lock()
+
+    entry, ok := c.entries[key]
+    if !ok || now.Sub(entry.LastFailure) > r.config.NegativeCacheTTL {
+        entry = &NegativeEntry{Trunk: trunk, Prefix: prefix, FirstFailure: now}
+        c.entries[key] = entry
+    }
+    entry.Failures++
+    entry.LastFailure = now
+    entry.LastCause = cause
+
+    var event *models.Event
+    if entry.Failures >= r.config.NegativeCacheFailures {
+        until := now.Add(r.config.NegativeCacheTTL)
+        if entry.State != negBlocked {
+            // New block, or a relapse while awaiting failback or ramping
+            logger.Warnf("ALERT: %s prefix %s failed %d times (cause %s), blocking until %s",
+                trunk, prefix, entry.Failures, cause, until.Format(time.RFC3339))
+            event = negativeEvent("destination.blocked", entry,
+                fmt.Sprintf("%d hard failures, last cause %s, blocked until %s", entry.Failures, cause, until.Format(time.RFC3339)))
+        }
+        entry.BlockedUntil = &until
+        entry.State = negBlocked
+        entry.RampUntil = nil
+    }
+    negativeCacheEntries.Set(float64(len(c.entries)))
+    c.mu.Unlock()
+
+    if event != nil {
+        r.publish(*event)
+    }
+}
+
+// unreachable reports whether a call to the destination must stay off the
+// trunk and why. Ramping destinations turn away the calls above their
+// current share.
+func (r *Router) unreachable(trunk, dnis string) (bool, string) {
+    if r.config.NegativeCacheTTL <= 0 {
+        return false, ""
+    }
+
+    key, _ := r.negativeKey(trunk, dnis)
+    now := r.clock.Now()
+    c := &r.negative
+    c.mu.Lock()
+
+    entry, ok := c.entries[key]
+    if !ok || entry.State == negWatching {
+        c.mu.Unlock()
+        return false, ""
+    }
+    event, recovered := r.advanceFailback(entry, now)
+    if recovered {
+        delete(c.entries, key)
+        negativeCacheEntries.Set(float64(len(c.entries)))
+    }
+
+    blocked, reason := false, ""
+    switch {
+    case recovered:
+    case entry.State == negBlocked:
+        blocked, reason = true, "for another "+entry.BlockedUntil.Sub(now).Round(time.Second).String()
+    case entry.State == negPending:
+        blocked, reason = true, "until failback is approved"
+    case entry.State == negRamping:
+        // Admit calls in proportion to how far the ramp has got
+        share := 1 - float64(entry.RampUntil.Sub(now))/float64(r.config.NegativeCacheRamp)
+        if mathrand.Float64() >= share {
+            blocked, reason = true, fmt.Sprintf("while ramping back (%.0f%% of calls)", share*100)
+        }
+    }
+    c.mu.Unlock()
+
+    if event != nil {
+        r.publish(*event)
+    }
+    return blocked, reason
+}
+
+// advanceFailback moves an entry whose block or ramp has run out to its
+// next state under the failback policy and returns the event documenting
+// the change. recovered means the destination is back in full service and
+// the entry should go. Caller must hold r.negative.mu.
+func (r *Router) advanceFailback(entry *NegativeEntry, now time.Time) (event *models.Event, recovered bool) {
+    switch entry.State {
+    case negBlocked:
+        if now.Before(*entry.BlockedUntil) {
+            return nil, false
+        }
+        switch r.config.NegativeCacheFailback {
+        case FailbackManual:
+            entry.State = negPending
+            logger.Infof("%s prefix %s block expired, awaiting failback approval", entry.Trunk, entry.Prefix)
+            return negativeEvent("destination.failback_pending", entry, "block expired, awaiting operator approval"), false
+        case FailbackRamp:
+            until := now.Add(r.config.NegativeCacheRamp)
+            entry.State = negRamping
+            entry.RampUntil = &until
+            logger.Infof("%s prefix %s block expired, ramping back until %s",
+                entry.Trunk, entry.Prefix, until.Format(time.RFC3339))
+            return negativeEvent("destination.ramping", entry,
+                "block expired, ramping back until "+until.Format(time.RFC3339)), false
+        }
+        return r.failback(entry, FailbackImmediate, "block expired"), true
+    case negRamping:
+        if now.Before(*entry.RampUntil) {
+            return nil, false
+        }
+        return r.failback(entry, FailbackRamp, "ramp complete"), true
+    }
+    return nil, false
+}
+
+// failback returns a destination to full service
+func (r *Router) failback(entry *NegativeEntry, policy, detail string) *models.Event {
+    negativeCacheFailbacks.Inc(policy)
+    logger.Infof("%s prefix %s restored (%s)", entry.Trunk, entry.Prefix, detail)
+    return negativeEvent("destination.restored", entry, detail)
+}
+
+func negativeEvent(kind string, entry *NegativeEntry, detail string) *models.Event {
+    return &models.Event{
+        Type:   kind,
+        DNIS:   entry.Prefix,
+        Detail: entry.Trunk + " prefix " + entry.Prefix + ": " + detail,
+    }
+}
+
+// routeAroundFailures returns the trunk to use for a new call, moving it to
+// the reroute trunk or failing fast when the destination is blocked
+func (r *Router) routeAroundFailures(trunk, dnis string) (string, error) {
+    blocked, reason := r.unreachable(trunk, dnis)
+    if !blocked {
+        return trunk, nil
+    }
+
+    reroute := r.config.NegativeCacheReroute
+    if reroute != "" && reroute != trunk {
+        if stillBlocked, _ := r.unreachable(reroute, dnis); !stillBlocked {
+            negativeCacheBlocks.Inc("rerouted")
+            logger.Infof("%s unreachable via %s, rerouting to %s", dnis, trunk, reroute)
+            return reroute, nil
+        }
+    }
+
+    negativeCacheBlocks.Inc("failed")
+    return "", fmt.Errorf("%w: %s via %s %s", ErrDestinationUnreachable, dnis, trunk, reason)
+}
+
+// pruneNegativeCache drops entries whose failures have aged out and moves
+// expired blocks and ramps on, so failback happens without waiting for a call
+func (r *Router) pruneNegativeCache() error {
+    now := r.clock.Now()
+    c := &r.negative
+    c.mu.Lock()
+
+    var events []models.Event
+    for key, entry := range c.entries {
+        if entry.State == negWatching {
+            if now.Sub(entry.LastFailure) > r.config.NegativeCacheTTL {
+                delete(c.entries, key)
+            }
+            continue
+        }
+        event, recovered := r.advanceFailback(entry, now)
+        if event != nil {
+            events = append(events, *event)
+        }
+        if recovered {
+            delete(c.entries, key)
+        }
+    }
+    negativeCacheEntries.Set(float64(len(c.entries)))
+    c.mu.Unlock()
+
+    for _, event := range events {
+        r.publish(event)
+    }
+    return nil
+}
+
+// NegativeCache lists cached destination failures, most recent first
+func (r *Router) NegativeCache() []NegativeEntry {
+    c := &r.negative
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    list := make([]NegativeEntry, 0, len(c.entries))
+    for _, entry := range c.entries {
+        list = append(list, *entry)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].LastFailure.After(list[j].LastFailure) })
+    return list
+}
+
+// ApproveFailback restores destinations awaiting manual failback that match
+// trunk and prefix (empty matches all) and returns how many were restored
+func (r *Router) ApproveFailback(trunk, prefix string) int {
+    c := &r.negative
+    c.mu.Lock()
+
+    var events []models.Event
+    for key, entry := range c.entries {
+        if entry.State != negPending || (trunk != "" && entry.Trunk != trunk) || (prefix != "" && entry.Prefix != prefix) {
+            continue
+        }
+        events = append(events, *r.failback(entry, FailbackManual, "failback approved"))
+        delete(c.entries, key)
+    }
+    negativeCacheEntries.Set(float64(len(c.entries)))
+    c.mu.Unlock()
+
+    for _, event := range events {
+        r.publish(event)
+    }
+    return len(events)
+}
+
+// ClearNegativeCache unblocks a trunk and prefix, or everything when both
+// are empty, and returns the number of entries removed
+func (r *Router) ClearNegativeCache(trunk, prefix string) int {
+    c := &r.negative
+    c.mu.Lock()
+    
+    removed := 0
+    var events []models.Event
+    for key, entry := range c.entries {
+        if (trunk == "" || entry.Trunk == trunk) && (prefix == "" || entry.Prefix == prefix) {
+            if entry.State != negWatching {
+                events = append(events, *negativeEvent("destination.restored", entry, "cleared by operator"))
+            }
+            delete(c.entries, key)
+            removed++
+        }
+    }
+    negativeCacheEntries.Set(float64(len(c.entries)))
+    c.mu.Unlock()
+
+    if removed > 0 {
+        logger.Infof("Cleared %d negative cache entries", removed)
+    }
+    for _, event := range events {
+        r.publish(event)
+    }
+    return removed
+}
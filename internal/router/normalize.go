@@ -0,0 +1,131 @@
+package router
+
+import (
+    "errors"
+    "fmt"
+    "net/url"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+// Numbers reach the router however the dialplan happened to pass them, and
+// Asterisk hands over more than digits:
+//
+//	sip_uri        "Alice" <sip:+15551234@10.0.0.1;user=phone> or tel:+15551234
+//	plus_space     a "+" sent unencoded in the query string arrives as a space
+//	parameters     15551234;npdi;rn=15550000 or a URI's ?headers
+//	percent_escape %2B15551234: escapes left by URIENCODE, in uppercase hex,
+//	               that a proxy or a second encoding kept from being decoded
+//	spaces         spaces inside the number
+//
+// Tolerant mode rewrites them into the plain number, strict mode refuses
+// them, and off only trims whitespace and line breaks as before. Each
+// rewrite or refusal is counted by field and kind.
+const (
+    NormalizeTolerant = "tolerant"
+    NormalizeStrict   = "strict"
+    NormalizeOff      = "off"
+)
+
+var (
+    inputNormalized = metrics.NewCounter("s2_input_normalized_total",
+        "Asterisk-supplied numbers rewritten by input normalization, by field and kind", "field", "kind")
+    inputRejected = metrics.NewCounter("s2_input_rejected_total",
+        "Asterisk-supplied numbers refused by strict input normalization, by field and kind", "field", "kind")
+)
+
+// ErrMalformedNumber is returned for an ANI, DNIS or DID that is empty after
+// normalization, or that strict mode refuses to normalize
+var ErrMalformedNumber = errors.New("malformed number")
+
+func validNormalization(mode string) bool {
+    switch mode {
+    case NormalizeTolerant, NormalizeStrict, NormalizeOff:
+        return true
+    }
+    return false
+}
+
+// normalizeNumber turns a number as Asterisk supplied it into the plain
+// number, per the configured mode; field names it in metrics and errors
+func (r *Router) normalizeNumber(field, value string) (string, error) {
+    if r.config.InputNormalization == NormalizeOff {
+        return cleanString(value), nil
+    }
+    number, kinds := normalizeNumber(value)
+    if r.config.InputNormalization == NormalizeStrict && len(kinds) > 0 {
+        for _, kind := range kinds {
+            inputRejected.Inc(field, kind)
+        }
+        return "", fmt.Errorf("%w: %s %q is not a plain number (%s)", ErrMalformedNumber, field, value, strings.Join(kinds, ", "))
+    }
+    for _, kind := range kinds {
+        inputNormalized.Inc(field, kind)
+    }
+    if number == "" && value != "" {
+        return "", fmt.Errorf("%w: %s %q holds no number", ErrMalformedNumber, field, value)
+    }
+    return number, nil
+}
+
+// normalizeNumber applies every rewrite value needs and names them
+func normalizeNumber(value string) (string, []string) {
+    var kinds []string
+    s := strings.ReplaceAll(strings.ReplaceAll(value, "\n", ""), "\r", "")
+
+    // Only a leading space can be a lost "+"; the number must follow it
+    if trimmed := strings.TrimLeft(s, " "); trimmed != s && trimmed != "" && trimmed[0] >= '0' && trimmed[0] <= '9' {
+        s = "+" + trimmed
+        kinds = append(kinds, "plus_space")
+    }
+    s = strings.TrimSpace(s)
+
+    if strings.Contains(s, "%") {
+        if decoded, err := url.PathUnescape(s); err == nil && decoded != s {
+            s = strings.TrimSpace(decoded)
+            kinds = append(kinds, "percent_escape")
+        }
+    }
+
+    if uri, ok := sipUser(s); ok {
+        s = uri
+        kinds = append(kinds, "sip_uri")
+    }
+
+    if i := strings.IndexAny(s, ";?"); i >= 0 {
+        s = strings.TrimSpace(s[:i])
+        kinds = append(kinds, "parameters")
+    }
+
+    if strings.ContainsAny(s, " \t") {
+        s = strings.Join(strings.Fields(s), "")
+        kinds = append(kinds, "spaces")
+    }
+    return s, kinds
+}
+
+// sipUser extracts the user part of a SIP or tel URI, with or without the
+// angle brackets and display name of a From header
+func sipUser(s string) (string, bool) {
+    if open := strings.LastIndex(s, "<"); open >= 0 {
+        if end := strings.Index(s[open:], ">"); end > 0 {
+            s = s[open+1 : open+end]
+        }
+    }
+    lower := strings.ToLower(s)
+    for _, scheme := range []string{"sips:", "sip:", "tel:"} {
+        if !strings.HasPrefix(lower, scheme) {
+            continue
+        }
+        user := s[len(scheme):]
+        // Only sip:/sips: have a host; a tel: number is all user
+        if scheme != "tel:" {
+            if at := strings.Index(user, "@"); at >= 0 {
+                user = user[:at]
+            }
+        }
+        return user, true
+    }
+    return s, false
+}
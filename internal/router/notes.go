@@ -0,0 +1,135 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Things notes can be attached to
+const (
+    NoteCall = "call"
+    NoteDID  = "did"
+)
+
+const maxNoteLength = 4000
+
+// ErrNoteSubjectNotFound is returned for notes on a call or DID that does not exist
+var ErrNoteSubjectNotFound = errors.New("not found")
+
+// AddNote attaches a note to an existing call record or DID
+func (r *Router) AddNote(ctx context.Context, subject, id, author, body string) (*models.Note, error) {
+    id = cleanString(id)
+    body = strings.TrimSpace(body)
+    if body == "" {
+        return nil, fmt.Errorf("note body is required")
+    }
+    if len(body) > maxNoteLength {
+        return nil, fmt.Errorf("note body exceeds %d characters", maxNoteLength)
+    }
+    if author == "" {
+        author = "unknown"
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    var exists int
+    var err error
+    switch subject {
+    case NoteCall:
+        err = r.db.QueryRowContext(ctx, `
+            SELECT 1 FROM call_records WHERE call_id = ?
+            UNION ALL SELECT 1 FROM call_records_archive WHERE call_id = ?
+            LIMIT 1
+        `, id, id).Scan(&exists)
+    case NoteDID:
+        err = r.db.QueryRowContext(ctx, "SELECT 1 FROM dids WHERE did = ?", id).Scan(&exists)
+    default:
+        return nil, fmt.Errorf("notes can only be attached to a call or a DID")
+    }
+    if err == sql.ErrNoRows {
+        return nil, fmt.Errorf("%s %s %w", subject, id, ErrNoteSubjectNotFound)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    note := models.Note{Subject: subject, SubjectID: id, Author: author, Body: body, CreatedAt: r.clock.Now()}
+    result, err := r.db.ExecContext(ctx, `
+        INSERT INTO notes (subject_type, subject_id, author, body, created_at)
+        VALUES (?, ?, ?, ?, ?)
+    `, note.Subject, note.SubjectID, note.Author, note.Body, note.CreatedAt)
+    if err != nil {
+        return nil, err
+    }
+    note.ID, _ = result.LastInsertId()
+
+    logger.Infof("Note %d added to %s %s by %s", note.ID, subject, id, author)
+    return &note, nil
+}
+
+// Notes lists the notes on a call or DID, oldest first
+func (r *Router) Notes(ctx context.Context, subject, id string) ([]models.Note, error) {
+    notes, err := r.notesFor(ctx, subject, []string{cleanString(id)})
+    if err != nil {
+        return nil, err
+    }
+    list := notes[cleanString(id)]
+    if list == nil {
+        list = []models.Note{}
+    }
+    return list, nil
+}
+
+// DeleteNote removes a note, e.g. one left on the wrong call
+func (r *Router) DeleteNote(ctx context.Context, id int64) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM notes WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+    if rows, _ := result.RowsAffected(); rows == 0 {
+        return fmt.Errorf("no note with id %d", id)
+    }
+    logger.Infof("Note %d deleted", id)
+    return nil
+}
+
+// notesFor loads the notes of several subjects at once, keyed by subject ID
+func (r *Router) notesFor(ctx context.Context, subject string, ids []string) (map[string][]models.Note, error) {
+    notes := make(map[string][]models.Note)
+    if len(ids) == 0 || r.callPathOnly {
+        return notes, nil
+    }
+
+    args := []interface{}{subject}
+    for _, id := range ids {
+        args = append(args, id)
+    }
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, subject_type, subject_id, author, body, created_at
+        FROM notes
+        WHERE subject_type = ? AND subject_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+        ORDER BY created_at, id
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var n models.Note
+        if err := rows.Scan(&n.ID, &n.Subject, &n.SubjectID, &n.Author, &n.Body, &n.CreatedAt); err != nil {
+            return nil, err
+        }
+        notes[n.SubjectID] = append(notes[n.SubjectID], n)
+    }
+    return notes, rows.Err()
+}
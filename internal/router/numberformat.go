@@ -0,0 +1,146 @@
+package router
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Output number styles, set per trunk with NumberFormats
+const (
+    FormatE164          = "e164"     // +4930123456
+    FormatInternational = "00"       // 004930123456
+    FormatNational      = "national" // 030123456, needs the trunk's country code
+)
+
+// numberFormat is how one trunk wants numbers written. countryCode is the
+// trunk's home country: national numbers are written against it and
+// national input (a single leading 0) is read against it.
+type numberFormat struct {
+    style       string
+    countryCode string
+}
+
+// numberFormats maps a trunk to the format of the ANI and DNIS sent to it
+type numberFormats map[string]numberFormat
+
+// parseNumberFormats reads "trunk=style" or "trunk=style:countrycode"
+// entries, e.g. trunk-s4=national:49
+func parseNumberFormats(entries []string) (numberFormats, error) {
+    formats := make(numberFormats)
+    for _, entry := range entries {
+        trunk, spec, ok := strings.Cut(entry, "=")
+        trunk = strings.TrimSpace(trunk)
+        if !ok || trunk == "" {
+            return nil, fmt.Errorf("invalid number format %q, expected trunk=style[:countrycode]", entry)
+        }
+        style, cc, _ := strings.Cut(strings.TrimSpace(spec), ":")
+        switch style {
+        case FormatE164, FormatInternational:
+        case FormatNational:
+            if cc == "" {
+                return nil, fmt.Errorf("number format %q: national needs a country code, e.g. national:49", entry)
+            }
+        default:
+            return nil, fmt.Errorf("number format %q: unknown style %q (e164, 00 or national)", entry, style)
+        }
+        if cc != "" && (!isDigits(cc) || len(cc) > 3) {
+            return nil, fmt.Errorf("number format %q: country code must be 1-3 digits", entry)
+        }
+        formats[trunk] = numberFormat{style: style, countryCode: cc}
+    }
+    return formats, nil
+}
+
+// format rewrites number for trunk. Numbers that are not plain digits
+// (anonymous, SIP URIs) and trunks without a format pass unchanged.
+func (fs numberFormats) format(trunk, number string) string {
+    f, ok := fs[trunk]
+    if !ok {
+        return number
+    }
+    digits, ok := internationalDigits(number, f.countryCode)
+    if !ok {
+        return number
+    }
+    switch f.style {
+    case FormatE164:
+        return "+" + digits
+    case FormatInternational:
+        return "00" + digits
+    case FormatNational:
+        if strings.HasPrefix(digits, f.countryCode) {
+            return "0" + digits[len(f.countryCode):]
+        }
+        return "00" + digits
+    }
+    return number
+}
+
+// variants lists other spellings of number that a formatted DID can come
+// back as, so the return leg still finds the call
+func (fs numberFormats) variants(number string) []string {
+    if len(fs) == 0 {
+        return nil
+    }
+    seen := map[string]bool{number: true}
+    var list []string
+    add := func(v string) {
+        if !seen[v] {
+            seen[v] = true
+            list = append(list, v)
+        }
+    }
+    codes := map[string]bool{"": true}
+    for _, f := range fs {
+        codes[f.countryCode] = true
+    }
+    for cc := range codes {
+        if digits, ok := internationalDigits(number, cc); ok {
+            add("+" + digits)
+            add(digits)
+            add("00" + digits)
+            if cc != "" && strings.HasPrefix(digits, cc) {
+                add("0" + digits[len(cc):])
+            }
+        }
+    }
+    return list
+}
+
+// internationalDigits reduces +CC..., 00CC... and, given the home country
+// code, 0... to the international digits without prefix. Bare digits are
+// taken as already international; national input without a country code
+// cannot be reduced.
+func internationalDigits(number, countryCode string) (string, bool) {
+    switch {
+    case strings.HasPrefix(number, "+"):
+        number = number[1:]
+    case strings.HasPrefix(number, "00"):
+        number = number[2:]
+    case strings.HasPrefix(number, "0"):
+        if countryCode == "" {
+            return "", false
+        }
+        number = countryCode + number[1:]
+    }
+    return number, isDigits(number)
+}
+
+// same reports whether a and b are the same number, allowing for the
+// rewriting of a trunk format
+func (fs numberFormats) same(a, b string) bool {
+    if a == b {
+        return true
+    }
+    for _, v := range fs.variants(a) {
+        if v == b {
+            return true
+        }
+    }
+    for _, v := range fs.variants(b) {
+        if v == a {
+            return true
+        }
+    }
+    return false
+}
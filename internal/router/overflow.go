@@ -0,0 +1,78 @@
+package router
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// What a call gets when no DID is free (after DIDWait, if set). With
+// OverflowFail it is refused with ErrNoAvailableDIDs. The others answer
+// with status "overflow" and no DID, so S1 keeps the call:
+//
+//	direct        next_hop is S4's trunk (OverflowTarget, or the call's
+//	              return-leg trunk), with the original ANI and DNIS
+//	announcement  next_hop is the dialplan context OverflowTarget, for a
+//	              busy announcement; the DNIS is the extension
+//
+// Overflowed calls are not tracked: no DID means no return leg to match.
+const (
+    OverflowFail         = ""
+    OverflowDirect       = "direct"
+    OverflowAnnouncement = "announcement"
+)
+
+var overflows = metrics.NewCounter("s2_overflow_total",
+    "Calls sent to the overflow route because no DID was free, by action", "action")
+
+func validateOverflow(action, target string) error {
+    switch action {
+    case OverflowFail, OverflowDirect:
+        return nil
+    case OverflowAnnouncement:
+        if target == "" {
+            return fmt.Errorf("overflow %s needs the announcement context as its target", action)
+        }
+        return nil
+    }
+    return fmt.Errorf("invalid overflow action %q", action)
+}
+
+// overflowResponse routes a call that found no DID along the overflow
+// route
+func (r *Router) overflowResponse(ctx context.Context, callID, ani, dnis string, tenant *models.Tenant, cause error) *models.CallResponse {
+    action, nextHop := r.config.Overflow, r.config.OverflowTarget
+    response := &models.CallResponse{
+        Status:     "overflow",
+        CallID:     callID,
+        Overflow:   action,
+        ANIToSend:  ani,
+        DNISToSend: dnis,
+    }
+    if action == OverflowDirect {
+        if nextHop == "" {
+            nextHop = r.trunkFor(legReturn, dnis, tenant)
+        }
+        response.ANIToSend = r.formats.format(nextHop, ani)
+        response.DNISToSend = r.formats.format(nextHop, dnis)
+    }
+    response.NextHop = nextHop
+
+    logger.Call(callID, "", ani).Context(ctx).Warnf("No DID for call %s (%v), overflowing %s to %s", callID, cause, action, nextHop)
+    overflows.Inc(action)
+    r.recordCallEvent(ctx, callID, models.CallEventOverflow, r.clock.Now(), action+" next_hop="+nextHop)
+    r.publish(models.Event{
+        Type:   "call.overflow",
+        CallID: callID,
+        ANI:    ani,
+        DNIS:   dnis,
+        Tenant: tenantID(tenant),
+        Detail: action + " " + nextHop,
+    })
+    if action == OverflowDirect {
+        return r.applyCarrier(response)
+    }
+    return response
+}
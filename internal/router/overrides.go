@@ -0,0 +1,235 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    legForward = "forward"
+    legReturn  = "return"
+
+    overrideActive    = "ACTIVE"
+    overrideExpired   = "EXPIRED"
+    overrideCancelled = "CANCELLED"
+
+    // Overrides are for emergencies; anything longer belongs in permanent config
+    maxOverrideDuration = 7 * 24 * time.Hour
+)
+
+// routingOverrides caches active overrides for the hot path
+type routingOverrides struct {
+    mu     sync.RWMutex
+    active []models.RoutingOverride
+}
+
+// trunkFor returns the trunk for a leg to the given destination, honouring
+// the longest active override prefix over the tenant's (or default) trunk
+func (r *Router) trunkFor(leg, dnis string, t *models.Tenant) string {
+    trunk := r.defaultTrunk(leg, t)
+
+    now := r.clock.Now()
+    longest := -1
+    r.overrides.mu.RLock()
+    for _, o := range r.overrides.active {
+        if o.Leg != leg || now.Before(o.StartsAt) || !now.Before(o.ExpiresAt) {
+            continue
+        }
+        if strings.HasPrefix(dnis, o.Prefix) && len(o.Prefix) > longest {
+            trunk = o.Trunk
+            longest = len(o.Prefix)
+        }
+    }
+    r.overrides.mu.RUnlock()
+    return trunk
+}
+
+// refreshOverrides reloads the active set, first expiring overrides past
+// their end time unless the router is read-only
+func (r *Router) refreshOverrides() error {
+    if !r.config.ReadOnly {
+        r.expireOverrides()
+    }
+
+    active, err := r.listOverrides(context.Background(), "status = ? AND expires_at > NOW()", overrideActive)
+    if err != nil {
+        logger.Errorf("Error loading overrides: %v", err)
+        return err
+    }
+    r.overrides.mu.Lock()
+    r.overrides.active = active
+    r.overrides.mu.Unlock()
+    return nil
+}
+
+// expireOverrides marks overrides past their end time, auditing each
+func (r *Router) expireOverrides() {
+    expired, err := r.listOverrides(context.Background(), "status = ? AND expires_at <= NOW()", overrideActive)
+    if err != nil {
+        logger.Errorf("Error loading expired overrides: %v", err)
+    }
+    for _, o := range expired {
+        result, err := r.backgroundExec("UPDATE routing_overrides SET status = ? WHERE id = ? AND status = ?",
+            overrideExpired, o.ID, overrideActive)
+        if err != nil {
+            logger.Errorf("Error expiring override %d: %v", o.ID, err)
+            continue
+        }
+        if rows, _ := result.RowsAffected(); rows > 0 {
+            logger.Infof("Override %d expired: %s %s -> %s", o.ID, o.Leg, o.Prefix, o.Trunk)
+            r.auditOverride(context.Background(), o.ID, "EXPIRED", "system", fmt.Sprintf("%s prefix %s reverted from %s", o.Leg, o.Prefix, o.Trunk))
+        }
+    }
+}
+
+// CreateOverride registers a temporary override lasting for duration from now
+func (r *Router) CreateOverride(ctx context.Context, o models.RoutingOverride, duration time.Duration) (*models.RoutingOverride, error) {
+    if o.Leg == "" {
+        o.Leg = legForward
+    }
+    if o.Leg != legForward && o.Leg != legReturn {
+        return nil, fmt.Errorf("leg must be %q or %q", legForward, legReturn)
+    }
+    if o.Prefix == "" || o.Trunk == "" {
+        return nil, fmt.Errorf("prefix and trunk are required")
+    }
+    if duration <= 0 || duration > maxOverrideDuration {
+        return nil, fmt.Errorf("duration must be between 0 and %s", maxOverrideDuration)
+    }
+    if o.CreatedBy == "" {
+        o.CreatedBy = "unknown"
+    }
+
+    o.StartsAt = r.clock.Now()
+    o.ExpiresAt = o.StartsAt.Add(duration)
+    o.Status = overrideActive
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, `
+        INSERT INTO routing_overrides (prefix, leg, trunk, reason, created_by, status, starts_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, o.Prefix, o.Leg, o.Trunk, o.Reason, o.CreatedBy, o.Status, o.StartsAt, o.ExpiresAt)
+    if err != nil {
+        return nil, err
+    }
+    o.ID, _ = result.LastInsertId()
+    o.CreatedAt = o.StartsAt
+
+    logger.Infof("Override %d created by %s: %s prefix %s -> %s until %s (%s)",
+        o.ID, o.CreatedBy, o.Leg, o.Prefix, o.Trunk, o.ExpiresAt.Format(time.RFC3339), o.Reason)
+    r.auditOverride(ctx, o.ID, "CREATED", o.CreatedBy,
+        fmt.Sprintf("%s prefix %s -> %s for %s: %s", o.Leg, o.Prefix, o.Trunk, duration, o.Reason))
+    r.refreshOverrides()
+
+    return &o, nil
+}
+
+// CancelOverride ends an active override early
+func (r *Router) CancelOverride(ctx context.Context, id int64, actor string) error {
+    if actor == "" {
+        actor = "unknown"
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, `
+        UPDATE routing_overrides SET status = ?, cancelled_at = NOW()
+        WHERE id = ? AND status = ?
+    `, overrideCancelled, id, overrideActive)
+    if err != nil {
+        return err
+    }
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("no active override with id %d", id)
+    }
+
+    logger.Infof("Override %d cancelled by %s", id, actor)
+    r.auditOverride(ctx, id, "CANCELLED", actor, "")
+    r.refreshOverrides()
+    return nil
+}
+
+// Overrides lists active overrides, or every override when all is set
+func (r *Router) Overrides(ctx context.Context, all bool) ([]models.RoutingOverride, error) {
+    if all {
+        return r.listOverrides(ctx, "1 = 1")
+    }
+    return r.listOverrides(ctx, "status = ?", overrideActive)
+}
+
+func (r *Router) listOverrides(ctx context.Context, where string, args ...interface{}) ([]models.RoutingOverride, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, prefix, leg, trunk, COALESCE(reason, ''), created_by, status,
+               starts_at, expires_at, cancelled_at, created_at
+        FROM routing_overrides
+        WHERE `+where+`
+        ORDER BY id DESC
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.RoutingOverride{}
+    for rows.Next() {
+        var o models.RoutingOverride
+        var cancelled sql.NullTime
+        if err := rows.Scan(&o.ID, &o.Prefix, &o.Leg, &o.Trunk, &o.Reason, &o.CreatedBy, &o.Status,
+            &o.StartsAt, &o.ExpiresAt, &cancelled, &o.CreatedAt); err != nil {
+            return nil, err
+        }
+        if cancelled.Valid {
+            o.CancelledAt = &cancelled.Time
+        }
+        list = append(list, o)
+    }
+    return list, rows.Err()
+}
+
+func (r *Router) auditOverride(ctx context.Context, id int64, action, actor, detail string) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, `
+        INSERT INTO override_audit (override_id, action, actor, detail)
+        VALUES (?, ?, ?, ?)
+    `, id, action, actor, detail)
+    if err != nil {
+        logger.Errorf("Error writing override audit for %d: %v", id, err)
+    }
+}
+
+// OverrideAudit returns the most recent audit entries
+func (r *Router) OverrideAudit(ctx context.Context, limit int) ([]models.OverrideAudit, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, override_id, action, actor, COALESCE(detail, ''), created_at
+        FROM override_audit
+        ORDER BY id DESC
+        LIMIT ?
+    `, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.OverrideAudit{}
+    for rows.Next() {
+        var a models.OverrideAudit
+        if err := rows.Scan(&a.ID, &a.OverrideID, &a.Action, &a.Actor, &a.Detail, &a.CreatedAt); err != nil {
+            return nil, err
+        }
+        list = append(list, a)
+    }
+    return list, rows.Err()
+}
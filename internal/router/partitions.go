@@ -0,0 +1,159 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "sort"
+    "sync"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// With S1Partitions set the DID pool is split by CRC32 of the number into
+// that many partitions, and each S1 source is assigned one: its calls only
+// get DIDs of its partition, so the DID of a returning call names the S1
+// node that sent it. CRC32 matches MySQL's, so the split needs no column.
+// Sources without an assignment draw from the whole pool.
+const maxSourceLen = 64
+
+// ErrInvalidSource is returned for an S1 source name over the size limit
+var ErrInvalidSource = errors.New("invalid source")
+
+// s1Partitions caches the partition assigned to each S1 source
+type s1Partitions struct {
+    mu       sync.RWMutex
+    bySource map[string]int
+}
+
+// didPartition returns the partition a DID belongs to
+func (r *Router) didPartition(did string) int {
+    return int(crc32.ChecksumIEEE([]byte(did)) % uint32(r.config.S1Partitions))
+}
+
+// partitionFor returns the partition of an S1 source, false if the pool is
+// not partitioned or the source has none
+func (r *Router) partitionFor(source string) (int, bool) {
+    if r.config.S1Partitions <= 0 || source == "" {
+        return 0, false
+    }
+    p := &r.partitions
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    partition, ok := p.bySource[source]
+    return partition, ok
+}
+
+// loadPartitions refreshes the cached source assignments from the database
+func (r *Router) loadPartitions() error {
+    list, err := r.S1Partitions(context.Background())
+    if err != nil {
+        logger.Errorf("Error loading S1 partitions: %v", err)
+        return err
+    }
+
+    bySource := make(map[string]int, len(list))
+    for _, s := range list {
+        bySource[s.Source] = s.Partition
+    }
+    r.partitions.mu.Lock()
+    r.partitions.bySource = bySource
+    r.partitions.mu.Unlock()
+    return nil
+}
+
+// S1Partitions lists the partition assigned to each S1 source
+func (r *Router) S1Partitions(ctx context.Context) ([]models.S1Partition, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT source, partition_no, updated_at
+        FROM s1_partitions
+        ORDER BY partition_no, source
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.S1Partition{}
+    for rows.Next() {
+        var s models.S1Partition
+        if err := rows.Scan(&s.Source, &s.Partition, &s.UpdatedAt); err != nil {
+            return nil, err
+        }
+        list = append(list, s)
+    }
+    return list, rows.Err()
+}
+
+// SetS1Partition assigns an S1 source to a partition
+func (r *Router) SetS1Partition(ctx context.Context, source string, partition int) (*models.S1Partition, error) {
+    if r.config.S1Partitions <= 0 {
+        return nil, fmt.Errorf("the DID pool is not partitioned (s1_partitions is 0)")
+    }
+    if source == "" || len(source) > maxSourceLen {
+        return nil, fmt.Errorf("source must be 1-%d characters", maxSourceLen)
+    }
+    if partition < 0 || partition >= r.config.S1Partitions {
+        return nil, fmt.Errorf("partition must be 0-%d", r.config.S1Partitions-1)
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, `
+        INSERT INTO s1_partitions (source, partition_no)
+        VALUES (?, ?)
+        ON DUPLICATE KEY UPDATE partition_no = VALUES(partition_no)
+    `, source, partition)
+    if err != nil {
+        return nil, err
+    }
+
+    r.loadPartitions()
+    logger.Infof("S1 source %s assigned to DID partition %d", source, partition)
+    return &models.S1Partition{Source: source, Partition: partition, UpdatedAt: r.clock.Now()}, nil
+}
+
+func (r *Router) DeleteS1Partition(ctx context.Context, source string) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM s1_partitions WHERE source = ?", source)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("S1 source %s has no partition", source)
+    }
+    r.loadPartitions()
+    return nil
+}
+
+// DIDSource tells which S1 sources a DID can have been handed to, for
+// tracing a returning call back upstream by its DID alone
+func (r *Router) DIDSource(did string) (*models.DIDSource, error) {
+    if r.config.S1Partitions <= 0 {
+        return nil, fmt.Errorf("the DID pool is not partitioned (s1_partitions is 0)")
+    }
+    did = cleanString(did)
+    src := &models.DIDSource{DID: did, Partition: r.didPartition(did), Sources: []string{}}
+
+    r.partitions.mu.RLock()
+    for source, partition := range r.partitions.bySource {
+        if partition == src.Partition {
+            src.Sources = append(src.Sources, source)
+        }
+    }
+    r.partitions.mu.RUnlock()
+    sort.Strings(src.Sources)
+    return src, nil
+}
+
+// PartitionCount is how many partitions the DID pool is hashed into, 0 if
+// it is not partitioned
+func (r *Router) PartitionCount() int {
+    return r.config.S1Partitions
+}
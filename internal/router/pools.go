@@ -0,0 +1,72 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Named pools split a tenant's DIDs by traffic class (e.g. us-retail,
+// uk-wholesale) so classes never share numbers. A call picks its pool with
+// IncomingOptions.Pool or by DNIS prefix; DIDs without a pool serve calls
+// that ask for none, and only those fall back to DID ranges.
+const maxPoolLen = 64
+
+// ErrInvalidPool is returned for a requested pool name over the size limit
+var ErrInvalidPool = errors.New("invalid pool")
+
+// DIDPools reports the size of every pool, per tenant
+func (r *Router) DIDPools(ctx context.Context) ([]models.DIDPool, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT pool, tenant_id, COUNT(*), SUM(CASE WHEN in_use = 0 THEN 1 ELSE 0 END)
+        FROM dids
+        GROUP BY pool, tenant_id
+        ORDER BY pool, tenant_id
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.DIDPool{}
+    for rows.Next() {
+        var p models.DIDPool
+        if err := rows.Scan(&p.Pool, &p.Tenant, &p.Total, &p.Free); err != nil {
+            return nil, err
+        }
+        list = append(list, p)
+    }
+    return list, rows.Err()
+}
+
+// AssignPoolDIDs moves DIDs into a named pool; an empty pool makes them
+// unpooled again
+func (r *Router) AssignPoolDIDs(ctx context.Context, pool string, dids []string) (int, error) {
+    if len(pool) > maxPoolLen {
+        return 0, fmt.Errorf("pool must be at most %d characters", maxPoolLen)
+    }
+    if len(dids) == 0 {
+        return 0, nil
+    }
+
+    args := make([]interface{}, 0, len(dids)+1)
+    args = append(args, pool)
+    for _, did := range dids {
+        args = append(args, did)
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(dids)), ",")
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "UPDATE dids SET pool = ? WHERE did IN ("+placeholders+")", args...)
+    if err != nil {
+        return 0, err
+    }
+    rows, _ := result.RowsAffected()
+    return int(rows), nil
+}
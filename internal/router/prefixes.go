@@ -0,0 +1,47 @@
+package router
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// prefixEntry maps numbers starting with prefix onto a name
+type prefixEntry struct {
+    prefix string
+    name   string
+}
+
+// prefixMap is ordered longest prefix first
+type prefixMap []prefixEntry
+
+// parsePrefixMap reads "prefix=name" entries, e.g. 1800=us-tollfree. kind
+// names the mapped value in errors; names are at most maxLen long.
+func parsePrefixMap(entries []string, kind string, maxLen int) (prefixMap, error) {
+    var list prefixMap
+    seen := make(map[string]bool)
+    for _, entry := range entries {
+        prefix, name, ok := strings.Cut(entry, "=")
+        prefix, name = strings.TrimSpace(prefix), strings.TrimSpace(name)
+        if !ok || prefix == "" || name == "" || len(name) > maxLen {
+            return nil, fmt.Errorf("invalid %s prefix %q, expected prefix=%s", kind, entry, kind)
+        }
+        if seen[prefix] {
+            return nil, fmt.Errorf("%s prefix %s mapped twice", kind, prefix)
+        }
+        seen[prefix] = true
+        list = append(list, prefixEntry{prefix: prefix, name: name})
+    }
+    sort.Slice(list, func(i, j int) bool { return len(list[i].prefix) > len(list[j].prefix) })
+    return list, nil
+}
+
+// lookup returns the name of the longest prefix of number, "" if none
+func (m prefixMap) lookup(number string) string {
+    for _, e := range m {
+        if strings.HasPrefix(number, e.prefix) {
+            return e.name
+        }
+    }
+    return ""
+}
@@ -0,0 +1,364 @@
+package router
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Auto-provisioning asks a number provider for more DIDs once a pool has
+// stayed above ProvisioningThreshold utilization for ProvisioningSustain.
+// The provider connector is an HTTP endpoint that receives
+//
+//	POST {"request_id": 7, "tenant_id": "acme", "pool": "us-retail", "count": 50}
+//
+// and answers with the numbers it bought, which are added to the pool:
+//
+//	{"dids": [{"did": "15550001234", "country": "US"}], "cost": 12.50}
+//
+// Requests count against a monthly budget of DIDs and of cost before they
+// are sent. With ProvisioningApproval they wait for an operator to approve
+// them through /api/provisioning first.
+const (
+    ProvisionPendingApproval = "PENDING_APPROVAL"
+    ProvisionApproved        = "APPROVED"
+    ProvisionFulfilled       = "FULFILLED"
+    ProvisionFailed          = "FAILED"
+    ProvisionRejected        = "REJECTED"
+
+    // Requests sent to the connector per run
+    provisionBatch = 10
+)
+
+// ErrProvisioningRequestNotFound is returned for unknown requests and for
+// requests no longer waiting for approval
+var ErrProvisioningRequestNotFound = errors.New("no provisioning request awaiting approval")
+
+var provisioningClient = &http.Client{Timeout: 30 * time.Second}
+
+// provisioning tracks how long each pool has been above the threshold
+type provisioning struct {
+    mu        sync.Mutex
+    since     map[string]time.Time // tenant/pool -> first run seen above the threshold
+    exhausted string               // month the budget was last reported exhausted
+}
+
+// checkProvisioning raises requests for pools that stayed too full and
+// orders the approved ones
+func (r *Router) checkProvisioning() error {
+    ctx := context.Background()
+    pools, err := r.DIDPools(ctx)
+    if err != nil {
+        return err
+    }
+    now := r.clock.Now()
+
+    p := &r.provisioning
+    p.mu.Lock()
+    full := make(map[string]bool)
+    var due []models.DIDPool
+    for _, pool := range pools {
+        if pool.Total == 0 {
+            continue
+        }
+        key := pool.Tenant + "/" + pool.Pool
+        if utilization(pool) < r.config.ProvisioningThreshold {
+            continue
+        }
+        full[key] = true
+        since, ok := p.since[key]
+        if !ok {
+            p.since[key] = now
+            continue
+        }
+        if now.Sub(since) >= r.config.ProvisioningSustain {
+            due = append(due, pool)
+        }
+    }
+    for key := range p.since {
+        if !full[key] {
+            delete(p.since, key)
+        }
+    }
+    p.mu.Unlock()
+
+    for _, pool := range due {
+        if err := r.requestDIDs(ctx, pool); err != nil {
+            return err
+        }
+    }
+    return r.orderApprovedDIDs(ctx)
+}
+
+func utilization(pool models.DIDPool) float64 {
+    return float64(pool.Total-pool.Free) / float64(pool.Total)
+}
+
+// requestDIDs files a request for one pool unless it already has one open
+// or the month's budget is spent
+func (r *Router) requestDIDs(ctx context.Context, pool models.DIDPool) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+
+    var open int
+    if err := r.db.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM did_provisioning
+        WHERE tenant_id = ? AND pool = ? AND status IN (?, ?)
+    `, pool.Tenant, pool.Pool, ProvisionPendingApproval, ProvisionApproved).Scan(&open); err != nil {
+        return err
+    }
+    if open > 0 {
+        return nil
+    }
+
+    budget, err := r.provisioningBudget(ctx)
+    if err != nil {
+        return err
+    }
+    count := r.config.ProvisioningBatch
+    if budget.DIDLimit > 0 && budget.DIDs+count > budget.DIDLimit {
+        count = budget.DIDLimit - budget.DIDs
+    }
+    if count <= 0 || (budget.CostLimit > 0 && budget.Cost >= budget.CostLimit) {
+        r.reportBudgetExhausted(budget)
+        return nil
+    }
+
+    status := ProvisionApproved
+    if r.config.ProvisioningApproval {
+        status = ProvisionPendingApproval
+    }
+    result, err := r.db.ExecContext(ctx, `
+        INSERT INTO did_provisioning (tenant_id, pool, count, utilization, status, requested_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, pool.Tenant, pool.Pool, count, utilization(pool), status, r.clock.Now())
+    if err != nil {
+        return err
+    }
+    id, _ := result.LastInsertId()
+
+    // The pool must stay full for another sustain period before the next one
+    r.provisioning.mu.Lock()
+    delete(r.provisioning.since, pool.Tenant+"/"+pool.Pool)
+    r.provisioning.mu.Unlock()
+
+    logger.Infof("Provisioning request %d: %d DIDs for pool %q of tenant %q at %.0f%% use (%s)",
+        id, count, pool.Pool, pool.Tenant, 100*utilization(pool), status)
+    r.publish(models.Event{
+        Type:   "provisioning.requested",
+        Tenant: pool.Tenant,
+        Detail: fmt.Sprintf("request=%d pool=%s count=%d status=%s", id, pool.Pool, count, status),
+    })
+    return nil
+}
+
+// reportBudgetExhausted raises one event per month once the budget is spent
+func (r *Router) reportBudgetExhausted(budget *models.ProvisioningBudget) {
+    p := &r.provisioning
+    p.mu.Lock()
+    reported := p.exhausted == budget.Month
+    p.exhausted = budget.Month
+    p.mu.Unlock()
+    if reported {
+        return
+    }
+    logger.Warnf("Provisioning budget for %s exhausted: %d DIDs, cost %.2f", budget.Month, budget.DIDs, budget.Cost)
+    r.publish(models.Event{
+        Type:   "provisioning.budget_exhausted",
+        Detail: fmt.Sprintf("month=%s dids=%d cost=%.2f", budget.Month, budget.DIDs, budget.Cost),
+    })
+}
+
+// orderApprovedDIDs sends the approved requests to the connector
+func (r *Router) orderApprovedDIDs(ctx context.Context) error {
+    requests, err := r.provisioningRequests(ctx, ProvisionApproved, provisionBatch)
+    if err != nil {
+        return err
+    }
+    for _, req := range requests {
+        added, cost, err := r.orderDIDs(ctx, req)
+        status, event, detail := ProvisionFulfilled, "provisioning.fulfilled", ""
+        if err != nil {
+            status, event, detail = ProvisionFailed, "provisioning.failed", err.Error()
+            if len(detail) > 255 {
+                detail = detail[:255]
+            }
+            logger.Warnf("Provisioning request %d failed: %v", req.ID, err)
+        } else {
+            logger.Infof("Provisioning request %d added %d DIDs to pool %q of tenant %q", req.ID, added, req.Pool, req.Tenant)
+        }
+        if _, err := r.backgroundExec(`
+            UPDATE did_provisioning SET status = ?, added = ?, cost = ?, error = NULLIF(?, ''), completed_at = ?
+            WHERE id = ?
+        `, status, added, cost, detail, r.clock.Now(), req.ID); err != nil {
+            return err
+        }
+        r.publish(models.Event{
+            Type:   event,
+            Tenant: req.Tenant,
+            Detail: strings.TrimSpace(fmt.Sprintf("request=%d pool=%s added=%d %s", req.ID, req.Pool, added, detail)),
+        })
+    }
+    return nil
+}
+
+// orderDIDs calls the connector for one request and imports what it bought
+func (r *Router) orderDIDs(ctx context.Context, req models.ProvisioningRequest) (added int, cost float64, err error) {
+    body, _ := json.Marshal(map[string]interface{}{
+        "request_id": req.ID,
+        "tenant_id":  req.Tenant,
+        "pool":       req.Pool,
+        "count":      req.Count,
+    })
+    resp, err := provisioningClient.Post(r.config.ProvisioningURL, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return 0, 0, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return 0, 0, fmt.Errorf("connector returned %s", resp.Status)
+    }
+
+    var result struct {
+        DIDs []struct {
+            DID     string `json:"did"`
+            Country string `json:"country"`
+        } `json:"dids"`
+        Cost float64 `json:"cost"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return 0, 0, fmt.Errorf("connector response: %w", err)
+    }
+    if len(result.DIDs) > req.Count {
+        // Paid for either way; keep them, but say so
+        logger.Infof("Provisioning request %d asked for %d DIDs, connector sent %d", req.ID, req.Count, len(result.DIDs))
+    }
+
+    rows := make([]importRow, 0, len(result.DIDs))
+    for i, d := range result.DIDs {
+        row, err := parseImportRow(i+1, []string{d.DID, d.Country})
+        if err != nil {
+            return 0, result.Cost, fmt.Errorf("connector sent DID %q: %w", d.DID, err)
+        }
+        rows = append(rows, row)
+    }
+    for start := 0; start < len(rows); start += importBatchSize {
+        end := start + importBatchSize
+        if end > len(rows) {
+            end = len(rows)
+        }
+        imported, _, err := r.importBatch(ctx, rows[start:end], req.Tenant, req.Pool, false)
+        if err != nil {
+            return added, result.Cost, err
+        }
+        added += imported
+    }
+    return added, result.Cost, nil
+}
+
+// ProvisioningRequests lists requests, newest first, optionally by status
+func (r *Router) ProvisioningRequests(ctx context.Context, status string, limit int) ([]models.ProvisioningRequest, error) {
+    return r.provisioningRequests(ctx, status, limit)
+}
+
+func (r *Router) provisioningRequests(ctx context.Context, status string, limit int) ([]models.ProvisioningRequest, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    order := "DESC"
+    if status == ProvisionApproved {
+        // Ordered oldest first
+        order = "ASC"
+    }
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, tenant_id, pool, count, utilization, status, added, cost, COALESCE(error, ''),
+            COALESCE(decided_by, ''), requested_at, completed_at
+        FROM did_provisioning
+        WHERE ? = '' OR status = ?
+        ORDER BY id `+order+`
+        LIMIT ?
+    `, status, status, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.ProvisioningRequest{}
+    for rows.Next() {
+        var p models.ProvisioningRequest
+        var completed sql.NullTime
+        if err := rows.Scan(&p.ID, &p.Tenant, &p.Pool, &p.Count, &p.Utilization, &p.Status, &p.Added, &p.Cost,
+            &p.Error, &p.DecidedBy, &p.RequestedAt, &completed); err != nil {
+            return nil, err
+        }
+        if completed.Valid {
+            p.CompletedAt = &completed.Time
+        }
+        list = append(list, p)
+    }
+    return list, rows.Err()
+}
+
+// DecideProvisioning approves or rejects a request awaiting approval. An
+// approved request is ordered on the next provisioning run.
+func (r *Router) DecideProvisioning(ctx context.Context, id int64, approve bool, by string) error {
+    if r.config.ReadOnly {
+        return ErrReadOnly
+    }
+    status := ProvisionRejected
+    var completed interface{} = r.clock.Now()
+    if approve {
+        status, completed = ProvisionApproved, nil
+    }
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, `
+        UPDATE did_provisioning SET status = ?, decided_by = NULLIF(?, ''), completed_at = ?
+        WHERE id = ? AND status = ?
+    `, status, by, completed, id, ProvisionPendingApproval)
+    if err != nil {
+        return err
+    }
+    if rows, _ := result.RowsAffected(); rows == 0 {
+        return fmt.Errorf("%w: %d", ErrProvisioningRequestNotFound, id)
+    }
+    logger.Infof("Provisioning request %d %s by %s", id, status, by)
+    return nil
+}
+
+// ProvisioningBudget reports this month's provisioning against the caps
+func (r *Router) ProvisioningBudget(ctx context.Context) (*models.ProvisioningBudget, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    return r.provisioningBudget(ctx)
+}
+
+// provisioningBudget sums the month so far; open requests hold their count
+func (r *Router) provisioningBudget(ctx context.Context) (*models.ProvisioningBudget, error) {
+    now := r.clock.Now().UTC()
+    month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+    budget := &models.ProvisioningBudget{
+        Month:     month.Format("2006-01"),
+        DIDLimit:  r.config.ProvisioningBudgetDIDs,
+        CostLimit: r.config.ProvisioningBudgetCost,
+    }
+    err := r.db.QueryRowContext(ctx, `
+        SELECT
+            COALESCE(SUM(CASE WHEN status IN (?, ?) THEN count WHEN status = ? THEN added ELSE 0 END), 0),
+            COALESCE(SUM(cost), 0)
+        FROM did_provisioning
+        WHERE requested_at >= ?
+    `, ProvisionPendingApproval, ProvisionApproved, ProvisionFulfilled, month).Scan(&budget.DIDs, &budget.Cost)
+    if err != nil {
+        return nil, err
+    }
+    return budget, nil
+}
@@ -0,0 +1,209 @@
+package router
+
+import (
+    "context"
+    "crypto/rand"
+    "fmt"
+    "math/big"
+    mathrand "math/rand"
+    "strconv"
+    "strings"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Random numbers tried per range before concluding it is (nearly) full
+const rangeProbeAttempts = 16
+
+// parseRangeBound splits an optional "+" from the digits of a range bound
+func parseRangeBound(v string) (plus bool, n uint64, width int, err error) {
+    v = strings.TrimSpace(v)
+    if strings.HasPrefix(v, "+") {
+        plus = true
+        v = v[1:]
+    }
+    if !isDigits(v) || len(v) > 18 {
+        return false, 0, 0, fmt.Errorf("invalid range bound %q", v)
+    }
+    n, err = strconv.ParseUint(v, 10, 64)
+    return plus, n, len(v), err
+}
+
+// rangeNumber formats the number at offset within a range
+func rangeNumber(plus bool, start uint64, width int, offset uint64) string {
+    number := fmt.Sprintf("%0*d", width, start+offset)
+    if plus {
+        return "+" + number
+    }
+    return number
+}
+
+// randomOffset picks a position within a range of n numbers. crypto/rand
+// keeps routers sharing a database from probing the same sequence.
+func randomOffset(n int64) uint64 {
+    v, err := rand.Int(rand.Reader, big.NewInt(n))
+    if err != nil {
+        return uint64(mathrand.Int63n(n))
+    }
+    return v.Uint64()
+}
+
+// materializeFromRange creates and claims an unused number from one of the
+// tenant's ranges. Inserting the row is the claim: the unique key on
+// dids.did makes a concurrent pick of the same number fail cleanly.
+func (r *Router) materializeFromRange(ctx context.Context, destination, tenant string) (string, error) {
+    ranges, err := r.listDIDRanges(ctx, "tenant_id = ?", tenant)
+    if err != nil {
+        return "", err
+    }
+
+    // Spread load over ranges rather than draining the first one
+    mathrand.Shuffle(len(ranges), func(i, j int) { ranges[i], ranges[j] = ranges[j], ranges[i] })
+
+    for _, rg := range ranges {
+        if rg.Materialized >= rg.Size {
+            continue
+        }
+        plus, start, width, _ := parseRangeBound(rg.Start)
+
+        for attempt := 0; attempt < rangeProbeAttempts; attempt++ {
+            did := rangeNumber(plus, start, width, randomOffset(rg.Size))
+            inserted, err := r.store.InsertClaimedDID(ctx, did, destination, rg.Country, tenant)
+            if err != nil {
+                return "", err
+            }
+            if inserted {
+                logger.Infof("Materialized DID %s from range %s-%s", did, rg.Start, rg.End)
+                return did, nil
+            }
+        }
+    }
+    return "", fmt.Errorf("no unused numbers left in DID ranges")
+}
+
+// DIDRanges lists ranges with how many of their numbers exist as DIDs
+func (r *Router) DIDRanges(ctx context.Context) ([]models.DIDRange, error) {
+    return r.listDIDRanges(ctx, "1 = 1")
+}
+
+func (r *Router) listDIDRanges(ctx context.Context, where string, args ...interface{}) ([]models.DIDRange, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, range_start, range_end, tenant_id, COALESCE(country, ''), created_at
+        FROM did_ranges
+        WHERE `+where+`
+        ORDER BY range_start
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+
+    list := []models.DIDRange{}
+    for rows.Next() {
+        var rg models.DIDRange
+        if err := rows.Scan(&rg.ID, &rg.Start, &rg.End, &rg.Tenant, &rg.Country, &rg.CreatedAt); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        _, start, _, _ := parseRangeBound(rg.Start)
+        _, end, _, _ := parseRangeBound(rg.End)
+        rg.Size = int64(end-start) + 1
+        list = append(list, rg)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    // Same-width bounds make string comparison match numeric order
+    for i := range list {
+        r.db.QueryRowContext(ctx, `
+            SELECT COUNT(*) FROM dids
+            WHERE did BETWEEN ? AND ? AND LENGTH(did) = ?
+        `, list[i].Start, list[i].End, len(list[i].Start)).Scan(&list[i].Materialized)
+    }
+    return list, nil
+}
+
+// AddDIDRange registers a block of numbers such as +4930123450000 to
+// +4930123459999. Nothing is inserted into dids until a number is allocated.
+func (r *Router) AddDIDRange(ctx context.Context, rg models.DIDRange) (*models.DIDRange, error) {
+    startPlus, start, startWidth, err := parseRangeBound(rg.Start)
+    if err != nil {
+        return nil, err
+    }
+    endPlus, end, endWidth, err := parseRangeBound(rg.End)
+    if err != nil {
+        return nil, err
+    }
+    if startPlus != endPlus || startWidth != endWidth {
+        return nil, fmt.Errorf("range bounds must have the same format and length")
+    }
+    if end < start {
+        return nil, fmt.Errorf("range end must not be below its start")
+    }
+    if rg.Tenant != "" && r.tenantByID(rg.Tenant) == nil {
+        return nil, fmt.Errorf("tenant %s not found", rg.Tenant)
+    }
+    rg.Start = rangeNumber(startPlus, start, startWidth, 0)
+    rg.End = rangeNumber(endPlus, end, endWidth, 0)
+
+    var overlap int64
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    r.db.QueryRowContext(ctx, `
+        SELECT id FROM did_ranges
+        WHERE LENGTH(range_start) = ? AND range_start <= ? AND range_end >= ?
+        LIMIT 1
+    `, len(rg.Start), rg.End, rg.Start).Scan(&overlap)
+    if overlap != 0 {
+        return nil, fmt.Errorf("overlaps DID range %d", overlap)
+    }
+
+    result, err := r.db.ExecContext(ctx, `
+        INSERT INTO did_ranges (range_start, range_end, tenant_id, country)
+        VALUES (?, ?, ?, NULLIF(?, ''))
+    `, rg.Start, rg.End, rg.Tenant, rg.Country)
+    if err != nil {
+        return nil, err
+    }
+
+    rg.ID, _ = result.LastInsertId()
+    rg.Size = int64(end-start) + 1
+    rg.CreatedAt = r.clock.Now()
+    logger.Infof("DID range %s-%s added (%d numbers)", rg.Start, rg.End, rg.Size)
+    return &rg, nil
+}
+
+// DeleteDIDRange stops allocating from a range; DIDs already materialized stay
+func (r *Router) DeleteDIDRange(ctx context.Context, id int64) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM did_ranges WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("DID range %d not found", id)
+    }
+    return nil
+}
+
+// unmaterializedRangeDIDs counts range numbers not yet created as DIDs
+func (r *Router) unmaterializedRangeDIDs(ctx context.Context) int64 {
+    if r.callPathOnly {
+        return 0
+    }
+    ranges, err := r.DIDRanges(ctx)
+    if err != nil {
+        return 0
+    }
+    var n int64
+    for _, rg := range ranges {
+        n += rg.Size - rg.Materialized
+    }
+    return n
+}
@@ -0,0 +1,242 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const defaultCurrency = "USD"
+
+// Per-minute billing unless a rate says otherwise
+const defaultIncrement = 60
+
+// Stands in for an open end date when checking overlaps
+var farFuture = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// rateDeck caches every rate row, past and scheduled, so lookups can be
+// evaluated at any instant and future price changes apply on their own
+type rateDeck struct {
+    mu    sync.RWMutex
+    rates []models.Rate
+}
+
+// rateEffectiveAt reports whether the rate applies at t
+func rateEffectiveAt(rate models.Rate, t time.Time) bool {
+    if t.Before(rate.EffectiveFrom) {
+        return false
+    }
+    return rate.EffectiveTo == nil || t.Before(*rate.EffectiveTo)
+}
+
+// loadRates refreshes the cached deck from the database
+func (r *Router) loadRates() error {
+    rates, err := r.listRates(context.Background(), "1 = 1")
+    if err != nil {
+        logger.Errorf("Error loading rates: %v", err)
+        return err
+    }
+    r.rates.mu.Lock()
+    r.rates.rates = rates
+    r.rates.mu.Unlock()
+    return nil
+}
+
+// RateFor returns the longest-prefix rate for a destination on a trunk at t
+func (r *Router) RateFor(trunk, dnis string, t time.Time) (*models.Rate, bool) {
+    r.rates.mu.RLock()
+    defer r.rates.mu.RUnlock()
+
+    var best *models.Rate
+    for i, rate := range r.rates.rates {
+        if rate.Trunk != trunk || !strings.HasPrefix(dnis, rate.Prefix) || !rateEffectiveAt(rate, t) {
+            continue
+        }
+        if best == nil || len(rate.Prefix) > len(best.Prefix) {
+            best = &r.rates.rates[i]
+        }
+    }
+    if best == nil {
+        return nil, false
+    }
+    found := *best
+    return &found, true
+}
+
+// costEstimate is the rate the forward leg of a call is billed at, nil
+// when no rate applies or estimates are hidden from S1
+func (r *Router) costEstimate(trunk, dnis string, t time.Time) *models.CostEstimate {
+    if r.config.HideCost {
+        return nil
+    }
+    rate, ok := r.RateFor(trunk, dnis, t)
+    if !ok {
+        return nil
+    }
+    return &models.CostEstimate{
+        RateID:           rate.ID,
+        Prefix:           rate.Prefix,
+        PerMinute:        rate.PerMinute,
+        Currency:         rate.Currency,
+        InitialIncrement: rate.InitialIncrement,
+        Increment:        rate.Increment,
+    }
+}
+
+// RatesAt lists the rates in effect at t, optionally for a single trunk
+func (r *Router) RatesAt(trunk string, t time.Time) []models.Rate {
+    r.rates.mu.RLock()
+    defer r.rates.mu.RUnlock()
+
+    list := []models.Rate{}
+    for _, rate := range r.rates.rates {
+        if (trunk == "" || rate.Trunk == trunk) && rateEffectiveAt(rate, t) {
+            list = append(list, rate)
+        }
+    }
+    return list
+}
+
+// Rates lists every rate row including expired and scheduled ones
+func (r *Router) Rates(ctx context.Context, trunk string) ([]models.Rate, error) {
+    if trunk == "" {
+        return r.listRates(ctx, "1 = 1")
+    }
+    return r.listRates(ctx, "trunk = ?", trunk)
+}
+
+// AddRate schedules a price for a trunk and prefix. An open-ended rate that
+// is already running when the new one starts is closed at that instant, so
+// loading next month's increase today needs a single call.
+func (r *Router) AddRate(ctx context.Context, rate models.Rate) (*models.Rate, error) {
+    if rate.Trunk == "" || rate.Prefix == "" {
+        return nil, fmt.Errorf("trunk and prefix are required")
+    }
+    if rate.PerMinute < 0 {
+        return nil, fmt.Errorf("per_minute must not be negative")
+    }
+    if rate.Currency == "" {
+        rate.Currency = defaultCurrency
+    }
+    if rate.InitialIncrement < 0 || rate.Increment < 0 {
+        return nil, fmt.Errorf("billing increments must not be negative")
+    }
+    if rate.InitialIncrement == 0 {
+        rate.InitialIncrement = defaultIncrement
+    }
+    if rate.Increment == 0 {
+        rate.Increment = defaultIncrement
+    }
+    if rate.EffectiveFrom.IsZero() {
+        rate.EffectiveFrom = r.clock.Now()
+    }
+    if rate.EffectiveTo != nil && !rate.EffectiveTo.After(rate.EffectiveFrom) {
+        return nil, fmt.Errorf("effective_to must be after effective_from")
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    // Supersede the open-ended rate the new one replaces
+    if _, err := tx.ExecContext(ctx, `
+        UPDATE rates SET effective_to = ?
+        WHERE trunk = ? AND prefix = ? AND effective_to IS NULL AND effective_from < ?
+    `, rate.EffectiveFrom, rate.Trunk, rate.Prefix, rate.EffectiveFrom); err != nil {
+        return nil, err
+    }
+
+    // Whatever still overlaps is a genuine conflict
+    end := farFuture
+    if rate.EffectiveTo != nil {
+        end = *rate.EffectiveTo
+    }
+    var conflict int64
+    err = tx.QueryRowContext(ctx, `
+        SELECT id FROM rates
+        WHERE trunk = ? AND prefix = ? AND effective_from < ? AND (effective_to IS NULL OR effective_to > ?)
+        LIMIT 1
+    `, rate.Trunk, rate.Prefix, end, rate.EffectiveFrom).Scan(&conflict)
+    if err == nil {
+        return nil, fmt.Errorf("overlaps rate %d for %s prefix %s", conflict, rate.Trunk, rate.Prefix)
+    }
+    if err != sql.ErrNoRows {
+        return nil, err
+    }
+
+    result, err := tx.ExecContext(ctx, `
+        INSERT INTO rates (trunk, prefix, per_minute, currency, initial_increment, billing_increment, effective_from, effective_to)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, rate.Trunk, rate.Prefix, rate.PerMinute, rate.Currency, rate.InitialIncrement, rate.Increment,
+        rate.EffectiveFrom, rate.EffectiveTo)
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+
+    rate.ID, _ = result.LastInsertId()
+    rate.CreatedAt = r.clock.Now()
+    logger.Infof("Rate %d scheduled: %s prefix %s at %.5f %s/min (%d/%d) from %s",
+        rate.ID, rate.Trunk, rate.Prefix, rate.PerMinute, rate.Currency, rate.InitialIncrement, rate.Increment,
+        rate.EffectiveFrom.Format(time.RFC3339))
+    r.loadRates()
+    return &rate, nil
+}
+
+func (r *Router) DeleteRate(ctx context.Context, id int64) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM rates WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("rate %d not found", id)
+    }
+    r.loadRates()
+    return nil
+}
+
+func (r *Router) listRates(ctx context.Context, where string, args ...interface{}) ([]models.Rate, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, trunk, prefix, per_minute, currency, initial_increment, billing_increment,
+            effective_from, effective_to, created_at
+        FROM rates
+        WHERE `+where+`
+        ORDER BY trunk, prefix, effective_from
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.Rate{}
+    for rows.Next() {
+        var rate models.Rate
+        var to sql.NullTime
+        if err := rows.Scan(&rate.ID, &rate.Trunk, &rate.Prefix, &rate.PerMinute, &rate.Currency,
+            &rate.InitialIncrement, &rate.Increment, &rate.EffectiveFrom, &to, &rate.CreatedAt); err != nil {
+            return nil, err
+        }
+        if to.Valid {
+            rate.EffectiveTo = &to.Time
+        }
+        list = append(list, rate)
+    }
+    return list, rows.Err()
+}
@@ -0,0 +1,358 @@
+package router
+
+import (
+    "context"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Compliance recordings get a SHA-256 checksum and size once the call has
+// ended and Asterisk has had recordingSettle to close the file. Purging
+// checks a file against them before deleting it and keeps any that fail,
+// and /api/calls/{callid}/recording/verify checks one on demand, so a
+// recording that was altered or truncated after the call is detected. The
+// metadata lives in the recordings table, or with the sidecar backend in a
+// <recording>.meta.json next to each file for deployments that archive the
+// directory as a whole.
+const (
+    recordingSettle = 10 * time.Second
+    // A file not there by then was not recorded, e.g. the call never answered
+    recordingGiveUp = 5 * time.Minute
+)
+
+// Recording verification results
+const (
+    RecordingOK               = "ok"
+    RecordingChecksumMismatch = "checksum_mismatch"
+    RecordingTruncated        = "truncated"
+    RecordingSizeMismatch     = "size_mismatch"
+    RecordingMissing          = "missing"
+)
+
+var (
+    recordingChecksums = metrics.NewCounter("s2_recording_checksums_total",
+        "Recordings checksummed after their call ended")
+    recordingVerifications = metrics.NewCounter("s2_recording_verifications_total",
+        "Recordings checked against their stored checksum by result", "result")
+)
+
+// ErrNoRecordingMeta is returned for calls without a checksummed recording
+var ErrNoRecordingMeta = errors.New("no recording checksum stored for call")
+
+// RecordingMetaStore keeps the checksum and size of each finished recording
+type RecordingMetaStore interface {
+    SaveRecording(ctx context.Context, meta *models.RecordingMeta) error
+    // Recording returns the metadata of callID's recording, nil if none
+    Recording(ctx context.Context, callID string) (*models.RecordingMeta, error)
+    // RecordVerification stores the outcome of a check
+    RecordVerification(ctx context.Context, callID string, at time.Time, status string) error
+}
+
+// recordingMetaBackends maps a -recording-metadata name to its constructor
+var recordingMetaBackends = map[string]func(db *sql.DB, dir string, timeout time.Duration) RecordingMetaStore{
+    "mysql":   newMySQLRecordingMeta,
+    "sidecar": newSidecarRecordingMeta,
+}
+
+// RecordingMetaBackends lists the checksum stores compiled into this build
+func RecordingMetaBackends() []string {
+    names := make([]string, 0, len(recordingMetaBackends))
+    for name := range recordingMetaBackends {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// pendingRecording is a finished call whose recording is not checksummed yet
+type pendingRecording struct {
+    callID  string
+    path    string
+    endedAt time.Time
+}
+
+type recordingChecksumQueue struct {
+    mu      sync.Mutex
+    pending []pendingRecording
+}
+
+// queueRecordingChecksum schedules the checksum of a finished call's
+// recording
+func (r *Router) queueRecordingChecksum(record *models.CallRecord) {
+    if r.recordingMeta == nil || record.RecordingPath == "" {
+        return
+    }
+    q := &r.recordingQueue
+    q.mu.Lock()
+    q.pending = append(q.pending, pendingRecording{callID: record.CallID, path: record.RecordingPath, endedAt: r.clock.Now()})
+    q.mu.Unlock()
+}
+
+// checksumRecordings stores the checksum and size of the recordings whose
+// calls ended at least recordingSettle ago
+func (r *Router) checksumRecordings() error {
+    q := &r.recordingQueue
+    q.mu.Lock()
+    var due, later []pendingRecording
+    for _, p := range q.pending {
+        if r.since(p.endedAt) >= recordingSettle {
+            due = append(due, p)
+        } else {
+            later = append(later, p)
+        }
+    }
+    q.pending = later
+    q.mu.Unlock()
+
+    var retry []pendingRecording
+    var failed error
+    for _, p := range due {
+        size, sum, err := hashFile(p.path)
+        if os.IsNotExist(err) {
+            if r.since(p.endedAt) < recordingGiveUp {
+                retry = append(retry, p)
+            }
+            continue
+        }
+        if err == nil {
+            err = r.recordingMeta.SaveRecording(context.Background(), &models.RecordingMeta{
+                CallID:      p.callID,
+                Path:        p.path,
+                Size:        size,
+                SHA256:      sum,
+                CompletedAt: r.clock.Now(),
+            })
+        }
+        if err != nil {
+            logger.Call(p.callID, "", "").Errorf("Failed to checksum recording %s: %v", p.path, err)
+            retry = append(retry, p)
+            failed = err
+            continue
+        }
+        recordingChecksums.Inc()
+    }
+
+    q.mu.Lock()
+    q.pending = append(q.pending, retry...)
+    q.mu.Unlock()
+    return failed
+}
+
+// VerifyRecording checks a call's recording against its stored checksum
+// and records the outcome
+func (r *Router) VerifyRecording(ctx context.Context, callID string) (*models.RecordingVerification, error) {
+    if r.recordingMeta == nil {
+        return nil, ErrNoRecordingMeta
+    }
+    meta, err := r.recordingMeta.Recording(ctx, cleanString(callID))
+    if err != nil {
+        return nil, err
+    }
+    if meta == nil {
+        return nil, ErrNoRecordingMeta
+    }
+    return r.verifyRecording(ctx, meta), nil
+}
+
+// RecordingMeta returns the stored checksum of a call's recording
+func (r *Router) RecordingMeta(ctx context.Context, callID string) (*models.RecordingMeta, error) {
+    if r.recordingMeta == nil {
+        return nil, ErrNoRecordingMeta
+    }
+    meta, err := r.recordingMeta.Recording(ctx, cleanString(callID))
+    if err == nil && meta == nil {
+        err = ErrNoRecordingMeta
+    }
+    return meta, err
+}
+
+func (r *Router) verifyRecording(ctx context.Context, meta *models.RecordingMeta) *models.RecordingVerification {
+    v := &models.RecordingVerification{CallID: meta.CallID, Path: meta.Path, ExpectedSize: meta.Size, ExpectedSHA256: meta.SHA256, CheckedAt: r.clock.Now()}
+    size, sum, err := hashFile(meta.Path)
+    switch {
+    case os.IsNotExist(err):
+        v.Status = RecordingMissing
+    case err != nil:
+        // Unreadable is not evidence of tampering; nothing is recorded
+        v.Status, v.Error = "error", err.Error()
+        recordingVerifications.Inc("error")
+        return v
+    case size < meta.Size:
+        v.Status = RecordingTruncated
+    case size != meta.Size:
+        v.Status = RecordingSizeMismatch
+    case sum != meta.SHA256:
+        v.Status = RecordingChecksumMismatch
+    default:
+        v.Status = RecordingOK
+    }
+    v.Size, v.SHA256 = size, sum
+    recordingVerifications.Inc(v.Status)
+
+    if err := r.recordingMeta.RecordVerification(ctx, meta.CallID, v.CheckedAt, v.Status); err != nil {
+        logger.Call(meta.CallID, "", "").Errorf("Failed to record verification of %s: %v", meta.Path, err)
+    }
+    if v.Status != RecordingOK && v.Status != RecordingMissing {
+        logger.Call(meta.CallID, "", "").Warnf("ALERT: recording %s failed verification: %s", meta.Path, v.Status)
+        r.publish(models.Event{
+            Type:   "recording.verify_failed",
+            CallID: meta.CallID,
+            Detail: fmt.Sprintf("%s: %s (size %d, expected %d)", meta.Path, v.Status, size, meta.Size),
+        })
+    }
+    return v
+}
+
+// verifyBeforePurge reports whether a recording about to be purged still
+// matches its checksum. One without a checksum, or failing for lack of the
+// file, may go; one that was altered is kept as evidence.
+func (r *Router) verifyBeforePurge(path string) bool {
+    if r.recordingMeta == nil {
+        return true
+    }
+    callID := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+    meta, err := r.recordingMeta.Recording(context.Background(), callID)
+    if err != nil || meta == nil || filepath.Clean(meta.Path) != filepath.Clean(path) {
+        return err == nil
+    }
+    switch r.verifyRecording(context.Background(), meta).Status {
+    case RecordingOK, RecordingMissing:
+        return true
+    }
+    return false
+}
+
+func hashFile(path string) (int64, string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return 0, "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    n, err := io.Copy(h, f)
+    if err != nil {
+        return 0, "", err
+    }
+    return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mysqlRecordingMeta keeps recording checksums in the recordings table
+type mysqlRecordingMeta struct {
+    db      *sql.DB
+    timeout time.Duration
+}
+
+func newMySQLRecordingMeta(db *sql.DB, _ string, timeout time.Duration) RecordingMetaStore {
+    return &mysqlRecordingMeta{db: db, timeout: timeout}
+}
+
+func (s *mysqlRecordingMeta) SaveRecording(ctx context.Context, meta *models.RecordingMeta) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    // A checksum is taken once; a later one would bless a tampered file
+    _, err := s.db.ExecContext(ctx, `
+        INSERT IGNORE INTO recordings (call_id, path, size_bytes, sha256, completed_at)
+        VALUES (?, ?, ?, ?, ?)
+    `, meta.CallID, meta.Path, meta.Size, meta.SHA256, meta.CompletedAt)
+    return err
+}
+
+func (s *mysqlRecordingMeta) Recording(ctx context.Context, callID string) (*models.RecordingMeta, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    meta := &models.RecordingMeta{CallID: callID}
+    var verifiedAt sql.NullTime
+    var status sql.NullString
+    err := s.db.QueryRowContext(ctx, `
+        SELECT path, size_bytes, sha256, completed_at, verified_at, verify_status
+        FROM recordings WHERE call_id = ?
+    `, callID).Scan(&meta.Path, &meta.Size, &meta.SHA256, &meta.CompletedAt, &verifiedAt, &status)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if verifiedAt.Valid {
+        meta.VerifiedAt = &verifiedAt.Time
+    }
+    meta.VerifyStatus = status.String
+    return meta, nil
+}
+
+func (s *mysqlRecordingMeta) RecordVerification(ctx context.Context, callID string, at time.Time, status string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.db.ExecContext(ctx, "UPDATE recordings SET verified_at = ?, verify_status = ? WHERE call_id = ?", at, status, callID)
+    return err
+}
+
+// sidecarRecordingMeta keeps each checksum in a JSON file next to its
+// recording, so it travels with the directory when it is archived
+type sidecarRecordingMeta struct {
+    dir string
+}
+
+func newSidecarRecordingMeta(_ *sql.DB, dir string, _ time.Duration) RecordingMetaStore {
+    return &sidecarRecordingMeta{dir: dir}
+}
+
+const sidecarSuffix = ".meta.json"
+
+func (s *sidecarRecordingMeta) file(callID string) string {
+    return filepath.Join(s.dir, filepath.Base(callID)+".wav"+sidecarSuffix)
+}
+
+func (s *sidecarRecordingMeta) SaveRecording(_ context.Context, meta *models.RecordingMeta) error {
+    b, err := json.MarshalIndent(meta, "", "  ")
+    if err != nil {
+        return err
+    }
+    f, err := os.OpenFile(s.file(meta.CallID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o444)
+    if os.IsExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(b); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+func (s *sidecarRecordingMeta) Recording(_ context.Context, callID string) (*models.RecordingMeta, error) {
+    b, err := os.ReadFile(s.file(callID))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var meta models.RecordingMeta
+    if err := json.Unmarshal(b, &meta); err != nil {
+        return nil, fmt.Errorf("%s: %w", s.file(callID), err)
+    }
+    return &meta, nil
+}
+
+// RecordVerification is not kept with the sidecar backend: the sidecar is
+// written once and read-only, and results go to metrics, logs and events
+func (s *sidecarRecordingMeta) RecordVerification(context.Context, string, time.Time, string) error {
+    return nil
+}
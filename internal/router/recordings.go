@@ -0,0 +1,186 @@
+package router
+
+import (
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// What happens once the recordings directory grows past its quota
+const (
+    RecordingFullStop  = "stop"  // stop asking the dialplan to record until usage drops
+    RecordingFullPurge = "purge" // delete the oldest recordings
+)
+
+// Usage must fall below this share of the quota before recordings resume,
+// and purging deletes down to it, so enforcement does not flap at the limit
+const recordingLowWater = 0.9
+
+var (
+    recordingBytes = metrics.NewGauge("s2_recordings_bytes",
+        "Bytes held in the recordings directory")
+    recordingPurged = metrics.NewCounter("s2_recordings_purged_total",
+        "Recordings deleted to stay within the quota")
+)
+
+// recordingUsage is the last measurement of the recordings directory
+type recordingUsage struct {
+    mu        sync.RWMutex
+    bytes     int64
+    files     int
+    checkedAt time.Time
+    suspended bool  // over quota with RecordingFullStop
+    purged    int64 // files deleted since start
+}
+
+type recordingFile struct {
+    path    string
+    size    int64
+    modTime time.Time
+}
+
+// checkRecordings measures the recordings directory and enforces the quota
+func (r *Router) checkRecordings() error {
+    var files []recordingFile
+    var total int64
+    count := 0
+    err := filepath.WalkDir(r.recordingPath, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) && path == r.recordingPath {
+                return filepath.SkipDir
+            }
+            return err
+        }
+        if !d.Type().IsRegular() {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            // Removed since the directory was read
+            return nil
+        }
+        total += info.Size()
+        // Checksum sidecars take space but go with their recording
+        if strings.HasSuffix(path, sidecarSuffix) {
+            return nil
+        }
+        count++
+        if r.config.RecordingFullAction == RecordingFullPurge {
+            files = append(files, recordingFile{path: path, size: info.Size(), modTime: info.ModTime()})
+        }
+        return nil
+    })
+    if err != nil {
+        logger.Errorf("Error measuring recordings in %s: %v", r.recordingPath, err)
+        return err
+    }
+
+    quota := r.config.RecordingQuota
+    var events []models.Event
+    if quota > 0 && total > quota && r.config.RecordingFullAction == RecordingFullPurge {
+        freed, deleted := r.purgeRecordings(files, total-int64(float64(quota)*recordingLowWater))
+        total -= freed
+        count -= deleted
+        logger.Warnf("ALERT: recordings over quota, purged %d oldest files (%d bytes)", deleted, freed)
+        events = append(events, models.Event{
+            Type:   "recordings.purged",
+            Detail: fmt.Sprintf("deleted %d oldest recordings (%d bytes) to stay within %d bytes", deleted, freed, quota),
+        })
+    }
+
+    u := &r.recordings
+    u.mu.Lock()
+    u.bytes, u.files, u.checkedAt = total, count, r.clock.Now()
+    switch {
+    case quota > 0 && total > quota && r.config.RecordingFullAction == RecordingFullStop && !u.suspended:
+        u.suspended = true
+        logger.Warnf("ALERT: recordings use %d bytes of %d, no longer requesting recordings", total, quota)
+        events = append(events, models.Event{
+            Type:   "recordings.suspended",
+            Detail: fmt.Sprintf("%d bytes used of %d, calls are not recorded", total, quota),
+        })
+    case u.suspended && (quota <= 0 || float64(total) <= float64(quota)*recordingLowWater):
+        u.suspended = false
+        logger.Infof("Recordings back to %d bytes of %d, recording again", total, quota)
+        events = append(events, models.Event{
+            Type:   "recordings.resumed",
+            Detail: fmt.Sprintf("%d bytes used of %d", total, quota),
+        })
+    }
+    u.mu.Unlock()
+    recordingBytes.Set(float64(total))
+
+    for _, event := range events {
+        r.publish(event)
+    }
+    return nil
+}
+
+// purgeRecordings deletes the oldest files until at least need bytes are
+// freed
+func (r *Router) purgeRecordings(files []recordingFile, need int64) (freed int64, deleted int) {
+    sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+    for i := len(files) - 1; i >= 0 && freed < need; i-- {
+        if !r.verifyBeforePurge(files[i].path) {
+            logger.Warnf("Keeping recording %s: it does not match its checksum", files[i].path)
+            continue
+        }
+        if err := os.Remove(files[i].path); err != nil && !os.IsNotExist(err) {
+            logger.Errorf("Failed to purge recording %s: %v", files[i].path, err)
+            continue
+        }
+        if info, err := os.Stat(files[i].path + sidecarSuffix); err == nil && os.Remove(files[i].path+sidecarSuffix) == nil {
+            freed += info.Size()
+        }
+        freed += files[i].size
+        deleted++
+    }
+
+    r.recordings.mu.Lock()
+    r.recordings.purged += int64(deleted)
+    r.recordings.mu.Unlock()
+    recordingPurged.Add(float64(deleted))
+    return freed, deleted
+}
+
+// recordingFor returns where a call should be recorded, "" while
+// recordings are suspended for being over quota
+func (r *Router) recordingFor(callID string) string {
+    r.recordings.mu.RLock()
+    suspended := r.recordings.suspended
+    r.recordings.mu.RUnlock()
+    if suspended {
+        return ""
+    }
+    return fmt.Sprintf("%s/%s.wav", r.recordingPath, callID)
+}
+
+// RecordingUsage reports the last measurement of the recordings directory
+func (r *Router) RecordingUsage() models.RecordingUsage {
+    u := &r.recordings
+    u.mu.RLock()
+    defer u.mu.RUnlock()
+
+    usage := models.RecordingUsage{
+        Path:       r.recordingPath,
+        Bytes:      u.bytes,
+        Files:      u.files,
+        QuotaBytes: r.config.RecordingQuota,
+        FullAction: r.config.RecordingFullAction,
+        Suspended:  u.suspended,
+        Purged:     u.purged,
+    }
+    if !u.checkedAt.IsZero() {
+        at := u.checkedAt
+        usage.CheckedAt = &at
+    }
+    return usage
+}
@@ -0,0 +1,163 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// ErrStateless is returned for operations on in-memory call state when
+// the router keeps none
+var ErrStateless = errors.New("stateless mode keeps no in-memory call state")
+
+// StateChange is one call the reload added, removed or changed
+type StateChange struct {
+    CallID string           `json:"call_id"`
+    DID    string           `json:"did"`
+    Status models.CallState `json:"status"`
+    Was    string           `json:"was,omitempty"` // what changed, for changed calls
+}
+
+// StateReload is the difference a reload made to the in-memory indexes
+type StateReload struct {
+    Lookback string        `json:"lookback"` // "in-flight" for the per-tenant in-flight windows
+    Loaded   int           `json:"loaded"`
+    Added    []StateChange `json:"added"`
+    Removed  []StateChange `json:"removed"`
+    Changed  []StateChange `json:"changed"`
+    Dropped  int           `json:"dropped_index_entries"` // DID and token entries no loaded call backs
+    Busy     []string      `json:"busy"`                  // calls left as they were, being routed or ended meanwhile
+}
+
+// ReloadState rebuilds the in-memory call indexes from the database, for
+// after the database was changed by hand. With lookback 0 it loads what a
+// restart would, the calls inside their tenant's in-flight window;
+// otherwise every unfinished call started within lookback; below 0 it
+// uses Config.StateReloadLookback. Calls wait while it runs, so none is
+// routed against half-rebuilt indexes.
+func (r *Router) ReloadState(ctx context.Context, lookback time.Duration) (*StateReload, error) {
+    if r.stateless() {
+        return nil, ErrStateless
+    }
+    if lookback < 0 {
+        lookback = r.config.StateReloadLookback
+    }
+    // Redis is updated once r.mu is released below
+    var removed, shared []*models.CallRecord
+    defer func() {
+        for _, record := range removed {
+            r.unshareCall(record)
+        }
+        for _, record := range shared {
+            r.shareCall(record)
+        }
+    }()
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    var records []*models.CallRecord
+    var err error
+    report := &StateReload{Lookback: "in-flight", Added: []StateChange{}, Removed: []StateChange{}, Changed: []StateChange{}, Busy: []string{}}
+    if lookback > 0 {
+        report.Lookback = lookback.String()
+        records, err = r.store.UnfinishedCallRecords(ctx, r.clock.Now().Add(-lookback))
+    } else {
+        records, err = r.store.InFlightCallRecords(ctx)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("loading call records: %w", err)
+    }
+    report.Loaded = len(records)
+
+    active := make(map[string]*models.CallRecord, len(records))
+    for _, record := range records {
+        active[record.CallID] = record
+    }
+
+    // A call whose lock is held is mid-update and its row may lag
+    var held []func()
+    defer func() {
+        for _, unlock := range held {
+            unlock()
+        }
+    }()
+    idle := func(callID string) bool {
+        unlock, ok := r.calls.tryLock(callID)
+        if ok {
+            held = append(held, unlock)
+        } else {
+            report.Busy = append(report.Busy, callID)
+        }
+        return ok
+    }
+
+    for callID, old := range r.activeCallsMap {
+        if _, ok := active[callID]; ok {
+            continue
+        }
+        if !idle(callID) {
+            active[callID] = old
+            continue
+        }
+        report.Removed = append(report.Removed, StateChange{CallID: callID, DID: old.AssignedDID, Status: old.Status})
+        r.untrackCall(old)
+        removed = append(removed, copyCallRecord(old))
+    }
+    for callID, record := range active {
+        old, ok := r.activeCallsMap[callID]
+        if old == record {
+            continue // kept while busy
+        }
+        changed := ok && (old.Status != record.Status || old.AssignedDID != record.AssignedDID || old.MatchToken != record.MatchToken)
+        switch {
+        case !ok && !idle(callID):
+            delete(active, callID)
+        case changed && !idle(callID):
+            active[callID] = old
+        case !ok:
+            report.Added = append(report.Added, StateChange{CallID: callID, DID: record.AssignedDID, Status: record.Status})
+            r.notifyLive("added", record)
+            shared = append(shared, copyCallRecord(record))
+        case changed:
+            report.Changed = append(report.Changed, StateChange{CallID: callID, DID: record.AssignedDID, Status: record.Status,
+                Was: fmt.Sprintf("status=%s did=%s token=%s", old.Status, old.AssignedDID, old.MatchToken)})
+            r.notifyLive("updated", record)
+            shared = append(shared, copyCallRecord(record))
+        default:
+            // Unchanged: keep the live record and what only memory knows
+            active[callID] = old
+        }
+    }
+
+    dids := make(map[string]string, len(active))
+    tokens := make(map[string]string)
+    for callID, record := range active {
+        dids[record.AssignedDID] = callID
+        if record.MatchToken != "" {
+            tokens[record.MatchToken] = callID
+        }
+    }
+    for did, callID := range r.didToCallMap {
+        if dids[did] != callID {
+            report.Dropped++
+        }
+    }
+    for token, callID := range r.tokenToCall {
+        if tokens[token] != callID {
+            report.Dropped++
+        }
+    }
+    r.activeCallsMap, r.didToCallMap, r.tokenToCall = active, dids, tokens
+
+    for _, list := range [][]StateChange{report.Added, report.Removed, report.Changed} {
+        sort.Slice(list, func(i, j int) bool { return list[i].CallID < list[j].CallID })
+    }
+    sort.Strings(report.Busy)
+    logger.Infof("Reloaded call state (%s): %d calls, %d added, %d removed, %d changed, %d index entries dropped",
+        report.Lookback, report.Loaded, len(report.Added), len(report.Removed), len(report.Changed), report.Dropped)
+    return report, nil
+}
@@ -0,0 +1,638 @@
+package router
+
+import (
+    "context"
+    "crypto/subtle"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/credentials/insecure"
+    grpcpeer "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/replicationpb"
+)
+
+var replicationLogger = logging.New("replication")
+
+// Replication streams call-state deltas to a warm standby, so it can take
+// over the in-flight calls without reading them back from the database -
+// which may be the component that failed. The primary calls the standby's
+// Replication.Stream gRPC method (internal/replicationpb/replication.proto),
+// in mutual TLS when the routers have certificates for it, and sends:
+//
+//	hello     the shared key, authenticating the stream
+//	snapshot  every in-flight call, on each (re)connect
+//	upsert    a call was routed or changed state
+//	delete    a call ended
+//	ping      sent every second
+//
+// The standby acks each snapshot and ping, and the primary drops a stream
+// that has gone unacknowledged for replicationTimeout. Deltas are queued as
+// the routing decision is made and sent straight away, so a failover loses
+// at most what was still in flight on the stream. A delta that finds the
+// queue full restarts the stream, and every stream starts from a snapshot,
+// so the standby never applies one with holes in it.
+const (
+    replicationQueueSize  = 4096
+    replicationHeartbeat  = time.Second
+    replicationTimeout    = 5 * time.Second // a stream silent for this long is dropped
+    replicationMaxBackoff = 30 * time.Second
+)
+
+var (
+    replicationSent = metrics.NewCounter("s2_replication_messages_sent_total",
+        "Call-state messages streamed to the standby by op", "op")
+    replicationApplied = metrics.NewCounter("s2_replication_messages_applied_total",
+        "Call-state messages applied from the primary by op", "op")
+    replicationResyncs = metrics.NewCounter("s2_replication_resyncs_total",
+        "Replication streams restarted from a snapshot")
+    replicationConnected = metrics.NewGauge("s2_replication_connected",
+        "1 while a replication stream is up, by role (primary or standby)", "role")
+)
+
+// ReplicationConfig enables call-state replication; an instance may both
+// stream to a standby and accept a stream
+type ReplicationConfig struct {
+    Peer   string      // standby host:port to stream to, empty disables
+    Listen string      // address accepting a primary's stream, empty disables
+    Key    string      // shared secret the primary must present
+    TLS    *tls.Config // mutual TLS for both ends of the stream, nil streams in the clear
+}
+
+// replicationDelta is a queued upsert or delete
+type replicationDelta struct {
+    op   string
+    call *models.CallRecord
+}
+
+type replicationState struct {
+    queue    chan replicationDelta // nil unless a peer is configured
+    overflow atomic.Bool           // a delta was dropped, the stream must resync
+    acked    atomic.Uint64         // last seq the standby acked on the current stream
+
+    mu       sync.Mutex
+    sending  *models.ReplicationStream
+    stream   chan struct{} // closed to drop the primary's stream currently applied
+    received *models.ReplicationStream
+
+    mirrored map[string]bool // CallIDs tracked from the primary's stream, guarded by r.mu
+}
+
+// startReplication opens the standby listener and starts streaming to the
+// peer, whichever are configured
+func (r *Router) startReplication(cfg ReplicationConfig) error {
+    r.replication.mirrored = make(map[string]bool)
+    if cfg.Listen != "" {
+        ln, err := net.Listen("tcp", cfg.Listen)
+        if err != nil {
+            return fmt.Errorf("replication listener: %w", err)
+        }
+        replicationLogger.Infof("Accepting call state from a primary on %s (TLS %t)", cfg.Listen, cfg.TLS != nil)
+        r.serveReplication(ln, cfg)
+    }
+    if cfg.Peer != "" {
+        r.replication.queue = make(chan replicationDelta, replicationQueueSize)
+        r.life.Go("replication", func(ctx context.Context) error {
+            r.runReplication(ctx, cfg)
+            return nil
+        })
+    }
+    return nil
+}
+
+// replicationCredentials are mutual TLS with cfg.TLS, or none
+func replicationCredentials(cfg ReplicationConfig) credentials.TransportCredentials {
+    if cfg.TLS == nil {
+        return insecure.NewCredentials()
+    }
+    return credentials.NewTLS(cfg.TLS)
+}
+
+// replicateCall queues the current state of a call for the standby
+func (r *Router) replicateCall(record *models.CallRecord) {
+    r.queueReplication("upsert", record)
+}
+
+// replicateEnd tells the standby a call is finished
+func (r *Router) replicateEnd(record *models.CallRecord) {
+    r.queueReplication("delete", record)
+}
+
+func (r *Router) queueReplication(op string, record *models.CallRecord) {
+    q := r.replication.queue
+    if q == nil {
+        return
+    }
+    // Copied now: the record keeps changing after the delta is queued
+    select {
+    case q <- replicationDelta{op: op, call: copyCallRecord(record)}:
+    default:
+        r.replication.overflow.Store(true)
+    }
+}
+
+func copyCallRecord(record *models.CallRecord) *models.CallRecord {
+    c := *record
+    if record.Tags != nil {
+        c.Tags = make(map[string]string, len(record.Tags))
+        for k, v := range record.Tags {
+            c.Tags[k] = v
+        }
+    }
+    return &c
+}
+
+// runReplication keeps a stream to the standby open until ctx is done
+func (r *Router) runReplication(ctx context.Context, cfg ReplicationConfig) {
+    peer := cfg.Peer
+    backoff := time.Second
+    for {
+        connected, err := r.streamReplication(ctx, cfg)
+        if ctx.Err() != nil {
+            return
+        }
+        if connected {
+            backoff = time.Second
+        }
+        replicationResyncs.Inc()
+        replicationLogger.Warnf("Stream to %s ended: %v, reconnecting in %s", peer, err, backoff)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(backoff):
+        }
+        if backoff *= 2; backoff > replicationMaxBackoff {
+            backoff = replicationMaxBackoff
+        }
+    }
+}
+
+// streamReplication sends a snapshot and then every queued delta over one
+// stream, returning when it fails or needs a resync
+func (r *Router) streamReplication(ctx context.Context, cfg ReplicationConfig) (connected bool, err error) {
+    peer := cfg.Peer
+    conn, err := grpc.DialContext(ctx, peer, grpc.WithTransportCredentials(replicationCredentials(cfg)))
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+    sctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    client, err := replicationpb.NewReplicationClient(conn).Stream(sctx)
+    if err != nil {
+        return false, err
+    }
+    defer client.CloseSend()
+
+    // Acks come back on the same stream; a Recv failing means the standby
+    // hung up. The watchdog cancels a stream acks stopped coming back on,
+    // which also unblocks a Send the standby stopped reading.
+    var ackedAt atomic.Int64
+    r.replication.acked.Store(0)
+    ackedAt.Store(time.Now().UnixNano())
+    closed := make(chan error, 1)
+    go func() {
+        for {
+            ack, err := client.Recv()
+            if err != nil {
+                closed <- err
+                return
+            }
+            r.replication.acked.Store(ack.Seq)
+            ackedAt.Store(time.Now().UnixNano())
+        }
+    }()
+    silent := make(chan struct{})
+    go func() {
+        watchdog := time.NewTicker(replicationHeartbeat)
+        defer watchdog.Stop()
+        for {
+            select {
+            case <-sctx.Done():
+                return
+            case <-watchdog.C:
+                if time.Since(time.Unix(0, ackedAt.Load())) > replicationTimeout {
+                    close(silent)
+                    cancel()
+                    return
+                }
+            }
+        }
+    }()
+
+    stream := &models.ReplicationStream{Peer: peer, Since: r.clock.Now()}
+    send := func(op string, d *replicationpb.Delta) error {
+        if op != "hello" {
+            stream.Seq++
+            d.Seq = stream.Seq
+        }
+        replicationSent.Inc(op)
+        return client.Send(d)
+    }
+    sendDelta := func(d replicationDelta) error {
+        delta := &replicationpb.Delta{}
+        if d.op == "delete" {
+            delta.Op = &replicationpb.Delta_Delete{Delete: callToProto(d.call)}
+        } else {
+            delta.Op = &replicationpb.Delta_Upsert{Upsert: callToProto(d.call)}
+        }
+        return send(d.op, delta)
+    }
+    sent := func() {
+        stream.LastAt = r.clock.Now()
+        r.replication.mu.Lock()
+        s := *stream
+        r.replication.sending = &s
+        r.replication.mu.Unlock()
+    }
+    // failed explains why the stream stopped taking sends
+    failed := func(err error) error {
+        select {
+        case <-silent:
+            return fmt.Errorf("no ack from the standby for %s", replicationTimeout)
+        case err := <-closed:
+            return err
+        default:
+            return err
+        }
+    }
+
+    // Deltas queued before the snapshot are already part of it
+    r.replication.overflow.Store(false)
+    for drained := false; !drained; {
+        select {
+        case <-r.replication.queue:
+        default:
+            drained = true
+        }
+    }
+    r.mu.RLock()
+    calls := make([]*replicationpb.Call, 0, len(r.activeCallsMap))
+    for _, record := range r.activeCallsMap {
+        calls = append(calls, callToProto(record))
+    }
+    r.mu.RUnlock()
+
+    if err := send("hello", &replicationpb.Delta{Op: &replicationpb.Delta_Hello{Hello: &replicationpb.Hello{Key: cfg.Key}}}); err != nil {
+        return false, failed(err)
+    }
+    if err := send("snapshot", &replicationpb.Delta{Op: &replicationpb.Delta_Snapshot{Snapshot: &replicationpb.Snapshot{Calls: calls}}}); err != nil {
+        return false, failed(err)
+    }
+    sent()
+    replicationLogger.Infof("Streaming call state to %s, snapshot of %d calls", peer, len(calls))
+    replicationConnected.Set(1, "primary")
+    defer func() {
+        replicationConnected.Set(0, "primary")
+        r.replication.mu.Lock()
+        r.replication.sending = nil
+        r.replication.mu.Unlock()
+    }()
+
+    heartbeat := r.clock.NewTicker(replicationHeartbeat)
+    defer heartbeat.Stop()
+    for {
+        if r.replication.overflow.Load() {
+            return true, errors.New("send queue overflowed")
+        }
+        var err error
+        select {
+        case <-sctx.Done():
+            if ctx.Err() != nil {
+                return true, nil
+            }
+            return true, failed(sctx.Err())
+        case err := <-closed:
+            return true, fmt.Errorf("standby closed the stream: %w", err)
+        case d := <-r.replication.queue:
+            err = sendDelta(d)
+            // Send whatever else is waiting before updating the status
+            for more := err == nil; more; {
+                select {
+                case d := <-r.replication.queue:
+                    err = sendDelta(d)
+                    more = err == nil
+                default:
+                    more = false
+                }
+            }
+        case <-heartbeat.C():
+            err = send("ping", &replicationpb.Delta{Op: &replicationpb.Delta_Ping{Ping: &replicationpb.Ping{}}})
+        }
+        if err != nil {
+            return true, failed(err)
+        }
+        sent()
+    }
+}
+
+// serveReplication accepts primaries' streams on ln until the router stops
+func (r *Router) serveReplication(ln net.Listener, cfg ReplicationConfig) {
+    srv := grpc.NewServer(grpc.Creds(replicationCredentials(cfg)))
+    replicationpb.RegisterReplicationServer(srv, &replicationServer{r: r, key: cfg.Key})
+    r.life.Go("replication-listener", func(ctx context.Context) error {
+        go func() {
+            <-ctx.Done()
+            srv.Stop()
+        }()
+        if err := srv.Serve(ln); err != nil && ctx.Err() == nil {
+            return err
+        }
+        return nil
+    })
+}
+
+// replicationServer is the standby's end of the stream
+type replicationServer struct {
+    replicationpb.UnimplementedReplicationServer
+    r   *Router
+    key string
+}
+
+// Stream applies one primary's stream until it ends. Once authenticated it
+// replaces the current stream, e.g. when a restarted primary reconnects
+// before the old stream timed out.
+func (s *replicationServer) Stream(stream replicationpb.Replication_StreamServer) error {
+    r := s.r
+    ctx := stream.Context()
+    peer := "unknown"
+    if p, ok := grpcpeer.FromContext(ctx); ok {
+        peer = p.Addr.String()
+    }
+
+    deltas := make(chan *replicationpb.Delta)
+    ended := make(chan error, 1)
+    go func() {
+        for {
+            d, err := stream.Recv()
+            if err != nil {
+                ended <- err
+                return
+            }
+            select {
+            case deltas <- d:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    var replaced chan struct{} // nil, so never ready, until authenticated
+    next := func() (*replicationpb.Delta, error) {
+        timer := time.NewTimer(replicationTimeout)
+        defer timer.Stop()
+        select {
+        case d := <-deltas:
+            return d, nil
+        case err := <-ended:
+            return nil, err
+        case <-timer.C:
+            return nil, fmt.Errorf("silent for %s", replicationTimeout)
+        case <-replaced:
+            return nil, errors.New("replaced by a newer stream")
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+
+    d, err := next()
+    if err != nil || d.GetHello() == nil || subtle.ConstantTimeCompare([]byte(d.GetHello().Key), []byte(s.key)) != 1 {
+        replicationLogger.Warnf("Refused stream from %s: bad or missing hello", peer)
+        return status.Error(codes.Unauthenticated, "bad or missing hello")
+    }
+
+    replaced = make(chan struct{})
+    r.replication.mu.Lock()
+    if r.replication.stream != nil {
+        close(r.replication.stream)
+    }
+    r.replication.stream = replaced
+    r.replication.mu.Unlock()
+
+    received := &models.ReplicationStream{Peer: peer, Since: r.clock.Now()}
+    replicationConnected.Set(1, "standby")
+    defer func() {
+        replicationConnected.Set(0, "standby")
+        r.replication.mu.Lock()
+        if r.replication.stream == replaced {
+            r.replication.stream = nil
+            r.replication.received = nil
+        }
+        r.replication.mu.Unlock()
+    }()
+
+    for {
+        d, err := next()
+        if err != nil {
+            if ctx.Err() == nil {
+                replicationLogger.Infof("Stream from %s ended: %v", peer, err)
+            }
+            return status.Error(codes.Aborted, err.Error())
+        }
+        if received.Seq != 0 && d.Seq != received.Seq+1 {
+            replicationLogger.Warnf("Stream from %s skipped from %d to %d, dropping it", peer, received.Seq, d.Seq)
+            return status.Errorf(codes.DataLoss, "sequence skipped from %d to %d", received.Seq, d.Seq)
+        }
+
+        op, ack := "", false
+        switch m := d.Op.(type) {
+        case *replicationpb.Delta_Snapshot:
+            op, ack = "snapshot", true
+            calls := make([]*models.CallRecord, len(m.Snapshot.Calls))
+            for i, c := range m.Snapshot.Calls {
+                calls[i] = callFromProto(c)
+            }
+            r.applySnapshot(calls)
+            replicationLogger.Infof("Snapshot of %d calls from %s", len(calls), peer)
+        case *replicationpb.Delta_Upsert:
+            op = "upsert"
+            r.applyReplicatedCall(callFromProto(m.Upsert))
+        case *replicationpb.Delta_Delete:
+            op = "delete"
+            r.applyReplicatedEnd(callFromProto(m.Delete))
+        case *replicationpb.Delta_Ping:
+            op, ack = "ping", true
+        }
+        replicationApplied.Inc(op)
+
+        received.Seq, received.LastAt = d.Seq, r.clock.Now()
+        r.replication.mu.Lock()
+        if r.replication.stream == replaced {
+            s := *received
+            r.replication.received = &s
+        }
+        r.replication.mu.Unlock()
+        if ack {
+            if err := stream.Send(&replicationpb.Ack{Seq: d.Seq}); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// callToProto is the wire form of a call record
+func callToProto(record *models.CallRecord) *replicationpb.Call {
+    c := &replicationpb.Call{
+        Id:              record.ID,
+        CallId:          record.CallID,
+        OriginalAni:     record.OriginalANI,
+        OriginalDnis:    record.OriginalDNIS,
+        AssignedDid:     record.AssignedDID,
+        Status:          string(record.Status),
+        Duration:        int32(record.Duration),
+        RecordingPath:   record.RecordingPath,
+        MatchToken:      record.MatchToken,
+        SettlementClass: record.SettlementClass,
+        Campaign:        record.Campaign,
+        ForwardTrunk:    record.ForwardTrunk,
+        Tenant:          record.Tenant,
+        TraceParent:     record.TraceParent,
+        DestCountry:     record.Destination.Country,
+        DestRegion:      record.Destination.Region,
+        DestType:        record.Destination.Type,
+    }
+    if !record.StartTime.IsZero() {
+        c.StartTime = timestamppb.New(record.StartTime)
+    }
+    if record.EndTime != nil {
+        c.EndTime = timestamppb.New(*record.EndTime)
+    }
+    if len(record.Tags) > 0 {
+        c.Tags = make(map[string]string, len(record.Tags))
+        for k, v := range record.Tags {
+            c.Tags[k] = v
+        }
+    }
+    return c
+}
+
+// callFromProto is the call record a Call carries
+func callFromProto(c *replicationpb.Call) *models.CallRecord {
+    record := &models.CallRecord{
+        ID:              c.Id,
+        CallID:          c.CallId,
+        OriginalANI:     c.OriginalAni,
+        OriginalDNIS:    c.OriginalDnis,
+        AssignedDID:     c.AssignedDid,
+        Status:          models.CallState(c.Status),
+        Duration:        int(c.Duration),
+        RecordingPath:   c.RecordingPath,
+        MatchToken:      c.MatchToken,
+        SettlementClass: c.SettlementClass,
+        Tags:            c.Tags,
+        Campaign:        c.Campaign,
+        ForwardTrunk:    c.ForwardTrunk,
+        Tenant:          c.Tenant,
+        TraceParent:     c.TraceParent,
+        Destination:     models.Destination{Country: c.DestCountry, Region: c.DestRegion, Type: c.DestType},
+    }
+    if c.StartTime != nil {
+        record.StartTime = c.StartTime.AsTime()
+    }
+    if c.EndTime != nil {
+        end := c.EndTime.AsTime()
+        record.EndTime = &end
+    }
+    return record
+}
+
+// applySnapshot replaces the calls mirrored from the primary
+func (r *Router) applySnapshot(calls []*models.CallRecord) {
+    var removed []*models.CallRecord
+    r.mu.Lock()
+    live := make(map[string]bool, len(calls))
+    for _, record := range calls {
+        live[record.CallID] = true
+        r.mirrorCall(record)
+    }
+    for callID := range r.replication.mirrored {
+        if record, ok := r.activeCallsMap[callID]; ok && !live[callID] {
+            r.untrackCall(record)
+            removed = append(removed, copyCallRecord(record))
+        }
+        if !live[callID] {
+            delete(r.replication.mirrored, callID)
+        }
+    }
+    r.mu.Unlock()
+    for _, record := range removed {
+        r.unshareCall(record)
+    }
+}
+
+func (r *Router) applyReplicatedCall(record *models.CallRecord) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.mirrorCall(record)
+}
+
+func (r *Router) applyReplicatedEnd(record *models.CallRecord) {
+    r.mu.Lock()
+    if !r.replication.mirrored[record.CallID] {
+        r.mu.Unlock()
+        return
+    }
+    delete(r.replication.mirrored, record.CallID)
+    current, ok := r.activeCallsMap[record.CallID]
+    if ok {
+        r.untrackCall(current)
+        current = copyCallRecord(current)
+    }
+    r.mu.Unlock()
+    if ok {
+        r.unshareCall(current)
+    }
+}
+
+// mirrorCall tracks a call from the primary, updating the existing record
+// in place so pointers handed out earlier see the change. Caller must hold r.mu.
+func (r *Router) mirrorCall(record *models.CallRecord) {
+    if current, ok := r.activeCallsMap[record.CallID]; ok {
+        if !r.replication.mirrored[record.CallID] {
+            // This instance routed the call itself
+            return
+        }
+        *current = *record
+        record = current
+    }
+    r.replication.mirrored[record.CallID] = true
+    r.trackCall(record)
+}
+
+// ReplicationStatus reports both directions of call-state replication, nil
+// when neither is configured
+func (r *Router) ReplicationStatus() *models.ReplicationStatus {
+    cfg := r.config.Replication
+    if cfg.Peer == "" && cfg.Listen == "" {
+        return nil
+    }
+    r.mu.RLock()
+    mirrored := len(r.replication.mirrored)
+    r.mu.RUnlock()
+
+    status := &models.ReplicationStatus{Peer: cfg.Peer, Listen: cfg.Listen, MirroredCalls: mirrored}
+    r.replication.mu.Lock()
+    if r.replication.sending != nil {
+        sending := *r.replication.sending
+        sending.Acked = r.replication.acked.Load()
+        status.Sending = &sending
+    }
+    status.Receiving = r.replication.received
+    r.replication.mu.Unlock()
+    if q := r.replication.queue; q != nil {
+        status.Queued = len(q)
+    }
+    return status
+}
@@ -0,0 +1,227 @@
+package router
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/credentials/insecure"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/replicationpb"
+)
+
+// peerTLS is a mutual TLS config like api.PeerTLS builds, on a throwaway
+// CA and a certificate for 127.0.0.1 that both routers share
+func peerTLS(t *testing.T) *tls.Config {
+    t.Helper()
+    caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Now()
+    ca := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "s2 test CA"},
+        NotBefore:             now.Add(-time.Hour),
+        NotAfter:              now.Add(time.Hour),
+        IsCA:                  true,
+        KeyUsage:              x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+    }
+    caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ca, err = x509.ParseCertificate(caDER); err != nil {
+        t.Fatal(err)
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    leaf := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject:      pkix.Name{CommonName: "s2-router"},
+        NotBefore:    now.Add(-time.Hour),
+        NotAfter:     now.Add(time.Hour),
+        IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    pool := x509.NewCertPool()
+    pool.AddCert(ca)
+    return &tls.Config{
+        MinVersion:   tls.VersionTLS12,
+        Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: key}},
+        RootCAs:      pool,
+        ClientCAs:    pool,
+        ClientAuth:   tls.RequireAndVerifyClientCert,
+    }
+}
+
+// eventually polls cond until it holds or within passes
+func eventually(t *testing.T, what string, within time.Duration, cond func() bool) {
+    t.Helper()
+    for deadline := time.Now().Add(within); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+        if cond() {
+            return
+        }
+    }
+    t.Fatalf("timed out waiting for %s", what)
+}
+
+// rogueSnapshot streams a hello and a snapshot holding callID to addr and
+// returns the error the stream ended with, nil if the standby acked it
+func rogueSnapshot(t *testing.T, addr string, creds credentials.TransportCredentials, callID string) error {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(creds))
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    stream, err := replicationpb.NewReplicationClient(conn).Stream(ctx)
+    if err != nil {
+        return err
+    }
+    stream.Send(&replicationpb.Delta{Op: &replicationpb.Delta_Hello{Hello: &replicationpb.Hello{Key: "key"}}})
+    stream.Send(&replicationpb.Delta{Seq: 1, Op: &replicationpb.Delta_Snapshot{Snapshot: &replicationpb.Snapshot{
+        Calls: []*replicationpb.Call{{CallId: callID, Status: string(models.CallStateActive)}},
+    }}})
+    _, err = stream.Recv()
+    return err
+}
+
+// serveStandby is a standby accepting the stream on ln
+func serveStandby(t *testing.T, ln net.Listener, tlsConfig *tls.Config) *Router {
+    t.Helper()
+    cfg := ReplicationConfig{Listen: ln.Addr().String(), Key: "key", TLS: tlsConfig}
+    standby := newTestRouter(t, newFakeStorage(), Config{Replication: cfg})
+    standby.replication.mirrored = make(map[string]bool)
+    standby.serveReplication(ln, cfg)
+    return standby
+}
+
+func receivedSeq(r *Router) uint64 {
+    if s := r.ReplicationStatus(); s != nil && s.Receiving != nil {
+        return s.Receiving.Seq
+    }
+    return 0
+}
+
+func hasCall(r *Router, callID string) bool {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.activeCallsMap[callID] != nil
+}
+
+// The stream to the standby runs in mutual TLS, a primary without a
+// certificate the standby's CA signed is refused, and the heartbeat ticks
+// on the router's clock
+func TestReplicationOverMutualTLS(t *testing.T) {
+    tlsConfig := peerTLS(t)
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    standby := serveStandby(t, ln, tlsConfig)
+    addr := ln.Addr().String()
+
+    if err := rogueSnapshot(t, addr, insecure.NewCredentials(), "plain-1"); err == nil {
+        t.Fatal("standby acked a stream in the clear")
+    }
+    // Trusts the standby, but its own certificate is from another CA
+    untrusted := peerTLS(t)
+    untrusted.RootCAs = tlsConfig.RootCAs
+    if err := rogueSnapshot(t, addr, credentials.NewTLS(untrusted), "untrusted-1"); err == nil {
+        t.Fatal("standby acked a stream from an unverified certificate")
+    }
+
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    toStandby := ReplicationConfig{Peer: addr, Key: "key", TLS: tlsConfig}
+    primary := newTestRouter(t, newFakeStorage(fakeDIDs(1)...), Config{Clock: fake, Replication: toStandby})
+    if err := primary.startReplication(toStandby); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the snapshot", 5*time.Second, func() bool { return receivedSeq(standby) >= 1 })
+
+    if _, err := primary.ProcessIncomingCall(context.Background(), "tls-1", "12125550001", "442070000001", IncomingOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the call on the standby", 5*time.Second, func() bool { return hasCall(standby, "tls-1") })
+    if hasCall(standby, "plain-1") || hasCall(standby, "untrusted-1") {
+        t.Fatal("standby applied a refused stream's snapshot")
+    }
+
+    // Nothing else is queued, so only a heartbeat moves the sequence on,
+    // well before a second of real time would tick
+    seq := receivedSeq(standby)
+    eventually(t, "a heartbeat", replicationHeartbeat/2, func() bool {
+        fake.Advance(replicationHeartbeat)
+        return receivedSeq(standby) > seq
+    })
+    eventually(t, "the heartbeat ack", 5*time.Second, func() bool {
+        s := primary.ReplicationStatus()
+        return s != nil && s.Sending != nil && s.Sending.Acked > seq
+    })
+}
+
+// A standby that comes back after losing the stream gets a fresh snapshot,
+// including the calls routed while it was gone
+func TestReplicationResnapshotsAfterReconnect(t *testing.T) {
+    tlsConfig := peerTLS(t)
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    first := serveStandby(t, ln, tlsConfig)
+
+    toStandby := ReplicationConfig{Peer: addr, Key: "key", TLS: tlsConfig}
+    primary := newTestRouter(t, newFakeStorage(fakeDIDs(2)...), Config{Replication: toStandby})
+    if err := primary.startReplication(toStandby); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := primary.ProcessIncomingCall(context.Background(), "before-1", "12125550001", "442070000001", IncomingOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the call on the first standby", 5*time.Second, func() bool { return hasCall(first, "before-1") })
+
+    if err := first.life.Shutdown(5 * time.Second); err != nil {
+        t.Fatal(err)
+    }
+    eventually(t, "the primary to notice", 5*time.Second, func() bool {
+        s := primary.ReplicationStatus()
+        return s != nil && s.Sending == nil
+    })
+    if _, err := primary.ProcessIncomingCall(context.Background(), "during-1", "12125550002", "442070000002", IncomingOptions{}); err != nil {
+        t.Fatal(err)
+    }
+
+    if ln, err = net.Listen("tcp", addr); err != nil {
+        t.Fatal(err)
+    }
+    second := serveStandby(t, ln, tlsConfig)
+    eventually(t, "the snapshot on the second standby", 10*time.Second, func() bool {
+        return hasCall(second, "before-1") && hasCall(second, "during-1")
+    })
+}
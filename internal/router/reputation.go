@@ -0,0 +1,202 @@
+package router
+
+import (
+    "context"
+    "math"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    // History loses half its weight every reputationHalfLife
+    reputationHalfLife = 7 * 24 * time.Hour
+    reputationLookback = 30 // days
+    // Score given to A-numbers with no history
+    reputationNeutral = 50.0
+    // Calls lasting this long count as fully engaged
+    reputationGoodDuration = 60.0
+    // Points lost per (decayed) complaint
+    reputationComplaintPenalty = 20.0
+)
+
+var reputationRouted = metrics.NewCounter("s2_reputation_rerouted_total",
+    "Calls sent to the scrutiny trunk because of a low ANI reputation")
+
+// aniReputation caches scores for the hot path
+type aniReputation struct {
+    mu     sync.RWMutex
+    scores map[string]models.ANIReputation
+}
+
+// reputationScore blends completion rate and engagement, then subtracts
+// complaints. A Laplace prior keeps a single call from swinging the score.
+func reputationScore(calls, completed, avgDuration, complaints float64) float64 {
+    completion := (completed + 1) / (calls + 2)
+    engagement := math.Min(avgDuration/reputationGoodDuration, 1)
+    if completed == 0 {
+        engagement = 0.5
+    }
+    score := 100*(0.6*completion+0.4*engagement) - reputationComplaintPenalty*complaints
+    return math.Round(math.Max(0, math.Min(100, score))*100) / 100
+}
+
+// refreshReputation recomputes decayed scores for every A-number seen in the
+// lookback window and persists them for reporting
+func (r *Router) refreshReputation() error {
+    halfLife := reputationHalfLife.Seconds()
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT original_ani, SUM(w),
+               SUM(CASE WHEN status = 'COMPLETED_AT_S4' THEN w ELSE 0 END),
+               SUM(CASE WHEN status = 'COMPLETED_AT_S4' THEN COALESCE(duration, 0) * w ELSE 0 END)
+        FROM (
+            SELECT original_ani, status, duration,
+                   POW(0.5, TIMESTAMPDIFF(SECOND, start_time, NOW()) / ?) AS w
+            FROM call_records
+            WHERE start_time > DATE_SUB(NOW(), INTERVAL ? DAY)
+        ) weighted
+        GROUP BY original_ani
+    `, halfLife, reputationLookback)
+    if err != nil {
+        logger.Errorf("Error loading ANI history: %v", err)
+        return err
+    }
+
+    now := r.clock.Now()
+    scores := make(map[string]models.ANIReputation)
+    for rows.Next() {
+        var rep models.ANIReputation
+        var weightedDuration float64
+        if err := rows.Scan(&rep.ANI, &rep.Calls, &rep.Completed, &weightedDuration); err != nil {
+            rows.Close()
+            return err
+        }
+        if rep.Completed > 0 {
+            rep.AvgDuration = math.Round(weightedDuration/rep.Completed*10) / 10
+        }
+        rep.UpdatedAt = now
+        scores[rep.ANI] = rep
+    }
+    rows.Close()
+
+    complaints, err := r.db.QueryContext(ctx, `
+        SELECT ani, SUM(POW(0.5, TIMESTAMPDIFF(SECOND, created_at, NOW()) / ?))
+        FROM ani_complaints
+        WHERE created_at > DATE_SUB(NOW(), INTERVAL ? DAY)
+        GROUP BY ani
+    `, halfLife, reputationLookback)
+    if err != nil {
+        logger.Errorf("Error loading ANI complaints: %v", err)
+        return err
+    }
+    for complaints.Next() {
+        var ani string
+        var weight float64
+        if err := complaints.Scan(&ani, &weight); err != nil {
+            complaints.Close()
+            return err
+        }
+        rep := scores[ani]
+        rep.ANI = ani
+        rep.Complaints = weight
+        rep.UpdatedAt = now
+        scores[ani] = rep
+    }
+    complaints.Close()
+
+    for ani, rep := range scores {
+        rep.Score = reputationScore(rep.Calls, rep.Completed, rep.AvgDuration, rep.Complaints)
+        scores[ani] = rep
+
+        if r.config.ReadOnly {
+            continue
+        }
+        _, err := r.backgroundExec(`
+            INSERT INTO ani_reputation (ani, score, calls, completed, avg_duration, complaints)
+            VALUES (?, ?, ?, ?, ?, ?)
+            ON DUPLICATE KEY UPDATE score = VALUES(score), calls = VALUES(calls), completed = VALUES(completed),
+                avg_duration = VALUES(avg_duration), complaints = VALUES(complaints)
+        `, ani, rep.Score, rep.Calls, rep.Completed, rep.AvgDuration, rep.Complaints)
+        if err != nil {
+            logger.Errorf("Error saving reputation for %s: %v", ani, err)
+        }
+    }
+
+    r.reputation.mu.Lock()
+    r.reputation.scores = scores
+    r.reputation.mu.Unlock()
+    return nil
+}
+
+// Reputation returns the current score for an A-number; unknown numbers
+// get the neutral score
+func (r *Router) Reputation(ani string) models.ANIReputation {
+    r.reputation.mu.RLock()
+    rep, ok := r.reputation.scores[ani]
+    r.reputation.mu.RUnlock()
+    if !ok {
+        return models.ANIReputation{ANI: ani, Score: reputationNeutral}
+    }
+    return rep
+}
+
+// LowReputation lists A-numbers scoring below threshold, worst first
+func (r *Router) LowReputation(ctx context.Context, threshold float64, limit int) ([]models.ANIReputation, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT ani, score, calls, completed, avg_duration, complaints, updated_at
+        FROM ani_reputation
+        WHERE score < ?
+        ORDER BY score, calls DESC
+        LIMIT ?
+    `, threshold, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.ANIReputation{}
+    for rows.Next() {
+        var rep models.ANIReputation
+        if err := rows.Scan(&rep.ANI, &rep.Score, &rep.Calls, &rep.Completed,
+            &rep.AvgDuration, &rep.Complaints, &rep.UpdatedAt); err != nil {
+            return nil, err
+        }
+        list = append(list, rep)
+    }
+    return list, rows.Err()
+}
+
+// AddComplaint flags an A-number, e.g. after a spam report from a carrier
+func (r *Router) AddComplaint(ctx context.Context, ani, reason string) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    _, err := r.db.ExecContext(ctx, "INSERT INTO ani_complaints (ani, reason) VALUES (?, ?)", ani, reason)
+    if err != nil {
+        return err
+    }
+    logger.Infof("Complaint recorded for ANI %s: %s", ani, reason)
+    return r.refreshReputation()
+}
+
+// forwardTrunkFor picks the S3 trunk for a new call. Operator overrides win;
+// otherwise low-reputation callers go to the scrutiny trunk when configured.
+func (r *Router) forwardTrunkFor(t *models.Tenant, ani, dnis string) string {
+    trunk := r.trunkFor(legForward, dnis, t)
+    if trunk != r.defaultTrunk(legForward, t) || r.config.ReputationTrunk == "" {
+        return trunk
+    }
+
+    if rep := r.Reputation(ani); rep.Score < r.config.ReputationThreshold {
+        reputationRouted.Inc()
+        logger.Infof("ANI %s reputation %.1f below %.1f, routing to %s",
+            ani, rep.Score, r.config.ReputationThreshold, r.config.ReputationTrunk)
+        return r.config.ReputationTrunk
+    }
+    return trunk
+}
@@ -1,33 +1,237 @@
 package router
 
 import (
+    "context"
     "database/sql"
-    "encoding/json"
+    "errors"
     "fmt"
-    "log"
-    "math/rand"
     "sync"
     "time"
 
     "strings"
     
     _ "github.com/go-sql-driver/mysql"
+    "github.com/asterisk-call-routing-v2/internal/ami"
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/lifecycle"
+    "github.com/asterisk-call-routing-v2/internal/logging"
     "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/numplan"
+    "github.com/asterisk-call-routing-v2/internal/ratelimit"
+    "github.com/asterisk-call-routing-v2/internal/tracing"
 )
 
+var logger = logging.New("router")
+
+// callLogger tags lines with a call's CallID, DID and ANI, and the
+// request ID of the API request being served
+func callLogger(ctx context.Context, record *models.CallRecord) *logging.Logger {
+    return logger.Call(record.CallID, record.AssignedDID, record.OriginalANI).Context(ctx)
+}
+
+// Default trunks the dialplan sends each leg to
+const (
+    trunkS3 = "trunk-s3"
+    trunkS4 = "trunk-s4"
+)
+
+// Config holds optional router behaviour; zero values select the defaults
+type Config struct {
+    StorageDriver          string            // backend for DIDs and call records, see StorageDrivers; "" means mysql
+    QueryTimeout           time.Duration     // bound on each database operation, 0 disables
+    DIDCooldown            time.Duration     // a released DID is not reassigned for this long, 0 disables
+    DIDWait                time.Duration     // how long a call waits for a DID when its pool is exhausted, 0 fails at once
+    Overflow               string            // what a call gets when no DID is free: OverflowFail, OverflowDirect or OverflowAnnouncement
+    OverflowTarget         string            // S4 trunk for OverflowDirect ("" is the return-leg trunk), dialplan context for OverflowAnnouncement
+    ForwardTrunk           string            // default trunk towards S3, "" means trunk-s3
+    ReturnTrunk            string            // default trunk towards S4, "" means trunk-s4
+    RecordingPath          string            // directory recordings are written to
+    RecordingQuota         int64             // bytes the recordings may use, 0 disables enforcement
+    RecordingFullAction    string            // RecordingFullStop (default) or RecordingFullPurge once over quota
+    RecordingInterval      time.Duration     // how often recordings disk use is measured, 0 disables
+    RecordingMetadata      string            // where recording checksums are kept, see RecordingMetaBackends; "" disables
+    WebhookURLs            []string          // consumers notified of call events
+    WebhookMaxAttempts     int               // deliveries are dead-lettered after this many failures
+    DedupWindow            time.Duration     // identical ANI/DNIS within this window reuse the call, 0 disables
+    TokenMode              string            // embed a match token in the forwarded DNIS: "", "prefix" or "suffix"
+    TokenDigits            int               // length of the match token
+    StatelessKey           string            // HMAC key; non-empty enables stateless routing
+    AnomalyThreshold       float64           // deviation score that raises a traffic alert, 0 disables
+    ReadOnly               bool              // serve queries only, e.g. against a DR replica
+    SchemaCheckInterval    time.Duration     // how often the live schema is compared with the expected one, 0 only checks on startup
+    SchemaRepair           bool              // apply safe schema fixes automatically
+    ReputationTrunk        string            // trunk for callers scoring below ReputationThreshold, "" disables
+    ReputationThreshold    float64           // ANI reputation score (0-100) below which calls are rerouted
+    Redis                  RedisConfig       // shared call state for multi-instance deployments, empty Addr disables
+    Replication            ReplicationConfig // call-state stream to or from a warm standby
+    V1DualWrite            V1DualWriteConfig // DID state mirrored into a v1 router during a migration, empty DSN disables
+    Diagnostics            DiagnosticsConfig // profiles captured when routing breaches its SLOs, empty Dir disables
+    EventStream            EventStreamConfig // message bus call events are streamed to, empty Backend disables
+    CDR                    CDRConfig         // where CDRs of finished calls are written, no Sinks disables
+    WriteRetryMaxAge       time.Duration     // how long a failed call state write is retried, 0 until shutdown
+    DBBreakerFailures      int               // storage calls in a row failing to reach MySQL that open the circuit breaker, 0 disables
+    DBReconnectMaxBackoff  time.Duration     // longest wait between reconnect attempts while the breaker is open, 0 means 30s
+    DegradedMode           bool              // keep allocating from an in-memory pool snapshot while the breaker is open
+    WriteRetryLimit        int               // call state writes queued for retry before the oldest are given up, 0 means 10000
+    WriteBehindWorkers     int               // writers call state writes are handed to off the signaling path, 0 writes inline
+    WriteBehindBuffer      int               // writes each writer buffers before new ones are dropped, 0 means 10000
+    WriteBatchInterval     time.Duration     // write-behind writers batch what arrives over this tick into multi-row statements, 0 writes one by one
+    WriteReportFile        string            // JSON lines file of unreconciled call state writes, empty keeps them in memory
+    AMI                    ami.Config        // Asterisk Manager connection for hangup detection, empty Addr disables
+    NegativeCacheTTL       time.Duration     // how long a failing destination stays blocked, 0 disables
+    NegativeCacheFailures  int               // hard failures within the TTL that block a destination
+    NegativeCacheDigits    int               // destination prefix length failures are grouped by
+    NegativeCacheReroute   string            // trunk tried for blocked destinations before failing fast
+    NegativeCacheFailback  string            // FailbackImmediate (default), FailbackManual or FailbackRamp
+    NegativeCacheRamp      time.Duration     // how long FailbackRamp takes to restore full traffic
+    ExportDir              string            // CDR export files are written here, "" disables exports
+    ExportRetention        time.Duration     // finished exports are deleted after this
+    StatsInterval          time.Duration     // how often stats are snapshotted into stats_history, 0 disables
+    StatsRetention         time.Duration     // snapshots older than this are deleted
+    ArchiveAfter           time.Duration     // closed call records older than this are moved to call_records_archive, 0 disables
+    ArchiveRetention       time.Duration     // archived call records older than this are deleted with their events, notes and recording metadata, 0 keeps them
+    ArchiveInterval        time.Duration     // how often the archiver runs, 0 means hourly
+    ArchiveBatch           int               // call records moved per transaction, 0 means 5000
+    TraceEndpoint          string            // OTLP/HTTP traces URL spans are exported to, "" only propagates context
+    CallIDGenerator        string            // issue CallIDs S1 omits: "", "ulid" or "snowflake"
+    NodeID                 int               // snowflake node ID, unique per router
+    Clock                  clock.Clock       // time source for expiry and workers, nil uses the system clock
+    InputNormalization     string            // NormalizeTolerant (default), NormalizeStrict or NormalizeOff for Asterisk-supplied numbers
+    E164Mode               string            // E164Off (default), E164Rewrite or E164Strict validation against NumberingRules
+    E164HomeCountry        string            // country code national numbers are read against, e.g. 44
+    NumberingRules         []string          // per-country E.164 rules as "cc=min[-max][:trunk[:intl]]"
+    DIDSelection           string            // how free DIDs are picked: "random" (default), "lru" or "round-robin"
+    DIDSelectionPools      []string          // per-pool overrides of DIDSelection as "tenant=strategy"
+    NumberFormats          []string          // ANI/DNIS output format per trunk as "trunk=e164|00|national[:countrycode]"
+    PoolPrefixes           []string          // DNIS prefix to DID pool mapping as "prefix=pool", longest prefix wins
+    CountryPrefixes        []string          // international prefix to DID country as "prefix=country", longest prefix wins
+    CountryFromNumberPlan  bool              // DID country from the embedded numbering plan's ISO codes where CountryPrefixes has none
+    StateReloadLookback    time.Duration     // unfinished calls ReloadState loads by default, 0 loads the in-flight windows
+    SoakCheck              time.Duration     // invariants verified this often under load, halting on a violation; 0 disables
+    SoakDumpFile           string            // where the soak check writes its dump, "" uses the temp dir
+    ANIMismatchMode        string            // ANIMismatchWarn (default) or ANIMismatchStrict to refuse the return leg
+    ANIMismatchQuarantine  time.Duration     // a DID returned with the wrong ANI-2 stays out of the pool this long, 0 disables
+    S1Partitions           int               // partitions the DID pool is hashed into for S1 sources, 0 disables
+    MaxCallDuration        time.Duration     // returned calls are ended after this unless their tenant says otherwise, 0 disables
+    MaxConcurrentCalls     int               // calls tracked at once before new ones are refused, 0 disables
+    MaxCPS                 float64           // incoming calls per second across the router, 0 disables
+    CPSBurst               int               // calls admitted at once above MaxCPS, 0 means one second's worth
+    HideCost               bool              // leave the cost estimate out of routing responses, for untrusted S1 callers
+    ProvisioningURL        string            // number provider connector DIDs are ordered from, "" disables
+    ProvisioningThreshold  float64           // pool utilization (0-1) that triggers provisioning
+    ProvisioningSustain    time.Duration     // how long a pool stays above the threshold before DIDs are ordered
+    ProvisioningBatch      int               // DIDs ordered per request
+    ProvisioningBudgetDIDs int               // DIDs ordered per calendar month, 0 is unlimited
+    ProvisioningBudgetCost float64           // connector cost per calendar month, 0 is unlimited
+    ProvisioningApproval   bool              // requests wait for an operator to approve them
+}
+
+// ErrReadOnly is returned for calls that would allocate or write in read-only mode
+var ErrReadOnly = errors.New("router is in read-only mode")
+
+// ErrNoAvailableDIDs is returned when the call's DID pool is exhausted
+var ErrNoAvailableDIDs = errors.New("no available DIDs")
+
+// ErrMissingCallID is returned for calls without a CallID when the router
+// does not issue its own
+var ErrMissingCallID = errors.New("missing CallID")
+
+// ErrCallNotFound is returned for a return leg or hangup whose DID, token
+// or CallID belongs to no call in flight
+var ErrCallNotFound = errors.New("no active call")
+
+// ErrDIDMismatch is returned for a stateless return leg whose DID and
+// ANI-2 are not what the router forwarded
+var ErrDIDMismatch = errors.New("DID does not match the call")
+
 type Router struct {
     db              *sql.DB
+    store           Storage
+    callPathOnly    bool // the backend has no feature tables, which only MySQL has
+    config          Config
+    clock           clock.Clock
     mu              sync.RWMutex
     activeCallsMap  map[string]*models.CallRecord  // CallID -> CallRecord
     didToCallMap    map[string]string              // DID -> CallID
     recordingPath   string
+    
+    workersMu       sync.Mutex
+    workers         map[string]*WorkerStatus
+    
+    recentIncoming  map[string]dedupEntry          // ANI|DNIS -> most recent call, guarded by mu
+    tokenToCall     map[string]string              // MatchToken -> CallID
+    bridgedCalls    map[string]bool                // CallIDs seen bridged on AMI, guarded by mu
+    admissions      map[string]*admission          // CallID -> call being admitted, guarded by mu
+    calls           callLocks
+    soak            soakMonitor
+    statelessDIDs   statelessPool
+    traffic         trafficProfile
+    settlement      settlementRules
+    campaigns       campaignLimits
+    carriers        carrierProfiles
+    cps             *ratelimit.Bucket // global CPS ceiling, nil without MaxCPS
+    overrides       routingOverrides
+    maps            mapMonitor
+    rates           rateDeck
+    reputation      aniReputation
+    ami             *ami.Client
+    negative        negativeCache
+    tenants         tenantDirectory
+    tracer          *tracing.Tracer
+    exports         exportJobs
+    shared          *sharedState // nil unless Redis is configured
+    ids             idGenerator  // nil unless CallIDGenerator is set
+    draining        bool         // set by Drain, guarded by mu
+    life            *lifecycle.Group
+    selection       *didSelection
+    formats         numberFormats
+    pools           prefixMap // DNIS prefix -> DID pool
+    countries       prefixMap // international prefix -> DID country
+    numbering       *numberingPlan // E.164 rules numbers are checked against
+    countryStats    countryStats
+    recordings      recordingUsage
+    recordingMeta   RecordingMetaStore // nil unless recording checksums are kept
+    recordingQueue  recordingChecksumQueue
+    partitions      s1Partitions
+    load            loadTracker
+    replication     replicationState
+    events          *eventStream // nil unless an event stream is configured
+    cdrs            *cdrWriter   // nil unless CDR sinks are configured
+    writes          writeRetry
+    writeBehind     *writeBehind // nil writes call state inline
+    breaker         *dbBreaker   // nil without a circuit breaker
+    v1              *v1Mirror    // nil unless dual-write to v1 is configured
+    provisioning    provisioning
+    blocklist       blocklistCache
+    live            liveFeed
+    schema          schemaStatus
+    archive         archiveState
+    slo             sloTracker
+    didQueue        didWaitQueue
 }
 
-func NewRouter(dsn string) (*Router, error) {
-	fmt.Println(rand.Intn(100))
-	 bolB, _ := json.Marshal(true)
-    fmt.Println(string(bolB))
-    db, err := sql.Open("mysql", dsn)
+func NewRouter(dsn string, cfg Config) (*Router, error) {
+    driver := cfg.StorageDriver
+    if driver == "" {
+        driver = "mysql"
+    }
+    backend, ok := storageBackends[driver]
+    if !ok {
+        return nil, fmt.Errorf("unsupported storage driver %q (available: %s)", driver, strings.Join(StorageDrivers(), ", "))
+    }
+    if !backend.features {
+        if names := mysqlOnly(cfg); len(names) > 0 {
+            return nil, fmt.Errorf("%s need the mysql storage driver", strings.Join(names, ", "))
+        }
+        // On by default, and off here without their tables
+        cfg.StatsInterval = 0
+        cfg.ExportDir = ""
+        cfg.RecordingMetadata = ""
+        cfg.AnomalyThreshold = 0
+        logger.Infof("Storage driver %s keeps DIDs and call records only: campaigns, rates, overrides, tenants, blocklists and the other feature tables are off", driver)
+    }
+
+    db, err := sql.Open(backend.sqlDriver, dsn)
     if err != nil {
         return nil, err
     }
@@ -39,33 +243,351 @@ func NewRouter(dsn string) (*Router, error) {
     // Set connection pool settings
     db.SetMaxOpenConns(25)
     db.SetMaxIdleConns(5)
+    if backend.maxConns > 0 {
+        db.SetMaxOpenConns(backend.maxConns)
+        db.SetMaxIdleConns(backend.maxConns)
+    }
     db.SetConnMaxLifetime(5 * time.Minute)
     
-    // Create tables if not exist
-    if err := createTables(db); err != nil {
+    // Create tables if not exist; a replica gets its schema from the primary
+    if !cfg.ReadOnly {
+        if err := backend.createTables(db); err != nil {
+            return nil, err
+        }
+    }
+    
+    if cfg.Clock == nil {
+        cfg.Clock = clock.Real()
+    }
+    r, err := newRouter(db, backend.open(db, cfg.QueryTimeout, cfg.DIDCooldown, cfg.Clock.Now), cfg)
+    if err != nil {
         return nil, err
     }
+    r.callPathOnly = !backend.features
+    cfg = r.config
     
-    r := &Router{
-        db:             db,
-        activeCallsMap: make(map[string]*models.CallRecord),
-        didToCallMap:   make(map[string]string),
-        recordingPath:  "/var/spool/asterisk/recordings",
+    // Dual-write wraps the storage before anything claims a DID
+    if cfg.V1DualWrite.DSN != "" && !cfg.ReadOnly {
+        if err := r.startV1DualWrite(cfg.V1DualWrite); err != nil {
+            return nil, err
+        }
+    }
+    
+    if !r.callPathOnly {
+        r.loadSettlementRules()
+        r.loadCampaigns()
+        r.loadCarriers()
+        r.loadTenants()
+        if cfg.S1Partitions > 0 {
+            r.loadPartitions()
+        }
+        r.refreshOverrides()
+        r.loadRates()
+        r.refreshReputation()
+        r.loadBlocklist()
+        if err := r.checkSchema(); err != nil {
+            logger.Warnf("Schema check failed: %v", err)
+        }
+    }
+    if err := r.store.Prepare(context.Background()); err != nil {
+        return nil, err
+    }
+    if cfg.DegradedMode && cfg.DBBreakerFailures <= 0 {
+        return nil, errors.New("degraded mode needs the database breaker enabled")
+    }
+    if cfg.DBBreakerFailures > 0 {
+        r.startBreaker(cfg.DBBreakerFailures, cfg.DBReconnectMaxBackoff, cfg.DegradedMode && !cfg.ReadOnly)
+    }
+    if r.breaker != nil && r.breaker.pool != nil {
+        if err := r.refreshPoolSnapshot(); err != nil {
+            return nil, fmt.Errorf("loading the pool snapshot: %w", err)
+        }
+    }
+    if cfg.WriteBehindWorkers > 0 && !cfg.ReadOnly {
+        r.startWriteBehind(cfg.WriteBehindWorkers, cfg.WriteBehindBuffer, cfg.WriteBatchInterval)
     }
     
     // Restore active calls from database
     if err := r.restoreActiveCalls(); err != nil {
-        log.Printf("[ROUTER] Warning: Failed to restore active calls: %v", err)
+        logger.Errorf("Failed to restore active calls: %v", err)
+    }
+    if err := r.startReplication(cfg.Replication); err != nil {
+        return nil, err
+    }
+    if err := r.startEventStream(cfg.EventStream); err != nil {
+        return nil, err
+    }
+    if !cfg.ReadOnly {
+        if err := r.startCDRSinks(cfg.CDR); err != nil {
+            return nil, err
+        }
     }
     
-    // Start cleanup goroutine
-    go r.cleanupRoutine()
+    // Start background workers; the writers stay with the primary
+    if !cfg.ReadOnly {
+        r.startWorker("cleanup", 30*time.Second, r.cleanupStaleCalls)
+        r.startWorker("map-sweep", mapSweepInterval, r.sweepMaps)
+        r.startWorker("max-duration", 30*time.Second, r.endLongCalls)
+        r.startWorker("state-writes", writeRetryInterval, r.retryWrites)
+        if r.breaker != nil && r.breaker.pool != nil {
+            r.startWorker("pool-snapshot", poolSnapshotInterval, r.refreshPoolSnapshot)
+        }
+        if len(cfg.WebhookURLs) > 0 {
+            r.startWorker("webhooks", 2*time.Second, r.deliverWebhooks)
+        }
+        if cfg.DedupWindow > 0 {
+            r.startWorker("dedup", cfg.DedupWindow, r.pruneDedup)
+        }
+        if cfg.NegativeCacheTTL > 0 {
+            // Swept at least every 10s so failbacks are not held up by a long TTL
+            sweep := cfg.NegativeCacheTTL
+            if sweep > 10*time.Second {
+                sweep = 10 * time.Second
+            }
+            r.startWorker("negative-cache", sweep, r.pruneNegativeCache)
+        }
+        if cfg.RecordingInterval > 0 {
+            r.startWorker("recordings", cfg.RecordingInterval, r.checkRecordings)
+        }
+        if r.recordingMeta != nil {
+            r.startWorker("recording-checksums", recordingSettle, r.checksumRecordings)
+        }
+        if cfg.StatsInterval > 0 {
+            r.startWorker("stats-history", cfg.StatsInterval, r.snapshotStats)
+        }
+        if !r.callPathOnly {
+            r.startWorker("blocklist-feeds", time.Minute, r.refreshBlocklistFeeds)
+        }
+        if cfg.ProvisioningURL != "" {
+            r.startWorker("provisioning", time.Minute, r.checkProvisioning)
+        }
+        if r.v1 != nil {
+            interval := cfg.V1DualWrite.ReconcileInterval
+            if interval <= 0 {
+                interval = v1ReconcileInterval
+            }
+            r.startWorker("v1-dual-write", interval, r.v1.reconcile)
+        }
+        if cfg.AMI.Addr != "" {
+            r.ami = ami.NewClient(cfg.AMI, r.HandleAMIEvent)
+            r.life.Go("ami", func(context.Context) error {
+                r.ami.Run()
+                return nil
+            })
+        }
+    } else {
+        logger.Infof("Read-only mode: allocations and writes are refused")
+    }
+    if !r.callPathOnly {
+        r.startWorker("traffic-profile", 5*time.Minute, r.learnTrafficProfile)
+        r.startWorker("settlement-rules", time.Minute, r.loadSettlementRules)
+        r.startWorker("campaigns", 30*time.Second, r.loadCampaigns)
+        r.startWorker("carriers", 30*time.Second, r.loadCarriers)
+        if cfg.S1Partitions > 0 {
+            r.startWorker("partitions", 30*time.Second, r.loadPartitions)
+        }
+        r.startWorker("tenants", 30*time.Second, r.loadTenants)
+        r.startWorker("overrides", 15*time.Second, r.refreshOverrides)
+        r.startWorker("rates", time.Minute, r.loadRates)
+        r.startWorker("reputation", 5*time.Minute, r.refreshReputation)
+        r.startWorker("blocklist", 30*time.Second, r.loadBlocklist)
+        if cfg.SchemaCheckInterval > 0 {
+            r.startWorker("schema", cfg.SchemaCheckInterval, r.checkSchema)
+        }
+    }
+    r.startWorker("map-sizes", mapSampleInterval, r.sampleMaps)
+    if cfg.Diagnostics.Dir != "" {
+        r.startWorker("diagnostics", diagnosticsCheckEvery, r.checkSLOs)
+    }
+    if cfg.ExportDir != "" {
+        r.startWorker("exports", 10*time.Minute, r.pruneExports)
+    }
+    if cfg.ArchiveAfter > 0 && !cfg.ReadOnly {
+        r.startWorker("call-archive", cfg.ArchiveInterval, r.archiveCallRecords)
+    }
+    if r.tracer.Exporting() {
+        r.startWorker("trace-export", 5*time.Second, r.tracer.Flush)
+    }
+    if cfg.SoakCheck > 0 {
+        r.startWorker("soak", cfg.SoakCheck, r.checkSoak)
+        logger.Warnf("Soak mode: checking invariants every %s, halting on the first violation", cfg.SoakCheck)
+    }
+    if r.stateless() {
+        r.refreshStatelessPool()
+        r.startWorker("stateless-pool", 30*time.Second, r.refreshStatelessPool)
+        logger.Infof("Stateless routing enabled")
+    }
     
     return r, nil
 }
 
-func createTables(db *sql.DB) error {
-    queries := []string{
+// newRouter checks cfg, fills in its defaults and builds a router on db
+// and store, without loading anything or starting workers
+func newRouter(db *sql.DB, store Storage, cfg Config) (*Router, error) {
+    if cfg.WebhookMaxAttempts <= 0 {
+        cfg.WebhookMaxAttempts = 10
+    }
+    if cfg.TokenDigits <= 0 {
+        cfg.TokenDigits = 4
+    }
+    if cfg.NegativeCacheFailures <= 0 {
+        cfg.NegativeCacheFailures = 3
+    }
+    if cfg.StatsRetention <= 0 {
+        cfg.StatsRetention = 7 * 24 * time.Hour
+    }
+    if cfg.ExportRetention <= 0 {
+        cfg.ExportRetention = 24 * time.Hour
+    }
+    if cfg.ArchiveInterval <= 0 {
+        cfg.ArchiveInterval = time.Hour
+    }
+    if cfg.ArchiveBatch <= 0 {
+        cfg.ArchiveBatch = 5000
+    }
+    if cfg.ForwardTrunk == "" {
+        cfg.ForwardTrunk = trunkS3
+    }
+    if cfg.ReturnTrunk == "" {
+        cfg.ReturnTrunk = trunkS4
+    }
+    if cfg.RecordingPath == "" {
+        cfg.RecordingPath = "/var/spool/asterisk/recordings"
+    }
+    if cfg.S1Partitions < 0 {
+        return nil, fmt.Errorf("s1 partitions must not be negative")
+    }
+    if cfg.ProvisioningURL != "" {
+        if cfg.ProvisioningThreshold <= 0 || cfg.ProvisioningThreshold > 1 {
+            return nil, fmt.Errorf("provisioning threshold must be between 0 and 1")
+        }
+        if cfg.ProvisioningBatch <= 0 {
+            cfg.ProvisioningBatch = 50
+        }
+    }
+    switch cfg.RecordingFullAction {
+    case "":
+        cfg.RecordingFullAction = RecordingFullStop
+    case RecordingFullStop, RecordingFullPurge:
+    default:
+        return nil, fmt.Errorf("invalid recording full action %q", cfg.RecordingFullAction)
+    }
+    if cfg.NegativeCacheDigits <= 0 {
+        cfg.NegativeCacheDigits = 6
+    }
+    switch cfg.NegativeCacheFailback {
+    case "":
+        cfg.NegativeCacheFailback = FailbackImmediate
+    case FailbackImmediate, FailbackManual, FailbackRamp:
+    default:
+        return nil, fmt.Errorf("invalid failback policy %q", cfg.NegativeCacheFailback)
+    }
+    if cfg.NegativeCacheRamp <= 0 {
+        cfg.NegativeCacheRamp = 5 * time.Minute
+    }
+    if cfg.InputNormalization == "" {
+        cfg.InputNormalization = NormalizeTolerant
+    }
+    if !validNormalization(cfg.InputNormalization) {
+        return nil, fmt.Errorf("invalid input normalization %q", cfg.InputNormalization)
+    }
+    if cfg.ANIMismatchMode == "" {
+        cfg.ANIMismatchMode = ANIMismatchWarn
+    }
+    if cfg.ANIMismatchMode != ANIMismatchWarn && cfg.ANIMismatchMode != ANIMismatchStrict {
+        return nil, fmt.Errorf("invalid ANI mismatch mode %q (warn or strict)", cfg.ANIMismatchMode)
+    }
+    if cfg.TokenMode != TokenOff && cfg.TokenMode != TokenPrefix && cfg.TokenMode != TokenSuffix {
+        return nil, fmt.Errorf("invalid token mode %q", cfg.TokenMode)
+    }
+    if err := validateOverflow(cfg.Overflow, cfg.OverflowTarget); err != nil {
+        return nil, err
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = clock.Real()
+    }
+    ids, err := newIDGenerator(cfg.CallIDGenerator, cfg.NodeID)
+    if err != nil {
+        return nil, err
+    }
+    selection, err := newDIDSelection(cfg.DIDSelection, cfg.DIDSelectionPools)
+    if err != nil {
+        return nil, err
+    }
+    formats, err := parseNumberFormats(cfg.NumberFormats)
+    if err != nil {
+        return nil, err
+    }
+    pools, err := parsePrefixMap(cfg.PoolPrefixes, "pool", maxPoolLen)
+    if err != nil {
+        return nil, err
+    }
+    countries, err := parsePrefixMap(cfg.CountryPrefixes, "country", 50)
+    if err != nil {
+        return nil, err
+    }
+    numbering, err := parseNumberingPlan(cfg.E164Mode, cfg.E164HomeCountry, cfg.NumberingRules)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := numplan.Size(); err != nil {
+        return nil, err
+    }
+    
+    var recordingMeta RecordingMetaStore
+    if cfg.RecordingMetadata != "" {
+        newMeta, ok := recordingMetaBackends[cfg.RecordingMetadata]
+        if !ok {
+            return nil, fmt.Errorf("unsupported recording metadata store %q (available: %s)", cfg.RecordingMetadata, strings.Join(RecordingMetaBackends(), ", "))
+        }
+        recordingMeta = newMeta(db, cfg.RecordingPath, cfg.QueryTimeout)
+    }
+    
+    r := &Router{
+        db:             db,
+        store:          store,
+        shared:         newSharedState(cfg.Redis),
+        ids:            ids,
+        config:         cfg,
+        clock:          cfg.Clock,
+        activeCallsMap: make(map[string]*models.CallRecord),
+        didToCallMap:   make(map[string]string),
+        recordingPath:  cfg.RecordingPath,
+        recordingMeta:  recordingMeta,
+        workers:        make(map[string]*WorkerStatus),
+        recentIncoming: make(map[string]dedupEntry),
+        tokenToCall:    make(map[string]string),
+        bridgedCalls:   make(map[string]bool),
+        admissions:     make(map[string]*admission),
+        negative:       negativeCache{entries: make(map[string]*NegativeEntry)},
+        campaigns:      campaignLimits{buckets: make(map[string]*ratelimit.Bucket)},
+        carriers:       carrierProfiles{buckets: make(map[string]*ratelimit.Bucket)},
+        maps:           mapMonitor{leaking: make(map[string]bool)},
+        tracer:         tracing.NewTracer("s2-router", cfg.TraceEndpoint),
+        exports:        exportJobs{jobs: make(map[string]*exportJob), slots: make(chan struct{}, maxConcurrentExports)},
+        life:           lifecycle.New(context.Background()),
+        selection:      selection,
+        formats:        formats,
+        pools:          pools,
+        countries:      countries,
+        numbering:      numbering,
+        countryStats:   countryStats{counts: make(map[string]*models.CountryMatch)},
+        provisioning:   provisioning{since: make(map[string]time.Time)},
+        blocklist:      blocklistCache{lookups: make(map[string]dnsblAnswer)},
+        live:           liveFeed{subs: make(map[chan models.LiveCallUpdate]bool)},
+    }
+    r.cps = newCPSBucket(cfg.MaxCPS, cfg.CPSBurst, r.clock)
+    if r.writes.limit = cfg.WriteRetryLimit; r.writes.limit <= 0 {
+        r.writes.limit = writeRetryLimit
+    }
+    return r, nil
+}
+
+// schemaDDL is the expected schema: createTables runs it on startup and
+// checkSchema compares the live database with it, so a column added here
+// also needs its migration below
+func schemaDDL() []string {
+    return []string{
         `CREATE TABLE IF NOT EXISTS call_records (
             id BIGINT AUTO_INCREMENT PRIMARY KEY,
             call_id VARCHAR(100) UNIQUE NOT NULL,
@@ -77,9 +599,52 @@ func createTables(db *sql.DB) error {
             end_time TIMESTAMP NULL,
             duration INT DEFAULT 0,
             recording_path VARCHAR(255),
+            match_token VARCHAR(20),
+            settlement_class VARCHAR(50),
+            tags JSON,
+            campaign_id VARCHAR(64),
+            forward_trunk VARCHAR(100),
+            tenant_id VARCHAR(64),
+            trace_parent VARCHAR(64),
+            hangup_cause VARCHAR(8),
+            dest_country VARCHAR(2),
+            dest_region VARCHAR(100),
+            dest_type VARCHAR(20),
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
             INDEX idx_call_id (call_id),
             INDEX idx_did (assigned_did),
             INDEX idx_status (status),
+            INDEX idx_start_time (start_time),
+            INDEX idx_match_token (match_token),
+            INDEX idx_settlement_class (settlement_class),
+            INDEX idx_campaign (campaign_id, start_time),
+            INDEX idx_destination (start_time, dest_country)
+        )`,
+        `CREATE TABLE IF NOT EXISTS call_records_archive (
+            id BIGINT PRIMARY KEY,
+            call_id VARCHAR(100) NOT NULL,
+            original_ani VARCHAR(50),
+            original_dnis VARCHAR(50),
+            assigned_did VARCHAR(50),
+            status VARCHAR(50),
+            start_time TIMESTAMP NULL,
+            end_time TIMESTAMP NULL,
+            duration INT DEFAULT 0,
+            recording_path VARCHAR(255),
+            match_token VARCHAR(20),
+            settlement_class VARCHAR(50),
+            tags JSON,
+            campaign_id VARCHAR(64),
+            forward_trunk VARCHAR(100),
+            tenant_id VARCHAR(64),
+            trace_parent VARCHAR(64),
+            hangup_cause VARCHAR(8),
+            dest_country VARCHAR(2),
+            dest_region VARCHAR(100),
+            dest_type VARCHAR(20),
+            updated_at TIMESTAMP NULL,
+            archived_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_call_id (call_id),
             INDEX idx_start_time (start_time)
         )`,
         `CREATE TABLE IF NOT EXISTS dids (
@@ -88,41 +653,496 @@ func createTables(db *sql.DB) error {
             in_use BOOLEAN DEFAULT FALSE,
             destination VARCHAR(50),
             country VARCHAR(50),
+            tags JSON,
+            tenant_id VARCHAR(64) NOT NULL DEFAULT '',
+            pool VARCHAR(64) NOT NULL DEFAULT '',
+            last_used_at TIMESTAMP NULL,
+            last_released_at TIMESTAMP(3) NULL,
+            quarantined_until TIMESTAMP(3) NULL,
+            quarantine_reason VARCHAR(255),
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+            INDEX idx_in_use (in_use),
+            INDEX idx_tenant_free (tenant_id, in_use),
+            INDEX idx_tenant_lru (tenant_id, in_use, last_used_at),
+            INDEX idx_tenant_rr (tenant_id, in_use, did),
+            INDEX idx_pool_free (tenant_id, pool, in_use, country)
+        )`,
+        `CREATE TABLE IF NOT EXISTS did_ranges (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            range_start VARCHAR(50) NOT NULL,
+            range_end VARCHAR(50) NOT NULL,
+            tenant_id VARCHAR(64) NOT NULL DEFAULT '',
+            country VARCHAR(50),
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_tenant (tenant_id)
+        )`,
+        `CREATE TABLE IF NOT EXISTS webhook_queue (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            event_type VARCHAR(50) NOT NULL,
+            url VARCHAR(255) NOT NULL,
+            payload TEXT NOT NULL,
+            status VARCHAR(20) NOT NULL DEFAULT 'PENDING',
+            attempts INT DEFAULT 0,
+            next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            last_error VARCHAR(255),
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            delivered_at TIMESTAMP NULL,
+            INDEX idx_status_next (status, next_attempt_at)
+        )`,
+        `CREATE TABLE IF NOT EXISTS settlement_rules (
+            id INT AUTO_INCREMENT PRIMARY KEY,
+            match_type VARCHAR(10) NOT NULL,
+            pattern VARCHAR(50) NOT NULL,
+            class VARCHAR(50) NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            UNIQUE KEY uniq_match (match_type, pattern)
+        )`,
+        `CREATE TABLE IF NOT EXISTS campaigns (
+            campaign_id VARCHAR(64) PRIMARY KEY,
+            max_cps DOUBLE DEFAULT 0,
+            max_concurrent INT DEFAULT 0,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+        )`,
+        `CREATE TABLE IF NOT EXISTS carrier_profiles (
+            trunk VARCHAR(100) PRIMARY KEY,
+            dial_prefix VARCHAR(20) NOT NULL DEFAULT '',
+            caller_id_header VARCHAR(10) NOT NULL DEFAULT '',
+            privacy VARCHAR(50) NOT NULL DEFAULT '',
+            max_cps DOUBLE DEFAULT 0,
+            headers JSON,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+        )`,
+        `CREATE TABLE IF NOT EXISTS s1_partitions (
+            source VARCHAR(64) PRIMARY KEY,
+            partition_no INT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+        )`,
+        `CREATE TABLE IF NOT EXISTS blocklist (
+            number VARCHAR(32) NOT NULL,
+            source VARCHAR(64) NOT NULL,
+            action VARCHAR(10) NOT NULL DEFAULT 'block',
+            reason VARCHAR(255),
+            expires_at DATETIME NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+            PRIMARY KEY (number, source),
+            INDEX idx_source (source),
+            INDEX idx_expires (expires_at)
+        )`,
+        `CREATE TABLE IF NOT EXISTS blocklist_feeds (
+            name VARCHAR(64) PRIMARY KEY,
+            url VARCHAR(512) NOT NULL,
+            format VARCHAR(10) NOT NULL,
+            action VARCHAR(10) NOT NULL DEFAULT 'block',
+            ttl INT NOT NULL,
+            fetch_interval INT NOT NULL,
+            priority INT NOT NULL DEFAULT 0,
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            last_fetch DATETIME NULL,
+            last_error VARCHAR(255),
+            entries INT NOT NULL DEFAULT 0,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+        )`,
+        `CREATE TABLE IF NOT EXISTS did_provisioning (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            tenant_id VARCHAR(64) NOT NULL DEFAULT '',
+            pool VARCHAR(64) NOT NULL DEFAULT '',
+            count INT NOT NULL,
+            utilization DOUBLE NOT NULL,
+            status VARCHAR(20) NOT NULL,
+            added INT NOT NULL DEFAULT 0,
+            cost DECIMAL(12,4) NOT NULL DEFAULT 0,
+            error VARCHAR(255),
+            decided_by VARCHAR(100),
+            requested_at DATETIME NOT NULL,
+            completed_at DATETIME NULL,
+            INDEX idx_status (status),
+            INDEX idx_requested (requested_at)
+        )`,
+        `CREATE TABLE IF NOT EXISTS tenants (
+            tenant_id VARCHAR(64) PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            forward_trunk VARCHAR(100),
+            return_trunk VARCHAR(100),
+            reservation_ttl INT NOT NULL DEFAULT 0,
+            stale_timeout INT NOT NULL DEFAULT 0,
+            max_duration INT NOT NULL DEFAULT 0,
+            priority INT NOT NULL DEFAULT 0,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+        )`,
+        `CREATE TABLE IF NOT EXISTS tenant_domains (
+            domain VARCHAR(255) PRIMARY KEY,
+            tenant_id VARCHAR(64) NOT NULL,
+            INDEX idx_tenant (tenant_id)
+        )`,
+        `CREATE TABLE IF NOT EXISTS routing_overrides (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            prefix VARCHAR(50) NOT NULL,
+            leg VARCHAR(10) NOT NULL,
+            trunk VARCHAR(100) NOT NULL,
+            reason VARCHAR(255),
+            created_by VARCHAR(100) NOT NULL,
+            status VARCHAR(20) NOT NULL,
+            starts_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            expires_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            cancelled_at TIMESTAMP NULL,
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_status_expires (status, expires_at)
+        )`,
+        `CREATE TABLE IF NOT EXISTS override_audit (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            override_id BIGINT NOT NULL,
+            action VARCHAR(20) NOT NULL,
+            actor VARCHAR(100) NOT NULL,
+            detail VARCHAR(255),
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_override (override_id)
+        )`,
+        `CREATE TABLE IF NOT EXISTS recordings (
+            call_id VARCHAR(100) PRIMARY KEY,
+            path VARCHAR(255) NOT NULL,
+            size_bytes BIGINT NOT NULL,
+            sha256 CHAR(64) NOT NULL,
+            completed_at TIMESTAMP(3) NOT NULL,
+            verified_at TIMESTAMP(3) NULL,
+            verify_status VARCHAR(20),
+            INDEX idx_verify (verify_status)
+        )`,
+        `CREATE TABLE IF NOT EXISTS stats_history (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            node VARCHAR(100) NOT NULL,
+            taken_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            active_calls INT NOT NULL,
+            total_dids INT NOT NULL,
+            used_dids INT NOT NULL,
+            available_dids BIGINT NOT NULL,
+            calls_today INT NOT NULL,
+            completed_today INT NOT NULL,
+            INDEX idx_taken (taken_at, node)
+        )`,
+        `CREATE TABLE IF NOT EXISTS notes (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            subject_type VARCHAR(10) NOT NULL,
+            subject_id VARCHAR(100) NOT NULL,
+            author VARCHAR(100) NOT NULL,
+            body TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_subject (subject_type, subject_id, created_at)
+        )`,
+        `CREATE TABLE IF NOT EXISTS rates (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            trunk VARCHAR(100) NOT NULL,
+            prefix VARCHAR(50) NOT NULL,
+            per_minute DECIMAL(12,6) NOT NULL,
+            currency CHAR(3) NOT NULL,
+            initial_increment INT NOT NULL DEFAULT 60,
+            billing_increment INT NOT NULL DEFAULT 60,
+            effective_from DATETIME NOT NULL,
+            effective_to DATETIME NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_trunk_prefix (trunk, prefix, effective_from)
+        )`,
+        `CREATE TABLE IF NOT EXISTS ani_reputation (
+            ani VARCHAR(50) PRIMARY KEY,
+            score DOUBLE NOT NULL,
+            calls DOUBLE NOT NULL DEFAULT 0,
+            completed DOUBLE NOT NULL DEFAULT 0,
+            avg_duration DOUBLE NOT NULL DEFAULT 0,
+            complaints DOUBLE NOT NULL DEFAULT 0,
             updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-            INDEX idx_in_use (in_use)
+            INDEX idx_score (score)
+        )`,
+        `CREATE TABLE IF NOT EXISTS ani_complaints (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            ani VARCHAR(50) NOT NULL,
+            reason VARCHAR(255),
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            INDEX idx_ani (ani, created_at)
+        )`,
+        `CREATE TABLE IF NOT EXISTS call_events (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            call_id VARCHAR(100) NOT NULL,
+            event VARCHAR(20) NOT NULL,
+            at TIMESTAMP(3) NOT NULL,
+            detail VARCHAR(255),
+            request_id VARCHAR(128),
+            INDEX idx_call (call_id, at)
+        )`,
+        `CREATE TABLE IF NOT EXISTS cdrs (
+            call_id VARCHAR(100) PRIMARY KEY,
+            seq BIGINT UNSIGNED NOT NULL,
+            node VARCHAR(100) NOT NULL,
+            ani VARCHAR(50),
+            dnis VARCHAR(50),
+            did VARCHAR(50),
+            status VARCHAR(50) NOT NULL,
+            start_time TIMESTAMP(3) NOT NULL,
+            end_time TIMESTAMP(3) NOT NULL,
+            duration INT NOT NULL,
+            hangup_cause VARCHAR(10),
+            end_source VARCHAR(20),
+            campaign_id VARCHAR(100),
+            tenant_id VARCHAR(100),
+            settlement_class VARCHAR(50),
+            forward_trunk VARCHAR(100),
+            dest_country VARCHAR(2),
+            dest_region VARCHAR(100),
+            dest_type VARCHAR(20),
+            INDEX idx_end (end_time),
+            INDEX idx_node_seq (node, seq)
         )`,
     }
-    
-    for _, query := range queries {
+}
+
+func createTables(db *sql.DB) error {
+    for _, query := range schemaDDL() {
         if _, err := db.Exec(query); err != nil {
             return err
         }
     }
     
+    // Columns added after the initial schema, for databases created by older versions
+    columns := []struct{ table, column, definition string }{
+        {"call_records", "match_token", "VARCHAR(20), ADD INDEX idx_match_token (match_token)"},
+        {"call_records", "updated_at", "TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+        {"call_records", "settlement_class", "VARCHAR(50), ADD INDEX idx_settlement_class (settlement_class)"},
+        {"call_records", "tags", "JSON"},
+        {"dids", "tags", "JSON"},
+        {"call_records", "campaign_id", "VARCHAR(64), ADD INDEX idx_campaign (campaign_id, start_time)"},
+        {"call_records", "forward_trunk", "VARCHAR(100)"},
+        {"call_records", "tenant_id", "VARCHAR(64)"},
+        {"call_records", "trace_parent", "VARCHAR(64)"},
+        {"call_records", "hangup_cause", "VARCHAR(8)"},
+        {"dids", "tenant_id", "VARCHAR(64) NOT NULL DEFAULT '', ADD INDEX idx_tenant_free (tenant_id, in_use)"},
+        {"dids", "last_used_at", "TIMESTAMP NULL, ADD INDEX idx_tenant_lru (tenant_id, in_use, last_used_at), ADD INDEX idx_tenant_rr (tenant_id, in_use, did)"},
+        {"dids", "last_released_at", "TIMESTAMP(3) NULL"},
+        {"dids", "quarantined_until", "TIMESTAMP(3) NULL"},
+        {"dids", "quarantine_reason", "VARCHAR(255)"},
+        {"dids", "pool", "VARCHAR(64) NOT NULL DEFAULT '', ADD INDEX idx_pool_free (tenant_id, pool, in_use, country)"},
+        {"rates", "initial_increment", "INT NOT NULL DEFAULT 60"},
+        {"rates", "billing_increment", "INT NOT NULL DEFAULT 60"},
+        {"call_events", "request_id", "VARCHAR(128)"},
+        {"tenants", "reservation_ttl", "INT NOT NULL DEFAULT 0"},
+        {"tenants", "stale_timeout", "INT NOT NULL DEFAULT 0"},
+        {"tenants", "max_duration", "INT NOT NULL DEFAULT 0"},
+        {"tenants", "priority", "INT NOT NULL DEFAULT 0"},
+        {"call_records", "dest_country", "VARCHAR(2), ADD INDEX idx_destination (start_time, dest_country)"},
+        {"call_records", "dest_region", "VARCHAR(100)"},
+        {"call_records", "dest_type", "VARCHAR(20)"},
+    }
+    for _, c := range columns {
+        if err := addColumnIfMissing(db, c.table, c.column, c.definition); err != nil {
+            return err
+        }
+    }
+    
     return nil
 }
 
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+    var count int
+    err := db.QueryRow(`
+        SELECT COUNT(*) FROM information_schema.COLUMNS
+        WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+    `, table, column).Scan(&count)
+    if err != nil || count > 0 {
+        return err
+    }
+    
+    logger.Infof("Adding column %s.%s", table, column)
+    _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+    return err
+}
+
+// IncomingOptions carries optional attributes supplied by S1 with a new call
+type IncomingOptions struct {
+    Tags        map[string]string
+    Campaign    string
+    Domain      string // SIP domain the call arrived on, selects the tenant
+    Pool        string // DID pool to allocate from; "" maps the DNIS through PoolPrefixes
+    Source      string // upstream S1 node, picks its DID partition when the pool is partitioned
+    TraceParent string // W3C traceparent of S1's span
+    Baggage     string // W3C baggage from S1, passed on to S3
+}
+
+// ReturnOptions carries optional attributes supplied with a call back from S3
+type ReturnOptions struct {
+    Token       string // match token; when empty it may still be decoded from the DID
+    TraceParent string // W3C traceparent of S3's span, "" continues the forward leg's trace
+    Baggage     string
+}
+
 // ProcessIncomingCall handles initial calls from S1 (Step 1 -> Step 2)
-func (r *Router) ProcessIncomingCall(callID, ani, dnis string) (*models.CallResponse, error) {
+func (r *Router) ProcessIncomingCall(ctx context.Context, callID, ani, dnis string, opts IncomingOptions) (response *models.CallResponse, err error) {
+    received := r.clock.Now()
+    span := r.tracer.Start("s2.route_incoming", opts.TraceParent)
+    defer func() {
+        finishSpan(span, "incoming", response, opts.Baggage, err)
+        r.observeRouting(span.Elapsed(), err)
+    }()
+    
+    // The CallID is the correlation key from here on: records, events,
+    // webhooks, traces and the response S1 gets back
+    if callID == "" {
+        if r.ids == nil {
+            return nil, ErrMissingCallID
+        }
+        callID = r.ids.NewID()
+        logger.Call(callID, "", ani).Context(ctx).Infof("Issued CallID %s", callID)
+    }
+    if ani, err = r.normalizeNumber("ani", ani); err != nil {
+        return nil, err
+    }
+    if ani, err = r.toE164("ani", ani); err != nil {
+        return nil, err
+    }
+    if dnis, err = r.normalizeNumber("dnis", dnis); err != nil {
+        return nil, err
+    }
+    if dnis, err = r.toE164("dnis", dnis); err != nil {
+        return nil, err
+    }
+    clog := logger.Call(callID, "", ani).Context(ctx)
+    span.SetAttr("call.id", callID)
+    span.SetAttr("call.ani", ani)
+    span.SetAttr("call.dnis", dnis)
+    
+    if r.config.ReadOnly {
+        return nil, ErrReadOnly
+    }
+    if r.Draining() {
+        return nil, ErrDraining
+    }
+    if err := r.checkCPS(); err != nil {
+        clog.Warnf("Rejecting call %s: %v", callID, err)
+        return nil, err
+    }
+    if err := ValidateTags(opts.Tags); err != nil {
+        return nil, err
+    }
+    if len(opts.Pool) > maxPoolLen {
+        return nil, fmt.Errorf("%w: pool must be at most %d characters", ErrInvalidPool, maxPoolLen)
+    }
+    if len(opts.Source) > maxSourceLen {
+        return nil, fmt.Errorf("%w: source must be at most %d characters", ErrInvalidSource, maxSourceLen)
+    }
+    if err := r.checkBlocklist(callID, ani, dnis); err != nil {
+        return nil, err
+    }
+    if r.stateless() {
+        return r.statelessForward(callID, ani, dnis, opts)
+    }
+    
+    // The call's writes stay in order without holding r.mu across them
+    unlock := r.calls.lock(callID)
+    defer unlock()
+    
     r.mu.Lock()
-    defer r.mu.Unlock()
+    locked := true
+    defer func() {
+        if locked {
+            r.mu.Unlock()
+        }
+    }()
+    
+    clog.Debugf("=== STEP 1->2: Processing incoming call ===")
+    clog.Debugf("CallID: %s, ANI-1: %s, DNIS-1: %s", callID, ani, dnis)
+    
+    // SIP forks/retransmits through S1 reuse the call already in flight,
+    // or wait for the one still being admitted
+    for {
+        if original := r.findDuplicate(ani, dnis); original != nil {
+            clog.Infof("Duplicate of call %s within dedup window, reusing DID %s",
+                original.CallID, original.AssignedDID)
+            return r.forwardResponse(original), nil
+        }
+        pending := r.admitting(ani, dnis)
+        if pending == nil {
+            break
+        }
+        if err := r.awaitAdmission(ctx, pending); err != nil {
+            return nil, err
+        }
+    }
+    if r.draining {
+        return nil, ErrDraining
+    }
     
-    log.Printf("[ROUTER] === STEP 1->2: Processing incoming call ===")
-    log.Printf("[ROUTER] CallID: %s, ANI-1: %s, DNIS-1: %s", callID, ani, dnis)
+    if err := r.checkConcurrency(); err != nil {
+        clog.Warnf("Rejecting call %s: %v", callID, err)
+        return nil, err
+    }
+    
+    tenant, err := r.tenantForDomain(opts.Domain)
+    if err != nil {
+        clog.Warnf("Rejecting call %s: %v", callID, err)
+        return nil, err
+    }
     
-    // Get available DID
-    did, err := r.getAvailableDID()
+    // Don't hammer a destination that keeps failing hard
+    forwardTrunk, err := r.routeAroundFailures(r.forwardTrunkFor(tenant, ani, dnis), dnis)
+    if err != nil {
+        clog.Warnf("Rejecting call %s: %v", callID, err)
+        return nil, err
+    }
+    
+    if err := r.checkCampaign(opts.Campaign); err != nil {
+        clog.Warnf("Rejecting call %s: %v", callID, err)
+        return nil, err
+    }
+    pacing, err := r.checkCarrier(forwardTrunk)
     if err != nil {
-        log.Printf("[ROUTER] Failed to get available DID: %v", err)
+        clog.Warnf("Rejecting call %s: %v", callID, err)
         return nil, err
     }
     
-    // Mark DID as in use
-    if err := r.markDIDInUse(did, dnis); err != nil {
-        log.Printf("[ROUTER] Failed to mark DID in use: %v", err)
+    // Admitted: the database work below runs without r.mu
+    adm := r.admit(callID, ani, dnis, opts.Campaign)
+    r.mu.Unlock()
+    locked = false
+    defer func() {
+        r.mu.Lock()
+        r.settle(adm)
+        r.mu.Unlock()
+    }()
+    
+    pool := opts.Pool
+    if pool == "" {
+        pool = r.pools.lookup(dnis)
+    }
+    
+    // Claim an available DID
+    filter := DIDFilter{Tenant: tenantID(tenant), Pool: pool, Country: r.countryOf(ani, dnis)}
+    if partition, ok := r.partitionFor(opts.Source); ok {
+        filter.Partitions, filter.Partition = r.config.S1Partitions, partition
+    }
+    did, err := r.allocateDID(ctx, dnis, filter)
+    if errors.Is(err, ErrNoAvailableDIDs) && r.config.DIDWait > 0 {
+        clog.Infof("No DID free for call %s, waiting up to %s for one", callID, r.config.DIDWait)
+        did, err = r.awaitDID(ctx, dnis, filter, tenant)
+    }
+    if err != nil {
+        if errors.Is(err, ErrNoAvailableDIDs) && r.config.Overflow != OverflowFail {
+            return r.overflowResponse(ctx, callID, ani, dnis, tenant, err), nil
+        }
+        clog.Errorf("Failed to allocate DID: %v", err)
         return nil, err
     }
+    clog = logger.Call(callID, did, ani).Context(ctx)
+    assigned := r.clock.Now()
+    
+    var didTags map[string]string
+    if !r.breaker.inMemory() { // the snapshot has no tags; don't wait on MySQL
+        if didTags, err = r.DIDTags(ctx, did); err != nil {
+            clog.Errorf("Failed to load tags for DID %s: %v", did, err)
+        }
+    }
     
     // Create call record
     record := &models.CallRecord{
@@ -131,89 +1151,183 @@ func (r *Router) ProcessIncomingCall(callID, ani, dnis string) (*models.CallResp
         OriginalDNIS: dnis,
         AssignedDID:  did,
         Status:       models.CallStateActive,
-        StartTime:    time.Now(),
-        RecordingPath: fmt.Sprintf("%s/%s.wav", r.recordingPath, callID),
+        StartTime:    r.clock.Now(),
+        RecordingPath: r.recordingFor(callID),
+        SettlementClass: r.classifyCall(dnis, r.trunkFor(legReturn, dnis, tenant)),
+        ForwardTrunk: forwardTrunk,
+        Tags:         callTags(opts.Tags, didTags),
+        Campaign:     opts.Campaign,
+        Tenant:       tenantID(tenant),
+        TraceParent:  span.Traceparent(),
+        Destination:  r.destinationOf(dnis),
     }
     
     // Store in memory
-    r.activeCallsMap[callID] = record
-    r.didToCallMap[did] = callID
+    r.mu.Lock()
+    if r.config.TokenMode != TokenOff {
+        record.MatchToken = r.newToken()
+    }
+    r.trackCall(record)
+    r.rememberIncoming(record)
+    r.settle(adm)
+    r.mu.Unlock()
     
     // Store in database
-    if err := r.storeCallRecord(record); err != nil {
-        log.Printf("[ROUTER] Failed to store call record: %v", err)
-    }
+    r.storeCallRecord(ctx, record)
+    r.recordCallEvent(ctx, callID, models.CallEventIncoming, received, "ani="+ani+" dnis="+dnis)
+    r.recordCallEvent(ctx, callID, models.CallEventDIDAssigned, assigned, did)
     
-    // According to workflow: ANI-2 = DNIS-1, DID is the new destination
-    response := &models.CallResponse{
-        Status:      "success",
-        DIDAssigned: did,
-        NextHop:     "trunk-s3",
-        ANIToSend:   dnis,      // DNIS-1 becomes ANI-2
-        DNISToSend:  did,       // DID becomes destination
-    }
+    response = r.forwardResponse(record)
+    response.PacingMs = pacingMillis(pacing)
     
-    log.Printf("[ROUTER] === TRANSFORMATION: ANI-1=%s, DNIS-1=%s -> ANI-2=%s, DID=%s ===", 
+    clog.Infof("=== TRANSFORMATION: ANI-1=%s, DNIS-1=%s -> ANI-2=%s, DID=%s ===", 
         ani, dnis, response.ANIToSend, response.DNISToSend)
     
     // Update status
-    r.updateCallStatus(callID, models.CallStateForwarded)
+    r.updateCallStatus(ctx, callID, models.CallStateForwarded)
+    r.recordCallEvent(ctx, callID, models.CallEventForwarded, r.clock.Now(), record.ForwardTrunk)
+    r.mu.Lock()
+    record.Status = models.CallStateForwarded
+    r.replicateCall(record)
+    r.notifyLive("added", record)
+    snapshot := copyCallRecord(record)
+    r.mu.Unlock()
+    r.shareCall(snapshot)
+    
+    r.publish(eventFor(ctx, "call.forwarded", snapshot, models.CallStateForwarded))
+    r.countAdmitted()
     
     return response, nil
 }
 
+// forwardResponse builds the S3-bound instructions for a call.
+// According to workflow: ANI-2 = DNIS-1, DID is the new destination
+func (r *Router) forwardResponse(record *models.CallRecord) *models.CallResponse {
+    dnis := EncodeToken(record.AssignedDID, record.MatchToken, r.config.TokenMode)
+    if record.MatchToken == "" {
+        // A token makes the DNIS a router code rather than a dialable number
+        dnis = r.formats.format(record.ForwardTrunk, dnis)
+    }
+    return r.applyCarrier(&models.CallResponse{
+        Status:      "success",
+        CallID:      record.CallID,
+        DIDAssigned: record.AssignedDID,
+        NextHop:     record.ForwardTrunk,
+        ANIToSend:   r.formats.format(record.ForwardTrunk, record.OriginalDNIS),  // DNIS-1 becomes ANI-2
+        DNISToSend:  dnis,  // DID becomes destination
+        MatchToken:  record.MatchToken,
+        Recording:   record.RecordingPath,
+        Cost:        r.costEstimate(record.ForwardTrunk, record.OriginalDNIS, record.StartTime),
+    })
+}
+
 // ProcessReturnCall handles calls returning from S3 (Step 3 -> Step 4)
-func (r *Router) ProcessReturnCall(ani2, did string) (*models.CallResponse, error) {
-    r.mu.Lock()
-    defer r.mu.Unlock()
+func (r *Router) ProcessReturnCall(ctx context.Context, ani2, did string, opts ReturnOptions) (response *models.CallResponse, err error) {
+    span := r.tracer.Start("s2.route_return", opts.TraceParent)
+    span.SetAttr("call.ani2", ani2)
+    span.SetAttr("call.did", did)
+    defer func() {
+        finishSpan(span, "return", response, opts.Baggage, err)
+        r.observeRouting(span.Elapsed(), err)
+    }()
     
-    log.Printf("[ROUTER] === STEP 3->4: Processing return call ===")
-    log.Printf("[ROUTER] ANI-2: %s, DID: %s", ani2, did)
+    if r.config.ReadOnly {
+        return nil, ErrReadOnly
+    }
+    if ani2, err = r.normalizeNumber("ani2", ani2); err != nil {
+        return nil, err
+    }
+    if ani2, err = r.toE164("ani2", ani2); err != nil {
+        return nil, err
+    }
+    if did, err = r.normalizeNumber("did", did); err != nil {
+        return nil, err
+    }
+    if did, err = r.toE164("did", did); err != nil {
+        return nil, err
+    }
+    if r.stateless() {
+        return r.statelessReturn(ani2, did)
+    }
     
-    // Clean DID string (remove any newlines or spaces)
-    did = cleanString(did)
-    ani2 = cleanString(ani2)
+    logger.Call("", did, ani2).Context(ctx).Debugf("=== STEP 3->4: Processing return call ===")
+    logger.Call("", did, ani2).Context(ctx).Debugf("ANI-2: %s, DID: %s, Token: %s", ani2, did, opts.Token)
     
-    // Find call by DID
-    callID, exists := r.didToCallMap[did]
-    if !exists {
-        log.Printf("[ROUTER] DID %s not found in memory, checking database", did)
-        // Try to find in database
-        record, err := r.getCallRecordByDID(did)
-        if err != nil {
-            log.Printf("[ROUTER] No record found for DID %s: %v", did, err)
-            return nil, fmt.Errorf("no active call for DID %s", did)
+    token := cleanString(opts.Token)
+    
+    // A match token carried back by S3 identifies the call even if the DID was reused
+    if token == "" && r.config.TokenMode != TokenOff {
+        if plainDID, decoded, ok := DecodeToken(did, r.config.TokenMode, r.config.TokenDigits); ok {
+            did, token = plainDID, decoded
         }
-        callID = record.CallID
-        // Restore to memory
-        r.activeCallsMap[callID] = record
-        r.didToCallMap[did] = callID
-        log.Printf("[ROUTER] Restored call %s from database", callID)
     }
     
+    var callID string
+    if token != "" {
+        callID, err = r.findCallByToken(ctx, token)
+    } else {
+        callID, err = r.findCallByDID(ctx, did)
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    unlock := r.calls.lock(callID)
+    defer unlock()
+    
     // Get call record
+    r.mu.RLock()
     record, exists := r.activeCallsMap[callID]
+    r.mu.RUnlock()
     if !exists {
-        return nil, fmt.Errorf("call record not found for callID %s", callID)
+        return nil, fmt.Errorf("%w: call record for %s is gone", ErrCallNotFound, callID)
+    }
+    
+    // Without context from S3 the leg still joins the forward leg's trace
+    span.Adopt(record.TraceParent)
+    span.SetAttr("call.id", callID)
+    clog := callLogger(ctx, record)
+    
+    if token != "" && did != record.AssignedDID {
+        clog.Warnf("Token %s belongs to DID %s, got %s", token, record.AssignedDID, did)
     }
     
     // Verify ANI-2 matches original DNIS-1
-    if ani2 != record.OriginalDNIS {
-        log.Printf("[ROUTER] WARNING: ANI mismatch - expected %s, got %s", record.OriginalDNIS, ani2)
+    if err := r.checkReturnANI(ctx, record, ani2, did); err != nil {
+        return nil, err
     }
     
+    nextHop := r.trunkFor(legReturn, record.OriginalDNIS, r.tenantByID(record.Tenant))
+    
     // Update status
-    r.updateCallStatus(callID, models.CallStateReturned)
+    r.mu.Lock()
+    if r.activeCallsMap[callID] != record {
+        r.mu.Unlock()
+        return nil, fmt.Errorf("%w: call %s ended meanwhile", ErrCallNotFound, callID)
+    }
+    record.Status = models.CallStateReturned
+    r.replicateCall(record)
+    r.notifyLive("updated", record)
+    snapshot := copyCallRecord(record)
+    r.mu.Unlock()
+    
+    r.updateCallStatus(ctx, callID, models.CallStateReturned)
+    r.recordCallEvent(ctx, callID, models.CallEventReturned, r.clock.Now(), "ani2="+ani2+" did="+did+" trunk="+nextHop)
+    r.shareCall(snapshot)
+    
+    r.publish(eventFor(ctx, "call.returned", snapshot, models.CallStateReturned))
     
     // Return original ANI and DNIS for forwarding to S4
-    response := &models.CallResponse{
+    response = &models.CallResponse{
         Status:     "success",
-        NextHop:    "trunk-s4",
-        ANIToSend:  record.OriginalANI,   // Restore original ANI-1
-        DNISToSend: record.OriginalDNIS,  // Restore original DNIS-1
+        CallID:     record.CallID,
+        NextHop:    nextHop,
+        ANIToSend:  r.formats.format(nextHop, record.OriginalANI),   // Restore original ANI-1
+        DNISToSend: r.formats.format(nextHop, record.OriginalDNIS),  // Restore original DNIS-1
     }
+    r.applyCarrier(response)
     
-    log.Printf("[ROUTER] === RESTORATION: ANI-2=%s, DID=%s -> ANI-1=%s, DNIS-1=%s ===", 
+    clog.Infof("=== RESTORATION: ANI-2=%s, DID=%s -> ANI-1=%s, DNIS-1=%s ===", 
         ani2, did, response.ANIToSend, response.DNISToSend)
     
     return response, nil
@@ -221,202 +1335,157 @@ func (r *Router) ProcessReturnCall(ani2, did string) (*models.CallResponse, erro
 
 // Helper methods
 
-func (r *Router) getAvailableDID() (string, error) {
-    query := `
-        SELECT did FROM dids 
-        WHERE in_use = 0 
-        ORDER BY RAND() 
-        LIMIT 1
-        FOR UPDATE
-    `
-    
-    var did string
-    err := r.db.QueryRow(query).Scan(&did)
-    if err != nil {
-        return "", fmt.Errorf("no available DIDs: %v", err)
+// findCallByDID resolves the call holding a DID, falling back to the database
+// A DID formatted for the forward trunk may come back in that format; the
+// other spellings are tried after the number as received. Caller must not
+// hold r.mu.
+func (r *Router) findCallByDID(ctx context.Context, did string) (string, error) {
+    callID, err := r.lookupCallByDID(ctx, did)
+    for _, v := range r.formats.variants(did) {
+        if err == nil {
+            break
+        }
+        callID, err = r.lookupCallByDID(ctx, v)
     }
-    
-    return did, nil
+    return callID, err
 }
 
-func (r *Router) markDIDInUse(did, destination string) error {
-    query := `
-        UPDATE dids 
-        SET in_use = 1, destination = ?, updated_at = NOW()
-        WHERE did = ?
-    `
-    
-    result, err := r.db.Exec(query, destination, did)
-    if err != nil {
-        return err
+func (r *Router) lookupCallByDID(ctx context.Context, did string) (string, error) {
+    r.mu.RLock()
+    callID, exists := r.didToCallMap[did]
+    r.mu.RUnlock()
+    if exists {
+        return callID, nil
     }
     
-    rows, _ := result.RowsAffected()
-    if rows == 0 {
-        return fmt.Errorf("DID not found: %s", did)
+    // Another router may have taken the forward leg
+    if record := r.sharedCallBy("did", did); record != nil {
+        callLogger(ctx, record).Infof("Restored call %s from shared state", record.CallID)
+        return r.restoreCall(record), nil
     }
     
-    return nil
-}
-
-func (r *Router) releaseDID(did string) error {
-    query := `
-        UPDATE dids 
-        SET in_use = 0, destination = NULL, updated_at = NOW()
-        WHERE did = ?
-    `
-    
-    _, err := r.db.Exec(query, did)
-    return err
-}
-
-func (r *Router) storeCallRecord(record *models.CallRecord) error {
-    query := `
-        INSERT INTO call_records 
-        (call_id, original_ani, original_dnis, assigned_did, status, start_time, recording_path)
-        VALUES (?, ?, ?, ?, ?, ?, ?)
-        ON DUPLICATE KEY UPDATE
-        status = VALUES(status),
-        assigned_did = VALUES(assigned_did),
-        updated_at = NOW()
-    `
-    
-    _, err := r.db.Exec(query, 
-        record.CallID, 
-        record.OriginalANI, 
-        record.OriginalDNIS,
-        record.AssignedDID, 
-        record.Status, 
-        record.StartTime,
-        record.RecordingPath,
-    )
+    logger.Call("", did, "").Context(ctx).Debugf("DID %s not found in memory, checking database", did)
+    // Try to find in database
+    record, err := r.store.CallRecordByDID(ctx, did)
+    if err == sql.ErrNoRows {
+        logger.Call("", did, "").Context(ctx).Warnf("No record found for DID %s", did)
+        return "", fmt.Errorf("%w for DID %s", ErrCallNotFound, did)
+    }
+    if err != nil {
+        logger.Call("", did, "").Context(ctx).Warnf("Error looking up DID %s: %v", did, err)
+        return "", fmt.Errorf("looking up DID %s: %w", did, err)
+    }
     
-    return err
+    // Restore to memory
+    callLogger(ctx, record).Infof("Restored call %s from database", record.CallID)
+    return r.restoreCall(record), nil
 }
 
-func (r *Router) updateCallStatus(callID string, status models.CallState) error {
-    query := `
-        UPDATE call_records 
-        SET status = ?, 
-            end_time = CASE WHEN ? IN ('COMPLETED_AT_S4', 'FAILED') THEN NOW() ELSE end_time END,
-            duration = CASE WHEN ? IN ('COMPLETED_AT_S4', 'FAILED') THEN TIMESTAMPDIFF(SECOND, start_time, NOW()) ELSE duration END
-        WHERE call_id = ?
-    `
-    
-    _, err := r.db.Exec(query, status, status, status, callID)
-    return err
+// restoreCall tracks a call loaded from shared state or the database,
+// unless a lookup running alongside already did
+func (r *Router) restoreCall(record *models.CallRecord) string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, tracked := r.activeCallsMap[record.CallID]; !tracked {
+        r.trackCall(record)
+    }
+    return record.CallID
 }
 
-func (r *Router) getCallRecordByDID(did string) (*models.CallRecord, error) {
-    query := `
-        SELECT call_id, original_ani, original_dnis, assigned_did, status, start_time, recording_path
-        FROM call_records
-        WHERE assigned_did = ? 
-        AND status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
-        AND start_time > DATE_SUB(NOW(), INTERVAL 5 MINUTE)
-        ORDER BY start_time DESC
-        LIMIT 1
-    `
-    
-    record := &models.CallRecord{}
-    err := r.db.QueryRow(query, did).Scan(
-        &record.CallID,
-        &record.OriginalANI,
-        &record.OriginalDNIS,
-        &record.AssignedDID,
-        &record.Status,
-        &record.StartTime,
-        &record.RecordingPath,
-    )
-    
-    if err != nil {
-        return nil, err
+// trackCall adds a record to the in-memory indexes. Caller must hold r.mu.
+func (r *Router) trackCall(record *models.CallRecord) {
+    r.activeCallsMap[record.CallID] = record
+    r.didToCallMap[record.AssignedDID] = record.CallID
+    if record.MatchToken != "" {
+        r.tokenToCall[record.MatchToken] = record.CallID
     }
-    
-    return record, nil
 }
 
-func (r *Router) restoreActiveCalls() error {
-    query := `
-        SELECT call_id, original_ani, original_dnis, assigned_did, status, start_time, recording_path
-        FROM call_records
-        WHERE status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
-        AND start_time > DATE_SUB(NOW(), INTERVAL 5 MINUTE)
-    `
-    
-    rows, err := r.db.Query(query)
-    if err != nil {
-        return err
-    }
-    defer rows.Close()
-    
-    count := 0
-    for rows.Next() {
-        record := &models.CallRecord{}
-        err := rows.Scan(
-            &record.CallID,
-            &record.OriginalANI,
-            &record.OriginalDNIS,
-            &record.AssignedDID,
-            &record.Status,
-            &record.StartTime,
-            &record.RecordingPath,
-        )
-        
+// Attempts at claiming a free DID before giving up; each attempt only fails
+// when another call claimed the same candidate in between
+const didClaimAttempts = 5
+
+// allocateDID atomically claims a free DID matching f for destination,
+// preferring f.Country and falling back to any country once it runs out.
+// The claim is a conditional UPDATE, so two requests racing for the same
+// DID - in this process or on another router sharing the database -
+// cannot both win it.
+func (r *Router) allocateDID(ctx context.Context, destination string, f DIDFilter) (string, error) {
+    selector := r.selection.forPool(f.Tenant)
+    country := f.Country
+    for attempt := 0; attempt < didClaimAttempts; attempt++ {
+        did, err := selector.next(ctx, r.store, f, attempt)
+        if err == sql.ErrNoRows && f.Country != "" {
+            // No DID of the caller's country left; take any from the pool
+            f.Country = ""
+            did, err = selector.next(ctx, r.store, f, attempt)
+        }
+        if err == sql.ErrNoRows && f.Partitions > 0 {
+            // Range numbers are random and would leave the partition
+            return "", fmt.Errorf("%w in partition %d", ErrNoAvailableDIDs, f.Partition)
+        }
+        if err == sql.ErrNoRows && f.Pool == "" && !r.callPathOnly {
+            // Pool exhausted; create a number from a range if one is defined
+            if did, rangeErr := r.materializeFromRange(ctx, destination, f.Tenant); rangeErr == nil {
+                if country != "" {
+                    r.countMatch(country, false)
+                }
+                return did, nil
+            }
+        }
+        if err == sql.ErrNoRows && f.Pool != "" {
+            return "", fmt.Errorf("%w in pool %s", ErrNoAvailableDIDs, f.Pool)
+        }
+        if err == sql.ErrNoRows {
+            return "", ErrNoAvailableDIDs
+        }
         if err != nil {
-            log.Printf("[ROUTER] Error scanning record: %v", err)
-            continue
+            return "", fmt.Errorf("allocating DID: %w", err)
         }
         
-        r.activeCallsMap[record.CallID] = record
-        r.didToCallMap[record.AssignedDID] = record.CallID
-        count++
+        claimed, err := r.store.ClaimDID(ctx, did, destination)
+        if err != nil {
+            return "", err
+        }
+        if claimed {
+            if country != "" {
+                r.countMatch(country, f.Country != "")
+            }
+            return did, nil
+        }
+        logger.Call("", did, "").Context(ctx).Infof("DID %s was claimed concurrently, retrying", did)
     }
     
-    log.Printf("[ROUTER] Restored %d active calls from database", count)
-    return nil
+    return "", fmt.Errorf("%w: lost %d claim races", ErrNoAvailableDIDs, didClaimAttempts)
 }
 
-func (r *Router) cleanupRoutine() {
-    ticker := time.NewTicker(30 * time.Second)
-    defer ticker.Stop()
+func (r *Router) restoreActiveCalls() error {
+    records, err := r.store.InFlightCallRecords(context.Background())
+    if err != nil {
+        logger.Errorf("Error scanning records: %v", err)
+    }
     
-    for range ticker.C {
-        r.cleanupStaleCalls()
+    for _, record := range records {
+        r.trackCall(record)
     }
+    
+    logger.Infof("Restored %d active calls from database", len(records))
+    return err
 }
 
-func (r *Router) cleanupStaleCalls() {
-    // Clean up calls older than 5 minutes
-    query := `
-        UPDATE call_records 
-        SET status = 'FAILED', end_time = NOW()
-        WHERE status IN ('ACTIVE', 'FORWARDED_TO_S3')
-        AND start_time < DATE_SUB(NOW(), INTERVAL 5 MINUTE)
-    `
-    
-    result, err := r.db.Exec(query)
+func (r *Router) cleanupStaleCalls() error {
+    rows, err := r.store.FailStaleCalls(context.Background())
     if err != nil {
-        log.Printf("[ROUTER] Error cleaning up stale calls: %v", err)
-        return
+        logger.Errorf("Error cleaning up stale calls: %v", err)
+        return err
     }
-    
-    rows, _ := result.RowsAffected()
     if rows > 0 {
-        log.Printf("[ROUTER] Cleaned up %d stale calls", rows)
-        
-        // Release DIDs
-        r.db.Exec(`
-            UPDATE dids d
-            INNER JOIN call_records cr ON d.did = cr.assigned_did
-            SET d.in_use = 0, d.destination = NULL
-            WHERE cr.status = 'FAILED'
-            AND cr.end_time > DATE_SUB(NOW(), INTERVAL 1 MINUTE)
-        `)
+        logger.Infof("Cleaned up %d stale calls", rows)
     }
+    return nil
 }
 
-func (r *Router) GetStatistics() (map[string]interface{}, error) {
+func (r *Router) GetStatistics(ctx context.Context) (map[string]interface{}, error) {
     r.mu.RLock()
     activeCalls := len(r.activeCallsMap)
     r.mu.RUnlock()
@@ -425,26 +1494,32 @@ func (r *Router) GetStatistics() (map[string]interface{}, error) {
     stats["active_calls"] = activeCalls
     
     // Get DID statistics
-    var totalDIDs, usedDIDs int
-    r.db.QueryRow("SELECT COUNT(*), SUM(CASE WHEN in_use = 1 THEN 1 ELSE 0 END) FROM dids").Scan(&totalDIDs, &usedDIDs)
+    totalDIDs, usedDIDs, _ := r.store.DIDCounts(ctx)
     
+    rangeDIDs := r.unmaterializedRangeDIDs(ctx)
     stats["total_dids"] = totalDIDs
     stats["used_dids"] = usedDIDs
-    stats["available_dids"] = totalDIDs - usedDIDs
+    stats["available_dids"] = int64(totalDIDs-usedDIDs) + rangeDIDs
+    stats["unmaterialized_range_dids"] = rangeDIDs
+    stats["did_wait_queue"] = r.didQueue.depth()
+    stats["state_writes_pending"] = r.writes.size()
+    if writeBehind := r.WriteBehindStatus(); writeBehind != nil {
+        stats["write_behind"] = writeBehind
+    }
+    if degraded := r.DegradedStatus(); degraded != nil {
+        stats["degraded"] = degraded
+    }
+    if archive := r.ArchiveStatus(); archive != nil {
+        stats["archive"] = archive
+    }
+    stats["maps"] = r.MapSizes()
     
     // Get call statistics
-    var todaysCalls, completedCalls int
-    r.db.QueryRow(`
-        SELECT 
-            COUNT(*),
-            SUM(CASE WHEN status = 'COMPLETED_AT_S4' THEN 1 ELSE 0 END)
-        FROM call_records 
-        WHERE DATE(start_time) = CURDATE()
-    `).Scan(&todaysCalls, &completedCalls)
+    todaysCalls, completedCalls, _ := r.store.CallCounts(ctx)
     
     stats["calls_today"] = todaysCalls
     stats["completed_calls"] = completedCalls
-    stats["timestamp"] = time.Now().Format(time.RFC3339)
+    stats["timestamp"] = r.clock.Now().Format(time.RFC3339)
     
     // Add memory call details
     var memoryDetails []map[string]interface{}
@@ -459,16 +1534,84 @@ func (r *Router) GetStatistics() (map[string]interface{}, error) {
     }
     r.mu.RUnlock()
     stats["memory_calls"] = memoryDetails
+    stats["shared_state"] = r.shared != nil
+    stats["recordings"] = r.RecordingUsage()
+    if replication := r.ReplicationStatus(); replication != nil {
+        stats["replication"] = replication
+    }
+    if v1 := r.V1DualWriteStatus(); v1 != nil {
+        stats["v1_dual_write"] = v1
+    }
+    if diagnostics := r.DiagnosticsStatus(); diagnostics != nil {
+        stats["diagnostics"] = diagnostics
+    }
+    if len(r.countries) > 0 || r.config.CountryFromNumberPlan {
+        stats["country_matching"] = r.CountryMatches()
+    }
+    
+    workers, healthy := r.WorkerHealth()
+    stats["workers"] = workers
+    stats["workers_healthy"] = healthy
     
     return stats, nil
 }
 
+// ReadOnly reports whether the router refuses writes
+func (r *Router) ReadOnly() bool {
+    return r.config.ReadOnly
+}
+
+// FeatureTables reports whether the storage backend has the feature
+// tables; without them only the call path and call history are served
+func (r *Router) FeatureTables() bool {
+    return !r.callPathOnly
+}
+
+// Close stops every background goroutine and waits for them before
+// releasing the database, so nothing outlives the router
 func (r *Router) Close() {
+    r.life.Stop()
+    if r.ami != nil {
+        r.ami.Close()
+    }
+    if err := r.life.Shutdown(closeTimeout); err != nil {
+        logger.Warnf("Background goroutines did not stop: %v", err)
+    }
+    if r.shared != nil {
+        r.shared.client.Close()
+    }
+    if r.v1 != nil {
+        r.v1.v1.Close()
+    }
+    r.flushWriteBehind()
+    if !r.config.ReadOnly {
+        r.abandonWrites()
+    }
     if r.db != nil {
         r.db.Close()
     }
 }
 
+// How long Close waits for workers and exports to return
+const closeTimeout = 10 * time.Second
+
+// Calls older than this without a terminal state are considered stale
+const staleCallAge = 5 * time.Minute
+
+// isInFlight reports whether a record is a live, non-stale call
+func (r *Router) isInFlight(record *models.CallRecord) bool {
+    switch record.Status {
+    case models.CallStateActive, models.CallStateForwarded, models.CallStateReturned:
+        return r.since(record.StartTime) < r.inFlightAge(record)
+    }
+    return false
+}
+
+// since is the time elapsed on the router's clock
+func (r *Router) since(t time.Time) time.Duration {
+    return clock.Since(r.clock, t)
+}
+
 // Utility function to clean strings
 func cleanString(s string) string {
     // Remove newlines, carriage returns, and extra spaces
@@ -0,0 +1,122 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+)
+
+// Rounds of calls hammer a small pool from many goroutines: every call of a
+// round arrives at once, more of them than there are DIDs, and holds what
+// it got until the round's calls come back from S3 and hang up together,
+// so released DIDs are claimed again while other calls race for them. A
+// DID must never be handed to two calls at once.
+func TestConcurrentCallsNeverShareDID(t *testing.T) {
+    const (
+        workers = 32
+        rounds  = 20
+        pool    = 8
+    )
+    store := newFakeStorage(fakeDIDs(pool)...)
+    r := newTestRouter(t, store, Config{})
+
+    // run starts fn on every worker at the same moment and waits for them
+    run := func(fn func(w int) error) {
+        start := make(chan struct{})
+        errs := make(chan error, workers)
+        var wg sync.WaitGroup
+        for w := 0; w < workers; w++ {
+            w := w
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                <-start
+                if err := fn(w); err != nil {
+                    errs <- err
+                }
+            }()
+        }
+        close(start)
+        wg.Wait()
+        close(errs)
+        for err := range errs {
+            t.Error(err)
+        }
+    }
+
+    handed := 0
+    for round := 0; round < rounds; round++ {
+        var mu sync.Mutex
+        holders := make(map[string]string) // DID -> call holding it
+        dids := make([]string, workers)
+        run(func(w int) error {
+            callID := fmt.Sprintf("race-%d-%d", round, w)
+            resp, err := r.ProcessIncomingCall(context.Background(), callID,
+                fmt.Sprintf("1212%03d%04d", round, w), fmt.Sprintf("4420%03d%04d", round, w), IncomingOptions{})
+            if errors.Is(err, ErrNoAvailableDIDs) {
+                return nil
+            }
+            if err != nil {
+                return fmt.Errorf("incoming %s: %w", callID, err)
+            }
+            mu.Lock()
+            defer mu.Unlock()
+            if other, held := holders[resp.DIDAssigned]; held {
+                return fmt.Errorf("DID %s handed to %s while %s holds it", resp.DIDAssigned, callID, other)
+            }
+            holders[resp.DIDAssigned] = callID
+            dids[w] = resp.DIDAssigned
+            return nil
+        })
+        if t.Failed() {
+            t.FailNow()
+        }
+        handed += len(holders)
+        for did, callID := range holders {
+            if !store.inUse(did) {
+                t.Fatalf("DID %s of %s is not marked in use", did, callID)
+            }
+        }
+
+        run(func(w int) error {
+            did := dids[w]
+            if did == "" {
+                return nil
+            }
+            callID := fmt.Sprintf("race-%d-%d", round, w)
+            back, err := r.ProcessReturnCall(context.Background(), fmt.Sprintf("4420%03d%04d", round, w), did, ReturnOptions{})
+            if err != nil {
+                return fmt.Errorf("return %s on %s: %w", callID, did, err)
+            }
+            if back.CallID != callID {
+                return fmt.Errorf("return on %s matched %s, want %s", did, back.CallID, callID)
+            }
+            if _, err := r.CompleteCall(context.Background(), callID, "16"); err != nil {
+                return fmt.Errorf("hangup %s: %w", callID, err)
+            }
+            return nil
+        })
+        if t.Failed() {
+            t.FailNow()
+        }
+    }
+    // Calls that lose didClaimAttempts races in a row give up, so not
+    // every round fills the pool
+    if handed < rounds {
+        t.Errorf("only %d calls got a DID in %d rounds", handed, rounds)
+    }
+
+    r.mu.RLock()
+    active := len(r.activeCallsMap)
+    r.mu.RUnlock()
+    if active != 0 {
+        t.Errorf("%d calls still active", active)
+    }
+    for _, did := range fakeDIDs(pool) {
+        if store.inUse(did) {
+            t.Errorf("DID %s still in use after every call ended", did)
+        }
+    }
+}
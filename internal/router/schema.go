@@ -0,0 +1,460 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// A DBA's manual change, a dropped index or a narrowed column, otherwise
+// only shows as slow queries or truncated values. The CREATE TABLE
+// statements of schemaDDL are the expected model: the live schema is
+// compared with them on startup and every SchemaCheckInterval, and drift
+// is logged once and reported by GET /api/schema. Extra columns and
+// indexes are reported but are not drift. With SchemaRepair the primary
+// applies the safe fixes itself.
+
+var schemaDrift = metrics.NewGauge("s2_schema_drift",
+    "Differences between the live database schema and the expected one, extra columns and indexes excluded")
+
+type schemaStatus struct {
+    mu    sync.Mutex
+    known map[string]bool // drift already logged
+}
+
+type schemaColumn struct {
+    name       string
+    definition string
+    typ        string // normalized, as compared with COLUMN_TYPE
+}
+
+type schemaIndex struct {
+    name    string
+    columns []string
+    unique  bool
+}
+
+type tableSchema struct {
+    name    string
+    ddl     string
+    columns []schemaColumn
+    indexes []schemaIndex
+}
+
+type liveTable struct {
+    columns []string // in table order
+    types   map[string]string
+    indexes map[string]*schemaIndex
+}
+
+func expectedSchema() []tableSchema {
+    ddls := schemaDDL()
+    tables := make([]tableSchema, 0, len(ddls))
+    for _, ddl := range ddls {
+        tables = append(tables, parseCreateTable(ddl))
+    }
+    return tables
+}
+
+// parseCreateTable reads the subset of CREATE TABLE that schemaDDL uses:
+// one column or index per item, inline PRIMARY KEY and UNIQUE. Inline keys
+// become indexes, so a column's definition can be reused in ALTER TABLE.
+func parseCreateTable(ddl string) tableSchema {
+    open, end := strings.Index(ddl, "("), strings.LastIndex(ddl, ")")
+    head := strings.Fields(ddl[:open])
+    t := tableSchema{name: head[len(head)-1], ddl: strings.Join(strings.Fields(ddl), " ")}
+
+    for _, item := range splitTopLevel(ddl[open+1 : end]) {
+        upper := strings.ToUpper(item)
+        switch {
+        case strings.HasPrefix(upper, "PRIMARY KEY"):
+            t.indexes = append(t.indexes, schemaIndex{name: "PRIMARY", columns: indexColumns(item), unique: true})
+        case strings.HasPrefix(upper, "UNIQUE KEY "), strings.HasPrefix(upper, "UNIQUE INDEX "):
+            t.indexes = append(t.indexes, schemaIndex{name: indexName(item, 2), columns: indexColumns(item), unique: true})
+        case strings.HasPrefix(upper, "INDEX "), strings.HasPrefix(upper, "KEY "):
+            t.indexes = append(t.indexes, schemaIndex{name: indexName(item, 1), columns: indexColumns(item)})
+        default:
+            words := strings.Fields(item)
+            col := schemaColumn{name: words[0], definition: strings.TrimSpace(item[len(words[0]):])}
+            col.typ = normalizeType(words[1])
+            if len(words) > 2 && strings.EqualFold(words[2], "UNSIGNED") {
+                col.typ += " unsigned"
+            }
+            switch {
+            case strings.Contains(upper, " PRIMARY KEY"):
+                t.indexes = append(t.indexes, schemaIndex{name: "PRIMARY", columns: []string{col.name}, unique: true})
+                col.definition = strings.Replace(col.definition, " PRIMARY KEY", "", 1)
+            case strings.Contains(upper+" ", " UNIQUE "):
+                // MySQL names an inline unique index after its column
+                t.indexes = append(t.indexes, schemaIndex{name: col.name, columns: []string{col.name}, unique: true})
+                col.definition = strings.Replace(col.definition, " UNIQUE", "", 1)
+            }
+            t.columns = append(t.columns, col)
+        }
+    }
+    return t
+}
+
+// splitTopLevel splits on the commas outside parentheses and quotes
+func splitTopLevel(s string) []string {
+    var items []string
+    depth, quoted, start := 0, false, 0
+    for i := 0; i < len(s); i++ {
+        switch c := s[i]; {
+        case c == '\'':
+            quoted = !quoted
+        case quoted:
+        case c == '(':
+            depth++
+        case c == ')':
+            depth--
+        case c == ',' && depth == 0:
+            items = append(items, s[start:i])
+            start = i + 1
+        }
+    }
+    items = append(items, s[start:])
+
+    out := items[:0]
+    for _, item := range items {
+        if item = strings.TrimSpace(item); item != "" {
+            out = append(out, item)
+        }
+    }
+    return out
+}
+
+// indexName returns the word after the first n keywords, e.g. n=2 for
+// UNIQUE KEY name (...)
+func indexName(item string, n int) string {
+    words := strings.Fields(item[:strings.Index(item, "(")])
+    if len(words) <= n {
+        return ""
+    }
+    return words[n]
+}
+
+func indexColumns(item string) []string {
+    inner := item[strings.Index(item, "(")+1 : strings.LastIndex(item, ")")]
+    var cols []string
+    for _, c := range strings.Split(inner, ",") {
+        cols = append(cols, strings.Trim(strings.TrimSpace(c), "`"))
+    }
+    return cols
+}
+
+var intTypes = map[string]int{"tinyint": 1, "smallint": 2, "mediumint": 3, "int": 4, "bigint": 5}
+
+// normalizeType maps a declared type and COLUMN_TYPE to one spelling:
+// BOOLEAN is tinyint(1), and integer display widths, which MySQL 8 no
+// longer shows, are dropped
+func normalizeType(t string) string {
+    t = strings.ToLower(strings.TrimSpace(t))
+    switch t {
+    case "boolean", "bool":
+        return "tinyint"
+    case "integer":
+        return "int"
+    }
+    base, suffix := t, ""
+    if i := strings.Index(t, " "); i > 0 {
+        base, suffix = t[:i], t[i:]
+    }
+    if i := strings.Index(base, "("); i > 0 && intTypes[base[:i]] > 0 {
+        base = base[:i]
+    }
+    return base + suffix
+}
+
+func typesMatch(expected, actual string) bool {
+    // MariaDB stores JSON as LONGTEXT
+    return expected == normalizeType(actual) || (expected == "json" && strings.EqualFold(actual, "longtext"))
+}
+
+// widens reports whether changing actual to expected loses no values: a
+// longer (var)char or a larger integer of the same signedness
+func widens(expected, actual string) bool {
+    actual = normalizeType(actual)
+    if eb, el, ok := typeLength(expected); ok {
+        ab, al, ok := typeLength(actual)
+        return ok && eb == ab && el > al
+    }
+    eb, es := splitUnsigned(expected)
+    ab, as := splitUnsigned(actual)
+    return es == as && intTypes[eb] > 0 && intTypes[ab] > 0 && intTypes[eb] > intTypes[ab]
+}
+
+func typeLength(t string) (base string, length int, ok bool) {
+    open := strings.Index(t, "(")
+    if open < 0 || !strings.HasSuffix(t, ")") {
+        return "", 0, false
+    }
+    base = t[:open]
+    if base != "varchar" && base != "char" {
+        return "", 0, false
+    }
+    n, err := strconv.Atoi(t[open+1 : len(t)-1])
+    return base, n, err == nil
+}
+
+func splitUnsigned(t string) (string, bool) {
+    if strings.HasSuffix(t, " unsigned") {
+        return strings.TrimSuffix(t, " unsigned"), true
+    }
+    return t, false
+}
+
+func (r *Router) liveSchema(ctx context.Context) (map[string]*liveTable, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+
+    tables := make(map[string]*liveTable)
+    table := func(name string) *liveTable {
+        t := tables[name]
+        if t == nil {
+            t = &liveTable{types: make(map[string]string), indexes: make(map[string]*schemaIndex)}
+            tables[name] = t
+        }
+        return t
+    }
+
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT TABLE_NAME, COLUMN_NAME, COLUMN_TYPE
+        FROM information_schema.COLUMNS
+        WHERE TABLE_SCHEMA = DATABASE()
+        ORDER BY TABLE_NAME, ORDINAL_POSITION
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var name, column, typ string
+        if err := rows.Scan(&name, &column, &typ); err != nil {
+            return nil, err
+        }
+        t := table(name)
+        t.columns = append(t.columns, column)
+        t.types[column] = typ
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    idx, err := r.db.QueryContext(ctx, `
+        SELECT TABLE_NAME, INDEX_NAME, NON_UNIQUE, COLUMN_NAME
+        FROM information_schema.STATISTICS
+        WHERE TABLE_SCHEMA = DATABASE()
+        ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer idx.Close()
+    for idx.Next() {
+        var name, index, column string
+        var nonUnique int
+        if err := idx.Scan(&name, &index, &nonUnique, &column); err != nil {
+            return nil, err
+        }
+        t := table(name)
+        i := t.indexes[index]
+        if i == nil {
+            i = &schemaIndex{name: index, unique: nonUnique == 0}
+            t.indexes[index] = i
+        }
+        i.columns = append(i.columns, column)
+    }
+    return tables, idx.Err()
+}
+
+// diffSchema lists what the live schema lacks or has different, then what
+// it has extra
+func diffSchema(expected []tableSchema, live map[string]*liveTable) []models.SchemaDrift {
+    drift := []models.SchemaDrift{}
+    for _, t := range expected {
+        lt := live[t.name]
+        if lt == nil {
+            drift = append(drift, models.SchemaDrift{Kind: "missing_table", Table: t.name, Fix: t.ddl, Safe: true})
+            continue
+        }
+
+        want := make(map[string]bool, len(t.columns))
+        for _, col := range t.columns {
+            want[col.name] = true
+            actual, ok := lt.types[col.name]
+            switch {
+            case !ok:
+                drift = append(drift, models.SchemaDrift{
+                    Kind: "missing_column", Table: t.name, Column: col.name, Expected: col.definition,
+                    Fix:  fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", t.name, col.name, col.definition),
+                    Safe: !strings.Contains(strings.ToUpper(col.definition), "AUTO_INCREMENT"),
+                })
+            case !typesMatch(col.typ, actual):
+                drift = append(drift, models.SchemaDrift{
+                    Kind: "wrong_type", Table: t.name, Column: col.name, Expected: col.typ, Actual: actual,
+                    Fix:  fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", t.name, col.name, col.definition),
+                    Safe: widens(col.typ, actual),
+                })
+            }
+        }
+
+        wantIndex := make(map[string]bool, len(t.indexes))
+        for _, idx := range t.indexes {
+            wantIndex[idx.name] = true
+            actual := lt.indexes[idx.name]
+            switch {
+            case actual == nil:
+                // A unique index fails on duplicates already there, so
+                // only plain indexes are added automatically
+                drift = append(drift, models.SchemaDrift{
+                    Kind: "missing_index", Table: t.name, Index: idx.name, Expected: describeIndex(&idx),
+                    Fix:  fmt.Sprintf("ALTER TABLE %s ADD %s", t.name, indexDefinition(&idx)),
+                    Safe: !idx.unique,
+                })
+            case describeIndex(actual) != describeIndex(&idx):
+                fix := fmt.Sprintf("ALTER TABLE %s DROP INDEX %s, ADD %s", t.name, idx.name, indexDefinition(&idx))
+                if idx.name == "PRIMARY" {
+                    fix = fmt.Sprintf("ALTER TABLE %s DROP PRIMARY KEY, ADD %s", t.name, indexDefinition(&idx))
+                }
+                drift = append(drift, models.SchemaDrift{
+                    Kind: "wrong_index", Table: t.name, Index: idx.name,
+                    Expected: describeIndex(&idx), Actual: describeIndex(actual), Fix: fix,
+                })
+            }
+        }
+
+        for _, col := range lt.columns {
+            if !want[col] {
+                drift = append(drift, models.SchemaDrift{Kind: "extra_column", Table: t.name, Column: col, Actual: lt.types[col]})
+            }
+        }
+        extra := make([]string, 0)
+        for name := range lt.indexes {
+            if !wantIndex[name] {
+                extra = append(extra, name)
+            }
+        }
+        sort.Strings(extra)
+        for _, name := range extra {
+            drift = append(drift, models.SchemaDrift{Kind: "extra_index", Table: t.name, Index: name, Actual: describeIndex(lt.indexes[name])})
+        }
+    }
+    return drift
+}
+
+func describeIndex(idx *schemaIndex) string {
+    s := "(" + strings.Join(idx.columns, ", ") + ")"
+    if idx.unique && idx.name != "PRIMARY" {
+        s = "unique " + s
+    }
+    return s
+}
+
+func indexDefinition(idx *schemaIndex) string {
+    cols := "(" + strings.Join(idx.columns, ", ") + ")"
+    switch {
+    case idx.name == "PRIMARY":
+        return "PRIMARY KEY " + cols
+    case idx.unique:
+        return "UNIQUE KEY " + idx.name + " " + cols
+    }
+    return "INDEX " + idx.name + " " + cols
+}
+
+func driftKey(d models.SchemaDrift) string {
+    return d.Kind + "|" + d.Table + "|" + d.Column + "|" + d.Index + "|" + d.Actual
+}
+
+// CheckSchema compares the live database with the expected schema, logging
+// drift not seen by the previous check
+func (r *Router) CheckSchema(ctx context.Context) (*models.SchemaReport, error) {
+    live, err := r.liveSchema(ctx)
+    if err != nil {
+        return nil, err
+    }
+    report := &models.SchemaReport{CheckedAt: r.clock.Now(), Drift: diffSchema(expectedSchema(), live)}
+
+    problems := 0
+    known := make(map[string]bool, len(report.Drift))
+    r.schema.mu.Lock()
+    for _, d := range report.Drift {
+        extra := strings.HasPrefix(d.Kind, "extra_")
+        if !extra {
+            problems++
+        }
+        key := driftKey(d)
+        known[key] = true
+        if r.schema.known[key] {
+            continue
+        }
+        name := d.Table
+        if d.Column != "" || d.Index != "" {
+            name += "." + d.Column + d.Index
+        }
+        if extra {
+            logger.Infof("Schema: %s %s (%s) is not in the expected schema", strings.TrimPrefix(d.Kind, "extra_"), name, d.Actual)
+        } else {
+            logger.Warnf("Schema drift: %s %s (expected %q, found %q); fix: %s", d.Kind, name, d.Expected, d.Actual, d.Fix)
+        }
+    }
+    r.schema.known = known
+    r.schema.mu.Unlock()
+
+    report.OK = problems == 0
+    schemaDrift.Set(float64(problems))
+    return report, nil
+}
+
+// RepairSchema applies the safe fixes of a fresh check and returns the
+// check after them. ALTER TABLE can take a while on a large table, so the
+// fixes are only bounded by ctx, not the query timeout.
+func (r *Router) RepairSchema(ctx context.Context) (*models.SchemaReport, error) {
+    if r.config.ReadOnly {
+        return nil, ErrReadOnly
+    }
+    report, err := r.CheckSchema(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    var repaired []models.SchemaDrift
+    for _, d := range report.Drift {
+        if !d.Safe || d.Fix == "" {
+            continue
+        }
+        if _, err := r.db.ExecContext(ctx, d.Fix); err != nil {
+            logger.Errorf("Schema fix failed: %s: %v", d.Fix, err)
+            continue
+        }
+        logger.Infof("Schema fix applied: %s", d.Fix)
+        repaired = append(repaired, d)
+    }
+    if len(repaired) == 0 {
+        return report, nil
+    }
+
+    report, err = r.CheckSchema(ctx)
+    if err != nil {
+        return nil, err
+    }
+    report.Repaired = repaired
+    return report, nil
+}
+
+// checkSchema is the startup check and the schema worker
+func (r *Router) checkSchema() error {
+    var err error
+    if r.config.SchemaRepair && !r.config.ReadOnly {
+        _, err = r.RepairSchema(context.Background())
+    } else {
+        _, err = r.CheckSchema(context.Background())
+    }
+    return err
+}
@@ -0,0 +1,112 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// DID selection strategies, chosen per pool with DIDSelection and
+// DIDSelectionPools
+const (
+    SelectRandom     = "random"
+    SelectLRU        = "lru"
+    SelectRoundRobin = "round-robin"
+)
+
+// didSelector decides which free DID of a pool is tried next. attempt
+// counts lost claim races so a retry can move past the contended number.
+type didSelector interface {
+    next(ctx context.Context, store Storage, f DIDFilter, attempt int) (string, error)
+}
+
+var didSelectors = map[string]func() didSelector{
+    SelectRandom:     func() didSelector { return randomSelector{} },
+    SelectLRU:        func() didSelector { return lruSelector{} },
+    SelectRoundRobin: func() didSelector { return &roundRobinSelector{cursor: make(map[string]string)} },
+}
+
+// DIDSelections lists the strategy names accepted in the config
+func DIDSelections() []string {
+    names := make([]string, 0, len(didSelectors))
+    for name := range didSelectors {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// randomSelector spreads calls evenly without keeping any state
+type randomSelector struct{}
+
+func (randomSelector) next(ctx context.Context, store Storage, f DIDFilter, attempt int) (string, error) {
+    return store.PickFreeDID(ctx, f)
+}
+
+// lruSelector rests every number as long as possible between calls, which
+// keeps carriers from flagging a DID that is reused back to back
+type lruSelector struct{}
+
+func (lruSelector) next(ctx context.Context, store Storage, f DIDFilter, attempt int) (string, error) {
+    return store.PickLeastRecentDID(ctx, f, attempt)
+}
+
+// roundRobinSelector walks each pool in number order. The cursor lives in
+// this router only; instances sharing a database each keep their own.
+type roundRobinSelector struct {
+    mu     sync.Mutex
+    cursor map[string]string // tenant/pool/country/partition -> last DID handed out
+}
+
+func (s *roundRobinSelector) next(ctx context.Context, store Storage, f DIDFilter, attempt int) (string, error) {
+    key := fmt.Sprintf("%s/%s/%s/%d", f.Tenant, f.Pool, f.Country, f.Partition)
+    s.mu.Lock()
+    after := s.cursor[key]
+    s.mu.Unlock()
+
+    did, err := store.PickFreeDIDAfter(ctx, f, after)
+    if err != nil {
+        return "", err
+    }
+    s.mu.Lock()
+    s.cursor[key] = did
+    s.mu.Unlock()
+    return did, nil
+}
+
+// didSelection holds the strategy of each pool
+type didSelection struct {
+    fallback didSelector
+    pools    map[string]didSelector // tenant ("" for the default pool) -> strategy
+}
+
+// newDIDSelection builds the strategies from the router config. pools
+// entries are "tenant=strategy"; use "=strategy" for the default pool.
+func newDIDSelection(strategy string, pools []string) (*didSelection, error) {
+    if strategy == "" {
+        strategy = SelectRandom
+    }
+    newSelector, ok := didSelectors[strategy]
+    if !ok {
+        return nil, fmt.Errorf("unknown DID selection %q (available: %s)", strategy, strings.Join(DIDSelections(), ", "))
+    }
+    sel := &didSelection{fallback: newSelector(), pools: make(map[string]didSelector)}
+    for _, entry := range pools {
+        tenant, name, ok := strings.Cut(entry, "=")
+        newSelector, known := didSelectors[strings.TrimSpace(name)]
+        if !ok || !known {
+            return nil, fmt.Errorf("invalid DID selection pool %q, expected tenant=%s", entry, strings.Join(DIDSelections(), "|"))
+        }
+        sel.pools[strings.TrimSpace(tenant)] = newSelector()
+    }
+    return sel, nil
+}
+
+func (s *didSelection) forPool(tenant string) didSelector {
+    if sel, ok := s.pools[tenant]; ok {
+        return sel
+    }
+    return s.fallback
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    settlementPrefix = "prefix"
+    settlementTrunk  = "trunk"
+
+    // Class recorded for calls no rule matches
+    settlementUnclassified = "unclassified"
+)
+
+// settlementRules caches the rule table for classification on the hot path
+type settlementRules struct {
+    mu    sync.RWMutex
+    rules []models.SettlementRule
+}
+
+// loadSettlementRules refreshes the cached rules from the database
+func (r *Router) loadSettlementRules() error {
+    rules, err := r.SettlementRules(context.Background())
+    if err != nil {
+        logger.Errorf("Error loading settlement rules: %v", err)
+        return err
+    }
+    r.settlement.mu.Lock()
+    r.settlement.rules = rules
+    r.settlement.mu.Unlock()
+    return nil
+}
+
+// classifyCall picks the settlement class for a destination and outbound
+// trunk. The longest matching prefix wins; trunk rules apply otherwise.
+func (r *Router) classifyCall(dnis, trunk string) string {
+    r.settlement.mu.RLock()
+    defer r.settlement.mu.RUnlock()
+
+    class := ""
+    longest := -1
+    for _, rule := range r.settlement.rules {
+        if rule.MatchType == settlementPrefix && strings.HasPrefix(dnis, rule.Pattern) && len(rule.Pattern) > longest {
+            class = rule.Class
+            longest = len(rule.Pattern)
+        }
+    }
+    if class != "" {
+        return class
+    }
+
+    for _, rule := range r.settlement.rules {
+        if rule.MatchType == settlementTrunk && rule.Pattern == trunk {
+            return rule.Class
+        }
+    }
+    return settlementUnclassified
+}
+
+// SettlementRules lists all rules
+func (r *Router) SettlementRules(ctx context.Context) ([]models.SettlementRule, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, match_type, pattern, class, created_at
+        FROM settlement_rules
+        ORDER BY match_type, pattern
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    rules := []models.SettlementRule{}
+    for rows.Next() {
+        var rule models.SettlementRule
+        if err := rows.Scan(&rule.ID, &rule.MatchType, &rule.Pattern, &rule.Class, &rule.CreatedAt); err != nil {
+            return nil, err
+        }
+        rules = append(rules, rule)
+    }
+    return rules, rows.Err()
+}
+
+// AddSettlementRule creates or replaces the class for a trunk or prefix
+func (r *Router) AddSettlementRule(ctx context.Context, rule models.SettlementRule) (*models.SettlementRule, error) {
+    if rule.MatchType != settlementPrefix && rule.MatchType != settlementTrunk {
+        return nil, fmt.Errorf("match_type must be %q or %q", settlementPrefix, settlementTrunk)
+    }
+    if rule.Pattern == "" || rule.Class == "" {
+        return nil, fmt.Errorf("pattern and class are required")
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, `
+        INSERT INTO settlement_rules (match_type, pattern, class)
+        VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE class = VALUES(class), id = LAST_INSERT_ID(id)
+    `, rule.MatchType, rule.Pattern, rule.Class)
+    if err != nil {
+        return nil, err
+    }
+
+    rule.ID, _ = result.LastInsertId()
+    rule.CreatedAt = r.clock.Now()
+    r.loadSettlementRules()
+    return &rule, nil
+}
+
+func (r *Router) DeleteSettlementRule(ctx context.Context, id int64) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "DELETE FROM settlement_rules WHERE id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("settlement rule %d not found", id)
+    }
+    r.loadSettlementRules()
+    return nil
+}
+
+// SettlementReport sums calls and minutes per class for calls started in [from, to)
+func (r *Router) SettlementReport(ctx context.Context, from, to time.Time) ([]models.SettlementUsage, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT COALESCE(settlement_class, ?), COUNT(*), COALESCE(SUM(duration), 0) / 60
+        FROM call_records
+        WHERE start_time >= ? AND start_time < ?
+        GROUP BY 1
+        ORDER BY 1
+    `, settlementUnclassified, from, to)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    report := []models.SettlementUsage{}
+    for rows.Next() {
+        var u models.SettlementUsage
+        if err := rows.Scan(&u.Class, &u.Calls, &u.Minutes); err != nil {
+            return nil, err
+        }
+        report = append(report, u)
+    }
+    return report, rows.Err()
+}
@@ -0,0 +1,350 @@
+package router
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "runtime/pprof"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Soak mode is for release testing: with SoakCheck set the router verifies
+// its own invariants that often while the simulator loads it, and halts
+// with a dump on the first violation instead of limping on. A violation
+// that can only be a race between the checker and a call in progress -
+// a DID claimed whose record is not written yet - counts once it is seen
+// on two checks in a row; a negative counter counts at once. The pool
+// checks assume this router owns the database, as it does in a soak.
+const (
+    soakExitCode   = 3
+    soakLogEvery   = 60 // checks between progress lines
+    soakUnfinished = `'ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3'`
+)
+
+var soakChecks = metrics.NewCounter("s2_soak_checks_total",
+    "Soak mode invariant checks, by result", "result")
+
+// SoakViolation is one broken invariant
+type SoakViolation struct {
+    Invariant string `json:"invariant"`
+    Key       string `json:"key"`
+    Detail    string `json:"detail"`
+
+    immediate bool // no second sighting needed
+}
+
+// soakMonitor remembers what the previous check saw
+type soakMonitor struct {
+    mu      sync.Mutex
+    checks  int64
+    suspect map[string]bool // invariant/key seen on the previous check
+}
+
+// soakDump is written before the process halts
+type soakDump struct {
+    At         time.Time              `json:"at"`
+    Checks     int64                  `json:"checks_passed"`
+    Violations []SoakViolation        `json:"violations"`
+    Calls      []*models.CallRecord   `json:"calls"`
+    Admissions []string               `json:"admissions"`
+    Orphans    []OrphanEntry          `json:"orphans"`
+    Writes     WriteReport            `json:"state_writes"`
+    MapHistory []MapSample            `json:"map_history"`
+    Workers    []WorkerStatus         `json:"workers"`
+    Stats      map[string]interface{} `json:"stats"`
+    Goroutines string                 `json:"goroutines"`
+}
+
+// checkSoak runs one round of invariant checks. A database error fails
+// the round without judging it; the next one tries again.
+func (r *Router) checkSoak() error {
+    violations, err := r.soakViolations()
+    if err != nil {
+        soakChecks.Inc("error")
+        logger.Errorf("Soak check failed: %v", err)
+        return err
+    }
+
+    s := &r.soak
+    s.mu.Lock()
+    seen := make(map[string]bool, len(violations))
+    var settled []SoakViolation
+    for _, v := range violations {
+        key := v.Invariant + "/" + v.Key
+        seen[key] = true
+        if v.immediate || s.suspect[key] {
+            settled = append(settled, v)
+        }
+    }
+    s.suspect = seen
+    if len(settled) == 0 {
+        s.checks++
+        checks := s.checks
+        s.mu.Unlock()
+        soakChecks.Inc("ok")
+        if checks%soakLogEvery == 0 {
+            logger.Infof("Soak: %d checks passed", checks)
+        }
+        return nil
+    }
+    checks := s.checks
+    s.mu.Unlock()
+
+    soakChecks.Inc("violation")
+    r.haltSoak(checks, settled)
+    return nil
+}
+
+// soakViolations gathers every invariant broken right now
+func (r *Router) soakViolations() ([]SoakViolation, error) {
+    violations := r.counterViolations()
+    if r.stateless() {
+        return violations, nil
+    }
+
+    // Memory first, so a call the database shows is not missing from a
+    // snapshot taken after it ended
+    r.mu.RLock()
+    tracked := make(map[string]string, len(r.activeCallsMap))
+    for callID, record := range r.activeCallsMap {
+        if r.isInFlight(record) {
+            tracked[callID] = record.AssignedDID
+        }
+    }
+    owners := make(map[string]string, len(r.didToCallMap))
+    for did, callID := range r.didToCallMap {
+        owners[did] = callID
+    }
+    for _, o := range r.findOrphans() {
+        if o.Map != "active_calls" && o.Reason != "call not in flight" {
+            violations = append(violations, SoakViolation{Invariant: "index_consistency", Key: o.Map + ":" + o.Key,
+                Detail: fmt.Sprintf("%s entry %s -> %s: %s", o.Map, o.Key, o.CallID, o.Reason)})
+        }
+    }
+    r.mu.RUnlock()
+
+    calls, inUse, err := r.soakPool()
+    if err != nil {
+        return nil, err
+    }
+
+    holders := make(map[string][]string)
+    for callID, did := range calls {
+        holders[did] = append(holders[did], callID)
+    }
+    for did, callIDs := range holders {
+        if did == "" {
+            continue
+        }
+        if len(callIDs) > 1 {
+            sort.Strings(callIDs)
+            violations = append(violations, SoakViolation{Invariant: "did_shared", Key: did,
+                Detail: fmt.Sprintf("DID %s held by %d unfinished calls: %v", did, len(callIDs), callIDs)})
+        }
+        if !inUse[did] && !r.writesPending(callIDs[0]) {
+            violations = append(violations, SoakViolation{Invariant: "did_not_in_use", Key: did,
+                Detail: fmt.Sprintf("DID %s is free but held by unfinished call %s", did, callIDs[0])})
+        }
+    }
+    for did := range inUse {
+        if len(holders[did]) > 0 {
+            continue
+        }
+        if callID := owners[did]; callID != "" && r.writesPending(callID) {
+            continue // its record is queued for retry
+        }
+        violations = append(violations, SoakViolation{Invariant: "did_leaked", Key: did,
+            Detail: fmt.Sprintf("DID %s is in use but no unfinished call holds it", did)})
+    }
+    for callID, did := range tracked {
+        if r.writesPending(callID) {
+            continue
+        }
+        switch held, ok := calls[callID]; {
+        case !ok:
+            violations = append(violations, SoakViolation{Invariant: "memory_db", Key: callID,
+                Detail: fmt.Sprintf("call %s is in flight in memory on DID %s but finished or missing in the database", callID, did)})
+        case held != did:
+            violations = append(violations, SoakViolation{Invariant: "memory_db", Key: callID,
+                Detail: fmt.Sprintf("call %s is on DID %s in memory but %s in the database", callID, did, held)})
+        }
+    }
+    return violations, nil
+}
+
+// soakPool reads, in one snapshot, the DID of every call whose latest
+// record is unfinished and the set of DIDs marked in use
+func (r *Router) soakPool() (calls map[string]string, inUse map[string]bool, err error) {
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+    if err != nil {
+        return nil, nil, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, `
+        SELECT c.call_id, COALESCE(c.assigned_did, '') FROM call_records c
+        WHERE c.status IN (`+soakUnfinished+`)
+            AND c.id = (SELECT MAX(l.id) FROM call_records l WHERE l.call_id = c.call_id)
+    `)
+    if err != nil {
+        return nil, nil, err
+    }
+    calls = make(map[string]string)
+    for rows.Next() {
+        var callID, did string
+        if err := rows.Scan(&callID, &did); err != nil {
+            rows.Close()
+            return nil, nil, err
+        }
+        calls[callID] = did
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, nil, err
+    }
+
+    rows, err = tx.QueryContext(ctx, "SELECT did FROM dids WHERE in_use = 1")
+    if err != nil {
+        return nil, nil, err
+    }
+    defer rows.Close()
+    inUse = make(map[string]bool)
+    for rows.Next() {
+        var did string
+        if err := rows.Scan(&did); err != nil {
+            return nil, nil, err
+        }
+        inUse[did] = true
+    }
+    return calls, inUse, rows.Err()
+}
+
+// counterViolations checks the in-memory counters, none of which can go
+// negative or disagree with what they count, even mid-call
+func (r *Router) counterViolations() []SoakViolation {
+    var violations []SoakViolation
+    negative := func(name string, n int64) {
+        if n < 0 {
+            violations = append(violations, SoakViolation{Invariant: "negative_counter", Key: name,
+                Detail: fmt.Sprintf("%s is %d", name, n), immediate: true})
+        }
+    }
+
+    q := &r.writes
+    q.mu.Lock()
+    sum := 0
+    for callID, n := range q.calls {
+        negative("state_writes["+callID+"]", int64(n))
+        sum += n
+    }
+    if sum != len(q.pending) {
+        violations = append(violations, SoakViolation{Invariant: "write_accounting", Key: "state_writes",
+            Detail: fmt.Sprintf("%d writes pending but %d counted per call", len(q.pending), sum), immediate: true})
+    }
+    q.mu.Unlock()
+
+    if wb := r.writeBehind; wb != nil {
+        wb.count.Lock()
+        sum := 0
+        for callID, n := range wb.calls {
+            negative("write_behind["+callID+"]", int64(n))
+            sum += n
+        }
+        if sum != wb.pending {
+            violations = append(violations, SoakViolation{Invariant: "write_accounting", Key: "write_behind",
+                Detail: fmt.Sprintf("%d writes buffered but %d counted per call", wb.pending, sum), immediate: true})
+        }
+        wb.count.Unlock()
+    }
+
+    l := &r.calls
+    l.mu.Lock()
+    for callID, c := range l.locks {
+        if c.refs <= 0 {
+            violations = append(violations, SoakViolation{Invariant: "lock_refs", Key: callID,
+                Detail: fmt.Sprintf("lock of call %s kept with %d references", callID, c.refs), immediate: true})
+        }
+    }
+    l.mu.Unlock()
+
+    u := &r.recordings
+    u.mu.RLock()
+    negative("recording_bytes", u.bytes)
+    negative("recording_files", int64(u.files))
+    negative("recordings_purged", u.purged)
+    u.mu.RUnlock()
+
+    load := &r.load
+    load.refresh.Lock()
+    negative("free_dids", load.free)
+    negative("used_dids", int64(load.used))
+    load.refresh.Unlock()
+    return violations
+}
+
+// haltSoak writes the dump and ends the process. Nothing is drained or
+// closed, so the database is left as the violation found it.
+func (r *Router) haltSoak(checks int64, violations []SoakViolation) {
+    sort.Slice(violations, func(i, j int) bool {
+        if violations[i].Invariant != violations[j].Invariant {
+            return violations[i].Invariant < violations[j].Invariant
+        }
+        return violations[i].Key < violations[j].Key
+    })
+    for _, v := range violations {
+        logger.Errorf("ALERT: soak: %s violated: %s", v.Invariant, v.Detail)
+    }
+
+    dump := soakDump{At: r.clock.Now(), Checks: checks, Violations: violations, Admissions: []string{}}
+    r.mu.RLock()
+    for _, record := range r.activeCallsMap {
+        dump.Calls = append(dump.Calls, copyCallRecord(record))
+    }
+    for callID := range r.admissions {
+        dump.Admissions = append(dump.Admissions, callID)
+    }
+    dump.Orphans = r.findOrphans()
+    r.mu.RUnlock()
+    sort.Slice(dump.Calls, func(i, j int) bool { return dump.Calls[i].CallID < dump.Calls[j].CallID })
+    sort.Strings(dump.Admissions)
+
+    dump.Writes = r.WriteReport()
+    dump.MapHistory = r.MapHistory()
+    dump.Workers, _ = r.WorkerHealth()
+    ctx, cancel := r.dbContext(context.Background())
+    if stats, err := r.GetStatistics(ctx); err == nil {
+        dump.Stats = stats
+    }
+    cancel()
+    var goroutines bytes.Buffer
+    pprof.Lookup("goroutine").WriteTo(&goroutines, 1)
+    dump.Goroutines = goroutines.String()
+
+    path := r.config.SoakDumpFile
+    if path == "" {
+        path = filepath.Join(os.TempDir(), fmt.Sprintf("s2-soak-%d.json", dump.At.Unix()))
+    }
+    data, err := json.MarshalIndent(dump, "", "  ")
+    if err == nil {
+        err = os.WriteFile(path, data, 0o644)
+    }
+    if err != nil {
+        logger.Errorf("Failed to write soak dump %s: %v", path, err)
+        os.Stderr.Write(data)
+    } else {
+        logger.Errorf("Soak dump written to %s", path)
+    }
+    logger.Errorf("Soak: halting after %d clean checks on %d violations", checks, len(violations))
+    os.Exit(soakExitCode)
+}
@@ -0,0 +1,140 @@
+package router
+
+import (
+    "encoding/json"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/redis"
+)
+
+// Shared call state lets several routers behind a load balancer serve each
+// other's return legs. Each in-flight call is mirrored into Redis as
+//
+//	<prefix>call:<CallID>  JSON call record
+//	<prefix>did:<DID>      CallID holding the DID
+//	<prefix>token:<token>  CallID owning the match token
+//
+// Keys expire a while after the call stops counting as in flight, so calls
+// that are never finished age out the same way the stale-call cleanup
+// fails them. The database remains the source of truth; Redis only saves
+// the lookup.
+
+// sharedStateTTL is how long a call's keys live, twice its in-flight age
+func (r *Router) sharedStateTTL(record *models.CallRecord) time.Duration {
+    return 2 * r.inFlightAge(record)
+}
+
+var sharedStateErrors = metrics.NewCounter("s2_shared_state_errors_total",
+    "Failed Redis operations on shared call state", "op")
+
+// RedisConfig enables shared call state
+type RedisConfig struct {
+    redis.Config
+    Prefix string // key prefix, defaults to "s2:"
+}
+
+type sharedState struct {
+    client *redis.Client
+    prefix string
+}
+
+func newSharedState(cfg RedisConfig) *sharedState {
+    if cfg.Addr == "" {
+        return nil
+    }
+    if cfg.Prefix == "" {
+        cfg.Prefix = "s2:"
+    }
+    return &sharedState{client: redis.NewClient(cfg.Config), prefix: cfg.Prefix}
+}
+
+// shareCall publishes a call and its DID/token mappings to the other routers
+func (r *Router) shareCall(record *models.CallRecord) {
+    s := r.shared
+    if s == nil {
+        return
+    }
+    data, err := json.Marshal(record)
+    if err != nil {
+        return
+    }
+    ttl := r.sharedStateTTL(record)
+    if err := s.client.Set(s.prefix+"call:"+record.CallID, string(data), ttl); err != nil {
+        sharedStateErrors.Inc("set")
+        logger.Errorf("Failed to share call %s: %v", record.CallID, err)
+        return
+    }
+    s.client.Set(s.prefix+"did:"+record.AssignedDID, record.CallID, ttl)
+    if record.MatchToken != "" {
+        s.client.Set(s.prefix+"token:"+record.MatchToken, record.CallID, ttl)
+    }
+}
+
+// unshareCall drops a finished call, leaving DID and token keys that another
+// router already pointed at a newer call
+func (r *Router) unshareCall(record *models.CallRecord) {
+    s := r.shared
+    if s == nil {
+        return
+    }
+    if err := s.client.Del(s.prefix + "call:" + record.CallID); err != nil {
+        sharedStateErrors.Inc("del")
+    }
+    s.client.DelIfEquals(s.prefix+"did:"+record.AssignedDID, record.CallID)
+    if record.MatchToken != "" {
+        s.client.DelIfEquals(s.prefix+"token:"+record.MatchToken, record.CallID)
+    }
+}
+
+// sharedCall loads a call another router may be handling, or nil
+func (r *Router) sharedCall(callID string) *models.CallRecord {
+    s := r.shared
+    if s == nil || callID == "" {
+        return nil
+    }
+    data, err := s.client.Get(s.prefix + "call:" + callID)
+    if err != nil {
+        if err != redis.ErrNil {
+            sharedStateErrors.Inc("get")
+        }
+        return nil
+    }
+    var record models.CallRecord
+    if err := json.Unmarshal([]byte(data), &record); err != nil || !r.isInFlight(&record) {
+        return nil
+    }
+    return &record
+}
+
+// sharedCallBy resolves a "did" or "token" mapping to its call, or nil
+func (r *Router) sharedCallBy(kind, key string) *models.CallRecord {
+    s := r.shared
+    if s == nil || key == "" {
+        return nil
+    }
+    callID, err := s.client.Get(s.prefix + kind + ":" + key)
+    if err != nil {
+        if err != redis.ErrNil {
+            sharedStateErrors.Inc("get")
+        }
+        return nil
+    }
+    return r.sharedCall(callID)
+}
+
+// syncShared picks up progress another router made on a call this one
+// tracks, e.g. the return leg having been routed elsewhere. Caller must
+// not hold r.mu.
+func (r *Router) syncShared(record *models.CallRecord) {
+    shared := r.sharedCall(record.CallID)
+    if shared == nil {
+        return
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if shared.Status != record.Status {
+        record.Status = shared.Status
+    }
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/redis"
+    "github.com/asterisk-call-routing-v2/internal/redis/redistest"
+)
+
+func newFakeRedis(t *testing.T) *redistest.Server {
+    t.Helper()
+    srv, err := redistest.NewServer("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+// newSharedRouter is one of several routers sharing call state through the
+// Redis at addr
+func newSharedRouter(t *testing.T, store *fakeStorage, addr string) *Router {
+    t.Helper()
+    r := newTestRouter(t, store, Config{Redis: RedisConfig{Config: redis.Config{Addr: addr}}})
+    t.Cleanup(r.shared.client.Close)
+    return r
+}
+
+func sharedRecord(t *testing.T, srv *redistest.Server, callID string) *models.CallRecord {
+    t.Helper()
+    data, ok := srv.Get("s2:call:" + callID)
+    if !ok {
+        return nil
+    }
+    var record models.CallRecord
+    if err := json.Unmarshal([]byte(data), &record); err != nil {
+        t.Fatalf("shared call %s: %v", callID, err)
+    }
+    return &record
+}
+
+func TestReturnLegServedByAnotherInstance(t *testing.T) {
+    srv := newFakeRedis(t)
+    // b's database never sees the call, so only Redis can tell b about it
+    a := newSharedRouter(t, newFakeStorage("15550001111"), srv.Addr())
+    b := newSharedRouter(t, newFakeStorage(), srv.Addr())
+    ctx := context.Background()
+
+    fwd, err := a.ProcessIncomingCall(ctx, "call-1", "12125551234", "442071234567", IncomingOptions{})
+    if err != nil {
+        t.Fatalf("forward leg on a: %v", err)
+    }
+    if got, _ := srv.Get("s2:did:" + fwd.DIDAssigned); got != "call-1" {
+        t.Fatalf("did key holds %q, want call-1", got)
+    }
+    shared := sharedRecord(t, srv, "call-1")
+    if shared == nil || shared.OriginalANI != "12125551234" || shared.Status != models.CallStateForwarded {
+        t.Fatalf("shared call = %+v", shared)
+    }
+    if ttl := srv.TTL("s2:call:call-1"); ttl != 2*staleCallAge {
+        t.Errorf("call key TTL = %v, want %v", ttl, 2*staleCallAge)
+    }
+
+    back, err := b.ProcessReturnCall(ctx, "442071234567", fwd.DIDAssigned, ReturnOptions{})
+    if err != nil {
+        t.Fatalf("return leg on b: %v", err)
+    }
+    if back.CallID != "call-1" || back.ANIToSend != "12125551234" || back.DNISToSend != "442071234567" {
+        t.Errorf("return leg on b = %+v, want call-1 restoring 12125551234 -> 442071234567", back)
+    }
+    // b shares the progress, and a picks it up
+    if shared := sharedRecord(t, srv, "call-1"); shared == nil || shared.Status != models.CallStateReturned {
+        t.Fatalf("shared call after return leg = %+v, want %s", shared, models.CallStateReturned)
+    }
+    a.mu.RLock()
+    record := a.activeCallsMap["call-1"]
+    a.mu.RUnlock()
+    a.syncShared(record)
+    if record.Status != models.CallStateReturned {
+        t.Errorf("a sees call-1 as %s after b routed the return leg, want %s", record.Status, models.CallStateReturned)
+    }
+
+    if _, err := b.CompleteCall(ctx, "call-1", "16"); err != nil {
+        t.Fatalf("hangup on b: %v", err)
+    }
+    for _, key := range []string{"s2:call:call-1", "s2:did:" + fwd.DIDAssigned} {
+        if _, ok := srv.Get(key); ok {
+            t.Errorf("%s still shared after the call ended", key)
+        }
+    }
+}
+
+func TestSharedStateExpires(t *testing.T) {
+    srv := newFakeRedis(t)
+    a := newSharedRouter(t, newFakeStorage("15550001111", "15550002222"), srv.Addr())
+    b := newSharedRouter(t, newFakeStorage(), srv.Addr())
+    ctx := context.Background()
+
+    fwd1, err := a.ProcessIncomingCall(ctx, "call-1", "12125551234", "442071234567", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    fwd2, err := a.ProcessIncomingCall(ctx, "call-2", "12125555678", "442077654321", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Redis keeps a call for twice its in-flight age, but a call past that
+    // age is not restored even while its keys live
+    b.clock.(*clock.Fake).Advance(staleCallAge)
+    srv.Advance(staleCallAge)
+    if _, err := b.ProcessReturnCall(ctx, "442071234567", fwd1.DIDAssigned, ReturnOptions{}); !errors.Is(err, ErrCallNotFound) {
+        t.Errorf("return leg on a call past its in-flight age: err = %v, want ErrCallNotFound", err)
+    }
+    if _, ok := srv.Get("s2:call:call-1"); !ok {
+        t.Fatal("call key expired before its TTL")
+    }
+
+    // Once the TTL runs out the keys are gone
+    b.clock.(*clock.Fake).Advance(-staleCallAge)
+    srv.Advance(staleCallAge - time.Millisecond)
+    if _, ok := srv.Get("s2:did:" + fwd2.DIDAssigned); !ok {
+        t.Fatal("did key expired before its TTL")
+    }
+    srv.Advance(time.Millisecond)
+    for _, key := range []string{"s2:call:call-2", "s2:did:" + fwd2.DIDAssigned} {
+        if _, ok := srv.Get(key); ok {
+            t.Errorf("%s outlived its TTL", key)
+        }
+    }
+    if _, err := b.ProcessReturnCall(ctx, "442077654321", fwd2.DIDAssigned, ReturnOptions{}); !errors.Is(err, ErrCallNotFound) {
+        t.Errorf("return leg after the keys expired: err = %v, want ErrCallNotFound", err)
+    }
+}
+
+func TestSharedStateRedisDown(t *testing.T) {
+    srv := newFakeRedis(t)
+    // Both routers use the one database, the source of truth
+    store := newFakeStorage("15550001111", "15550002222")
+    a := newSharedRouter(t, store, srv.Addr())
+    b := newSharedRouter(t, store, srv.Addr())
+    ctx := context.Background()
+    srv.Close()
+
+    setErrors := sharedStateErrors.Value("set")
+    getErrors := sharedStateErrors.Value("get")
+    fwd, err := a.ProcessIncomingCall(ctx, "call-1", "12125551234", "442071234567", IncomingOptions{})
+    if err != nil {
+        t.Fatalf("forward leg with Redis down: %v", err)
+    }
+    if got := sharedStateErrors.Value("set") - setErrors; got != 1 {
+        t.Errorf("%v failed sets counted, want 1", got)
+    }
+
+    // b falls back to the database
+    back, err := b.ProcessReturnCall(ctx, "442071234567", fwd.DIDAssigned, ReturnOptions{})
+    if err != nil {
+        t.Fatalf("return leg on b with Redis down: %v", err)
+    }
+    if back.CallID != "call-1" || back.ANIToSend != "12125551234" {
+        t.Errorf("return leg on b = %+v, want call-1 restoring 12125551234", back)
+    }
+    if sharedStateErrors.Value("get") == getErrors {
+        t.Error("failed lookup not counted")
+    }
+    if _, err := b.CompleteCall(ctx, "call-1", "16"); err != nil {
+        t.Fatalf("hangup on b with Redis down: %v", err)
+    }
+    if store.inUse(fwd.DIDAssigned) {
+        t.Errorf("DID %s still in use after the call ended", fwd.DIDAssigned)
+    }
+}
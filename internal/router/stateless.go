@@ -0,0 +1,240 @@
+package router
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Stateless mode carries ANI-1 inside the forwarded DNIS so the return leg
+// can be restored without any lookup. DNIS-1 already travels as ANI-2.
+//
+// Forwarded DNIS layout (digits only, parsed from the right):
+//
+//	<DID><ANI-1 digits><plus flag 0|1><ANI-1 length, 2 digits><MAC, 10 digits>
+//
+// The MAC is an HMAC-SHA256 over DID, ANI-1, DNIS-1 and the statelessWindow
+// the call was forwarded in, truncated to ten decimal digits, so a tampered
+// or corrupted number is rejected and a captured one stops working once
+// the next window has passed. The return leg must come back within one to
+// two windows; its DID must also still be in the pool.
+const (
+    statelessMACDigits = 10
+    statelessWindow    = 5 * time.Minute
+)
+
+// statelessPool holds the DID list stateless calls rotate through.
+// DIDs are shared, never marked in use, because the number itself identifies the call.
+type statelessPool struct {
+    mu    sync.Mutex
+    dids  []string
+    known map[string]bool
+    next  int
+}
+
+func (p *statelessPool) pick() (string, bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if len(p.dids) == 0 {
+        return "", false
+    }
+    did := p.dids[p.next%len(p.dids)]
+    p.next++
+    return did, true
+}
+
+func (p *statelessPool) set(dids []string) {
+    known := make(map[string]bool, len(dids))
+    for _, did := range dids {
+        known[did] = true
+    }
+    p.mu.Lock()
+    p.dids, p.known = dids, known
+    p.mu.Unlock()
+}
+
+func (p *statelessPool) has(did string) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.known[did]
+}
+
+func (r *Router) stateless() bool {
+    return r.config.StatelessKey != ""
+}
+
+// refreshStatelessPool reloads the DID list from the database
+func (r *Router) refreshStatelessPool() error {
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, "SELECT did FROM dids ORDER BY did")
+    if err != nil {
+        logger.Errorf("Error loading stateless DID pool: %v", err)
+        return err
+    }
+    defer rows.Close()
+
+    var dids []string
+    for rows.Next() {
+        var did string
+        if err := rows.Scan(&did); err == nil {
+            dids = append(dids, did)
+        }
+    }
+    r.statelessDIDs.set(dids)
+    return nil
+}
+
+func (r *Router) statelessForward(callID, ani, dnis string, opts IncomingOptions) (*models.CallResponse, error) {
+    did, ok := r.statelessDIDs.pick()
+    if !ok {
+        return nil, fmt.Errorf("%w: none configured for stateless routing", ErrNoAvailableDIDs)
+    }
+
+    encoded, err := EncodeStateless(r.config.StatelessKey, did, ani, dnis, r.clock.Now())
+    if err != nil {
+        return nil, err
+    }
+    trunk := r.forwardTrunkFor(nil, ani, dnis)
+    pacing, err := r.checkCarrier(trunk)
+    if err != nil {
+        return nil, err
+    }
+
+    logger.Call(callID, did, ani).Infof("=== STATELESS: CallID=%s ANI-1=%s, DNIS-1=%s -> ANI-2=%s, DNIS=%s ===",
+        callID, ani, dnis, dnis, encoded)
+
+    r.publish(models.Event{
+        Type:   "call.forwarded",
+        CallID: callID,
+        ANI:    ani,
+        DNIS:   dnis,
+        DID:    did,
+        Status: models.CallStateForwarded,
+        Tags:   opts.Tags,
+    })
+
+    return r.applyCarrier(&models.CallResponse{
+        Status:      "success",
+        CallID:      callID,
+        DIDAssigned: did,
+        NextHop:     trunk,
+        ANIToSend:   dnis, // unformatted: the return leg's MAC covers ANI-2
+        DNISToSend:  encoded,
+        Cost:        r.costEstimate(trunk, dnis, r.clock.Now()),
+        PacingMs:    pacingMillis(pacing),
+    }), nil
+}
+
+func (r *Router) statelessReturn(ani2, number string) (*models.CallResponse, error) {
+    did, ani, dnis, err := DecodeStateless(r.config.StatelessKey, number, ani2, r.clock.Now())
+    if err == nil && !r.statelessDIDs.has(did) {
+        err = fmt.Errorf("%w: DID %s is not in the stateless pool", ErrDIDMismatch, did)
+    }
+    if err != nil {
+        logger.Warnf("Stateless decode failed for %s: %v", number, err)
+        return nil, err
+    }
+
+    logger.Call("", did, ani).Infof("=== STATELESS RESTORATION: ANI-2=%s, DNIS=%s -> ANI-1=%s, DNIS-1=%s ===",
+        ani2, number, ani, dnis)
+
+    r.publish(models.Event{
+        Type:   "call.returned",
+        ANI:    ani,
+        DNIS:   dnis,
+        DID:    did,
+        Status: models.CallStateReturned,
+    })
+
+    nextHop := r.trunkFor(legReturn, dnis, nil)
+    return r.applyCarrier(&models.CallResponse{
+        Status:     "success",
+        NextHop:    nextHop,
+        ANIToSend:  r.formats.format(nextHop, ani),
+        DNISToSend: r.formats.format(nextHop, dnis),
+    }), nil
+}
+
+// EncodeStateless builds the forwarded DNIS carrying ANI-1 and an integrity
+// code valid for the window at falls in. ANI-1 may have a leading "+";
+// otherwise it must be digits.
+func EncodeStateless(key, did, ani, dnis string, at time.Time) (string, error) {
+    plus := "0"
+    digits := ani
+    if strings.HasPrefix(digits, "+") {
+        plus = "1"
+        digits = digits[1:]
+    }
+    if !isDigits(digits) || !isDigits(did) {
+        return "", fmt.Errorf("stateless mode needs numeric ANI and DID, got %q / %q", ani, did)
+    }
+    if len(digits) > 99 {
+        return "", fmt.Errorf("ANI too long for stateless encoding: %d digits", len(digits))
+    }
+
+    return fmt.Sprintf("%s%s%s%02d%s", did, digits, plus, len(digits), statelessMAC(key, did, ani, dnis, statelessEpoch(at))), nil
+}
+
+// DecodeStateless reverses EncodeStateless. ani2 is the ANI received from
+// S3, which carries DNIS-1; the number must have been encoded in the
+// window now falls in or the one before.
+func DecodeStateless(key, number, ani2 string, now time.Time) (did, ani, dnis string, err error) {
+    if !isDigits(number) {
+        return "", "", "", fmt.Errorf("%w: stateless number must be numeric", ErrMalformedNumber)
+    }
+
+    // MAC + ANI length + plus flag
+    trailer := statelessMACDigits + 3
+    if len(number) <= trailer {
+        return "", "", "", fmt.Errorf("%w: number too short for stateless decoding", ErrMalformedNumber)
+    }
+
+    mac := number[len(number)-statelessMACDigits:]
+    aniLen, _ := strconv.Atoi(number[len(number)-statelessMACDigits-2 : len(number)-statelessMACDigits])
+    plus := number[len(number)-trailer]
+
+    body := number[:len(number)-trailer]
+    if aniLen > len(body) || (plus != '0' && plus != '1') {
+        return "", "", "", fmt.Errorf("%w: malformed stateless number", ErrMalformedNumber)
+    }
+
+    did = body[:len(body)-aniLen]
+    ani = body[len(body)-aniLen:]
+    if plus == '1' {
+        ani = "+" + ani
+    }
+    dnis = ani2
+
+    epoch := statelessEpoch(now)
+    for _, e := range []int64{epoch, epoch - 1} {
+        if hmac.Equal([]byte(mac), []byte(statelessMAC(key, did, ani, dnis, e))) {
+            return did, ani, dnis, nil
+        }
+    }
+    return "", "", "", fmt.Errorf("%w: stateless integrity check failed", ErrDIDMismatch)
+}
+
+// statelessEpoch numbers the window t falls in
+func statelessEpoch(t time.Time) int64 {
+    return t.Unix() / int64(statelessWindow/time.Second)
+}
+
+func statelessMAC(key, did, ani, dnis string, epoch int64) string {
+    h := hmac.New(sha256.New, []byte(key))
+    h.Write([]byte(did + "|" + ani + "|" + dnis + "|" + strconv.FormatInt(epoch, 10)))
+    sum := binary.BigEndian.Uint64(h.Sum(nil)[:8])
+    return fmt.Sprintf("%010d", sum%10000000000)
+}
+
+func isDigits(s string) bool {
+    return s != "" && strings.Trim(s, "0123456789") == ""
+}
@@ -0,0 +1,49 @@
+package router
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestStatelessRoundTrip(t *testing.T) {
+    at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    encoded, err := EncodeStateless("key", "15550001", "+4420700001", "15551234", at)
+    if err != nil {
+        t.Fatal(err)
+    }
+    did, ani, dnis, err := DecodeStateless("key", encoded, "15551234", at.Add(time.Minute))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if did != "15550001" || ani != "+4420700001" || dnis != "15551234" {
+        t.Fatalf("decoded %s %s %s", did, ani, dnis)
+    }
+}
+
+func TestStatelessRejectsReplayAndTampering(t *testing.T) {
+    at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    encoded, err := EncodeStateless("key", "15550001", "4420700001", "15551234", at)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Still good in the next window, gone in the one after
+    if _, _, _, err := DecodeStateless("key", encoded, "15551234", at.Add(statelessWindow)); err != nil {
+        t.Fatalf("next window: %v", err)
+    }
+    if _, _, _, err := DecodeStateless("key", encoded, "15551234", at.Add(2*statelessWindow)); !errors.Is(err, ErrDIDMismatch) {
+        t.Fatalf("replayed two windows later: got %v", err)
+    }
+
+    if _, _, _, err := DecodeStateless("key", encoded, "15559999", at); !errors.Is(err, ErrDIDMismatch) {
+        t.Fatalf("other DNIS-1: got %v", err)
+    }
+    if _, _, _, err := DecodeStateless("other", encoded, "15551234", at); !errors.Is(err, ErrDIDMismatch) {
+        t.Fatalf("other key: got %v", err)
+    }
+    tampered := "2" + encoded[1:]
+    if _, _, _, err := DecodeStateless("key", tampered, "15551234", at); !errors.Is(err, ErrDIDMismatch) {
+        t.Fatalf("tampered DID: got %v", err)
+    }
+}
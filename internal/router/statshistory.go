@@ -0,0 +1,90 @@
+package router
+
+import (
+    "context"
+    "os"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Each router writes its own rows, so active_calls is per node while the
+// DID and call counts are the shared database's
+var statsNode = func() string {
+    name, err := os.Hostname()
+    if err != nil || name == "" {
+        return "unknown"
+    }
+    return name
+}()
+
+// snapshotStats records the key stats for /api/stats/history and deletes
+// snapshots past StatsRetention
+func (r *Router) snapshotStats() error {
+    r.mu.RLock()
+    activeCalls := len(r.activeCallsMap)
+    r.mu.RUnlock()
+
+    totalDIDs, usedDIDs, err := r.store.DIDCounts(context.Background())
+    if err != nil {
+        return err
+    }
+    available := int64(totalDIDs-usedDIDs) + r.unmaterializedRangeDIDs(context.Background())
+    calls, completed, err := r.store.CallCounts(context.Background())
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    if _, err := r.db.ExecContext(ctx, `
+        INSERT INTO stats_history (node, taken_at, active_calls, total_dids, used_dids, available_dids, calls_today, completed_today)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, statsNode, r.clock.Now(), activeCalls, totalDIDs, usedDIDs, available, calls, completed); err != nil {
+        return err
+    }
+
+    result, err := r.db.ExecContext(ctx, "DELETE FROM stats_history WHERE taken_at < ?", r.clock.Now().Add(-r.config.StatsRetention))
+    if err != nil {
+        return err
+    }
+    if n, _ := result.RowsAffected(); n > 0 {
+        logger.Infof("Pruned %d stats snapshots older than %s", n, r.config.StatsRetention)
+    }
+    return nil
+}
+
+// StatsHistory returns the snapshots taken since the given time, oldest
+// first, optionally for one node only
+func (r *Router) StatsHistory(ctx context.Context, since time.Time, node string) ([]models.StatsSnapshot, error) {
+    query := `
+        SELECT node, taken_at, active_calls, total_dids, used_dids, available_dids, calls_today, completed_today
+        FROM stats_history
+        WHERE taken_at >= ?`
+    args := []interface{}{since}
+    if node != "" {
+        query += " AND node = ?"
+        args = append(args, node)
+    }
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, query+" ORDER BY taken_at, node", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    history := []models.StatsSnapshot{}
+    for rows.Next() {
+        var s models.StatsSnapshot
+        if err := rows.Scan(&s.Node, &s.TakenAt, &s.ActiveCalls, &s.TotalDIDs, &s.UsedDIDs,
+            &s.AvailableDIDs, &s.CallsToday, &s.CompletedToday); err != nil {
+            return nil, err
+        }
+        if pool := float64(s.UsedDIDs) + float64(s.AvailableDIDs); pool > 0 {
+            s.Utilization = float64(s.UsedDIDs) / pool
+        }
+        history = append(history, s)
+    }
+    return history, rows.Err()
+}
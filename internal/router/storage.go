@@ -0,0 +1,206 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "sort"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Storage is the persistence the call path depends on: the DID pool and the
+// call records that tie a DID to its call. The MySQL implementation bounds
+// every method by its query timeout, so a wedged database fails the call
+// instead of holding it, and the circuit breaker wraps it the same way.
+// Feature tables (campaigns, rates, overrides, ...) are queried through
+// the router's *sql.DB directly, and exist on MySQL only.
+type Storage interface {
+    // Prepare readies the statements run on every call; NewRouter calls
+    // it once the schema exists
+    Prepare(ctx context.Context) error
+
+    // PickFreeDID returns a random unclaimed DID matching f, or
+    // sql.ErrNoRows when there is none. The Pick methods skip DIDs
+    // released less than the backend's cooldown ago.
+    PickFreeDID(ctx context.Context, f DIDFilter) (string, error)
+    // PickLeastRecentDID returns the free DID claimed longest ago (never
+    // claimed first), skipping the skip oldest
+    PickLeastRecentDID(ctx context.Context, f DIDFilter, skip int) (string, error)
+    // PickFreeDIDAfter returns the first free DID above after in number
+    // order, wrapping to the lowest
+    PickFreeDIDAfter(ctx context.Context, f DIDFilter, after string) (string, error)
+    // ClaimDID marks did in use only if it is still free
+    ClaimDID(ctx context.Context, did, destination string) (bool, error)
+    // InsertClaimedDID creates did already in use; false means it exists
+    InsertClaimedDID(ctx context.Context, did, destination, country, tenant string) (bool, error)
+    // ReleaseDID frees did and starts its cooldown, unless a call in
+    // flight other than callID holds it; false means it was left in use
+    ReleaseDID(ctx context.Context, did, callID string) (bool, error)
+    // DIDCounts reports the size of the DID table and how many are in use
+    DIDCounts(ctx context.Context) (total, used int, err error)
+
+    StoreCallRecord(ctx context.Context, record *models.CallRecord) error
+    UpdateCallStatus(ctx context.Context, callID string, status models.CallState) error
+    RecordHangupCause(ctx context.Context, callID, cause string) error
+    // The batch forms write many calls in one statement each, failing or
+    // landing as a whole
+    StoreCallRecords(ctx context.Context, records []*models.CallRecord) error
+    UpdateCallStatuses(ctx context.Context, callIDs []string, status models.CallState) error
+    RecordHangupCauses(ctx context.Context, callIDs []string, cause string) error
+    // In-flight lookups only see calls younger than their tenant's
+    // reservation TTL or stale timeout (staleCallAge by default)
+    CallRecordByDID(ctx context.Context, did string) (*models.CallRecord, error)
+    CallRecordByToken(ctx context.Context, token string) (*models.CallRecord, error)
+    InFlightCallRecord(ctx context.Context, callID string) (*models.CallRecord, error)
+    InFlightCallRecords(ctx context.Context) ([]*models.CallRecord, error)
+    // UnfinishedCallRecords lists calls started after since that have no
+    // final status, in flight or not
+    UnfinishedCallRecords(ctx context.Context, since time.Time) ([]*models.CallRecord, error)
+    // FailStaleCalls fails calls that never came back from S3 within their
+    // reservation TTL and frees their DIDs
+    FailStaleCalls(ctx context.Context) (int64, error)
+    // CallCounts reports today's calls and how many completed
+    CallCounts(ctx context.Context) (calls, completed int, err error)
+    // DIDHistory lists calls that used a DID, newest first
+    DIDHistory(ctx context.Context, did string, from, to time.Time, limit int) ([]models.DIDCall, error)
+    // ListCalls returns one page of the calls matching f, newest first,
+    // and how many match in all
+    ListCalls(ctx context.Context, f CallFilter, offset, limit int) ([]models.Call, int, error)
+    // CallDetail returns the latest record with callID, nil if there is none
+    CallDetail(ctx context.Context, callID string) (*models.CallDetail, error)
+    // RecordCallEvent appends one transition to a call's timeline
+    RecordCallEvent(ctx context.Context, callID string, event models.CallEvent) error
+    // CallEvents returns a call's timeline, oldest first
+    CallEvents(ctx context.Context, callID string) ([]models.CallEvent, error)
+    // CallStatuses reports the status of each of callIDs that has a record
+    CallStatuses(ctx context.Context, callIDs []string) (map[string]models.CallState, error)
+    // CallsEnded counts the calls that reached a final status after from,
+    // up to and including to
+    CallsEnded(ctx context.Context, from, to time.Time) (int, error)
+    // BackdateCallEnd sets a finished call's end time, and its duration
+    // with it, to end
+    BackdateCallEnd(ctx context.Context, callID string, end time.Time) error
+}
+
+// storageBackend is one StorageDriver: the database/sql driver it opens,
+// the schema it creates and the Storage it runs the call path on
+type storageBackend struct {
+    sqlDriver    string
+    maxConns     int // 0 keeps the router's pool size
+    createTables func(db *sql.DB) error
+    open         func(db *sql.DB, timeout, cooldown time.Duration, now func() time.Time) Storage
+
+    // features is set when the feature tables (campaigns, rates,
+    // overrides, ...) live beside the call path tables. The other
+    // backends route calls but leave those features off.
+    features bool
+}
+
+var storageBackends = map[string]storageBackend{
+    "mysql": {sqlDriver: "mysql", createTables: createTables, open: newMySQLStorage, features: true},
+    "postgres": {sqlDriver: "postgres", createTables: postgresDialect.createTables,
+        open: postgresDialect.newStorage},
+    // One connection, so that writers queue in the pool rather than fail
+    // with SQLITE_BUSY
+    "sqlite": {sqlDriver: "sqlite", maxConns: 1, createTables: sqliteDialect.createTables,
+        open: sqliteDialect.newStorage},
+}
+
+// StorageDrivers lists the storage backends compiled into this build
+func StorageDrivers() []string {
+    names := make([]string, 0, len(storageBackends))
+    for name := range storageBackends {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// mysqlOnly names the settings in cfg whose features keep their state in
+// the feature tables, which only the mysql backend has
+func mysqlOnly(cfg Config) []string {
+    var names []string
+    add := func(set bool, name string) {
+        if set {
+            names = append(names, name)
+        }
+    }
+    add(cfg.V1DualWrite.DSN != "", "v1 dual-write")
+    add(cfg.DegradedMode, "degraded mode")
+    add(len(cfg.WebhookURLs) > 0, "webhooks")
+    add(cfg.StatelessKey != "", "stateless routing")
+    add(cfg.ReputationTrunk != "", "reputation routing")
+    add(cfg.ArchiveAfter > 0, "call archiving")
+    add(cfg.SoakCheck > 0, "soak checks")
+    add(cfg.ANIMismatchQuarantine > 0, "ANI mismatch quarantine")
+    add(cfg.S1Partitions > 0, "S1 partitions")
+    add(cfg.ProvisioningURL != "", "DID provisioning")
+    add(cfg.SchemaRepair, "schema repair")
+    for _, sink := range cfg.CDR.Sinks {
+        add(sink == "mysql", "the mysql CDR sink")
+    }
+    return names
+}
+
+// StatementError is a call path statement that failed, with the name it
+// is prepared under. Prepare is set when it could not be prepared at all,
+// which at startup means the schema is not what the router expects.
+type StatementError struct {
+    Statement string
+    Prepare   bool
+    Err       error
+}
+
+func (e *StatementError) Error() string {
+    if e.Prepare {
+        return fmt.Sprintf("preparing %s statement: %v", e.Statement, e.Err)
+    }
+    return fmt.Sprintf("%s statement: %v", e.Statement, e.Err)
+}
+
+func (e *StatementError) Unwrap() error { return e.Err }
+
+// DIDFilter narrows the free DIDs a Pick method may return
+type DIDFilter struct {
+    Tenant  string // "" for the default tenant
+    Pool    string // named pool, "" for unpooled DIDs
+    Country string // required country column, "" for any
+
+    // With Partitions > 0 only DIDs whose CRC32 modulo Partitions is
+    // Partition match
+    Partitions int
+    Partition  int
+}
+
+// CallFilter narrows a call listing; zero fields match everything
+type CallFilter struct {
+    Status models.CallState
+    ANI    string
+    DID    string
+    From   time.Time // start_time at or after
+    To     time.Time // start_time before
+}
+
+// withQueryTimeout bounds one database operation by d, on top of any
+// deadline ctx already has. d <= 0 leaves ctx unbounded.
+func withQueryTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+    if d <= 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, d)
+}
+
+// dbContext bounds a feature-table operation on r.db by the query timeout
+func (r *Router) dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    return withQueryTimeout(ctx, r.config.QueryTimeout)
+}
+
+// backgroundExec runs one statement for a background task, bounded on its
+// own so a long loop of writes doesn't share a single deadline
+func (r *Router) backgroundExec(query string, args ...interface{}) (sql.Result, error) {
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    return r.db.ExecContext(ctx, query, args...)
+}
@@ -0,0 +1,450 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// The contract tests run every storage backend through the same cases.
+// SQLite runs on a file in the test's temp dir; PostgreSQL and MySQL run
+// when S2_TEST_POSTGRES_DSN or S2_TEST_MYSQL_DSN names a scratch database,
+// whose call path tables they empty.
+var contractDSNs = map[string]string{
+    "postgres": "S2_TEST_POSTGRES_DSN",
+    "mysql":    "S2_TEST_MYSQL_DSN",
+}
+
+// contractStore is one backend under test with its clock
+type contractStore struct {
+    Storage
+    clock *clock.Fake
+}
+
+// newContractStore opens driver on a clean database; cooldown is the DID
+// cooldown of the storage it returns
+func newContractStore(t *testing.T, driver string, cooldown time.Duration) *contractStore {
+    t.Helper()
+    backend := storageBackends[driver]
+    dsn := "file:" + filepath.Join(t.TempDir(), "s2.db") + "?_pragma=busy_timeout(5000)"
+    if env, ok := contractDSNs[driver]; ok {
+        if dsn = os.Getenv(env); dsn == "" {
+            t.Skipf("%s not set", env)
+        }
+    }
+    db, err := sql.Open(backend.sqlDriver, dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.Close() })
+    if backend.maxConns > 0 {
+        db.SetMaxOpenConns(backend.maxConns)
+    }
+    if err := backend.createTables(db); err != nil {
+        t.Fatal(err)
+    }
+    for _, table := range []string{"call_events", "call_records", "dids"} {
+        if _, err := db.Exec("DELETE FROM " + table); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Near the database's own time, for the MySQL statements that still
+    // read it
+    fake := clock.NewFake(time.Now().UTC().Truncate(time.Second))
+    store := backend.open(db, 5*time.Second, cooldown, fake.Now)
+    if err := store.Prepare(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    return &contractStore{Storage: store, clock: fake}
+}
+
+// freeDIDs adds dids to the default pool, free
+func (s *contractStore) freeDIDs(t *testing.T, country string, dids ...string) {
+    t.Helper()
+    ctx := context.Background()
+    for _, did := range dids {
+        if ok, err := s.InsertClaimedDID(ctx, did, "seed", country, ""); err != nil || !ok {
+            t.Fatalf("insert %s: %v, %v", did, ok, err)
+        }
+        if _, err := s.ReleaseDID(ctx, did, ""); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func (s *contractStore) startCall(t *testing.T, callID, did string, started time.Time) {
+    t.Helper()
+    err := s.StoreCallRecord(context.Background(), &models.CallRecord{
+        CallID:       callID,
+        OriginalANI:  "15550001",
+        OriginalDNIS: "4420001",
+        AssignedDID:  did,
+        Status:       models.CallStateActive,
+        StartTime:    started,
+        MatchToken:   "tok-" + callID,
+        Tags:         map[string]string{"campaign": "spring"},
+        Tenant:       "acme",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func runContract(t *testing.T, name string, cooldown time.Duration, test func(t *testing.T, s *contractStore)) {
+    t.Run(name, func(t *testing.T) {
+        for _, driver := range StorageDrivers() {
+            driver := driver
+            t.Run(driver, func(t *testing.T) {
+                test(t, newContractStore(t, driver, cooldown))
+            })
+        }
+    })
+}
+
+func TestStorageContract(t *testing.T) {
+    ctx := context.Background()
+
+    runContract(t, "claim and release", 0, func(t *testing.T, s *contractStore) {
+        if ok, err := s.InsertClaimedDID(ctx, "100", "s3", "US", ""); err != nil || !ok {
+            t.Fatalf("first insert: %v, %v", ok, err)
+        }
+        if ok, err := s.InsertClaimedDID(ctx, "100", "s3", "US", ""); err != nil || ok {
+            t.Fatalf("second insert of the same DID: %v, %v", ok, err)
+        }
+        if ok, err := s.ClaimDID(ctx, "100", "s3"); err != nil || ok {
+            t.Fatalf("claim of a DID in use: %v, %v", ok, err)
+        }
+        if released, err := s.ReleaseDID(ctx, "100", ""); err != nil || !released {
+            t.Fatalf("release: %v, %v", released, err)
+        }
+        if ok, err := s.ClaimDID(ctx, "100", "s3"); err != nil || !ok {
+            t.Fatalf("claim of a released DID: %v, %v", ok, err)
+        }
+        if total, used, err := s.DIDCounts(ctx); err != nil || total != 1 || used != 1 {
+            t.Fatalf("counts %d/%d, %v", total, used, err)
+        }
+    })
+
+    runContract(t, "release guard", 0, func(t *testing.T, s *contractStore) {
+        s.freeDIDs(t, "", "100")
+        if ok, err := s.ClaimDID(ctx, "100", "s3"); err != nil || !ok {
+            t.Fatalf("claim: %v, %v", ok, err)
+        }
+        s.startCall(t, "call-2", "100", s.clock.Now())
+        if released, err := s.ReleaseDID(ctx, "100", "call-1"); err != nil || released {
+            t.Fatalf("release for a call no longer holding the DID: %v, %v", released, err)
+        }
+        if _, used, err := s.DIDCounts(ctx); err != nil || used != 1 {
+            t.Fatalf("%d DIDs in use, %v", used, err)
+        }
+        if released, err := s.ReleaseDID(ctx, "100", "call-2"); err != nil || !released {
+            t.Fatalf("release for the holder: %v, %v", released, err)
+        }
+    })
+
+    runContract(t, "picks", 0, func(t *testing.T, s *contractStore) {
+        if _, err := s.PickFreeDID(ctx, DIDFilter{}); err != sql.ErrNoRows {
+            t.Fatalf("pick from an empty table: %v", err)
+        }
+        for _, did := range []string{"100", "101", "102"} {
+            s.freeDIDs(t, "US", did)
+            s.clock.Advance(time.Minute)
+        }
+        s.freeDIDs(t, "GB", "200")
+
+        for i := 0; i < 10; i++ {
+            did, err := s.PickFreeDID(ctx, DIDFilter{Country: "US"})
+            if err != nil || (did != "100" && did != "101" && did != "102") {
+                t.Fatalf("random US pick %q, %v", did, err)
+            }
+        }
+        if _, err := s.PickFreeDID(ctx, DIDFilter{Country: "FR"}); err != sql.ErrNoRows {
+            t.Fatalf("pick with no DID in the country: %v", err)
+        }
+        if _, err := s.PickFreeDID(ctx, DIDFilter{Pool: "premium"}); err != sql.ErrNoRows {
+            t.Fatalf("pick from an empty pool: %v", err)
+        }
+
+        if did, err := s.PickLeastRecentDID(ctx, DIDFilter{Country: "US"}, 0); err != nil || did != "100" {
+            t.Fatalf("least recent %q, %v", did, err)
+        }
+        if did, err := s.PickLeastRecentDID(ctx, DIDFilter{Country: "US"}, 1); err != nil || did != "101" {
+            t.Fatalf("second least recent %q, %v", did, err)
+        }
+        if did, err := s.PickFreeDIDAfter(ctx, DIDFilter{Country: "US"}, "100"); err != nil || did != "101" {
+            t.Fatalf("after 100 %q, %v", did, err)
+        }
+        if did, err := s.PickFreeDIDAfter(ctx, DIDFilter{Country: "US"}, "102"); err != nil || did != "100" {
+            t.Fatalf("after 102 should wrap, got %q, %v", did, err)
+        }
+
+        if ok, err := s.ClaimDID(ctx, "101", "s3"); err != nil || !ok {
+            t.Fatalf("claim: %v, %v", ok, err)
+        }
+        if did, err := s.PickFreeDIDAfter(ctx, DIDFilter{Country: "US"}, "100"); err != nil || did != "102" {
+            t.Fatalf("after 100 with 101 claimed %q, %v", did, err)
+        }
+    })
+
+    runContract(t, "cooldown", 30*time.Second, func(t *testing.T, s *contractStore) {
+        s.freeDIDs(t, "", "100")
+        if _, err := s.PickFreeDID(ctx, DIDFilter{}); err != sql.ErrNoRows {
+            t.Fatalf("pick inside the cooldown: %v", err)
+        }
+        s.clock.Advance(31 * time.Second)
+        if did, err := s.PickFreeDID(ctx, DIDFilter{}); err != nil || did != "100" {
+            t.Fatalf("pick after the cooldown %q, %v", did, err)
+        }
+    })
+
+    runContract(t, "call lifecycle", 0, func(t *testing.T, s *contractStore) {
+        started := s.clock.Now()
+        s.startCall(t, "call-1", "100", started)
+        // The upsert keeps one row per call
+        s.startCall(t, "call-1", "100", started)
+
+        byDID, err := s.CallRecordByDID(ctx, "100")
+        if err != nil || byDID.CallID != "call-1" || !byDID.StartTime.Equal(started) ||
+            byDID.Tags["campaign"] != "spring" || byDID.Tenant != "acme" {
+            t.Fatalf("by DID %+v, %v", byDID, err)
+        }
+        if byToken, err := s.CallRecordByToken(ctx, "tok-call-1"); err != nil || byToken.CallID != "call-1" {
+            t.Fatalf("by token %+v, %v", byToken, err)
+        }
+        if err := s.UpdateCallStatus(ctx, "call-1", models.CallStateForwarded); err != nil {
+            t.Fatal(err)
+        }
+        if record, err := s.InFlightCallRecord(ctx, "call-1"); err != nil || record.Status != models.CallStateForwarded {
+            t.Fatalf("in flight %+v, %v", record, err)
+        }
+        if records, err := s.InFlightCallRecords(ctx); err != nil || len(records) != 1 {
+            t.Fatalf("in flight records %d, %v", len(records), err)
+        }
+        if records, err := s.UnfinishedCallRecords(ctx, started.Add(-time.Hour)); err != nil || len(records) != 1 {
+            t.Fatalf("unfinished records %d, %v", len(records), err)
+        }
+
+        s.clock.Advance(10 * time.Second)
+        if err := s.UpdateCallStatus(ctx, "call-1", models.CallStateCompleted); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.RecordHangupCause(ctx, "call-1", "16"); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := s.CallRecordByDID(ctx, "100"); err != sql.ErrNoRows {
+            t.Fatalf("a completed call is not in flight: %v", err)
+        }
+        detail, err := s.CallDetail(ctx, "call-1")
+        if err != nil || detail == nil {
+            t.Fatalf("detail %+v, %v", detail, err)
+        }
+        if detail.Status != models.CallStateCompleted || detail.Duration != 10 || detail.HangupCause != "16" ||
+            detail.EndTime == nil || !detail.EndTime.Equal(s.clock.Now()) || detail.MatchToken != "tok-call-1" {
+            t.Fatalf("detail %+v", detail)
+        }
+        if detail, err := s.CallDetail(ctx, "call-none"); err != nil || detail != nil {
+            t.Fatalf("detail of an unknown call %+v, %v", detail, err)
+        }
+
+        statuses, err := s.CallStatuses(ctx, []string{"call-1", "call-none"})
+        if err != nil || len(statuses) != 1 || statuses["call-1"] != models.CallStateCompleted {
+            t.Fatalf("statuses %v, %v", statuses, err)
+        }
+        if n, err := s.CallsEnded(ctx, started, s.clock.Now()); err != nil || n != 1 {
+            t.Fatalf("ended %d, %v", n, err)
+        }
+        if n, err := s.CallsEnded(ctx, s.clock.Now(), s.clock.Now().Add(time.Minute)); err != nil || n != 0 {
+            t.Fatalf("ended after the call %d, %v", n, err)
+        }
+
+        if err := s.BackdateCallEnd(ctx, "call-1", started.Add(4*time.Second)); err != nil {
+            t.Fatal(err)
+        }
+        history, err := s.DIDHistory(ctx, "100", started.Add(-time.Minute), started.Add(time.Minute), 10)
+        if err != nil || len(history) != 1 {
+            t.Fatalf("history %+v, %v", history, err)
+        }
+        if h := history[0]; h.CallID != "call-1" || h.Duration != 4 || h.EndTime == nil || !h.EndTime.Equal(started.Add(4*time.Second)) {
+            t.Fatalf("backdated history %+v", h)
+        }
+        if calls, completed, err := s.CallCounts(ctx); err != nil || calls != 1 || completed != 1 {
+            t.Fatalf("counts %d/%d, %v", calls, completed, err)
+        }
+    })
+
+    runContract(t, "batches", 0, func(t *testing.T, s *contractStore) {
+        started := s.clock.Now()
+        var records []*models.CallRecord
+        for _, id := range []string{"call-1", "call-2", "call-3"} {
+            records = append(records, &models.CallRecord{
+                CallID: id, AssignedDID: "100", Status: models.CallStateActive, StartTime: started,
+            })
+        }
+        if err := s.StoreCallRecords(ctx, records); err != nil {
+            t.Fatal(err)
+        }
+        s.clock.Advance(3 * time.Second)
+        if err := s.UpdateCallStatuses(ctx, []string{"call-1", "call-2"}, models.CallStateFailed); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.RecordHangupCauses(ctx, []string{"call-1", "call-2"}, "17"); err != nil {
+            t.Fatal(err)
+        }
+
+        calls, total, err := s.ListCalls(ctx, CallFilter{Status: models.CallStateFailed}, 0, 10)
+        if err != nil || total != 2 || len(calls) != 2 {
+            t.Fatalf("failed calls %+v, %d, %v", calls, total, err)
+        }
+        for _, c := range calls {
+            if c.Duration != 3 || c.HangupCause != "17" {
+                t.Fatalf("failed call %+v", c)
+            }
+        }
+        if calls, total, err := s.ListCalls(ctx, CallFilter{DID: "100"}, 2, 2); err != nil || total != 3 || len(calls) != 1 {
+            t.Fatalf("second page %+v, %d, %v", calls, total, err)
+        }
+        if _, total, err := s.ListCalls(ctx, CallFilter{From: started.Add(time.Second)}, 0, 10); err != nil || total != 0 {
+            t.Fatalf("calls after the batch %d, %v", total, err)
+        }
+    })
+
+    runContract(t, "stale calls", 0, func(t *testing.T, s *contractStore) {
+        s.freeDIDs(t, "", "100", "101")
+
+        // call-1 goes stale on 100. call-2 goes stale on 101, which is
+        // then handed to call-3, still live: the sweep must not free it.
+        for _, did := range []string{"100", "101"} {
+            if ok, err := s.ClaimDID(ctx, did, "s3"); err != nil || !ok {
+                t.Fatalf("claim %s: %v, %v", did, ok, err)
+            }
+        }
+        s.startCall(t, "call-1", "100", s.clock.Now())
+        s.startCall(t, "call-2", "101", s.clock.Now())
+        s.clock.Advance(staleCallAge - time.Second)
+        if n, err := s.FailStaleCalls(ctx); err != nil || n != 0 {
+            t.Fatalf("failed %d calls within their reservation TTL, %v", n, err)
+        }
+        s.clock.Advance(2 * time.Second)
+        s.startCall(t, "call-3", "101", s.clock.Now())
+
+        n, err := s.FailStaleCalls(ctx)
+        if err != nil || n != 2 {
+            t.Fatalf("failed %d stale calls, %v", n, err)
+        }
+        statuses, err := s.CallStatuses(ctx, []string{"call-1", "call-2", "call-3"})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if statuses["call-1"] != models.CallStateFailed || statuses["call-2"] != models.CallStateFailed ||
+            statuses["call-3"] != models.CallStateActive {
+            t.Fatalf("statuses after the sweep %v", statuses)
+        }
+        if did, err := s.PickFreeDID(ctx, DIDFilter{}); err != nil || did != "100" {
+            t.Fatalf("only the stale call's DID is free, picked %q, %v", did, err)
+        }
+        if _, used, err := s.DIDCounts(ctx); err != nil || used != 1 {
+            t.Fatalf("%d DIDs in use after the sweep, %v", used, err)
+        }
+        events, err := s.CallEvents(ctx, "call-1")
+        if err != nil || len(events) != 1 || events[0].Event != "FAILED" || events[0].Detail != "stale" ||
+            !events[0].At.Equal(s.clock.Now()) {
+            t.Fatalf("stale call events %+v at %s, %v", events, s.clock.Now(), err)
+        }
+        if n, err := s.FailStaleCalls(ctx); err != nil || n != 0 {
+            t.Fatalf("second sweep failed %d, %v", n, err)
+        }
+    })
+
+    runContract(t, "events", 0, func(t *testing.T, s *contractStore) {
+        at := s.clock.Now()
+        for i, event := range []string{"ACTIVE", "FORWARDED_TO_S3"} {
+            e := models.CallEvent{Event: event, At: at.Add(time.Duration(i) * time.Millisecond), RequestID: "req-1"}
+            if err := s.RecordCallEvent(ctx, "call-1", e); err != nil {
+                t.Fatal(err)
+            }
+        }
+        events, err := s.CallEvents(ctx, "call-1")
+        if err != nil || len(events) != 2 {
+            t.Fatalf("events %+v, %v", events, err)
+        }
+        if events[0].Event != "ACTIVE" || events[1].Event != "FORWARDED_TO_S3" || events[0].RequestID != "req-1" ||
+            !events[1].At.Equal(at.Add(time.Millisecond)) {
+            t.Fatalf("events %+v", events)
+        }
+        if events, err := s.CallEvents(ctx, "call-none"); err != nil || len(events) != 0 {
+            t.Fatalf("events of an unknown call %+v, %v", events, err)
+        }
+    })
+}
+
+// Partitioned picks hash with MySQL's CRC32; elsewhere they fail rather
+// than pick from the whole table
+func TestPartitionedPickNeedsMySQL(t *testing.T) {
+    for _, driver := range []string{"postgres", "sqlite"} {
+        s := storageBackends[driver].open(nil, time.Second, 0, time.Now)
+        _, err := s.PickFreeDID(context.Background(), DIDFilter{Partitions: 4, Partition: 1})
+        if !errors.Is(err, errPartitionsNeedMySQL) {
+            t.Errorf("%s: partitioned pick returned %v", driver, err)
+        }
+    }
+}
+
+// A router on SQLite routes a call end to end, with no MySQL anywhere
+func TestSQLiteRouterRoutesCalls(t *testing.T) {
+    dsn := "file:" + filepath.Join(t.TempDir(), "s2.db") + "?_pragma=busy_timeout(5000)"
+    r, err := NewRouter(dsn, Config{StorageDriver: "sqlite"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+    if r.FeatureTables() {
+        t.Fatal("sqlite reports the feature tables")
+    }
+    ctx := context.Background()
+    for _, did := range []string{"18005550100", "18005550101"} {
+        if _, err := r.store.InsertClaimedDID(ctx, did, "seed", "", ""); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := r.store.ReleaseDID(ctx, did, ""); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    resp, err := r.ProcessIncomingCall(ctx, "call-1", "12125550001", "442075550001", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.ProcessReturnCall(ctx, "12125550001", resp.DIDAssigned, ReturnOptions{}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.CompleteCall(ctx, "call-1", "16"); err != nil {
+        t.Fatal(err)
+    }
+    detail, err := r.store.CallDetail(ctx, "call-1")
+    if err != nil || detail == nil || detail.Status != models.CallStateCompleted || detail.DID != resp.DIDAssigned {
+        t.Fatalf("detail %+v, %v", detail, err)
+    }
+    if _, used, err := r.store.DIDCounts(ctx); err != nil || used != 0 {
+        t.Fatalf("%d DIDs in use after the call, %v", used, err)
+    }
+}
+
+func TestStorageDriverSettings(t *testing.T) {
+    dsn := "file:" + filepath.Join(t.TempDir(), "s2.db")
+    if _, err := NewRouter(dsn, Config{StorageDriver: "oracle"}); err == nil || !strings.Contains(err.Error(), "available: mysql, postgres, sqlite") {
+        t.Errorf("unknown driver: %v", err)
+    }
+    _, err := NewRouter(dsn, Config{StorageDriver: "sqlite", WebhookURLs: []string{"http://hooks"}, StatelessKey: "k"})
+    if err == nil || !strings.Contains(err.Error(), "need the mysql storage driver") {
+        t.Errorf("mysql-only settings on sqlite: %v", err)
+    }
+}
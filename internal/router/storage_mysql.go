@@ -0,0 +1,853 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    mathrand "math/rand"
+    "strings"
+    "time"
+
+    "github.com/go-sql-driver/mysql"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// MySQL error for a duplicate unique key
+const mysqlDuplicateEntry = 1062
+
+type mysqlStorage struct {
+    db       *sql.DB
+    timeout  time.Duration
+    cooldown time.Duration
+    now      func() time.Time     // the router's clock, bound in place of NOW() in every query
+    queries  map[string]string    // call path statements by name
+    stmts    map[string]*sql.Stmt // the same, prepared by Prepare
+}
+
+func newMySQLStorage(db *sql.DB, timeout, cooldown time.Duration, now func() time.Time) Storage {
+    s := &mysqlStorage{db: db, timeout: timeout, cooldown: cooldown, now: now}
+    s.queries = s.callPathQueries()
+    return s
+}
+
+// Call record writes, shared by the prepared single-row statements and
+// the batched multi-row ones
+const (
+    callRecordInsert = `
+        INSERT INTO call_records
+        (call_id, original_ani, original_dnis, assigned_did, status, start_time, recording_path, match_token, settlement_class, tags, campaign_id, forward_trunk, tenant_id, trace_parent,
+        dest_country, dest_region, dest_type)
+        VALUES `
+    callRecordRow    = `(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''))`
+    callRecordUpsert = `
+        ON DUPLICATE KEY UPDATE
+        status = VALUES(status),
+        assigned_did = VALUES(assigned_did),
+        match_token = VALUES(match_token),
+        updated_at = ?
+    `
+    statusUpdate = `
+        UPDATE call_records
+        SET status = ?,
+            end_time = CASE WHEN ? IN ('COMPLETED_AT_S4', 'FAILED') THEN ? ELSE end_time END,
+            duration = CASE WHEN ? IN ('COMPLETED_AT_S4', 'FAILED') THEN TIMESTAMPDIFF(SECOND, start_time, ?) ELSE duration END
+        WHERE `
+)
+
+// callPathQueries is the SQL run on every call. A free DID lookup comes in
+// one shape per combination of the optional filters, each prepared.
+func (s *mysqlStorage) callPathQueries() map[string]string {
+    queries := map[string]string{
+        "pick_bounds": "SELECT MIN(id), MAX(id) FROM dids",
+        "claim": `
+            UPDATE dids
+            SET in_use = 1, destination = ?, last_used_at = ?, updated_at = ?
+            WHERE did = ? AND in_use = 0
+        `,
+        "release": `
+            UPDATE dids
+            SET in_use = 0, destination = NULL, last_released_at = ?, updated_at = ?
+            WHERE did = ?
+            AND NOT EXISTS (
+                SELECT 1 FROM call_records
+                WHERE call_records.assigned_did = dids.did AND call_id <> ?
+                AND status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+                AND ` + inFlightWindow + `
+            )
+        `,
+        "insert_call":   callRecordInsert + callRecordRow + callRecordUpsert,
+        "update_status": statusUpdate + "call_id = ?",
+        "hangup_cause":  "UPDATE call_records SET hangup_cause = ? WHERE call_id = ?",
+    }
+    for _, country := range []bool{false, true} {
+        for _, partitioned := range []bool{false, true} {
+            where := s.freeWhere(country, partitioned)
+            queries[pickName("pick", country, partitioned)] = `
+                SELECT did FROM dids
+                WHERE ` + where + ` AND id >= ?
+                ORDER BY id
+                LIMIT 1
+            `
+            queries[pickName("pick_wrap", country, partitioned)] = `
+                SELECT did FROM dids
+                WHERE ` + where + ` AND id < ?
+                ORDER BY id
+                LIMIT 1
+            `
+        }
+    }
+    return queries
+}
+
+// pickName names the free DID lookup for a filter shape
+func pickName(base string, country, partitioned bool) string {
+    if country {
+        base += "_country"
+    }
+    if partitioned {
+        base += "_partition"
+    }
+    return base
+}
+
+// Prepare parses the call path statements once, so calls skip the parse.
+// It needs the schema, so runs after createTables.
+func (s *mysqlStorage) Prepare(ctx context.Context) error {
+    stmts := make(map[string]*sql.Stmt, len(s.queries))
+    for name, query := range s.queries {
+        stmt, err := s.db.PrepareContext(ctx, query)
+        if err != nil {
+            for _, stmt := range stmts {
+                stmt.Close()
+            }
+            return &StatementError{Statement: name, Prepare: true, Err: err}
+        }
+        stmts[name] = stmt
+    }
+    s.stmts = stmts
+    return nil
+}
+
+// exec runs the named call path statement, prepared when Prepare has run
+func (s *mysqlStorage) exec(ctx context.Context, name string, args ...interface{}) (sql.Result, error) {
+    var result sql.Result
+    var err error
+    if stmt := s.stmts[name]; stmt != nil {
+        result, err = stmt.ExecContext(ctx, args...)
+    } else {
+        result, err = s.db.ExecContext(ctx, s.queries[name], args...)
+    }
+    if err != nil {
+        return nil, &StatementError{Statement: name, Err: err}
+    }
+    return result, nil
+}
+
+// scan reads one row of the named call path statement into dest.
+// sql.ErrNoRows comes back as it is.
+func (s *mysqlStorage) scan(ctx context.Context, name string, args []interface{}, dest ...interface{}) error {
+    var row *sql.Row
+    if stmt := s.stmts[name]; stmt != nil {
+        row = stmt.QueryRowContext(ctx, args...)
+    } else {
+        row = s.db.QueryRowContext(ctx, s.queries[name], args...)
+    }
+    err := row.Scan(dest...)
+    if err != nil && err != sql.ErrNoRows {
+        return &StatementError{Statement: name, Err: err}
+    }
+    return err
+}
+
+// free is the condition for a free DID matching f, skipping DIDs still in
+// their cooldown or quarantine, and its arguments. Both sides of the
+// cooldown use the router's clock.
+func (s *mysqlStorage) free(f DIDFilter) (string, []interface{}) {
+    now := s.now()
+    args := []interface{}{f.Tenant, f.Pool, now}
+    if f.Country != "" {
+        args = append(args, f.Country)
+    }
+    if f.Partitions > 0 {
+        args = append(args, f.Partitions, f.Partition)
+    }
+    if s.cooldown > 0 {
+        args = append(args, now.Add(-s.cooldown))
+    }
+    return s.freeWhere(f.Country != "", f.Partitions > 0), args
+}
+
+// freeWhere is the condition free builds for a filter shape
+func (s *mysqlStorage) freeWhere(country, partitioned bool) string {
+    where := "in_use = 0 AND tenant_id = ? AND pool = ? AND (quarantined_until IS NULL OR quarantined_until <= ?)"
+    if country {
+        where += " AND country = ?"
+    }
+    if partitioned {
+        where += " AND CRC32(did) % ? = ?"
+    }
+    if s.cooldown > 0 {
+        where += " AND (last_released_at IS NULL OR last_released_at <= ?)"
+    }
+    return where
+}
+
+// PickFreeDID starts at a random id and takes the next free DID from there,
+// wrapping to the lowest. Unlike ORDER BY RAND() both lookups are range
+// reads on idx_pool_free, which carries the primary key.
+func (s *mysqlStorage) PickFreeDID(ctx context.Context, f DIDFilter) (string, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    var low, high sql.NullInt64
+    if err := s.scan(ctx, "pick_bounds", nil, &low, &high); err != nil {
+        return "", err
+    }
+    if !low.Valid {
+        return "", sql.ErrNoRows
+    }
+    start := low.Int64 + mathrand.Int63n(high.Int64-low.Int64+1)
+
+    _, args := s.free(f)
+    args = append(args, start)
+    country, partitioned := f.Country != "", f.Partitions > 0
+    var did string
+    err := s.scan(ctx, pickName("pick", country, partitioned), args, &did)
+    if err == sql.ErrNoRows {
+        err = s.scan(ctx, pickName("pick_wrap", country, partitioned), args, &did)
+    }
+    return did, err
+}
+
+func (s *mysqlStorage) PickLeastRecentDID(ctx context.Context, f DIDFilter, skip int) (string, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    where, args := s.free(f)
+    var did string
+    err := s.db.QueryRowContext(ctx, `
+        SELECT did FROM dids
+        WHERE `+where+`
+        ORDER BY last_used_at, id
+        LIMIT 1 OFFSET ?
+    `, append(args, skip)...).Scan(&did)
+    return did, err
+}
+
+func (s *mysqlStorage) PickFreeDIDAfter(ctx context.Context, f DIDFilter, after string) (string, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    where, args := s.free(f)
+    var did string
+    err := s.db.QueryRowContext(ctx, `
+        SELECT did FROM dids
+        WHERE `+where+` AND did > ?
+        ORDER BY did
+        LIMIT 1
+    `, append(args, after)...).Scan(&did)
+    if err == sql.ErrNoRows && after != "" {
+        err = s.db.QueryRowContext(ctx, `
+            SELECT did FROM dids
+            WHERE `+where+`
+            ORDER BY did
+            LIMIT 1
+        `, args...).Scan(&did)
+    }
+    return did, err
+}
+
+func (s *mysqlStorage) ClaimDID(ctx context.Context, did, destination string) (bool, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    result, err := s.exec(ctx, "claim", destination, now, now, did)
+    if err != nil {
+        return false, err
+    }
+
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return false, err
+    }
+    return rows == 1, nil
+}
+
+func (s *mysqlStorage) InsertClaimedDID(ctx context.Context, did, destination, country, tenant string) (bool, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.db.ExecContext(ctx, `
+        INSERT INTO dids (did, in_use, destination, country, tenant_id, last_used_at)
+        VALUES (?, 1, ?, NULLIF(?, ''), ?, ?)
+    `, did, destination, country, tenant, s.now())
+    if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlDuplicateEntry {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (s *mysqlStorage) ReleaseDID(ctx context.Context, did, callID string) (bool, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    result, err := s.exec(ctx, "release", now, now, did, callID, now)
+    if err != nil {
+        return false, err
+    }
+    rows, err := result.RowsAffected()
+    return rows == 1, err
+}
+
+func (s *mysqlStorage) DIDCounts(ctx context.Context) (total, used int, err error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    var inUse sql.NullInt64
+    err = s.db.QueryRowContext(ctx, "SELECT COUNT(*), SUM(CASE WHEN in_use = 1 THEN 1 ELSE 0 END) FROM dids").Scan(&total, &inUse)
+    return total, int(inUse.Int64), err
+}
+
+func (s *mysqlStorage) StoreCallRecord(ctx context.Context, record *models.CallRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.exec(ctx, "insert_call", append(callRecordArgs(record), s.now())...)
+    return err
+}
+
+// callRecordArgs are the values of one callRecordRow
+func callRecordArgs(record *models.CallRecord) []interface{} {
+    return []interface{}{
+        record.CallID,
+        record.OriginalANI,
+        record.OriginalDNIS,
+        record.AssignedDID,
+        record.Status,
+        record.StartTime,
+        record.RecordingPath,
+        record.MatchToken,
+        record.SettlementClass,
+        encodeTags(record.Tags),
+        record.Campaign,
+        record.ForwardTrunk,
+        record.Tenant,
+        record.TraceParent,
+        record.Destination.Country,
+        record.Destination.Region,
+        record.Destination.Type,
+    }
+}
+
+func (s *mysqlStorage) UpdateCallStatus(ctx context.Context, callID string, status models.CallState) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    _, err := s.exec(ctx, "update_status", status, status, now, status, now, callID)
+    return err
+}
+
+func (s *mysqlStorage) RecordHangupCause(ctx context.Context, callID, cause string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.exec(ctx, "hangup_cause", cause, callID)
+    return err
+}
+
+func (s *mysqlStorage) StoreCallRecords(ctx context.Context, records []*models.CallRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    args := make([]interface{}, 0, len(records)*17+1)
+    for _, record := range records {
+        args = append(args, callRecordArgs(record)...)
+    }
+    args = append(args, s.now())
+    query := callRecordInsert + callRecordRow + strings.Repeat(", "+callRecordRow, len(records)-1) + callRecordUpsert
+    if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+        return &StatementError{Statement: "insert_calls", Err: err}
+    }
+    return nil
+}
+
+func (s *mysqlStorage) UpdateCallStatuses(ctx context.Context, callIDs []string, status models.CallState) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    args := []interface{}{status, status, now, status, now}
+    for _, callID := range callIDs {
+        args = append(args, callID)
+    }
+    query := statusUpdate + "call_id IN (?" + strings.Repeat(", ?", len(callIDs)-1) + ")"
+    if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+        return &StatementError{Statement: "update_statuses", Err: err}
+    }
+    return nil
+}
+
+func (s *mysqlStorage) RecordHangupCauses(ctx context.Context, callIDs []string, cause string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    args := []interface{}{cause}
+    for _, callID := range callIDs {
+        args = append(args, callID)
+    }
+    query := "UPDATE call_records SET hangup_cause = ? WHERE call_id IN (?" + strings.Repeat(", ?", len(callIDs)-1) + ")"
+    if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+        return &StatementError{Statement: "hangup_causes", Err: err}
+    }
+    return nil
+}
+
+// Columns read by scanCallRecord, in order
+const callRecordColumns = `call_id, original_ani, original_dnis, assigned_did, status, start_time, recording_path,
+        COALESCE(match_token, ''), COALESCE(settlement_class, ''), tags, COALESCE(campaign_id, ''), COALESCE(forward_trunk, ''),
+        COALESCE(tenant_id, ''), COALESCE(trace_parent, ''), COALESCE(dest_country, ''), COALESCE(dest_region, ''), COALESCE(dest_type, '')`
+
+type rowScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+func scanCallRecord(row rowScanner) (*models.CallRecord, error) {
+    record := &models.CallRecord{}
+    var tags sql.NullString
+    err := row.Scan(
+        &record.CallID,
+        &record.OriginalANI,
+        &record.OriginalDNIS,
+        &record.AssignedDID,
+        &record.Status,
+        &record.StartTime,
+        &record.RecordingPath,
+        &record.MatchToken,
+        &record.SettlementClass,
+        &tags,
+        &record.Campaign,
+        &record.ForwardTrunk,
+        &record.Tenant,
+        &record.TraceParent,
+        &record.Destination.Country,
+        &record.Destination.Region,
+        &record.Destination.Type,
+    )
+    if err != nil {
+        return nil, err
+    }
+
+    record.Tags = decodeTags(tags)
+    if record.ForwardTrunk == "" {
+        record.ForwardTrunk = trunkS3
+    }
+    return record, nil
+}
+
+func (s *mysqlStorage) CallRecordByDID(ctx context.Context, did string) (*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    query := `
+        SELECT ` + callRecordColumns + `
+        FROM call_records
+        WHERE assigned_did = ?
+        AND status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+        AND ` + inFlightWindow + `
+        ORDER BY start_time DESC
+        LIMIT 1
+    `
+
+    return scanCallRecord(s.db.QueryRowContext(ctx, query, did, s.now()))
+}
+
+func (s *mysqlStorage) CallRecordByToken(ctx context.Context, token string) (*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    query := `
+        SELECT ` + callRecordColumns + `
+        FROM call_records
+        WHERE match_token = ?
+        AND status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+        AND ` + inFlightWindow + `
+        ORDER BY start_time DESC
+        LIMIT 1
+    `
+
+    return scanCallRecord(s.db.QueryRowContext(ctx, query, token, s.now()))
+}
+
+func (s *mysqlStorage) InFlightCallRecord(ctx context.Context, callID string) (*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    query := `
+        SELECT ` + callRecordColumns + `
+        FROM call_records
+        WHERE call_id = ?
+        AND status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+        ORDER BY start_time DESC
+        LIMIT 1
+    `
+
+    return scanCallRecord(s.db.QueryRowContext(ctx, query, callID))
+}
+
+func (s *mysqlStorage) InFlightCallRecords(ctx context.Context) ([]*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    query := `
+        SELECT ` + callRecordColumns + `
+        FROM call_records
+        WHERE status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+        AND ` + inFlightWindow + `
+    `
+
+    rows, err := s.db.QueryContext(ctx, query, s.now())
+    if err != nil {
+        return nil, err
+    }
+    return scanCallRecords(rows)
+}
+
+func (s *mysqlStorage) UnfinishedCallRecords(ctx context.Context, since time.Time) ([]*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    query := `
+        SELECT ` + callRecordColumns + `
+        FROM call_records
+        WHERE status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+        AND start_time > ?
+    `
+
+    rows, err := s.db.QueryContext(ctx, query, since)
+    if err != nil {
+        return nil, err
+    }
+    return scanCallRecords(rows)
+}
+
+func scanCallRecords(rows *sql.Rows) ([]*models.CallRecord, error) {
+    defer rows.Close()
+    var records []*models.CallRecord
+    for rows.Next() {
+        record, err := scanCallRecord(rows)
+        if err != nil {
+            return records, err
+        }
+        records = append(records, record)
+    }
+    return records, rows.Err()
+}
+
+// A call is in flight for its tenant's reservation TTL until it returns
+// from S3 and for its stale timeout after; both default to staleCallAge.
+// The ? is the router's clock, so that the window agrees with isInFlight.
+var (
+    inFlightWindow = "start_time > DATE_SUB(?, INTERVAL CASE WHEN status = 'RETURNED_FROM_S3' THEN " +
+        tenantSeconds("stale_timeout") + " ELSE " + tenantSeconds("reservation_ttl") + " END SECOND)"
+    staleReservation = "start_time < DATE_SUB(?, INTERVAL " + tenantSeconds("reservation_ttl") + " SECOND)"
+)
+
+// FailStaleCalls locks the calls past their reservation TTL, fails just
+// those and frees their DIDs, in one transaction. A DID is only freed while
+// it is still claimed and no call in flight holds it, so one that has been
+// handed to a new call since the stale call took it stays in use.
+func (s *mysqlStorage) FailStaleCalls(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, `
+        SELECT call_id, COALESCE(assigned_did, '')
+        FROM call_records
+        WHERE status IN ('ACTIVE', 'FORWARDED_TO_S3')
+        AND `+staleReservation+`
+        FOR UPDATE
+    `, now)
+    if err != nil {
+        return 0, err
+    }
+    var callIDs, dids []string
+    for rows.Next() {
+        var callID, did string
+        if err := rows.Scan(&callID, &did); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        callIDs = append(callIDs, callID)
+        if did != "" {
+            dids = append(dids, did)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    if len(callIDs) == 0 {
+        return 0, tx.Commit()
+    }
+
+    // Stale calls end their timeline with the failure
+    in, ids := inList(callIDs)
+    if _, err := tx.ExecContext(ctx, `
+        INSERT INTO call_events (call_id, event, at, detail)
+        SELECT call_id, 'FAILED', ?, 'stale'
+        FROM call_records
+        WHERE call_id IN `+in, append([]interface{}{now}, ids...)...); err != nil {
+        return 0, err
+    }
+    if _, err := tx.ExecContext(ctx, `
+        UPDATE call_records
+        SET status = 'FAILED', end_time = ?, updated_at = ?
+        WHERE call_id IN `+in, append([]interface{}{now, now}, ids...)...); err != nil {
+        return 0, err
+    }
+
+    if len(dids) > 0 {
+        in, args := inList(dids)
+        if _, err := tx.ExecContext(ctx, `
+            UPDATE dids d
+            SET d.in_use = 0, d.destination = NULL, d.last_released_at = ?, d.updated_at = ?
+            WHERE d.did IN `+in+`
+            AND d.in_use = 1
+            AND NOT EXISTS (
+                SELECT 1 FROM call_records
+                WHERE call_records.assigned_did = d.did
+                AND status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+                AND `+inFlightWindow+`
+            )
+        `, append(append([]interface{}{now, now}, args...), now)...); err != nil {
+            return 0, err
+        }
+    }
+    return int64(len(callIDs)), tx.Commit()
+}
+
+func (s *mysqlStorage) CallStatuses(ctx context.Context, callIDs []string) (map[string]models.CallState, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    args := make([]interface{}, len(callIDs))
+    for i, callID := range callIDs {
+        args[i] = callID
+    }
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT call_id, status FROM call_records
+        WHERE call_id IN (?`+strings.Repeat(", ?", len(callIDs)-1)+`)
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    return scanCallStatuses(rows)
+}
+
+// scanCallStatuses reads call_id, status rows into a map
+func scanCallStatuses(rows *sql.Rows) (map[string]models.CallState, error) {
+    defer rows.Close()
+    statuses := make(map[string]models.CallState)
+    for rows.Next() {
+        var callID string
+        var status models.CallState
+        if err := rows.Scan(&callID, &status); err != nil {
+            return nil, err
+        }
+        statuses[callID] = status
+    }
+    return statuses, rows.Err()
+}
+
+func (s *mysqlStorage) CallsEnded(ctx context.Context, from, to time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    var n int
+    err := s.db.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM call_records
+        WHERE status IN ('COMPLETED_AT_S4', 'FAILED') AND end_time > ? AND end_time <= ?
+    `, from, to).Scan(&n)
+    return n, err
+}
+
+func (s *mysqlStorage) BackdateCallEnd(ctx context.Context, callID string, end time.Time) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.db.ExecContext(ctx,
+        "UPDATE call_records SET end_time = ?, duration = GREATEST(TIMESTAMPDIFF(SECOND, start_time, ?), 0) WHERE call_id = ?",
+        end, end, callID)
+    return err
+}
+
+func (s *mysqlStorage) CallCounts(ctx context.Context) (calls, completed int, err error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    var done sql.NullInt64
+    err = s.db.QueryRowContext(ctx, `
+        SELECT
+            COUNT(*),
+            SUM(CASE WHEN status = 'COMPLETED_AT_S4' THEN 1 ELSE 0 END)
+        FROM call_records
+        WHERE DATE(start_time) = CURDATE()
+    `).Scan(&calls, &done)
+    return calls, int(done.Int64), err
+}
+
+func (s *mysqlStorage) DIDHistory(ctx context.Context, did string, from, to time.Time, limit int) ([]models.DIDCall, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT call_id, original_ani, original_dnis, status, start_time, end_time, duration,
+            COALESCE(hangup_cause, ''), COALESCE(campaign_id, ''), COALESCE(tenant_id, ''),
+            COALESCE(forward_trunk, '')
+        FROM call_records
+        WHERE assigned_did = ? AND start_time >= ? AND start_time < ?
+        ORDER BY start_time DESC
+        LIMIT ?
+    `, did, from, to, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    calls := []models.DIDCall{}
+    for rows.Next() {
+        var c models.DIDCall
+        var end sql.NullTime
+        if err := rows.Scan(&c.CallID, &c.ANI, &c.DNIS, &c.Status, &c.StartTime, &end, &c.Duration,
+            &c.HangupCause, &c.Campaign, &c.Tenant, &c.ForwardTrunk); err != nil {
+            return nil, err
+        }
+        if end.Valid {
+            c.EndTime = &end.Time
+        }
+        calls = append(calls, c)
+    }
+    return calls, rows.Err()
+}
+
+func (s *mysqlStorage) RecordCallEvent(ctx context.Context, callID string, event models.CallEvent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.db.ExecContext(ctx, `
+        INSERT INTO call_events (call_id, event, at, detail, request_id)
+        VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))
+    `, callID, event.Event, event.At, event.Detail, event.RequestID)
+    return err
+}
+
+func (s *mysqlStorage) CallEvents(ctx context.Context, callID string) ([]models.CallEvent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT event, at, COALESCE(detail, ''), COALESCE(request_id, '')
+        FROM call_events
+        WHERE call_id = ?
+        ORDER BY at, id
+    `, callID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    events := []models.CallEvent{}
+    for rows.Next() {
+        var e models.CallEvent
+        if err := rows.Scan(&e.Event, &e.At, &e.Detail, &e.RequestID); err != nil {
+            return nil, err
+        }
+        events = append(events, e)
+    }
+    return events, rows.Err()
+}
+
+func (s *mysqlStorage) ListCalls(ctx context.Context, f CallFilter, offset, limit int) ([]models.Call, int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+
+    where := "1 = 1"
+    var args []interface{}
+    if f.Status != "" {
+        where += " AND status = ?"
+        args = append(args, f.Status)
+    }
+    if f.ANI != "" {
+        where += " AND original_ani = ?"
+        args = append(args, f.ANI)
+    }
+    if f.DID != "" {
+        where += " AND assigned_did = ?"
+        args = append(args, f.DID)
+    }
+    if !f.From.IsZero() {
+        where += " AND start_time >= ?"
+        args = append(args, f.From)
+    }
+    if !f.To.IsZero() {
+        where += " AND start_time < ?"
+        args = append(args, f.To)
+    }
+
+    var total int
+    if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM call_records WHERE "+where, args...).Scan(&total); err != nil {
+        return nil, 0, err
+    }
+
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT `+callColumns+`
+        FROM call_records
+        WHERE `+where+`
+        ORDER BY start_time DESC, id DESC
+        LIMIT ? OFFSET ?
+    `, append(args, limit, offset)...)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    calls := []models.Call{}
+    for rows.Next() {
+        var c models.Call
+        if err := scanCall(rows, &c); err != nil {
+            return nil, 0, err
+        }
+        calls = append(calls, c)
+    }
+    return calls, total, rows.Err()
+}
+
+const callColumns = `call_id, original_ani, original_dnis, COALESCE(assigned_did, ''), status, start_time, end_time, duration,
+            COALESCE(hangup_cause, ''), COALESCE(settlement_class, ''), COALESCE(campaign_id, ''),
+            COALESCE(tenant_id, ''), COALESCE(forward_trunk, ''), tags`
+
+// scanCall reads the callColumns into c, followed by any extra columns
+func scanCall(row rowScanner, c *models.Call, extra ...interface{}) error {
+    var end sql.NullTime
+    var tags sql.NullString
+    dest := append([]interface{}{&c.CallID, &c.ANI, &c.DNIS, &c.DID, &c.Status, &c.StartTime, &end, &c.Duration,
+        &c.HangupCause, &c.SettlementClass, &c.Campaign, &c.Tenant, &c.ForwardTrunk, &tags}, extra...)
+    if err := row.Scan(dest...); err != nil {
+        return err
+    }
+    if end.Valid {
+        c.EndTime = &end.Time
+    }
+    c.Tags = decodeTags(tags)
+    return nil
+}
+
+// CallDetail falls back to call_records_archive for a call archived since
+func (s *mysqlStorage) CallDetail(ctx context.Context, callID string) (*models.CallDetail, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    for _, table := range []string{"call_records", "call_records_archive"} {
+        row := s.db.QueryRowContext(ctx, `
+            SELECT `+callColumns+`, COALESCE(match_token, ''), COALESCE(recording_path, ''), COALESCE(trace_parent, '')
+            FROM `+table+`
+            WHERE call_id = ?
+            ORDER BY start_time DESC, id DESC
+            LIMIT 1
+        `, callID)
+
+        var d models.CallDetail
+        err := scanCall(row, &d.Call, &d.MatchToken, &d.RecordingPath, &d.TraceParent)
+        if err == sql.ErrNoRows {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        return &d, nil
+    }
+    return nil, nil
+}
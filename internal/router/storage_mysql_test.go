@@ -0,0 +1,362 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// recordingDriver logs every statement run through it with its arguments,
+// and the transactions around them as BEGIN, COMMIT and ROLLBACK. Queries
+// return the rows of the first answer they contain the text of, if any,
+// and statements report one row changed.
+type recordingDriver struct{}
+
+type recordingConn struct{ log *queryLog }
+
+type recordingTx struct{ log *queryLog }
+
+type queryLog struct {
+    mu      sync.Mutex
+    queries []loggedQuery
+    answers []cannedAnswer
+}
+
+type cannedAnswer struct {
+    match   string
+    columns []string
+    rows    [][]driver.Value
+}
+
+type cannedRows struct {
+    columns []string
+    rows    [][]driver.Value
+}
+
+type loggedQuery struct {
+    query string
+    args  []driver.Value
+}
+
+var recordingLogs sync.Map // DSN -> *queryLog
+
+func init() {
+    sql.Register("s2record", recordingDriver{})
+}
+
+func (recordingDriver) Open(dsn string) (driver.Conn, error) {
+    log, _ := recordingLogs.Load(dsn)
+    return &recordingConn{log: log.(*queryLog)}, nil
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c *recordingConn) Close() error                              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) {
+    c.log.add("BEGIN", nil)
+    return recordingTx{log: c.log}, nil
+}
+
+func (tx recordingTx) Commit() error {
+    tx.log.add("COMMIT", nil)
+    return nil
+}
+
+func (tx recordingTx) Rollback() error {
+    tx.log.add("ROLLBACK", nil)
+    return nil
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+    c.log.add(query, args)
+    return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+    c.log.add(query, args)
+    c.log.mu.Lock()
+    defer c.log.mu.Unlock()
+    for _, a := range c.log.answers {
+        if strings.Contains(query, a.match) {
+            return &cannedRows{columns: a.columns, rows: a.rows}, nil
+        }
+    }
+    return emptyRows{}, nil
+}
+
+func (r *cannedRows) Columns() []string { return r.columns }
+func (r *cannedRows) Close() error      { return nil }
+
+func (r *cannedRows) Next(dest []driver.Value) error {
+    if len(r.rows) == 0 {
+        return io.EOF
+    }
+    copy(dest, r.rows[0])
+    r.rows = r.rows[1:]
+    return nil
+}
+
+// answer makes queries containing match return rows
+func (l *queryLog) answer(match string, columns []string, rows ...[]driver.Value) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.answers = append(l.answers, cannedAnswer{match: match, columns: columns, rows: rows})
+}
+
+func (l *queryLog) add(query string, args []driver.NamedValue) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    q := loggedQuery{query: query}
+    for _, arg := range args {
+        q.args = append(q.args, arg.Value)
+    }
+    l.queries = append(l.queries, q)
+}
+
+// take returns the statements logged since the last take
+func (l *queryLog) take() []loggedQuery {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    queries := l.queries
+    l.queries = nil
+    return queries
+}
+
+// openRecordingDB opens a database on the recording driver with its log
+func openRecordingDB(t *testing.T) (*sql.DB, *queryLog) {
+    t.Helper()
+    dsn := fmt.Sprintf("record-%d", emptyDSNCount.Add(1))
+    log := &queryLog{}
+    recordingLogs.Store(dsn, log)
+    db, err := sql.Open("s2record", dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        db.Close()
+        recordingLogs.Delete(dsn)
+    })
+    return db, log
+}
+
+func newRecordingStorage(t *testing.T, cooldown time.Duration, c clock.Clock) (*mysqlStorage, *queryLog) {
+    t.Helper()
+    db, log := openRecordingDB(t)
+    return newMySQLStorage(db, time.Second, cooldown, c.Now).(*mysqlStorage), log
+}
+
+// timeArgs are the times bound to q
+func (q loggedQuery) timeArgs() []time.Time {
+    var times []time.Time
+    for _, arg := range q.args {
+        if at, ok := arg.(time.Time); ok {
+            times = append(times, at)
+        }
+    }
+    return times
+}
+
+// A released DID cools down on the router's clock: it stays out of the
+// free set until the clock has moved a full cooldown past the release
+func TestDIDCooldownFollowsRouterClock(t *testing.T) {
+    const cooldown = 30 * time.Second
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    s, log := newRecordingStorage(t, cooldown, fake)
+    ctx := context.Background()
+
+    if _, err := s.ReleaseDID(ctx, "15550000000", "call-1"); err != nil {
+        t.Fatal(err)
+    }
+    release := log.take()
+    if len(release) != 1 || len(release[0].timeArgs()) == 0 {
+        t.Fatalf("release bound %v", release)
+    }
+    // The release time, and the in-flight window of its holder guard
+    for _, at := range release[0].timeArgs() {
+        if !at.Equal(fake.Now()) {
+            t.Fatalf("released at %s, clock at %s", at, fake.Now())
+        }
+    }
+    released := release[0].timeArgs()[0]
+
+    // free binds the quarantine check to now and the cooldown to the
+    // latest release it lets through, last_released_at <= ?
+    cooledDown := func() bool {
+        t.Helper()
+        if _, err := s.PickLeastRecentDID(ctx, DIDFilter{Pool: "default"}, 0); err != sql.ErrNoRows {
+            t.Fatalf("pick: %v", err)
+        }
+        queries := log.take()
+        if len(queries) != 1 {
+            t.Fatalf("pick ran %d queries", len(queries))
+        }
+        if strings.Contains(queries[0].query, "NOW(") {
+            t.Fatalf("pick reads the database clock: %s", queries[0].query)
+        }
+        times := queries[0].timeArgs()
+        if len(times) != 2 || !times[0].Equal(fake.Now()) {
+            t.Fatalf("pick bound %v at %s", times, fake.Now())
+        }
+        return !released.After(times[1])
+    }
+
+    fake.Advance(cooldown - time.Millisecond)
+    if cooledDown() {
+        t.Fatal("DID free before its cooldown ran out")
+    }
+    fake.Advance(time.Millisecond)
+    if !cooledDown() {
+        t.Fatal("DID still cooling down after the cooldown")
+    }
+}
+
+// Reservations expire on the router's clock: FailStaleCalls and the
+// in-flight lookups bind its time, so a call started at the reservation
+// TTL ago is still in flight and one a second older is stale
+func TestReservationTTLFollowsRouterClock(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    s, log := newRecordingStorage(t, 0, fake)
+    ctx := context.Background()
+    started := fake.Now()
+
+    // staleReservation is start_time < DATE_SUB(?, INTERVAL ttl SECOND);
+    // with no stale rows the sweep is BEGIN, the locking select, COMMIT
+    stale := func() bool {
+        t.Helper()
+        if _, err := s.FailStaleCalls(ctx); err != nil {
+            t.Fatal(err)
+        }
+        queries := log.take()
+        if len(queries) != 3 || queries[0].query != "BEGIN" || queries[2].query != "COMMIT" {
+            t.Fatalf("FailStaleCalls ran %v", queries)
+        }
+        for _, q := range queries {
+            if strings.Contains(q.query, "NOW(") {
+                t.Fatalf("FailStaleCalls reads the database clock: %s", q.query)
+            }
+            for _, at := range q.timeArgs() {
+                if !at.Equal(fake.Now()) {
+                    t.Fatalf("FailStaleCalls bound %s at %s", at, fake.Now())
+                }
+            }
+        }
+        return started.Before(queries[1].timeArgs()[0].Add(-staleCallAge))
+    }
+
+    fake.Advance(staleCallAge)
+    if stale() {
+        t.Fatal("call stale at its reservation TTL")
+    }
+    if _, err := s.CallRecordByDID(ctx, "15550000000"); err != sql.ErrNoRows {
+        t.Fatalf("lookup: %v", err)
+    }
+    lookup := log.take()
+    if len(lookup) != 1 || len(lookup[0].timeArgs()) != 1 || !lookup[0].timeArgs()[0].Equal(fake.Now()) {
+        t.Fatalf("in-flight lookup bound %v at %s", lookup, fake.Now())
+    }
+
+    fake.Advance(time.Second)
+    if !stale() {
+        t.Fatal("call not stale past its reservation TTL")
+    }
+}
+
+// The sweep frees the DIDs of the calls it failed and no others, each only
+// while still claimed and held by no call in flight: a DID reclaimed by a
+// new call after its stale call took it survives
+func TestFailStaleCallsReleasesOnlyItsDIDs(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    s, log := newRecordingStorage(t, 0, fake)
+    log.answer("SELECT call_id, COALESCE(assigned_did, '')", []string{"call_id", "assigned_did"},
+        []driver.Value{"call-1", "15550000001"},
+        []driver.Value{"call-2", ""},
+        []driver.Value{"call-3", "15550000003"},
+    )
+
+    n, err := s.FailStaleCalls(context.Background())
+    if err != nil || n != 3 {
+        t.Fatalf("failed %d, %v", n, err)
+    }
+    queries := log.take()
+    if len(queries) != 6 || queries[0].query != "BEGIN" || queries[5].query != "COMMIT" {
+        t.Fatalf("FailStaleCalls ran %v", queries)
+    }
+    if !strings.Contains(queries[1].query, "FOR UPDATE") {
+        t.Fatalf("stale calls are not locked: %s", queries[1].query)
+    }
+    for _, q := range queries[2:4] {
+        if fmt.Sprint(q.args[len(q.args)-3:]) != "[call-1 call-2 call-3]" {
+            t.Fatalf("%s bound %v", q.query, q.args)
+        }
+    }
+
+    release := queries[4]
+    for _, guard := range []string{"d.in_use = 1", "NOT EXISTS", "call_records.assigned_did = d.did"} {
+        if !strings.Contains(release.query, guard) {
+            t.Fatalf("release lacks %q: %s", guard, release.query)
+        }
+    }
+    if strings.Contains(release.query, "JOIN") || strings.Contains(release.query, "'FAILED'") {
+        t.Fatalf("release picks DIDs by failed calls rather than the swept ones: %s", release.query)
+    }
+    if fmt.Sprint(release.args[2:4]) != "[15550000001 15550000003]" {
+        t.Fatalf("release bound %v", release.args)
+    }
+}
+
+// Every write on the call path stamps its times from the router's clock,
+// never the database's: each statement binds the clock's time, whatever
+// the call record itself carries
+func TestCallWritesFollowRouterClock(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    s, log := newRecordingStorage(t, 0, fake)
+    ctx := context.Background()
+    record := &models.CallRecord{CallID: "call-1", AssignedDID: "15550000001", Status: models.CallStateActive, StartTime: fake.Now()}
+
+    writes := []struct {
+        name  string
+        write func() error
+    }{
+        {"claim", func() error { _, err := s.ClaimDID(ctx, "15550000001", "s3"); return err }},
+        {"insert claimed", func() error { _, err := s.InsertClaimedDID(ctx, "15550000002", "s3", "", ""); return err }},
+        {"store", func() error { return s.StoreCallRecord(ctx, record) }},
+        {"store batch", func() error { return s.StoreCallRecords(ctx, []*models.CallRecord{record}) }},
+        {"forward", func() error { return s.UpdateCallStatus(ctx, "call-1", models.CallStateForwarded) }},
+        {"complete", func() error { return s.UpdateCallStatus(ctx, "call-1", models.CallStateCompleted) }},
+        {"complete batch", func() error {
+            return s.UpdateCallStatuses(ctx, []string{"call-1"}, models.CallStateCompleted)
+        }},
+        {"release", func() error { _, err := s.ReleaseDID(ctx, "15550000001", "call-1"); return err }},
+    }
+    for _, w := range writes {
+        fake.Advance(time.Minute)
+        if err := w.write(); err != nil {
+            t.Fatalf("%s: %v", w.name, err)
+        }
+        queries := log.take()
+        if len(queries) != 1 {
+            t.Fatalf("%s ran %v", w.name, queries)
+        }
+        q := queries[0]
+        if strings.Contains(q.query, "NOW(") {
+            t.Fatalf("%s reads the database clock: %s", w.name, q.query)
+        }
+        times := q.timeArgs()
+        if len(times) == 0 || !times[len(times)-1].Equal(fake.Now()) {
+            t.Fatalf("%s bound %v at %s", w.name, times, fake.Now())
+        }
+        for _, at := range times {
+            if !at.Equal(fake.Now()) && !at.Equal(record.StartTime) {
+                t.Fatalf("%s bound %s at %s", w.name, at, fake.Now())
+            }
+        }
+    }
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+    "time"
+
+    _ "github.com/lib/pq"
+)
+
+// postgresDialect runs the call path on PostgreSQL 9.5 or later. The
+// timestamps are timestamptz, so the zone a time is bound in does not
+// matter there; in_use stays a number so the SQL is shared with SQLite.
+var postgresDialect = &sqlDialect{
+    numbered: true,
+    lockRows: " FOR UPDATE",
+    elapsed:  "GREATEST(CAST(FLOOR(EXTRACT(EPOCH FROM CAST(? AS TIMESTAMPTZ) - start_time)) AS INTEGER), 0)",
+    bindTime: func(t time.Time) interface{} { return t.UTC() },
+    schema: []string{
+        `CREATE TABLE IF NOT EXISTS dids (
+            id SERIAL PRIMARY KEY,
+            did VARCHAR(50) UNIQUE NOT NULL,
+            in_use SMALLINT NOT NULL DEFAULT 0,
+            destination VARCHAR(50),
+            country VARCHAR(50),
+            tags TEXT,
+            tenant_id VARCHAR(64) NOT NULL DEFAULT '',
+            pool VARCHAR(64) NOT NULL DEFAULT '',
+            last_used_at TIMESTAMPTZ,
+            last_released_at TIMESTAMPTZ,
+            quarantined_until TIMESTAMPTZ,
+            quarantine_reason VARCHAR(255),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+        )`,
+        `CREATE INDEX IF NOT EXISTS idx_dids_pool_free ON dids (tenant_id, pool, in_use, country)`,
+        `CREATE INDEX IF NOT EXISTS idx_dids_lru ON dids (tenant_id, in_use, last_used_at)`,
+        `CREATE TABLE IF NOT EXISTS call_records (
+            id BIGSERIAL PRIMARY KEY,
+            call_id VARCHAR(100) UNIQUE NOT NULL,
+            original_ani VARCHAR(50),
+            original_dnis VARCHAR(50),
+            assigned_did VARCHAR(50),
+            status VARCHAR(50),
+            start_time TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            end_time TIMESTAMPTZ,
+            duration INTEGER NOT NULL DEFAULT 0,
+            recording_path VARCHAR(255),
+            match_token VARCHAR(20),
+            settlement_class VARCHAR(50),
+            tags TEXT,
+            campaign_id VARCHAR(64),
+            forward_trunk VARCHAR(100),
+            tenant_id VARCHAR(64),
+            trace_parent VARCHAR(64),
+            hangup_cause VARCHAR(8),
+            dest_country VARCHAR(2),
+            dest_region VARCHAR(100),
+            dest_type VARCHAR(20),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+        )`,
+        `CREATE INDEX IF NOT EXISTS idx_call_records_did ON call_records (assigned_did, start_time)`,
+        `CREATE INDEX IF NOT EXISTS idx_call_records_status ON call_records (status, start_time)`,
+        `CREATE INDEX IF NOT EXISTS idx_call_records_start ON call_records (start_time)`,
+        `CREATE INDEX IF NOT EXISTS idx_call_records_token ON call_records (match_token)`,
+        `CREATE TABLE IF NOT EXISTS call_events (
+            id BIGSERIAL PRIMARY KEY,
+            call_id VARCHAR(100) NOT NULL,
+            event VARCHAR(20) NOT NULL,
+            at TIMESTAMPTZ NOT NULL,
+            detail VARCHAR(255),
+            request_id VARCHAR(128)
+        )`,
+        `CREATE INDEX IF NOT EXISTS idx_call_events_call ON call_events (call_id, at)`,
+    },
+}
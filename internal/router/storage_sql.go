@@ -0,0 +1,768 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    mathrand "math/rand"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// sqlDialect is what the postgres and sqlite backends differ in. They share
+// sqlStorage, whose SQL is written with ? placeholders and no MySQL
+// functions, and have only the call path tables: dids, call_records and
+// call_events.
+type sqlDialect struct {
+    numbered bool   // placeholders are $1, $2, ... rather than ?
+    lockRows string // appended to a SELECT whose rows a transaction updates next
+    elapsed  string // whole seconds from start_time to the bound time, at least 0
+    schema   []string
+
+    // bindTime converts a time argument; every time is bound in UTC so
+    // that stored times compare in one zone
+    bindTime func(t time.Time) interface{}
+}
+
+// errPartitionsNeedMySQL is returned for a partitioned pick, since the
+// partition hash is MySQL's CRC32
+var errPartitionsNeedMySQL = errors.New("DID partitions need the mysql storage driver")
+
+func (d *sqlDialect) createTables(db *sql.DB) error {
+    for _, query := range d.schema {
+        if _, err := db.Exec(query); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (d *sqlDialect) newStorage(db *sql.DB, timeout, cooldown time.Duration, now func() time.Time) Storage {
+    s := &sqlStorage{d: d, db: db, timeout: timeout, cooldown: cooldown, now: now}
+    s.queries = s.callPathQueries()
+    return s
+}
+
+// rebind rewrites the ? placeholders of query for the dialect
+func (d *sqlDialect) rebind(query string) string {
+    if !d.numbered {
+        return query
+    }
+    var b strings.Builder
+    n := 0
+    for _, c := range query {
+        if c != '?' {
+            b.WriteRune(c)
+            continue
+        }
+        n++
+        b.WriteString("$" + strconv.Itoa(n))
+    }
+    return b.String()
+}
+
+type sqlStorage struct {
+    d        *sqlDialect
+    db       *sql.DB
+    timeout  time.Duration
+    cooldown time.Duration
+    now      func() time.Time
+    queries  map[string]string    // call path statements by name, rebound
+    stmts    map[string]*sql.Stmt // the same, prepared by Prepare
+}
+
+// bind converts the time arguments in args, in place
+func (s *sqlStorage) bind(args ...interface{}) []interface{} {
+    for i, arg := range args {
+        if t, ok := arg.(time.Time); ok {
+            args[i] = s.d.bindTime(t)
+        }
+    }
+    return args
+}
+
+func (s *sqlStorage) execContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+    return s.db.ExecContext(ctx, s.d.rebind(query), s.bind(args...)...)
+}
+
+func (s *sqlStorage) queryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    return s.db.QueryContext(ctx, s.d.rebind(query), s.bind(args...)...)
+}
+
+func (s *sqlStorage) queryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+    return s.db.QueryRowContext(ctx, s.d.rebind(query), s.bind(args...)...)
+}
+
+// Without tenant overrides, which live in the feature tables, a call is
+// in flight for staleCallAge whatever its status
+const (
+    sqlInFlight   = "status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3') AND start_time > ?"
+    sqlCallInsert = `
+        INSERT INTO call_records
+        (call_id, original_ani, original_dnis, assigned_did, status, start_time, recording_path, match_token, settlement_class, tags, campaign_id, forward_trunk, tenant_id, trace_parent,
+        dest_country, dest_region, dest_type)
+        VALUES ` + callRecordRow + `
+        ON CONFLICT (call_id) DO UPDATE SET
+        status = excluded.status,
+        assigned_did = excluded.assigned_did,
+        match_token = excluded.match_token,
+        updated_at = ?
+    `
+)
+
+func (s *sqlStorage) callPathQueries() map[string]string {
+    queries := map[string]string{
+        "pick_bounds": "SELECT MIN(id), MAX(id) FROM dids",
+        "claim": `
+            UPDATE dids
+            SET in_use = 1, destination = ?, last_used_at = ?, updated_at = ?
+            WHERE did = ? AND in_use = 0
+        `,
+        "release": `
+            UPDATE dids
+            SET in_use = 0, destination = NULL, last_released_at = ?, updated_at = ?
+            WHERE did = ?
+            AND NOT EXISTS (
+                SELECT 1 FROM call_records
+                WHERE call_records.assigned_did = dids.did AND call_id <> ?
+                AND ` + sqlInFlight + `
+            )
+        `,
+        "insert_call":   sqlCallInsert,
+        "update_status": "UPDATE call_records SET status = ?, updated_at = ? WHERE call_id = ?",
+        "end_call":      "UPDATE call_records SET status = ?, end_time = ?, duration = " + s.d.elapsed + ", updated_at = ? WHERE call_id = ?",
+        "hangup_cause":  "UPDATE call_records SET hangup_cause = ? WHERE call_id = ?",
+    }
+    for _, country := range []bool{false, true} {
+        where := s.freeWhere(country)
+        queries[pickName("pick", country, false)] = `
+            SELECT did FROM dids
+            WHERE ` + where + ` AND id >= ?
+            ORDER BY id
+            LIMIT 1
+        `
+        queries[pickName("pick_wrap", country, false)] = `
+            SELECT did FROM dids
+            WHERE ` + where + ` AND id < ?
+            ORDER BY id
+            LIMIT 1
+        `
+    }
+    for name, query := range queries {
+        queries[name] = s.d.rebind(query)
+    }
+    return queries
+}
+
+func (s *sqlStorage) Prepare(ctx context.Context) error {
+    stmts := make(map[string]*sql.Stmt, len(s.queries))
+    for name, query := range s.queries {
+        stmt, err := s.db.PrepareContext(ctx, query)
+        if err != nil {
+            for _, stmt := range stmts {
+                stmt.Close()
+            }
+            return &StatementError{Statement: name, Prepare: true, Err: err}
+        }
+        stmts[name] = stmt
+    }
+    s.stmts = stmts
+    return nil
+}
+
+// exec runs the named call path statement, prepared when Prepare has run
+func (s *sqlStorage) exec(ctx context.Context, name string, args ...interface{}) (sql.Result, error) {
+    var result sql.Result
+    var err error
+    if stmt := s.stmts[name]; stmt != nil {
+        result, err = stmt.ExecContext(ctx, s.bind(args...)...)
+    } else {
+        result, err = s.db.ExecContext(ctx, s.queries[name], s.bind(args...)...)
+    }
+    if err != nil {
+        return nil, &StatementError{Statement: name, Err: err}
+    }
+    return result, nil
+}
+
+// scan reads one row of the named call path statement into dest.
+// sql.ErrNoRows comes back as it is.
+func (s *sqlStorage) scan(ctx context.Context, name string, args []interface{}, dest ...interface{}) error {
+    var row *sql.Row
+    if stmt := s.stmts[name]; stmt != nil {
+        row = stmt.QueryRowContext(ctx, s.bind(args...)...)
+    } else {
+        row = s.db.QueryRowContext(ctx, s.queries[name], s.bind(args...)...)
+    }
+    err := row.Scan(dest...)
+    if err != nil && err != sql.ErrNoRows {
+        return &StatementError{Statement: name, Err: err}
+    }
+    return err
+}
+
+// free is the condition for a free DID matching f and its arguments, as
+// on MySQL
+func (s *sqlStorage) free(f DIDFilter) (string, []interface{}, error) {
+    if f.Partitions > 0 {
+        return "", nil, errPartitionsNeedMySQL
+    }
+    now := s.now()
+    args := []interface{}{f.Tenant, f.Pool, now}
+    if f.Country != "" {
+        args = append(args, f.Country)
+    }
+    if s.cooldown > 0 {
+        args = append(args, now.Add(-s.cooldown))
+    }
+    return s.freeWhere(f.Country != ""), args, nil
+}
+
+func (s *sqlStorage) freeWhere(country bool) string {
+    where := "in_use = 0 AND tenant_id = ? AND pool = ? AND (quarantined_until IS NULL OR quarantined_until <= ?)"
+    if country {
+        where += " AND country = ?"
+    }
+    if s.cooldown > 0 {
+        where += " AND (last_released_at IS NULL OR last_released_at <= ?)"
+    }
+    return where
+}
+
+// PickFreeDID starts at a random id and takes the next free DID from
+// there, wrapping to the lowest
+func (s *sqlStorage) PickFreeDID(ctx context.Context, f DIDFilter) (string, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, args, err := s.free(f)
+    if err != nil {
+        return "", err
+    }
+    var low, high sql.NullInt64
+    if err := s.scan(ctx, "pick_bounds", nil, &low, &high); err != nil {
+        return "", err
+    }
+    if !low.Valid {
+        return "", sql.ErrNoRows
+    }
+    start := low.Int64 + mathrand.Int63n(high.Int64-low.Int64+1)
+
+    args = append(args, start)
+    country := f.Country != ""
+    var did string
+    err = s.scan(ctx, pickName("pick", country, false), args, &did)
+    if err == sql.ErrNoRows {
+        err = s.scan(ctx, pickName("pick_wrap", country, false), args, &did)
+    }
+    return did, err
+}
+
+func (s *sqlStorage) PickLeastRecentDID(ctx context.Context, f DIDFilter, skip int) (string, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    where, args, err := s.free(f)
+    if err != nil {
+        return "", err
+    }
+    var did string
+    err = s.queryRowContext(ctx, `
+        SELECT did FROM dids
+        WHERE `+where+`
+        ORDER BY last_used_at NULLS FIRST, id
+        LIMIT 1 OFFSET ?
+    `, append(args, skip)...).Scan(&did)
+    return did, err
+}
+
+func (s *sqlStorage) PickFreeDIDAfter(ctx context.Context, f DIDFilter, after string) (string, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    where, args, err := s.free(f)
+    if err != nil {
+        return "", err
+    }
+    var did string
+    err = s.queryRowContext(ctx, `
+        SELECT did FROM dids
+        WHERE `+where+` AND did > ?
+        ORDER BY did
+        LIMIT 1
+    `, append(args, after)...).Scan(&did)
+    if err == sql.ErrNoRows && after != "" {
+        err = s.queryRowContext(ctx, `
+            SELECT did FROM dids
+            WHERE `+where+`
+            ORDER BY did
+            LIMIT 1
+        `, args...).Scan(&did)
+    }
+    return did, err
+}
+
+func (s *sqlStorage) ClaimDID(ctx context.Context, did, destination string) (bool, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    result, err := s.exec(ctx, "claim", destination, now, now, did)
+    if err != nil {
+        return false, err
+    }
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return false, err
+    }
+    return rows == 1, nil
+}
+
+func (s *sqlStorage) InsertClaimedDID(ctx context.Context, did, destination, country, tenant string) (bool, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    result, err := s.execContext(ctx, `
+        INSERT INTO dids (did, in_use, destination, country, tenant_id, last_used_at)
+        VALUES (?, 1, ?, NULLIF(?, ''), ?, ?)
+        ON CONFLICT (did) DO NOTHING
+    `, did, destination, country, tenant, s.now())
+    if err != nil {
+        return false, err
+    }
+    rows, err := result.RowsAffected()
+    return rows == 1, err
+}
+
+func (s *sqlStorage) ReleaseDID(ctx context.Context, did, callID string) (bool, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    result, err := s.exec(ctx, "release", now, now, did, callID, s.inFlightSince())
+    if err != nil {
+        return false, err
+    }
+    rows, err := result.RowsAffected()
+    return rows == 1, err
+}
+
+func (s *sqlStorage) DIDCounts(ctx context.Context) (total, used int, err error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    var inUse sql.NullInt64
+    err = s.queryRowContext(ctx, "SELECT COUNT(*), SUM(CASE WHEN in_use = 1 THEN 1 ELSE 0 END) FROM dids").Scan(&total, &inUse)
+    return total, int(inUse.Int64), err
+}
+
+func (s *sqlStorage) StoreCallRecord(ctx context.Context, record *models.CallRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.exec(ctx, "insert_call", append(callRecordArgs(record), s.now())...)
+    return err
+}
+
+// finalStatus reports whether a call in status has ended
+func finalStatus(status models.CallState) bool {
+    return status == models.CallStateCompleted || status == models.CallStateFailed
+}
+
+func (s *sqlStorage) UpdateCallStatus(ctx context.Context, callID string, status models.CallState) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    var err error
+    if finalStatus(status) {
+        _, err = s.exec(ctx, "end_call", status, now, now, now, callID)
+    } else {
+        _, err = s.exec(ctx, "update_status", status, now, callID)
+    }
+    return err
+}
+
+func (s *sqlStorage) RecordHangupCause(ctx context.Context, callID, cause string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.exec(ctx, "hangup_cause", cause, callID)
+    return err
+}
+
+// StoreCallRecords upserts each record in one transaction; a multi-row
+// upsert would fail on PostgreSQL for a batch holding a call twice
+func (s *sqlStorage) StoreCallRecords(ctx context.Context, records []*models.CallRecord) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return &StatementError{Statement: "insert_calls", Err: err}
+    }
+    defer tx.Rollback()
+    now := s.now()
+    for _, record := range records {
+        if _, err := tx.ExecContext(ctx, s.queries["insert_call"], s.bind(append(callRecordArgs(record), now)...)...); err != nil {
+            return &StatementError{Statement: "insert_calls", Err: err}
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return &StatementError{Statement: "insert_calls", Err: err}
+    }
+    return nil
+}
+
+// inList is "(?, ?, ...)" for n values, and the values of callIDs
+func inList(callIDs []string) (string, []interface{}) {
+    args := make([]interface{}, len(callIDs))
+    for i, callID := range callIDs {
+        args[i] = callID
+    }
+    return "(?" + strings.Repeat(", ?", len(callIDs)-1) + ")", args
+}
+
+func (s *sqlStorage) UpdateCallStatuses(ctx context.Context, callIDs []string, status models.CallState) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    in, ids := inList(callIDs)
+    query := "UPDATE call_records SET status = ?, updated_at = ? WHERE call_id IN " + in
+    args := []interface{}{status, now}
+    if finalStatus(status) {
+        query = "UPDATE call_records SET status = ?, end_time = ?, duration = " + s.d.elapsed + ", updated_at = ? WHERE call_id IN " + in
+        args = []interface{}{status, now, now, now}
+    }
+    if _, err := s.execContext(ctx, query, append(args, ids...)...); err != nil {
+        return &StatementError{Statement: "update_statuses", Err: err}
+    }
+    return nil
+}
+
+func (s *sqlStorage) RecordHangupCauses(ctx context.Context, callIDs []string, cause string) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    in, ids := inList(callIDs)
+    if _, err := s.execContext(ctx, "UPDATE call_records SET hangup_cause = ? WHERE call_id IN "+in, append([]interface{}{cause}, ids...)...); err != nil {
+        return &StatementError{Statement: "hangup_causes", Err: err}
+    }
+    return nil
+}
+
+// inFlightSince is the start_time a call must be younger than to be in flight
+func (s *sqlStorage) inFlightSince() time.Time {
+    return s.now().Add(-staleCallAge)
+}
+
+func (s *sqlStorage) CallRecordByDID(ctx context.Context, did string) (*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    return scanCallRecord(s.queryRowContext(ctx, `
+        SELECT `+callRecordColumns+`
+        FROM call_records
+        WHERE assigned_did = ? AND `+sqlInFlight+`
+        ORDER BY start_time DESC
+        LIMIT 1
+    `, did, s.inFlightSince()))
+}
+
+func (s *sqlStorage) CallRecordByToken(ctx context.Context, token string) (*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    return scanCallRecord(s.queryRowContext(ctx, `
+        SELECT `+callRecordColumns+`
+        FROM call_records
+        WHERE match_token = ? AND `+sqlInFlight+`
+        ORDER BY start_time DESC
+        LIMIT 1
+    `, token, s.inFlightSince()))
+}
+
+func (s *sqlStorage) InFlightCallRecord(ctx context.Context, callID string) (*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    return scanCallRecord(s.queryRowContext(ctx, `
+        SELECT `+callRecordColumns+`
+        FROM call_records
+        WHERE call_id = ?
+        AND status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+        ORDER BY start_time DESC
+        LIMIT 1
+    `, callID))
+}
+
+func (s *sqlStorage) InFlightCallRecords(ctx context.Context) ([]*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    rows, err := s.queryContext(ctx, "SELECT "+callRecordColumns+" FROM call_records WHERE "+sqlInFlight, s.inFlightSince())
+    if err != nil {
+        return nil, err
+    }
+    return scanCallRecords(rows)
+}
+
+func (s *sqlStorage) UnfinishedCallRecords(ctx context.Context, since time.Time) ([]*models.CallRecord, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    rows, err := s.queryContext(ctx, `
+        SELECT `+callRecordColumns+`
+        FROM call_records
+        WHERE status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3')
+        AND start_time > ?
+    `, since)
+    if err != nil {
+        return nil, err
+    }
+    return scanCallRecords(rows)
+}
+
+// FailStaleCalls fails the calls past staleCallAge that never came back
+// from S3, then frees each one's DID unless a call still in flight holds
+// it, all in one transaction
+func (s *sqlStorage) FailStaleCalls(ctx context.Context) (int64, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, s.d.rebind(`
+        SELECT call_id, COALESCE(assigned_did, '') FROM call_records
+        WHERE status IN ('ACTIVE', 'FORWARDED_TO_S3') AND start_time <= ?
+    `+s.d.lockRows), s.bind(s.inFlightSince())...)
+    if err != nil {
+        return 0, err
+    }
+    type staleCall struct{ callID, did string }
+    var stale []staleCall
+    for rows.Next() {
+        var c staleCall
+        if err := rows.Scan(&c.callID, &c.did); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        stale = append(stale, c)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    exec := func(query string, args ...interface{}) error {
+        _, err := tx.ExecContext(ctx, s.d.rebind(query), s.bind(args...)...)
+        return err
+    }
+    for _, c := range stale {
+        if err := exec("INSERT INTO call_events (call_id, event, at, detail) VALUES (?, 'FAILED', ?, 'stale')", c.callID, now); err != nil {
+            return 0, err
+        }
+        if err := exec("UPDATE call_records SET status = 'FAILED', end_time = ?, updated_at = ? WHERE call_id = ?", now, now, c.callID); err != nil {
+            return 0, err
+        }
+    }
+    for _, c := range stale {
+        if c.did == "" {
+            continue
+        }
+        err := exec(`
+            UPDATE dids
+            SET in_use = 0, destination = NULL, last_released_at = ?, updated_at = ?
+            WHERE did = ? AND in_use = 1
+            AND NOT EXISTS (
+                SELECT 1 FROM call_records cr
+                WHERE cr.assigned_did = dids.did
+                AND cr.status IN ('ACTIVE', 'FORWARDED_TO_S3', 'RETURNED_FROM_S3') AND cr.start_time > ?
+            )
+        `, now, now, c.did, s.inFlightSince())
+        if err != nil {
+            return 0, err
+        }
+    }
+    return int64(len(stale)), tx.Commit()
+}
+
+func (s *sqlStorage) CallStatuses(ctx context.Context, callIDs []string) (map[string]models.CallState, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    in, ids := inList(callIDs)
+    rows, err := s.queryContext(ctx, "SELECT call_id, status FROM call_records WHERE call_id IN "+in, ids...)
+    if err != nil {
+        return nil, err
+    }
+    return scanCallStatuses(rows)
+}
+
+func (s *sqlStorage) CallsEnded(ctx context.Context, from, to time.Time) (int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    var n int
+    err := s.queryRowContext(ctx, `
+        SELECT COUNT(*) FROM call_records
+        WHERE status IN ('COMPLETED_AT_S4', 'FAILED') AND end_time > ? AND end_time <= ?
+    `, from, to).Scan(&n)
+    return n, err
+}
+
+func (s *sqlStorage) BackdateCallEnd(ctx context.Context, callID string, end time.Time) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.execContext(ctx, "UPDATE call_records SET end_time = ?, duration = "+s.d.elapsed+" WHERE call_id = ?", end, end, callID)
+    return err
+}
+
+// CallCounts counts the calls started since midnight on the router's clock
+func (s *sqlStorage) CallCounts(ctx context.Context) (calls, completed int, err error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    now := s.now()
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+    var done sql.NullInt64
+    err = s.queryRowContext(ctx, `
+        SELECT
+            COUNT(*),
+            SUM(CASE WHEN status = 'COMPLETED_AT_S4' THEN 1 ELSE 0 END)
+        FROM call_records
+        WHERE start_time >= ? AND start_time < ?
+    `, today, today.AddDate(0, 0, 1)).Scan(&calls, &done)
+    return calls, int(done.Int64), err
+}
+
+func (s *sqlStorage) DIDHistory(ctx context.Context, did string, from, to time.Time, limit int) ([]models.DIDCall, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    rows, err := s.queryContext(ctx, `
+        SELECT call_id, original_ani, original_dnis, status, start_time, end_time, duration,
+            COALESCE(hangup_cause, ''), COALESCE(campaign_id, ''), COALESCE(tenant_id, ''),
+            COALESCE(forward_trunk, '')
+        FROM call_records
+        WHERE assigned_did = ? AND start_time >= ? AND start_time < ?
+        ORDER BY start_time DESC
+        LIMIT ?
+    `, did, from, to, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    calls := []models.DIDCall{}
+    for rows.Next() {
+        var c models.DIDCall
+        var end sql.NullTime
+        if err := rows.Scan(&c.CallID, &c.ANI, &c.DNIS, &c.Status, &c.StartTime, &end, &c.Duration,
+            &c.HangupCause, &c.Campaign, &c.Tenant, &c.ForwardTrunk); err != nil {
+            return nil, err
+        }
+        if end.Valid {
+            c.EndTime = &end.Time
+        }
+        calls = append(calls, c)
+    }
+    return calls, rows.Err()
+}
+
+func (s *sqlStorage) ListCalls(ctx context.Context, f CallFilter, offset, limit int) ([]models.Call, int, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+
+    where := "1 = 1"
+    var args []interface{}
+    if f.Status != "" {
+        where += " AND status = ?"
+        args = append(args, f.Status)
+    }
+    if f.ANI != "" {
+        where += " AND original_ani = ?"
+        args = append(args, f.ANI)
+    }
+    if f.DID != "" {
+        where += " AND assigned_did = ?"
+        args = append(args, f.DID)
+    }
+    if !f.From.IsZero() {
+        where += " AND start_time >= ?"
+        args = append(args, f.From)
+    }
+    if !f.To.IsZero() {
+        where += " AND start_time < ?"
+        args = append(args, f.To)
+    }
+
+    var total int
+    if err := s.queryRowContext(ctx, "SELECT COUNT(*) FROM call_records WHERE "+where, args...).Scan(&total); err != nil {
+        return nil, 0, err
+    }
+
+    rows, err := s.queryContext(ctx, `
+        SELECT `+callColumns+`
+        FROM call_records
+        WHERE `+where+`
+        ORDER BY start_time DESC, id DESC
+        LIMIT ? OFFSET ?
+    `, append(args, limit, offset)...)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    calls := []models.Call{}
+    for rows.Next() {
+        var c models.Call
+        if err := scanCall(rows, &c); err != nil {
+            return nil, 0, err
+        }
+        calls = append(calls, c)
+    }
+    return calls, total, rows.Err()
+}
+
+// CallDetail reads call_records only; archiving is a MySQL feature
+func (s *sqlStorage) CallDetail(ctx context.Context, callID string) (*models.CallDetail, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    row := s.queryRowContext(ctx, `
+        SELECT `+callColumns+`, COALESCE(match_token, ''), COALESCE(recording_path, ''), COALESCE(trace_parent, '')
+        FROM call_records
+        WHERE call_id = ?
+    `, callID)
+
+    var d models.CallDetail
+    err := scanCall(row, &d.Call, &d.MatchToken, &d.RecordingPath, &d.TraceParent)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &d, nil
+}
+
+func (s *sqlStorage) RecordCallEvent(ctx context.Context, callID string, event models.CallEvent) error {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    _, err := s.execContext(ctx, `
+        INSERT INTO call_events (call_id, event, at, detail, request_id)
+        VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))
+    `, callID, event.Event, event.At, event.Detail, event.RequestID)
+    return err
+}
+
+func (s *sqlStorage) CallEvents(ctx context.Context, callID string) ([]models.CallEvent, error) {
+    ctx, cancel := withQueryTimeout(ctx, s.timeout)
+    defer cancel()
+    rows, err := s.queryContext(ctx, `
+        SELECT event, at, COALESCE(detail, ''), COALESCE(request_id, '')
+        FROM call_events
+        WHERE call_id = ?
+        ORDER BY at, id
+    `, callID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    events := []models.CallEvent{}
+    for rows.Next() {
+        var e models.CallEvent
+        if err := rows.Scan(&e.Event, &e.At, &e.Detail, &e.RequestID); err != nil {
+            return nil, err
+        }
+        events = append(events, e)
+    }
+    return events, rows.Err()
+}
@@ -0,0 +1,212 @@
+package router
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    maxTags        = 20
+    maxTagKeyLen   = 64
+    maxTagValueLen = 255
+
+    // DID tags are copied onto the call under this prefix at allocation
+    didTagPrefix = "did."
+)
+
+// ErrInvalidTags is returned for tag sets over the size limits
+var ErrInvalidTags = errors.New("invalid tags")
+
+// ValidateTags enforces the limits on caller-supplied tags
+func ValidateTags(tags map[string]string) error {
+    if len(tags) > maxTags {
+        return fmt.Errorf("%w: too many tags: %d (max %d)", ErrInvalidTags, len(tags), maxTags)
+    }
+    for k, v := range tags {
+        if k == "" || len(k) > maxTagKeyLen {
+            return fmt.Errorf("%w: tag key %q must be 1-%d characters", ErrInvalidTags, k, maxTagKeyLen)
+        }
+        if len(v) > maxTagValueLen {
+            return fmt.Errorf("%w: tag %q value exceeds %d characters", ErrInvalidTags, k, maxTagValueLen)
+        }
+    }
+    return nil
+}
+
+// callTags merges the DID's tags (prefixed) with the caller's tags so the
+// call record carries everything downstream systems need to correlate
+func callTags(tags, didTags map[string]string) map[string]string {
+    if len(tags) == 0 && len(didTags) == 0 {
+        return nil
+    }
+    merged := make(map[string]string, len(tags)+len(didTags))
+    for k, v := range didTags {
+        merged[didTagPrefix+k] = v
+    }
+    for k, v := range tags {
+        merged[k] = v
+    }
+    return merged
+}
+
+func encodeTags(tags map[string]string) interface{} {
+    if len(tags) == 0 {
+        return nil
+    }
+    b, _ := json.Marshal(tags)
+    return string(b)
+}
+
+func decodeTags(raw sql.NullString) map[string]string {
+    if !raw.Valid || raw.String == "" {
+        return nil
+    }
+    var tags map[string]string
+    if err := json.Unmarshal([]byte(raw.String), &tags); err != nil {
+        logger.Infof("Ignoring malformed tags %q: %v", raw.String, err)
+        return nil
+    }
+    return tags
+}
+
+// DIDTags returns the tags stored on a DID
+func (r *Router) DIDTags(ctx context.Context, did string) (map[string]string, error) {
+    var raw sql.NullString
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    err := r.db.QueryRowContext(ctx, "SELECT tags FROM dids WHERE did = ?", did).Scan(&raw)
+    if err == sql.ErrNoRows {
+        return nil, fmt.Errorf("DID not found: %s", did)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return decodeTags(raw), nil
+}
+
+// SetDIDTags replaces the tags stored on a DID
+func (r *Router) SetDIDTags(ctx context.Context, did string, tags map[string]string) error {
+    if err := ValidateTags(tags); err != nil {
+        return err
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "UPDATE dids SET tags = ? WHERE did = ?", encodeTags(tags), did)
+    if err != nil {
+        return err
+    }
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        // MySQL reports 0 affected rows when the value is unchanged, so confirm the DID exists
+        if _, err := r.DIDTags(ctx, did); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// CallTags returns the tags of a call, from memory if it is active
+func (r *Router) CallTags(ctx context.Context, callID string) (map[string]string, error) {
+    r.mu.RLock()
+    record, ok := r.activeCallsMap[callID]
+    var tags map[string]string
+    if ok {
+        tags = copyTags(record.Tags)
+    }
+    r.mu.RUnlock()
+    if ok {
+        return tags, nil
+    }
+
+    var raw sql.NullString
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    err := r.db.QueryRowContext(ctx, `
+        SELECT tags FROM call_records WHERE call_id = ?
+        UNION ALL SELECT tags FROM call_records_archive WHERE call_id = ?
+        LIMIT 1
+    `, callID, callID).Scan(&raw)
+    if err == sql.ErrNoRows {
+        return nil, fmt.Errorf("call not found: %s", callID)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return decodeTags(raw), nil
+}
+
+// MergeCallTags adds or overwrites tags on a call; an empty value removes the key
+func (r *Router) MergeCallTags(ctx context.Context, callID string, updates map[string]string) (map[string]string, error) {
+    current, err := r.CallTags(ctx, callID)
+    if err != nil {
+        return nil, err
+    }
+
+    merged := copyTags(current)
+    if merged == nil {
+        merged = make(map[string]string)
+    }
+    for k, v := range updates {
+        if v == "" {
+            delete(merged, k)
+            continue
+        }
+        merged[k] = v
+    }
+    if err := ValidateTags(merged); err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    // The call is in one of the two, whichever CallTags found it in
+    for _, table := range []string{"call_records", "call_records_archive"} {
+        if _, err := r.db.ExecContext(ctx, "UPDATE "+table+" SET tags = ? WHERE call_id = ?", encodeTags(merged), callID); err != nil {
+            return nil, err
+        }
+    }
+
+    r.mu.Lock()
+    if record, ok := r.activeCallsMap[callID]; ok {
+        record.Tags = merged
+    }
+    r.mu.Unlock()
+
+    return merged, nil
+}
+
+func copyTags(tags map[string]string) map[string]string {
+    if tags == nil {
+        return nil
+    }
+    out := make(map[string]string, len(tags))
+    for k, v := range tags {
+        out[k] = v
+    }
+    return out
+}
+
+// eventFor builds a call event carrying the record's identifiers and tags,
+// and the request ID of the API request that raised it
+func eventFor(ctx context.Context, eventType string, record *models.CallRecord, status models.CallState) models.Event {
+    return models.Event{
+        Type:      eventType,
+        CallID:    record.CallID,
+        ANI:       record.OriginalANI,
+        DNIS:      record.OriginalDNIS,
+        DID:       record.AssignedDID,
+        Status:    status,
+        Tags:      copyTags(record.Tags),
+        Campaign:  record.Campaign,
+        Tenant:    record.Tenant,
+        TraceID:   traceID(record.TraceParent),
+        RequestID: logging.RequestID(ctx),
+    }
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "strconv"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Wholesale and retail traffic age differently: a wholesale carrier may
+// take minutes to bring a call back from S3, a retail call that has not
+// hung up after an hour has lost its hangup. A tenant's profile can
+// override, per tenant:
+//
+//	reservation_ttl  how long a forwarded call holds its DID waiting for
+//	                 the return leg before it fails as stale (5m)
+//	stale_timeout    how long a returned call is tracked without a hangup
+//	                 before lookups stop matching it (5m)
+//	max_duration     how long a returned call may last before S2 ends it
+//	                 and frees its DID (routing.max_call_duration)
+//	priority         order calls waiting for a DID are served in
+//
+// Zero keeps the router default. The database side reads the overrides
+// from the tenants table itself, so every router applies the same ones.
+const maxTenantTimeout = 24 * 60 * 60 // seconds
+
+// validateTenantQoS checks the QoS overrides of a tenant profile
+func validateTenantQoS(t models.Tenant) error {
+    for _, v := range []struct {
+        name    string
+        seconds int
+    }{
+        {"reservation_ttl", t.ReservationTTL},
+        {"stale_timeout", t.StaleTimeout},
+        {"max_duration", t.MaxDuration},
+    } {
+        if v.seconds < 0 || v.seconds > maxTenantTimeout {
+            return fmt.Errorf("%s must be 0-%d seconds", v.name, maxTenantTimeout)
+        }
+    }
+    return nil
+}
+
+// inFlightAge is how long a call counts as in flight in its current state:
+// the reservation TTL until it returns from S3, the stale timeout after
+func (r *Router) inFlightAge(record *models.CallRecord) time.Duration {
+    t := r.tenantByID(record.Tenant)
+    if t == nil {
+        return staleCallAge
+    }
+    seconds := t.ReservationTTL
+    if record.Status == models.CallStateReturned {
+        seconds = t.StaleTimeout
+    }
+    if seconds <= 0 {
+        return staleCallAge
+    }
+    return time.Duration(seconds) * time.Second
+}
+
+// maxDuration is how long a returned call may last, 0 for no limit
+func (r *Router) maxDuration(record *models.CallRecord) time.Duration {
+    if t := r.tenantByID(record.Tenant); t != nil && t.MaxDuration > 0 {
+        return time.Duration(t.MaxDuration) * time.Second
+    }
+    return r.config.MaxCallDuration
+}
+
+// endLongCalls ends returned calls past their maximum duration, freeing
+// the DIDs of calls whose hangup was lost
+func (r *Router) endLongCalls() error {
+    ctx := context.Background()
+    r.mu.RLock()
+    var expired []*models.CallRecord
+    for _, record := range r.activeCallsMap {
+        if record.Status != models.CallStateReturned {
+            continue
+        }
+        if limit := r.maxDuration(record); limit > 0 && r.since(record.StartTime) >= limit {
+            expired = append(expired, record)
+        }
+    }
+    r.mu.RUnlock()
+
+    for _, record := range expired {
+        unlock := r.calls.lock(record.CallID)
+        r.mu.RLock()
+        current := r.activeCallsMap[record.CallID] == record && record.Status == models.CallStateReturned
+        r.mu.RUnlock()
+        if current {
+            callLogger(ctx, record).Warnf("Call %s exceeded its maximum duration of %s, ending it and releasing DID %s",
+                record.CallID, r.maxDuration(record), record.AssignedDID)
+            r.finishCall(ctx, record, models.CallStateCompleted, "", "max_duration")
+        }
+        unlock()
+    }
+    return nil
+}
+
+// tenantSeconds is the SQL for a call_records row's tenant override of
+// column, in seconds, falling back to the router default
+func tenantSeconds(column string) string {
+    return "COALESCE((SELECT NULLIF(t." + column + ", 0) FROM tenants t WHERE t.tenant_id = call_records.tenant_id), " +
+        strconv.Itoa(int(staleCallAge.Seconds())) + ")"
+}
@@ -0,0 +1,259 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// ErrUnknownTenant is returned when S1 passes a SIP domain no tenant owns
+var ErrUnknownTenant = errors.New("unknown tenant domain")
+
+// tenantDirectory caches tenants for the hot path
+type tenantDirectory struct {
+    mu       sync.RWMutex
+    byID     map[string]*models.Tenant
+    byDomain map[string]*models.Tenant
+}
+
+// normalizeDomain lowercases a SIP domain and drops any port
+func normalizeDomain(domain string) string {
+    domain = strings.ToLower(strings.TrimSpace(domain))
+    if i := strings.LastIndex(domain, ":"); i > 0 && !strings.Contains(domain[i:], "]") {
+        domain = domain[:i]
+    }
+    return domain
+}
+
+// loadTenants refreshes the cached directory from the database
+func (r *Router) loadTenants() error {
+    list, err := r.Tenants(context.Background())
+    if err != nil {
+        logger.Errorf("Error loading tenants: %v", err)
+        return err
+    }
+
+    byID := make(map[string]*models.Tenant, len(list))
+    byDomain := make(map[string]*models.Tenant)
+    for i := range list {
+        t := &list[i]
+        byID[t.ID] = t
+        for _, d := range t.Domains {
+            byDomain[d] = t
+        }
+    }
+
+    r.tenants.mu.Lock()
+    r.tenants.byID = byID
+    r.tenants.byDomain = byDomain
+    r.tenants.mu.Unlock()
+    return nil
+}
+
+// tenantForDomain resolves the tenant for a call. No domain selects the
+// default (untenanted) pool and trunks.
+func (r *Router) tenantForDomain(domain string) (*models.Tenant, error) {
+    domain = normalizeDomain(domain)
+    if domain == "" {
+        return nil, nil
+    }
+
+    r.tenants.mu.RLock()
+    t, ok := r.tenants.byDomain[domain]
+    r.tenants.mu.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, domain)
+    }
+    return t, nil
+}
+
+// tenantByID returns the cached tenant, or nil for the default tenant
+func (r *Router) tenantByID(id string) *models.Tenant {
+    if id == "" {
+        return nil
+    }
+    r.tenants.mu.RLock()
+    defer r.tenants.mu.RUnlock()
+    return r.tenants.byID[id]
+}
+
+// defaultTrunk is the trunk a leg uses before overrides are applied
+func (r *Router) defaultTrunk(leg string, t *models.Tenant) string {
+    if leg == legReturn {
+        if t != nil && t.ReturnTrunk != "" {
+            return t.ReturnTrunk
+        }
+        return r.config.ReturnTrunk
+    }
+    if t != nil && t.ForwardTrunk != "" {
+        return t.ForwardTrunk
+    }
+    return r.config.ForwardTrunk
+}
+
+func tenantID(t *models.Tenant) string {
+    if t == nil {
+        return ""
+    }
+    return t.ID
+}
+
+// Tenants lists configured tenants with their domains
+func (r *Router) Tenants(ctx context.Context) ([]models.Tenant, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT tenant_id, name, COALESCE(forward_trunk, ''), COALESCE(return_trunk, ''),
+            reservation_ttl, stale_timeout, max_duration, priority, updated_at
+        FROM tenants
+        ORDER BY tenant_id
+    `)
+    if err != nil {
+        return nil, err
+    }
+
+    list := []models.Tenant{}
+    index := make(map[string]int)
+    for rows.Next() {
+        t := models.Tenant{Domains: []string{}}
+        if err := rows.Scan(&t.ID, &t.Name, &t.ForwardTrunk, &t.ReturnTrunk,
+            &t.ReservationTTL, &t.StaleTimeout, &t.MaxDuration, &t.Priority, &t.UpdatedAt); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        index[t.ID] = len(list)
+        list = append(list, t)
+    }
+    rows.Close()
+
+    domains, err := r.db.QueryContext(ctx, "SELECT domain, tenant_id FROM tenant_domains ORDER BY domain")
+    if err != nil {
+        return nil, err
+    }
+    defer domains.Close()
+    for domains.Next() {
+        var domain, id string
+        if err := domains.Scan(&domain, &id); err != nil {
+            return nil, err
+        }
+        if i, ok := index[id]; ok {
+            list[i].Domains = append(list[i].Domains, domain)
+        }
+    }
+    return list, domains.Err()
+}
+
+// SetTenant creates or updates a tenant and replaces its domain list
+func (r *Router) SetTenant(ctx context.Context, t models.Tenant) (*models.Tenant, error) {
+    if t.ID == "" || len(t.ID) > 64 {
+        return nil, fmt.Errorf("tenant_id must be 1-64 characters")
+    }
+    domains := make([]string, 0, len(t.Domains))
+    for _, d := range t.Domains {
+        if d = normalizeDomain(d); d != "" {
+            domains = append(domains, d)
+        }
+    }
+    if len(domains) == 0 {
+        return nil, fmt.Errorf("at least one domain is required")
+    }
+    t.Domains = domains
+    if err := validateTenantQoS(t); err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    tx, err := r.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    _, err = tx.ExecContext(ctx, `
+        INSERT INTO tenants (tenant_id, name, forward_trunk, return_trunk, reservation_ttl, stale_timeout, max_duration, priority)
+        VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE name = VALUES(name), forward_trunk = VALUES(forward_trunk),
+            return_trunk = VALUES(return_trunk), reservation_ttl = VALUES(reservation_ttl),
+            stale_timeout = VALUES(stale_timeout), max_duration = VALUES(max_duration), priority = VALUES(priority)
+    `, t.ID, t.Name, t.ForwardTrunk, t.ReturnTrunk, t.ReservationTTL, t.StaleTimeout, t.MaxDuration, t.Priority)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := tx.ExecContext(ctx, "DELETE FROM tenant_domains WHERE tenant_id = ?", t.ID); err != nil {
+        return nil, err
+    }
+    for _, d := range domains {
+        var owner string
+        err := tx.QueryRowContext(ctx, "SELECT tenant_id FROM tenant_domains WHERE domain = ?", d).Scan(&owner)
+        if err == nil {
+            return nil, fmt.Errorf("domain %s already belongs to tenant %s", d, owner)
+        }
+        if _, err := tx.ExecContext(ctx, "INSERT INTO tenant_domains (domain, tenant_id) VALUES (?, ?)", d, t.ID); err != nil {
+            return nil, err
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+
+    t.UpdatedAt = r.clock.Now()
+    logger.Infof("Tenant %s saved with domains %s", t.ID, strings.Join(domains, ", "))
+    r.loadTenants()
+    return &t, nil
+}
+
+func (r *Router) DeleteTenant(ctx context.Context, id string) error {
+    var inUse int
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM dids WHERE tenant_id = ?", id).Scan(&inUse)
+    if inUse > 0 {
+        return fmt.Errorf("tenant %s still owns %d DIDs", id, inUse)
+    }
+
+    result, err := r.db.ExecContext(ctx, "DELETE FROM tenants WHERE tenant_id = ?", id)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("tenant %s not found", id)
+    }
+    r.db.ExecContext(ctx, "DELETE FROM tenant_domains WHERE tenant_id = ?", id)
+    r.loadTenants()
+    return nil
+}
+
+// AssignTenantDIDs moves DIDs into a tenant's pool; an empty id returns
+// them to the default pool
+func (r *Router) AssignTenantDIDs(ctx context.Context, id string, dids []string) (int, error) {
+    if id != "" && r.tenantByID(id) == nil {
+        return 0, fmt.Errorf("tenant %s not found", id)
+    }
+    if len(dids) == 0 {
+        return 0, nil
+    }
+
+    args := make([]interface{}, 0, len(dids)+1)
+    args = append(args, id)
+    for _, did := range dids {
+        args = append(args, did)
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(dids)), ",")
+
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, "UPDATE dids SET tenant_id = ? WHERE did IN ("+placeholders+")", args...)
+    if err != nil {
+        return 0, err
+    }
+    rows, _ := result.RowsAffected()
+    return int(rows), nil
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+    "errors"
+    "fmt"
+    "math"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/ratelimit"
+)
+
+// ErrThrottled is returned for incoming calls above the router's CPS
+// ceiling. It is checked before any lookup, so a surge is refused without
+// reaching the database; S1 retries after a second or on the other S2.
+var ErrThrottled = errors.New("throttled")
+
+// ErrCapacity is returned for incoming calls while the router tracks
+// MaxConcurrentCalls already. The dialplan plays congestion rather than
+// S2 taking a call it cannot track.
+var ErrCapacity = errors.New("router at capacity")
+
+var (
+    cpsThrottled = metrics.NewCounter("s2_cps_throttled_total",
+        "Incoming calls refused by the global CPS ceiling")
+    capacityRejected = metrics.NewCounter("s2_capacity_rejected_total",
+        "Incoming calls refused at the concurrent call limit")
+)
+
+// newCPSBucket returns the bucket of the CPS ceiling, nil when disabled
+func newCPSBucket(maxCPS float64, burst int, c clock.Clock) *ratelimit.Bucket {
+    if maxCPS <= 0 {
+        return nil
+    }
+    if burst <= 0 {
+        burst = int(math.Ceil(maxCPS))
+    }
+    return ratelimit.NewBucket(maxCPS, burst, c)
+}
+
+// checkCPS takes a token from the global CPS bucket, if there is one
+func (r *Router) checkCPS() error {
+    if r.cps == nil || r.cps.Allow() {
+        return nil
+    }
+    cpsThrottled.Inc()
+    return fmt.Errorf("%w: over %.1f calls per second", ErrThrottled, r.config.MaxCPS)
+}
+
+// checkConcurrency refuses a new call at the concurrent call limit.
+// Caller must hold r.mu.
+func (r *Router) checkConcurrency() error {
+    limit := r.config.MaxConcurrentCalls
+    if limit <= 0 || len(r.activeCallsMap)+len(r.admissions) < limit {
+        return nil
+    }
+    capacityRejected.Inc()
+    return fmt.Errorf("%w: %d concurrent calls", ErrCapacity, limit)
+}
@@ -0,0 +1,51 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/clock"
+)
+
+// The CPS ceiling refills on the router's clock: once the burst is spent
+// calls are throttled until the clock has moved on a token's worth
+func TestCPSCeilingRefillsOnRouterClock(t *testing.T) {
+    fake := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+    r := newTestRouter(t, newFakeStorage(fakeDIDs(10)...), Config{Clock: fake, MaxCPS: 2, CPSBurst: 2})
+    ctx := context.Background()
+    calls := 0
+    call := func() error {
+        calls++
+        _, err := r.ProcessIncomingCall(ctx, fmt.Sprintf("cps-%d", calls), "12125550001", fmt.Sprintf("44207000000%d", calls), IncomingOptions{})
+        return err
+    }
+
+    for i := 0; i < 2; i++ {
+        if err := call(); err != nil {
+            t.Fatalf("call %d within the burst: %v", calls, err)
+        }
+    }
+    if err := call(); !errors.Is(err, ErrThrottled) {
+        t.Fatalf("call over the burst: %v", err)
+    }
+    // Real time passing refills nothing
+    time.Sleep(600 * time.Millisecond)
+    if err := call(); !errors.Is(err, ErrThrottled) {
+        t.Fatalf("call after real time passed: %v", err)
+    }
+
+    fake.Advance(400 * time.Millisecond)
+    if err := call(); !errors.Is(err, ErrThrottled) {
+        t.Fatalf("call before a token refilled: %v", err)
+    }
+    fake.Advance(100 * time.Millisecond)
+    if err := call(); err != nil {
+        t.Fatalf("call after a token refilled: %v", err)
+    }
+    if err := call(); !errors.Is(err, ErrThrottled) {
+        t.Fatalf("second call on one refilled token: %v", err)
+    }
+}
@@ -0,0 +1,46 @@
+package router
+
+import (
+    "context"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// recordCallEvent appends a transition to the call's timeline, with the
+// request ID of the API request that caused it. A failed write only costs
+// the timeline, never the call.
+func (r *Router) recordCallEvent(ctx context.Context, callID, event string, at time.Time, detail string) {
+    if len(detail) > 255 {
+        detail = detail[:255]
+    }
+    ev := models.CallEvent{Event: event, At: at, Detail: detail, RequestID: logging.RequestID(ctx)}
+    if err := r.store.RecordCallEvent(ctx, callID, ev); err != nil {
+        logger.Call(callID, "", "").Context(ctx).Errorf("Failed to record %s for call %s: %v", event, callID, err)
+    }
+}
+
+// CallTimeline returns the recorded transitions of a call with the time
+// spent between each, or nil if none were recorded
+func (r *Router) CallTimeline(ctx context.Context, callID string) (*models.CallTimeline, error) {
+    events, err := r.store.CallEvents(ctx, callID)
+    if err != nil || len(events) == 0 {
+        return nil, err
+    }
+
+    timeline := &models.CallTimeline{CallID: callID, Events: events, Stages: []models.StageLatency{}}
+    for i := 1; i < len(events); i++ {
+        timeline.Stages = append(timeline.Stages, models.StageLatency{
+            From:   events[i-1].Event,
+            To:     events[i].Event,
+            Millis: millis(events[i].At.Sub(events[i-1].At)),
+        })
+    }
+    timeline.Total = millis(events[len(events)-1].At.Sub(events[0].At))
+    return timeline, nil
+}
+
+func millis(d time.Duration) float64 {
+    return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "fmt"
+    "math/big"
+)
+
+// Match token placement in the DNIS forwarded to S3
+const (
+    TokenOff    = ""
+    TokenPrefix = "prefix"
+    TokenSuffix = "suffix"
+)
+
+// EncodeToken embeds a match token into the number sent to S3.
+// With an empty token or TokenOff the DID is returned unchanged.
+func EncodeToken(did, token, mode string) string {
+    if token == "" {
+        return did
+    }
+    switch mode {
+    case TokenPrefix:
+        return token + did
+    case TokenSuffix:
+        return did + token
+    }
+    return did
+}
+
+// DecodeToken splits a number received back from S3 into the DID and the
+// match token of the given length. ok is false if the number cannot carry
+// a token, e.g. because S3 stripped it.
+func DecodeToken(number, mode string, digits int) (did, token string, ok bool) {
+    if digits <= 0 || len(number) <= digits || !isDigits(number) {
+        return number, "", false
+    }
+    switch mode {
+    case TokenPrefix:
+        return number[digits:], number[:digits], true
+    case TokenSuffix:
+        return number[:len(number)-digits], number[len(number)-digits:], true
+    }
+    return number, "", false
+}
+
+// newToken returns a random numeric token not held by any active call.
+// Caller must hold r.mu.
+func (r *Router) newToken() string {
+    max := big.NewInt(1)
+    for i := 0; i < r.config.TokenDigits; i++ {
+        max.Mul(max, big.NewInt(10))
+    }
+
+    var token string
+    for attempt := 0; attempt < 10; attempt++ {
+        n, err := rand.Int(rand.Reader, max)
+        if err != nil {
+            break
+        }
+        token = fmt.Sprintf("%0*d", r.config.TokenDigits, n)
+        if _, taken := r.tokenToCall[token]; !taken {
+            return token
+        }
+    }
+    logger.Warnf("Could not find a free match token, reusing %s", token)
+    return token
+}
+
+// findCallByToken resolves the call a match token was issued to, falling
+// back to the database. Caller must not hold r.mu.
+func (r *Router) findCallByToken(ctx context.Context, token string) (string, error) {
+    r.mu.RLock()
+    callID, exists := r.tokenToCall[token]
+    r.mu.RUnlock()
+    if exists {
+        return callID, nil
+    }
+
+    if record := r.sharedCallBy("token", token); record != nil {
+        callLogger(ctx, record).Infof("Restored call %s from shared state", record.CallID)
+        return r.restoreCall(record), nil
+    }
+
+    logger.Debugf("Token %s not found in memory, checking database", token)
+    record, err := r.store.CallRecordByToken(ctx, token)
+    if err == sql.ErrNoRows {
+        logger.Warnf("No record found for token %s", token)
+        return "", fmt.Errorf("%w for token %s", ErrCallNotFound, token)
+    }
+    if err != nil {
+        logger.Warnf("Error looking up token %s: %v", token, err)
+        return "", fmt.Errorf("looking up token %s: %w", token, err)
+    }
+
+    callLogger(ctx, record).Infof("Restored call %s from database", record.CallID)
+    return r.restoreCall(record), nil
+}
@@ -0,0 +1,55 @@
+package router
+
+import (
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+    "github.com/asterisk-call-routing-v2/internal/tracing"
+)
+
+// Baggage member naming the S2 call, so S3/S4 spans can be searched by it
+const baggageCallID = "s2.call_id"
+
+// Exemplars carry the routing span's trace ID, so a slow bucket in Grafana
+// links straight to one of the calls that landed in it
+var routingDuration = metrics.NewHistogram("s2_routing_duration_seconds",
+    "Time to route a call by direction (incoming or return)", nil, "direction")
+
+// finishSpan ends a routing span, records its latency and hands its context
+// to the next hop
+func finishSpan(span *tracing.Span, direction string, response *models.CallResponse, baggage string, err error) {
+    routingDuration.ObserveExemplar(span.Elapsed().Seconds(), span.ExemplarTraceID(), direction)
+    if response != nil {
+        response.TraceParent = span.Traceparent()
+        response.Baggage = tracing.MergeBaggage(baggage, baggageCallID, span.Attr("call.id"))
+    }
+    span.End(err)
+}
+
+// traceSpan records a short span under the call's forward span, e.g. for
+// its completion
+func (r *Router) traceSpan(name string, record *models.CallRecord, attrs ...string) {
+    span := r.tracer.Start(name, record.TraceParent)
+    span.SetAttr("call.id", record.CallID)
+    for i := 0; i+1 < len(attrs); i += 2 {
+        span.SetAttr(attrs[i], attrs[i+1])
+    }
+    span.End(nil)
+}
+
+// TraceExemplar returns the trace ID of a traceparent the router issued,
+// for HTTP latency exemplars; "" when traces are not exported
+func (r *Router) TraceExemplar(traceparent string) string {
+    sc, ok := tracing.ParseTraceparent(traceparent)
+    if !ok {
+        return ""
+    }
+    return r.tracer.ExemplarTraceID(sc)
+}
+
+// traceID extracts the trace ID from a stored traceparent
+func traceID(traceparent string) string {
+    if sc, ok := tracing.ParseTraceparent(traceparent); ok {
+        return sc.TraceIDString()
+    }
+    return ""
+}
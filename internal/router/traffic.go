@@ -0,0 +1,217 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+const (
+    profileWeeks = 4
+    maxAnomalies = 100
+)
+
+var trafficAnomalies = metrics.NewCounter("s2_traffic_anomalies_total",
+    "Hours whose call volume deviated from the learned profile", "direction")
+
+// ProfileSlot is the learned call volume for one hour of the week
+type ProfileSlot struct {
+    Weekday time.Weekday `json:"weekday"`
+    Hour    int          `json:"hour"`
+    Mean    float64      `json:"mean"`
+    StdDev  float64      `json:"stddev"`
+    Samples int          `json:"samples"`
+}
+
+// TrafficAnomaly is an hour whose volume deviated from its profile slot
+type TrafficAnomaly struct {
+    Hour     time.Time `json:"hour"`
+    Observed int       `json:"observed"`
+    Expected float64   `json:"expected"`
+    Score    float64   `json:"score"`
+    Kind     string    `json:"kind"` // "spike" or "drop"
+}
+
+// trafficProfile holds the learned baseline and recent deviations
+type trafficProfile struct {
+    mu          sync.RWMutex
+    slots       map[int]ProfileSlot // weekday*24+hour
+    learnedAt   time.Time
+    anomalies   []TrafficAnomaly
+    lastChecked time.Time
+}
+
+func slotIndex(t time.Time) int {
+    return int(t.Weekday())*24 + t.Hour()
+}
+
+// learnTrafficProfile rebuilds the per-hour-of-week baseline from recent
+// history and checks the last complete hour against it
+func (r *Router) learnTrafficProfile() error {
+    now := r.clock.Now()
+    currentHour := now.Truncate(time.Hour)
+    since := currentHour.AddDate(0, 0, -7*profileWeeks)
+
+    counts, err := r.hourlyCounts(context.Background(), since, currentHour)
+    if err != nil {
+        logger.Errorf("Error loading traffic history: %v", err)
+        return err
+    }
+
+    // Walk every hour so hours without calls count as zero
+    samples := make(map[int][]float64)
+    for h := since; h.Before(currentHour); h = h.Add(time.Hour) {
+        samples[slotIndex(h)] = append(samples[slotIndex(h)], float64(counts[h.Unix()]))
+    }
+
+    slots := make(map[int]ProfileSlot, len(samples))
+    for idx, values := range samples {
+        mean, stddev := meanStdDev(values)
+        slots[idx] = ProfileSlot{
+            Weekday: time.Weekday(idx / 24),
+            Hour:    idx % 24,
+            Mean:    math.Round(mean*100) / 100,
+            StdDev:  math.Round(stddev*100) / 100,
+            Samples: len(values),
+        }
+    }
+
+    p := &r.traffic
+    p.mu.Lock()
+    p.slots = slots
+    p.learnedAt = now
+    p.mu.Unlock()
+
+    // The last complete hour is compared against a profile that excludes it
+    lastHour := currentHour.Add(-time.Hour)
+    if !p.lastChecked.Equal(lastHour) {
+        p.lastChecked = lastHour
+        r.checkTrafficHour(lastHour, counts[lastHour.Unix()], samples[slotIndex(lastHour)])
+    }
+    return nil
+}
+
+func (r *Router) checkTrafficHour(hour time.Time, observed int, history []float64) {
+    if r.config.AnomalyThreshold <= 0 || len(history) < 2 {
+        return
+    }
+
+    // Exclude the hour being judged from its own baseline
+    mean, stddev := meanStdDev(history[:len(history)-1])
+
+    // Poisson floor keeps quiet hours from alerting on a handful of calls
+    spread := math.Max(stddev, math.Max(math.Sqrt(mean), 1))
+    score := (float64(observed) - mean) / spread
+    if math.Abs(score) < r.config.AnomalyThreshold {
+        return
+    }
+
+    anomaly := TrafficAnomaly{
+        Hour:     hour,
+        Observed: observed,
+        Expected: math.Round(mean*100) / 100,
+        Score:    math.Round(score*100) / 100,
+        Kind:     "spike",
+    }
+    if score < 0 {
+        anomaly.Kind = "drop"
+    }
+
+    trafficAnomalies.Inc(anomaly.Kind)
+    logger.Warnf("ALERT: traffic %s at %s: %d calls, expected %.1f (score %.1f)",
+        anomaly.Kind, hour.Format("Mon 15:04"), observed, mean, score)
+
+    p := &r.traffic
+    p.mu.Lock()
+    p.anomalies = append(p.anomalies, anomaly)
+    if len(p.anomalies) > maxAnomalies {
+        p.anomalies = p.anomalies[len(p.anomalies)-maxAnomalies:]
+    }
+    p.mu.Unlock()
+
+    r.publish(models.Event{
+        Type:   "traffic.anomaly",
+        Detail: fmt.Sprintf("%s: %d calls in hour starting %s, expected %.1f", anomaly.Kind, observed, hour.Format(time.RFC3339), mean),
+    })
+}
+
+// hourlyCounts returns call attempts per hour keyed by the hour's Unix time
+func (r *Router) hourlyCounts(ctx context.Context, from, to time.Time) (map[int64]int, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT DATE_FORMAT(start_time, '%Y-%m-%d %H:00:00') AS hour, COUNT(*)
+        FROM call_records
+        WHERE start_time >= ? AND start_time < ?
+        GROUP BY hour
+    `, from, to)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    counts := make(map[int64]int)
+    for rows.Next() {
+        var hour string
+        var n int
+        if err := rows.Scan(&hour, &n); err != nil {
+            return nil, err
+        }
+        t, err := time.ParseInLocation("2006-01-02 15:04:05", hour, time.Local)
+        if err != nil {
+            continue
+        }
+        counts[t.Unix()] = n
+    }
+    return counts, rows.Err()
+}
+
+// TrafficBaseline returns the learned profile ordered by weekday and hour
+func (r *Router) TrafficBaseline() ([]ProfileSlot, time.Time) {
+    p := &r.traffic
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+
+    list := make([]ProfileSlot, 0, len(p.slots))
+    for idx := 0; idx < 7*24; idx++ {
+        if slot, ok := p.slots[idx]; ok {
+            list = append(list, slot)
+        }
+    }
+    return list, p.learnedAt
+}
+
+// TrafficAnomalies returns recent deviations, newest first
+func (r *Router) TrafficAnomalies() []TrafficAnomaly {
+    p := &r.traffic
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+
+    list := make([]TrafficAnomaly, 0, len(p.anomalies))
+    for i := len(p.anomalies) - 1; i >= 0; i-- {
+        list = append(list, p.anomalies[i])
+    }
+    return list
+}
+
+func meanStdDev(values []float64) (float64, float64) {
+    if len(values) == 0 {
+        return 0, 0
+    }
+    var sum float64
+    for _, v := range values {
+        sum += v
+    }
+    mean := sum / float64(len(values))
+
+    var sq float64
+    for _, v := range values {
+        sq += (v - mean) * (v - mean)
+    }
+    return mean, math.Sqrt(sq / float64(len(values)))
+}
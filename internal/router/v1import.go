@@ -0,0 +1,273 @@
+package router
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// v1Statuses maps the statuses of the v1 router's call_records to call
+// states. Both the short names and the v2 spellings are accepted; anything
+// else is rejected rather than filed as a failure nobody anticipated.
+var v1Statuses = map[string]models.CallState{
+    "ACTIVE":           models.CallStateActive,
+    "NEW":              models.CallStateActive,
+    "FORWARDED":        models.CallStateForwarded,
+    "FORWARDED_TO_S3":  models.CallStateForwarded,
+    "RETURNED":         models.CallStateReturned,
+    "RETURNED_FROM_S3": models.CallStateReturned,
+    "COMPLETED":        models.CallStateCompleted,
+    "COMPLETED_AT_S4":  models.CallStateCompleted,
+    "SUCCESS":          models.CallStateCompleted,
+    "FAILED":           models.CallStateFailed,
+    "ERROR":            models.CallStateFailed,
+    "TIMEOUT":          models.CallStateFailed,
+    "ABANDONED":        models.CallStateFailed,
+    "STALE":            models.CallStateFailed,
+}
+
+// Calls in flight in v1 continue on v2 if they started within the stale
+// cleanup's window; it would fail older ones anyway
+const v1ActiveWindow = 5 * time.Minute
+
+func inFlight(status models.CallState) bool {
+    return status == models.CallStateActive || status == models.CallStateForwarded || status == models.CallStateReturned
+}
+
+// ImportV1 adds a batch of a v1 router database: its DIDs to the default
+// pool, free, and its calls to the call history with their statuses mapped
+// to call states. Calls in flight claim their DID and are tracked, so they
+// can come back from S3 to this router after the cutover. DIDs and calls
+// already present are skipped, so a migration can be rerun. dryRun
+// validates and counts without writing.
+func (r *Router) ImportV1(ctx context.Context, batch *models.V1Batch, dryRun bool) (*models.V1Import, error) {
+    if r.config.ReadOnly && !dryRun {
+        return nil, ErrReadOnly
+    }
+    if len(batch.DIDs)+len(batch.Calls) > maxImportRows {
+        return nil, fmt.Errorf("batch exceeds %d rows", maxImportRows)
+    }
+
+    report := &models.V1Import{DryRun: dryRun}
+    reject := func(callID, did string, err error) {
+        report.Invalid++
+        if len(report.Errors) < maxImportErrors {
+            report.Errors = append(report.Errors, models.V1ImportError{CallID: callID, DID: did, Error: err.Error()})
+        }
+    }
+
+    var dids []importRow
+    seen := make(map[string]bool)
+    for _, d := range batch.DIDs {
+        row, err := parseImportRow(0, []string{d.DID, d.Country})
+        if err != nil {
+            reject("", d.DID, err)
+            continue
+        }
+        if seen[row.did] {
+            report.DIDsExisting++
+            continue
+        }
+        seen[row.did] = true
+        dids = append(dids, row)
+    }
+    for start := 0; start < len(dids); start += importBatchSize {
+        end := start + importBatchSize
+        if end > len(dids) {
+            end = len(dids)
+        }
+        imported, existing, err := r.importBatch(ctx, dids[start:end], "", "", dryRun)
+        if err != nil {
+            return nil, fmt.Errorf("v1 import stopped after %d DIDs: %w", report.DIDs, err)
+        }
+        report.DIDs += imported
+        report.DIDsExisting += existing
+    }
+
+    var calls []*models.CallRecord
+    seen = make(map[string]bool)
+    for _, c := range batch.Calls {
+        record, err := r.v1CallRecord(c)
+        if err != nil {
+            reject(c.CallID, c.DID, err)
+            continue
+        }
+        if seen[record.CallID] {
+            report.CallsExisting++
+            continue
+        }
+        seen[record.CallID] = true
+        calls = append(calls, record)
+    }
+    now := r.clock.Now()
+    for start := 0; start < len(calls); start += importBatchSize {
+        end := start + importBatchSize
+        if end > len(calls) {
+            end = len(calls)
+        }
+        if err := r.importV1Calls(ctx, calls[start:end], now, dryRun, report); err != nil {
+            return nil, fmt.Errorf("v1 import stopped after %d calls: %w", report.Calls, err)
+        }
+    }
+
+    if !dryRun {
+        logger.Infof("Imported from v1: %d DIDs (%d existing), %d calls (%d existing, %d active, %d abandoned), %d invalid rows",
+            report.DIDs, report.DIDsExisting, report.Calls, report.CallsExisting, report.Active, report.Abandoned, report.Invalid)
+    }
+    return report, nil
+}
+
+// v1CallRecord validates a v1 call and maps it to a call record
+func (r *Router) v1CallRecord(c models.V1Call) (*models.CallRecord, error) {
+    status, ok := v1Statuses[strings.ToUpper(strings.TrimSpace(c.Status))]
+    switch {
+    case c.CallID == "" || len(c.CallID) > 100:
+        return nil, errors.New("call_id must be 1-100 characters")
+    case !ok:
+        return nil, fmt.Errorf("unknown v1 status %q", c.Status)
+    case c.StartTime.IsZero():
+        return nil, errors.New("missing start_time")
+    case len(c.ANI) > 50 || len(c.DNIS) > 50 || len(c.DID) > 50:
+        return nil, errors.New("ANI, DNIS and DID must be at most 50 characters")
+    case len(c.RecordingPath) > 255:
+        return nil, errors.New("recording_path exceeds 255 characters")
+    }
+    return &models.CallRecord{
+        CallID:        c.CallID,
+        OriginalANI:   c.ANI,
+        OriginalDNIS:  c.DNIS,
+        AssignedDID:   c.DID,
+        Status:        status,
+        StartTime:     c.StartTime,
+        EndTime:       c.EndTime,
+        Duration:      c.Duration,
+        RecordingPath: c.RecordingPath,
+        ForwardTrunk:  r.config.ForwardTrunk,
+    }, nil
+}
+
+// importV1Calls skips the calls already recorded, claims the DIDs of the
+// ones still in flight and inserts the rest in one statement
+func (r *Router) importV1Calls(ctx context.Context, records []*models.CallRecord, now time.Time, dryRun bool, report *models.V1Import) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+
+    args := make([]interface{}, len(records))
+    for i, record := range records {
+        args[i] = record.CallID
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(records)), ",")
+    rows, err := r.db.QueryContext(ctx, "SELECT call_id FROM call_records WHERE call_id IN ("+placeholders+")", args...)
+    if err != nil {
+        return err
+    }
+    present := make(map[string]bool)
+    for rows.Next() {
+        var callID string
+        if err := rows.Scan(&callID); err == nil {
+            present[callID] = true
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    var fresh, active []*models.CallRecord
+    for _, record := range records {
+        if present[record.CallID] {
+            report.CallsExisting++
+            continue
+        }
+        fresh = append(fresh, record)
+        if !inFlight(record.Status) {
+            continue
+        }
+        if now.Sub(record.StartTime) > v1ActiveWindow || record.AssignedDID == "" {
+            record.Status = models.CallStateFailed
+            report.Abandoned++
+            continue
+        }
+        if dryRun {
+            report.Active++
+            continue
+        }
+        claimed, err := r.claimV1DID(ctx, record)
+        if err != nil {
+            r.releaseV1DIDs(active)
+            return err
+        }
+        if !claimed {
+            logger.Call(record.CallID, record.AssignedDID, record.OriginalANI).Warnf(
+                "v1 call %s abandoned: DID %s is in use on v2", record.CallID, record.AssignedDID)
+            record.Status = models.CallStateFailed
+            report.Abandoned++
+            continue
+        }
+        active = append(active, record)
+    }
+    if len(fresh) == 0 || dryRun {
+        report.Calls += len(fresh)
+        return nil
+    }
+
+    values := make([]string, 0, len(fresh))
+    args = args[:0]
+    for _, record := range fresh {
+        values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)")
+        args = append(args, record.CallID, record.OriginalANI, record.OriginalDNIS, record.AssignedDID, record.Status,
+            record.StartTime, record.EndTime, record.Duration, record.RecordingPath, record.ForwardTrunk)
+    }
+    res, err := r.db.ExecContext(ctx, `
+        INSERT IGNORE INTO call_records
+        (call_id, original_ani, original_dnis, assigned_did, status, start_time, end_time, duration, recording_path, forward_trunk)
+        VALUES `+strings.Join(values, ", "), args...)
+    if err != nil {
+        r.releaseV1DIDs(active)
+        return err
+    }
+    n, _ := res.RowsAffected()
+    report.Calls += int(n)
+    report.CallsExisting += len(fresh) - int(n)
+
+    r.mu.Lock()
+    for _, record := range active {
+        r.trackCall(record)
+        r.replicateCall(record)
+        r.notifyLive("added", record)
+    }
+    r.mu.Unlock()
+    for _, record := range active {
+        r.shareCall(record)
+    }
+    report.Active += len(active)
+    return nil
+}
+
+// claimV1DID marks an in-flight call's DID in use, adding a DID v2 did not
+// have yet. It fails when a v2 call holds the DID.
+func (r *Router) claimV1DID(ctx context.Context, record *models.CallRecord) (bool, error) {
+    res, err := r.db.ExecContext(ctx, `
+        UPDATE dids SET in_use = 1, destination = ?, last_used_at = NOW()
+        WHERE did = ? AND in_use = 0
+    `, record.OriginalDNIS, record.AssignedDID)
+    if err != nil {
+        return false, err
+    }
+    if n, _ := res.RowsAffected(); n > 0 {
+        return true, nil
+    }
+    return r.store.InsertClaimedDID(ctx, record.AssignedDID, record.OriginalDNIS, "", "")
+}
+
+func (r *Router) releaseV1DIDs(records []*models.CallRecord) {
+    for _, record := range records {
+        if _, err := r.store.ReleaseDID(context.Background(), record.AssignedDID, record.CallID); err != nil {
+            logger.Errorf("Failed to release DID %s: %v", record.AssignedDID, err)
+        }
+    }
+}
@@ -0,0 +1,224 @@
+package router
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+var webhookLogger = logging.New("webhook")
+
+const (
+    webhookPending   = "PENDING"
+    webhookDelivered = "DELIVERED"
+    webhookDead      = "DEAD"
+
+    webhookBaseBackoff = 5 * time.Second
+    webhookMaxBackoff  = 10 * time.Minute
+    webhookBatchSize   = 50
+)
+
+var (
+    webhookDeliveries = metrics.NewCounter("s2_webhook_deliveries_total",
+        "Webhook delivery attempts by result", "result")
+    webhookQueueDepth = metrics.NewGauge("s2_webhook_queue_depth",
+        "Webhook notifications waiting for delivery")
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// publish fans an event out to every configured consumer
+func (r *Router) publish(event models.Event) {
+    if event.Timestamp.IsZero() {
+        event.Timestamp = r.clock.Now()
+    }
+    event.SchemaVersion = models.EventSchemaVersion
+    r.enqueueWebhooks(event)
+    r.streamEvent(event)
+}
+
+// enqueueWebhooks persists one delivery row per configured URL so events
+// raised during a consumer outage survive a router restart
+func (r *Router) enqueueWebhooks(event models.Event) {
+    if len(r.config.WebhookURLs) == 0 || r.config.ReadOnly {
+        return
+    }
+
+    payload, err := json.Marshal(event)
+    if err != nil {
+        webhookLogger.Errorf("Failed to encode %s event: %v", event.Type, err)
+        return
+    }
+
+    // Queued outside the caller's context: an event must not be lost
+    // because the request that raised it was cancelled
+    for _, url := range r.config.WebhookURLs {
+        _, err := r.backgroundExec(`
+            INSERT INTO webhook_queue (event_type, url, payload, status, next_attempt_at)
+            VALUES (?, ?, ?, ?, NOW())
+        `, event.Type, url, string(payload), webhookPending)
+        if err != nil {
+            webhookLogger.Errorf("Failed to queue %s event for %s: %v", event.Type, url, err)
+        }
+    }
+}
+
+// deliverWebhooks sends every due notification once, rescheduling failures
+// with exponential backoff and dead-lettering those out of attempts
+func (r *Router) deliverWebhooks() error {
+    ctx, cancel := r.dbContext(context.Background())
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, event_type, url, payload, attempts
+        FROM webhook_queue
+        WHERE status = ? AND next_attempt_at <= NOW()
+        ORDER BY id
+        LIMIT ?
+    `, webhookPending, webhookBatchSize)
+    if err != nil {
+        webhookLogger.Errorf("Error loading queue: %v", err)
+        return err
+    }
+
+    var due []models.WebhookDelivery
+    for rows.Next() {
+        var d models.WebhookDelivery
+        if err := rows.Scan(&d.ID, &d.EventType, &d.URL, &d.Payload, &d.Attempts); err != nil {
+            webhookLogger.Errorf("Error scanning queue row: %v", err)
+            continue
+        }
+        due = append(due, d)
+    }
+    rows.Close()
+    cancel()
+
+    for _, d := range due {
+        err := postWebhook(d.URL, d.Payload)
+        attempts := d.Attempts + 1
+
+        if err == nil {
+            webhookDeliveries.Inc("delivered")
+            r.backgroundExec(`
+                UPDATE webhook_queue
+                SET status = ?, attempts = ?, last_error = NULL, delivered_at = NOW()
+                WHERE id = ?
+            `, webhookDelivered, attempts, d.ID)
+            continue
+        }
+
+        if attempts >= r.config.WebhookMaxAttempts {
+            webhookDeliveries.Inc("dead")
+            webhookLogger.Warnf("Giving up on delivery %d (%s to %s) after %d attempts: %v",
+                d.ID, d.EventType, d.URL, attempts, err)
+            r.backgroundExec(`
+                UPDATE webhook_queue SET status = ?, attempts = ?, last_error = ? WHERE id = ?
+            `, webhookDead, attempts, truncate(err.Error(), 255), d.ID)
+            continue
+        }
+
+        webhookDeliveries.Inc("retry")
+        delay := webhookBackoff(attempts)
+        webhookLogger.Warnf("Delivery %d to %s failed (attempt %d), retrying in %s: %v",
+            d.ID, d.URL, attempts, delay, err)
+        r.backgroundExec(`
+            UPDATE webhook_queue
+            SET attempts = ?, last_error = ?, next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+            WHERE id = ?
+        `, attempts, truncate(err.Error(), 255), int(delay.Seconds()), d.ID)
+    }
+
+    var depth int
+    ctx, cancel = r.dbContext(context.Background())
+    defer cancel()
+    if err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM webhook_queue WHERE status = ?", webhookPending).Scan(&depth); err == nil {
+        webhookQueueDepth.Set(float64(depth))
+    }
+    return nil
+}
+
+func postWebhook(url, payload string) error {
+    resp, err := webhookClient.Post(url, "application/json", bytes.NewBufferString(payload))
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("unexpected status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// webhookBackoff doubles the delay for every failed attempt up to a ceiling
+func webhookBackoff(attempts int) time.Duration {
+    delay := webhookBaseBackoff
+    for i := 1; i < attempts; i++ {
+        delay *= 2
+        if delay >= webhookMaxBackoff {
+            return webhookMaxBackoff
+        }
+    }
+    return delay
+}
+
+// DeadWebhooks lists notifications that exhausted their delivery attempts
+func (r *Router) DeadWebhooks(ctx context.Context, limit int) ([]models.WebhookDelivery, error) {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    rows, err := r.db.QueryContext(ctx, `
+        SELECT id, event_type, url, payload, status, attempts, next_attempt_at, COALESCE(last_error, ''), created_at
+        FROM webhook_queue
+        WHERE status = ?
+        ORDER BY id DESC
+        LIMIT ?
+    `, webhookDead, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    list := []models.WebhookDelivery{}
+    for rows.Next() {
+        var d models.WebhookDelivery
+        if err := rows.Scan(&d.ID, &d.EventType, &d.URL, &d.Payload, &d.Status,
+            &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.CreatedAt); err != nil {
+            return nil, err
+        }
+        list = append(list, d)
+    }
+    return list, rows.Err()
+}
+
+// RetryDeadWebhook puts a dead-lettered notification back in the queue
+func (r *Router) RetryDeadWebhook(ctx context.Context, id int64) error {
+    ctx, cancel := r.dbContext(ctx)
+    defer cancel()
+    result, err := r.db.ExecContext(ctx, `
+        UPDATE webhook_queue
+        SET status = ?, attempts = 0, next_attempt_at = NOW()
+        WHERE id = ? AND status = ?
+    `, webhookPending, id, webhookDead)
+    if err != nil {
+        return err
+    }
+
+    rows, _ := result.RowsAffected()
+    if rows == 0 {
+        return fmt.Errorf("no dead webhook with id %d", id)
+    }
+    return nil
+}
+
+func truncate(s string, n int) string {
+    if len(s) > n {
+        return s[:n]
+    }
+    return s
+}
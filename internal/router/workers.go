@@ -0,0 +1,191 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "runtime/debug"
+    "sort"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+var (
+    workerPanics = metrics.NewCounter("s2_worker_panics_total",
+        "Panics recovered in background workers", "worker")
+    workerErrors = metrics.NewCounter("s2_worker_errors_total",
+        "Background worker runs that returned an error", "worker")
+    workerDuration = metrics.NewHistogram("s2_worker_run_duration_seconds",
+        "Time taken by one background worker run", nil, "worker")
+)
+
+// WorkerStatus reports the health of one background goroutine
+type WorkerStatus struct {
+    Name         string     `json:"name"`
+    Running      bool       `json:"running"`
+    Interval     string     `json:"interval"`
+    Runs         int64      `json:"runs"`
+    InRun        bool       `json:"in_run"`
+    Stuck        bool       `json:"stuck"`
+    LastRunAt    *time.Time `json:"last_run_at,omitempty"`
+    LastDuration string     `json:"last_duration,omitempty"`
+    Errors       int        `json:"errors"`
+    LastError    string     `json:"last_error,omitempty"`
+    LastErrorAt  *time.Time `json:"last_error_at,omitempty"`
+    Panics       int        `json:"panics"`
+    LastPanic    string     `json:"last_panic,omitempty"`
+    LastPanicAt  *time.Time `json:"last_panic_at,omitempty"`
+
+    interval time.Duration
+    runStart time.Time
+}
+
+// A worker that panicked this recently is reported as unhealthy
+const workerPanicGrace = 5 * time.Minute
+
+// A run lasting this many intervals (and at least workerStuckMin) is stuck
+const (
+    workerStuckIntervals = 3
+    workerStuckMin       = time.Minute
+)
+
+// startWorker runs fn every interval in a goroutine owned by the router's
+// lifecycle group, so Close ends it. Each run is guarded so a panic is
+// reported and the next tick still fires, instead of silently killing
+// background maintenance forever.
+func (r *Router) startWorker(name string, interval time.Duration, fn func() error) {
+    r.workersMu.Lock()
+    r.workers[name] = &WorkerStatus{Name: name, Running: true, Interval: interval.String(), interval: interval}
+    r.workersMu.Unlock()
+
+    r.life.Go(name, func(ctx context.Context) error {
+        defer func() {
+            // Only reachable if the loop itself panics; record it so health shows it
+            if rec := recover(); rec != nil {
+                r.recordPanic(name, rec)
+            }
+            r.workersMu.Lock()
+            r.workers[name].Running = false
+            r.workersMu.Unlock()
+        }()
+
+        ticker := r.clock.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ctx.Done():
+                return nil
+            case <-ticker.C():
+                r.runGuarded(name, fn)
+            }
+        }
+    })
+}
+
+// runGuarded calls fn, recording its timing and outcome and recovering any panic
+func (r *Router) runGuarded(name string, fn func() error) {
+    start := r.clock.Now()
+    r.workersMu.Lock()
+    if st, ok := r.workers[name]; ok {
+        st.InRun = true
+        st.runStart = start
+    }
+    r.workersMu.Unlock()
+
+    var err error
+    defer func() {
+        if rec := recover(); rec != nil {
+            r.recordPanic(name, rec)
+        }
+        r.finishRun(name, start, err)
+    }()
+    err = fn()
+}
+
+func (r *Router) finishRun(name string, start time.Time, err error) {
+    elapsed := r.since(start)
+    workerDuration.Observe(elapsed.Seconds(), name)
+    if err != nil {
+        workerErrors.Inc(name)
+    }
+
+    now := r.clock.Now()
+    r.workersMu.Lock()
+    defer r.workersMu.Unlock()
+    st, ok := r.workers[name]
+    if !ok {
+        return
+    }
+    st.InRun = false
+    st.Runs++
+    st.LastRunAt = &now
+    st.LastDuration = elapsed.String()
+    if err != nil {
+        st.Errors++
+        st.LastError = err.Error()
+        st.LastErrorAt = &now
+    }
+}
+
+func (r *Router) recordPanic(name string, rec interface{}) {
+    logger.Warnf("ALERT: worker %s panicked: %v\n%s", name, rec, debug.Stack())
+    workerPanics.Inc(name)
+
+    now := r.clock.Now()
+    r.workersMu.Lock()
+    defer r.workersMu.Unlock()
+    if st, ok := r.workers[name]; ok {
+        st.Panics++
+        st.LastPanic = fmt.Sprint(rec)
+        st.LastPanicAt = &now
+    }
+}
+
+// stuck reports whether the current run has gone on far longer than the
+// worker's interval. Caller must hold r.workersMu.
+func (st *WorkerStatus) stuck(now time.Time) bool {
+    if !st.InRun {
+        return false
+    }
+    limit := workerStuckIntervals * st.interval
+    if limit < workerStuckMin {
+        limit = workerStuckMin
+    }
+    return now.Sub(st.runStart) > limit
+}
+
+// WorkerHealth returns a snapshot of every background worker and whether
+// they are all healthy
+func (r *Router) WorkerHealth() ([]WorkerStatus, bool) {
+    r.workersMu.Lock()
+    defer r.workersMu.Unlock()
+
+    now := r.clock.Now()
+    healthy := true
+    list := make([]WorkerStatus, 0, len(r.workers))
+    for _, st := range r.workers {
+        st.Stuck = st.stuck(now)
+        if !st.Running || st.Stuck || (st.LastPanicAt != nil && now.Sub(*st.LastPanicAt) < workerPanicGrace) {
+            healthy = false
+        }
+        list = append(list, *st)
+    }
+    if r.ami != nil {
+        st := r.ami.Status()
+        if !st.Connected {
+            healthy = false
+        }
+        list = append(list, WorkerStatus{
+            Name:        "ami",
+            Running:     st.Connected,
+            Runs:        st.Events,
+            LastRunAt:   st.LastEventAt,
+            Errors:      st.Failures,
+            LastError:   st.LastError,
+            LastErrorAt: st.LastErrorAt,
+        })
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list, healthy
+}
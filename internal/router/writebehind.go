@@ -0,0 +1,342 @@
+package router
+
+import (
+    "context"
+    "hash/fnv"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// With WriteBehindWorkers set, call state writes are handed to a pool of
+// writers instead of being made on the signaling path. A call always goes
+// to the same writer, which applies its writes one at a time in the order
+// they were made, so the per-call ordering of stateWrite holds. A write
+// that fails goes on to the retry queue as before. When a writer's buffer
+// stays full for writeBehindWait the write is dropped and reported as
+// unreconciled. Close flushes the buffers before the last retry.
+//
+// With WriteBatchInterval set as well, a writer gathers what arrives over
+// that tick and writes it in rounds of at most one write per call: the
+// records of a round in one multi-row insert, its status changes and
+// hangup causes in one update per distinct value. A round the database
+// fails is queued for retry whole; one it rejects is written row by row
+// so only the offending write is given up.
+const (
+    writeBehindWait     = 50 * time.Millisecond
+    writeBehindFlushTTL = 5 * time.Second // left over writes go to the retry queue untried
+    writeBatchMax       = 500             // writes gathered per tick
+)
+
+var (
+    writeBehindDepth = metrics.NewGauge("s2_write_behind_pending",
+        "Call state writes buffered for the write-behind writers")
+    writeBehindDrops = metrics.NewCounter("s2_write_behind_dropped_total",
+        "Call state writes dropped because the write-behind buffer was full", "write")
+    writeBatchRows = metrics.NewHistogram("s2_write_batch_rows",
+        "Calls written per batched call state statement", []float64{1, 2, 5, 10, 20, 50, 100, 200, 500}, "write")
+)
+
+// writeBehind is the writer pool and the writes it holds
+type writeBehind struct {
+    shards []chan *FailedWrite
+    done   sync.WaitGroup
+
+    mu      sync.RWMutex // held for reading while a write is handed over
+    closed  bool
+    flushed chan struct{} // closed once the writers have exited
+    flushBy atomic.Int64  // UnixNano deadline set by Close, read by the writers
+
+    count   sync.Mutex
+    calls   map[string]int // buffered writes per call
+    pending int
+}
+
+// startWriteBehind starts the writers. They leave the lifecycle group
+// alone and stop when Close flushes them.
+func (r *Router) startWriteBehind(workers, buffer int, batch time.Duration) {
+    if buffer <= 0 {
+        buffer = 10000
+    }
+    wb := &writeBehind{flushed: make(chan struct{}), calls: make(map[string]int)}
+    for i := 0; i < workers; i++ {
+        ch := make(chan *FailedWrite, buffer)
+        wb.shards = append(wb.shards, ch)
+        wb.done.Add(1)
+        go func() {
+            defer wb.done.Done()
+            if batch <= 0 {
+                for w := range ch {
+                    r.writeBehindApply([]*FailedWrite{w})
+                }
+                return
+            }
+            for w := range ch {
+                r.writeBehindApply(gatherWrites(ch, w, batch))
+            }
+        }()
+    }
+    r.writeBehind = wb
+    if batch > 0 {
+        logger.Infof("Writing call state behind %d writers, %d writes buffered each, batched every %s", workers, buffer, batch)
+    } else {
+        logger.Infof("Writing call state behind %d writers, %d writes buffered each", workers, buffer)
+    }
+}
+
+// gatherWrites collects what follows first on ch within one tick, up to
+// writeBatchMax
+func gatherWrites(ch chan *FailedWrite, first *FailedWrite, tick time.Duration) []*FailedWrite {
+    batch := []*FailedWrite{first}
+    timer := time.NewTimer(tick)
+    defer timer.Stop()
+    for len(batch) < writeBatchMax {
+        select {
+        case w, ok := <-ch:
+            if !ok {
+                return batch
+            }
+            batch = append(batch, w)
+        case <-timer.C:
+            return batch
+        }
+    }
+    return batch
+}
+
+// deferWrite hands w to its call's writer; false means the pool is
+// closed and the caller must write it itself
+func (r *Router) deferWrite(ctx context.Context, w *FailedWrite) bool {
+    wb := r.writeBehind
+    wb.mu.RLock()
+    if wb.closed {
+        wb.mu.RUnlock()
+        <-wb.flushed
+        return false
+    }
+    defer wb.mu.RUnlock()
+
+    h := fnv.New32a()
+    h.Write([]byte(w.CallID))
+    ch := wb.shards[h.Sum32()%uint32(len(wb.shards))]
+    wb.track(w.CallID, 1)
+    select {
+    case ch <- w:
+        return true
+    default:
+    }
+
+    timer := time.NewTimer(writeBehindWait)
+    defer timer.Stop()
+    select {
+    case ch <- w:
+        return true
+    case <-timer.C:
+    case <-ctx.Done():
+    }
+    wb.track(w.CallID, -1)
+    writeBehindDrops.Inc(w.Write)
+    w.Error = "write-behind buffer full"
+    logger.Call(w.CallID, "", "").Context(ctx).Errorf("Dropped %s write of call %s: write-behind buffer full", w.Write, w.CallID)
+    r.giveUpWrite(w, "write-behind buffer full")
+    return true
+}
+
+// writeBehindApply makes buffered writes, or past the flush deadline
+// queues them for the final retry
+func (r *Router) writeBehindApply(batch []*FailedWrite) {
+    wb := r.writeBehind
+    defer func() {
+        for _, w := range batch {
+            wb.track(w.CallID, -1)
+        }
+    }()
+    if flushBy := wb.flushBy.Load(); flushBy != 0 && r.clock.Now().UnixNano() > flushBy {
+        for _, w := range batch {
+            stateWrites.Inc(w.Write, "queued")
+            if evicted := r.writes.queue(w); evicted != nil {
+                r.giveUpWrite(evicted, "retry queue full")
+            }
+        }
+        return
+    }
+
+    // A call's second write starts a new round, so it lands after its first
+    var round []*FailedWrite
+    seen := make(map[string]bool)
+    for _, w := range batch {
+        if seen[w.CallID] {
+            r.writeRound(round)
+            round, seen = nil, make(map[string]bool)
+        }
+        seen[w.CallID] = true
+        round = append(round, w)
+    }
+    r.writeRound(round)
+}
+
+// writeRound writes calls that have one write each. A call with earlier
+// writes queued for retry goes behind them, through writeNow.
+func (r *Router) writeRound(round []*FailedWrite) {
+    if len(round) == 1 {
+        r.writeNow(context.Background(), round[0])
+        return
+    }
+    var records []*FailedWrite
+    statuses := make(map[models.CallState][]*FailedWrite)
+    causes := make(map[string][]*FailedWrite)
+    for _, w := range round {
+        switch {
+        case r.writes.behind(w.CallID):
+            r.writeNow(context.Background(), w)
+        case w.Write == writeRecord:
+            records = append(records, w)
+        case w.Write == writeStatus:
+            statuses[w.Status] = append(statuses[w.Status], w)
+        case w.Write == writeHangupCause:
+            causes[w.HangupCause] = append(causes[w.HangupCause], w)
+        default:
+            r.writeNow(context.Background(), w)
+        }
+    }
+
+    if len(records) > 0 {
+        r.writeBatch(writeRecord, records, func(ctx context.Context) error {
+            list := make([]*models.CallRecord, len(records))
+            for i, w := range records {
+                list[i] = w.record
+            }
+            return r.store.StoreCallRecords(ctx, list)
+        })
+    }
+    for status, writes := range statuses {
+        status, writes := status, writes
+        r.writeBatch(writeStatus, writes, func(ctx context.Context) error {
+            return r.store.UpdateCallStatuses(ctx, callIDsOf(writes), status)
+        })
+    }
+    for cause, writes := range causes {
+        cause, writes := cause, writes
+        r.writeBatch(writeHangupCause, writes, func(ctx context.Context) error {
+            return r.store.RecordHangupCauses(ctx, callIDsOf(writes), cause)
+        })
+    }
+}
+
+// writeBatch runs one multi-row statement for writes. If the database
+// rejects it each write is made on its own; if it failed, they are all
+// queued for retry.
+func (r *Router) writeBatch(kind string, writes []*FailedWrite, write func(ctx context.Context) error) {
+    if len(writes) == 1 {
+        r.writeNow(context.Background(), writes[0])
+        return
+    }
+    writeBatchRows.Observe(float64(len(writes)), kind)
+    err := write(context.Background())
+    if err == nil {
+        return
+    }
+    if permanentWriteError(err) {
+        logger.Warnf("Batched %s write of %d calls rejected, writing them one by one: %v", kind, len(writes), err)
+        for _, w := range writes {
+            r.writeNow(context.Background(), w)
+        }
+        return
+    }
+    logger.Errorf("Batched %s write of %d calls failed, queued for retry: %v", kind, len(writes), err)
+    for _, w := range writes {
+        w.Attempts, w.Error = 1, err.Error()
+        stateWrites.Inc(w.Write, "queued")
+        if evicted := r.writes.queue(w); evicted != nil {
+            r.giveUpWrite(evicted, "retry queue full")
+        }
+    }
+}
+
+func callIDsOf(writes []*FailedWrite) []string {
+    callIDs := make([]string, len(writes))
+    for i, w := range writes {
+        callIDs[i] = w.CallID
+    }
+    return callIDs
+}
+
+// flushWriteBehind stops taking writes and waits for the writers to
+// empty their buffers
+func (r *Router) flushWriteBehind() {
+    wb := r.writeBehind
+    if wb == nil {
+        return
+    }
+    wb.mu.Lock()
+    if wb.closed {
+        wb.mu.Unlock()
+        return
+    }
+    wb.closed = true
+    wb.flushBy.Store(r.clock.Now().Add(writeBehindFlushTTL).UnixNano())
+    for _, ch := range wb.shards {
+        close(ch)
+    }
+    wb.mu.Unlock()
+
+    if n := wb.size(); n > 0 {
+        logger.Infof("Flushing %d buffered call state writes", n)
+    }
+    wb.done.Wait()
+    close(wb.flushed)
+}
+
+// track counts writes buffered for a call
+func (wb *writeBehind) track(callID string, n int) {
+    wb.count.Lock()
+    defer wb.count.Unlock()
+    if wb.calls[callID] += n; wb.calls[callID] <= 0 {
+        delete(wb.calls, callID)
+    }
+    wb.pending += n
+    writeBehindDepth.Set(float64(wb.pending))
+}
+
+// buffered reports whether a call has writes its writer has not made yet
+func (wb *writeBehind) buffered(callID string) bool {
+    if wb == nil {
+        return false
+    }
+    wb.count.Lock()
+    defer wb.count.Unlock()
+    return wb.calls[callID] > 0
+}
+
+func (wb *writeBehind) size() int {
+    if wb == nil {
+        return 0
+    }
+    wb.count.Lock()
+    defer wb.count.Unlock()
+    return wb.pending
+}
+
+// writesPending reports whether the database is behind a call, its writes
+// buffered or queued for retry
+func (r *Router) writesPending(callID string) bool {
+    return r.writeBehind.buffered(callID) || r.writes.behind(callID)
+}
+
+// WriteBehindStatus reports the buffered writes per writer, nil when
+// writes are made on the signaling path
+func (r *Router) WriteBehindStatus() map[string]int {
+    wb := r.writeBehind
+    if wb == nil {
+        return nil
+    }
+    status := map[string]int{"pending": wb.size()}
+    for i, ch := range wb.shards {
+        status["writer_"+strconv.Itoa(i)] = len(ch)
+    }
+    return status
+}
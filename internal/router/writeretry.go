@@ -0,0 +1,395 @@
+package router
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/go-sql-driver/mysql"
+
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+    "github.com/asterisk-call-routing-v2/internal/models"
+)
+
+// Call state writes (the call record, its status changes, hangup cause and
+// the release of its DID) that fail are queued and retried in order until
+// the database takes them, rather than logged and lost. Writes for a call
+// queue behind any of its earlier writes still pending, so a status change
+// never lands before the record it updates, and a DID is only released
+// after the call's final status. A release only frees the DID while no
+// other in-flight call holds it, and is kept when the call's record is
+// given up, since the DID stays in use without it. A write is given up, and reported as
+// unreconciled, when the database rejects it outright, when it has been
+// retried for WriteRetryMaxAge, when the queue is full or when the router
+// shuts down with it still pending. The report is kept in memory and, with
+// WriteReportFile set, appended to that file as JSON lines.
+const (
+    writeRecord      = "record"
+    writeStatus      = "status"
+    writeHangupCause = "hangup_cause"
+    writeReleaseDID  = "release_did"
+)
+
+const (
+    writeRetryInterval = 5 * time.Second
+    writeRetryLimit    = 10000 // writes queued before the oldest are given up, by default
+    writeReportKeep    = 1000  // unreconciled writes kept in memory
+)
+
+// MySQL errors that are worth retrying although the server answered
+const (
+    mysqlLockWaitTimeout = 1205
+    mysqlDeadlock        = 1213
+)
+
+var (
+    stateWrites = metrics.NewCounter("s2_state_write_retries_total",
+        "Call state writes by kind and outcome (queued, reconciled or unreconciled)", "write", "result")
+    stateWritesPending = metrics.NewGauge("s2_state_writes_pending",
+        "Failed call state writes waiting to be retried")
+)
+
+// FailedWrite is a call state write the database did not take
+type FailedWrite struct {
+    CallID      string           `json:"call_id"`
+    Write       string           `json:"write"` // record, status, hangup_cause or release_did
+    Status      models.CallState `json:"status,omitempty"`
+    HangupCause string           `json:"hangup_cause,omitempty"`
+    DID         string           `json:"did,omitempty"`
+    At          time.Time        `json:"at"` // when the write was first tried
+    Attempts    int              `json:"attempts"`
+    Error       string           `json:"error"`
+    GaveUpAt    *time.Time       `json:"gave_up_at,omitempty"`
+    Reason      string           `json:"reason,omitempty"` // why it was given up
+
+    record *models.CallRecord // copy taken when the write was made
+}
+
+// WriteReport is the state of failed call state writes
+type WriteReport struct {
+    Pending      []FailedWrite `json:"pending"`
+    Reconciled   int64         `json:"reconciled"`
+    Unreconciled []FailedWrite `json:"unreconciled"`
+}
+
+// writeRetry is the queue of failed writes and the unreconciled report
+type writeRetry struct {
+    mu           sync.Mutex
+    pending      []*FailedWrite
+    calls        map[string]int // pending writes per call
+    limit        int
+    reconciled   int64
+    unreconciled []FailedWrite
+}
+
+// storeCallRecord writes a new call record
+func (r *Router) storeCallRecord(ctx context.Context, record *models.CallRecord) {
+    snapshot := *record
+    r.stateWrite(ctx, &FailedWrite{CallID: record.CallID, Write: writeRecord, Status: record.Status, record: &snapshot})
+}
+
+// updateCallStatus writes a call's status change
+func (r *Router) updateCallStatus(ctx context.Context, callID string, status models.CallState) {
+    r.stateWrite(ctx, &FailedWrite{CallID: callID, Write: writeStatus, Status: status})
+}
+
+// recordHangupCause writes the Q.850 cause a call ended with
+func (r *Router) recordHangupCause(ctx context.Context, callID, cause string) {
+    r.stateWrite(ctx, &FailedWrite{CallID: callID, Write: writeHangupCause, HangupCause: cause})
+}
+
+// releaseDID frees the DID an ended call held. It goes through the call's
+// writer like the call's other writes, so the DID is only free for another
+// call once the database has this one ended and a late hangup finds
+// nothing in flight to end again.
+func (r *Router) releaseDID(ctx context.Context, callID, did string) {
+    r.stateWrite(ctx, &FailedWrite{CallID: callID, Write: writeReleaseDID, DID: did})
+}
+
+// stateWrite hands w to the write-behind writers, or makes it now
+func (r *Router) stateWrite(ctx context.Context, w *FailedWrite) {
+    w.At = r.clock.Now()
+    if r.writeBehind != nil && r.deferWrite(ctx, w) {
+        return
+    }
+    r.writeNow(ctx, w)
+}
+
+// writeNow applies w, or queues it if it fails or the call already has
+// writes waiting
+func (r *Router) writeNow(ctx context.Context, w *FailedWrite) {
+    if !r.writes.behind(w.CallID) {
+        err := r.applyWrite(ctx, w, false)
+        if err == nil {
+            return
+        }
+        w.Attempts, w.Error = 1, err.Error()
+        if permanentWriteError(err) {
+            logger.Call(w.CallID, "", "").Context(ctx).Errorf("Failed to write %s of call %s: %v", w.Write, w.CallID, err)
+            r.giveUpWrite(w, "rejected by the database")
+            return
+        }
+        logger.Call(w.CallID, "", "").Context(ctx).Errorf("Failed to write %s of call %s, queued for retry: %v", w.Write, w.CallID, err)
+    }
+    stateWrites.Inc(w.Write, "queued")
+    if evicted := r.writes.queue(w); evicted != nil {
+        r.giveUpWrite(evicted, "retry queue full")
+    }
+}
+
+// applyWrite makes one attempt at w; replay is set for a queued write
+func (r *Router) applyWrite(ctx context.Context, w *FailedWrite, replay bool) error {
+    switch w.Write {
+    case writeRecord:
+        return r.store.StoreCallRecord(ctx, w.record)
+    case writeStatus:
+        if err := r.store.UpdateCallStatus(ctx, w.CallID, w.Status); err != nil || !replay {
+            return err
+        }
+        // A replayed final status would otherwise end the call when the
+        // database came back, not when it ended
+        if w.Status == models.CallStateCompleted || w.Status == models.CallStateFailed {
+            return r.store.BackdateCallEnd(ctx, w.CallID, w.At)
+        }
+        return nil
+    case writeHangupCause:
+        return r.store.RecordHangupCause(ctx, w.CallID, w.HangupCause)
+    case writeReleaseDID:
+        // The DID may have been reaped and claimed again, e.g. while this
+        // release waited for retry
+        released, err := r.store.ReleaseDID(ctx, w.DID, w.CallID)
+        if err != nil {
+            return err
+        }
+        if !released {
+            logger.Call(w.CallID, w.DID, "").Context(ctx).Infof("DID %s of call %s is held by another call, left in use", w.DID, w.CallID)
+            return nil
+        }
+        r.didQueue.notify()
+        return nil
+    }
+    return fmt.Errorf("unknown write %q", w.Write)
+}
+
+// permanentWriteError reports whether the database rejected a write, so
+// retrying it would fail the same way
+func permanentWriteError(err error) bool {
+    var mysqlErr *mysql.MySQLError
+    return errors.As(err, &mysqlErr) && mysqlErr.Number != mysqlLockWaitTimeout && mysqlErr.Number != mysqlDeadlock
+}
+
+// retryWrites replays the queued writes in order. It stops at the first
+// one that fails again, since the database is most likely still down.
+func (r *Router) retryWrites() error {
+    for {
+        w := r.writes.next()
+        if w == nil {
+            return nil
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), writeRetryInterval)
+        err := r.applyWrite(ctx, w, true)
+        cancel()
+        if err == nil {
+            r.writes.done(w, true)
+            stateWrites.Inc(w.Write, "reconciled")
+            continue
+        }
+
+        r.writes.failed(w, err)
+        if permanentWriteError(err) {
+            r.writes.done(w, false)
+            r.giveUpWrite(w, "rejected by the database")
+            continue
+        }
+        if maxAge := r.config.WriteRetryMaxAge; maxAge > 0 && r.since(w.At) > maxAge {
+            r.writes.done(w, false)
+            r.giveUpWrite(w, fmt.Sprintf("still failing after %s", maxAge))
+            continue
+        }
+        return fmt.Errorf("%d call state writes pending: %w", r.writes.size(), err)
+    }
+}
+
+// abandonWrites makes a last attempt at the queued writes when the
+// router closes and reports whatever is still pending
+func (r *Router) abandonWrites() {
+    if r.writes.size() == 0 {
+        return
+    }
+    if err := r.retryWrites(); err != nil {
+        logger.Errorf("Giving up on call state writes at shutdown: %v", err)
+    }
+    for w := r.writes.next(); w != nil; w = r.writes.next() {
+        r.writes.done(w, false)
+        r.giveUpWrite(w, "router shut down")
+    }
+}
+
+// giveUpWrite reports w as unreconciled, along with every later write
+// queued for the same call, which would not land right without it
+func (r *Router) giveUpWrite(w *FailedWrite, reason string) {
+    now := r.clock.Now()
+    given := []*FailedWrite{w}
+    if w.Write == writeRecord {
+        given = append(given, r.writes.dropCall(w.CallID)...)
+    }
+    for i, g := range given {
+        g.GaveUpAt, g.Reason = &now, reason
+        if i > 0 {
+            g.Reason = "call record was not written"
+        }
+        stateWrites.Inc(g.Write, "unreconciled")
+        logger.Call(g.CallID, "", "").Errorf("UNRECONCILED: %s write of call %s given up (%s) after %d attempts: %s",
+            g.Write, g.CallID, g.Reason, g.Attempts, g.Error)
+        r.writes.report(*g)
+        r.appendWriteReport(*g)
+    }
+}
+
+// appendWriteReport adds an unreconciled write to WriteReportFile
+func (r *Router) appendWriteReport(w FailedWrite) {
+    path := r.config.WriteReportFile
+    if path == "" {
+        return
+    }
+    line, err := json.Marshal(w)
+    if err != nil {
+        return
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        logger.Errorf("Failed to write unreconciled write report %s: %v", path, err)
+        return
+    }
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+    if err != nil {
+        logger.Errorf("Failed to write unreconciled write report %s: %v", path, err)
+        return
+    }
+    defer f.Close()
+    if _, err := f.Write(append(line, '\n')); err != nil {
+        logger.Errorf("Failed to write unreconciled write report %s: %v", path, err)
+    }
+}
+
+// WriteReport lists the failed writes still being retried, how many were
+// reconciled and the most recent ones given up on, oldest first
+func (r *Router) WriteReport() WriteReport {
+    q := &r.writes
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    report := WriteReport{
+        Pending:      make([]FailedWrite, 0, len(q.pending)),
+        Reconciled:   q.reconciled,
+        Unreconciled: append([]FailedWrite{}, q.unreconciled...),
+    }
+    for _, w := range q.pending {
+        report.Pending = append(report.Pending, *w)
+    }
+    return report
+}
+
+// behind reports whether a call has writes waiting to be retried
+func (q *writeRetry) behind(callID string) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.calls[callID] > 0
+}
+
+// queue appends w, returning the oldest write if the queue overflowed
+func (q *writeRetry) queue(w *FailedWrite) *FailedWrite {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.calls == nil {
+        q.calls = make(map[string]int)
+    }
+    q.pending = append(q.pending, w)
+    q.calls[w.CallID]++
+    var evicted *FailedWrite
+    if len(q.pending) > q.limit {
+        evicted = q.pending[0]
+        q.remove(0)
+    }
+    stateWritesPending.Set(float64(len(q.pending)))
+    return evicted
+}
+
+// next is the oldest queued write, nil if there is none
+func (q *writeRetry) next() *FailedWrite {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if len(q.pending) == 0 {
+        return nil
+    }
+    return q.pending[0]
+}
+
+// done takes w off the queue
+func (q *writeRetry) done(w *FailedWrite, reconciled bool) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for i, p := range q.pending {
+        if p == w {
+            q.remove(i)
+            break
+        }
+    }
+    if reconciled {
+        q.reconciled++
+    }
+    stateWritesPending.Set(float64(len(q.pending)))
+}
+
+// failed records another failed attempt at w
+func (q *writeRetry) failed(w *FailedWrite, err error) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    w.Attempts++
+    w.Error = err.Error()
+}
+
+// dropCall takes every queued write of a call but its DID release off
+// the queue
+func (q *writeRetry) dropCall(callID string) []*FailedWrite {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    var dropped []*FailedWrite
+    for i := 0; i < len(q.pending); {
+        if q.pending[i].CallID == callID && q.pending[i].Write != writeReleaseDID {
+            dropped = append(dropped, q.pending[i])
+            q.remove(i)
+            continue
+        }
+        i++
+    }
+    stateWritesPending.Set(float64(len(q.pending)))
+    return dropped
+}
+
+// remove deletes pending[i]. Caller must hold q.mu.
+func (q *writeRetry) remove(i int) {
+    w := q.pending[i]
+    q.pending = append(q.pending[:i], q.pending[i+1:]...)
+    if q.calls[w.CallID]--; q.calls[w.CallID] <= 0 {
+        delete(q.calls, w.CallID)
+    }
+}
+
+func (q *writeRetry) report(w FailedWrite) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.unreconciled = append(q.unreconciled, w)
+    if len(q.unreconciled) > writeReportKeep {
+        q.unreconciled = q.unreconciled[len(q.unreconciled)-writeReportKeep:]
+    }
+}
+
+func (q *writeRetry) size() int {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return len(q.pending)
+}
@@ -0,0 +1,65 @@
+package router
+
+import (
+    "context"
+    "fmt"
+    "testing"
+)
+
+// With the write-behind writers on, an ended call's DID is released by its
+// writer after its final status, not ahead of it on the signaling path
+func TestReleaseFollowsFinalStatus(t *testing.T) {
+    store := newFakeStorage(fakeDIDs(1)...)
+    r := newTestRouter(t, store, Config{})
+    r.startWriteBehind(1, 100, 0)
+    ctx := context.Background()
+
+    resp, err := r.ProcessIncomingCall(ctx, "wb-1", "12125550001", "442070000001", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.CompleteCall(ctx, "wb-1", "16"); err != nil {
+        t.Fatal(err)
+    }
+    r.flushWriteBehind()
+
+    writes := store.landed()
+    want := []string{"status wb-1 FORWARDED_TO_S3", "status wb-1 FAILED", "release wb-1 " + resp.DIDAssigned}
+    if fmt.Sprint(writes) != fmt.Sprint(want) {
+        t.Fatalf("writes landed as %q, want %q", writes, want)
+    }
+}
+
+// A late release, e.g. from an AMI hangup for a call ended already, leaves
+// a DID another call has claimed since in use
+func TestLateReleaseKeepsReclaimedDID(t *testing.T) {
+    store := newFakeStorage(fakeDIDs(1)...)
+    r := newTestRouter(t, store, Config{})
+    ctx := context.Background()
+
+    first, err := r.ProcessIncomingCall(ctx, "late-1", "12125550001", "442070000001", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := r.CompleteCall(ctx, "late-1", "16"); err != nil {
+        t.Fatal(err)
+    }
+    second, err := r.ProcessIncomingCall(ctx, "late-2", "12125550002", "442070000002", IncomingOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if second.DIDAssigned != first.DIDAssigned {
+        t.Fatalf("second call got %s, not the only DID %s", second.DIDAssigned, first.DIDAssigned)
+    }
+
+    r.releaseDID(ctx, "late-1", first.DIDAssigned)
+    if !store.inUse(second.DIDAssigned) {
+        t.Fatalf("late release of late-1 freed DID %s held by late-2", second.DIDAssigned)
+    }
+    if _, err := r.CompleteCall(ctx, "late-1", "16"); err == nil {
+        t.Fatal("ended call late-1 completed twice")
+    }
+    if !store.inUse(second.DIDAssigned) {
+        t.Fatalf("second hangup of late-1 freed DID %s held by late-2", second.DIDAssigned)
+    }
+}
@@ -0,0 +1,380 @@
+package tracing
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/asterisk-call-routing-v2/internal/logging"
+    "github.com/asterisk-call-routing-v2/internal/metrics"
+)
+
+var logger = logging.New("trace")
+
+// Trace context travels between the servers as W3C Trace Context values.
+// S1 hands its own traceparent (and optional baggage) to /api/processIncoming;
+// S2 answers with a traceparent naming its routing span. The dialplan must copy
+// the returned values onto the next hop unchanged:
+//
+//	S1 -> S2   traceparent / baggage query params (or HTTP headers)
+//	S2 -> S3   "traceparent" and "baggage" SIP headers on the INVITE to S3
+//	S3 -> S2   S3 returns the SIP headers on its call back into S2, which
+//	           passes them to /api/processReturn
+//	S2 -> S4   "traceparent" and "baggage" SIP headers on the INVITE to S4
+//
+// With the headers copied at every hop, each server's spans share one trace
+// ID and nest under the span of the hop before it, so the whole S1->S4 path
+// shows up as a single trace in Jaeger.
+const (
+    HeaderTraceparent = "traceparent"
+    HeaderBaggage     = "baggage"
+)
+
+// Spans waiting for export; beyond this new spans are dropped
+const maxQueuedSpans = 4096
+
+var (
+    spansExported = metrics.NewCounter("s2_trace_spans_exported_total", "Spans delivered to the trace collector")
+    spansDropped  = metrics.NewCounter("s2_trace_spans_dropped_total", "Spans dropped because the export queue was full or the collector failed")
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+    TraceID [16]byte
+    SpanID  [8]byte
+    Sampled bool
+}
+
+// Valid reports whether the context has non-zero trace and span IDs
+func (sc SpanContext) Valid() bool {
+    return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceIDString is the trace ID as 32 hex digits
+func (sc SpanContext) TraceIDString() string {
+    return hex.EncodeToString(sc.TraceID[:])
+}
+
+// Traceparent renders the version 00 traceparent header value
+func (sc SpanContext) Traceparent() string {
+    if !sc.Valid() {
+        return ""
+    }
+    flags := "00"
+    if sc.Sampled {
+        flags = "01"
+    }
+    return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent decodes a traceparent header value. Unknown future
+// versions are accepted as long as the version 00 fields parse.
+func ParseTraceparent(v string) (SpanContext, bool) {
+    var sc SpanContext
+    parts := strings.Split(strings.TrimSpace(v), "-")
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+        return sc, false
+    }
+    if parts[0] == "00" && len(parts) != 4 {
+        return sc, false
+    }
+    if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+        return sc, false
+    }
+    if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+        return SpanContext{}, false
+    }
+    if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+        return SpanContext{}, false
+    }
+    flags, err := strconv.ParseUint(parts[3], 16, 8)
+    if err != nil || !sc.Valid() {
+        return SpanContext{}, false
+    }
+    sc.Sampled = flags&1 == 1
+    return sc, true
+}
+
+// MergeBaggage adds key=value members to a baggage header value, replacing
+// members with the same key and keeping everything else S1 sent
+func MergeBaggage(baggage string, kv ...string) string {
+    set := make(map[string]bool, len(kv)/2)
+    var members []string
+    for i := 0; i+1 < len(kv); i += 2 {
+        if kv[i+1] == "" {
+            continue
+        }
+        set[kv[i]] = true
+        members = append(members, kv[i]+"="+kv[i+1])
+    }
+    for _, m := range strings.Split(baggage, ",") {
+        m = strings.TrimSpace(m)
+        if m == "" {
+            continue
+        }
+        key := strings.TrimSpace(strings.SplitN(strings.SplitN(m, ";", 2)[0], "=", 2)[0])
+        if !set[key] {
+            members = append(members, m)
+        }
+    }
+    return strings.Join(members, ",")
+}
+
+// Span is one timed operation. Spans are cheap; when the tracer has no
+// collector they only exist to propagate context.
+type Span struct {
+    tracer  *Tracer
+    name    string
+    context SpanContext
+    parent  [8]byte
+    start   time.Time
+    attrs   map[string]string
+    err     error
+}
+
+// Context is the span's own context, which downstream hops should use as parent
+func (s *Span) Context() SpanContext {
+    return s.context
+}
+
+// Traceparent is the header value naming this span as the parent
+func (s *Span) Traceparent() string {
+    return s.context.Traceparent()
+}
+
+// HasParent reports whether the span continues an existing trace
+func (s *Span) HasParent() bool {
+    return s.parent != [8]byte{}
+}
+
+// Adopt moves a span that started a new trace under the given parent.
+// It is for legs whose context is only found after the span started, such
+// as a return call matched to the trace stored with its forward leg.
+func (s *Span) Adopt(traceparent string) {
+    if s.HasParent() {
+        return
+    }
+    if parent, ok := ParseTraceparent(traceparent); ok {
+        s.context.TraceID = parent.TraceID
+        s.context.Sampled = parent.Sampled
+        s.parent = parent.SpanID
+    }
+}
+
+// Elapsed is the time since the span started
+func (s *Span) Elapsed() time.Duration {
+    return time.Since(s.start)
+}
+
+// ExemplarTraceID is the trace ID to attach to metrics measured within the
+// span, "" unless the span will reach the collector
+func (s *Span) ExemplarTraceID() string {
+    return s.tracer.ExemplarTraceID(s.context)
+}
+
+func (s *Span) SetAttr(key, value string) {
+    if value != "" {
+        s.attrs[key] = value
+    }
+}
+
+func (s *Span) Attr(key string) string {
+    return s.attrs[key]
+}
+
+// End finishes the span, recording err as its status, and queues it for export
+func (s *Span) End(err error) {
+    s.err = err
+    s.tracer.finish(s, time.Now())
+}
+
+type finishedSpan struct {
+    *Span
+    end time.Time
+}
+
+// Tracer creates spans and exports sampled ones to an OTLP/HTTP collector
+// (e.g. Jaeger's http://host:4318/v1/traces) in the JSON encoding
+type Tracer struct {
+    service  string
+    endpoint string
+    client   *http.Client
+
+    mu    sync.Mutex
+    queue []finishedSpan
+}
+
+// NewTracer builds a tracer for service. An empty endpoint disables export
+// but still propagates trace context.
+func NewTracer(service, endpoint string) *Tracer {
+    return &Tracer{
+        service:  service,
+        endpoint: endpoint,
+        client:   &http.Client{Timeout: 10 * time.Second},
+    }
+}
+
+// Exporting reports whether spans are sent to a collector
+func (t *Tracer) Exporting() bool {
+    return t.endpoint != ""
+}
+
+// ExemplarTraceID returns the trace ID of sc when it is sampled and spans are
+// exported, so a metric exemplar never points at a trace nobody has
+func (t *Tracer) ExemplarTraceID(sc SpanContext) string {
+    if !t.Exporting() || !sc.Sampled || !sc.Valid() {
+        return ""
+    }
+    return sc.TraceIDString()
+}
+
+// Start begins a span under the traceparent received from the previous hop,
+// or a new sampled trace when there is none
+func (t *Tracer) Start(name, traceparent string) *Span {
+    s := &Span{
+        tracer: t,
+        name:   name,
+        start:  time.Now(),
+        attrs:  make(map[string]string),
+    }
+    if parent, ok := ParseTraceparent(traceparent); ok {
+        s.context.TraceID = parent.TraceID
+        s.context.Sampled = parent.Sampled
+        s.parent = parent.SpanID
+    } else {
+        randomID(s.context.TraceID[:])
+        s.context.Sampled = true
+    }
+    randomID(s.context.SpanID[:])
+    return s
+}
+
+func (t *Tracer) finish(s *Span, end time.Time) {
+    if !t.Exporting() || !s.context.Sampled {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if len(t.queue) >= maxQueuedSpans {
+        spansDropped.Inc()
+        return
+    }
+    t.queue = append(t.queue, finishedSpan{Span: s, end: end})
+}
+
+// Flush sends queued spans to the collector
+func (t *Tracer) Flush() error {
+    t.mu.Lock()
+    batch := t.queue
+    t.queue = nil
+    t.mu.Unlock()
+    if len(batch) == 0 {
+        return nil
+    }
+
+    body, err := json.Marshal(t.otlpPayload(batch))
+    if err != nil {
+        return err
+    }
+    resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+    if err != nil {
+        spansDropped.Add(float64(len(batch)))
+        logger.Warnf("Export of %d spans failed: %v", len(batch), err)
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        spansDropped.Add(float64(len(batch)))
+        return fmt.Errorf("trace collector returned %s", resp.Status)
+    }
+    spansExported.Add(float64(len(batch)))
+    return nil
+}
+
+// OTLP JSON encoding, limited to the fields Jaeger needs
+type otlpKeyValue struct {
+    Key   string            `json:"key"`
+    Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+    Code    int    `json:"code"` // 1 ok, 2 error
+    Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+    TraceID      string         `json:"traceId"`
+    SpanID       string         `json:"spanId"`
+    ParentSpanID string         `json:"parentSpanId,omitempty"`
+    Name         string         `json:"name"`
+    Kind         int            `json:"kind"` // 2 server
+    Start        string         `json:"startTimeUnixNano"`
+    End          string         `json:"endTimeUnixNano"`
+    Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+    Status       otlpStatus     `json:"status"`
+}
+
+func attr(key, value string) otlpKeyValue {
+    return otlpKeyValue{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+func (t *Tracer) otlpPayload(batch []finishedSpan) interface{} {
+    spans := make([]otlpSpan, 0, len(batch))
+    for _, s := range batch {
+        os := otlpSpan{
+            TraceID: hex.EncodeToString(s.context.TraceID[:]),
+            SpanID:  hex.EncodeToString(s.context.SpanID[:]),
+            Name:    s.name,
+            Kind:    2,
+            Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+            End:     strconv.FormatInt(s.end.UnixNano(), 10),
+            Status:  otlpStatus{Code: 1},
+        }
+        if s.HasParent() {
+            os.ParentSpanID = hex.EncodeToString(s.parent[:])
+        }
+        for k, v := range s.attrs {
+            os.Attributes = append(os.Attributes, attr(k, v))
+        }
+        if s.err != nil {
+            os.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+        }
+        spans = append(spans, os)
+    }
+
+    return map[string]interface{}{
+        "resourceSpans": []interface{}{
+            map[string]interface{}{
+                "resource": map[string]interface{}{
+                    "attributes": []otlpKeyValue{attr("service.name", t.service)},
+                },
+                "scopeSpans": []interface{}{
+                    map[string]interface{}{
+                        "scope": map[string]string{"name": t.service},
+                        "spans": spans,
+                    },
+                },
+            },
+        },
+    }
+}
+
+func randomID(b []byte) {
+    for {
+        if _, err := rand.Read(b); err != nil {
+            panic(fmt.Sprintf("tracing: crypto/rand failed: %v", err))
+        }
+        for _, c := range b {
+            if c != 0 {
+                return
+            }
+        }
+    }
+}
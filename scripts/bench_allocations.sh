@@ -0,0 +1,41 @@
+#!/bin/bash
+# Measure allocation throughput with CONCURRENCY calls in flight at once.
+# Each worker sends processIncoming, then hangs the call up so its DID goes
+# back to the pool; the router needs at least CONCURRENCY free DIDs and no
+# DID cooldown. Run against a router with a database of its own:
+#   ./scripts/bench_allocations.sh [CALLS] [CONCURRENCY] [URL]
+
+CALLS=${1:-5000}
+CONCURRENCY=${2:-500}
+URL=${3:-http://localhost:8001}
+OUT=$(mktemp -d)
+trap 'rm -rf "$OUT"' EXIT
+
+call() {
+    local i=$1 callid="bench-$$-$1"
+    curl -s -o "$OUT/$i.json" -w "%{time_total}\n" -H "X-API-Key: ${API_KEY:-}" \
+        "$URL/api/processIncoming?callid=$callid&ani=1555$(printf %06d "$i")&dnis=44207$(printf %06d "$i")" >> "$OUT/latency.$BASHPID"
+    curl -s -o /dev/null -X POST -H "X-API-Key: ${API_KEY:-}" "$URL/api/hangup?callid=$callid&cause=16"
+}
+export -f call
+export OUT URL API_KEY
+
+echo "Sending $CALLS calls to $URL, $CONCURRENCY at a time..."
+start=$(date +%s.%N)
+seq 1 "$CALLS" | xargs -P "$CONCURRENCY" -I{} bash -c 'call {}'
+end=$(date +%s.%N)
+
+ok=$(cat "$OUT"/*.json | jq -r 'select(.status == "success") | .call_id' 2>/dev/null | grep -c .)
+elapsed=$(echo "$end - $start" | bc)
+sort -n "$OUT"/latency.* > "$OUT/latency"
+n=$(wc -l < "$OUT/latency")
+p50=$(sed -n "$(( (n + 1) / 2 ))p" "$OUT/latency")
+p99=$(sed -n "$(( (n * 99 + 99) / 100 ))p" "$OUT/latency")
+
+echo "Allocated: $ok/$CALLS in ${elapsed}s"
+echo "Throughput: $(echo "scale=1; $CALLS / $elapsed" | bc) calls/s (each with its hangup)"
+echo "processIncoming latency: p50 ${p50}s, p99 ${p99}s"
+if [ "$ok" -ne "$CALLS" ]; then
+    echo "Refusals:"
+    cat "$OUT"/*.json | jq -r 'select(.status != "success") | .code' 2>/dev/null | sort | uniq -c
+fi
@@ -0,0 +1,27 @@
+#!/bin/bash
+# Soak the router before a release: keep it under allocation load for
+# HOURS while it checks its own invariants, and fail as soon as it halts.
+# Start the router first, alone on its own database, with the hidden soak
+# flags:
+#   bin/router -config router.yaml -soak 5s -soak-dump /tmp/soak.json
+#   ./scripts/soak.sh [HOURS] [CONCURRENCY] [URL]
+# A violation stops the router with exit code 3; the dump names the broken
+# invariant and holds the calls, indexes and goroutines at that moment.
+
+HOURS=${1:-4}
+CONCURRENCY=${2:-200}
+URL=${3:-http://localhost:8001}
+DIR=$(dirname "$0")
+
+end=$(( $(date +%s) + $(echo "$HOURS * 3600 / 1" | bc) ))
+round=0
+while [ "$(date +%s)" -lt "$end" ]; do
+    round=$((round + 1))
+    echo "Round $round:"
+    "$DIR/bench_allocations.sh" $((CONCURRENCY * 10)) "$CONCURRENCY" "$URL" | sed 's/^/  /'
+    if ! curl -sf -o /dev/null -H "X-API-Key: ${API_KEY:-}" "$URL/api/health"; then
+        echo "Router stopped answering after round $round - check its log and soak dump"
+        exit 1
+    fi
+done
+echo "Soak passed: $round rounds over ${HOURS}h"
@@ -0,0 +1,30 @@
+#!/bin/bash
+# Hammer processIncoming concurrently and verify no DID is handed to two calls.
+# Run against a router (or several sharing one database) with at least
+# CALLS free DIDs:  ./scripts/test_did_race.sh [CALLS] [URL...]
+
+CALLS=${1:-50}
+shift
+URLS=("${@:-http://localhost:8001}")
+OUT=$(mktemp -d)
+trap 'rm -rf "$OUT"' EXIT
+
+echo "Firing $CALLS concurrent incoming calls at ${URLS[*]}..."
+for i in $(seq 1 "$CALLS"); do
+    url=${URLS[$(( i % ${#URLS[@]} ))]}
+    curl -s -H "X-API-Key: ${API_KEY:-}" \
+        "$url/api/processIncoming?callid=race-$$-$i&ani=1555000$i&dnis=4420700$i" > "$OUT/$i.json" &
+done
+wait
+
+assigned=$(cat "$OUT"/*.json | jq -r 'select(.status == "success") | .did_assigned' 2>/dev/null)
+total=$(echo "$assigned" | grep -c .)
+unique=$(echo "$assigned" | sort -u | grep -c .)
+
+echo "Successful allocations: $total, distinct DIDs: $unique"
+if [ "$total" -ne "$unique" ]; then
+    echo "FAIL: DIDs assigned to more than one call:"
+    echo "$assigned" | sort | uniq -d
+    exit 1
+fi
+echo "PASS"
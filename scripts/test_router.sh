@@ -17,3 +17,25 @@ curl -s "http://localhost:8001/api/processIncoming?callid=test123&ani=1234567890
 # Test return call (this will fail without a valid DID)
 echo -e "\n4. Testing return call:"
 curl -s "http://localhost:8001/api/processReturn?ani2=0987654321&did=12125551001" | jq .
+
+# Test hangup (ends the call started in step 3 and releases its DID)
+echo -e "\n5. Testing hangup:"
+curl -s -X POST "http://localhost:8001/api/hangup?callid=test123&cause=16" | jq .
+
+# Test trace propagation (the response traceparent keeps S1's trace ID)
+echo -e "\n6. Testing trace context propagation:"
+curl -s "http://localhost:8001/api/processIncoming?callid=trace123&ani=1234567890&dnis=0987654322&traceparent=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01&baggage=s1.node%3Dedge1" | jq '{traceparent, baggage}'
+curl -s -X POST "http://localhost:8001/api/hangup?callid=trace123&cause=16" > /dev/null
+
+# Test async CDR export (queue, poll, download)
+echo -e "\n7. Testing CDR export job:"
+JOB=$(curl -s -X POST http://localhost:8001/api/exports -d "{\"from\":\"$(date +%F)\",\"format\":\"csv\"}" | jq -r .id)
+sleep 1
+curl -s "http://localhost:8001/api/exports/$JOB" | jq .
+curl -s "http://localhost:8001/api/exports/$JOB/download" | head -5
+
+# Test JSON request bodies (the + in the ANI needs no URL encoding)
+echo -e "\n8. Testing JSON request body:"
+curl -s -X POST http://localhost:8001/api/processIncoming -H "Content-Type: application/json" \
+    -d '{"callid":"json123","ani":"+441234567890","dnis":"0987654323"}' | jq .
+curl -s -X POST "http://localhost:8001/api/hangup?callid=json123&cause=16" > /dev/null